@@ -495,6 +495,61 @@ func TaskVisibilityTimestamp(timestamp int64) Tag {
 	return newInt64("queue-task-visibility-timestamp", timestamp)
 }
 
+// TaskPriority returns tag for TaskPriority
+func TaskPriority(priority int) Tag {
+	return newInt("queue-task-priority", priority)
+}
+
+// TaskPartition returns tag for TaskPartition
+func TaskPartition(partition int) Tag {
+	return newInt("queue-task-partition", partition)
+}
+
+// TaskSchedulerChild returns tag for TaskSchedulerChild
+func TaskSchedulerChild(name string) Tag {
+	return newStringTag("queue-task-scheduler-child", name)
+}
+
+// TaskCorrelationID returns tag for TaskCorrelationID
+func TaskCorrelationID(correlationID string) Tag {
+	return newStringTag("queue-task-correlation-id", correlationID)
+}
+
+// TaskQueueSize returns tag for TaskQueueSize
+func TaskQueueSize(size int) Tag {
+	return newInt("queue-task-queue-size", size)
+}
+
+// TaskProcessingLatency returns tag for TaskProcessingLatency
+func TaskProcessingLatency(latency time.Duration) Tag {
+	return newDurationTag("queue-task-processing-latency", latency)
+}
+
+// TaskMetricTags returns tag for TaskMetricTags
+func TaskMetricTags(tags map[string]string) Tag {
+	return newObjectTag("queue-task-metric-tags", tags)
+}
+
+// TaskQueueDepths returns tag for TaskQueueDepths
+func TaskQueueDepths(depths []int) Tag {
+	return newObjectTag("queue-task-queue-depths", depths)
+}
+
+// DrainEstimatedTime returns tag for DrainEstimatedTime
+func DrainEstimatedTime(estimatedTime time.Duration) Tag {
+	return newDurationTag("queue-task-drain-estimated-time", estimatedTime)
+}
+
+// TaskWeights returns tag for TaskWeights
+func TaskWeights(weights map[int]int) Tag {
+	return newObjectTag("queue-task-weights", weights)
+}
+
+// TaskWeightRatio returns tag for TaskWeightRatio
+func TaskWeightRatio(ratio float64) Tag {
+	return newObjectTag("queue-task-weight-ratio", ratio)
+}
+
 // NumberProcessed returns tag for NumberProcessed
 func NumberProcessed(n int) Tag {
 	return newInt("number-processed", n)
@@ -54,6 +54,7 @@ const (
 	Counter MetricType = iota
 	Timer
 	Gauge
+	Histogram
 )
 
 // Service names for all services that emit metrics.
@@ -122,6 +123,9 @@ var GoRuntimeMetrics = map[MetricName]MetricType{
 	GcPauseMsTimer:       Timer,
 }
 
+// priorityTaskRetryAttemptsBuckets are the buckets for the number of attempts made to process a task
+var priorityTaskRetryAttemptsBuckets = tally.ValueBuckets{1, 2, 3, 4, 5, 10, 20, 50, 100}
+
 // Scopes enum
 const (
 	// -- Common Operation scopes --
@@ -1647,9 +1651,76 @@ const (
 	ParallelTaskSubmitRequest
 	ParallelTaskSubmitLatency
 	ParallelTaskTaskProcessingLatency
+	ParallelTaskLiveWorkerCount
 
 	PriorityTaskSubmitRequest
 	PriorityTaskSubmitLatency
+	PriorityTaskRetryBudgetExhausted
+	PriorityTaskProcessorSubmitLatency
+	PriorityTaskSlow
+	PriorityTaskInFlight
+	PriorityTaskIdempotencyDeduped
+	PriorityTaskAgedOut
+	PriorityTaskDispatcherIdleTime
+	PriorityTaskDispatcherBusyTime
+	PriorityTaskInversion
+	PriorityTaskRetryAttempts
+	PriorityTaskSequenceGap
+	PriorityTaskSequenceSkipped
+	PriorityTaskQuiesced
+	PriorityTaskIdleOnlyDispatchTime
+	PriorityTaskResubmitLoopBroken
+	PriorityTaskDrainRemaining
+	PriorityTaskDrainEstimatedTime
+	PriorityTaskDeadLettered
+	PriorityTaskDeadLetterDropped
+	PriorityTaskQueueThresholdCrossed
+	PriorityTaskQueueThresholdRecovered
+	PriorityTaskBackpressureDelay
+	PriorityTaskCircuitBreakerOpen
+	PriorityTaskCircuitBreakerRejected
+	PriorityTaskPreempted
+	PriorityTaskAttempts
+	PriorityTaskAttemptLatency
+	PriorityTaskEndToEndLatency
+	PriorityTaskRejected
+	PriorityTaskRetryBackoff
+	PriorityTaskCommitLag
+	ParallelTaskStolen
+	PriorityTaskCapacityBorrowed
+	PriorityTaskCapacityReclaimed
+	PriorityTaskAllowedRetryRate
+	PriorityTaskAgePromoted
+	PriorityTaskEffectiveConcurrency
+	PriorityTaskDispatchShare
+	PriorityTaskExecutionShare
+	PriorityTaskGlobalRetriesExhausted
+	PriorityTaskWeightDrift
+	PriorityTaskYielded
+	PriorityTaskRetryCapacityExhausted
+	ParallelTaskRetryingWorkerCount
+	ParallelTaskNewTaskWorkerCount
+	PriorityTaskRoundPreempted
+	PriorityTaskWeightRatioExceeded
+	PriorityTaskSchedulerFailed
+	PriorityTaskProcessorQueueFull
+	PriorityTaskProcessorQueueOccupancy
+	PriorityTaskOutcomes
+	PriorityTaskResourceUtilization
+	PriorityTaskReservedCapacityUsage
+	PriorityTaskSharedCapacityUsage
+	PriorityTaskSpuriousWakeup
+	PriorityTaskEvicted
+	PriorityTaskShed
+	PriorityTaskReadinessCheckAttempt
+	PriorityTaskReadinessCheckFailure
+	PriorityTaskQueuedBytes
+	PriorityTaskQueuedBytesRejected
+	PriorityTaskQueuedBytesShed
+	PriorityTaskSLAViolation
+	PriorityTaskNonDroppableDrainExtended
+	PriorityTaskWeightsUpdated
+	PriorityTaskWeight
 
 	HistoryArchiverArchiveNonRetryableErrorCount
 	HistoryArchiverArchiveTransientErrorCount
@@ -2082,8 +2153,75 @@ var MetricDefs = map[ServiceIdx]map[int]metricDefinition{
 		ParallelTaskSubmitRequest:                           {metricName: "paralleltask_submit_request", metricType: Counter},
 		ParallelTaskSubmitLatency:                           {metricName: "paralleltask_submit_latency", metricType: Timer},
 		ParallelTaskTaskProcessingLatency:                   {metricName: "paralleltask_task_processing_latency", metricType: Timer},
+		ParallelTaskLiveWorkerCount:                         {metricName: "paralleltask_live_worker_count", metricType: Gauge},
 		PriorityTaskSubmitRequest:                           {metricName: "prioritytask_submit_request", metricType: Counter},
 		PriorityTaskSubmitLatency:                           {metricName: "prioritytask_submit_latency", metricType: Timer},
+		PriorityTaskRetryBudgetExhausted:                    {metricName: "prioritytask_retry_budget_exhausted", metricType: Counter},
+		PriorityTaskProcessorSubmitLatency:                  {metricName: "prioritytask_processor_submit_latency", metricType: Timer},
+		PriorityTaskSlow:                                    {metricName: "prioritytask_slow", metricType: Counter},
+		PriorityTaskInFlight:                                {metricName: "prioritytask_in_flight", metricType: Gauge},
+		PriorityTaskIdempotencyDeduped:                      {metricName: "prioritytask_idempotency_deduped", metricType: Counter},
+		PriorityTaskAgedOut:                                 {metricName: "prioritytask_aged_out", metricType: Counter},
+		PriorityTaskDispatcherIdleTime:                      {metricName: "prioritytask_dispatcher_idle_time", metricType: Timer},
+		PriorityTaskDispatcherBusyTime:                      {metricName: "prioritytask_dispatcher_busy_time", metricType: Timer},
+		PriorityTaskInversion:                               {metricName: "prioritytask_inversion", metricType: Counter},
+		PriorityTaskRetryAttempts:                           {metricName: "prioritytask_retry_attempts", metricType: Histogram, buckets: priorityTaskRetryAttemptsBuckets},
+		PriorityTaskSequenceGap:                             {metricName: "prioritytask_sequence_gap", metricType: Gauge},
+		PriorityTaskSequenceSkipped:                         {metricName: "prioritytask_sequence_skipped", metricType: Counter},
+		PriorityTaskQuiesced:                                {metricName: "prioritytask_quiesced", metricType: Gauge},
+		PriorityTaskIdleOnlyDispatchTime:                    {metricName: "prioritytask_idle_only_dispatch_time", metricType: Timer},
+		PriorityTaskResubmitLoopBroken:                      {metricName: "prioritytask_resubmit_loop_broken", metricType: Counter},
+		PriorityTaskDrainRemaining:                          {metricName: "prioritytask_drain_remaining", metricType: Gauge},
+		PriorityTaskDrainEstimatedTime:                      {metricName: "prioritytask_drain_estimated_time_seconds", metricType: Gauge},
+		PriorityTaskDeadLettered:                            {metricName: "prioritytask_dead_lettered", metricType: Counter},
+		PriorityTaskDeadLetterDropped:                       {metricName: "prioritytask_dead_letter_dropped", metricType: Counter},
+		PriorityTaskQueueThresholdCrossed:                   {metricName: "prioritytask_queue_threshold_crossed", metricType: Counter},
+		PriorityTaskQueueThresholdRecovered:                 {metricName: "prioritytask_queue_threshold_recovered", metricType: Counter},
+		PriorityTaskBackpressureDelay:                       {metricName: "prioritytask_backpressure_delay", metricType: Timer},
+		PriorityTaskCircuitBreakerOpen:                      {metricName: "prioritytask_circuit_breaker_open", metricType: Gauge},
+		PriorityTaskCircuitBreakerRejected:                  {metricName: "prioritytask_circuit_breaker_rejected", metricType: Counter},
+		PriorityTaskPreempted:                               {metricName: "prioritytask_preempted", metricType: Counter},
+		PriorityTaskAttempts:                                {metricName: "prioritytask_attempts", metricType: Counter},
+		PriorityTaskAttemptLatency:                          {metricName: "prioritytask_attempt_latency", metricType: Timer},
+		PriorityTaskEndToEndLatency:                         {metricName: "prioritytask_end_to_end_latency", metricType: Timer},
+		PriorityTaskRejected:                                {metricName: "prioritytask_rejected", metricType: Counter},
+		PriorityTaskRetryBackoff:                            {metricName: "prioritytask_retry_backoff", metricType: Timer},
+		PriorityTaskCommitLag:                               {metricName: "prioritytask_commit_lag", metricType: Gauge},
+		ParallelTaskStolen:                                  {metricName: "paralleltask_stolen", metricType: Counter},
+		PriorityTaskCapacityBorrowed:                        {metricName: "prioritytask_capacity_borrowed", metricType: Counter},
+		PriorityTaskCapacityReclaimed:                       {metricName: "prioritytask_capacity_reclaimed", metricType: Counter},
+		PriorityTaskAllowedRetryRate:                        {metricName: "prioritytask_allowed_retry_rate", metricType: Gauge},
+		PriorityTaskAgePromoted:                             {metricName: "prioritytask_age_promoted", metricType: Counter},
+		PriorityTaskEffectiveConcurrency:                    {metricName: "prioritytask_effective_concurrency", metricType: Gauge},
+		PriorityTaskDispatchShare:                           {metricName: "prioritytask_dispatch_share", metricType: Gauge},
+		PriorityTaskExecutionShare:                          {metricName: "prioritytask_execution_share", metricType: Gauge},
+		PriorityTaskGlobalRetriesExhausted:                  {metricName: "prioritytask_global_retries_exhausted", metricType: Counter},
+		PriorityTaskWeightDrift:                             {metricName: "prioritytask_weight_drift", metricType: Gauge},
+		PriorityTaskYielded:                                 {metricName: "prioritytask_yielded", metricType: Counter},
+		PriorityTaskRetryCapacityExhausted:                  {metricName: "prioritytask_retry_capacity_exhausted", metricType: Counter},
+		ParallelTaskRetryingWorkerCount:                     {metricName: "paralleltask_retrying_worker_count", metricType: Gauge},
+		ParallelTaskNewTaskWorkerCount:                      {metricName: "paralleltask_new_task_worker_count", metricType: Gauge},
+		PriorityTaskRoundPreempted:                          {metricName: "prioritytask_round_preempted", metricType: Counter},
+		PriorityTaskWeightRatioExceeded:                     {metricName: "prioritytask_weight_ratio_exceeded", metricType: Counter},
+		PriorityTaskSchedulerFailed:                         {metricName: "prioritytask_scheduler_failed", metricType: Counter},
+		PriorityTaskProcessorQueueFull:                      {metricName: "prioritytask_processor_queue_full", metricType: Counter},
+		PriorityTaskProcessorQueueOccupancy:                 {metricName: "prioritytask_processor_queue_occupancy", metricType: Gauge},
+		PriorityTaskOutcomes:                                {metricName: "prioritytask_outcomes", metricType: Counter},
+		PriorityTaskResourceUtilization:                     {metricName: "prioritytask_resource_utilization", metricType: Gauge},
+		PriorityTaskReservedCapacityUsage:                   {metricName: "prioritytask_reserved_capacity_usage", metricType: Gauge},
+		PriorityTaskSharedCapacityUsage:                     {metricName: "prioritytask_shared_capacity_usage", metricType: Gauge},
+		PriorityTaskSpuriousWakeup:                          {metricName: "prioritytask_spurious_wakeup", metricType: Counter},
+		PriorityTaskEvicted:                                 {metricName: "prioritytask_evicted", metricType: Counter},
+		PriorityTaskShed:                                    {metricName: "prioritytask_shed", metricType: Counter},
+		PriorityTaskReadinessCheckAttempt:                   {metricName: "prioritytask_readiness_check_attempt", metricType: Counter},
+		PriorityTaskReadinessCheckFailure:                   {metricName: "prioritytask_readiness_check_failure", metricType: Counter},
+		PriorityTaskQueuedBytes:                             {metricName: "prioritytask_queued_bytes", metricType: Gauge},
+		PriorityTaskQueuedBytesRejected:                     {metricName: "prioritytask_queued_bytes_rejected", metricType: Counter},
+		PriorityTaskQueuedBytesShed:                         {metricName: "prioritytask_queued_bytes_shed", metricType: Counter},
+		PriorityTaskSLAViolation:                            {metricName: "prioritytask_sla_violation", metricType: Counter},
+		PriorityTaskNonDroppableDrainExtended:               {metricName: "prioritytask_non_droppable_drain_extended", metricType: Counter},
+		PriorityTaskWeightsUpdated:                          {metricName: "prioritytask_weights_updated", metricType: Counter},
+		PriorityTaskWeight:                                  {metricName: "prioritytask_weight", metricType: Gauge},
 
 		HistoryArchiverArchiveNonRetryableErrorCount:              {metricName: "history_archiver_archive_non_retryable_error", metricType: Counter},
 		HistoryArchiverArchiveTransientErrorCount:                 {metricName: "history_archiver_archive_transient_error", metricType: Counter},
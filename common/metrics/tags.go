@@ -20,6 +20,10 @@
 
 package metrics
 
+import (
+	"strconv"
+)
+
 const (
 	revisionTag     = "revision"
 	branchTag       = "branch"
@@ -36,6 +40,17 @@ const (
 	activityType  = "activityType"
 	decisionType  = "decisionType"
 	invariantType = "invariantType"
+	taskPriority  = "task_priority"
+
+	waitingTaskPriority = "waiting_task_priority"
+	taskOutcome         = "task_outcome"
+	queueThreshold      = "queue_threshold"
+	taskDependency      = "task_dependency"
+	taskAttempt         = "attempt"
+	rejectReason        = "reason"
+	taskPartition       = "task_partition"
+	resourceDimension   = "resource_dimension"
+	schedulerChild      = "task_scheduler_child"
 
 	domainAllValue = "all"
 	unknownValue   = "_unknown_"
@@ -87,6 +102,51 @@ type (
 	invariantTypeTag struct {
 		value string
 	}
+
+	taskPriorityTag struct {
+		value string
+	}
+
+	waitingTaskPriorityTag struct {
+		value string
+	}
+
+	taskOutcomeTag struct {
+		value string
+	}
+
+	queueThresholdTag struct {
+		value string
+	}
+
+	taskDependencyTag struct {
+		value string
+	}
+
+	taskAttemptTag struct {
+		value string
+	}
+
+	rejectReasonTag struct {
+		value string
+	}
+
+	taskPartitionTag struct {
+		value string
+	}
+
+	resourceDimensionTag struct {
+		value string
+	}
+
+	schedulerChildTag struct {
+		value string
+	}
+
+	stringTag struct {
+		key   string
+		value string
+	}
 )
 
 // DomainTag returns a new domain tag. For timers, this also ensures that we
@@ -279,3 +339,180 @@ func (d invariantTypeTag) Key() string {
 func (d invariantTypeTag) Value() string {
 	return d.value
 }
+
+// TaskPriorityTag returns a new task priority tag.
+func TaskPriorityTag(value int) Tag {
+	return taskPriorityTag{strconv.Itoa(value)}
+}
+
+// Key returns the key of the task priority tag
+func (d taskPriorityTag) Key() string {
+	return taskPriority
+}
+
+// Value returns the value of the task priority tag
+func (d taskPriorityTag) Value() string {
+	return d.value
+}
+
+// WaitingTaskPriorityTag returns a new tag for the priority of tasks waiting to be dispatched.
+func WaitingTaskPriorityTag(value int) Tag {
+	return waitingTaskPriorityTag{strconv.Itoa(value)}
+}
+
+// Key returns the key of the waiting task priority tag
+func (d waitingTaskPriorityTag) Key() string {
+	return waitingTaskPriority
+}
+
+// Value returns the value of the waiting task priority tag
+func (d waitingTaskPriorityTag) Value() string {
+	return d.value
+}
+
+// TaskOutcomeTag returns a new tag for the final outcome of processing a task.
+func TaskOutcomeTag(value string) Tag {
+	return taskOutcomeTag{value}
+}
+
+// Key returns the key of the task outcome tag
+func (d taskOutcomeTag) Key() string {
+	return taskOutcome
+}
+
+// Value returns the value of the task outcome tag
+func (d taskOutcomeTag) Value() string {
+	return d.value
+}
+
+// QueueThresholdTag returns a new tag for a queue depth threshold, as a fraction of the queue capacity.
+func QueueThresholdTag(value float64) Tag {
+	return queueThresholdTag{strconv.FormatFloat(value, 'f', -1, 64)}
+}
+
+// Key returns the key of the queue threshold tag
+func (d queueThresholdTag) Key() string {
+	return queueThreshold
+}
+
+// Value returns the value of the queue threshold tag
+func (d queueThresholdTag) Value() string {
+	return d.value
+}
+
+// TaskDependencyTag returns a new tag for the downstream dependency of a task.
+func TaskDependencyTag(value string) Tag {
+	if len(value) == 0 {
+		value = unknownValue
+	}
+	return taskDependencyTag{value}
+}
+
+// Key returns the key of the task dependency tag
+func (d taskDependencyTag) Key() string {
+	return taskDependency
+}
+
+// Value returns the value of the task dependency tag
+func (d taskDependencyTag) Value() string {
+	return d.value
+}
+
+// TaskAttemptTag returns a new tag for whether an execution of a task is its first attempt or a retry.
+func TaskAttemptTag(value string) Tag {
+	return taskAttemptTag{value}
+}
+
+// Key returns the key of the task attempt tag
+func (d taskAttemptTag) Key() string {
+	return taskAttempt
+}
+
+// Value returns the value of the task attempt tag
+func (d taskAttemptTag) Value() string {
+	return d.value
+}
+
+// RejectReasonTag returns a new tag for the reason a task submission is rejected.
+func RejectReasonTag(value string) Tag {
+	return rejectReasonTag{value}
+}
+
+// Key returns the key of the reject reason tag
+func (d rejectReasonTag) Key() string {
+	return rejectReason
+}
+
+// Value returns the value of the reject reason tag
+func (d rejectReasonTag) Value() string {
+	return d.value
+}
+
+// TaskPartitionTag returns a new tag for the partition of a partitioned task scheduler.
+func TaskPartitionTag(value int) Tag {
+	return taskPartitionTag{strconv.Itoa(value)}
+}
+
+// Key returns the key of the task partition tag
+func (d taskPartitionTag) Key() string {
+	return taskPartition
+}
+
+// Value returns the value of the task partition tag
+func (d taskPartitionTag) Value() string {
+	return d.value
+}
+
+// ResourceDimensionTag returns a new tag for the resource dimension whose budget is consumed by tasks.
+func ResourceDimensionTag(value string) Tag {
+	if len(value) == 0 {
+		value = unknownValue
+	}
+	return resourceDimensionTag{value}
+}
+
+// Key returns the key of the resource dimension tag
+func (d resourceDimensionTag) Key() string {
+	return resourceDimension
+}
+
+// Value returns the value of the resource dimension tag
+func (d resourceDimensionTag) Value() string {
+	return d.value
+}
+
+// SchedulerChildTag returns a new tag for the child scheduler of a hierarchical task scheduler.
+func SchedulerChildTag(value string) Tag {
+	if len(value) == 0 {
+		value = unknownValue
+	}
+	return schedulerChildTag{value}
+}
+
+// Key returns the key of the scheduler child tag
+func (d schedulerChildTag) Key() string {
+	return schedulerChild
+}
+
+// Value returns the value of the scheduler child tag
+func (d schedulerChildTag) Value() string {
+	return d.value
+}
+
+// StringTag returns a new tag with the given key and value.
+func StringTag(key string, value string) Tag {
+	if len(value) == 0 {
+		value = unknownValue
+	}
+	return stringTag{key, value}
+}
+
+// Key returns the key of the string tag
+func (d stringTag) Key() string {
+	return d.key
+}
+
+// Value returns the value of the string tag
+func (d stringTag) Value() string {
+	return d.value
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"time"
+)
+
+type (
+	// agingQueue wraps a task queue and evicts the tasks which have been queued
+	// for longer than maxAge before polling, instead of exposing them to the dispatch strategy
+	agingQueue struct {
+		*taskQueueImpl
+
+		maxAge time.Duration
+		// onAgedOut is invoked with each evicted task
+		onAgedOut func(task PriorityTask)
+	}
+)
+
+func newAgingQueue(
+	queue *taskQueueImpl,
+	maxAge time.Duration,
+	onAgedOut func(task PriorityTask),
+) *agingQueue {
+	return &agingQueue{
+		taskQueueImpl: queue,
+		maxAge:        maxAge,
+		onAgedOut:     onAgedOut,
+	}
+}
+
+func (q *agingQueue) Poll() (PriorityTask, bool) {
+	q.evictExpired()
+	return q.taskQueueImpl.Poll()
+}
+
+func (q *agingQueue) evictExpired() {
+	deadline := time.Now().Add(-q.maxAge)
+	for {
+		task, ok := q.PollExpired(deadline)
+		if !ok {
+			return
+		}
+		q.onAgedOut(task)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	agingQueueSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestAgingQueueSuite(t *testing.T) {
+	s := new(agingQueueSuite)
+	suite.Run(t, s)
+}
+
+func (s *agingQueueSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *agingQueueSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *agingQueueSuite) TestPoll() {
+	var agedOutTasks []PriorityTask
+	queue := newAgingQueue(newTaskQueue(1, 3), time.Minute, func(task PriorityTask) {
+		agedOutTasks = append(agedOutTasks, task)
+	})
+
+	tasks := []PriorityTask{
+		NewMockPriorityTask(s.controller),
+		NewMockPriorityTask(s.controller),
+		NewMockPriorityTask(s.controller),
+	}
+	for _, task := range tasks {
+		s.True(queue.Offer(task))
+	}
+	// the first two tasks have been queued for longer than the max age
+	queue.enqueueTimes[0] = time.Now().Add(-2 * time.Minute)
+	queue.enqueueTimes[1] = time.Now().Add(-2 * time.Minute)
+
+	task, ok := queue.Poll()
+	s.True(ok)
+	s.Equal(tasks[2], task)
+	s.Equal(tasks[:2], agedOutTasks)
+
+	_, ok = queue.Poll()
+	s.False(ok)
+	s.Len(agedOutTasks, 2)
+}
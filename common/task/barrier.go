@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// Barrier tracks the completion of a group of tasks
+	Barrier interface {
+		// Wait blocks until all tasks in the group are completed (acked or nacked)
+		// or the context is done
+		Wait(ctx context.Context) error
+	}
+
+	barrierImpl struct {
+		remaining int64
+		doneCh    chan struct{}
+	}
+
+	barrierTask struct {
+		taskWrapper
+
+		once    sync.Once
+		barrier *barrierImpl
+	}
+)
+
+// SubmitGroup submits a group of tasks to the scheduler and returns a Barrier
+// which can be used to wait for the completion of all tasks in the group.
+// If any of the tasks fails to be submitted, the error will be returned and
+// the tasks not submitted will be considered as completed by the barrier.
+// Note that tasks abandoned by a stopped processor are neither acked nor nacked,
+// so Wait should always be called with a context that will eventually be done.
+func SubmitGroup(
+	scheduler Scheduler,
+	tasks []PriorityTask,
+) (Barrier, error) {
+	barrier := &barrierImpl{
+		remaining: int64(len(tasks)),
+		doneCh:    make(chan struct{}),
+	}
+	if len(tasks) == 0 {
+		close(barrier.doneCh)
+		return barrier, nil
+	}
+
+	for idx, task := range tasks {
+		if err := scheduler.Submit(&barrierTask{
+			taskWrapper: taskWrapper{PriorityTask: task},
+			barrier:     barrier,
+		}); err != nil {
+			barrier.done(int64(len(tasks) - idx))
+			return barrier, err
+		}
+	}
+	return barrier, nil
+}
+
+func (b *barrierImpl) Wait(
+	ctx context.Context,
+) error {
+	select {
+	case <-b.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *barrierImpl) done(
+	count int64,
+) {
+	if atomic.AddInt64(&b.remaining, -count) == 0 {
+		close(b.doneCh)
+	}
+}
+
+func (t *barrierTask) Ack() {
+	t.PriorityTask.Ack()
+	t.done()
+}
+
+func (t *barrierTask) Nack() {
+	t.PriorityTask.Nack()
+	t.done()
+}
+
+func (t *barrierTask) done() {
+	t.once.Do(func() {
+		t.barrier.done(1)
+	})
+}
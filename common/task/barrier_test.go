@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	barrierSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller    *gomock.Controller
+		mockScheduler *MockScheduler
+	}
+)
+
+func TestBarrierSuite(t *testing.T) {
+	s := new(barrierSuite)
+	suite.Run(t, s)
+}
+
+func (s *barrierSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockScheduler = NewMockScheduler(s.controller)
+}
+
+func (s *barrierSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *barrierSuite) TestSubmitGroup_Success() {
+	numTasks := 5
+	tasks := []PriorityTask{}
+	var submitted []PriorityTask
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		if i%2 == 0 {
+			mockTask.EXPECT().Ack().Times(1)
+		} else {
+			mockTask.EXPECT().Nack().Times(1)
+		}
+		tasks = append(tasks, mockTask)
+	}
+	s.mockScheduler.EXPECT().Submit(gomock.Any()).DoAndReturn(func(task PriorityTask) error {
+		submitted = append(submitted, task)
+		return nil
+	}).Times(numTasks)
+
+	barrier, err := SubmitGroup(s.mockScheduler, tasks)
+	s.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, barrier.Wait(ctx))
+
+	for i, task := range submitted {
+		if i%2 == 0 {
+			task.Ack()
+		} else {
+			task.Nack()
+		}
+	}
+	s.NoError(barrier.Wait(context.Background()))
+}
+
+func (s *barrierSuite) TestSubmitGroup_SubmitFailed() {
+	mockTask1 := NewMockPriorityTask(s.controller)
+	mockTask2 := NewMockPriorityTask(s.controller)
+	mockTask1.EXPECT().Ack().Times(2)
+
+	var submitted PriorityTask
+	submitErr := errors.New("some random error")
+	gomock.InOrder(
+		s.mockScheduler.EXPECT().Submit(gomock.Any()).DoAndReturn(func(task PriorityTask) error {
+			submitted = task
+			return nil
+		}),
+		s.mockScheduler.EXPECT().Submit(gomock.Any()).Return(submitErr),
+	)
+
+	barrier, err := SubmitGroup(s.mockScheduler, []PriorityTask{mockTask1, mockTask2})
+	s.Equal(submitErr, err)
+
+	submitted.Ack()
+	submitted.Ack() // duplicate completion should not be counted twice
+	s.NoError(barrier.Wait(context.Background()))
+}
+
+func (s *barrierSuite) TestSubmitGroup_FirstSubmitFailed() {
+	submitErr := errors.New("some random error")
+	s.mockScheduler.EXPECT().Submit(gomock.Any()).Return(submitErr).Times(1)
+
+	barrier, err := SubmitGroup(s.mockScheduler, []PriorityTask{
+		NewMockPriorityTask(s.controller),
+		NewMockPriorityTask(s.controller),
+	})
+	s.Equal(submitErr, err)
+	s.NoError(barrier.Wait(context.Background()))
+}
+
+func (s *barrierSuite) TestSubmitGroup_Empty() {
+	barrier, err := SubmitGroup(s.mockScheduler, nil)
+	s.NoError(err)
+	s.NoError(barrier.Wait(context.Background()))
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// circuitBreakers tracks the consecutive failures of the tasks of each dependency, and stops
+	// admitting tasks of a dependency for openDuration once the failures reach the threshold. After
+	// that, a single task is admitted every openDuration as a probe until one of them succeeds
+	circuitBreakers struct {
+		sync.Mutex
+
+		threshold    int
+		openDuration time.Duration
+		breakers     map[string]*circuitBreaker
+		// onStateChange is invoked with the lock held whenever a breaker opens or closes
+		onStateChange func(dependency string, open bool)
+		now           func() time.Time
+	}
+
+	circuitBreaker struct {
+		failures int
+		open     bool
+		// probeTime is the time the breaker opened or last admitted a probe
+		probeTime time.Time
+	}
+)
+
+func newCircuitBreakers(
+	threshold int,
+	openDuration time.Duration,
+	onStateChange func(dependency string, open bool),
+) *circuitBreakers {
+	return &circuitBreakers{
+		threshold:     threshold,
+		openDuration:  openDuration,
+		breakers:      make(map[string]*circuitBreaker),
+		onStateChange: onStateChange,
+		now:           time.Now,
+	}
+}
+
+// allow returns true if the task of the dependency can be dispatched,
+// i.e. the breaker is closed or it's time to probe the dependency
+func (c *circuitBreakers) allow(
+	dependency string,
+) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	breaker, ok := c.breakers[dependency]
+	if !ok || !breaker.open {
+		return true
+	}
+	if now := c.now(); now.Sub(breaker.probeTime) >= c.openDuration {
+		breaker.probeTime = now
+		return true
+	}
+	return false
+}
+
+// record records the result of an execution of the task of the dependency
+func (c *circuitBreakers) record(
+	dependency string,
+	succeeded bool,
+) {
+	c.Lock()
+	defer c.Unlock()
+
+	breaker, ok := c.breakers[dependency]
+	if !ok {
+		if succeeded {
+			return
+		}
+		breaker = &circuitBreaker{}
+		c.breakers[dependency] = breaker
+	}
+
+	if succeeded {
+		breaker.failures = 0
+		if breaker.open {
+			breaker.open = false
+			c.onStateChange(dependency, false)
+		}
+		return
+	}
+
+	breaker.failures++
+	if breaker.open {
+		// a failed probe, or a task dispatched before the breaker opened,
+		// keeps the breaker open for another openDuration
+		breaker.probeTime = c.now()
+		return
+	}
+	if breaker.failures >= c.threshold {
+		breaker.open = true
+		breaker.probeTime = c.now()
+		c.onStateChange(dependency, true)
+	}
+}
+
+// getTaskDependency returns the dependency of the task
+// after unwrapping the wrappers added by the scheduler
+func getTaskDependency(
+	task Task,
+) (string, bool) {
+	dependentTask, ok := unwrapSchedulerTask(task).(DependentTask)
+	if !ok {
+		return "", false
+	}
+	return dependentTask.Dependency(), true
+}
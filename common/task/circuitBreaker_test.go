@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	var stateChanges []bool
+	breakers := newCircuitBreakers(2, time.Second, func(dependency string, open bool) {
+		require.Equal(t, "some random dependency", dependency)
+		stateChanges = append(stateChanges, open)
+	})
+	now := time.Now()
+	breakers.now = func() time.Time { return now }
+	dependency := "some random dependency"
+
+	// failures must be consecutive to open the breaker
+	breakers.record(dependency, false)
+	breakers.record(dependency, true)
+	breakers.record(dependency, false)
+	require.True(t, breakers.allow(dependency))
+	require.Empty(t, stateChanges)
+
+	breakers.record(dependency, false)
+	require.Equal(t, []bool{true}, stateChanges)
+	require.False(t, breakers.allow(dependency))
+	require.True(t, breakers.allow("other dependency"))
+
+	// only one probe is admitted every open duration
+	now = now.Add(time.Second)
+	require.True(t, breakers.allow(dependency))
+	require.False(t, breakers.allow(dependency))
+	breakers.record(dependency, false)
+	now = now.Add(time.Second / 2)
+	require.False(t, breakers.allow(dependency))
+	now = now.Add(time.Second / 2)
+	require.True(t, breakers.allow(dependency))
+
+	breakers.record(dependency, true)
+	require.Equal(t, []bool{true, false}, stateChanges)
+	require.True(t, breakers.allow(dependency))
+	require.True(t, breakers.allow(dependency))
+}
+
+func TestGetTaskDependency(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	mockTask := NewMockDependentTask(controller)
+	mockTask.EXPECT().Dependency().Return("some random dependency").Times(2)
+	dependency, ok := getTaskDependency(mockTask)
+	require.True(t, ok)
+	require.Equal(t, "some random dependency", dependency)
+
+	dependency, ok = getTaskDependency(&concurrencyLimitedTask{
+		taskWrapper: taskWrapper{PriorityTask: &requeuedTask{
+			taskWrapper: taskWrapper{PriorityTask: newPrioritySnapshotTask(mockTask, 1)},
+		}},
+	})
+	require.True(t, ok)
+	require.Equal(t, "some random dependency", dependency)
+
+	_, ok = getTaskDependency(NewMockPriorityTask(controller))
+	require.False(t, ok)
+}
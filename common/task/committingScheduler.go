@@ -0,0 +1,229 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// CommittingTask is the interface for tasks read from a replayable stream, whose offsets are
+	// committed once all the tasks before them are completed, so consumers can resume from there
+	CommittingTask interface {
+		PriorityTask
+		// Offset returns the offset of the task, which is unique among the tasks of a stream
+		Offset() int64
+		// Commit is invoked after the task is acked and all the tasks with smaller offsets are
+		// committed, it's called with the scheduler's lock held, so it must not call the scheduler
+		Commit()
+	}
+
+	// CommittingScheduler is the scheduler tracking the offsets of CommittingTasks
+	CommittingScheduler interface {
+		Scheduler
+		// CommittedOffset returns the offset of the last committed task, consumers
+		// restarting from the stream should resume from the offset following it
+		CommittedOffset() int64
+	}
+
+	// CommittingSchedulerOptions configs the committing scheduler
+	CommittingSchedulerOptions struct {
+		// CommittedOffset is the offset committed before, e.g. by the previous consumer of the stream,
+		// tasks at or before it are rejected and the first task to commit is the one following it
+		CommittedOffset int64
+	}
+
+	// committingScheduler submits CommittingTasks to the underlying scheduler in any order, and
+	// advances the committed offset only past the tasks completed contiguously from it
+	committingScheduler struct {
+		sync.Mutex
+
+		status       int32
+		scheduler    Scheduler
+		logger       log.Logger
+		metricsScope metrics.Scope
+
+		// the following fields are protected by the lock
+		committedOffset int64
+		ackedTasks      map[int64]CommittingTask
+	}
+
+	// committingSchedulerTask is the task submitted to the underlying
+	// scheduler, it reports the ack of a CommittingTask to the scheduler
+	committingSchedulerTask struct {
+		CommittingTask
+
+		scheduler *committingScheduler
+	}
+)
+
+var _ CommittingScheduler = (*committingScheduler)(nil)
+
+var (
+	// ErrNotCommittingTask is the error returned when submitting a task not implementing CommittingTask
+	ErrNotCommittingTask = errors.New("task does not implement CommittingTask")
+	// ErrStaleOffset is the error returned when submitting a task whose
+	// offset is already committed or acked by the committing scheduler
+	ErrStaleOffset = errors.New("task offset is already committed or acked")
+)
+
+// NewCommittingScheduler creates a scheduler which submits CommittingTasks to the given scheduler and commits
+// their offsets in order, i.e. a task acked before the tasks preceding it is held until they are all acked,
+// so the committed offset never passes a task which may have to be replayed. A nacked task holds back the
+// committed offset until the task with the same offset is submitted again and acked
+func NewCommittingScheduler(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	scheduler Scheduler,
+	options *CommittingSchedulerOptions,
+) CommittingScheduler {
+	return &committingScheduler{
+		status:          common.DaemonStatusInitialized,
+		scheduler:       scheduler,
+		logger:          logger,
+		metricsScope:    metricsClient.Scope(metrics.TaskSchedulerScope),
+		committedOffset: options.CommittedOffset,
+		ackedTasks:      make(map[int64]CommittingTask),
+	}
+}
+
+func (s *committingScheduler) Start() {
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
+		return
+	}
+
+	s.scheduler.Start()
+}
+
+// Stop stops the underlying scheduler, the acked tasks waiting for
+// the tasks preceding them are left uncommitted to be replayed
+func (s *committingScheduler) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusStarted, common.DaemonStatusStopped) {
+		return
+	}
+
+	s.scheduler.Stop()
+}
+
+func (s *committingScheduler) Submit(
+	task PriorityTask,
+) error {
+	committingTask, err := s.newCommittingSchedulerTask(task)
+	if err != nil {
+		return err
+	}
+	return s.scheduler.Submit(committingTask)
+}
+
+func (s *committingScheduler) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	committingTask, err := s.newCommittingSchedulerTask(task)
+	if err != nil {
+		return false, err
+	}
+	return s.scheduler.TrySubmit(committingTask)
+}
+
+func (s *committingScheduler) CommittedOffset() int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.committedOffset
+}
+
+func (s *committingScheduler) newCommittingSchedulerTask(
+	task PriorityTask,
+) (*committingSchedulerTask, error) {
+	committingTask, ok := task.(CommittingTask)
+	if !ok {
+		return nil, ErrNotCommittingTask
+	}
+	if atomic.LoadInt32(&s.status) == common.DaemonStatusStopped {
+		return nil, ErrTaskSchedulerClosed
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	offset := committingTask.Offset()
+	if _, ok := s.ackedTasks[offset]; ok || offset <= s.committedOffset {
+		return nil, ErrStaleOffset
+	}
+	return &committingSchedulerTask{
+		CommittingTask: committingTask,
+		scheduler:      s,
+	}, nil
+}
+
+// ack records the acked task and commits the acked tasks following the committed offset
+func (s *committingScheduler) ack(
+	task CommittingTask,
+) {
+	s.Lock()
+	defer s.Unlock()
+
+	// the same offset may be acked again if it's submitted more than once
+	offset := task.Offset()
+	if _, ok := s.ackedTasks[offset]; ok || offset <= s.committedOffset {
+		return
+	}
+	s.ackedTasks[offset] = task
+
+	for {
+		task, ok := s.ackedTasks[s.committedOffset+1]
+		if !ok {
+			break
+		}
+		delete(s.ackedTasks, s.committedOffset+1)
+		s.committedOffset++
+		task.Commit()
+	}
+	s.metricsScope.UpdateGauge(metrics.PriorityTaskCommitLag, float64(len(s.ackedTasks)))
+}
+
+func (t *committingSchedulerTask) Ack() {
+	t.CommittingTask.Ack()
+	t.scheduler.ack(t.CommittingTask)
+}
+
+func (t *committingSchedulerTask) MetricTags() map[string]string {
+	if taggedTask, ok := t.CommittingTask.(MetricTaggedTask); ok {
+		return taggedTask.MetricTags()
+	}
+	return nil
+}
+
+func (t *committingSchedulerTask) ExecuteWithContext(
+	ctx context.Context,
+) error {
+	if contextAwareTask, ok := t.CommittingTask.(ContextAwareTask); ok {
+		return contextAwareTask.ExecuteWithContext(ctx)
+	}
+	return t.CommittingTask.Execute()
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	committingSchedulerSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller    *gomock.Controller
+		mockScheduler *MockScheduler
+		testScope     tally.TestScope
+
+		committingScheduler *committingScheduler
+		committedOffsets    []int64
+		submittedTasks      []PriorityTask
+	}
+
+	testCommittingTask struct {
+		*MockPriorityTask
+
+		offset int64
+		commit func(offset int64)
+	}
+)
+
+func TestCommittingSchedulerSuite(t *testing.T) {
+	s := new(committingSchedulerSuite)
+	suite.Run(t, s)
+}
+
+func (s *committingSchedulerSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockScheduler = NewMockScheduler(s.controller)
+	s.testScope = tally.NewTestScope("test", nil)
+
+	s.committingScheduler = NewCommittingScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(s.testScope, metrics.Common),
+		s.mockScheduler,
+		&CommittingSchedulerOptions{
+			CommittedOffset: 9,
+		},
+	).(*committingScheduler)
+	s.committedOffsets = nil
+	s.submittedTasks = nil
+	s.mockScheduler.EXPECT().Submit(gomock.Any()).DoAndReturn(func(task PriorityTask) error {
+		s.submittedTasks = append(s.submittedTasks, task)
+		return nil
+	}).AnyTimes()
+}
+
+func (s *committingSchedulerSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *committingSchedulerSuite) TestSubmit_CommitInOrder() {
+	tasks := s.newTestCommittingTasks(10, 13)
+	for _, task := range tasks {
+		task.MockPriorityTask.EXPECT().Ack().Times(1)
+		s.NoError(s.committingScheduler.Submit(task))
+	}
+	s.Len(s.submittedTasks, 3)
+
+	s.submittedTasks[2].Ack()
+	s.Empty(s.committedOffsets)
+	s.Equal(int64(9), s.committingScheduler.CommittedOffset())
+	s.Equal(float64(1), s.getCommitLag())
+
+	s.submittedTasks[0].Ack()
+	s.Equal([]int64{10}, s.committedOffsets)
+	s.Equal(int64(10), s.committingScheduler.CommittedOffset())
+
+	s.submittedTasks[1].Ack()
+	s.Equal([]int64{10, 11, 12}, s.committedOffsets)
+	s.Equal(int64(12), s.committingScheduler.CommittedOffset())
+	s.Equal(float64(0), s.getCommitLag())
+	s.Empty(s.committingScheduler.ackedTasks)
+}
+
+func (s *committingSchedulerSuite) TestSubmit_Rejected() {
+	s.Equal(ErrNotCommittingTask, s.committingScheduler.Submit(NewMockPriorityTask(s.controller)))
+
+	tasks := s.newTestCommittingTasks(9, 12)
+	s.Equal(ErrStaleOffset, s.committingScheduler.Submit(tasks[0]))
+
+	tasks[2].MockPriorityTask.EXPECT().Ack().Times(1)
+	s.NoError(s.committingScheduler.Submit(tasks[2]))
+	s.submittedTasks[0].Ack()
+	submitted, err := s.committingScheduler.TrySubmit(tasks[2])
+	s.Equal(ErrStaleOffset, err)
+	s.False(submitted)
+
+	s.mockScheduler.EXPECT().TrySubmit(gomock.Any()).Return(false, nil).Times(1)
+	submitted, err = s.committingScheduler.TrySubmit(tasks[1])
+	s.NoError(err)
+	s.False(submitted)
+	s.Empty(s.committedOffsets)
+}
+
+func (s *committingSchedulerSuite) TestNack_Replay() {
+	tasks := s.newTestCommittingTasks(10, 11)
+	tasks[0].MockPriorityTask.EXPECT().Nack().Times(1)
+	s.NoError(s.committingScheduler.Submit(tasks[0]))
+	s.submittedTasks[0].Nack()
+	s.Equal(int64(9), s.committingScheduler.CommittedOffset())
+
+	// the nacked offset can be replayed, and is committed once acked
+	tasks[0].MockPriorityTask.EXPECT().Ack().Times(1)
+	s.NoError(s.committingScheduler.Submit(tasks[0]))
+	s.submittedTasks[1].Ack()
+	s.Equal([]int64{10}, s.committedOffsets)
+	s.Equal(int64(10), s.committingScheduler.CommittedOffset())
+}
+
+func (s *committingSchedulerSuite) TestStartStop() {
+	s.mockScheduler.EXPECT().Start().Times(1)
+	s.committingScheduler.Start()
+
+	s.mockScheduler.EXPECT().Stop().Times(1)
+	s.committingScheduler.Stop()
+
+	s.Equal(ErrTaskSchedulerClosed, s.committingScheduler.Submit(s.newTestCommittingTasks(10, 11)[0]))
+}
+
+func (s *committingSchedulerSuite) newTestCommittingTasks(
+	from int64,
+	to int64,
+) []*testCommittingTask {
+	var tasks []*testCommittingTask
+	for offset := from; offset != to; offset++ {
+		tasks = append(tasks, &testCommittingTask{
+			MockPriorityTask: NewMockPriorityTask(s.controller),
+			offset:           offset,
+			commit: func(offset int64) {
+				s.committedOffsets = append(s.committedOffsets, offset)
+			},
+		})
+	}
+	return tasks
+}
+
+func (s *committingSchedulerSuite) getCommitLag() float64 {
+	for _, gauge := range s.testScope.Snapshot().Gauges() {
+		if gauge.Name() == "test.prioritytask_commit_lag" {
+			return gauge.Value()
+		}
+	}
+	return -1
+}
+
+func (t *testCommittingTask) Offset() int64 {
+	return t.offset
+}
+
+func (t *testCommittingTask) Commit() {
+	t.commit(t.offset)
+}
@@ -0,0 +1,539 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// concurrencyLimitedQueue wraps a task queue and stops exposing tasks to the
+	// dispatch strategy once the number of in-flight tasks reaches the limit
+	concurrencyLimitedQueue struct {
+		TaskQueue
+
+		limit    int32
+		inFlight int32
+		// onUpdate is invoked with the number of in-flight tasks whenever it changes
+		onUpdate func(inFlight int32)
+		// onRelease is invoked after an in-flight task completes
+		onRelease func()
+
+		// pool is set when the queue borrows and lends capacity
+		pool *capacityPool
+		// lent is the number of slots of the queue taken by tasks of lower priorities
+		lent int32
+		// borrowers are the tasks taking the lent slots, mapped to whether they're asked to yield
+		borrowLock sync.Mutex
+		borrowers  map[*concurrencyLimitedTask]bool
+
+		// executions, if set, integrates the number of dispatched tasks of the queue over time, including
+		// tasks taking borrowed slots, for computing the concurrency actually achieved by the priority
+		executions *concurrencyIntegrator
+
+		// share is set when the dispatch of the queue is throttled by its share of the in-flight tasks
+		share *executionShare
+		// dispatched is the number of tasks polled since the shares are last reported
+		dispatched int32
+
+		// resources is set when the dispatch of the queue is throttled by the resource budget
+		// shared by all priorities, peek returns the task at the head of the queue to charge
+		resources *resourceBudget
+		peek      func() (PriorityTask, bool)
+	}
+
+	// concurrencyLimitedTask releases its slot in the queue once acked or nacked
+	concurrencyLimitedTask struct {
+		taskWrapper
+
+		once  sync.Once
+		queue *concurrencyLimitedQueue
+		// lender is the queue whose slot is borrowed by the task, nil if the task takes a slot of its own queue
+		lender *concurrencyLimitedQueue
+		// cost is the cost charged to the resource budget of the queue for the task
+		cost map[string]float64
+	}
+
+	// capacityPool lets concurrency limited queues borrow the slots of queues of higher priorities which have
+	// no queued task, and lets the lenders reclaim the slots by asking the borrowing PreemptibleTasks to yield
+	capacityPool struct {
+		sync.Mutex
+		queues []*concurrencyLimitedQueue // sorted by priority, replaced on update
+
+		// onBorrow is invoked with the priority of the borrowing queue when a slot is lent
+		onBorrow func(priority int)
+		// onReclaim is invoked with the priority of the lending queue when a borrowing task is asked to yield
+		onReclaim func(priority int)
+	}
+
+	// executionShare throttles the dispatch of a queue whose share of the in-flight tasks exceeds
+	// its share of the weights, so that the execution share of priorities tracks their weights
+	// even if tasks of some priorities take longer to execute
+	executionShare struct {
+		sync.Mutex
+		queues []*concurrencyLimitedQueue // replaced on update
+
+		weights func() map[int]int
+	}
+
+	// concurrencyIntegrator integrates a concurrency over time, so that
+	// the average concurrency over a sampling window can be computed
+	concurrencyIntegrator struct {
+		sync.Mutex
+		concurrency int
+		// area is the integral of the concurrency over time since windowStart, in concurrency nanoseconds
+		area        float64
+		lastUpdate  time.Time
+		windowStart time.Time
+	}
+)
+
+func newConcurrencyLimitedQueue(
+	queue TaskQueue,
+	limit int,
+	onUpdate func(inFlight int32),
+	onRelease func(),
+) *concurrencyLimitedQueue {
+	return &concurrencyLimitedQueue{
+		TaskQueue: queue,
+		limit:     int32(limit),
+		onUpdate:  onUpdate,
+		onRelease: onRelease,
+	}
+}
+
+func newExecutionShare(
+	weights func() map[int]int,
+) *executionShare {
+	return &executionShare{
+		weights: weights,
+	}
+}
+
+func newCapacityPool(
+	onBorrow func(priority int),
+	onReclaim func(priority int),
+) *capacityPool {
+	return &capacityPool{
+		onBorrow:  onBorrow,
+		onReclaim: onReclaim,
+	}
+}
+
+func (q *concurrencyLimitedQueue) Len() int {
+	if ok, _ := q.acquirable(); !ok || !q.headFits() {
+		return 0
+	}
+	return q.TaskQueue.Len()
+}
+
+// Poll must not be invoked concurrently, which is guaranteed
+// as dispatch strategies are invoked under the dispatch lock
+func (q *concurrencyLimitedQueue) Poll() (PriorityTask, bool) {
+	ok, lender := q.acquirable()
+	if !ok || !q.headFits() {
+		return nil, false
+	}
+
+	task, ok := q.TaskQueue.Poll()
+	if !ok {
+		return nil, false
+	}
+	limitedTask := &concurrencyLimitedTask{
+		taskWrapper: taskWrapper{PriorityTask: task},
+		queue:       q,
+		lender:      lender,
+	}
+	if q.resources != nil {
+		// the polled task is charged even if it's not the peeked one, e.g. as the head expired in between,
+		// which may exceed the budget slightly. Budgets are only charged under the dispatch lock, so the
+		// head stays within the budget until it's polled
+		limitedTask.cost = q.resources.cost(task)
+		q.resources.acquire(limitedTask.cost)
+	}
+	if lender != nil {
+		lender.lend(limitedTask)
+		q.pool.onBorrow(q.Priority())
+	} else {
+		q.onUpdate(atomic.AddInt32(&q.inFlight, 1))
+	}
+	if q.executions != nil {
+		q.executions.add(1, time.Now())
+	}
+	if q.share != nil {
+		atomic.AddInt32(&q.dispatched, 1)
+	}
+	return limitedTask, true
+}
+
+// acquirable returns if a task of the queue can be dispatched, along with the queue lending
+// its slot to the task, which is nil if the queue has slots of its own left
+func (q *concurrencyLimitedQueue) acquirable() (bool, *concurrencyLimitedQueue) {
+	if q.share != nil && q.share.exceeded(q) {
+		return false, nil
+	}
+	if !q.isFull() {
+		return true, nil
+	}
+	if q.pool == nil {
+		return false, nil
+	}
+
+	q.reclaim()
+	if lender := q.pool.lender(q); lender != nil {
+		return true, lender
+	}
+	return false, nil
+}
+
+// headFits returns true if the task at the head of the queue fits in the resource budget
+func (q *concurrencyLimitedQueue) headFits() bool {
+	if q.resources == nil {
+		return true
+	}
+	task, ok := q.peek()
+	return !ok || q.resources.fits(q.resources.cost(task))
+}
+
+// isFull returns true if all the slots of the queue are taken, including slots lent to other queues.
+// Slots are only taken while dispatching, so a queue which is not full stays so until it's polled
+func (q *concurrencyLimitedQueue) isFull() bool {
+	return atomic.LoadInt32(&q.inFlight)+atomic.LoadInt32(&q.lent) >= q.limit
+}
+
+// idle returns true if the queue can lend a slot, i.e. it has no queued
+// task waiting for the slot and not all of its slots are taken
+func (q *concurrencyLimitedQueue) idle() bool {
+	return q.TaskQueue.Len() == 0 && !q.isFull()
+}
+
+func (q *concurrencyLimitedQueue) release() {
+	q.onUpdate(atomic.AddInt32(&q.inFlight, -1))
+	q.onRelease()
+}
+
+func (q *concurrencyLimitedQueue) lend(
+	task *concurrencyLimitedTask,
+) {
+	q.borrowLock.Lock()
+	if q.borrowers == nil {
+		q.borrowers = make(map[*concurrencyLimitedTask]bool)
+	}
+	q.borrowers[task] = false
+	q.borrowLock.Unlock()
+	atomic.AddInt32(&q.lent, 1)
+}
+
+// returnSlot releases the slot lent to the task, the lender's tasks may become dispatchable
+func (q *concurrencyLimitedQueue) returnSlot(
+	task *concurrencyLimitedTask,
+) {
+	q.borrowLock.Lock()
+	delete(q.borrowers, task)
+	q.borrowLock.Unlock()
+	atomic.AddInt32(&q.lent, -1)
+	q.onRelease()
+}
+
+// reclaim asks a borrowing task to yield for each queued task of the queue, in addition to the
+// tasks already asked to yield. Borrowing tasks which are not PreemptibleTask keep their slots until
+// they complete. A task may be asked to yield before its execution starts if the processor buffers it
+func (q *concurrencyLimitedQueue) reclaim() {
+	if atomic.LoadInt32(&q.lent) == 0 {
+		return
+	}
+	numQueued := q.TaskQueue.Len()
+	if numQueued == 0 {
+		return
+	}
+
+	var preempted []PreemptibleTask
+	q.borrowLock.Lock()
+	numReclaiming := 0
+	for _, yielding := range q.borrowers {
+		if yielding {
+			numReclaiming++
+		}
+	}
+	for task, yielding := range q.borrowers {
+		if numReclaiming >= numQueued {
+			break
+		}
+		if yielding {
+			continue
+		}
+		q.borrowers[task] = true
+		numReclaiming++
+		if preemptibleTask, ok := unwrapSchedulerTask(task.PriorityTask).(PreemptibleTask); ok {
+			preempted = append(preempted, preemptibleTask)
+		}
+	}
+	q.borrowLock.Unlock()
+
+	// tasks may complete synchronously when asked to yield, which returns their slots
+	for _, task := range preempted {
+		q.pool.onReclaim(q.Priority())
+		task.Preempt()
+	}
+}
+
+// add adds the queue to the pool so that it can borrow from and lend to the other queues
+func (p *capacityPool) add(
+	queue *concurrencyLimitedQueue,
+) {
+	p.Lock()
+	defer p.Unlock()
+
+	queues := make([]*concurrencyLimitedQueue, 0, len(p.queues)+1)
+	for _, existing := range p.queues {
+		if existing.Priority() < queue.Priority() {
+			queues = append(queues, existing)
+		}
+	}
+	queues = append(queues, queue)
+	for _, existing := range p.queues {
+		if existing.Priority() > queue.Priority() {
+			queues = append(queues, existing)
+		}
+	}
+	queue.pool = p
+	p.queues = queues
+}
+
+// remove removes the queue of the priority from the pool
+func (p *capacityPool) remove(
+	priority int,
+) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.queues = removeConcurrencyLimitedQueue(p.queues, priority)
+}
+
+// lender returns the queue which can lend a slot to the borrower, slots are borrowed from the queue
+// of the lowest priority that is higher than the borrower's, keeping the slots of the highest priorities
+func (p *capacityPool) lender(
+	borrower *concurrencyLimitedQueue,
+) *concurrencyLimitedQueue {
+	p.Lock()
+	queues := p.queues
+	p.Unlock()
+
+	for idx := len(queues) - 1; idx >= 0; idx-- {
+		if queue := queues[idx]; queue.Priority() < borrower.Priority() && queue.idle() {
+			return queue
+		}
+	}
+	return nil
+}
+
+// add adds the queue to the queues whose execution shares are balanced
+func (s *executionShare) add(
+	queue *concurrencyLimitedQueue,
+) {
+	s.Lock()
+	defer s.Unlock()
+
+	queues := make([]*concurrencyLimitedQueue, 0, len(s.queues)+1)
+	queues = append(queues, s.queues...)
+	queue.share = s
+	s.queues = append(queues, queue)
+}
+
+// remove removes the queue of the priority from the queues whose execution shares are balanced
+func (s *executionShare) remove(
+	priority int,
+) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.queues = removeConcurrencyLimitedQueue(s.queues, priority)
+}
+
+// removeConcurrencyLimitedQueue returns a new list without the queue of the priority,
+// a new list is needed as the current one may be iterated without the lock
+func removeConcurrencyLimitedQueue(
+	queues []*concurrencyLimitedQueue,
+	priority int,
+) []*concurrencyLimitedQueue {
+	newQueues := make([]*concurrencyLimitedQueue, 0, len(queues))
+	for _, queue := range queues {
+		if queue.Priority() != priority {
+			newQueues = append(newQueues, queue)
+		}
+	}
+	return newQueues
+}
+
+// exceeded returns true if the share of the in-flight tasks taken by the queue exceeds the share of its weight,
+// both among the weighted queues with queued or in-flight tasks, and another weighted queue has a task which can
+// be dispatched instead. A queue without in-flight tasks is never throttled, nor is one without weight
+func (s *executionShare) exceeded(
+	queue *concurrencyLimitedQueue,
+) bool {
+	inFlight := atomic.LoadInt32(&queue.inFlight)
+	weights := s.weights()
+	weight := weights[queue.Priority()]
+	if inFlight == 0 || weight <= 0 {
+		return false
+	}
+
+	s.Lock()
+	queues := s.queues
+	s.Unlock()
+
+	totalInFlight, totalWeight := int64(0), int64(0)
+	contended := false
+	for _, other := range queues {
+		otherWeight := weights[other.Priority()]
+		if otherWeight <= 0 {
+			continue
+		}
+		otherInFlight := atomic.LoadInt32(&other.inFlight)
+		queued := other.TaskQueue.Len() != 0
+		if otherInFlight == 0 && !queued {
+			continue
+		}
+		totalInFlight += int64(otherInFlight)
+		totalWeight += int64(otherWeight)
+		if other != queue && queued && !other.isFull() {
+			contended = true
+		}
+	}
+	return contended && int64(inFlight)*totalWeight > int64(weight)*totalInFlight
+}
+
+// shares returns the share of the tasks polled from each queue since the last call, and the share
+// of the in-flight tasks taken by each queue, both keyed by priority. Priorities are omitted if
+// no task is polled or in-flight respectively
+func (s *executionShare) shares() (map[int]float64, map[int]float64) {
+	s.Lock()
+	queues := s.queues
+	s.Unlock()
+
+	dispatched := make(map[int]int32, len(queues))
+	inFlight := make(map[int]int32, len(queues))
+	totalDispatched, totalInFlight := int32(0), int32(0)
+	for _, queue := range queues {
+		dispatched[queue.Priority()] = atomic.SwapInt32(&queue.dispatched, 0)
+		inFlight[queue.Priority()] = atomic.LoadInt32(&queue.inFlight)
+		totalDispatched += dispatched[queue.Priority()]
+		totalInFlight += inFlight[queue.Priority()]
+	}
+
+	dispatchShares := make(map[int]float64, len(queues))
+	executionShares := make(map[int]float64, len(queues))
+	for priority := range dispatched {
+		if dispatched[priority] != 0 {
+			dispatchShares[priority] = float64(dispatched[priority]) / float64(totalDispatched)
+		}
+		if inFlight[priority] != 0 {
+			executionShares[priority] = float64(inFlight[priority]) / float64(totalInFlight)
+		}
+	}
+	return dispatchShares, executionShares
+}
+
+func (t *concurrencyLimitedTask) Ack() {
+	t.PriorityTask.Ack()
+	t.release()
+}
+
+func (t *concurrencyLimitedTask) Nack() {
+	t.PriorityTask.Nack()
+	t.release()
+}
+
+func (t *concurrencyLimitedTask) retryState() (int, int, time.Time, bool) {
+	if provider, ok := t.PriorityTask.(retryStateProvider); ok {
+		return provider.retryState()
+	}
+	return 0, 0, time.Time{}, false
+}
+
+func (t *concurrencyLimitedTask) release() {
+	t.once.Do(func() {
+		if t.cost != nil {
+			// refunded before the slot is released, which notifies the dispatchers
+			t.queue.resources.release(t.cost)
+		}
+		if t.queue.executions != nil {
+			t.queue.executions.add(-1, time.Now())
+		}
+		if t.lender != nil {
+			t.lender.returnSlot(t)
+			return
+		}
+		t.queue.release()
+	})
+}
+
+func newConcurrencyIntegrator(
+	now time.Time,
+) *concurrencyIntegrator {
+	return &concurrencyIntegrator{
+		lastUpdate:  now,
+		windowStart: now,
+	}
+}
+
+// add changes the concurrency by delta at the given time
+func (c *concurrencyIntegrator) add(
+	delta int,
+	now time.Time,
+) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.advanceLocked(now)
+	c.concurrency += delta
+}
+
+// sample returns the average concurrency since the last sample, or since the
+// integrator is created, and starts a new sampling window at the given time
+func (c *concurrencyIntegrator) sample(
+	now time.Time,
+) float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	c.advanceLocked(now)
+	window := c.lastUpdate.Sub(c.windowStart)
+	average := float64(c.concurrency)
+	if window > 0 {
+		average = c.area / float64(window)
+	}
+	c.area = 0
+	c.windowStart = c.lastUpdate
+	return average
+}
+
+func (c *concurrencyIntegrator) advanceLocked(
+	now time.Time,
+) {
+	// the clock may go backwards between callers reading it and taking the lock
+	if now.After(c.lastUpdate) {
+		c.area += float64(c.concurrency) * float64(now.Sub(c.lastUpdate))
+		c.lastUpdate = now
+	}
+}
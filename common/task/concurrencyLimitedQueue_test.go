@@ -0,0 +1,211 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	concurrencyLimitedQueueSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestConcurrencyLimitedQueueSuite(t *testing.T) {
+	s := new(concurrencyLimitedQueueSuite)
+	suite.Run(t, s)
+}
+
+func (s *concurrencyLimitedQueueSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *concurrencyLimitedQueueSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *concurrencyLimitedQueueSuite) TestPoll() {
+	taskQueue := newTaskQueue(1, 10)
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Ack().AnyTimes()
+		mockTask.EXPECT().Nack().AnyTimes()
+		s.True(taskQueue.Offer(mockTask))
+	}
+
+	var inFlightUpdates []int32
+	numReleased := 0
+	queue := newConcurrencyLimitedQueue(
+		taskQueue,
+		2,
+		func(inFlight int32) { inFlightUpdates = append(inFlightUpdates, inFlight) },
+		func() { numReleased++ },
+	)
+
+	task1, ok := queue.Poll()
+	s.True(ok)
+	task2, ok := queue.Poll()
+	s.True(ok)
+
+	// limit reached
+	s.Zero(queue.Len())
+	_, ok = queue.Poll()
+	s.False(ok)
+	s.Equal(1, taskQueue.Len())
+
+	task1.Ack()
+	task1.Ack() // slot is only released once
+	s.Equal(1, queue.Len())
+	task3, ok := queue.Poll()
+	s.True(ok)
+
+	task2.Nack()
+	task3.Ack()
+	s.Equal([]int32{1, 2, 1, 2, 1, 0}, inFlightUpdates)
+	s.Equal(3, numReleased)
+}
+
+func (s *concurrencyLimitedQueueSuite) TestBorrowCapacity() {
+	var borrowed, reclaimed []int
+	pool := newCapacityPool(
+		func(priority int) { borrowed = append(borrowed, priority) },
+		func(priority int) { reclaimed = append(reclaimed, priority) },
+	)
+	newQueue := func(taskQueue TaskQueue) *concurrencyLimitedQueue {
+		queue := newConcurrencyLimitedQueue(taskQueue, 1, func(int32) {}, func() {})
+		pool.add(queue)
+		return queue
+	}
+	highTaskQueue := newTaskQueue(0, 10)
+	highQueue := newQueue(highTaskQueue)
+	lowTaskQueue := newTaskQueue(1, 10)
+	lowQueue := newQueue(lowTaskQueue)
+
+	var lowTasks []*MockPreemptibleTask
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPreemptibleTask(s.controller)
+		mockTask.EXPECT().Ack().AnyTimes()
+		s.True(lowTaskQueue.Offer(mockTask))
+		lowTasks = append(lowTasks, mockTask)
+	}
+
+	// the second task borrows the slot of the idle high priority queue
+	_, ok := lowQueue.Poll()
+	s.True(ok)
+	borrowingTask, ok := lowQueue.Poll()
+	s.True(ok)
+	s.Equal([]int{1}, borrowed)
+	s.Zero(lowQueue.Len())
+	_, ok = lowQueue.Poll()
+	s.False(ok)
+
+	// the borrowing task is asked to yield once high priority tasks are queued
+	s.True(highTaskQueue.Offer(NewMockPriorityTask(s.controller)))
+	lowTasks[1].EXPECT().Preempt().Times(1)
+	s.Zero(highQueue.Len())
+	s.Zero(highQueue.Len())
+	s.Equal([]int{0}, reclaimed)
+
+	borrowingTask.Ack()
+	s.Equal(1, highQueue.Len())
+	_, ok = highQueue.Poll()
+	s.True(ok)
+	s.Zero(lowQueue.Len())
+}
+
+func (s *concurrencyLimitedQueueSuite) TestExecutionShare() {
+	share := newExecutionShare(func() map[int]int {
+		return map[int]int{0: 2, 1: 1}
+	})
+	newQueue := func(taskQueue TaskQueue) *concurrencyLimitedQueue {
+		queue := newConcurrencyLimitedQueue(taskQueue, 10, func(int32) {}, func() {})
+		share.add(queue)
+		return queue
+	}
+	highTaskQueue := newTaskQueue(0, 10)
+	highQueue := newQueue(highTaskQueue)
+	lowTaskQueue := newTaskQueue(1, 10)
+	lowQueue := newQueue(lowTaskQueue)
+	offer := func(taskQueue TaskQueue) {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Ack().AnyTimes()
+		s.True(taskQueue.(*taskQueueImpl).Offer(mockTask))
+	}
+	for i := 0; i != 3; i++ {
+		offer(lowTaskQueue)
+	}
+
+	// low priority tasks can take all the workers until high priority tasks are queued
+	lowTask, ok := lowQueue.Poll()
+	s.True(ok)
+	_, ok = lowQueue.Poll()
+	s.True(ok)
+	offer(highTaskQueue)
+	offer(highTaskQueue)
+	s.Zero(lowQueue.Len())
+	_, ok = lowQueue.Poll()
+	s.False(ok)
+
+	// the low priority is throttled until its share of the in-flight tasks drops to 1/3
+	_, ok = highQueue.Poll()
+	s.True(ok)
+	s.Zero(lowQueue.Len())
+	_, ok = highQueue.Poll()
+	s.True(ok)
+	s.Equal(1, lowQueue.Len())
+
+	lowTask.Ack()
+	dispatchShares, executionShares := share.shares()
+	s.Equal(map[int]float64{0: 0.5, 1: 0.5}, dispatchShares)
+	s.InDelta(2.0/3, executionShares[0], 1e-9)
+	s.InDelta(1.0/3, executionShares[1], 1e-9)
+	dispatchShares, _ = share.shares()
+	s.Empty(dispatchShares)
+}
+
+func (s *concurrencyLimitedQueueSuite) TestConcurrencyIntegrator() {
+	now := time.Now()
+	integrator := newConcurrencyIntegrator(now)
+	s.Zero(integrator.sample(now))
+
+	integrator.add(2, now)
+	integrator.add(-1, now.Add(time.Second))
+	s.InDelta(1.5, integrator.sample(now.Add(2*time.Second)), 1e-9)
+
+	// each sample starts a new window
+	integrator.add(-1, now.Add(3*time.Second))
+	s.InDelta(0.5, integrator.sample(now.Add(4*time.Second)), 1e-9)
+
+	// an empty window reports the current concurrency
+	integrator.add(1, now.Add(4*time.Second))
+	s.Equal(float64(1), integrator.sample(now.Add(4*time.Second)))
+}
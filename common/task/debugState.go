@@ -0,0 +1,186 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/uber/cadence/common"
+)
+
+type (
+	// schedulerDebugState is a snapshot of the scheduler state written by WriteDebugState
+	schedulerDebugState struct {
+		time            time.Time
+		status          string
+		quiesced        bool
+		healthy         bool
+		unhealthyReason string
+		dispatcherState string
+		options         []byte
+		priorities      []PriorityDebugInfo
+		stats           WeightedRoundRobinTaskSchedulerStats
+		inFlightTasks   []InFlightTask
+		recentEvents    []SchedulerEvent
+	}
+)
+
+var schedulerStatusNames = map[int32]string{
+	common.DaemonStatusInitialized: "initialized",
+	common.DaemonStatusStarted:     "started",
+	common.DaemonStatusStopped:     "stopped",
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) WriteDebugState(
+	writer io.Writer,
+) error {
+	var buf bytes.Buffer
+	w.debugState().write(&buf)
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+// debugState captures the state of the scheduler, the queue depth and dispatch state of all
+// the priorities are captured at the same time, the other sections are captured one after another
+func (w *weightedRoundRobinTaskSchedulerImpl) debugState() *schedulerDebugState {
+	state := &schedulerDebugState{
+		time:            time.Now(),
+		status:          schedulerStatusNames[atomic.LoadInt32(&w.status)],
+		quiesced:        w.isQuiesced(),
+		dispatcherState: w.DispatcherState(),
+		priorities:      w.DispatchDebugState(),
+		stats:           w.Stats(),
+		inFlightTasks:   w.InFlightTasks(),
+		recentEvents:    w.RecentEvents(),
+	}
+	state.healthy, state.unhealthyReason = w.Healthy()
+	// fields without a JSON representation, e.g. durations and callbacks, are omitted
+	options, err := json.MarshalIndent(w.options, "", "  ")
+	if err != nil {
+		options = []byte(fmt.Sprintf("failed to encode options: %v", err))
+	}
+	state.options = options
+	return state
+}
+
+func (s *schedulerDebugState) write(
+	buf *bytes.Buffer,
+) {
+	fmt.Fprintf(buf, "time: %v\n", s.time.Format(time.RFC3339Nano))
+	fmt.Fprintf(buf, "status: %v\n", s.status)
+	fmt.Fprintf(buf, "quiesced: %v\n", s.quiesced)
+	if s.healthy {
+		fmt.Fprintf(buf, "healthy: true\n")
+	} else {
+		fmt.Fprintf(buf, "healthy: false (%v)\n", s.unhealthyReason)
+	}
+	fmt.Fprintf(buf, "dispatcher state: %v\n", s.dispatcherState)
+
+	fmt.Fprintf(buf, "\noptions:\n%s\n", s.options)
+
+	fmt.Fprintf(buf, "\npriorities:\n")
+	table := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "priority\tweight\tqueued\tdispatched in round\tlast serviced\n")
+	for _, priority := range s.priorities {
+		lastServiced := "never"
+		if !priority.LastServiced.IsZero() {
+			lastServiced = fmt.Sprintf("%v ago", s.time.Sub(priority.LastServiced))
+		}
+		fmt.Fprintf(
+			table,
+			"%v\t%v\t%v\t%v\t%v\n",
+			priority.Priority,
+			priority.Weight,
+			priority.QueueDepth,
+			priority.DispatchedInRound,
+			lastServiced,
+		)
+	}
+	table.Flush()
+	if s.stats.DynamicPriorityTasks != 0 {
+		fmt.Fprintf(buf, "dynamic priority tasks: %v\n", s.stats.DynamicPriorityTasks)
+	}
+
+	processor := s.stats.Processor
+	fmt.Fprintf(buf, "\nworkers:\n")
+	fmt.Fprintf(buf, "configured: %v, live: %v, busy: %v", processor.ConfiguredWorkers, processor.LiveWorkers, processor.BusyWorkers)
+	if processor.LiveWorkers != 0 {
+		fmt.Fprintf(buf, ", utilization: %.2f", float64(processor.BusyWorkers)/float64(processor.LiveWorkers))
+	}
+	fmt.Fprintf(
+		buf,
+		"\nprocessor queued: %v, retrying: %v, pending: %v, succeeded: %v, failed: %v\n",
+		processor.QueuedTasks,
+		processor.RetryingTasks,
+		processor.PendingTasks,
+		processor.SucceededTasks,
+		processor.FailedTasks,
+	)
+
+	fmt.Fprintf(buf, "\nin-flight tasks: %v\n", len(s.inFlightTasks))
+	table = tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	if len(s.inFlightTasks) != 0 {
+		fmt.Fprintf(table, "priority\trunning for\ttags\n")
+	}
+	for _, task := range s.inFlightTasks {
+		fmt.Fprintf(table, "%v\t%v\t%v\n", task.Priority, s.time.Sub(task.StartTime), formatDebugTags(task.Tags))
+	}
+	table.Flush()
+
+	fmt.Fprintf(buf, "\nrecent events: %v\n", len(s.recentEvents))
+	table = tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	if len(s.recentEvents) != 0 {
+		fmt.Fprintf(table, "time\ttype\tpriority\terror\n")
+	}
+	for _, event := range s.recentEvents {
+		errMessage := ""
+		if event.Err != nil {
+			errMessage = event.Err.Error()
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\n", event.Time.Format(time.RFC3339Nano), event.Type, event.Priority, errMessage)
+	}
+	table.Flush()
+}
+
+// formatDebugTags formats the tags sorted by key
+func formatDebugTags(
+	tags map[string]string,
+) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/uber/cadence/common/backoff"
+)
+
+type (
+	failingWriter struct{}
+)
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestWriteDebugState() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:           testSchedulerWeights,
+			QueueSize:         s.queueSize,
+			WorkerCount:       1,
+			DispatcherCount:   0,
+			RetryPolicy:       backoff.NewExponentialRetryPolicy(time.Millisecond),
+			EventRecorderSize: 10,
+		},
+	)
+	var buf bytes.Buffer
+	s.NoError(scheduler.WriteDebugState(&buf))
+	s.Contains(buf.String(), "status: initialized\n")
+	s.Contains(buf.String(), "healthy: false (scheduler is not started)\n")
+	s.Contains(buf.String(), "in-flight tasks: 0\n")
+	s.Contains(buf.String(), "recent events: 0\n")
+
+	for _, priority := range []int{0, 0, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+	}
+	_, _, ok := scheduler.nextTask()
+	s.True(ok)
+
+	buf.Reset()
+	s.NoError(scheduler.WriteDebugState(&buf))
+	report := buf.String()
+	s.Contains(report, `"queueSize": 1000`)
+	s.Contains(report, "dispatcher state: stopped\n")
+	s.Contains(report, "recent events: 3\n")
+	s.Contains(report, "workers:\nconfigured: 1")
+
+	// rows of the priorities table are the priority, weight, queued tasks and tasks dispatched in round
+	var rows [][]string
+	lines := strings.Split(report[strings.Index(report, "priorities:\n"):], "\n")
+	for _, line := range lines[2:] {
+		if line == "" {
+			break
+		}
+		rows = append(rows, strings.Fields(line)[:4])
+	}
+	s.Equal([][]string{{"0", "3", "1", "1"}, {"2", "1", "1", "0"}}, rows)
+
+	s.Error(scheduler.WriteDebugState(&failingWriter{}))
+}
+
+func (w *failingWriter) Write(_ []byte) (int, error) {
+	return 0, errors.New("failed to write")
+}
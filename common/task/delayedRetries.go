@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// delayedRetries holds the tasks requeued for retry until their retry backoff elapses, so that
+	// waiting out the backoff doesn't occupy a worker. Each held task has a slot reserved in the
+	// queue of its priority, and is committed to the queue once its timer fires
+	delayedRetries struct {
+		sync.Mutex
+
+		closed bool
+		timers map[*requeuedTask]*time.Timer
+	}
+)
+
+func newDelayedRetries() *delayedRetries {
+	return &delayedRetries{
+		timers: make(map[*requeuedTask]*time.Timer),
+	}
+}
+
+// add holds the task for the delay and then invokes commit with the lock held, so that the task is
+// either committed or returned by close. Returns false without holding the task if it's closed
+func (d *delayedRetries) add(
+	task *requeuedTask,
+	delay time.Duration,
+	commit func(task *requeuedTask),
+) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return false
+	}
+	d.timers[task] = time.AfterFunc(delay, func() {
+		d.Lock()
+		defer d.Unlock()
+
+		if _, ok := d.timers[task]; !ok {
+			// returned by close
+			return
+		}
+		delete(d.timers, task)
+		commit(task)
+	})
+	return true
+}
+
+// close stops holding tasks, and returns the tasks still held
+func (d *delayedRetries) close() []PriorityTask {
+	d.Lock()
+	defer d.Unlock()
+
+	d.closed = true
+	tasks := make([]PriorityTask, 0, len(d.timers))
+	for task, timer := range d.timers {
+		timer.Stop()
+		tasks = append(tasks, task)
+	}
+	d.timers = make(map[*requeuedTask]*time.Timer)
+	return tasks
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelayedRetries(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	delayedRetries := newDelayedRetries()
+	committedCh := make(chan *requeuedTask, 1)
+	commit := func(task *requeuedTask) { committedCh <- task }
+
+	readyTask := &requeuedTask{taskWrapper: taskWrapper{PriorityTask: NewMockPriorityTask(controller)}}
+	require.True(t, delayedRetries.add(readyTask, time.Millisecond, commit))
+	require.True(t, <-committedCh == readyTask)
+
+	// tasks still held are returned on close instead of being committed
+	heldTask := &requeuedTask{taskWrapper: taskWrapper{PriorityTask: NewMockPriorityTask(controller)}}
+	require.True(t, delayedRetries.add(heldTask, time.Hour, commit))
+	tasks := delayedRetries.close()
+	require.Len(t, tasks, 1)
+	require.True(t, tasks[0] == heldTask)
+	require.False(t, delayedRetries.add(heldTask, time.Millisecond, commit))
+	require.Empty(t, committedCh)
+}
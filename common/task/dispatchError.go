@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// DispatchError is the error passed to DispatchErrorHandler when a task fails to be submitted to
+	// the processor, it wraps the error returned by the processor, which can be inspected via errors.As
+	// or errors.Is on the DispatchError
+	DispatchError struct {
+		// Err is the error returned by the processor
+		Err error
+		// Priority is the priority of the queue the task is dispatched from
+		Priority int
+		// EnqueueTime is when the task is added to its priority queue,
+		// it's zero if the task is not dispatched from a queue
+		EnqueueTime time.Time
+	}
+)
+
+func (e *DispatchError) Error() string {
+	return fmt.Sprintf("failed to dispatch task with priority %v: %v", e.Priority, e.Err)
+}
+
+// Unwrap returns the error returned by the processor
+func (e *DispatchError) Unwrap() error {
+	return e.Err
+}
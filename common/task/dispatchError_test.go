@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatchError(t *testing.T) {
+	submitErr := errors.New("some random error")
+	enqueueTime := time.Now()
+	var err error = &DispatchError{
+		Err:         submitErr,
+		Priority:    2,
+		EnqueueTime: enqueueTime,
+	}
+	err = fmt.Errorf("wrapped: %w", err)
+
+	require.True(t, errors.Is(err, submitErr))
+	var dispatchErr *DispatchError
+	require.True(t, errors.As(err, &dispatchErr))
+	require.Equal(t, 2, dispatchErr.Priority)
+	require.Equal(t, enqueueTime, dispatchErr.EnqueueTime)
+	require.Equal(t, "failed to dispatch task with priority 2: some random error", dispatchErr.Error())
+}
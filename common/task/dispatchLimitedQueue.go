@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+type (
+	// dispatchLimitedQueue wraps a task queue and only exposes the task at the head
+	// of the queue to the dispatch strategy if it's allowed by the limiter. When the
+	// head is denied, the queue appears empty, so that the priority is skipped in the
+	// current round while the order of the tasks in the queue is preserved
+	dispatchLimitedQueue struct {
+		TaskQueue
+
+		queue   *taskQueueImpl
+		limiter DispatchLimiter
+		// evictExpired, if specified, evicts the expired tasks
+		// so that the limiter is not consulted for them
+		evictExpired func()
+		// onDenied is invoked when the head of the queue is denied by the limiter
+		onDenied func()
+	}
+)
+
+func newDispatchLimitedQueue(
+	queue *taskQueueImpl,
+	limiter DispatchLimiter,
+	evictExpired func(),
+	onDenied func(),
+) *dispatchLimitedQueue {
+	return &dispatchLimitedQueue{
+		TaskQueue:    queue,
+		queue:        queue,
+		limiter:      limiter,
+		evictExpired: evictExpired,
+		onDenied:     onDenied,
+	}
+}
+
+// Poll must not be invoked concurrently, which is guaranteed
+// as dispatch strategies are invoked under the dispatch lock
+func (q *dispatchLimitedQueue) Poll() (PriorityTask, bool) {
+	if q.evictExpired != nil {
+		q.evictExpired()
+	}
+
+	task, ok := q.queue.Peek()
+	if !ok {
+		return nil, false
+	}
+	if !q.limiter.Allow(task) {
+		q.onDenied()
+		return nil, false
+	}
+	return q.queue.Poll()
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	dispatchLimitedQueueSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller  *gomock.Controller
+		mockLimiter *MockDispatchLimiter
+	}
+)
+
+func TestDispatchLimitedQueueSuite(t *testing.T) {
+	s := new(dispatchLimitedQueueSuite)
+	suite.Run(t, s)
+}
+
+func (s *dispatchLimitedQueueSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockLimiter = NewMockDispatchLimiter(s.controller)
+}
+
+func (s *dispatchLimitedQueueSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *dispatchLimitedQueueSuite) TestPoll() {
+	numDenied := 0
+	taskQueue := newTaskQueue(1, 3)
+	queue := newDispatchLimitedQueue(taskQueue, s.mockLimiter, nil, func() { numDenied++ })
+
+	_, ok := queue.Poll()
+	s.False(ok)
+
+	mockTask1 := NewMockPriorityTask(s.controller)
+	mockTask2 := NewMockPriorityTask(s.controller)
+	s.True(taskQueue.Offer(mockTask1))
+	s.True(taskQueue.Offer(mockTask2))
+
+	s.mockLimiter.EXPECT().Allow(mockTask1).Return(false).Times(1)
+	_, ok = queue.Poll()
+	s.False(ok)
+	s.Equal(1, numDenied)
+	s.Equal(2, queue.Len())
+
+	// denied task stays at the head of the queue
+	s.mockLimiter.EXPECT().Allow(mockTask1).Return(true).Times(1)
+	task, ok := queue.Poll()
+	s.True(ok)
+	s.Equal(mockTask1, task)
+	s.Equal(1, numDenied)
+}
+
+func (s *dispatchLimitedQueueSuite) TestPoll_EvictExpired() {
+	taskQueue := newTaskQueue(1, 3)
+	mockTask1 := NewMockPriorityTask(s.controller)
+	mockTask2 := NewMockPriorityTask(s.controller)
+	s.True(taskQueue.Offer(mockTask1))
+	s.True(taskQueue.Offer(mockTask2))
+
+	// the limiter is not consulted for the expired task
+	evictExpired := func() {
+		if task, ok := taskQueue.Peek(); ok && task == mockTask1 {
+			taskQueue.Poll()
+		}
+	}
+	queue := newDispatchLimitedQueue(taskQueue, s.mockLimiter, evictExpired, func() {})
+	s.mockLimiter.EXPECT().Allow(mockTask2).Return(true).Times(1)
+	task, ok := queue.Poll()
+	s.True(ok)
+	s.Equal(mockTask2, task)
+}
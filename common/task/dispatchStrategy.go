@@ -0,0 +1,292 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"math"
+)
+
+type (
+	// WeightedRoundRobinDispatchStrategy dispatches tasks in rounds, in each round
+	// at most weight number of tasks are dispatched from the queue of each priority.
+	// If a min dispatch is specified for a priority, each round starts with a guaranteed
+	// pass which dispatches up to that number of tasks from the priority, those tasks
+	// are deducted from the weight of the priority in the following weighted pass
+	WeightedRoundRobinDispatchStrategy struct {
+		weights     func() map[int]int
+		minDispatch map[int]int
+
+		// index of the queue currently being serviced
+		index int
+		// whether the current pass is the guaranteed pass
+		guaranteedPass bool
+		// number of tasks can still be dispatched in the current pass, keyed by priority
+		credits map[int]int
+		// number of tasks dispatched in the current round, keyed by priority
+		roundDispatched map[int]int
+		// weights used by the current round, keyed by priority
+		roundWeights map[int]int
+		// whether any task is dispatched in the current round
+		dispatched bool
+		inRound    bool
+	}
+
+	// StrictPriorityDispatchStrategy always dispatches from the non-empty queue with
+	// the lowest priority value, tasks with higher priority values may starve
+	StrictPriorityDispatchStrategy struct{}
+
+	// VirtualTimeFairQueuingDispatchStrategy is a start-time fair queuing strategy. Each task is assigned a
+	// virtual start time, the later of the virtual clock when it reaches the head of its queue and the virtual
+	// finish time of the previous task of the same priority, and a virtual finish time, its start time plus the
+	// inverse of its priority's weight. The task with the smallest virtual finish time is always dispatched
+	// next, and the virtual clock advances to its start time. This shares the dispatches in proportion to the
+	// weights over any period in which the priorities are backlogged, regardless of burst patterns, while WRR
+	// only does so per round. Ties are broken in favor of the lower priority value, and priorities with no
+	// weight are never dispatched
+	VirtualTimeFairQueuingDispatchStrategy struct {
+		weights func() map[int]int
+
+		virtualTime float64
+		// virtual finish time of the last task dispatched, keyed by priority
+		finishTimes map[int]float64
+		// virtual start time of the task at the head of each non-empty queue, keyed by priority
+		headStartTimes map[int]float64
+	}
+)
+
+var (
+	_ DispatchStrategy = (*WeightedRoundRobinDispatchStrategy)(nil)
+	_ DispatchStrategy = (*StrictPriorityDispatchStrategy)(nil)
+	_ DispatchStrategy = (*VirtualTimeFairQueuingDispatchStrategy)(nil)
+)
+
+// NewWeightedRoundRobinDispatchStrategy creates a new WRR dispatch strategy,
+// the weights are loaded at the beginning of each round. minDispatch specifies
+// the number of tasks guaranteed to be dispatched per round for each priority
+// (if it has them), regardless of its weight, it can be nil
+func NewWeightedRoundRobinDispatchStrategy(
+	weights func() map[int]int,
+	minDispatch map[int]int,
+) *WeightedRoundRobinDispatchStrategy {
+	return &WeightedRoundRobinDispatchStrategy{
+		weights:         weights,
+		minDispatch:     minDispatch,
+		credits:         make(map[int]int),
+		roundDispatched: make(map[int]int),
+	}
+}
+
+// Next implements DispatchStrategy
+func (s *WeightedRoundRobinDispatchStrategy) Next(
+	queues []TaskQueue,
+) (PriorityTask, bool) {
+	if !s.inRound {
+		s.startNewRound()
+	}
+
+	for {
+		if s.index >= len(queues) {
+			if s.guaranteedPass {
+				s.startWeightedPass()
+				continue
+			}
+			// current round is finished, stop if nothing
+			// can be dispatched, otherwise start a new one
+			if !s.dispatched {
+				s.inRound = false
+				return nil, false
+			}
+			s.startNewRound()
+		}
+
+		queue := queues[s.index]
+		priority := queue.Priority()
+		if s.credits[priority] > 0 {
+			if task, ok := queue.Poll(); ok {
+				s.credits[priority]--
+				s.roundDispatched[priority]++
+				s.dispatched = true
+				return task, true
+			}
+		}
+		s.index++
+	}
+}
+
+func (s *WeightedRoundRobinDispatchStrategy) startNewRound() {
+	s.dispatched = false
+	s.inRound = true
+	s.roundWeights = s.weights()
+	for priority := range s.roundDispatched {
+		delete(s.roundDispatched, priority)
+	}
+	if len(s.minDispatch) == 0 {
+		s.startWeightedPass()
+		return
+	}
+
+	s.index = 0
+	s.guaranteedPass = true
+	for priority := range s.credits {
+		delete(s.credits, priority)
+	}
+	for priority, minDispatch := range s.minDispatch {
+		s.credits[priority] = minDispatch
+	}
+}
+
+func (s *WeightedRoundRobinDispatchStrategy) startWeightedPass() {
+	s.index = 0
+	s.guaranteedPass = false
+	for priority := range s.credits {
+		delete(s.credits, priority)
+	}
+	for priority, weight := range s.roundWeights {
+		if credit := weight - s.roundDispatched[priority]; credit > 0 {
+			s.credits[priority] = credit
+		}
+	}
+}
+
+// abortRound ends the current round, so that the next call to Next starts a new
+// round from the first queue, returns false if no round is in progress
+func (s *WeightedRoundRobinDispatchStrategy) abortRound() bool {
+	if !s.inRound {
+		return false
+	}
+	s.inRound = false
+	return true
+}
+
+// dispatchedInRound returns the number of tasks dispatched
+// for the priority in the current round
+func (s *WeightedRoundRobinDispatchStrategy) dispatchedInRound(
+	priority int,
+) int {
+	if !s.inRound {
+		return 0
+	}
+	return s.roundDispatched[priority]
+}
+
+// NewStrictPriorityDispatchStrategy creates a new strict priority dispatch strategy
+func NewStrictPriorityDispatchStrategy() *StrictPriorityDispatchStrategy {
+	return &StrictPriorityDispatchStrategy{}
+}
+
+// Next implements DispatchStrategy
+func (s *StrictPriorityDispatchStrategy) Next(
+	queues []TaskQueue,
+) (PriorityTask, bool) {
+	for _, queue := range queues {
+		if task, ok := queue.Poll(); ok {
+			return task, true
+		}
+	}
+	return nil, false
+}
+
+// NewVirtualTimeFairQueuingDispatchStrategy creates a new virtual time fair
+// queuing dispatch strategy, the weights are loaded for each dispatch
+func NewVirtualTimeFairQueuingDispatchStrategy(
+	weights func() map[int]int,
+) *VirtualTimeFairQueuingDispatchStrategy {
+	return &VirtualTimeFairQueuingDispatchStrategy{
+		weights:        weights,
+		finishTimes:    make(map[int]float64),
+		headStartTimes: make(map[int]float64),
+	}
+}
+
+// Next implements DispatchStrategy
+func (s *VirtualTimeFairQueuingDispatchStrategy) Next(
+	queues []TaskQueue,
+) (PriorityTask, bool) {
+	weights := s.weights()
+	// queues which fail to be polled although not empty, e.g. when the task is denied
+	// by the dispatch limiter, are skipped so that other queues can be dispatched from
+	var skipped map[int]struct{}
+	for {
+		selected := -1
+		var selectedStartTime, selectedFinishTime float64
+		backlogged := false
+		for idx, queue := range queues {
+			if _, ok := skipped[idx]; ok {
+				backlogged = true
+				continue
+			}
+			priority := queue.Priority()
+			if queue.Len() == 0 {
+				delete(s.headStartTimes, priority)
+				continue
+			}
+			backlogged = true
+
+			weight := weights[priority]
+			if weight <= 0 {
+				continue
+			}
+			startTime, ok := s.headStartTimes[priority]
+			if !ok {
+				startTime = math.Max(s.virtualTime, s.finishTimes[priority])
+				s.headStartTimes[priority] = startTime
+			}
+			finishTime := startTime + 1/float64(weight)
+			if selected == -1 || finishTime < selectedFinishTime {
+				selected = idx
+				selectedStartTime = startTime
+				selectedFinishTime = finishTime
+			}
+		}
+
+		if selected == -1 {
+			if !backlogged {
+				// the virtual clock restarts after an idle period,
+				// which keeps the virtual times from growing indefinitely
+				s.reset()
+			}
+			return nil, false
+		}
+
+		if task, ok := queues[selected].Poll(); ok {
+			priority := queues[selected].Priority()
+			s.virtualTime = selectedStartTime
+			s.finishTimes[priority] = selectedFinishTime
+			// the next task of the priority starts once the dispatched one finishes
+			s.headStartTimes[priority] = selectedFinishTime
+			return task, true
+		}
+		if skipped == nil {
+			skipped = make(map[int]struct{})
+		}
+		skipped[selected] = struct{}{}
+	}
+}
+
+func (s *VirtualTimeFairQueuingDispatchStrategy) reset() {
+	s.virtualTime = 0
+	for priority := range s.finishTimes {
+		delete(s.finishTimes, priority)
+	}
+	for priority := range s.headStartTimes {
+		delete(s.headStartTimes, priority)
+	}
+}
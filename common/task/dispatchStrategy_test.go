@@ -0,0 +1,250 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	dispatchStrategySuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestDispatchStrategySuite(t *testing.T) {
+	s := new(dispatchStrategySuite)
+	suite.Run(t, s)
+}
+
+func (s *dispatchStrategySuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *dispatchStrategySuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *dispatchStrategySuite) TestWeightedRoundRobin() {
+	weights := map[int]int{0: 3, 1: 2, 2: 1}
+	queues := s.newTestTaskQueues(map[int]int{0: 4, 1: 4, 2: 1})
+	strategy := NewWeightedRoundRobinDispatchStrategy(func() map[int]int { return weights }, nil)
+
+	expectedPriorities := []int{
+		0, 0, 0, 1, 1, 2, // round 1
+		0, 1, 1, // round 2
+	}
+	for _, expectedPriority := range expectedPriorities {
+		task, ok := strategy.Next(queues)
+		s.True(ok)
+		s.Equal(expectedPriority, task.Priority())
+	}
+
+	_, ok := strategy.Next(queues)
+	s.False(ok)
+
+	// strategy can be used again after new tasks are added
+	s.True(queues[2].(*taskQueueImpl).Offer(s.newTestTask(2)))
+	task, ok := strategy.Next(queues)
+	s.True(ok)
+	s.Equal(2, task.Priority())
+}
+
+func (s *dispatchStrategySuite) TestWeightedRoundRobin_ZeroWeight() {
+	weights := map[int]int{0: 1, 1: 0}
+	queues := s.newTestTaskQueues(map[int]int{0: 1, 1: 1})
+	strategy := NewWeightedRoundRobinDispatchStrategy(func() map[int]int { return weights }, nil)
+
+	task, ok := strategy.Next(queues)
+	s.True(ok)
+	s.Equal(0, task.Priority())
+
+	_, ok = strategy.Next(queues)
+	s.False(ok)
+	s.Equal(1, queues[1].Len())
+
+	weights = map[int]int{0: 1, 1: 1}
+	task, ok = strategy.Next(queues)
+	s.True(ok)
+	s.Equal(1, task.Priority())
+}
+
+func (s *dispatchStrategySuite) TestWeightedRoundRobin_MinDispatch() {
+	weights := map[int]int{0: 100, 1: 1}
+	queues := s.newTestTaskQueues(map[int]int{0: 250, 1: 10})
+	strategy := NewWeightedRoundRobinDispatchStrategy(
+		func() map[int]int { return weights },
+		map[int]int{1: 3},
+	)
+
+	for round := 0; round != 2; round++ {
+		// guaranteed pass dispatches from the low weight priority first
+		for i := 0; i != 3; i++ {
+			task, ok := strategy.Next(queues)
+			s.True(ok)
+			s.Equal(1, task.Priority())
+			s.Equal(i+1, strategy.dispatchedInRound(1))
+		}
+		// the weight of priority 1 is used up by the guaranteed pass
+		for i := 0; i != 100; i++ {
+			task, ok := strategy.Next(queues)
+			s.True(ok)
+			s.Equal(0, task.Priority())
+		}
+	}
+	s.Equal(4, queues[1].Len())
+	s.Equal(50, queues[0].Len())
+}
+
+func (s *dispatchStrategySuite) TestStrictPriority() {
+	queues := s.newTestTaskQueues(map[int]int{0: 2, 1: 1})
+	strategy := NewStrictPriorityDispatchStrategy()
+
+	for _, expectedPriority := range []int{0, 0, 1} {
+		task, ok := strategy.Next(queues)
+		s.True(ok)
+		s.Equal(expectedPriority, task.Priority())
+	}
+
+	_, ok := strategy.Next(queues)
+	s.False(ok)
+	_, ok = strategy.Next(nil)
+	s.False(ok)
+}
+
+func (s *dispatchStrategySuite) TestVirtualTimeFairQueuing() {
+	weights := map[int]int{0: 3, 1: 2, 2: 1}
+	queues := s.newTestTaskQueues(map[int]int{0: 60, 1: 60, 2: 60})
+	strategy := NewVirtualTimeFairQueuingDispatchStrategy(func() map[int]int { return weights })
+
+	// the number of tasks dispatched for each priority never
+	// deviates from its share by more than one task
+	dispatched := make(map[int]int)
+	for numDispatched := 1; numDispatched <= 60; numDispatched++ {
+		task, ok := strategy.Next(queues)
+		s.True(ok)
+		dispatched[task.Priority()]++
+		for priority, weight := range weights {
+			share := float64(numDispatched*weight) / 6
+			s.InDelta(share, dispatched[priority], 1)
+		}
+	}
+	s.Equal(map[int]int{0: 30, 1: 20, 2: 10}, dispatched)
+}
+
+func (s *dispatchStrategySuite) TestVirtualTimeFairQueuing_Burst() {
+	weights := map[int]int{0: 1, 1: 1}
+	queues := s.newTestTaskQueues(map[int]int{0: 20, 1: 0})
+	queues[1] = newTaskQueue(1, 10)
+	strategy := NewVirtualTimeFairQueuingDispatchStrategy(func() map[int]int { return weights })
+
+	for i := 0; i != 10; i++ {
+		task, ok := strategy.Next(queues)
+		s.True(ok)
+		s.Equal(0, task.Priority())
+	}
+
+	// priority 1 gets no credit for the time it was idle
+	for i := 0; i != 10; i++ {
+		s.True(queues[1].(*taskQueueImpl).Offer(s.newTestTask(1)))
+	}
+	for i := 0; i != 10; i++ {
+		for _, expectedPriority := range []int{1, 0} {
+			task, ok := strategy.Next(queues)
+			s.True(ok)
+			s.Equal(expectedPriority, task.Priority())
+		}
+	}
+
+	// virtual clock restarts once all the queues are empty
+	_, ok := strategy.Next(queues)
+	s.False(ok)
+	s.Zero(strategy.virtualTime)
+	s.Empty(strategy.finishTimes)
+}
+
+func (s *dispatchStrategySuite) TestVirtualTimeFairQueuing_ZeroWeight() {
+	weights := map[int]int{0: 1, 1: 0}
+	queues := s.newTestTaskQueues(map[int]int{0: 1, 1: 1})
+	strategy := NewVirtualTimeFairQueuingDispatchStrategy(func() map[int]int { return weights })
+
+	task, ok := strategy.Next(queues)
+	s.True(ok)
+	s.Equal(0, task.Priority())
+
+	_, ok = strategy.Next(queues)
+	s.False(ok)
+	s.Equal(1, queues[1].Len())
+
+	weights = map[int]int{0: 1, 1: 1}
+	task, ok = strategy.Next(queues)
+	s.True(ok)
+	s.Equal(1, task.Priority())
+}
+
+func (s *dispatchStrategySuite) TestVirtualTimeFairQueuing_SkipUnpollableQueue() {
+	weights := map[int]int{0: 2, 1: 1}
+	queues := s.newTestTaskQueues(map[int]int{0: 1, 1: 1})
+	mockLimiter := NewMockDispatchLimiter(s.controller)
+	mockLimiter.EXPECT().Allow(gomock.Any()).Return(false).Times(2)
+	limitedQueue := queues[0].(*taskQueueImpl)
+	queues[0] = newDispatchLimitedQueue(limitedQueue, mockLimiter, func() {}, func() {})
+	strategy := NewVirtualTimeFairQueuingDispatchStrategy(func() map[int]int { return weights })
+
+	task, ok := strategy.Next(queues)
+	s.True(ok)
+	s.Equal(1, task.Priority())
+
+	_, ok = strategy.Next(queues)
+	s.False(ok)
+	s.Equal(1, limitedQueue.Len())
+}
+
+func (s *dispatchStrategySuite) newTestTaskQueues(
+	numTasks map[int]int,
+) []TaskQueue {
+	queues := make([]TaskQueue, len(numTasks))
+	for priority, num := range numTasks {
+		queue := newTaskQueue(priority, num+1)
+		for i := 0; i != num; i++ {
+			s.True(queue.Offer(s.newTestTask(priority)))
+		}
+		queues[priority] = queue
+	}
+	return queues
+}
+
+func (s *dispatchStrategySuite) newTestTask(
+	priority int,
+) PriorityTask {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+	return mockTask
+}
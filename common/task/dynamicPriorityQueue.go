@@ -0,0 +1,252 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type (
+	// dynamicPriorityQueue holds the DynamicPriorityTasks of a WRR task scheduler created with
+	// DynamicPriority. Unlike the per priority task queues, which are FIFO, the current priorities
+	// of all held tasks are re-evaluated each time the queue is peeked, so that the task with the
+	// highest current priority is at the top. Tasks with the same priority are in submission order
+	dynamicPriorityQueue struct {
+		// slotsCh bounds the number of held tasks, a slot is
+		// taken before a task is added and released after it's removed
+		slotsCh chan struct{}
+
+		sync.Mutex
+		entries dynamicPriorityHeap
+		nextSeq int64
+		closed  bool
+	}
+
+	dynamicPriorityHeap struct {
+		entries []*dynamicPriorityEntry
+		// less returns true if the first priority is higher than the second
+		less func(a, b int) bool
+	}
+
+	dynamicPriorityEntry struct {
+		task        PriorityTask
+		dynamicTask DynamicPriorityTask
+		// priority is the current priority of the task when the queue is last peeked
+		priority int
+		// submittedPriority is the priority the task is submitted with
+		submittedPriority int
+		seq               int64
+		enqueueTime       time.Time
+		// index is the index of the entry in the heap, or -1 once it's removed
+		index int
+	}
+
+	// dynamicPriorityView exposes the top of a dynamicPriorityQueue to the dispatch strategy as
+	// if it were at the head of the task queue of its current priority, for a single dispatch
+	dynamicPriorityView struct {
+		TaskQueue
+		queue  *dynamicPriorityQueue
+		entry  *dynamicPriorityEntry
+		onPoll func(priority int, enqueueTime time.Time)
+	}
+)
+
+func newDynamicPriorityQueue(
+	capacity int,
+	less func(a, b int) bool,
+) *dynamicPriorityQueue {
+	if capacity <= 0 {
+		// a queue without capacity can never accept a task
+		capacity = 1
+	}
+
+	return &dynamicPriorityQueue{
+		slotsCh: make(chan struct{}, capacity),
+		entries: dynamicPriorityHeap{less: less},
+	}
+}
+
+// put blocks until the task is added and returns the number of tasks held before it,
+// returns false if either shutdownCh is closed first or the queue is closed. A zero
+// enqueueTime means the task is enqueued when it's added
+func (q *dynamicPriorityQueue) put(
+	task PriorityTask,
+	dynamicTask DynamicPriorityTask,
+	enqueueTime time.Time,
+	shutdownCh <-chan struct{},
+) (int, bool) {
+	select {
+	case q.slotsCh <- struct{}{}:
+	case <-shutdownCh:
+		return 0, false
+	}
+	return q.add(task, dynamicTask, enqueueTime)
+}
+
+// offer adds the task only if the queue is neither full nor closed
+func (q *dynamicPriorityQueue) offer(
+	task PriorityTask,
+	dynamicTask DynamicPriorityTask,
+) bool {
+	select {
+	case q.slotsCh <- struct{}{}:
+	default:
+		return false
+	}
+	_, ok := q.add(task, dynamicTask, time.Time{})
+	return ok
+}
+
+func (q *dynamicPriorityQueue) add(
+	task PriorityTask,
+	dynamicTask DynamicPriorityTask,
+	enqueueTime time.Time,
+) (int, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		<-q.slotsCh
+		return 0, false
+	}
+	position := q.entries.Len()
+	heap.Push(&q.entries, &dynamicPriorityEntry{
+		task:              task,
+		dynamicTask:       dynamicTask,
+		priority:          dynamicTask.CurrentPriority(),
+		submittedPriority: task.Priority(),
+		seq:               q.nextSeq,
+		enqueueTime:       enqueueTimeOrNow(enqueueTime),
+	})
+	q.nextSeq++
+	return position, true
+}
+
+// peek re-evaluates the current priorities of all held tasks, which takes
+// linear time, and returns the entry of the task with the highest priority
+func (q *dynamicPriorityQueue) peek() (*dynamicPriorityEntry, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.entries.Len() == 0 {
+		return nil, false
+	}
+	for _, entry := range q.entries.entries {
+		entry.priority = entry.dynamicTask.CurrentPriority()
+	}
+	heap.Init(&q.entries)
+	return q.entries.entries[0], true
+}
+
+// remove removes the entry, returns false if it's already removed
+func (q *dynamicPriorityQueue) remove(
+	entry *dynamicPriorityEntry,
+) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if entry.index < 0 {
+		return false
+	}
+	heap.Remove(&q.entries, entry.index)
+	<-q.slotsCh
+	return true
+}
+
+func (q *dynamicPriorityQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.entries.Len()
+}
+
+// close removes and returns all held tasks, tasks can't be added afterwards
+func (q *dynamicPriorityQueue) close() []PriorityTask {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	tasks := make([]PriorityTask, 0, q.entries.Len())
+	for q.entries.Len() != 0 {
+		tasks = append(tasks, heap.Pop(&q.entries).(*dynamicPriorityEntry).task)
+		<-q.slotsCh
+	}
+	return tasks
+}
+
+func (h *dynamicPriorityHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *dynamicPriorityHeap) Less(i, j int) bool {
+	if h.entries[i].priority != h.entries[j].priority {
+		return h.less(h.entries[i].priority, h.entries[j].priority)
+	}
+	return h.entries[i].seq < h.entries[j].seq
+}
+
+func (h *dynamicPriorityHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *dynamicPriorityHeap) Push(x interface{}) {
+	entry := x.(*dynamicPriorityEntry)
+	entry.index = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *dynamicPriorityHeap) Pop() interface{} {
+	last := len(h.entries) - 1
+	entry := h.entries[last]
+	h.entries[last] = nil
+	h.entries = h.entries[:last]
+	entry.index = -1
+	return entry
+}
+
+func (v *dynamicPriorityView) Len() int {
+	numTasks := v.TaskQueue.Len()
+	if v.entry != nil {
+		numTasks++
+	}
+	return numTasks
+}
+
+// Poll returns the held task before the tasks in the task queue, SetPriority
+// is called with the priority of the task queue before the task is returned
+func (v *dynamicPriorityView) Poll() (PriorityTask, bool) {
+	if entry := v.entry; entry != nil {
+		v.entry = nil
+		if v.queue.remove(entry) {
+			priority := v.Priority()
+			entry.task.SetPriority(priority)
+			if v.onPoll != nil {
+				v.onPoll(priority, entry.enqueueTime)
+			}
+			return entry.task, true
+		}
+	}
+	return v.TaskQueue.Poll()
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynamicPriorityQueue(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	queue := newDynamicPriorityQueue(3, func(a, b int) bool { return a < b })
+	newMockTask := func(priority *int32) *MockDynamicPriorityTask {
+		mockTask := NewMockDynamicPriorityTask(controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		mockTask.EXPECT().CurrentPriority().DoAndReturn(func() int {
+			return int(atomic.LoadInt32(priority))
+		}).AnyTimes()
+		return mockTask
+	}
+	priorities := []int32{2, 1, 1}
+	var tasks []*MockDynamicPriorityTask
+	for idx := range priorities {
+		tasks = append(tasks, newMockTask(&priorities[idx]))
+	}
+
+	position, ok := queue.put(tasks[0], tasks[0], time.Time{}, nil)
+	require.True(t, ok)
+	require.Zero(t, position)
+	require.True(t, queue.offer(tasks[1], tasks[1]))
+	require.True(t, queue.offer(tasks[2], tasks[2]))
+	require.False(t, queue.offer(tasks[0], tasks[0]))
+	require.Equal(t, 3, queue.len())
+
+	// tasks of the same priority are in submission order
+	entry, ok := queue.peek()
+	require.True(t, ok)
+	require.Equal(t, tasks[1], entry.task)
+	require.Equal(t, 1, entry.submittedPriority)
+
+	// current priorities are re-evaluated on peek
+	atomic.StoreInt32(&priorities[0], 0)
+	entry, ok = queue.peek()
+	require.True(t, ok)
+	require.Equal(t, tasks[0], entry.task)
+	require.Equal(t, 0, entry.priority)
+	require.True(t, queue.remove(entry))
+	require.False(t, queue.remove(entry))
+	require.Equal(t, 2, queue.len())
+
+	shutdownCh := make(chan struct{})
+	close(shutdownCh)
+	require.True(t, queue.offer(tasks[0], tasks[0]))
+	_, ok = queue.put(tasks[0], tasks[0], time.Time{}, shutdownCh)
+	require.False(t, ok)
+
+	require.ElementsMatch(t, []PriorityTask{tasks[0], tasks[1], tasks[2]}, queue.close())
+	require.Zero(t, queue.len())
+	require.False(t, queue.offer(tasks[0], tasks[0]))
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// endToEndTask is the task submitted to the processor when EndToEndLatency is specified,
+	// it records the latency from when the task is queued until it's acked or exhausted.
+	// The queue time is kept across retries within the processor and requeues
+	endToEndTask struct {
+		taskWrapper
+
+		scheduler *weightedRoundRobinTaskSchedulerImpl
+		priority  int
+		queueTime time.Time
+		recorded  int32
+	}
+)
+
+func newEndToEndTask(
+	task PriorityTask,
+	scheduler *weightedRoundRobinTaskSchedulerImpl,
+	priority int,
+	queueTime time.Time,
+) *endToEndTask {
+	return &endToEndTask{
+		taskWrapper: taskWrapper{PriorityTask: task},
+		scheduler:   scheduler,
+		priority:    priority,
+		queueTime:   queueTime,
+	}
+}
+
+func (t *endToEndTask) Ack() {
+	t.PriorityTask.Ack()
+	t.record(taskOutcomeSuccess)
+}
+
+func (t *endToEndTask) Nack() {
+	t.PriorityTask.Nack()
+	t.record(taskOutcomeExhausted)
+}
+
+func (t *endToEndTask) retryState() (int, int, time.Time, bool) {
+	if provider, ok := t.PriorityTask.(retryStateProvider); ok {
+		return provider.retryState()
+	}
+	return 0, 0, time.Time{}, false
+}
+
+// record emits the latency once, tagged by the outcome and the priority the task is dispatched with
+func (t *endToEndTask) record(
+	outcome string,
+) {
+	if !atomic.CompareAndSwapInt32(&t.recorded, 0, 1) {
+		return
+	}
+	t.scheduler.getTaskMetricsScope(unwrapSchedulerTask(t.PriorityTask).(PriorityTask), t.priority).
+		Tagged(metrics.TaskOutcomeTag(outcome)).
+		RecordTimer(metrics.PriorityTaskEndToEndLatency, time.Since(t.queueTime))
+}
+
+// unwrapEndToEndTask returns the endToEndTask, or nil if the given task is not
+// wrapped, along with the task wrapped by it
+func unwrapEndToEndTask(
+	task PriorityTask,
+) (*endToEndTask, PriorityTask) {
+	if timedTask, ok := task.(*endToEndTask); ok {
+		return timedTask, timedTask.PriorityTask
+	}
+	return nil, task
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// SchedulerEventType is the type of an event recorded by the scheduler
+	SchedulerEventType int
+
+	// SchedulerEvent is an event recorded by the scheduler for debugging
+	SchedulerEvent struct {
+		Type     SchedulerEventType
+		Time     time.Time
+		Priority int
+		// Err is the error returned by the processor for EventTypeDispatchError
+		Err error
+	}
+
+	// eventRecorder keeps the most recent events in a ring buffer, writers never block each other
+	// as each event claims a slot by atomically incrementing the sequence number. Under heavy
+	// contention, an event may be lost if it's overwritten by a writer a full lap behind
+	eventRecorder struct {
+		nextSeq uint64
+		slots   []atomic.Value // store *recordedEvent
+	}
+
+	recordedEvent struct {
+		seq   uint64
+		event SchedulerEvent
+	}
+)
+
+const (
+	// EventTypeSubmit is recorded when a task is accepted by the scheduler
+	EventTypeSubmit SchedulerEventType = iota + 1
+	// EventTypeDispatch is recorded when a task is submitted to the processor
+	EventTypeDispatch
+	// EventTypeDispatchError is recorded when a task fails to be submitted to the processor
+	EventTypeDispatchError
+	// EventTypeDrop is recorded when a task is dropped from the queue without being
+	// dispatched, because it aged out or the scheduler is stopped
+	EventTypeDrop
+)
+
+var schedulerEventTypeNames = map[SchedulerEventType]string{
+	EventTypeSubmit:        "submit",
+	EventTypeDispatch:      "dispatch",
+	EventTypeDispatchError: "dispatch_error",
+	EventTypeDrop:          "drop",
+}
+
+func (t SchedulerEventType) String() string {
+	if name, ok := schedulerEventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+func newEventRecorder(
+	size int,
+) *eventRecorder {
+	return &eventRecorder{
+		slots: make([]atomic.Value, size),
+	}
+}
+
+// record records an event, it's a no-op if the recorder is nil
+func (r *eventRecorder) record(
+	eventType SchedulerEventType,
+	priority int,
+	err error,
+) {
+	if r == nil {
+		return
+	}
+
+	seq := atomic.AddUint64(&r.nextSeq, 1) - 1
+	r.slots[seq%uint64(len(r.slots))].Store(&recordedEvent{
+		seq: seq,
+		event: SchedulerEvent{
+			Type:     eventType,
+			Time:     time.Now(),
+			Priority: priority,
+			Err:      err,
+		},
+	})
+}
+
+// recentEvents returns the recorded events from the oldest to the newest
+func (r *eventRecorder) recentEvents() []SchedulerEvent {
+	if r == nil {
+		return nil
+	}
+
+	recorded := make([]*recordedEvent, 0, len(r.slots))
+	for idx := range r.slots {
+		if event, ok := r.slots[idx].Load().(*recordedEvent); ok {
+			recorded = append(recorded, event)
+		}
+	}
+	sort.Slice(recorded, func(i, j int) bool {
+		return recorded[i].seq < recorded[j].seq
+	})
+
+	events := make([]SchedulerEvent, 0, len(recorded))
+	for _, event := range recorded {
+		events = append(events, event.event)
+	}
+	return events
+}
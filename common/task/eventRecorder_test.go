@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	eventRecorderSuite struct {
+		*require.Assertions
+		suite.Suite
+	}
+)
+
+func TestEventRecorderSuite(t *testing.T) {
+	s := new(eventRecorderSuite)
+	suite.Run(t, s)
+}
+
+func (s *eventRecorderSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+}
+
+func (s *eventRecorderSuite) TestRecentEvents() {
+	recorder := newEventRecorder(3)
+	s.Empty(recorder.recentEvents())
+
+	err := errors.New("some random error")
+	recorder.record(EventTypeSubmit, 1, nil)
+	recorder.record(EventTypeDispatchError, 1, err)
+	events := recorder.recentEvents()
+	s.Len(events, 2)
+	s.Equal(EventTypeSubmit, events[0].Type)
+	s.Equal(1, events[0].Priority)
+	s.Equal(EventTypeDispatchError, events[1].Type)
+	s.Equal(err, events[1].Err)
+	s.False(events[1].Time.Before(events[0].Time))
+
+	// only the most recent events are kept
+	for priority := 0; priority != 4; priority++ {
+		recorder.record(EventTypeDispatch, priority, nil)
+	}
+	events = recorder.recentEvents()
+	s.Len(events, 3)
+	for idx, event := range events {
+		s.Equal(EventTypeDispatch, event.Type)
+		s.Equal(idx+1, event.Priority)
+	}
+}
+
+func (s *eventRecorderSuite) TestNilRecorder() {
+	var recorder *eventRecorder
+	recorder.record(EventTypeSubmit, 1, nil)
+	s.Nil(recorder.recentEvents())
+}
+
+func (s *eventRecorderSuite) TestConcurrentRecord() {
+	recorder := newEventRecorder(16)
+
+	var recordWG sync.WaitGroup
+	for i := 0; i != 10; i++ {
+		recordWG.Add(1)
+		go func() {
+			defer recordWG.Done()
+			for j := 0; j != 100; j++ {
+				recorder.record(EventTypeSubmit, j, nil)
+				recorder.recentEvents()
+			}
+		}()
+	}
+	recordWG.Wait()
+
+	s.Len(recorder.recentEvents(), 16)
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+type (
+	// FanOutTask is the interface for tasks which spawn subtasks while being executed, and
+	// are only completed once all the subtasks are completed, see SubmitFanOut
+	FanOutTask interface {
+		PriorityTask
+		// ExecuteWithSubtasks processes the task, it's used instead of Execute. The subtasks
+		// submitted via the submitter are counted toward the completion of the task
+		ExecuteWithSubtasks(submitter SubtaskSubmitter) error
+	}
+
+	// SubtaskSubmitter submits the subtasks of a FanOutTask, subtasks which are FanOutTask
+	// themselves are only completed when their own subtasks are completed
+	SubtaskSubmitter interface {
+		// Submit submits the subtask to the scheduler the parent task is submitted to
+		Submit(task PriorityTask) error
+		// SubmitTo submits the subtask to the given scheduler
+		SubmitTo(scheduler Scheduler, task PriorityTask) error
+	}
+
+	// fanOutTask defers the ack or nack of the task until the task and all its subtasks are completed,
+	// it's nacked if it or any of its subtasks is nacked, and acked otherwise
+	fanOutTask struct {
+		PriorityTask
+
+		barrier   *barrierImpl
+		scheduler Scheduler
+		parent    *fanOutTask
+		// pending is the number of subtasks not yet completed, plus one until the task itself is completed
+		pending int32
+		failed  int32
+		done    int32
+	}
+
+	subtaskSubmitter struct {
+		parent *fanOutTask
+	}
+)
+
+// ErrParentTaskCompleted is the error returned when submitting a subtask of a completed FanOutTask
+var ErrParentTaskCompleted = errors.New("parent task is already completed")
+
+// SubmitFanOut submits the task to the scheduler and returns a Barrier which can be used to wait for the
+// completion of the task and all its subtasks. The task is only acked or nacked once all the subtasks
+// are completed, in the goroutine completing the last of them. Subtasks submitted by failed executions
+// are still counted, so the task can be safely retried.
+//
+// Submitting a subtask blocks while the subtask's queue is full, with the execution of the parent task
+// occupying a worker. If all the workers of a scheduler are occupied by parent tasks blocked on
+// submitting to the same scheduler, no subtask can be executed and the scheduler is deadlocked. Subtasks
+// should be submitted to a scheduler whose workers can't be exhausted by their parents, e.g. a separate
+// scheduler, or the same scheduler only if it has more workers than concurrent fan-outs, or via TrySubmit
+// on a queue sized for the fan-out. Like SubmitGroup, Wait should be called with a context that will
+// eventually be done, as dropped tasks are neither acked nor nacked.
+func SubmitFanOut(
+	scheduler Scheduler,
+	task FanOutTask,
+) (Barrier, error) {
+	barrier := &barrierImpl{
+		remaining: 1,
+		doneCh:    make(chan struct{}),
+	}
+
+	wrapped := newFanOutTask(task, scheduler, nil)
+	wrapped.barrier = barrier
+	if err := scheduler.Submit(wrapped); err != nil {
+		barrier.done(1)
+		return barrier, err
+	}
+	return barrier, nil
+}
+
+func newFanOutTask(
+	task PriorityTask,
+	scheduler Scheduler,
+	parent *fanOutTask,
+) *fanOutTask {
+	return &fanOutTask{
+		PriorityTask: task,
+		scheduler:    scheduler,
+		parent:       parent,
+		pending:      1,
+	}
+}
+
+func (t *fanOutTask) Execute() error {
+	if fanOut, ok := t.PriorityTask.(FanOutTask); ok {
+		return fanOut.ExecuteWithSubtasks(&subtaskSubmitter{parent: t})
+	}
+	return t.PriorityTask.Execute()
+}
+
+func (t *fanOutTask) Ack() {
+	t.complete(false)
+}
+
+func (t *fanOutTask) Nack() {
+	t.complete(true)
+}
+
+// complete marks the task itself as completed, only the first call counts
+func (t *fanOutTask) complete(
+	failed bool,
+) {
+	if !atomic.CompareAndSwapInt32(&t.done, 0, 1) {
+		return
+	}
+	t.release(failed)
+}
+
+// acquire counts a new subtask, returns false if the task is already completed
+func (t *fanOutTask) acquire() bool {
+	for {
+		pending := atomic.LoadInt32(&t.pending)
+		if pending == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&t.pending, pending, pending+1) {
+			return true
+		}
+	}
+}
+
+// release is called once the task itself or one of its subtasks is completed
+func (t *fanOutTask) release(
+	failed bool,
+) {
+	if failed {
+		atomic.StoreInt32(&t.failed, 1)
+	}
+	if atomic.AddInt32(&t.pending, -1) != 0 {
+		return
+	}
+
+	failed = atomic.LoadInt32(&t.failed) != 0
+	if failed {
+		t.PriorityTask.Nack()
+	} else {
+		t.PriorityTask.Ack()
+	}
+	if t.barrier != nil {
+		t.barrier.done(1)
+	}
+	if t.parent != nil {
+		t.parent.release(failed)
+	}
+}
+
+func (s *subtaskSubmitter) Submit(
+	task PriorityTask,
+) error {
+	return s.SubmitTo(s.parent.scheduler, task)
+}
+
+func (s *subtaskSubmitter) SubmitTo(
+	scheduler Scheduler,
+	task PriorityTask,
+) error {
+	if !s.parent.acquire() {
+		return ErrParentTaskCompleted
+	}
+	if err := scheduler.Submit(newFanOutTask(task, scheduler, s.parent)); err != nil {
+		// the subtask is not counted, the parent may be completed meanwhile
+		s.parent.release(false)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	fanOutSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller    *gomock.Controller
+		mockScheduler *MockScheduler
+	}
+
+	testFanOutTask struct {
+		*MockPriorityTask
+
+		execute func(submitter SubtaskSubmitter) error
+	}
+)
+
+func TestFanOutSuite(t *testing.T) {
+	s := new(fanOutSuite)
+	suite.Run(t, s)
+}
+
+func (s *fanOutSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockScheduler = NewMockScheduler(s.controller)
+}
+
+func (s *fanOutSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *fanOutSuite) TestSubmitFanOut_Success() {
+	var submitted []PriorityTask
+	s.mockScheduler.EXPECT().Submit(gomock.Any()).DoAndReturn(func(task PriorityTask) error {
+		submitted = append(submitted, task)
+		return nil
+	}).Times(4)
+
+	grandchild := NewMockPriorityTask(s.controller)
+	child1 := NewMockPriorityTask(s.controller)
+	child2 := &testFanOutTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		execute: func(submitter SubtaskSubmitter) error {
+			return submitter.Submit(grandchild)
+		},
+	}
+	parent := &testFanOutTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		execute: func(submitter SubtaskSubmitter) error {
+			s.NoError(submitter.Submit(child1))
+			return submitter.SubmitTo(s.mockScheduler, child2)
+		},
+	}
+
+	barrier, err := SubmitFanOut(s.mockScheduler, parent)
+	s.NoError(err)
+	s.Len(submitted, 1)
+	s.NoError(submitted[0].Execute())
+	s.Len(submitted, 3)
+	s.NoError(submitted[2].Execute())
+	s.Len(submitted, 4)
+
+	// tasks are acked only once their subtasks are completed
+	submitted[0].Ack()
+	submitted[2].Ack()
+	child1.EXPECT().Ack().Times(1)
+	submitted[1].Ack()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, barrier.Wait(ctx))
+
+	grandchild.EXPECT().Ack().Times(1)
+	child2.MockPriorityTask.EXPECT().Ack().Times(1)
+	parent.MockPriorityTask.EXPECT().Ack().Times(1)
+	submitted[3].Ack()
+	s.NoError(barrier.Wait(context.Background()))
+}
+
+func (s *fanOutSuite) TestSubmitFanOut_SubtaskFailed() {
+	var submitted []PriorityTask
+	submitErr := errors.New("some random error")
+	gomock.InOrder(
+		s.mockScheduler.EXPECT().Submit(gomock.Any()).DoAndReturn(func(task PriorityTask) error {
+			submitted = append(submitted, task)
+			return nil
+		}).Times(2),
+		s.mockScheduler.EXPECT().Submit(gomock.Any()).Return(submitErr),
+	)
+
+	child := NewMockPriorityTask(s.controller)
+	var parentSubmitter SubtaskSubmitter
+	parent := &testFanOutTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		execute: func(submitter SubtaskSubmitter) error {
+			parentSubmitter = submitter
+			s.NoError(submitter.Submit(child))
+			// the subtask failed to be submitted is not counted
+			return submitter.Submit(NewMockPriorityTask(s.controller))
+		},
+	}
+
+	barrier, err := SubmitFanOut(s.mockScheduler, parent)
+	s.NoError(err)
+	s.Equal(submitErr, submitted[0].Execute())
+	submitted[0].Ack()
+	submitted[0].Ack() // duplicate completion should not be counted twice
+
+	// the parent is nacked if any of its subtasks is nacked
+	child.EXPECT().Nack().Times(1)
+	parent.MockPriorityTask.EXPECT().Nack().Times(1)
+	submitted[1].Nack()
+	s.NoError(barrier.Wait(context.Background()))
+	s.Equal(ErrParentTaskCompleted, parentSubmitter.Submit(NewMockPriorityTask(s.controller)))
+}
+
+func (s *fanOutSuite) TestSubmitFanOut_SubmitFailed() {
+	submitErr := errors.New("some random error")
+	s.mockScheduler.EXPECT().Submit(gomock.Any()).Return(submitErr)
+
+	barrier, err := SubmitFanOut(s.mockScheduler, &testFanOutTask{MockPriorityTask: NewMockPriorityTask(s.controller)})
+	s.Equal(submitErr, err)
+	s.NoError(barrier.Wait(context.Background()))
+}
+
+func (t *testFanOutTask) ExecuteWithSubtasks(
+	submitter SubtaskSubmitter,
+) error {
+	return t.execute(submitter)
+}
@@ -149,7 +149,7 @@ func (f *fifoTaskSchedulerImpl) dispatcher() {
 		select {
 		case task := <-f.taskCh:
 			if err := f.processor.Submit(task); err != nil {
-				f.logger.Error("failed to submit task to processor", tag.Error(err))
+				f.logger.Error("failed to submit task to processor", appendCorrelationTag([]tag.Tag{tag.Error(err)}, task)...)
 				task.Nack()
 			}
 		case <-f.shutdownCh:
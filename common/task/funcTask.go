@@ -0,0 +1,101 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type (
+	// funcTask is a PriorityTask which processes itself by calling a function, so that callers with a
+	// single concrete payload type can capture the typed payload in the function, instead of defining
+	// a task type per payload and asserting the payload type in Execute
+	funcTask struct {
+		run      func(ctx context.Context) error
+		priority int
+		state    int32
+	}
+)
+
+var _ PriorityTask = (*funcTask)(nil)
+var _ ContextAwareTask = (*funcTask)(nil)
+
+// NewFuncTask creates a PriorityTask with the given priority which calls run when executed. The context
+// passed to run is the one the processor executes the task with, e.g. cancelled when submitted via
+// SubmitFuture and cancelled, or context.Background() if the task is executed via Execute. Errors
+// returned by run are retried as configured by the scheduler's retry policy
+func NewFuncTask(
+	priority int,
+	run func(ctx context.Context) error,
+) PriorityTask {
+	return &funcTask{
+		run:      run,
+		priority: priority,
+		state:    int32(TaskStatePending),
+	}
+}
+
+// SubmitFunc submits a task created by NewFuncTask to the scheduler, run usually
+// calls a typed handler with the payload it captures, which keeps its concrete type
+func SubmitFunc(
+	scheduler Scheduler,
+	priority int,
+	run func(ctx context.Context) error,
+) error {
+	return scheduler.Submit(NewFuncTask(priority, run))
+}
+
+func (t *funcTask) Execute() error {
+	return t.run(context.Background())
+}
+
+func (t *funcTask) ExecuteWithContext(ctx context.Context) error {
+	return t.run(ctx)
+}
+
+func (t *funcTask) HandleErr(err error) error {
+	return err
+}
+
+func (t *funcTask) RetryErr(err error) bool {
+	return true
+}
+
+func (t *funcTask) Ack() {
+	atomic.CompareAndSwapInt32(&t.state, int32(TaskStatePending), int32(TaskStateAcked))
+}
+
+func (t *funcTask) Nack() {
+	atomic.CompareAndSwapInt32(&t.state, int32(TaskStatePending), int32(TaskStateNacked))
+}
+
+func (t *funcTask) State() State {
+	return State(atomic.LoadInt32(&t.state))
+}
+
+func (t *funcTask) Priority() int {
+	return t.priority
+}
+
+func (t *funcTask) SetPriority(priority int) {
+	t.priority = priority
+}
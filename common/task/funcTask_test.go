@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+func TestFuncTask(t *testing.T) {
+	type contextKey struct{}
+	ctx := context.WithValue(context.Background(), contextKey{}, "value")
+	var values []interface{}
+	task := NewFuncTask(1, func(ctx context.Context) error {
+		values = append(values, ctx.Value(contextKey{}))
+		return errRetryable
+	})
+
+	require.Equal(t, 1, task.Priority())
+	require.Equal(t, errRetryable, task.Execute())
+	require.Equal(t, errRetryable, task.(ContextAwareTask).ExecuteWithContext(ctx))
+	require.Equal(t, []interface{}{nil, "value"}, values)
+	require.Equal(t, errRetryable, task.HandleErr(errRetryable))
+	require.True(t, task.RetryErr(errRetryable))
+
+	require.Equal(t, TaskStatePending, task.State())
+	task.Nack()
+	task.Ack()
+	require.Equal(t, TaskStateNacked, task.State())
+}
+
+func TestSubmitFunc(t *testing.T) {
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewNopLogger(),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       10,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	require.NoError(t, err)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	type payload struct {
+		id int
+	}
+	resultCh := make(chan int, 1)
+	process := func(ctx context.Context, p payload) error {
+		resultCh <- p.id
+		return nil
+	}
+	item := payload{id: 42}
+	require.NoError(t, SubmitFunc(scheduler, 2, func(ctx context.Context) error {
+		return process(ctx, item)
+	}))
+	require.Equal(t, 42, <-resultCh)
+}
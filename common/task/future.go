@@ -0,0 +1,353 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// TaskFuture is the handle of a task submitted via SubmitFuture
+	TaskFuture interface {
+		// Get blocks until the task is completed or the context is done, returns nil
+		// if the task is acked, ErrTaskNacked if nacked and ErrTaskCancelled if the task
+		// is removed from the scheduler by Cancel before being dispatched
+		Get(ctx context.Context) error
+		// GetResult is the same as Get, except that it also returns the result of a ResultTask, which
+		// is the result of its successful execution if the task is acked, and nil otherwise
+		GetResult(ctx context.Context) (interface{}, error)
+		// Cancel removes the task from the scheduler if it's still pending and returns true,
+		// the task will then be neither acked nor nacked. If the task is already dispatched,
+		// cancellation is signaled via the context passed to ContextAwareTask and true is returned.
+		// Cancelling a completed task is a no-op and returns false
+		Cancel() bool
+	}
+
+	// ContextAwareTask is the interface for tasks which support cooperative cancellation,
+	// when submitted via SubmitFuture, ExecuteWithContext will be used instead of Execute
+	ContextAwareTask interface {
+		// ExecuteWithContext process the task, ctx is cancelled when the task is cancelled
+		ExecuteWithContext(ctx context.Context) error
+	}
+
+	// ResultTask is the interface for tasks which produce a result for the submitter, when submitted
+	// via SubmitFuture, ExecuteWithResult will be used instead of Execute and ExecuteWithContext. The
+	// result is kept when ExecuteWithResult returns no error, replacing the result of a previous attempt
+	// if the task is retried, and it's delivered to TaskFuture.GetResult once the task is acked. No result
+	// is delivered if the task is nacked or cancelled, and the result of a completed task never changes
+	ResultTask interface {
+		// ExecuteWithResult process the task, ctx is cancelled when the task is cancelled
+		ExecuteWithResult(ctx context.Context) (interface{}, error)
+	}
+
+	futureTask struct {
+		taskWrapper
+
+		ctx    context.Context
+		cancel context.CancelFunc
+		// remove removes the task from the scheduler queue,
+		// returns false if the task is not in the queue
+		remove func() bool
+
+		sync.Mutex
+		completed bool
+		err       error
+		doneCh    chan struct{}
+		// executionResult is the result of the last successful execution of a ResultTask,
+		// which becomes the result once the task is acked
+		executionResult interface{}
+		result          interface{}
+	}
+
+	// dispatchAwaitedTask signals the submitter once the task is submitted to the processor, or
+	// when it's acked or nacked before that, e.g. when it's replaced or dropped from the queue
+	dispatchAwaitedTask struct {
+		taskWrapper
+
+		// dispatching is set while the task is being submitted to the processor, when
+		// the task may be acked or nacked by the processor before the submission returns
+		dispatching  int32
+		once         sync.Once
+		err          error
+		dispatchedCh chan struct{}
+	}
+
+	// failureCallbackTask invokes the callback of a task submitted via SubmitWithFailureCallback
+	// once the task is exhausted, the callback is invoked at most once
+	failureCallbackTask struct {
+		taskWrapper
+
+		onFailure func(err error)
+		once      sync.Once
+	}
+
+	// exhaustionObserver is implemented by tasks which need to know when they're exhausted by the processor
+	exhaustionObserver interface {
+		exhausted(err error)
+	}
+
+	// dispatchObserver is implemented by tasks which need to know when they're submitted to the processor
+	dispatchObserver interface {
+		beforeDispatch()
+		afterDispatch(err error)
+	}
+)
+
+var (
+	// ErrTaskNacked is the error returned by TaskFuture when the task is nacked
+	ErrTaskNacked = errors.New("task is nacked")
+	// ErrTaskCancelled is the error returned by TaskFuture when the task is cancelled before dispatched
+	ErrTaskCancelled = errors.New("task is cancelled")
+	// ErrTaskNotDispatched is the error returned by SubmitAndAwaitDispatch when
+	// the task is acked or nacked before it's submitted to the processor
+	ErrTaskNotDispatched = errors.New("task is completed before dispatched")
+)
+
+func newFutureTask(
+	task PriorityTask,
+) *futureTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &futureTask{
+		taskWrapper: taskWrapper{PriorityTask: task},
+		ctx:         ctx,
+		cancel:      cancel,
+		remove:      func() bool { return false },
+		doneCh:      make(chan struct{}),
+	}
+}
+
+func (t *futureTask) Execute() error {
+	return t.execute(t.ctx)
+}
+
+// ExecuteWithContext executes the task with a context which is cancelled when either the
+// given context, e.g. on processor shutdown, is done or the task is cancelled via its future
+func (t *futureTask) ExecuteWithContext(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return t.execute(ctx)
+}
+
+func (t *futureTask) execute(
+	ctx context.Context,
+) error {
+	if resultTask, ok := t.PriorityTask.(ResultTask); ok {
+		result, err := resultTask.ExecuteWithResult(ctx)
+		if err == nil {
+			t.Lock()
+			t.executionResult = result
+			t.Unlock()
+		}
+		return err
+	}
+	if contextAwareTask, ok := t.PriorityTask.(ContextAwareTask); ok {
+		return contextAwareTask.ExecuteWithContext(ctx)
+	}
+	return t.PriorityTask.Execute()
+}
+
+func (t *futureTask) RetryErr(err error) bool {
+	if t.ctx.Err() != nil {
+		// task is cancelled, no need to retry
+		return false
+	}
+	return t.PriorityTask.RetryErr(err)
+}
+
+func (t *futureTask) Ack() {
+	t.PriorityTask.Ack()
+	t.complete(nil)
+}
+
+func (t *futureTask) Nack() {
+	t.PriorityTask.Nack()
+	t.complete(ErrTaskNacked)
+}
+
+func (t *futureTask) Get(
+	ctx context.Context,
+) error {
+	select {
+	case <-t.doneCh:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *futureTask) GetResult(
+	ctx context.Context,
+) (interface{}, error) {
+	select {
+	case <-t.doneCh:
+		return t.result, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *futureTask) Cancel() bool {
+	t.Lock()
+	if t.completed {
+		t.Unlock()
+		return false
+	}
+	t.cancel()
+	t.Unlock()
+
+	if t.remove() {
+		t.complete(ErrTaskCancelled)
+	}
+	return true
+}
+
+func (t *futureTask) complete(
+	err error,
+) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.completed {
+		return
+	}
+	t.completed = true
+	t.err = err
+	if err == nil {
+		t.result = t.executionResult
+	}
+	t.cancel()
+	close(t.doneCh)
+}
+
+func newDispatchAwaitedTask(
+	task PriorityTask,
+) *dispatchAwaitedTask {
+	return &dispatchAwaitedTask{
+		taskWrapper:  taskWrapper{PriorityTask: task},
+		dispatchedCh: make(chan struct{}),
+	}
+}
+
+func (t *dispatchAwaitedTask) Ack() {
+	t.PriorityTask.Ack()
+	t.complete()
+}
+
+func (t *dispatchAwaitedTask) Nack() {
+	t.PriorityTask.Nack()
+	t.complete()
+}
+
+func (t *dispatchAwaitedTask) beforeDispatch() {
+	atomic.StoreInt32(&t.dispatching, 1)
+}
+
+func (t *dispatchAwaitedTask) afterDispatch(
+	err error,
+) {
+	if err == nil {
+		t.signal(nil)
+		return
+	}
+	atomic.StoreInt32(&t.dispatching, 0)
+}
+
+func (t *dispatchAwaitedTask) complete() {
+	if atomic.LoadInt32(&t.dispatching) == 1 {
+		// completed by the processor
+		t.signal(nil)
+		return
+	}
+	t.signal(ErrTaskNotDispatched)
+}
+
+func (t *dispatchAwaitedTask) signal(
+	err error,
+) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.dispatchedCh)
+	})
+}
+
+// getDispatchObserver returns the outermost dispatchObserver among the task and
+// the tasks wrapped by it, or nil if none of them is an observer
+func getDispatchObserver(
+	task PriorityTask,
+) dispatchObserver {
+	for {
+		if observer, ok := task.(dispatchObserver); ok {
+			return observer
+		}
+		wrapper, ok := task.(wrappedTask)
+		if !ok {
+			return nil
+		}
+		task = wrapper.unwrap()
+	}
+}
+
+// getExhaustionObserver returns the outermost exhaustionObserver among the task
+// and the tasks wrapped by it, or nil if none of them is an observer
+func getExhaustionObserver(
+	task Task,
+) exhaustionObserver {
+	for {
+		if observer, ok := task.(exhaustionObserver); ok {
+			return observer
+		}
+		wrapper, ok := task.(wrappedTask)
+		if !ok {
+			return nil
+		}
+		task = wrapper.unwrap()
+	}
+}
+
+func newFailureCallbackTask(
+	task PriorityTask,
+	onFailure func(err error),
+) *failureCallbackTask {
+	return &failureCallbackTask{
+		taskWrapper: taskWrapper{PriorityTask: task},
+		onFailure:   onFailure,
+	}
+}
+
+func (t *failureCallbackTask) exhausted(
+	err error,
+) {
+	t.once.Do(func() {
+		t.onFailure(err)
+	})
+}
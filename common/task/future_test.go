@@ -0,0 +1,212 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	futureSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+
+	testContextAwareTask struct {
+		*MockPriorityTask
+
+		executeFn func(ctx context.Context) error
+	}
+
+	testResultTask struct {
+		*MockPriorityTask
+
+		executeFn func(ctx context.Context) (interface{}, error)
+	}
+)
+
+func TestFutureSuite(t *testing.T) {
+	s := new(futureSuite)
+	suite.Run(t, s)
+}
+
+func (s *futureSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *futureSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *futureSuite) TestGet() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Ack().Times(1)
+	future := newFutureTask(mockTask)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, future.Get(ctx))
+
+	future.Ack()
+	s.NoError(future.Get(context.Background()))
+
+	mockTask = NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Nack().Times(1)
+	future = newFutureTask(mockTask)
+	future.Nack()
+	s.Equal(ErrTaskNacked, future.Get(context.Background()))
+}
+
+func (s *futureSuite) TestGetResult() {
+	attempts := 0
+	errRetryable := errors.New("retryable error")
+	task := &testResultTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		executeFn: func(ctx context.Context) (interface{}, error) {
+			attempts++
+			if attempts == 1 {
+				return "partial result", errRetryable
+			}
+			return attempts, nil
+		},
+	}
+	task.EXPECT().Ack().Times(1)
+	future := newFutureTask(task)
+
+	s.Equal(errRetryable, future.Execute())
+	s.NoError(future.Execute())
+	future.Ack()
+	result, err := future.GetResult(context.Background())
+	s.NoError(err)
+	s.Equal(2, result)
+
+	// the result of a completed task never changes
+	task.EXPECT().Nack().Times(1)
+	future.Nack()
+	result, err = future.GetResult(context.Background())
+	s.NoError(err)
+	s.Equal(2, result)
+
+	// no result for tasks which are not result tasks or nacked
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Ack().Times(1)
+	future = newFutureTask(mockTask)
+	future.Ack()
+	result, err = future.GetResult(context.Background())
+	s.NoError(err)
+	s.Nil(result)
+
+	task.MockPriorityTask = NewMockPriorityTask(s.controller)
+	task.EXPECT().Nack().Times(1)
+	future = newFutureTask(task)
+	s.NoError(future.Execute())
+	future.Nack()
+	result, err = future.GetResult(context.Background())
+	s.Equal(ErrTaskNacked, err)
+	s.Nil(result)
+}
+
+func (s *futureSuite) TestCancel_Pending() {
+	future := newFutureTask(NewMockPriorityTask(s.controller))
+	future.remove = func() bool { return true }
+
+	s.True(future.Cancel())
+	s.Equal(ErrTaskCancelled, future.Get(context.Background()))
+	s.False(future.Cancel())
+}
+
+func (s *futureSuite) TestCancel_Executing() {
+	errCancelled := errors.New("task cancelled")
+	executingCh := make(chan struct{})
+	task := &testContextAwareTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		executeFn: func(ctx context.Context) error {
+			close(executingCh)
+			<-ctx.Done()
+			return errCancelled
+		},
+	}
+	task.EXPECT().Nack().Times(1)
+	future := newFutureTask(task)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- future.Execute()
+	}()
+
+	<-executingCh
+	s.True(future.Cancel())
+	s.Equal(errCancelled, <-errCh)
+	s.False(future.RetryErr(errCancelled))
+
+	future.Nack()
+	s.Equal(ErrTaskNacked, future.Get(context.Background()))
+}
+
+func (s *futureSuite) TestCancel_Completed() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Ack().Times(1)
+	future := newFutureTask(mockTask)
+	future.remove = func() bool {
+		s.Fail("remove should not be called for completed task")
+		return false
+	}
+
+	future.Ack()
+	s.False(future.Cancel())
+	s.NoError(future.Get(context.Background()))
+}
+
+func (s *futureSuite) TestFailureCallbackTask() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Nack().Times(1)
+	var failures []error
+	task := newFailureCallbackTask(mockTask, func(err error) {
+		failures = append(failures, err)
+	})
+
+	// the observer is found through the wrappers added by the scheduler
+	observer := getExhaustionObserver(newPrioritySnapshotTask(task, 1))
+	s.NotNil(observer)
+	observer.exhausted(errNonRetryable)
+	observer.exhausted(errRetryable)
+	task.Nack()
+	s.Equal([]error{errNonRetryable}, failures)
+}
+
+func (t *testContextAwareTask) ExecuteWithContext(ctx context.Context) error {
+	return t.executeFn(ctx)
+}
+
+func (t *testResultTask) ExecuteWithResult(ctx context.Context) (interface{}, error) {
+	return t.executeFn(ctx)
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// HierarchicalSchedulerOptions configs the hierarchical scheduler
+	HierarchicalSchedulerOptions struct {
+		// ParentOptions are the options of the parent WRR task scheduler, whose Weights are keyed by the
+		// priorities of the children. The parent owns the workers executing the tasks of all children
+		ParentOptions *WeightedRoundRobinTaskSchedulerOptions
+		// Children are the child schedulers keyed by name
+		Children map[string]HierarchicalChildOptions
+	}
+
+	// HierarchicalChildOptions configs a child scheduler of the hierarchical scheduler
+	HierarchicalChildOptions struct {
+		// Priority is the priority of the child in the parent scheduler, children may share a priority
+		Priority int
+		// SchedulerOptions are the options of the WRR task scheduler of the child, whose Weights are keyed by
+		// the priorities of its tasks. The child executes its tasks on the workers of the parent, so it's
+		// subject to the same constraints as a scheduler with WorkerPool, which can't be specified
+		SchedulerOptions *WeightedRoundRobinTaskSchedulerOptions
+	}
+
+	// HierarchicalScheduler is a scheduler which weights WRR task schedulers against each other
+	HierarchicalScheduler interface {
+		Scheduler
+		// Stats returns the stats of the parent, of each child, and their aggregates
+		Stats() HierarchicalSchedulerStats
+	}
+
+	// HierarchicalSchedulerStats is a snapshot of the internal state of a hierarchical scheduler
+	HierarchicalSchedulerStats struct {
+		// Parent is the stats of the parent scheduler, whose queued tasks are keyed by the priorities
+		// of the children, and whose processor stats cover the tasks of all children
+		Parent WeightedRoundRobinTaskSchedulerStats
+		// Children is the stats of each child scheduler keyed by name,
+		// their processor stats are empty as their tasks are executed by the parent
+		Children map[string]WeightedRoundRobinTaskSchedulerStats
+		// QueuedTasks is the number of tasks waiting to be dispatched by the parent and all the children
+		QueuedTasks int
+	}
+
+	// hierarchicalScheduler routes HierarchicalTasks to the child schedulers, whose
+	// dispatched tasks are queued in the parent scheduler with the priority of the child
+	hierarchicalScheduler struct {
+		parent   WeightedRoundRobinTaskScheduler
+		children map[string]WeightedRoundRobinTaskScheduler
+	}
+
+	// hierarchyParent is the parent scheduler a child
+	// scheduler submits its dispatched tasks to
+	hierarchyParent struct {
+		scheduler WeightedRoundRobinTaskScheduler
+		priority  int
+	}
+
+	// hierarchicalChildProcessor is the processor of a child scheduler,
+	// which submits the dispatched tasks to the parent scheduler
+	hierarchicalChildProcessor struct {
+		parent *hierarchyParent
+	}
+
+	// hierarchicalDispatchTask is a task dispatched by a child scheduler, which is
+	// queued in the parent scheduler with the priority of the child
+	hierarchicalDispatchTask struct {
+		taskWrapper
+
+		priority int
+	}
+)
+
+var _ HierarchicalScheduler = (*hierarchicalScheduler)(nil)
+
+var (
+	// ErrNotHierarchicalTask is the error returned when submitting a task not implementing HierarchicalTask
+	ErrNotHierarchicalTask = errors.New("task does not implement HierarchicalTask")
+	// ErrUnknownSchedulerChild is the error returned when submitting a task of an unknown child scheduler
+	ErrUnknownSchedulerChild = errors.New("unknown child scheduler")
+)
+
+// NewHierarchicalScheduler creates a scheduler which routes each HierarchicalTask to the child scheduler named by
+// its Child, so that tasks are weighted in two levels, e.g. teams and then workflows of each team. Each child is
+// a WRR task scheduler dispatching its tasks by their priorities and weights, and instead of executing them, it
+// submits them to the parent WRR task scheduler with the priority of the child, where they're weighted against
+// the tasks of the other children and executed. The parent processor sees a wrapper of the tasks, interfaces such
+// as RetryPolicyTask and BatchableTask are still looked up on the submitted tasks.
+//
+// A child dispatches a task only once its queue in the parent has room, so the parent queue size bounds how far
+// ahead of the parent a child dispatches, the smaller it is, the more each parent dispatch is decided by the
+// weights of both levels at that time rather than when the tasks were dispatched by the children. Metrics of
+// each child are tagged with its name
+func NewHierarchicalScheduler(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	options *HierarchicalSchedulerOptions,
+) (HierarchicalScheduler, error) {
+	if options.ParentOptions == nil {
+		return nil, errors.New("parent scheduler options are not specified")
+	}
+	if len(options.Children) == 0 {
+		return nil, errors.New("no child scheduler is specified")
+	}
+	parentWeights, err := validateOptions(options.ParentOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(options.Children))
+	for name, child := range options.Children {
+		if child.SchedulerOptions == nil {
+			return nil, fmt.Errorf("scheduler options of child %v are not specified", name)
+		}
+		if child.SchedulerOptions.WorkerPool != nil {
+			return nil, fmt.Errorf("child %v can't be used with shared worker pool", name)
+		}
+		if _, ok := parentWeights[child.Priority]; !ok {
+			return nil, fmt.Errorf("priority %v of child %v has no weight in the parent", child.Priority, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parent, err := NewWeightedRoundRobinTaskScheduler(logger, metricsClient, options.ParentOptions)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string]WeightedRoundRobinTaskScheduler, len(names))
+	for _, name := range names {
+		child := options.Children[name]
+		schedulerOptions := *child.SchedulerOptions
+		schedulerOptions.hierarchyParent = &hierarchyParent{
+			scheduler: parent,
+			priority:  child.Priority,
+		}
+		scheduler, err := NewWeightedRoundRobinTaskScheduler(
+			logger.WithTags(tag.TaskSchedulerChild(name)),
+			metricsClient,
+			&schedulerOptions,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("child %v: %v", name, err)
+		}
+		scheduler.SetMetricsScope(metricsClient.Scope(metrics.TaskSchedulerScope, metrics.SchedulerChildTag(name)))
+		children[name] = scheduler
+	}
+	return &hierarchicalScheduler{
+		parent:   parent,
+		children: children,
+	}, nil
+}
+
+func (s *hierarchicalScheduler) Start() {
+	s.parent.Start()
+	for _, scheduler := range s.children {
+		scheduler.Start()
+	}
+}
+
+// Stop stops the children concurrently before the parent, so that the
+// tasks they're dispatching can still be queued in the parent
+func (s *hierarchicalScheduler) Stop() {
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(len(s.children))
+	for _, scheduler := range s.children {
+		go func(scheduler WeightedRoundRobinTaskScheduler) {
+			defer waitGroup.Done()
+			scheduler.Stop()
+		}(scheduler)
+	}
+	waitGroup.Wait()
+	s.parent.Stop()
+}
+
+func (s *hierarchicalScheduler) Submit(
+	task PriorityTask,
+) error {
+	scheduler, err := s.getChild(task)
+	if err != nil {
+		return err
+	}
+	return scheduler.Submit(task)
+}
+
+func (s *hierarchicalScheduler) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	scheduler, err := s.getChild(task)
+	if err != nil {
+		return false, err
+	}
+	return scheduler.TrySubmit(task)
+}
+
+func (s *hierarchicalScheduler) Stats() HierarchicalSchedulerStats {
+	stats := HierarchicalSchedulerStats{
+		Parent:   s.parent.Stats(),
+		Children: make(map[string]WeightedRoundRobinTaskSchedulerStats, len(s.children)),
+	}
+	stats.QueuedTasks = queuedTasks(stats.Parent)
+	for name, scheduler := range s.children {
+		childStats := scheduler.Stats()
+		stats.Children[name] = childStats
+		stats.QueuedTasks += queuedTasks(childStats)
+	}
+	return stats
+}
+
+func (s *hierarchicalScheduler) getChild(
+	task PriorityTask,
+) (WeightedRoundRobinTaskScheduler, error) {
+	hierarchicalTask, ok := task.(HierarchicalTask)
+	if !ok {
+		return nil, ErrNotHierarchicalTask
+	}
+	scheduler, ok := s.children[hierarchicalTask.Child()]
+	if !ok {
+		return nil, ErrUnknownSchedulerChild
+	}
+	return scheduler, nil
+}
+
+func queuedTasks(
+	stats WeightedRoundRobinTaskSchedulerStats,
+) int {
+	count := stats.DynamicPriorityTasks
+	for _, queued := range stats.QueuedTasks {
+		count += queued
+	}
+	return count
+}
+
+func newHierarchicalChildProcessor(
+	parent *hierarchyParent,
+) *hierarchicalChildProcessor {
+	return &hierarchicalChildProcessor{
+		parent: parent,
+	}
+}
+
+func (p *hierarchicalChildProcessor) Start() {}
+
+func (p *hierarchicalChildProcessor) Stop() {}
+
+// Submit blocks until the task is queued in the parent scheduler, or the parent is stopped
+func (p *hierarchicalChildProcessor) Submit(
+	task Task,
+) error {
+	err := p.parent.scheduler.Submit(&hierarchicalDispatchTask{
+		taskWrapper: taskWrapper{PriorityTask: task.(PriorityTask)},
+		priority:    p.parent.priority,
+	})
+	if err == ErrTaskSchedulerClosed {
+		// the parent is the processor of the child
+		return ErrTaskProcessorClosed
+	}
+	return err
+}
+
+func (t *hierarchicalDispatchTask) Priority() int {
+	return t.priority
+}
+
+func (t *hierarchicalDispatchTask) SetPriority(
+	priority int,
+) {
+	t.priority = priority
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+func TestHierarchicalScheduler(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	logger, err := loggerimpl.NewDevelopment()
+	require.NoError(t, err)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler, err := NewHierarchicalScheduler(
+		logger,
+		metrics.NewClient(testScope, metrics.Common),
+		&HierarchicalSchedulerOptions{
+			ParentOptions: newTestHierarchyOptions(),
+			Children: map[string]HierarchicalChildOptions{
+				"a": {Priority: 0, SchedulerOptions: newTestHierarchyOptions()},
+				"b": {Priority: 1, SchedulerOptions: newTestHierarchyOptions()},
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	var lock sync.Mutex
+	executed := make(map[string]int)
+	var waitGroup sync.WaitGroup
+	newHierarchicalTask := func(child string, priority int) *MockHierarchicalTask {
+		mockTask := NewMockHierarchicalTask(controller)
+		mockTask.EXPECT().Child().Return(child).AnyTimes()
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Execute().DoAndReturn(func() error {
+			lock.Lock()
+			defer lock.Unlock()
+			executed[child]++
+			return nil
+		}).Times(1)
+		mockTask.EXPECT().Ack().Do(func() { waitGroup.Done() }).Times(1)
+		return mockTask
+	}
+
+	waitGroup.Add(5)
+	for _, priority := range []int{0, 2, 1} {
+		require.NoError(t, scheduler.Submit(newHierarchicalTask("a", priority)))
+	}
+	require.NoError(t, scheduler.Submit(newHierarchicalTask("b", 0)))
+	submitted, err := scheduler.TrySubmit(newHierarchicalTask("b", 2))
+	require.NoError(t, err)
+	require.True(t, submitted)
+
+	// tasks are kept in the queues of the children as the scheduler is not started
+	stats := scheduler.Stats()
+	require.Equal(t, 5, stats.QueuedTasks)
+	require.Equal(t, map[int]int{0: 1, 1: 1, 2: 1}, stats.Children["a"].QueuedTasks)
+	require.Equal(t, map[int]int{0: 1, 2: 1}, stats.Children["b"].QueuedTasks)
+	numSubmitted := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_submit_request" {
+			numSubmitted[counter.Tags()["task_scheduler_child"]] += counter.Value()
+		}
+	}
+	require.Equal(t, int64(3), numSubmitted["a"])
+	require.Equal(t, int64(2), numSubmitted["b"])
+
+	mockTask := NewMockPriorityTask(controller)
+	require.Equal(t, ErrNotHierarchicalTask, scheduler.Submit(mockTask))
+	_, err = scheduler.TrySubmit(mockTask)
+	require.Equal(t, ErrNotHierarchicalTask, err)
+	unknownTask := NewMockHierarchicalTask(controller)
+	unknownTask.EXPECT().Child().Return("c").AnyTimes()
+	require.Equal(t, ErrUnknownSchedulerChild, scheduler.Submit(unknownTask))
+
+	scheduler.Start()
+	waitGroup.Wait()
+	scheduler.Stop()
+
+	// the tasks of both children are executed by the parent
+	require.Equal(t, map[string]int{"a": 3, "b": 2}, executed)
+	stats = scheduler.Stats()
+	require.Zero(t, stats.QueuedTasks)
+	require.Equal(t, int64(5), stats.Parent.Processor.SucceededTasks)
+}
+
+func TestNewHierarchicalScheduler_InvalidOptions(t *testing.T) {
+	logger, err := loggerimpl.NewDevelopment()
+	require.NoError(t, err)
+	invalidOptions := newTestHierarchyOptions()
+	invalidOptions.DispatcherCount = -1
+	poolOptions := newTestHierarchyOptions()
+	poolOptions.WorkerPool = &SharedWorkerPool{}
+	batchOptions := newTestHierarchyOptions()
+	batchOptions.BatchWindow = time.Millisecond
+	for _, options := range []*HierarchicalSchedulerOptions{
+		{
+			Children: map[string]HierarchicalChildOptions{
+				"a": {Priority: 0, SchedulerOptions: newTestHierarchyOptions()},
+			},
+		},
+		{
+			ParentOptions: newTestHierarchyOptions(),
+		},
+		{
+			ParentOptions: invalidOptions,
+			Children: map[string]HierarchicalChildOptions{
+				"a": {Priority: 0, SchedulerOptions: newTestHierarchyOptions()},
+			},
+		},
+		{
+			ParentOptions: newTestHierarchyOptions(),
+			Children: map[string]HierarchicalChildOptions{
+				"a": {Priority: 0},
+			},
+		},
+		{
+			ParentOptions: newTestHierarchyOptions(),
+			Children: map[string]HierarchicalChildOptions{
+				"a": {Priority: 5, SchedulerOptions: newTestHierarchyOptions()},
+			},
+		},
+		{
+			ParentOptions: newTestHierarchyOptions(),
+			Children: map[string]HierarchicalChildOptions{
+				"a": {Priority: 0, SchedulerOptions: poolOptions},
+			},
+		},
+		{
+			ParentOptions: newTestHierarchyOptions(),
+			Children: map[string]HierarchicalChildOptions{
+				"a": {Priority: 0, SchedulerOptions: batchOptions},
+			},
+		},
+	} {
+		_, err := NewHierarchicalScheduler(logger, metrics.NewClient(tally.NoopScope, metrics.Common), options)
+		require.Error(t, err)
+	}
+}
+
+func newTestHierarchyOptions() *WeightedRoundRobinTaskSchedulerOptions {
+	return &WeightedRoundRobinTaskSchedulerOptions{
+		Weights:         testSchedulerWeights,
+		QueueSize:       10,
+		WorkerCount:     1,
+		DispatcherCount: 1,
+		RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		// tasks are kept in the queues as the scheduler is not started
+		AllowSubmitBeforeStart: true,
+	}
+}
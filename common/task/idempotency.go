@@ -0,0 +1,104 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"time"
+
+	"github.com/uber/cadence/common/cache"
+)
+
+type (
+	// idempotencyKeys remembers the idempotency keys of recently submitted tasks
+	idempotencyKeys struct {
+		cache cache.Cache
+	}
+
+	// idempotencyMarker is stored in the cache for each accepted submission,
+	// it must not be zero sized so that each marker has a distinct address
+	idempotencyMarker struct {
+		submitTime time.Time
+	}
+
+	// idempotentTaskWrapper forgets the idempotency key when the task is nacked,
+	// so that the task can be resubmitted for retry
+	idempotentTaskWrapper struct {
+		taskWrapper
+
+		key  string
+		keys *idempotencyKeys
+	}
+)
+
+func newIdempotencyKeys(
+	size int,
+	ttl time.Duration,
+) *idempotencyKeys {
+	return &idempotencyKeys{
+		cache: cache.New(&cache.Options{
+			MaxCount: size,
+			TTL:      ttl,
+		}),
+	}
+}
+
+// acquire records the idempotency key of the task, it returns the task to be submitted
+// and whether the task is a duplicate of a task submitted earlier within the TTL
+func (k *idempotencyKeys) acquire(
+	task PriorityTask,
+) (PriorityTask, bool) {
+	idempotentTask, ok := unwrapSchedulerTask(task).(IdempotentTask)
+	if !ok {
+		return task, false
+	}
+
+	key := idempotentTask.IdempotencyKey()
+	marker := &idempotencyMarker{submitTime: time.Now()}
+	if existing, err := k.cache.PutIfNotExist(key, marker); err != nil || existing != marker {
+		return task, true
+	}
+
+	return &idempotentTaskWrapper{
+		taskWrapper: taskWrapper{PriorityTask: task},
+		key:         key,
+		keys:        k,
+	}, false
+}
+
+// release forgets the idempotency key of an acquired task
+func (k *idempotencyKeys) release(
+	task PriorityTask,
+) {
+	if wrapper, ok := task.(*idempotentTaskWrapper); ok {
+		k.cache.Delete(wrapper.key)
+	}
+}
+
+func (t *idempotentTaskWrapper) IdempotencyKey() string {
+	return t.key
+}
+
+func (t *idempotentTaskWrapper) Nack() {
+	// key must be released before nacking, in case
+	// the task is resubmitted synchronously in Nack
+	t.keys.release(t)
+	t.PriorityTask.Nack()
+}
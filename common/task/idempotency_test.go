@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	idempotencyKeysSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+
+	testIdempotentTask struct {
+		*MockPriorityTask
+		*MockIdempotentTask
+	}
+)
+
+func TestIdempotencyKeysSuite(t *testing.T) {
+	s := new(idempotencyKeysSuite)
+	suite.Run(t, s)
+}
+
+func (s *idempotencyKeysSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *idempotencyKeysSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *idempotencyKeysSuite) TestAcquire() {
+	keys := newIdempotencyKeys(10, time.Minute)
+
+	plainTask := NewMockPriorityTask(s.controller)
+	task, deduped := keys.acquire(plainTask)
+	s.False(deduped)
+	s.Equal(plainTask, task)
+
+	idempotentTask := s.newTestIdempotentTask("some random key")
+	task, deduped = keys.acquire(idempotentTask)
+	s.False(deduped)
+	s.Equal("some random key", task.(IdempotentTask).IdempotencyKey())
+
+	// same task object submitted again is also a duplicate
+	_, deduped = keys.acquire(idempotentTask)
+	s.True(deduped)
+	_, deduped = keys.acquire(s.newTestIdempotentTask("some random key"))
+	s.True(deduped)
+
+	keys.release(task)
+	_, deduped = keys.acquire(idempotentTask)
+	s.False(deduped)
+}
+
+func (s *idempotencyKeysSuite) TestAcquire_TTL() {
+	keys := newIdempotencyKeys(10, 10*time.Millisecond)
+
+	_, deduped := keys.acquire(s.newTestIdempotentTask("some random key"))
+	s.False(deduped)
+	time.Sleep(20 * time.Millisecond)
+	_, deduped = keys.acquire(s.newTestIdempotentTask("some random key"))
+	s.False(deduped)
+}
+
+func (s *idempotencyKeysSuite) TestNack_ReleaseKey() {
+	keys := newIdempotencyKeys(10, time.Minute)
+
+	idempotentTask := s.newTestIdempotentTask("some random key")
+	task, deduped := keys.acquire(idempotentTask)
+	s.False(deduped)
+
+	idempotentTask.MockPriorityTask.EXPECT().Nack().Do(func() {
+		// key is released before the task is nacked
+		_, deduped := keys.acquire(idempotentTask)
+		s.False(deduped)
+	}).Times(1)
+	task.Nack()
+}
+
+func (s *idempotencyKeysSuite) newTestIdempotentTask(
+	key string,
+) *testIdempotentTask {
+	mockIdempotentTask := NewMockIdempotentTask(s.controller)
+	mockIdempotentTask.EXPECT().IdempotencyKey().Return(key).AnyTimes()
+	return &testIdempotentTask{
+		MockPriorityTask:   NewMockPriorityTask(s.controller),
+		MockIdempotentTask: mockIdempotentTask,
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/cadence/common"
+)
+
+type (
+	// Ingestor reads items from a channel, converts them to tasks and submits them
+	// to a scheduler, so that channel based producers can be bridged to the scheduler.
+	// Reading from the channel is blocked while the scheduler is full, so the
+	// backpressure is propagated to the producers
+	Ingestor struct {
+		status     int32
+		scheduler  Scheduler
+		ch         <-chan interface{}
+		toTask     func(item interface{}) PriorityTask
+		shutdownCh chan struct{}
+		shutdownWG sync.WaitGroup
+	}
+)
+
+const (
+	ingestorShutdownTimeout = time.Minute
+)
+
+var _ common.Daemon = (*Ingestor)(nil)
+
+// NewChannelIngestor creates a new Ingestor reading from ch, items are passed as interface{} as the
+// module can't use type parameters. toTask is invoked with each item received from the channel.
+// The ingestor stops by itself once the channel is closed
+func NewChannelIngestor(
+	scheduler Scheduler,
+	ch <-chan interface{},
+	toTask func(item interface{}) PriorityTask,
+) *Ingestor {
+	return &Ingestor{
+		status:     common.DaemonStatusInitialized,
+		scheduler:  scheduler,
+		ch:         ch,
+		toTask:     toTask,
+		shutdownCh: make(chan struct{}),
+	}
+}
+
+// Start starts reading from the channel
+func (i *Ingestor) Start() {
+	if !atomic.CompareAndSwapInt32(&i.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
+		return
+	}
+
+	i.shutdownWG.Add(1)
+	go i.ingestLoop()
+}
+
+// Stop stops reading from the channel, items not yet received are left in the channel.
+// An item already received is still submitted and may block Stop until the scheduler accepts it
+func (i *Ingestor) Stop() {
+	if !atomic.CompareAndSwapInt32(&i.status, common.DaemonStatusStarted, common.DaemonStatusStopped) {
+		return
+	}
+
+	close(i.shutdownCh)
+	common.AwaitWaitGroup(&i.shutdownWG, ingestorShutdownTimeout)
+}
+
+func (i *Ingestor) ingestLoop() {
+	defer i.shutdownWG.Done()
+
+	for {
+		var item interface{}
+		select {
+		case <-i.shutdownCh:
+			return
+		case received, ok := <-i.ch:
+			if !ok {
+				// the channel is closed
+				return
+			}
+			item = received
+		}
+
+		task := i.toTask(item)
+		if err := i.scheduler.Submit(task); err != nil {
+			// task is not accepted, give it back to its owner
+			task.Nack()
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	ingestorSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller    *gomock.Controller
+		mockScheduler *MockScheduler
+	}
+)
+
+func TestIngestorSuite(t *testing.T) {
+	s := new(ingestorSuite)
+	suite.Run(t, s)
+}
+
+func (s *ingestorSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockScheduler = NewMockScheduler(s.controller)
+}
+
+func (s *ingestorSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *ingestorSuite) TestIngest() {
+	ch := make(chan interface{})
+	tasks := make(map[int]*MockPriorityTask)
+	for item := 0; item != 3; item++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		tasks[item] = mockTask
+		s.mockScheduler.EXPECT().Submit(mockTask).Return(nil).Times(1)
+	}
+	// tasks not accepted by the scheduler are nacked
+	rejectedTask := NewMockPriorityTask(s.controller)
+	tasks[3] = rejectedTask
+	s.mockScheduler.EXPECT().Submit(rejectedTask).Return(errors.New("some random error")).Times(1)
+	rejectedTask.EXPECT().Nack().Times(1)
+
+	ingestor := NewChannelIngestor(s.mockScheduler, ch, func(item interface{}) PriorityTask {
+		return tasks[item.(int)]
+	})
+	ingestor.Start()
+	for item := 0; item != 4; item++ {
+		ch <- item
+	}
+
+	// ingestor stops by itself once the channel is closed
+	close(ch)
+	ingestor.shutdownWG.Wait()
+	ingestor.Stop()
+}
+
+func (s *ingestorSuite) TestStop() {
+	ch := make(chan interface{}, 1)
+	ingestor := NewChannelIngestor(s.mockScheduler, ch, func(item interface{}) PriorityTask {
+		s.Fail("no item should be ingested")
+		return nil
+	})
+	ingestor.Start()
+	ingestor.Stop()
+
+	// items sent after stop are left in the channel
+	ch <- 1
+	s.Len(ch, 1)
+}
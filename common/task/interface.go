@@ -24,6 +24,7 @@ package task
 
 import (
 	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/backoff"
 )
 
 type (
@@ -48,6 +49,21 @@ type (
 	// State represents the current state of a task
 	State int
 
+	// DispatchErrorAction represents the action a scheduler takes when
+	// a task fails to be submitted to the processor
+	DispatchErrorAction int
+
+	// OutOfRangePolicy decides how a scheduler handles tasks whose priority has no weight
+	OutOfRangePolicy int
+
+	// DeadLetterOverflowPolicy decides how a scheduler handles exhausted tasks when the dead letter queue is full
+	DeadLetterOverflowPolicy int
+
+	// DispatchErrorHandler is invoked when a task fails to be submitted to the processor, the returned
+	// action determines what happens to the task. Schedulers pass a *DispatchError wrapping the error
+	// returned by the processor
+	DispatchErrorHandler func(task PriorityTask, err error) DispatchErrorAction
+
 	// Task is the interface for tasks
 	Task interface {
 		// Execute process this task
@@ -73,6 +89,180 @@ type (
 		SetPriority(int)
 	}
 
+	// MetricTaggedTask is the interface for tasks which provide additional
+	// dimensions for the metrics emitted when scheduling and processing the task
+	MetricTaggedTask interface {
+		// MetricTags returns the metric tags of the task, only tags whose key
+		// is in the allowlist configured in the scheduler/processor will be used
+		MetricTags() map[string]string
+	}
+
+	// ResourceCostTask is the interface for tasks which consume scarce resources while being
+	// dispatched but not yet acked or nacked, see WeightedRoundRobinTaskSchedulerOptions.ResourceBudgets
+	ResourceCostTask interface {
+		PriorityTask
+		// ResourceCost returns the cost of the task on each resource dimension,
+		// it should be cheap and return the same cost for the lifetime of the task
+		ResourceCost() map[string]float64
+	}
+
+	// RetryPolicyTask is the interface for tasks which may be retried differently from other tasks, e.g. one
+	// requeued by an admin action which should not be retried at all. The policy of the task takes precedence
+	// over the RetryPolicy of the processor, and of the scheduler which passes its policy to the processor
+	RetryPolicyTask interface {
+		// RetryPolicy returns the retry policy of the task, or nil to use the processor's policy
+		RetryPolicy() backoff.RetryPolicy
+	}
+
+	// BatchableTask is the interface for tasks which can be executed together with other tasks of the same batch
+	// key in a single call, e.g. tasks calling the same downstream endpoint, see ParallelTaskProcessorOptions.BatchWindow
+	BatchableTask interface {
+		PriorityTask
+		// BatchKey returns the key of the batch the task can be executed with, an empty key means the task is
+		// executed on its own via Execute
+		BatchKey() string
+		// BatchExecute executes the tasks of a batch, which includes the task it's called on, and returns
+		// the error of each task in the same order as the tasks
+		BatchExecute(tasks []PriorityTask) []error
+	}
+
+	// CorrelatedTask is the interface for tasks which carry a correlation ID, e.g. the request or workflow ID
+	// the task is created for. The ID is included in the log lines about the task emitted by the schedulers
+	// and processors, such as dispatch errors, slow tasks, execution hook panics and exhaustion
+	CorrelatedTask interface {
+		// CorrelationID returns the correlation ID of the task, an empty ID is not logged
+		CorrelationID() string
+	}
+
+	// IdempotentTask is the interface for tasks which should not be submitted more than once
+	IdempotentTask interface {
+		// IdempotencyKey returns the key identifying the task, submissions
+		// with the same key are considered duplicates
+		IdempotencyKey() string
+	}
+
+	// ReplaceableTask is the interface for tasks which can replace a queued task with the same key
+	ReplaceableTask interface {
+		PriorityTask
+		// ReplaceKey returns the key of the task, the returned value must be comparable
+		ReplaceKey() interface{}
+	}
+
+	// SequencedTask is the interface for tasks which must be dispatched in the order of their sequence numbers
+	SequencedTask interface {
+		PriorityTask
+		// Sequence returns the sequence number of the task, which is unique among the tasks of a stream
+		Sequence() int64
+	}
+
+	// NamedTask is the interface for tasks routed to a named queue by NamedQueueScheduler
+	NamedTask interface {
+		PriorityTask
+		// QueueName returns the name of the queue the task belongs to, e.g. the task category
+		QueueName() string
+	}
+
+	// PartitionedTask is the interface for tasks routed to a partition by PartitionedScheduler
+	PartitionedTask interface {
+		PriorityTask
+		// PartitionKey returns the key of the task, tasks with the same key are submitted to the same partition
+		PartitionKey() string
+	}
+
+	// HierarchicalTask is the interface for tasks routed to a child scheduler by HierarchicalScheduler
+	HierarchicalTask interface {
+		PriorityTask
+		// Child returns the name of the child scheduler the task is submitted to
+		Child() string
+	}
+
+	// DependentTask is the interface for tasks which call a downstream dependency, so that the
+	// WRR task scheduler can stop dispatching them while the dependency keeps failing
+	DependentTask interface {
+		PriorityTask
+		// Dependency returns the name of the downstream dependency the task calls
+		Dependency() string
+	}
+
+	// PreemptibleTask is the interface for long running tasks which can yield their worker to tasks of higher
+	// priorities, e.g. by saving their progress and submitting themselves again. Preemption is cooperative,
+	// the task keeps occupying the worker until its execution returns
+	PreemptibleTask interface {
+		PriorityTask
+		// Preempt asks the task being executed to yield, it may be called concurrently with the execution
+		Preempt()
+	}
+
+	// NonDroppableTask is the interface for tasks which must not be discarded by the WRR task scheduler.
+	// They're never shed, evicted or expired, and on stop they're either executed or handed to
+	// OnTasksDropped, HandoffTarget or the dead letter queue of their priority, see NonDroppableGracePeriod
+	NonDroppableTask interface {
+		PriorityTask
+		// NonDroppable returns true if the task must not be dropped
+		NonDroppable() bool
+	}
+
+	// YieldChecker is polled by long running ContextAwareTasks executed by a WRR task scheduler created with
+	// CooperativeYield, see YieldCheckerFromContext. When ShouldYield returns true, the task should save its
+	// progress and return ErrTaskYielded from ExecuteWithContext, so that its worker is freed for tasks of
+	// higher priorities and the task is queued again at the tail of its priority queue. Yielding is
+	// cooperative, a task which never polls the checker keeps occupying its worker until it completes
+	YieldChecker interface {
+		// ShouldYield returns true if tasks of higher priorities are waiting while all workers are busy,
+		// it's safe to be called concurrently and cheap enough to be polled between units of work
+		ShouldYield() bool
+	}
+
+	// DynamicPriorityTask is the interface for tasks whose priority depends on conditions that evolve between
+	// submission and dispatch, e.g. an approaching deadline. The priority is resolved at dispatch time when
+	// the WRR task scheduler is created with DynamicPriority, otherwise the task is a regular PriorityTask
+	DynamicPriorityTask interface {
+		PriorityTask
+		// CurrentPriority returns the priority of the task at the moment, it's called with the
+		// scheduler's locks held, so it must be cheap and must not call the scheduler
+		CurrentPriority() int
+	}
+
+	// BulkNackableTask is the interface for tasks which can be nacked in bulk
+	BulkNackableTask interface {
+		// BulkNacker returns the nacker for the task, tasks with the same nacker
+		// are nacked in a single call. The returned value must be comparable
+		BulkNacker() BulkNacker
+	}
+
+	// BulkNacker nacks a group of tasks in a single call
+	BulkNacker interface {
+		// NackAll nacks all the given tasks
+		NackAll(tasks []PriorityTask)
+	}
+
+	// TaskQueue is the read side of a scheduler's per priority task queue,
+	// exposed to DispatchStrategy for selecting the next task to dispatch
+	TaskQueue interface {
+		// Priority returns the priority of tasks in the queue
+		Priority() int
+		// Len returns the number of tasks in the queue
+		Len() int
+		// Poll removes and returns the task at the head of the queue,
+		// returns false if the queue is empty
+		Poll() (PriorityTask, bool)
+	}
+
+	// DispatchStrategy decides which task is dispatched next by a scheduler,
+	// calls to Next are serialized by the scheduler, so implementation can be stateful
+	DispatchStrategy interface {
+		// Next polls the next task to dispatch from the given queues, which are sorted by priority,
+		// or by the scheduler's PriorityOrder if specified, returns false if no task should be dispatched now
+		Next(queues []TaskQueue) (PriorityTask, bool)
+	}
+
+	// DispatchLimiter decides whether a task can be dispatched now, it's consulted before dispatching
+	// each task, so that task execution can respect quotas like the domain rate limits. Implementations
+	// may consume a token upon approval, as a task is always dispatched once Allow returns true
+	DispatchLimiter interface {
+		Allow(task PriorityTask) bool
+	}
+
 	// SequentialTaskQueueFactory is the function which generate a new SequentialTaskQueue
 	// for a give SequentialTask
 	SequentialTaskQueueFactory func(task Task) SequentialTaskQueue
@@ -100,6 +290,33 @@ const (
 	SchedulerTypeWRR
 )
 
+const (
+	// DispatchErrorActionNack nacks the task, this is the default action
+	DispatchErrorActionNack DispatchErrorAction = iota + 1
+	// DispatchErrorActionRetry puts the task back to its priority queue so that it
+	// will be dispatched again in a later round, the task will be nacked if the queue is full
+	DispatchErrorActionRetry
+	// DispatchErrorActionDrop neither acks nor nacks the task, the handler takes ownership of the task
+	DispatchErrorActionDrop
+)
+
+const (
+	// OutOfRangePolicyReject fails the submission of the task, this is the default policy
+	OutOfRangePolicyReject OutOfRangePolicy = iota
+	// OutOfRangePolicyClampToLowest assigns the lowest priority with a weight, i.e. the largest value, to the task
+	OutOfRangePolicyClampToLowest
+	// OutOfRangePolicyClampToHighest assigns the highest priority with a weight, i.e. the smallest value, to the task
+	OutOfRangePolicyClampToHighest
+)
+
+const (
+	// DeadLetterOverflowPolicyFallback handles the exhausted task as if the priority had no
+	// dead letter queue, i.e. via OnTaskExhausted or Nack, this is the default policy
+	DeadLetterOverflowPolicyFallback DeadLetterOverflowPolicy = iota
+	// DeadLetterOverflowPolicyDropOldest nacks the oldest task in the dead letter queue to make room
+	DeadLetterOverflowPolicyDropOldest
+)
+
 const (
 	// TaskStatePending is the state for a task when it's waiting to be processed or currently being processed
 	TaskStatePending State = iota + 1
@@ -402,6 +402,1435 @@ func (mr *MockPriorityTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockPriorityTask)(nil).SetPriority), arg0)
 }
 
+// MockMetricTaggedTask is a mock of MetricTaggedTask interface
+type MockMetricTaggedTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockMetricTaggedTaskMockRecorder
+}
+
+// MockMetricTaggedTaskMockRecorder is the mock recorder for MockMetricTaggedTask
+type MockMetricTaggedTaskMockRecorder struct {
+	mock *MockMetricTaggedTask
+}
+
+// NewMockMetricTaggedTask creates a new mock instance
+func NewMockMetricTaggedTask(ctrl *gomock.Controller) *MockMetricTaggedTask {
+	mock := &MockMetricTaggedTask{ctrl: ctrl}
+	mock.recorder = &MockMetricTaggedTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockMetricTaggedTask) EXPECT() *MockMetricTaggedTaskMockRecorder {
+	return m.recorder
+}
+
+// MetricTags mocks base method
+func (m *MockMetricTaggedTask) MetricTags() map[string]string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MetricTags")
+	ret0, _ := ret[0].(map[string]string)
+	return ret0
+}
+
+// MetricTags indicates an expected call of MetricTags
+func (mr *MockMetricTaggedTaskMockRecorder) MetricTags() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MetricTags", reflect.TypeOf((*MockMetricTaggedTask)(nil).MetricTags))
+}
+
+// MockIdempotentTask is a mock of IdempotentTask interface
+type MockIdempotentTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockIdempotentTaskMockRecorder
+}
+
+// MockIdempotentTaskMockRecorder is the mock recorder for MockIdempotentTask
+type MockIdempotentTaskMockRecorder struct {
+	mock *MockIdempotentTask
+}
+
+// NewMockIdempotentTask creates a new mock instance
+func NewMockIdempotentTask(ctrl *gomock.Controller) *MockIdempotentTask {
+	mock := &MockIdempotentTask{ctrl: ctrl}
+	mock.recorder = &MockIdempotentTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockIdempotentTask) EXPECT() *MockIdempotentTaskMockRecorder {
+	return m.recorder
+}
+
+// IdempotencyKey mocks base method
+func (m *MockIdempotentTask) IdempotencyKey() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IdempotencyKey")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// IdempotencyKey indicates an expected call of IdempotencyKey
+func (mr *MockIdempotentTaskMockRecorder) IdempotencyKey() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IdempotencyKey", reflect.TypeOf((*MockIdempotentTask)(nil).IdempotencyKey))
+}
+
+// MockReplaceableTask is a mock of ReplaceableTask interface
+type MockReplaceableTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockReplaceableTaskMockRecorder
+}
+
+// MockReplaceableTaskMockRecorder is the mock recorder for MockReplaceableTask
+type MockReplaceableTaskMockRecorder struct {
+	mock *MockReplaceableTask
+}
+
+// NewMockReplaceableTask creates a new mock instance
+func NewMockReplaceableTask(ctrl *gomock.Controller) *MockReplaceableTask {
+	mock := &MockReplaceableTask{ctrl: ctrl}
+	mock.recorder = &MockReplaceableTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockReplaceableTask) EXPECT() *MockReplaceableTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockReplaceableTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockReplaceableTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockReplaceableTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockReplaceableTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockReplaceableTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockReplaceableTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockReplaceableTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockReplaceableTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockReplaceableTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockReplaceableTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockReplaceableTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockReplaceableTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockReplaceableTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockReplaceableTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockReplaceableTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockReplaceableTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockReplaceableTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockReplaceableTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockReplaceableTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockReplaceableTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockReplaceableTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockReplaceableTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockReplaceableTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockReplaceableTask)(nil).SetPriority), arg0)
+}
+
+// ReplaceKey mocks base method
+func (m *MockReplaceableTask) ReplaceKey() interface{} {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReplaceKey")
+	ret0, _ := ret[0].(interface{})
+	return ret0
+}
+
+// ReplaceKey indicates an expected call of ReplaceKey
+func (mr *MockReplaceableTaskMockRecorder) ReplaceKey() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReplaceKey", reflect.TypeOf((*MockReplaceableTask)(nil).ReplaceKey))
+}
+
+// MockSequencedTask is a mock of SequencedTask interface
+type MockSequencedTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockSequencedTaskMockRecorder
+}
+
+// MockSequencedTaskMockRecorder is the mock recorder for MockSequencedTask
+type MockSequencedTaskMockRecorder struct {
+	mock *MockSequencedTask
+}
+
+// NewMockSequencedTask creates a new mock instance
+func NewMockSequencedTask(ctrl *gomock.Controller) *MockSequencedTask {
+	mock := &MockSequencedTask{ctrl: ctrl}
+	mock.recorder = &MockSequencedTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSequencedTask) EXPECT() *MockSequencedTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockSequencedTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockSequencedTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockSequencedTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockSequencedTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockSequencedTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockSequencedTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockSequencedTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockSequencedTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockSequencedTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockSequencedTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockSequencedTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockSequencedTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockSequencedTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockSequencedTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockSequencedTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockSequencedTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockSequencedTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockSequencedTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockSequencedTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockSequencedTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockSequencedTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockSequencedTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockSequencedTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockSequencedTask)(nil).SetPriority), arg0)
+}
+
+// Sequence mocks base method
+func (m *MockSequencedTask) Sequence() int64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Sequence")
+	ret0, _ := ret[0].(int64)
+	return ret0
+}
+
+// Sequence indicates an expected call of Sequence
+func (mr *MockSequencedTaskMockRecorder) Sequence() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Sequence", reflect.TypeOf((*MockSequencedTask)(nil).Sequence))
+}
+
+// MockNamedTask is a mock of NamedTask interface
+type MockNamedTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockNamedTaskMockRecorder
+}
+
+// MockNamedTaskMockRecorder is the mock recorder for MockNamedTask
+type MockNamedTaskMockRecorder struct {
+	mock *MockNamedTask
+}
+
+// NewMockNamedTask creates a new mock instance
+func NewMockNamedTask(ctrl *gomock.Controller) *MockNamedTask {
+	mock := &MockNamedTask{ctrl: ctrl}
+	mock.recorder = &MockNamedTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockNamedTask) EXPECT() *MockNamedTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockNamedTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockNamedTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockNamedTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockNamedTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockNamedTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockNamedTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockNamedTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockNamedTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockNamedTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockNamedTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockNamedTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockNamedTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockNamedTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockNamedTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockNamedTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockNamedTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockNamedTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockNamedTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockNamedTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockNamedTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockNamedTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockNamedTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockNamedTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockNamedTask)(nil).SetPriority), arg0)
+}
+
+// QueueName mocks base method
+func (m *MockNamedTask) QueueName() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QueueName")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// QueueName indicates an expected call of QueueName
+func (mr *MockNamedTaskMockRecorder) QueueName() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueueName", reflect.TypeOf((*MockNamedTask)(nil).QueueName))
+}
+
+// MockPartitionedTask is a mock of PartitionedTask interface
+type MockPartitionedTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockPartitionedTaskMockRecorder
+}
+
+// MockPartitionedTaskMockRecorder is the mock recorder for MockPartitionedTask
+type MockPartitionedTaskMockRecorder struct {
+	mock *MockPartitionedTask
+}
+
+// NewMockPartitionedTask creates a new mock instance
+func NewMockPartitionedTask(ctrl *gomock.Controller) *MockPartitionedTask {
+	mock := &MockPartitionedTask{ctrl: ctrl}
+	mock.recorder = &MockPartitionedTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockPartitionedTask) EXPECT() *MockPartitionedTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockPartitionedTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockPartitionedTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockPartitionedTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockPartitionedTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockPartitionedTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockPartitionedTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockPartitionedTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockPartitionedTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockPartitionedTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockPartitionedTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockPartitionedTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockPartitionedTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockPartitionedTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockPartitionedTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockPartitionedTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockPartitionedTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockPartitionedTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockPartitionedTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockPartitionedTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockPartitionedTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockPartitionedTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockPartitionedTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockPartitionedTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockPartitionedTask)(nil).SetPriority), arg0)
+}
+
+// PartitionKey mocks base method
+func (m *MockPartitionedTask) PartitionKey() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PartitionKey")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// PartitionKey indicates an expected call of PartitionKey
+func (mr *MockPartitionedTaskMockRecorder) PartitionKey() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PartitionKey", reflect.TypeOf((*MockPartitionedTask)(nil).PartitionKey))
+}
+
+// MockHierarchicalTask is a mock of HierarchicalTask interface
+type MockHierarchicalTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockHierarchicalTaskMockRecorder
+}
+
+// MockHierarchicalTaskMockRecorder is the mock recorder for MockHierarchicalTask
+type MockHierarchicalTaskMockRecorder struct {
+	mock *MockHierarchicalTask
+}
+
+// NewMockHierarchicalTask creates a new mock instance
+func NewMockHierarchicalTask(ctrl *gomock.Controller) *MockHierarchicalTask {
+	mock := &MockHierarchicalTask{ctrl: ctrl}
+	mock.recorder = &MockHierarchicalTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockHierarchicalTask) EXPECT() *MockHierarchicalTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockHierarchicalTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockHierarchicalTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockHierarchicalTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockHierarchicalTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockHierarchicalTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockHierarchicalTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockHierarchicalTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockHierarchicalTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockHierarchicalTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockHierarchicalTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockHierarchicalTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockHierarchicalTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockHierarchicalTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockHierarchicalTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockHierarchicalTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockHierarchicalTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockHierarchicalTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockHierarchicalTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockHierarchicalTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockHierarchicalTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockHierarchicalTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockHierarchicalTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockHierarchicalTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockHierarchicalTask)(nil).SetPriority), arg0)
+}
+
+// Child mocks base method
+func (m *MockHierarchicalTask) Child() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Child")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Child indicates an expected call of Child
+func (mr *MockHierarchicalTaskMockRecorder) Child() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Child", reflect.TypeOf((*MockHierarchicalTask)(nil).Child))
+}
+
+// MockDependentTask is a mock of DependentTask interface
+type MockDependentTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockDependentTaskMockRecorder
+}
+
+// MockDependentTaskMockRecorder is the mock recorder for MockDependentTask
+type MockDependentTaskMockRecorder struct {
+	mock *MockDependentTask
+}
+
+// NewMockDependentTask creates a new mock instance
+func NewMockDependentTask(ctrl *gomock.Controller) *MockDependentTask {
+	mock := &MockDependentTask{ctrl: ctrl}
+	mock.recorder = &MockDependentTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockDependentTask) EXPECT() *MockDependentTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockDependentTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockDependentTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockDependentTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockDependentTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockDependentTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockDependentTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockDependentTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockDependentTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockDependentTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockDependentTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockDependentTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockDependentTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockDependentTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockDependentTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockDependentTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockDependentTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockDependentTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockDependentTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockDependentTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockDependentTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockDependentTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockDependentTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockDependentTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockDependentTask)(nil).SetPriority), arg0)
+}
+
+// Dependency mocks base method
+func (m *MockDependentTask) Dependency() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Dependency")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Dependency indicates an expected call of Dependency
+func (mr *MockDependentTaskMockRecorder) Dependency() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dependency", reflect.TypeOf((*MockDependentTask)(nil).Dependency))
+}
+
+// MockPreemptibleTask is a mock of PreemptibleTask interface
+type MockPreemptibleTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockPreemptibleTaskMockRecorder
+}
+
+// MockPreemptibleTaskMockRecorder is the mock recorder for MockPreemptibleTask
+type MockPreemptibleTaskMockRecorder struct {
+	mock *MockPreemptibleTask
+}
+
+// NewMockPreemptibleTask creates a new mock instance
+func NewMockPreemptibleTask(ctrl *gomock.Controller) *MockPreemptibleTask {
+	mock := &MockPreemptibleTask{ctrl: ctrl}
+	mock.recorder = &MockPreemptibleTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockPreemptibleTask) EXPECT() *MockPreemptibleTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockPreemptibleTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockPreemptibleTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockPreemptibleTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockPreemptibleTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockPreemptibleTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockPreemptibleTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockPreemptibleTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockPreemptibleTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockPreemptibleTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockPreemptibleTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockPreemptibleTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockPreemptibleTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockPreemptibleTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockPreemptibleTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockPreemptibleTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockPreemptibleTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockPreemptibleTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockPreemptibleTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockPreemptibleTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockPreemptibleTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockPreemptibleTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockPreemptibleTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockPreemptibleTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockPreemptibleTask)(nil).SetPriority), arg0)
+}
+
+// Preempt mocks base method
+func (m *MockPreemptibleTask) Preempt() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Preempt")
+}
+
+// Preempt indicates an expected call of Preempt
+func (mr *MockPreemptibleTaskMockRecorder) Preempt() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Preempt", reflect.TypeOf((*MockPreemptibleTask)(nil).Preempt))
+}
+
+// MockDynamicPriorityTask is a mock of DynamicPriorityTask interface
+type MockDynamicPriorityTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockDynamicPriorityTaskMockRecorder
+}
+
+// MockDynamicPriorityTaskMockRecorder is the mock recorder for MockDynamicPriorityTask
+type MockDynamicPriorityTaskMockRecorder struct {
+	mock *MockDynamicPriorityTask
+}
+
+// NewMockDynamicPriorityTask creates a new mock instance
+func NewMockDynamicPriorityTask(ctrl *gomock.Controller) *MockDynamicPriorityTask {
+	mock := &MockDynamicPriorityTask{ctrl: ctrl}
+	mock.recorder = &MockDynamicPriorityTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockDynamicPriorityTask) EXPECT() *MockDynamicPriorityTaskMockRecorder {
+	return m.recorder
+}
+
+// Execute mocks base method
+func (m *MockDynamicPriorityTask) Execute() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Execute indicates an expected call of Execute
+func (mr *MockDynamicPriorityTaskMockRecorder) Execute() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockDynamicPriorityTask)(nil).Execute))
+}
+
+// HandleErr mocks base method
+func (m *MockDynamicPriorityTask) HandleErr(err error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandleErr", err)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HandleErr indicates an expected call of HandleErr
+func (mr *MockDynamicPriorityTaskMockRecorder) HandleErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleErr", reflect.TypeOf((*MockDynamicPriorityTask)(nil).HandleErr), err)
+}
+
+// RetryErr mocks base method
+func (m *MockDynamicPriorityTask) RetryErr(err error) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryErr", err)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// RetryErr indicates an expected call of RetryErr
+func (mr *MockDynamicPriorityTaskMockRecorder) RetryErr(err interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryErr", reflect.TypeOf((*MockDynamicPriorityTask)(nil).RetryErr), err)
+}
+
+// Ack mocks base method
+func (m *MockDynamicPriorityTask) Ack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Ack")
+}
+
+// Ack indicates an expected call of Ack
+func (mr *MockDynamicPriorityTaskMockRecorder) Ack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*MockDynamicPriorityTask)(nil).Ack))
+}
+
+// Nack mocks base method
+func (m *MockDynamicPriorityTask) Nack() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Nack")
+}
+
+// Nack indicates an expected call of Nack
+func (mr *MockDynamicPriorityTaskMockRecorder) Nack() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*MockDynamicPriorityTask)(nil).Nack))
+}
+
+// State mocks base method
+func (m *MockDynamicPriorityTask) State() State {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(State)
+	return ret0
+}
+
+// State indicates an expected call of State
+func (mr *MockDynamicPriorityTaskMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockDynamicPriorityTask)(nil).State))
+}
+
+// Priority mocks base method
+func (m *MockDynamicPriorityTask) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockDynamicPriorityTaskMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockDynamicPriorityTask)(nil).Priority))
+}
+
+// SetPriority mocks base method
+func (m *MockDynamicPriorityTask) SetPriority(arg0 int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPriority", arg0)
+}
+
+// SetPriority indicates an expected call of SetPriority
+func (mr *MockDynamicPriorityTaskMockRecorder) SetPriority(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPriority", reflect.TypeOf((*MockDynamicPriorityTask)(nil).SetPriority), arg0)
+}
+
+// CurrentPriority mocks base method
+func (m *MockDynamicPriorityTask) CurrentPriority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CurrentPriority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// CurrentPriority indicates an expected call of CurrentPriority
+func (mr *MockDynamicPriorityTaskMockRecorder) CurrentPriority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CurrentPriority", reflect.TypeOf((*MockDynamicPriorityTask)(nil).CurrentPriority))
+}
+
+// MockBulkNackableTask is a mock of BulkNackableTask interface
+type MockBulkNackableTask struct {
+	ctrl     *gomock.Controller
+	recorder *MockBulkNackableTaskMockRecorder
+}
+
+// MockBulkNackableTaskMockRecorder is the mock recorder for MockBulkNackableTask
+type MockBulkNackableTaskMockRecorder struct {
+	mock *MockBulkNackableTask
+}
+
+// NewMockBulkNackableTask creates a new mock instance
+func NewMockBulkNackableTask(ctrl *gomock.Controller) *MockBulkNackableTask {
+	mock := &MockBulkNackableTask{ctrl: ctrl}
+	mock.recorder = &MockBulkNackableTaskMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockBulkNackableTask) EXPECT() *MockBulkNackableTaskMockRecorder {
+	return m.recorder
+}
+
+// BulkNacker mocks base method
+func (m *MockBulkNackableTask) BulkNacker() BulkNacker {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BulkNacker")
+	ret0, _ := ret[0].(BulkNacker)
+	return ret0
+}
+
+// BulkNacker indicates an expected call of BulkNacker
+func (mr *MockBulkNackableTaskMockRecorder) BulkNacker() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BulkNacker", reflect.TypeOf((*MockBulkNackableTask)(nil).BulkNacker))
+}
+
+// MockBulkNacker is a mock of BulkNacker interface
+type MockBulkNacker struct {
+	ctrl     *gomock.Controller
+	recorder *MockBulkNackerMockRecorder
+}
+
+// MockBulkNackerMockRecorder is the mock recorder for MockBulkNacker
+type MockBulkNackerMockRecorder struct {
+	mock *MockBulkNacker
+}
+
+// NewMockBulkNacker creates a new mock instance
+func NewMockBulkNacker(ctrl *gomock.Controller) *MockBulkNacker {
+	mock := &MockBulkNacker{ctrl: ctrl}
+	mock.recorder = &MockBulkNackerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockBulkNacker) EXPECT() *MockBulkNackerMockRecorder {
+	return m.recorder
+}
+
+// NackAll mocks base method
+func (m *MockBulkNacker) NackAll(tasks []PriorityTask) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "NackAll", tasks)
+}
+
+// NackAll indicates an expected call of NackAll
+func (mr *MockBulkNackerMockRecorder) NackAll(tasks interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NackAll", reflect.TypeOf((*MockBulkNacker)(nil).NackAll), tasks)
+}
+
+// MockTaskQueue is a mock of TaskQueue interface
+type MockTaskQueue struct {
+	ctrl     *gomock.Controller
+	recorder *MockTaskQueueMockRecorder
+}
+
+// MockTaskQueueMockRecorder is the mock recorder for MockTaskQueue
+type MockTaskQueueMockRecorder struct {
+	mock *MockTaskQueue
+}
+
+// NewMockTaskQueue creates a new mock instance
+func NewMockTaskQueue(ctrl *gomock.Controller) *MockTaskQueue {
+	mock := &MockTaskQueue{ctrl: ctrl}
+	mock.recorder = &MockTaskQueueMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockTaskQueue) EXPECT() *MockTaskQueueMockRecorder {
+	return m.recorder
+}
+
+// Priority mocks base method
+func (m *MockTaskQueue) Priority() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Priority")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Priority indicates an expected call of Priority
+func (mr *MockTaskQueueMockRecorder) Priority() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Priority", reflect.TypeOf((*MockTaskQueue)(nil).Priority))
+}
+
+// Len mocks base method
+func (m *MockTaskQueue) Len() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Len")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Len indicates an expected call of Len
+func (mr *MockTaskQueueMockRecorder) Len() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Len", reflect.TypeOf((*MockTaskQueue)(nil).Len))
+}
+
+// Poll mocks base method
+func (m *MockTaskQueue) Poll() (PriorityTask, bool) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Poll")
+	ret0, _ := ret[0].(PriorityTask)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// Poll indicates an expected call of Poll
+func (mr *MockTaskQueueMockRecorder) Poll() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Poll", reflect.TypeOf((*MockTaskQueue)(nil).Poll))
+}
+
+// MockDispatchStrategy is a mock of DispatchStrategy interface
+type MockDispatchStrategy struct {
+	ctrl     *gomock.Controller
+	recorder *MockDispatchStrategyMockRecorder
+}
+
+// MockDispatchStrategyMockRecorder is the mock recorder for MockDispatchStrategy
+type MockDispatchStrategyMockRecorder struct {
+	mock *MockDispatchStrategy
+}
+
+// NewMockDispatchStrategy creates a new mock instance
+func NewMockDispatchStrategy(ctrl *gomock.Controller) *MockDispatchStrategy {
+	mock := &MockDispatchStrategy{ctrl: ctrl}
+	mock.recorder = &MockDispatchStrategyMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockDispatchStrategy) EXPECT() *MockDispatchStrategyMockRecorder {
+	return m.recorder
+}
+
+// Next mocks base method
+func (m *MockDispatchStrategy) Next(queues []TaskQueue) (PriorityTask, bool) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Next", queues)
+	ret0, _ := ret[0].(PriorityTask)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// Next indicates an expected call of Next
+func (mr *MockDispatchStrategyMockRecorder) Next(queues interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockDispatchStrategy)(nil).Next), queues)
+}
+
+// MockDispatchLimiter is a mock of DispatchLimiter interface
+type MockDispatchLimiter struct {
+	ctrl     *gomock.Controller
+	recorder *MockDispatchLimiterMockRecorder
+}
+
+// MockDispatchLimiterMockRecorder is the mock recorder for MockDispatchLimiter
+type MockDispatchLimiterMockRecorder struct {
+	mock *MockDispatchLimiter
+}
+
+// NewMockDispatchLimiter creates a new mock instance
+func NewMockDispatchLimiter(ctrl *gomock.Controller) *MockDispatchLimiter {
+	mock := &MockDispatchLimiter{ctrl: ctrl}
+	mock.recorder = &MockDispatchLimiterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockDispatchLimiter) EXPECT() *MockDispatchLimiterMockRecorder {
+	return m.recorder
+}
+
+// Allow mocks base method
+func (m *MockDispatchLimiter) Allow(task PriorityTask) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Allow", task)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Allow indicates an expected call of Allow
+func (mr *MockDispatchLimiterMockRecorder) Allow(task interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Allow", reflect.TypeOf((*MockDispatchLimiter)(nil).Allow), task)
+}
+
 // MockSequentialTaskQueue is a mock of SequentialTaskQueue interface
 type MockSequentialTaskQueue struct {
 	ctrl     *gomock.Controller
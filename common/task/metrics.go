@@ -0,0 +1,235 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// batchedCounters accumulates counter increments keyed by the metric and tags,
+	// so that each counter is emitted in a single call when flushed
+	batchedCounters struct {
+		sync.RWMutex
+
+		counters map[string]*batchedCounter
+	}
+
+	batchedCounter struct {
+		metric int
+		tags   []metrics.Tag
+		value  int64
+	}
+
+	// priorityScopes caches the sub-scope of each task priority, so that metrics of
+	// different priorities are emitted to distinct scopes without tagging them on every emission
+	priorityScopes struct {
+		scope  metrics.Scope
+		scopes sync.Map // priority -> metrics.Scope
+	}
+)
+
+func newMetricTagAllowlist(
+	keys []string,
+) map[string]struct{} {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	allowlist := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		allowlist[key] = struct{}{}
+	}
+	return allowlist
+}
+
+// getTaskMetricsScope returns the metrics scope tagged with the task priority
+// and the task's metric tags that are in the allowlist
+func getTaskMetricsScope(
+	scope metrics.Scope,
+	task Task,
+	priority int,
+	allowlist map[string]struct{},
+) metrics.Scope {
+	return getTaggedMetricsScope(scope, getTaskMetricsTags(task, priority, allowlist))
+}
+
+// getTaskMetricsTags returns the task priority tag
+// and the task's metric tags that are in the allowlist
+func getTaskMetricsTags(
+	task Task,
+	priority int,
+	allowlist map[string]struct{},
+) []metrics.Tag {
+	var tags []metrics.Tag
+	if priority != NoPriority {
+		tags = append(tags, metrics.TaskPriorityTag(priority))
+	}
+	if taggedTask, ok := task.(MetricTaggedTask); ok && len(allowlist) != 0 {
+		for key, value := range taggedTask.MetricTags() {
+			if _, ok := allowlist[key]; ok {
+				tags = append(tags, metrics.StringTag(key, value))
+			}
+		}
+	}
+	return tags
+}
+
+// getAllowedMetricTags returns the task's metric tags that are in the allowlist
+func getAllowedMetricTags(
+	task Task,
+	allowlist map[string]struct{},
+) map[string]string {
+	taggedTask, ok := task.(MetricTaggedTask)
+	if !ok || len(allowlist) == 0 {
+		return nil
+	}
+	var tags map[string]string
+	for key, value := range taggedTask.MetricTags() {
+		if _, ok := allowlist[key]; ok {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+func newPriorityScopes(
+	scope metrics.Scope,
+) *priorityScopes {
+	return &priorityScopes{
+		scope: scope,
+	}
+}
+
+// get returns the sub-scope of the priority, which is
+// created on first use and never removed afterwards
+func (s *priorityScopes) get(
+	priority int,
+) metrics.Scope {
+	if priority == NoPriority {
+		return s.scope
+	}
+	if scope, ok := s.scopes.Load(priority); ok {
+		return scope.(metrics.Scope)
+	}
+	scope, _ := s.scopes.LoadOrStore(priority, s.scope.Tagged(metrics.TaskPriorityTag(priority)))
+	return scope.(metrics.Scope)
+}
+
+// getTaskScope is the same as getTaskMetricsScope,
+// except that the scope of the priority is reused
+func (s *priorityScopes) getTaskScope(
+	task Task,
+	priority int,
+	allowlist map[string]struct{},
+) metrics.Scope {
+	return getTaggedMetricsScope(s.get(priority), getTaskMetricsTags(task, NoPriority, allowlist))
+}
+
+func getTaggedMetricsScope(
+	scope metrics.Scope,
+	tags []metrics.Tag,
+) metrics.Scope {
+	if len(tags) == 0 {
+		return scope
+	}
+	return scope.Tagged(tags...)
+}
+
+// recordLatency records the time elapsed since start to the timer. It replaces StartTimer and Stop
+// on the per task paths, as each stopwatch allocates the slice of its timers
+func recordLatency(
+	scope metrics.Scope,
+	timer int,
+	start time.Time,
+) {
+	scope.RecordTimer(timer, time.Since(start))
+}
+
+func newBatchedCounters() *batchedCounters {
+	return &batchedCounters{
+		counters: make(map[string]*batchedCounter),
+	}
+}
+
+// add increases the counter of the metric with the given tags, the
+// counter is created on first use and never removed afterwards
+func (c *batchedCounters) add(
+	metric int,
+	tags []metrics.Tag,
+	delta int64,
+) {
+	key := batchedCounterKey(metric, tags)
+
+	c.RLock()
+	counter, ok := c.counters[key]
+	c.RUnlock()
+	if !ok {
+		c.Lock()
+		if counter, ok = c.counters[key]; !ok {
+			counter = &batchedCounter{
+				metric: metric,
+				tags:   tags,
+			}
+			c.counters[key] = counter
+		}
+		c.Unlock()
+	}
+	atomic.AddInt64(&counter.value, delta)
+}
+
+// flush emits the increments accumulated since the last flush to the scope
+func (c *batchedCounters) flush(
+	scope metrics.Scope,
+) {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, counter := range c.counters {
+		if value := atomic.SwapInt64(&counter.value, 0); value != 0 {
+			getTaggedMetricsScope(scope, counter.tags).AddCounter(counter.metric, value)
+		}
+	}
+}
+
+// batchedCounterKey identifies the counter by the metric and tags, tags are
+// sorted as the order of the tags from MetricTaggedTask is not deterministic
+func batchedCounterKey(
+	metric int,
+	tags []metrics.Tag,
+) string {
+	tagPairs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tagPairs = append(tagPairs, tag.Key()+"="+tag.Value())
+	}
+	sort.Strings(tagPairs)
+	return strconv.Itoa(metric) + "," + strings.Join(tagPairs, ",")
+}
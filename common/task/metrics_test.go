@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	testMetricTaggedTask struct {
+		*MockPriorityTask
+		*MockMetricTaggedTask
+	}
+)
+
+func TestGetTaskMetricsScope(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	testScope := tally.NewTestScope("test", nil)
+	scope := metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope)
+
+	mockTaggedTask := NewMockMetricTaggedTask(controller)
+	mockTaggedTask.EXPECT().MetricTags().Return(map[string]string{
+		"tenant":    "some random tenant",
+		"task_type": "some random type",
+	}).Times(1)
+	task := &testMetricTaggedTask{
+		MockPriorityTask:     NewMockPriorityTask(controller),
+		MockMetricTaggedTask: mockTaggedTask,
+	}
+
+	allowlist := newMetricTagAllowlist([]string{"tenant"})
+	getTaskMetricsScope(scope, task, 2, allowlist).IncCounter(metrics.PriorityTaskSubmitRequest)
+	getTaskMetricsScope(scope, task, NoPriority, nil).IncCounter(metrics.PriorityTaskSubmitRequest)
+
+	counters := testScope.Snapshot().Counters()
+	require.Len(t, counters, 2)
+	for _, counter := range counters {
+		tags := counter.Tags()
+		if _, ok := tags["task_priority"]; ok {
+			require.Equal(t, "2", tags["task_priority"])
+			require.Equal(t, "some random tenant", tags["tenant"])
+			require.NotContains(t, tags, "task_type")
+		} else {
+			require.NotContains(t, tags, "tenant")
+		}
+	}
+}
+
+func TestPriorityScopes(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	testScope := tally.NewTestScope("test", nil)
+	scopes := newPriorityScopes(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	require.True(t, scopes.get(1) == scopes.get(1))
+	require.True(t, scopes.get(NoPriority) == scopes.scope)
+
+	mockTaggedTask := NewMockMetricTaggedTask(controller)
+	mockTaggedTask.EXPECT().MetricTags().Return(map[string]string{
+		"tenant":    "some random tenant",
+		"task_type": "some random type",
+	}).Times(1)
+	task := &testMetricTaggedTask{
+		MockPriorityTask:     NewMockPriorityTask(controller),
+		MockMetricTaggedTask: mockTaggedTask,
+	}
+	scopes.getTaskScope(task, 2, newMetricTagAllowlist([]string{"tenant"})).IncCounter(metrics.PriorityTaskSubmitRequest)
+
+	counters := testScope.Snapshot().Counters()
+	require.Len(t, counters, 1)
+	for _, counter := range counters {
+		require.Equal(t, map[string]string{
+			"operation":     "TaskScheduler",
+			"task_priority": "2",
+			"tenant":        "some random tenant",
+		}, counter.Tags())
+	}
+}
+
+func TestBatchedCounters(t *testing.T) {
+	testScope := tally.NewTestScope("test", nil)
+	scope := metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope)
+
+	counters := newBatchedCounters()
+	priorityTag := metrics.TaskPriorityTag(1)
+	tenantTag := metrics.StringTag("tenant", "some random tenant")
+	counters.add(metrics.PriorityTaskSubmitRequest, []metrics.Tag{priorityTag, tenantTag}, 1)
+	counters.add(metrics.PriorityTaskSubmitRequest, []metrics.Tag{tenantTag, priorityTag}, 2)
+	counters.add(metrics.PriorityTaskSubmitRequest, nil, 1)
+	counters.add(metrics.PriorityTaskAgedOut, []metrics.Tag{priorityTag}, 1)
+	require.Empty(t, testScope.Snapshot().Counters())
+
+	counters.flush(scope)
+	counters.flush(scope)
+	values := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		values[counter.Name()+","+counter.Tags()["task_priority"]] += counter.Value()
+	}
+	require.Equal(t, map[string]int64{
+		"test.prioritytask_submit_request,1": 3,
+		"test.prioritytask_submit_request,":  1,
+		"test.prioritytask_aged_out,1":       1,
+	}, values)
+}
+
+func BenchmarkRecordLatency(b *testing.B) {
+	scope := metrics.NewClient(tally.NoopScope, metrics.Common).Scope(metrics.TaskSchedulerScope)
+	b.Run("Stopwatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i != b.N; i++ {
+			sw := scope.StartTimer(metrics.PriorityTaskSubmitLatency)
+			sw.Stop()
+		}
+	})
+	b.Run("RecordLatency", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i != b.N; i++ {
+			recordLatency(scope, metrics.PriorityTaskSubmitLatency, time.Now())
+		}
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// mpscRing is a bounded lock-free ring of tasks with multiple producers and a single consumer.
+	// Producers must acquire a slot before pushing a task, so that push never finds the ring full,
+	// and the consumer is serialized by the owner of the ring, e.g. by holding a lock
+	mpscRing struct {
+		// occupied is the number of acquired slots, whose high bit is set once the ring is closed.
+		// Slots are acquired against a capacity which may include slots outside of the ring
+		occupied int64
+		// tail is the position of the next task to push, advanced by producers
+		tail uint64
+		// head is the position of the next task to pop, only accessed by the consumer
+		head  uint64
+		mask  uint64
+		slots []mpscRingSlot
+	}
+
+	// mpscRingSlot holds the task pushed at position seq-1, if seq is the position of the consumer plus one
+	mpscRingSlot struct {
+		seq         uint64
+		task        PriorityTask
+		enqueueTime time.Time
+	}
+)
+
+const mpscRingClosedBit = int64(1) << 62
+
+func newMPSCRing(
+	capacity int,
+) *mpscRing {
+	size := 1
+	for size < capacity {
+		size <<= 1
+	}
+	return &mpscRing{
+		mask:  uint64(size - 1),
+		slots: make([]mpscRingSlot, size),
+	}
+}
+
+// acquire acquires the given number of slots if no more than capacity slots will be acquired,
+// and returns the number of slots acquired before, it fails once the ring is closed
+func (r *mpscRing) acquire(
+	count int,
+	capacity int,
+) (int, bool) {
+	for {
+		occupied := atomic.LoadInt64(&r.occupied)
+		if occupied&mpscRingClosedBit != 0 || occupied+int64(count) > int64(capacity) {
+			return 0, false
+		}
+		if atomic.CompareAndSwapInt64(&r.occupied, occupied, occupied+int64(count)) {
+			return int(occupied), true
+		}
+	}
+}
+
+// release releases the given number of acquired slots
+func (r *mpscRing) release(
+	count int,
+) {
+	atomic.AddInt64(&r.occupied, -int64(count))
+}
+
+// numAcquired returns the number of acquired slots
+func (r *mpscRing) numAcquired() int {
+	return int(atomic.LoadInt64(&r.occupied) &^ mpscRingClosedBit)
+}
+
+// close fails all the following acquisitions, tasks pushed into slots
+// acquired before are still delivered to the consumer
+func (r *mpscRing) close() {
+	for {
+		occupied := atomic.LoadInt64(&r.occupied)
+		if atomic.CompareAndSwapInt64(&r.occupied, occupied, occupied|mpscRingClosedBit) {
+			return
+		}
+	}
+}
+
+// push adds the task to the tail of the ring, the caller must have acquired a slot for it,
+// and the number of acquired slots must never exceed the size of the ring
+func (r *mpscRing) push(
+	task PriorityTask,
+	enqueueTime time.Time,
+) {
+	pos := atomic.AddUint64(&r.tail, 1) - 1
+	slot := &r.slots[pos&r.mask]
+	slot.task = task
+	slot.enqueueTime = enqueueTime
+	// publishes the task to the consumer
+	atomic.StoreUint64(&slot.seq, pos+1)
+}
+
+// pop removes the task at the head of the ring, returns false if the ring
+// is empty or the producer of the task at the head hasn't finished pushing
+func (r *mpscRing) pop() (PriorityTask, time.Time, bool) {
+	slot := &r.slots[r.head&r.mask]
+	if atomic.LoadUint64(&slot.seq) != r.head+1 {
+		return nil, time.Time{}, false
+	}
+	task, enqueueTime := slot.task, slot.enqueueTime
+	slot.task = nil
+	r.head++
+	return task, enqueueTime, true
+}
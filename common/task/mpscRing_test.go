@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMPSCRing_AcquirePushPop(t *testing.T) {
+	ring := newMPSCRing(3)
+	require.Equal(t, 4, len(ring.slots))
+
+	_, _, ok := ring.pop()
+	require.False(t, ok)
+
+	// wrap around the ring a few times
+	for round := 0; round != 3; round++ {
+		tasks := []PriorityTask{}
+		for i := 0; i != 3; i++ {
+			position, ok := ring.acquire(1, 3)
+			require.True(t, ok)
+			require.Equal(t, i, position)
+			task := &benchmarkPriorityTask{priority: i}
+			ring.push(task, time.Now())
+			tasks = append(tasks, task)
+		}
+		_, ok := ring.acquire(1, 3)
+		require.False(t, ok)
+
+		for _, expectedTask := range tasks {
+			task, enqueueTime, ok := ring.pop()
+			require.True(t, ok)
+			require.Equal(t, expectedTask, task)
+			require.False(t, enqueueTime.IsZero())
+			ring.release(1)
+		}
+		_, _, ok = ring.pop()
+		require.False(t, ok)
+		require.Zero(t, ring.numAcquired())
+	}
+
+	_, ok = ring.acquire(2, 3)
+	require.True(t, ok)
+	ring.close()
+	require.Equal(t, 2, ring.numAcquired())
+	_, ok = ring.acquire(1, 3)
+	require.False(t, ok)
+	ring.release(2)
+	require.Zero(t, ring.numAcquired())
+	_, ok = ring.acquire(1, 3)
+	require.False(t, ok)
+}
+
+func TestMPSCRing_ConcurrentProducers(t *testing.T) {
+	numProducers := 8
+	numTasksPerProducer := 1000
+	ring := newMPSCRing(16)
+
+	var producerWG sync.WaitGroup
+	producerWG.Add(numProducers)
+	for producer := 0; producer != numProducers; producer++ {
+		go func(producer int) {
+			defer producerWG.Done()
+			for i := 0; i != numTasksPerProducer; i++ {
+				for {
+					if _, ok := ring.acquire(1, 16); ok {
+						break
+					}
+					runtime.Gosched()
+				}
+				ring.push(&benchmarkPriorityTask{priority: producer, executionTime: time.Duration(i)}, time.Now())
+			}
+		}(producer)
+	}
+
+	// tasks of each producer are popped in the order they're pushed
+	next := make([]time.Duration, numProducers)
+	for numPopped := 0; numPopped != numProducers*numTasksPerProducer; {
+		task, _, ok := ring.pop()
+		if !ok {
+			runtime.Gosched()
+			continue
+		}
+		ring.release(1)
+		numPopped++
+		benchmarkTask := task.(*benchmarkPriorityTask)
+		require.Equal(t, next[benchmarkTask.priority], benchmarkTask.executionTime)
+		next[benchmarkTask.priority]++
+	}
+	producerWG.Wait()
+	_, _, ok := ring.pop()
+	require.False(t, ok)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+	"github.com/uber/cadence/common/metrics"
+	"github.com/uber/cadence/common/service/dynamicconfig"
+)
+
+type (
+	// namedQueueScheduler routes NamedTasks to the priorities of a WRR task scheduler, each named
+	// queue is backed by a priority, so the queues are weighted and dispatched as priorities are
+	namedQueueScheduler struct {
+		scheduler  Scheduler
+		priorities map[string]int
+	}
+)
+
+var _ Scheduler = (*namedQueueScheduler)(nil)
+
+var (
+	// ErrNotNamedTask is the error returned when submitting a task not implementing NamedTask
+	ErrNotNamedTask = errors.New("task does not implement NamedTask")
+)
+
+// NewNamedQueueScheduler creates a scheduler which routes each NamedTask to the queue named by QueueName, queues
+// are weighted by the given weights and dispatched by a WRR task scheduler created with the given options, whose
+// Weights are ignored. Queues are backed by priorities assigned in the alphabetical order of the names, and the
+// priority of a task is set to the one of its queue when submitted, so metrics are tagged with that priority.
+// Tasks of unknown queues are rejected
+func NewNamedQueueScheduler(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	weights map[string]int,
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) (Scheduler, error) {
+	if len(weights) == 0 {
+		return nil, errors.New("weight is not specified for any named queue")
+	}
+
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	priorities := make(map[string]int, len(names))
+	priorityWeights := make(map[string]interface{}, len(names))
+	for priority, name := range names {
+		priorities[name] = priority
+		priorityWeights[strconv.Itoa(priority)] = weights[name]
+		logger.Info("Named queue is backed by task priority.", tag.Value(name), tag.TaskPriority(priority))
+	}
+
+	schedulerOptions := *options
+	schedulerOptions.Weights = dynamicconfig.GetMapPropertyFn(priorityWeights)
+	schedulerOptions.NormalizeWeightsTo = 0
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(logger, metricsClient, &schedulerOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &namedQueueScheduler{
+		scheduler:  scheduler,
+		priorities: priorities,
+	}, nil
+}
+
+func (s *namedQueueScheduler) Start() {
+	s.scheduler.Start()
+}
+
+func (s *namedQueueScheduler) Stop() {
+	s.scheduler.Stop()
+}
+
+func (s *namedQueueScheduler) Submit(
+	task PriorityTask,
+) error {
+	if err := s.setPriority(task); err != nil {
+		return err
+	}
+	return s.scheduler.Submit(task)
+}
+
+func (s *namedQueueScheduler) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	if err := s.setPriority(task); err != nil {
+		return false, err
+	}
+	return s.scheduler.TrySubmit(task)
+}
+
+func (s *namedQueueScheduler) setPriority(
+	task PriorityTask,
+) error {
+	namedTask, ok := task.(NamedTask)
+	if !ok {
+		return ErrNotNamedTask
+	}
+	priority, ok := s.priorities[namedTask.QueueName()]
+	if !ok {
+		return fmt.Errorf("unknown task queue: %v", namedTask.QueueName())
+	}
+	task.SetPriority(priority)
+	return nil
+}
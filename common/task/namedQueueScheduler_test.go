@@ -0,0 +1,77 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+func TestNamedQueueScheduler(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	logger, err := loggerimpl.NewDevelopment()
+	require.NoError(t, err)
+	scheduler, err := NewNamedQueueScheduler(
+		logger,
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		map[string]int{"transfer": 5, "activity": 3, "timer": 1},
+		&WeightedRoundRobinTaskSchedulerOptions{
+			QueueSize:       10,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			// tasks are kept in the queues as the scheduler is not started
+			AllowSubmitBeforeStart: true,
+		},
+	)
+	require.NoError(t, err)
+	schedulerImpl := scheduler.(*namedQueueScheduler).scheduler.(*weightedRoundRobinTaskSchedulerImpl)
+	require.Equal(t, map[int]int{0: 3, 1: 1, 2: 5}, schedulerImpl.getWeights())
+
+	newNamedTask := func(queueName string, priority int) *MockNamedTask {
+		mockTask := NewMockNamedTask(controller)
+		mockTask.EXPECT().QueueName().Return(queueName).AnyTimes()
+		mockTask.EXPECT().SetPriority(priority)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+	require.NoError(t, scheduler.Submit(newNamedTask("timer", 1)))
+	submitted, err := scheduler.TrySubmit(newNamedTask("transfer", 2))
+	require.NoError(t, err)
+	require.True(t, submitted)
+	require.Equal(t, 1, schedulerImpl.taskQueues[1].Len())
+	require.Equal(t, 1, schedulerImpl.taskQueues[2].Len())
+
+	unknownTask := NewMockNamedTask(controller)
+	unknownTask.EXPECT().QueueName().Return("replication").AnyTimes()
+	require.Error(t, scheduler.Submit(unknownTask))
+	require.Equal(t, ErrNotNamedTask, scheduler.Submit(NewMockPriorityTask(controller)))
+}
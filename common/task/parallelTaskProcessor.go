@@ -21,7 +21,11 @@
 package task
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,15 +33,242 @@ import (
 	"github.com/uber/cadence/common"
 	"github.com/uber/cadence/common/backoff"
 	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
 	"github.com/uber/cadence/common/metrics"
+	"github.com/uber/cadence/common/quotas"
 )
 
 type (
+	// ParallelTaskProcessor is the interface for the parallel task processor,
+	// which supports adjusting the number of workers at runtime
+	ParallelTaskProcessor interface {
+		Processor
+		// SetWorkerCount updates the number of workers of the processor
+		SetWorkerCount(count int) error
+		// Stats returns a snapshot of the processor's internal state
+		Stats() ProcessorStats
+		// TrySubmit submits the task only if there's an idle worker
+		// and the task can be submitted without blocking
+		TrySubmit(task Task) (bool, error)
+		// Complete finalizes a task left pending with DeferredAck, the task is acked if err is nil and
+		// handled as exhausted otherwise. It returns ErrUnknownTaskHandle if the task is already completed
+		Complete(handle TaskHandle, err error) error
+		// WasStarted returns true if the processor has been started, even if it's stopped afterwards,
+		// so that callers starting it defensively can check it idempotently
+		WasStarted() bool
+		// InFlightTasks returns descriptors of the tasks currently being executed by workers,
+		// sorted by their start time. Tasks left pending with DeferredAck are not included
+		InFlightTasks() []InFlightTask
+		// SetGlobalMaxRetries replaces GlobalMaxRetries, and the retries counted toward the cap start
+		// from zero again, so that tests can cap the retries at any point. Zero removes the cap
+		SetGlobalMaxRetries(maxRetries int) error
+	}
+
+	// TaskHandle identifies a task executed by ParallelTaskProcessor with DeferredAck
+	TaskHandle int64
+
+	// ProcessorStats is a snapshot of the internal state of ParallelTaskProcessor
+	ProcessorStats struct {
+		// ConfiguredWorkers is the worker count the processor is configured with
+		ConfiguredWorkers int
+		// LiveWorkers is the number of worker goroutines currently running
+		LiveWorkers int
+		// BusyWorkers is the number of workers currently processing a task
+		BusyWorkers int
+		// QueuedTasks is the number of tasks waiting to be picked up by a worker
+		QueuedTasks int
+		// RetryingTasks is the number of tasks being processed that have been retried at least once
+		RetryingTasks int
+		// SucceededTasks is the number of tasks acked since the processor is created
+		SucceededTasks int64
+		// FailedTasks is the number of tasks nacked or exhausted since the processor is created
+		FailedTasks int64
+		// PendingTasks is the number of tasks left pending with DeferredAck, which don't occupy workers
+		PendingTasks int
+		// BatchedTasks is the number of tasks held in batches not yet flushed to the buffer, see BatchWindow
+		BatchedTasks int
+	}
+
+	// InFlightTask describes a task being executed by ParallelTaskProcessor
+	InFlightTask struct {
+		// Priority is the priority of the task, or NoPriority if it's not a PriorityTask
+		Priority int
+		// StartTime is when a worker started executing the task, including retries in place
+		StartTime time.Time
+		// Tags are the metric tags of the task whose key is in MetricTagAllowlist
+		Tags map[string]string
+	}
+
 	// ParallelTaskProcessorOptions configs PriorityTaskProcessor
 	ParallelTaskProcessorOptions struct {
 		QueueSize   int
 		WorkerCount int
 		RetryPolicy backoff.RetryPolicy
+		// MaxRetriesPerSecond limits the total number of retries across all tasks,
+		// once the budget is exhausted, tasks that would retry are considered exhausted.
+		// Zero means unlimited
+		MaxRetriesPerSecond int
+		// GlobalMaxRetries caps the cumulative number of retries across all tasks, once reached, tasks that
+		// would retry are considered exhausted and PriorityTaskGlobalRetriesExhausted is emitted. Unlike the
+		// retry policy and MaxRetriesPerSecond, it never recovers by itself, as it's meant for fault injection
+		// tests to exercise the exhaustion handling. It can be updated via SetGlobalMaxRetries. Zero means unlimited
+		GlobalMaxRetries int
+		// NewTaskReservedFraction, if specified, reserves the fraction of WorkerCount, rounded up, for tasks which
+		// are executed for the first time, so that a retry storm can't starve fresh tasks. The other workers can
+		// keep retrying tasks in place, and tasks that would retry in place while they're all retrying are
+		// considered exhausted, unless taken over by RequeueRetry which frees the worker. The split of the busy
+		// workers is emitted as ParallelTaskRetryingWorkerCount and ParallelTaskNewTaskWorkerCount whenever a
+		// worker starts or stops retrying. Zero means no worker is reserved, one means no task is retried in place
+		NewTaskReservedFraction float64
+		// RetrySlowStartWindow, if specified along with MaxRetriesPerSecond, ramps the retry budget linearly
+		// from one retry per second back to MaxRetriesPerSecond over the window whenever the budget is
+		// exhausted, instead of letting all the retries accumulated meanwhile through once tokens are available
+		// again. The WRR task scheduler also restarts the ramp when a circuit breaker closes. The allowed
+		// retry rate is emitted as PriorityTaskAllowedRetryRate whenever it changes
+		RetrySlowStartWindow time.Duration
+		// OnTaskExhausted, if specified, is invoked instead of Nack when a task fails with a
+		// non-retryable error or exhausts all its retries, the callback takes over the ownership of the task
+		OnTaskExhausted func(task Task, err error)
+		// OnTaskAttempt, if specified, is invoked after each execution of a task, including retries,
+		// with the error returned by HandleErr, or nil if the execution succeeded
+		OnTaskAttempt func(task Task, err error)
+		// MetricTagAllowlist specifies the keys of task metric tags that can be used
+		// for tagging the metrics emitted when processing tasks
+		MetricTagAllowlist []string
+		// PerPriorityScope emits the metrics of each task priority to a sub-scope
+		// created once per priority, instead of tagging the metrics for every task
+		PerPriorityScope bool
+		// IdleWorkerTimeout specifies how long a worker can stay idle before it exits,
+		// workers are recreated on demand when tasks arrive. Zero means workers never exit
+		IdleWorkerTimeout time.Duration
+		// MinWorkerCount is the minimum number of workers that are kept alive
+		// when IdleWorkerTimeout is specified
+		MinWorkerCount int
+		// SlowTaskThreshold, if specified, logs a warning for tasks whose
+		// processing latency, including retries, exceeds the threshold
+		SlowTaskThreshold time.Duration
+		// ShutdownTimeout is how long Stop waits for the tasks being processed to finish, default to one minute.
+		// Tasks implementing ContextAwareTask are executed via ExecuteWithContext, and the context is
+		// cancelled when Stop is called, so that they can abort cooperatively
+		ShutdownTimeout time.Duration
+		// OnShutdownTimeout, if specified, is invoked for each task still being processed when
+		// ShutdownTimeout is reached, so that it can be recorded or requeued. The callback takes over
+		// the ownership of the task, the processor won't ack or nack it even if it completes afterwards
+		OnShutdownTimeout func(task Task)
+		// RequeueRetry, if specified, is invoked instead of retrying in place when a PriorityTask fails
+		// and the retry policy allows another attempt, with the number of retries made and the time of
+		// the first attempt of the task. The callback takes over the ownership of the task if it returns
+		// true, otherwise the task is retried in place. Tasks implementing retryStateProvider are
+		// retried from the state they carry, so the retry policy keeps bounding the attempts and
+		// expiration across requeues, but the backoff interval is not applied when requeued
+		RequeueRetry func(task PriorityTask, retries int, firstAttemptTime time.Time) bool
+		// MaxRequeues, if specified, considers a task exhausted instead of invoking RequeueRetry once
+		// it has been requeued for the number of times, so that a task which keeps failing can't loop
+		// through requeues forever when the retry policy doesn't bound the attempts
+		MaxRequeues int
+		// ExecuteContext, if specified, derives the context passed to ExecuteWithContext for PriorityTasks
+		// implementing ContextAwareTask, e.g. to inject a logger enriched with task metadata, a deadline or
+		// a tracing span. It's called once per task and the context is shared by all attempts of the task.
+		// The derived context is still cancelled when Stop is called. If not specified, a background
+		// context cancelled when Stop is called is used
+		ExecuteContext func(task PriorityTask) context.Context
+		// DeferredAck, if true, allows ContextAwareTasks to defer their ack until a downstream system confirms
+		// the work, by returning ErrTaskPending from ExecuteWithContext. The task is then left pending without
+		// occupying a worker, and it's acked or handled as exhausted only when Complete is called with the
+		// handle obtained via TaskHandleFromContext, which may happen before ExecuteWithContext returns. Pending
+		// tasks are not retried, and they're still considered in-flight by the submitter until acked or nacked,
+		// e.g. pending tasks take up MaxConcurrencyByPriority of WRR task schedulers. Tasks pending when the
+		// processor is stopped are neither acked nor nacked, as other tasks being processed at that time, so
+		// the delivery is at-least-once: a task confirmed downstream may be redelivered by its source
+		DeferredAck bool
+		// Preemption, if true, calls Preempt on a PreemptibleTask being executed when a task of a higher
+		// priority, i.e. a smaller priority value, is submitted while no worker is idle, so that the
+		// preempted task can yield its worker. The task with the lowest priority is preempted first, and
+		// each task is preempted at most once per execution. Each preemption is emitted as PriorityTaskPreempted
+		Preemption bool
+		// OnYield, if specified, is invoked when a ContextAwareTask returns ErrTaskYielded from ExecuteWithContext,
+		// with the number of retries made and the time of the first attempt of the task, like RequeueRetry. The
+		// callback takes over the ownership of the task if it returns true, and the yield is emitted as
+		// PriorityTaskYielded. Otherwise ErrTaskYielded is handled as any other error returned by the task
+		OnYield func(task PriorityTask, retries int, firstAttemptTime time.Time) bool
+		// PriorityQueue, if true, buffers the submitted tasks by priority instead of in FIFO order, so that
+		// workers always pick up the buffered task with the highest priority. Ignored if QueueSize is zero
+		PriorityQueue bool
+		// WorkStealing, if true, buffers the submitted tasks in a deque per worker, with QueueSize spread over
+		// WorkerCount deques. Submitted tasks are placed in the deques in round robin order, each worker picks
+		// up tasks from its own deque, and steals from the other deques once its own is empty, so that
+		// workers contend on their own deques instead of a shared buffer. Each steal is emitted as
+		// ParallelTaskStolen. Ignored if QueueSize is zero or PriorityQueue is specified
+		WorkStealing bool
+		// RetryBackoffMultiplier, if specified, is invoked with the task and its priority before each retry
+		// in place, and the interval computed by RetryPolicy is multiplied by the result, e.g. to back off
+		// further while the system is overloaded. The effective interval is emitted as PriorityTaskRetryBackoff
+		RetryBackoffMultiplier func(task Task, priority int) float64
+		// BeforeExecute and AfterExecute, if specified, are invoked by the worker right before and after each
+		// execution of a PriorityTask, including retries, for lightweight instrumentation like logging and
+		// metrics without wrapping every task. AfterExecute receives the error returned by the execution,
+		// before HandleErr is applied, and the latency of the execution. Both are invoked before the task is
+		// acked or nacked, except that with DeferredAck, Complete may ack a pending task before AfterExecute
+		// is invoked. Panics in the hooks are recovered and logged, so they can't fail the task
+		BeforeExecute func(task PriorityTask)
+		AfterExecute  func(task PriorityTask, err error, latency time.Duration)
+		// OnWorkerStart and OnWorkerStop, if specified, are invoked by each worker with its ID, exactly once per
+		// worker, e.g. to set up and flush per-worker connections or buffers. OnWorkerStart is invoked when the
+		// worker starts, before it picks up any task, and OnWorkerStop when it exits, after its last task is
+		// acked, nacked or handed off, so neither runs concurrently with a task execution of the same worker.
+		// Workers exit when the processor is stopped, when SetWorkerCount shrinks the pool or when retired by
+		// IdleWorkerTimeout, and the IDs of exited workers are not reused. Stop waits for OnWorkerStop within
+		// ShutdownTimeout, workers still executing a task afterwards invoke it once the task returns. Panics
+		// in the hooks are recovered and logged
+		OnWorkerStart func(workerID int)
+		OnWorkerStop  func(workerID int)
+		// BatchWindow, if specified, batches the BatchableTasks submitted via Submit with the same batch key. A batch
+		// is flushed to the buffer as a single task once MaxBatchSize tasks are added, or once the window elapses
+		// since its first task is added, and a worker invokes BatchExecute on the first task with all the tasks of
+		// the batch, whose results are then handled for each task as the result of its first execution. Tasks with
+		// a retryable error are then processed one after another by the same worker, as if they're newly submitted,
+		// and a batch holding a single task is processed as the task itself. Tasks held in batches don't take up
+		// the buffer, and they're dropped as the buffered tasks when the processor is stopped. Tasks submitted
+		// via TrySubmit are not batched
+		BatchWindow time.Duration
+		// MaxBatchSize is the max number of tasks in a batch, zero means unlimited
+		MaxBatchSize int
+	}
+
+	// retryStateProvider is implemented by tasks which are requeued for retry,
+	// ok is false if the task hasn't been requeued
+	retryStateProvider interface {
+		retryState() (retries int, requeues int, firstAttemptTime time.Time, ok bool)
+	}
+
+	// bufferReporter is implemented by processors which report how full their buffer of submitted tasks is
+	bufferReporter interface {
+		// submitReportingBlocked is the same as Submit, except that onBlocked
+		// is invoked before blocking on a full buffer
+		submitReportingBlocked(task Task, onBlocked func()) error
+		// bufferOccupancy returns the fraction of the buffer taken by the tasks waiting for a worker
+		bufferOccupancy() float64
+	}
+
+	// retrySlowStarter is implemented by processors whose retry budget can be ramped again
+	retrySlowStarter interface {
+		restartRetrySlowStart()
+	}
+
+	// offsetRetryPolicy continues a retry policy with the retries
+	// made and the time elapsed before the task is requeued
+	offsetRetryPolicy struct {
+		policy  backoff.RetryPolicy
+		retries int
+		elapsed time.Duration
+	}
+
+	// scaledRetryPolicy multiplies the intervals of a retry policy by
+	// the multiplier at the time of each retry
+	scaledRetryPolicy struct {
+		policy     backoff.RetryPolicy
+		multiplier func() float64
+		onDelay    func(delay time.Duration)
 	}
 
 	parallelTaskProcessorImpl struct {
@@ -48,12 +279,129 @@ type (
 		logger       log.Logger
 		metricsScope metrics.Scope
 		options      *ParallelTaskProcessorOptions
+		// priorityQueue replaces tasksCh when PriorityQueue is specified
+		priorityQueue *priorityProcessorQueue
+		// workStealingQueue replaces tasksCh when WorkStealing is specified
+		workStealingQueue *workStealingQueue
+		// priorityScopes is only set when PerPriorityScope is specified
+		priorityScopes *priorityScopes
+		// batcher is nil unless BatchWindow is specified
+		batcher *taskBatcher
+
+		workerLock        sync.Mutex
+		workerCount       int
+		workerShutdownChs []chan struct{}
+		liveWorkers       int32
+		idleWorkers       int32
+		pendingSubmits    int32
+		// nextWorker assigns each worker its ID and its deque of workStealingQueue
+		nextWorker int32
+
+		busyWorkers    int32
+		retryingTasks  int32
+		succeededTasks int64
+		failedTasks    int64
+		// retryingWorkers is the number of workers retrying tasks in place,
+		// only tracked when NewTaskReservedFraction is specified
+		retryingWorkers int32
+
+		retryLimiter       quotas.Limiter
+		retrySlowStart     *retrySlowStart // replaces retryLimiter when RetrySlowStartWindow is specified
+		metricTagAllowlist map[string]struct{}
+		// globalMaxRetries is the current GlobalMaxRetries, and globalRetries
+		// is the number of retries counted toward it
+		globalMaxRetries int64
+		globalRetries    int64
+
+		shutdownCtx    context.Context
+		shutdownCancel context.CancelFunc
+		// inflightTasks tracks the tasks being processed, the processor no longer
+		// owns a task once it's removed by handoffInflightTasks
+		inflightLock   sync.Mutex
+		inflightTasks  map[int64]*inflightTask
+		nextInflightID int64
+
+		// deferredTasks tracks the tasks executed with DeferredAck by their handles,
+		// from before their execution starts until they're completed
+		deferredLock   sync.Mutex
+		deferredTasks  map[TaskHandle]*deferredTask
+		nextTaskHandle int64
+
+		// preemptibleTasks tracks the PreemptibleTasks being executed when Preemption is specified
+		preemptLock       sync.Mutex
+		preemptibleTasks  map[int64]*preemptibleExecution
+		nextPreemptibleID int64
 	}
+
+	// inflightTask is a task being executed by a worker
+	inflightTask struct {
+		task      Task
+		priority  int
+		startTime time.Time
+	}
+
+	// preemptibleExecution is the execution of a PreemptibleTask
+	preemptibleExecution struct {
+		task      PreemptibleTask
+		priority  int
+		preempted bool
+	}
+
+	// deferredTask is the completion state of a task executed with DeferredAck
+	deferredTask struct {
+		task Task
+		// pending is true once the execution returns ErrTaskPending
+		pending bool
+		// completed is true if Complete is called before the execution returns
+		completed bool
+		err       error
+	}
+
+	taskHandleContextKey struct{}
+)
+
+const (
+	defaultShutdownTimeout = time.Minute
+
+	// outcomes of tasks tagged on PriorityTaskRetryAttempts, tasks failed with
+	// non-retryable errors are also considered exhausted
+	taskOutcomeSuccess   = "success"
+	taskOutcomeExhausted = "exhausted"
+	// taskOutcomeFailure is the outcome of a failed execution tagged on PriorityTaskAttempts
+	taskOutcomeFailure = "failure"
+
+	// outcome categories of tasks finalized by the processor tagged on PriorityTaskOutcomes, exactly one is emitted
+	// for each task which is acked or exhausted, along with taskOutcomeSuccess for acked tasks. Tasks requeued,
+	// yielded, left pending with DeferredAck or dropped on shutdown are not finalized yet
+	//
+	// retryable_failure: failed with a retryable error which is not retried, e.g. as the retry budget is exhausted
+	// permanent_failure: failed with a non-retryable error, or completed with an error via Complete
+	// timeout: failed with context.DeadlineExceeded, e.g. as the context returned by ExecuteContext expires
+	// panic: the execution panicked, which is emitted before the panic propagates
+	// expired: failed once the retry policy is exhausted, the last error is not checked
+	taskOutcomeRetryableFailure = "retryable_failure"
+	taskOutcomePermanentFailure = "permanent_failure"
+	taskOutcomeTimeout          = "timeout"
+	taskOutcomePanic            = "panic"
+	taskOutcomeExpired          = "expired"
+
+	// attempts tagged on the execution and outcome metrics, retries
+	// include executions after the task is requeued for retry
+	taskAttemptFirst = "first"
+	taskAttemptRetry = "retry"
 )
 
 var (
 	// ErrTaskProcessorClosed is the error returned when submiting task to a stopped processor
 	ErrTaskProcessorClosed = errors.New("task processor has already shutdown")
+	// ErrTaskPending is returned by ExecuteWithContext to leave the task pending
+	// until Complete is called, when the processor is created with DeferredAck
+	ErrTaskPending = errors.New("task is pending completion")
+	// ErrTaskYielded is returned by ExecuteWithContext to give up the worker, so that the
+	// task is executed again later, when the processor is created with OnYield
+	ErrTaskYielded = errors.New("task yielded its worker")
+	// ErrUnknownTaskHandle is the error returned when completing a task which is already completed
+	ErrUnknownTaskHandle = errors.New("task handle is unknown or already completed")
 )
 
 // NewParallelTaskProcessor creates a new PriorityTaskProcessor
@@ -61,15 +409,75 @@ func NewParallelTaskProcessor(
 	logger log.Logger,
 	metricsClient metrics.Client,
 	options *ParallelTaskProcessorOptions,
-) Processor {
-	return &parallelTaskProcessorImpl{
-		status:       common.DaemonStatusInitialized,
-		tasksCh:      make(chan Task, options.QueueSize),
-		shutdownCh:   make(chan struct{}),
-		logger:       logger,
-		metricsScope: metricsClient.Scope(metrics.ParallelTaskProcessingScope),
-		options:      options,
+) ParallelTaskProcessor {
+	var retryLimiter quotas.Limiter
+	if options.MaxRetriesPerSecond > 0 && options.RetrySlowStartWindow <= 0 {
+		retryLimiter = quotas.NewSimpleRateLimiter(options.MaxRetriesPerSecond)
 	}
+
+	var tasksCh chan Task
+	var priorityQueue *priorityProcessorQueue
+	var stealingQueue *workStealingQueue
+	if options.PriorityQueue && options.QueueSize > 0 {
+		priorityQueue = newPriorityProcessorQueue(options.QueueSize)
+	} else if options.WorkStealing && options.QueueSize > 0 {
+		stealingQueue = newWorkStealingQueue(options.QueueSize, options.WorkerCount)
+	} else {
+		tasksCh = make(chan Task, options.QueueSize)
+	}
+
+	metricsScope := metricsClient.Scope(metrics.ParallelTaskProcessingScope)
+	var scopes *priorityScopes
+	if options.PerPriorityScope {
+		scopes = newPriorityScopes(metricsScope)
+	}
+
+	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
+	processor := &parallelTaskProcessorImpl{
+		status:             common.DaemonStatusInitialized,
+		tasksCh:            tasksCh,
+		priorityQueue:      priorityQueue,
+		workStealingQueue:  stealingQueue,
+		shutdownCh:         make(chan struct{}),
+		logger:             logger,
+		metricsScope:       metricsScope,
+		priorityScopes:     scopes,
+		options:            options,
+		workerCount:        options.WorkerCount,
+		retryLimiter:       retryLimiter,
+		globalMaxRetries:   int64(options.GlobalMaxRetries),
+		metricTagAllowlist: newMetricTagAllowlist(options.MetricTagAllowlist),
+		shutdownCtx:        shutdownCtx,
+		shutdownCancel:     shutdownCancel,
+		inflightTasks:      make(map[int64]*inflightTask),
+		deferredTasks:      make(map[TaskHandle]*deferredTask),
+		preemptibleTasks:   make(map[int64]*preemptibleExecution),
+	}
+	if options.BatchWindow > 0 {
+		processor.batcher = newTaskBatcher(options.BatchWindow, options.MaxBatchSize, func(task Task) {
+			// the batch is dropped as the buffered tasks if the processor is stopped
+			_ = processor.submit(task, nil, nil)
+		})
+	}
+	if options.MaxRetriesPerSecond > 0 && options.RetrySlowStartWindow > 0 {
+		processor.retrySlowStart = newRetrySlowStart(
+			float64(options.MaxRetriesPerSecond),
+			options.RetrySlowStartWindow,
+			func(rate float64) {
+				processor.metricsScope.UpdateGauge(metrics.PriorityTaskAllowedRetryRate, rate)
+			},
+		)
+	}
+	return processor
+}
+
+// TaskHandleFromContext returns the handle of the task executed with
+// the context, if the task is executed by a processor with DeferredAck
+func TaskHandleFromContext(
+	ctx context.Context,
+) (TaskHandle, bool) {
+	handle, ok := ctx.Value(taskHandleContextKey{}).(TaskHandle)
+	return handle, ok
 }
 
 func (p *parallelTaskProcessorImpl) Start() {
@@ -77,10 +485,9 @@ func (p *parallelTaskProcessorImpl) Start() {
 		return
 	}
 
-	p.workerWG.Add(p.options.WorkerCount)
-	for i := 0; i < p.options.WorkerCount; i++ {
-		go p.taskWorker()
-	}
+	p.workerLock.Lock()
+	p.startWorkersLocked(p.workerCount)
+	p.workerLock.Unlock()
 	p.logger.Info("Parallel task processor started.")
 }
 
@@ -90,71 +497,1177 @@ func (p *parallelTaskProcessorImpl) Stop() {
 	}
 
 	close(p.shutdownCh)
-	if success := common.AwaitWaitGroup(&p.workerWG, time.Minute); !success {
+	p.shutdownCancel()
+	if p.batcher != nil {
+		p.batcher.close()
+	}
+
+	shutdownTimeout := p.options.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	if success := common.AwaitWaitGroup(&p.workerWG, shutdownTimeout); !success {
 		p.logger.Warn("Parallel task processor timedout on shutdown.")
+		p.handoffInflightTasks()
 	}
 	p.logger.Info("Parallel task processor shutdown.")
 }
 
+func (p *parallelTaskProcessorImpl) WasStarted() bool {
+	return atomic.LoadInt32(&p.status) != common.DaemonStatusInitialized
+}
+
 func (p *parallelTaskProcessorImpl) Submit(task Task) error {
+	return p.submitBatched(task, nil)
+}
+
+func (p *parallelTaskProcessorImpl) submitReportingBlocked(
+	task Task,
+	onBlocked func(),
+) error {
+	return p.submitBatched(task, onBlocked)
+}
+
+// submitBatched adds the task to its batch if it's a BatchableTask and BatchWindow is
+// specified, otherwise the task, or its batch once it's full, is submitted via submit
+func (p *parallelTaskProcessorImpl) submitBatched(
+	task Task,
+	onBlocked func(),
+) error {
+	if p.batcher != nil {
+		batched, batch := p.batcher.add(task)
+		if batched && batch == nil {
+			// the task is held until its batch is flushed
+			p.metricsScope.IncCounter(metrics.ParallelTaskSubmitRequest)
+			return nil
+		}
+		if batched {
+			task = batch
+		}
+	}
+	return p.submit(task, nil, onBlocked)
+}
+
+// submit blocks until the task is submitted, or either the processor or cancelCh is closed.
+// onBlocked, if not nil, is invoked before blocking as the buffer is full
+func (p *parallelTaskProcessorImpl) submit(
+	task Task,
+	cancelCh <-chan struct{},
+	onBlocked func(),
+) error {
 	p.metricsScope.IncCounter(metrics.ParallelTaskSubmitRequest)
 	sw := p.metricsScope.StartTimer(metrics.ParallelTaskSubmitLatency)
 	defer sw.Stop()
 
+	if p.options.IdleWorkerTimeout > 0 {
+		atomic.AddInt32(&p.pendingSubmits, 1)
+		defer atomic.AddInt32(&p.pendingSubmits, -1)
+		p.ensureWorker()
+	}
+
+	if p.options.Preemption && atomic.LoadInt32(&p.idleWorkers) == 0 {
+		p.preemptFor(task)
+	}
+
+	if p.priorityQueue != nil {
+		if onBlocked != nil {
+			if p.priorityQueue.offer(task) {
+				return nil
+			}
+			onBlocked()
+		}
+		if !p.priorityQueue.put(task, p.shutdownCh, cancelCh) {
+			return ErrTaskProcessorClosed
+		}
+		return nil
+	}
+	if p.workStealingQueue != nil {
+		if onBlocked != nil {
+			if p.workStealingQueue.offer(task) {
+				return nil
+			}
+			onBlocked()
+		}
+		if !p.workStealingQueue.put(task, p.shutdownCh, cancelCh) {
+			return ErrTaskProcessorClosed
+		}
+		return nil
+	}
+
+	if onBlocked != nil {
+		select {
+		case p.tasksCh <- task:
+			return nil
+		default:
+			onBlocked()
+		}
+	}
 	select {
 	case p.tasksCh <- task:
 		return nil
 	case <-p.shutdownCh:
 		return ErrTaskProcessorClosed
+	case <-cancelCh:
+		return ErrTaskProcessorClosed
+	}
+}
+
+func (p *parallelTaskProcessorImpl) TrySubmit(task Task) (bool, error) {
+	if p.isStopped() {
+		return false, ErrTaskProcessorClosed
+	}
+	if atomic.LoadInt32(&p.idleWorkers) == 0 {
+		return false, nil
+	}
+
+	if p.priorityQueue != nil {
+		if !p.priorityQueue.offer(task) {
+			return false, nil
+		}
+		p.metricsScope.IncCounter(metrics.ParallelTaskSubmitRequest)
+		return true, nil
+	}
+	if p.workStealingQueue != nil {
+		if !p.workStealingQueue.offer(task) {
+			return false, nil
+		}
+		p.metricsScope.IncCounter(metrics.ParallelTaskSubmitRequest)
+		return true, nil
+	}
+
+	select {
+	case p.tasksCh <- task:
+		p.metricsScope.IncCounter(metrics.ParallelTaskSubmitRequest)
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (p *parallelTaskProcessorImpl) SetWorkerCount(
+	count int,
+) error {
+	if count <= 0 {
+		return fmt.Errorf("worker count must be positive, got: %v", count)
+	}
+
+	p.workerLock.Lock()
+	defer p.workerLock.Unlock()
+
+	switch atomic.LoadInt32(&p.status) {
+	case common.DaemonStatusInitialized:
+		// workers will be created upon start
+	case common.DaemonStatusStarted:
+		if delta := count - len(p.workerShutdownChs); delta > 0 {
+			p.startWorkersLocked(delta)
+		} else {
+			for _, workerShutdownCh := range p.workerShutdownChs[count:] {
+				close(workerShutdownCh)
+			}
+			p.workerShutdownChs = p.workerShutdownChs[:count]
+			p.updateLiveWorkersLocked()
+		}
+	default:
+		return ErrTaskProcessorClosed
+	}
+
+	p.workerCount = count
+	return nil
+}
+
+func (p *parallelTaskProcessorImpl) Stats() ProcessorStats {
+	p.workerLock.Lock()
+	configuredWorkers := p.workerCount
+	p.workerLock.Unlock()
+
+	return ProcessorStats{
+		ConfiguredWorkers: configuredWorkers,
+		LiveWorkers:       int(atomic.LoadInt32(&p.liveWorkers)),
+		BusyWorkers:       int(atomic.LoadInt32(&p.busyWorkers)),
+		QueuedTasks:       p.queuedTasks(),
+		RetryingTasks:     int(atomic.LoadInt32(&p.retryingTasks)),
+		SucceededTasks:    atomic.LoadInt64(&p.succeededTasks),
+		FailedTasks:       atomic.LoadInt64(&p.failedTasks),
+		PendingTasks:      p.pendingTasks(),
+		BatchedTasks:      p.batchedTasks(),
+	}
+}
+
+func (p *parallelTaskProcessorImpl) batchedTasks() int {
+	if p.batcher == nil {
+		return 0
+	}
+	return p.batcher.len()
+}
+
+func (p *parallelTaskProcessorImpl) Complete(
+	handle TaskHandle,
+	err error,
+) error {
+	if p.isStopped() {
+		return ErrTaskProcessorClosed
+	}
+
+	p.deferredLock.Lock()
+	deferred, ok := p.deferredTasks[handle]
+	if !ok || deferred.completed {
+		p.deferredLock.Unlock()
+		return ErrUnknownTaskHandle
+	}
+	if !deferred.pending {
+		// the execution is still ongoing, the task is finalized once it returns
+		deferred.completed = true
+		deferred.err = err
+		p.deferredLock.Unlock()
+		return nil
 	}
+	delete(p.deferredTasks, handle)
+	p.deferredLock.Unlock()
+
+	outcome := taskOutcomeSuccess
+	if err != nil {
+		outcome = failureOutcome(err, taskOutcomePermanentFailure)
+	}
+	priority := NoPriority
+	if priorityTask, ok := deferred.task.(PriorityTask); ok {
+		priority = priorityTask.Priority()
+	}
+	recordOutcome(p.getTaskMetricsScope(deferred.task, priority), outcome)
+	p.finalizeTask(deferred.task, err)
+	return nil
+}
+
+func (p *parallelTaskProcessorImpl) pendingTasks() int {
+	p.deferredLock.Lock()
+	defer p.deferredLock.Unlock()
+
+	pending := 0
+	for _, deferred := range p.deferredTasks {
+		if deferred.pending {
+			pending++
+		}
+	}
+	return pending
 }
 
-func (p *parallelTaskProcessorImpl) taskWorker() {
+// trackDeferredTask returns the context carrying the handle of the task, and a function
+// which returns if the task should be left pending given whether the execution returns ErrTaskPending,
+// along with the result of Complete if it's called before that
+func (p *parallelTaskProcessorImpl) trackDeferredTask(
+	ctx context.Context,
+	task Task,
+) (context.Context, func(executionPending bool) (pending bool, completed bool, err error)) {
+	handle := TaskHandle(atomic.AddInt64(&p.nextTaskHandle, 1))
+	deferred := &deferredTask{task: task}
+	p.deferredLock.Lock()
+	p.deferredTasks[handle] = deferred
+	p.deferredLock.Unlock()
+
+	return context.WithValue(ctx, taskHandleContextKey{}, handle), func(executionPending bool) (bool, bool, error) {
+		p.deferredLock.Lock()
+		defer p.deferredLock.Unlock()
+
+		if executionPending && !deferred.completed && !p.isStopped() {
+			deferred.pending = true
+			return true, false, nil
+		}
+		delete(p.deferredTasks, handle)
+		return false, executionPending && deferred.completed, deferred.err
+	}
+}
+
+func (p *parallelTaskProcessorImpl) bufferOccupancy() float64 {
+	if p.options.QueueSize <= 0 {
+		return 0
+	}
+	return float64(p.queuedTasks()) / float64(p.options.QueueSize)
+}
+
+func (p *parallelTaskProcessorImpl) queuedTasks() int {
+	if p.priorityQueue != nil {
+		return p.priorityQueue.len()
+	}
+	if p.workStealingQueue != nil {
+		return p.workStealingQueue.len()
+	}
+	return len(p.tasksCh)
+}
+
+func (p *parallelTaskProcessorImpl) startWorkersLocked(
+	count int,
+) {
+	p.workerWG.Add(count)
+	for i := 0; i < count; i++ {
+		workerShutdownCh := make(chan struct{})
+		p.workerShutdownChs = append(p.workerShutdownChs, workerShutdownCh)
+		go p.taskWorker(workerShutdownCh)
+	}
+	p.updateLiveWorkersLocked()
+}
+
+func (p *parallelTaskProcessorImpl) updateLiveWorkersLocked() {
+	atomic.StoreInt32(&p.liveWorkers, int32(len(p.workerShutdownChs)))
+	p.metricsScope.UpdateGauge(metrics.ParallelTaskLiveWorkerCount, float64(len(p.workerShutdownChs)))
+}
+
+// ensureWorker starts a new worker if there's no idle worker
+// and the number of live workers is below the configured worker count
+func (p *parallelTaskProcessorImpl) ensureWorker() {
+	if atomic.LoadInt32(&p.idleWorkers) != 0 {
+		return
+	}
+
+	p.workerLock.Lock()
+	defer p.workerLock.Unlock()
+
+	if atomic.LoadInt32(&p.idleWorkers) == 0 &&
+		len(p.workerShutdownChs) < p.workerCount &&
+		atomic.LoadInt32(&p.status) == common.DaemonStatusStarted {
+		p.startWorkersLocked(1)
+	}
+}
+
+// retireIdleWorker removes the worker if the number of live workers is
+// above the configured minimum, returns true if the worker should exit
+func (p *parallelTaskProcessorImpl) retireIdleWorker(
+	workerShutdownCh <-chan struct{},
+) bool {
+	p.workerLock.Lock()
+	defer p.workerLock.Unlock()
+
+	if len(p.workerShutdownChs) <= p.options.MinWorkerCount ||
+		atomic.LoadInt32(&p.pendingSubmits) != 0 ||
+		p.queuedTasks() != 0 {
+		return false
+	}
+
+	for idx, ch := range p.workerShutdownChs {
+		if ch == workerShutdownCh {
+			p.workerShutdownChs = append(p.workerShutdownChs[:idx], p.workerShutdownChs[idx+1:]...)
+			p.updateLiveWorkersLocked()
+			return true
+		}
+	}
+	// worker is already removed by SetWorkerCount
+	return true
+}
+
+func (p *parallelTaskProcessorImpl) taskWorker(
+	workerShutdownCh <-chan struct{},
+) {
 	defer p.workerWG.Done()
 
+	var idleTimer *time.Timer
+	var idleTimerCh <-chan time.Time
+	if p.options.IdleWorkerTimeout > 0 {
+		idleTimer = time.NewTimer(p.options.IdleWorkerTimeout)
+		defer idleTimer.Stop()
+		idleTimerCh = idleTimer.C
+	}
+	var priorityReadyCh <-chan struct{}
+	if p.priorityQueue != nil {
+		priorityReadyCh = p.priorityQueue.readyCh
+	}
+	var stealingReadyCh <-chan struct{}
+	worker := int(atomic.AddInt32(&p.nextWorker, 1))
+	if p.workStealingQueue != nil {
+		stealingReadyCh = p.workStealingQueue.readyCh
+	}
+	p.invokeWorkerHook("OnWorkerStart", p.options.OnWorkerStart, worker)
+	defer p.invokeWorkerHook("OnWorkerStop", p.options.OnWorkerStop, worker)
+
 	for {
+		atomic.AddInt32(&p.idleWorkers, 1)
 		select {
 		case <-p.shutdownCh:
+			atomic.AddInt32(&p.idleWorkers, -1)
+			return
+		case <-workerShutdownCh:
+			atomic.AddInt32(&p.idleWorkers, -1)
 			return
 		case task := <-p.tasksCh:
+			atomic.AddInt32(&p.idleWorkers, -1)
+			p.executeTask(task)
+		case <-priorityReadyCh:
+			atomic.AddInt32(&p.idleWorkers, -1)
+			p.executeTask(p.priorityQueue.poll())
+		case <-stealingReadyCh:
+			atomic.AddInt32(&p.idleWorkers, -1)
+			task, stolen := p.workStealingQueue.poll(worker)
+			if stolen {
+				p.metricsScope.IncCounter(metrics.ParallelTaskStolen)
+			}
 			p.executeTask(task)
+		case <-idleTimerCh:
+			atomic.AddInt32(&p.idleWorkers, -1)
+			if p.retireIdleWorker(workerShutdownCh) {
+				return
+			}
+		}
+
+		if idleTimer != nil {
+			if !idleTimer.Stop() {
+				select {
+				case <-idleTimer.C:
+				default:
+				}
+			}
+			idleTimer.Reset(p.options.IdleWorkerTimeout)
 		}
 	}
 }
 
 func (p *parallelTaskProcessorImpl) executeTask(task Task) {
-	sw := p.metricsScope.StartTimer(metrics.ParallelTaskTaskProcessingLatency)
-	defer sw.Stop()
+	if batch, ok := task.(*taskBatch); ok {
+		p.executeBatch(batch)
+		return
+	}
+
+	atomic.AddInt32(&p.busyWorkers, 1)
+	defer atomic.AddInt32(&p.busyWorkers, -1)
+
+	priority := NoPriority
+	if priorityTask, ok := task.(PriorityTask); ok {
+		priority = priorityTask.Priority()
+	}
+	metricsScope := p.getTaskMetricsScope(task, priority)
+	defer func() {
+		if r := recover(); r != nil {
+			recordOutcome(metricsScope, taskOutcomePanic)
+			panic(r)
+		}
+	}()
+
+	startTime := time.Now()
+	defer func() {
+		latency := time.Since(startTime)
+		metricsScope.RecordTimer(metrics.ParallelTaskTaskProcessingLatency, latency)
+		if p.options.SlowTaskThreshold > 0 && latency > p.options.SlowTaskThreshold {
+			p.logSlowTask(task, priority, latency)
+			metricsScope.IncCounter(metrics.PriorityTaskSlow)
+		}
+	}()
 
+	inflightID := p.trackInflightTask(task, priority, startTime)
+	preemptibleID := p.trackPreemptibleTask(task, priority)
+	defer p.untrackPreemptibleTask(preemptibleID)
+
+	retryPolicy := taskRetryPolicy(task, p.options.RetryPolicy)
+	priorRetries := 0
+	priorRequeues := 0
+	firstAttemptTime := startTime
+	if provider, ok := task.(retryStateProvider); ok {
+		if retries, requeues, attemptTime, ok := provider.retryState(); ok {
+			priorRetries = retries
+			priorRequeues = requeues
+			firstAttemptTime = attemptTime
+			retryPolicy = &offsetRetryPolicy{
+				policy:  retryPolicy,
+				retries: retries,
+				elapsed: startTime.Sub(attemptTime),
+			}
+		}
+	}
+
+	if p.options.RetryBackoffMultiplier != nil {
+		retryPolicy = &scaledRetryPolicy{
+			policy: retryPolicy,
+			multiplier: func() float64 {
+				return p.options.RetryBackoffMultiplier(task, priority)
+			},
+			onDelay: func(delay time.Duration) {
+				metricsScope.RecordTimer(metrics.PriorityTaskRetryBackoff, delay)
+			},
+		}
+	}
+
+	execute := task.Execute
+	var untrackDeferredTask func(executionPending bool) (bool, bool, error)
+	if contextAwareTask, ok := task.(ContextAwareTask); ok {
+		ctx, cancel := p.executeContext(task)
+		defer cancel()
+		if p.options.DeferredAck {
+			ctx, untrackDeferredTask = p.trackDeferredTask(ctx, task)
+		}
+		execute = func() error {
+			return contextAwareTask.ExecuteWithContext(ctx)
+		}
+	}
+	executions := 0
+	executionPending := false
+	yielded := false
+	// outcome is the outcome of the last failed execution decided by isRetryable,
+	// empty if the retry policy is exhausted before the error is checked
+	outcome := ""
 	op := func() error {
-		if err := task.Execute(); err != nil {
-			return task.HandleErr(err)
+		executions++
+		attemptStartTime := time.Now()
+		p.beforeExecute(task)
+		err := execute()
+		p.afterExecute(task, err, time.Since(attemptStartTime))
+		if err != nil {
+			if untrackDeferredTask != nil && err == ErrTaskPending {
+				executionPending = true
+				return nil
+			}
+			if err == ErrTaskYielded && p.yieldTask(task, priorRetries+executions-1, firstAttemptTime) {
+				yielded = true
+				metricsScope.IncCounter(metrics.PriorityTaskYielded)
+				return nil
+			}
+			err = task.HandleErr(err)
+			outcome = ""
 		}
-		return nil
+		recordAttempt(metricsScope, priorRetries+executions, time.Since(attemptStartTime), err)
+		if p.options.OnTaskAttempt != nil {
+			p.options.OnTaskAttempt(task, err)
+		}
+		return err
 	}
 
+	retrying := false
+	retryingInPlace := false
+	requeued := false
+	defer func() {
+		if retrying {
+			atomic.AddInt32(&p.retryingTasks, -1)
+		}
+		if retryingInPlace {
+			p.releaseRetryingWorker()
+		}
+	}()
+
 	isRetryable := func(err error) bool {
 		if p.isStopped() {
 			return false
 		}
-		return task.RetryErr(err)
+		if !task.RetryErr(err) {
+			outcome = taskOutcomePermanentFailure
+			return false
+		}
+		outcome = taskOutcomeRetryableFailure
+		if !p.allowRetry() {
+			metricsScope.IncCounter(metrics.PriorityTaskRetryBudgetExhausted)
+			return false
+		}
+		if !p.allowGlobalRetry() {
+			metricsScope.IncCounter(metrics.PriorityTaskGlobalRetriesExhausted)
+			return false
+		}
+		if !retrying {
+			retrying = true
+			atomic.AddInt32(&p.retryingTasks, 1)
+		}
+		if priorityTask, ok := task.(PriorityTask); ok && p.options.RequeueRetry != nil {
+			if p.options.MaxRequeues > 0 && priorRequeues >= p.options.MaxRequeues {
+				// the task would loop through requeues, break the loop by exhausting it
+				metricsScope.IncCounter(metrics.PriorityTaskResubmitLoopBroken)
+				return false
+			}
+			if p.options.RequeueRetry(priorityTask, priorRetries+executions, firstAttemptTime) {
+				// stop retrying in place
+				requeued = true
+				return false
+			}
+		}
+		if p.options.NewTaskReservedFraction > 0 && !retryingInPlace {
+			if !p.acquireRetryingWorker() {
+				metricsScope.IncCounter(metrics.PriorityTaskRetryCapacityExhausted)
+				return false
+			}
+			retryingInPlace = true
+		}
+		return true
 	}
 
-	if err := backoff.Retry(op, p.options.RetryPolicy, isRetryable); err != nil {
+	err := backoff.Retry(op, retryPolicy, isRetryable)
+	if !p.untrackInflightTask(inflightID) || requeued || yielded {
+		// task is handed off to OnShutdownTimeout, requeued for retry or yielded
+		if untrackDeferredTask != nil {
+			untrackDeferredTask(false)
+		}
+		return
+	}
+	if untrackDeferredTask != nil {
+		pending, completed, completeErr := untrackDeferredTask(executionPending)
+		if pending {
+			// the worker is freed, the task is finalized by Complete
+			return
+		}
+		if completed {
+			err = completeErr
+			outcome = taskOutcomePermanentFailure
+		} else if executionPending {
+			// pending when the processor is stopped
+			return
+		}
+	}
+	if err != nil {
 		if p.isStopped() {
 			// neither ack or nack here
 			return
 		}
 
 		// non-retryable error or exhausted all retries
-		task.Nack()
+		recordRetryAttempts(metricsScope, taskOutcomeExhausted, priorRetries+executions)
+		if outcome == "" {
+			// the retry policy is exhausted before the error is checked
+			outcome = taskOutcomeExpired
+		}
+		recordOutcome(metricsScope, failureOutcome(err, outcome))
+		p.finalizeTask(task, err)
 		return
 	}
 
 	// no error
-	task.Ack()
+	recordRetryAttempts(metricsScope, taskOutcomeSuccess, priorRetries+executions)
+	recordOutcome(metricsScope, taskOutcomeSuccess)
+	p.finalizeTask(task, nil)
+}
+
+// executeBatch executes the tasks of the batch via BatchExecute, tasks failed with a
+// retryable error are then processed one after another via executeTask
+func (p *parallelTaskProcessorImpl) executeBatch(
+	batch *taskBatch,
+) {
+	for _, task := range p.executeBatchOnce(batch) {
+		p.executeTask(task)
+	}
+}
+
+// executeBatchOnce executes the tasks of the batch via BatchExecute, finalizes the
+// tasks which are not to be retried, and returns the ones failed with a retryable error
+func (p *parallelTaskProcessorImpl) executeBatchOnce(
+	batch *taskBatch,
+) []Task {
+	atomic.AddInt32(&p.busyWorkers, 1)
+	defer atomic.AddInt32(&p.busyWorkers, -1)
+
+	startTime := time.Now()
+	tasks := make([]PriorityTask, 0, len(batch.tasks))
+	inflightIDs := make([]int64, 0, len(batch.tasks))
+	for _, task := range batch.tasks {
+		tasks = append(tasks, unwrapSchedulerTask(task).(PriorityTask))
+		inflightIDs = append(inflightIDs, p.trackInflightTask(task, task.(PriorityTask).Priority(), startTime))
+		p.beforeExecute(task)
+	}
+	errs := tasks[0].(BatchableTask).BatchExecute(tasks)
+	latency := time.Since(startTime)
+	if len(errs) != len(tasks) {
+		err := fmt.Errorf("batch execution returned %v errors for %v tasks", len(errs), len(tasks))
+		p.logger.Error("Batch execution returned mismatched errors.", tag.Error(err))
+		errs = make([]error, len(tasks))
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+
+	var retryTasks []Task
+	for i, task := range batch.tasks {
+		err := errs[i]
+		metricsScope := p.getTaskMetricsScope(task, task.(PriorityTask).Priority())
+		metricsScope.RecordTimer(metrics.ParallelTaskTaskProcessingLatency, latency)
+		p.afterExecute(task, err, latency)
+		if err != nil {
+			err = task.HandleErr(err)
+		}
+		recordAttempt(metricsScope, 1, latency, err)
+		if p.options.OnTaskAttempt != nil {
+			p.options.OnTaskAttempt(task, err)
+		}
+		if !p.untrackInflightTask(inflightIDs[i]) {
+			// task is handed off to OnShutdownTimeout
+			continue
+		}
+		if err == nil {
+			recordRetryAttempts(metricsScope, taskOutcomeSuccess, 1)
+			recordOutcome(metricsScope, taskOutcomeSuccess)
+			p.finalizeTask(task, nil)
+			continue
+		}
+		if p.isStopped() {
+			// neither ack or nack here
+			continue
+		}
+		if task.RetryErr(err) {
+			retryTasks = append(retryTasks, task)
+			continue
+		}
+		recordRetryAttempts(metricsScope, taskOutcomeExhausted, 1)
+		recordOutcome(metricsScope, failureOutcome(err, taskOutcomePermanentFailure))
+		p.finalizeTask(task, err)
+	}
+	return retryTasks
+}
+
+// beforeExecute invokes the BeforeExecute hook, if specified, with PriorityTasks
+func (p *parallelTaskProcessorImpl) beforeExecute(
+	task Task,
+) {
+	if p.options.BeforeExecute == nil {
+		return
+	}
+	if priorityTask, ok := task.(PriorityTask); ok {
+		defer p.recoverHookPanic("BeforeExecute", task)
+		p.options.BeforeExecute(priorityTask)
+	}
+}
+
+// afterExecute invokes the AfterExecute hook, if specified, with PriorityTasks
+func (p *parallelTaskProcessorImpl) afterExecute(
+	task Task,
+	err error,
+	latency time.Duration,
+) {
+	if p.options.AfterExecute == nil {
+		return
+	}
+	if priorityTask, ok := task.(PriorityTask); ok {
+		defer p.recoverHookPanic("AfterExecute", task)
+		p.options.AfterExecute(priorityTask, err, latency)
+	}
+}
+
+// invokeWorkerHook invokes OnWorkerStart or OnWorkerStop, if specified, with the worker ID
+func (p *parallelTaskProcessorImpl) invokeWorkerHook(
+	hook string,
+	fn func(workerID int),
+	worker int,
+) {
+	if fn == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger.Error(fmt.Sprintf("Worker hook %v panicked.", hook), tag.Value(r))
+		}
+	}()
+	fn(worker)
+}
+
+// recoverHookPanic must be deferred by the caller of an execution hook
+func (p *parallelTaskProcessorImpl) recoverHookPanic(
+	hook string,
+	task Task,
+) {
+	if r := recover(); r != nil {
+		p.logger.Error(
+			fmt.Sprintf("Task execution hook %v panicked.", hook),
+			appendCorrelationTag([]tag.Tag{tag.Value(r)}, task)...,
+		)
+	}
+}
+
+// finalizeTask acks the task if err is nil, otherwise the task is exhausted
+func (p *parallelTaskProcessorImpl) finalizeTask(
+	task Task,
+	err error,
+) {
+	if err == nil {
+		atomic.AddInt64(&p.succeededTasks, 1)
+		task.Ack()
+		return
+	}
+
+	atomic.AddInt64(&p.failedTasks, 1)
+	p.logger.Warn("Task exhausted.", appendCorrelationTag([]tag.Tag{tag.Error(err)}, task)...)
+	if observer := getExhaustionObserver(task); observer != nil {
+		observer.exhausted(err)
+	}
+	if p.options.OnTaskExhausted != nil {
+		p.options.OnTaskExhausted(task, err)
+		return
+	}
+	task.Nack()
+}
+
+// recordRetryAttempts records the total number of attempts made to process a task, including
+// the attempts made before the task is requeued for retry, once the task succeeds or fails
+// getTaskMetricsScope returns the scope for the metrics emitted when processing the task
+func (p *parallelTaskProcessorImpl) getTaskMetricsScope(
+	task Task,
+	priority int,
+) metrics.Scope {
+	if p.priorityScopes != nil {
+		return p.priorityScopes.getTaskScope(task, priority, p.metricTagAllowlist)
+	}
+	return getTaskMetricsScope(p.metricsScope, task, priority, p.metricTagAllowlist)
+}
+
+func recordRetryAttempts(
+	metricsScope metrics.Scope,
+	outcome string,
+	attempts int,
+) {
+	metricsScope.Tagged(metrics.TaskOutcomeTag(outcome), metrics.TaskAttemptTag(getTaskAttempt(attempts))).
+		RecordHistogramValue(metrics.PriorityTaskRetryAttempts, float64(attempts))
+}
+
+// taskRetryPolicy returns the retry policy of the task if it's a RetryPolicyTask with a policy,
+// looking through the wrappers added by the schedulers, otherwise the default policy
+func taskRetryPolicy(
+	task Task,
+	defaultPolicy backoff.RetryPolicy,
+) backoff.RetryPolicy {
+	if policyTask, ok := unwrapSchedulerTask(task).(RetryPolicyTask); ok {
+		if policy := policyTask.RetryPolicy(); policy != nil {
+			return policy
+		}
+	}
+	return defaultPolicy
+}
+
+// recordOutcome emits the outcome category of a finalized task
+func recordOutcome(
+	metricsScope metrics.Scope,
+	outcome string,
+) {
+	metricsScope.Tagged(metrics.TaskOutcomeTag(outcome)).IncCounter(metrics.PriorityTaskOutcomes)
+}
+
+// failureOutcome returns the outcome category of a task failed with the error,
+// timeouts are told apart from other failures regardless of the retries
+func failureOutcome(
+	err error,
+	outcome string,
+) string {
+	if err == context.DeadlineExceeded {
+		return taskOutcomeTimeout
+	}
+	return outcome
+}
+
+// recordAttempt emits the outcome and latency of an execution, so that
+// the success rate of first attempts can be told apart from retries
+func recordAttempt(
+	metricsScope metrics.Scope,
+	attempt int,
+	latency time.Duration,
+	err error,
+) {
+	outcome := taskOutcomeSuccess
+	if err != nil {
+		outcome = taskOutcomeFailure
+	}
+	attemptScope := metricsScope.Tagged(metrics.TaskAttemptTag(getTaskAttempt(attempt)))
+	attemptScope.Tagged(metrics.TaskOutcomeTag(outcome)).IncCounter(metrics.PriorityTaskAttempts)
+	attemptScope.RecordTimer(metrics.PriorityTaskAttemptLatency, latency)
+}
+
+func getTaskAttempt(
+	attempt int,
+) string {
+	if attempt <= 1 {
+		return taskAttemptFirst
+	}
+	return taskAttemptRetry
+}
+
+// executeContext returns the context for executing the task, which is cancelled when Stop is called
+func (p *parallelTaskProcessorImpl) executeContext(
+	task Task,
+) (context.Context, context.CancelFunc) {
+	priorityTask, ok := task.(PriorityTask)
+	if !ok || p.options.ExecuteContext == nil {
+		return p.shutdownCtx, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(p.options.ExecuteContext(priorityTask))
+	go func() {
+		select {
+		case <-p.shutdownCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// yieldTask hands the task off to OnYield, returns true if the task is taken over
+func (p *parallelTaskProcessorImpl) yieldTask(
+	task Task,
+	retries int,
+	firstAttemptTime time.Time,
+) bool {
+	if p.options.OnYield == nil || p.isStopped() {
+		return false
+	}
+	priorityTask, ok := task.(PriorityTask)
+	if !ok {
+		return false
+	}
+	return p.options.OnYield(priorityTask, retries, firstAttemptTime)
+}
+
+// trackPreemptibleTask returns the id for untracking the task, tasks
+// are only tracked if they're preemptible and Preemption is specified
+func (p *parallelTaskProcessorImpl) trackPreemptibleTask(
+	task Task,
+	priority int,
+) int64 {
+	if !p.options.Preemption {
+		return 0
+	}
+	preemptibleTask, ok := unwrapSchedulerTask(task).(PreemptibleTask)
+	if !ok {
+		return 0
+	}
+
+	p.preemptLock.Lock()
+	defer p.preemptLock.Unlock()
+
+	p.nextPreemptibleID++
+	p.preemptibleTasks[p.nextPreemptibleID] = &preemptibleExecution{
+		task:     preemptibleTask,
+		priority: priority,
+	}
+	return p.nextPreemptibleID
+}
+
+func (p *parallelTaskProcessorImpl) untrackPreemptibleTask(
+	id int64,
+) {
+	if id == 0 {
+		return
+	}
+
+	p.preemptLock.Lock()
+	defer p.preemptLock.Unlock()
+
+	delete(p.preemptibleTasks, id)
+}
+
+// preemptFor preempts the preemptible task with the lowest priority
+// that is lower than the priority of the given task and not yet preempted
+func (p *parallelTaskProcessorImpl) preemptFor(
+	task Task,
+) {
+	priorityTask, ok := task.(PriorityTask)
+	if !ok {
+		return
+	}
+	priority := priorityTask.Priority()
+
+	p.preemptLock.Lock()
+	var victim *preemptibleExecution
+	for _, execution := range p.preemptibleTasks {
+		if execution.preempted || execution.priority <= priority {
+			continue
+		}
+		if victim == nil || execution.priority > victim.priority {
+			victim = execution
+		}
+	}
+	if victim != nil {
+		victim.preempted = true
+	}
+	p.preemptLock.Unlock()
+
+	if victim == nil {
+		return
+	}
+	// preempt outside the lock as the task may resubmit itself
+	victim.task.Preempt()
+	p.getTaskMetricsScope(victim.task, victim.priority).IncCounter(metrics.PriorityTaskPreempted)
+}
+
+func (p *parallelTaskProcessorImpl) InFlightTasks() []InFlightTask {
+	p.inflightLock.Lock()
+	executions := make([]*inflightTask, 0, len(p.inflightTasks))
+	for _, execution := range p.inflightTasks {
+		executions = append(executions, execution)
+	}
+	p.inflightLock.Unlock()
+
+	// build the descriptors outside the lock so that workers are not blocked
+	tasks := make([]InFlightTask, 0, len(executions))
+	for _, execution := range executions {
+		tasks = append(tasks, InFlightTask{
+			Priority:  execution.priority,
+			StartTime: execution.startTime,
+			Tags:      getAllowedMetricTags(execution.task, p.metricTagAllowlist),
+		})
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].StartTime.Before(tasks[j].StartTime)
+	})
+	return tasks
+}
+
+// trackInflightTask returns the id for untracking the task
+func (p *parallelTaskProcessorImpl) trackInflightTask(
+	task Task,
+	priority int,
+	startTime time.Time,
+) int64 {
+	p.inflightLock.Lock()
+	defer p.inflightLock.Unlock()
+
+	p.nextInflightID++
+	p.inflightTasks[p.nextInflightID] = &inflightTask{
+		task:      task,
+		priority:  priority,
+		startTime: startTime,
+	}
+	return p.nextInflightID
+}
+
+// untrackInflightTask returns false if the task
+// is already handed off to OnShutdownTimeout
+func (p *parallelTaskProcessorImpl) untrackInflightTask(
+	id int64,
+) bool {
+	p.inflightLock.Lock()
+	defer p.inflightLock.Unlock()
+
+	if _, ok := p.inflightTasks[id]; !ok {
+		return false
+	}
+	delete(p.inflightTasks, id)
+	return true
+}
+
+func (p *parallelTaskProcessorImpl) handoffInflightTasks() {
+	if p.options.OnShutdownTimeout == nil {
+		return
+	}
+
+	p.inflightLock.Lock()
+	tasks := make([]Task, 0, len(p.inflightTasks))
+	for id, execution := range p.inflightTasks {
+		tasks = append(tasks, execution.task)
+		delete(p.inflightTasks, id)
+	}
+	p.inflightLock.Unlock()
+
+	for _, task := range tasks {
+		p.options.OnShutdownTimeout(task)
+	}
+}
+
+func (p *parallelTaskProcessorImpl) logSlowTask(
+	task Task,
+	priority int,
+	latency time.Duration,
+) {
+	tags := []tag.Tag{
+		tag.TaskPriority(priority),
+		tag.TaskProcessingLatency(latency),
+	}
+	if taggedTask, ok := task.(MetricTaggedTask); ok {
+		tags = append(tags, tag.TaskMetricTags(taggedTask.MetricTags()))
+	}
+	p.logger.Warn("Slow task detected.", appendCorrelationTag(tags, task)...)
+}
+
+// appendCorrelationTag appends the correlation ID of the task to the log tags, if the task,
+// or the task wrapped by the scheduler, is a CorrelatedTask with a non-empty ID
+func appendCorrelationTag(
+	tags []tag.Tag,
+	task Task,
+) []tag.Tag {
+	correlatedTask, ok := unwrapSchedulerTask(task).(CorrelatedTask)
+	if !ok {
+		return tags
+	}
+	if correlationID := correlatedTask.CorrelationID(); correlationID != "" {
+		tags = append(tags, tag.TaskCorrelationID(correlationID))
+	}
+	return tags
+}
+
+// allowRetry returns false if the retry budget is exhausted
+func (p *parallelTaskProcessorImpl) allowRetry() bool {
+	if p.retrySlowStart != nil {
+		return p.retrySlowStart.allow()
+	}
+	return p.retryLimiter == nil || p.retryLimiter.Allow()
+}
+
+// acquireRetryingWorker returns false if all the workers not reserved
+// by NewTaskReservedFraction are already retrying tasks in place
+func (p *parallelTaskProcessorImpl) acquireRetryingWorker() bool {
+	p.workerLock.Lock()
+	workerCount := p.workerCount
+	p.workerLock.Unlock()
+	reserved := int(math.Ceil(float64(workerCount) * p.options.NewTaskReservedFraction))
+
+	for {
+		retryingWorkers := atomic.LoadInt32(&p.retryingWorkers)
+		if int(retryingWorkers) >= workerCount-reserved {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.retryingWorkers, retryingWorkers, retryingWorkers+1) {
+			p.emitWorkerSplit(retryingWorkers + 1)
+			return true
+		}
+	}
+}
+
+func (p *parallelTaskProcessorImpl) releaseRetryingWorker() {
+	p.emitWorkerSplit(atomic.AddInt32(&p.retryingWorkers, -1))
+}
+
+// emitWorkerSplit emits the number of busy workers retrying tasks in place and executing new tasks
+func (p *parallelTaskProcessorImpl) emitWorkerSplit(
+	retryingWorkers int32,
+) {
+	newTaskWorkers := atomic.LoadInt32(&p.busyWorkers) - retryingWorkers
+	if newTaskWorkers < 0 {
+		newTaskWorkers = 0
+	}
+	p.metricsScope.UpdateGauge(metrics.ParallelTaskRetryingWorkerCount, float64(retryingWorkers))
+	p.metricsScope.UpdateGauge(metrics.ParallelTaskNewTaskWorkerCount, float64(newTaskWorkers))
+}
+
+// allowGlobalRetry returns false once GlobalMaxRetries is reached
+func (p *parallelTaskProcessorImpl) allowGlobalRetry() bool {
+	maxRetries := atomic.LoadInt64(&p.globalMaxRetries)
+	return maxRetries <= 0 || atomic.AddInt64(&p.globalRetries, 1) <= maxRetries
+}
+
+func (p *parallelTaskProcessorImpl) SetGlobalMaxRetries(
+	maxRetries int,
+) error {
+	if maxRetries < 0 {
+		return fmt.Errorf("global max retries must not be negative, got: %v", maxRetries)
+	}
+
+	atomic.StoreInt64(&p.globalRetries, 0)
+	atomic.StoreInt64(&p.globalMaxRetries, int64(maxRetries))
+	p.logger.Info("Parallel task processor global max retries updated.", tag.Counter(maxRetries))
+	return nil
+}
+
+// restartRetrySlowStart ramps the retry budget from the minimum rate again, e.g. once a downstream
+// dependency recovers, it's a no-op unless RetrySlowStartWindow is specified
+func (p *parallelTaskProcessorImpl) restartRetrySlowStart() {
+	if p.retrySlowStart != nil {
+		p.retrySlowStart.restart()
+	}
 }
 
 func (p *parallelTaskProcessorImpl) isStopped() bool {
 	return atomic.LoadInt32(&p.status) == common.DaemonStatusStopped
 }
+
+func (p *offsetRetryPolicy) ComputeNextDelay(
+	elapsedTime time.Duration,
+	numAttempts int,
+) time.Duration {
+	return p.policy.ComputeNextDelay(elapsedTime+p.elapsed, numAttempts+p.retries)
+}
+
+func (p *scaledRetryPolicy) ComputeNextDelay(
+	elapsedTime time.Duration,
+	numAttempts int,
+) time.Duration {
+	delay := p.policy.ComputeNextDelay(elapsedTime, numAttempts)
+	if delay < 0 {
+		// no more retries
+		return delay
+	}
+	delay = time.Duration(float64(delay) * p.multiplier())
+	p.onDelay(delay)
+	return delay
+}
@@ -21,7 +21,11 @@
 package task
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -30,11 +34,15 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/uber/cadence/common"
 	"github.com/uber/cadence/common/backoff"
 	"github.com/uber/cadence/common/log/loggerimpl"
 	"github.com/uber/cadence/common/metrics"
+	"github.com/uber/cadence/common/quotas"
 )
 
 type (
@@ -46,6 +54,25 @@ type (
 
 		processor *parallelTaskProcessorImpl
 	}
+
+	testCorrelatedTask struct {
+		*MockPriorityTask
+
+		correlationID string
+	}
+
+	testRetryPolicyTask struct {
+		*MockPriorityTask
+
+		retryPolicy backoff.RetryPolicy
+	}
+
+	testBatchableTask struct {
+		*MockPriorityTask
+
+		batchKey     string
+		batchExecute func(tasks []PriorityTask) []error
+	}
 )
 
 var (
@@ -96,6 +123,64 @@ func (s *parallelTaskProcessorSuite) TestSubmit_Fail() {
 	s.Equal(ErrTaskProcessorClosed, err)
 }
 
+func (s *parallelTaskProcessorSuite) TestTrySubmit() {
+	mockTask := NewMockTask(s.controller)
+	submitted, err := s.processor.TrySubmit(mockTask)
+	s.NoError(err)
+	s.False(submitted) // no idle worker
+
+	doneCh := make(chan struct{})
+	mockTask.EXPECT().Execute().Return(nil).Times(1)
+	mockTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+	s.processor.Start()
+	for atomic.LoadInt32(&s.processor.idleWorkers) == 0 {
+		runtime.Gosched()
+	}
+	submitted, err = s.processor.TrySubmit(mockTask)
+	s.NoError(err)
+	s.True(submitted)
+	<-doneCh
+
+	s.processor.Stop()
+	submitted, err = s.processor.TrySubmit(mockTask)
+	s.Equal(ErrTaskProcessorClosed, err)
+	s.False(submitted)
+}
+
+func (s *parallelTaskProcessorSuite) TestSubmitReportingBlocked() {
+	for name, options := range map[string]*ParallelTaskProcessorOptions{
+		"channel":       {QueueSize: 1, WorkerCount: 1},
+		"priorityQueue": {QueueSize: 1, WorkerCount: 1, PriorityQueue: true},
+		"workStealing":  {QueueSize: 1, WorkerCount: 1, WorkStealing: true},
+	} {
+		options.RetryPolicy = backoff.NewExponentialRetryPolicy(time.Millisecond)
+		processor := NewParallelTaskProcessor(
+			loggerimpl.NewDevelopmentForTest(s.Suite),
+			metrics.NewClient(tally.NoopScope, metrics.Common),
+			options,
+		).(*parallelTaskProcessorImpl)
+
+		// workers are not started, so the buffer is full once a task is submitted
+		blockedCh := make(chan struct{}, 2)
+		onBlocked := func() { blockedCh <- struct{}{} }
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		s.NoError(processor.submitReportingBlocked(mockTask, onBlocked), name)
+		s.Empty(blockedCh, name)
+		s.Equal(float64(1), processor.bufferOccupancy(), name)
+
+		cancelCh := make(chan struct{})
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- processor.submit(mockTask, cancelCh, onBlocked)
+		}()
+		<-blockedCh
+		close(cancelCh)
+		s.Equal(ErrTaskProcessorClosed, <-errCh, name)
+		s.Empty(blockedCh, name)
+	}
+}
+
 func (s *parallelTaskProcessorSuite) TestTaskWorker() {
 	numTasks := 5
 
@@ -114,10 +199,368 @@ func (s *parallelTaskProcessorSuite) TestTaskWorker() {
 		close(done)
 	}()
 
-	s.processor.taskWorker()
+	s.processor.taskWorker(make(chan struct{}))
 	<-done
 }
 
+func (s *parallelTaskProcessorSuite) TestPriorityQueue_PickupOrder() {
+	processor := NewParallelTaskProcessor(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:     10,
+			WorkerCount:   1,
+			RetryPolicy:   backoff.NewExponentialRetryPolicy(time.Millisecond),
+			PriorityQueue: true,
+		},
+	).(*parallelTaskProcessorImpl)
+
+	// tasks are buffered before workers are started
+	priorities := []int{2, 0, 1, 0}
+	var executed []int
+	var taskWG sync.WaitGroup
+	taskWG.Add(len(priorities))
+	for idx, priority := range priorities {
+		idx := idx
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Execute().DoAndReturn(func() error {
+			executed = append(executed, idx)
+			return nil
+		})
+		mockTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+		s.NoError(processor.Submit(mockTask))
+	}
+	s.Equal(len(priorities), processor.Stats().QueuedTasks)
+
+	processor.Start()
+	defer processor.Stop()
+	taskWG.Wait()
+	s.Equal([]int{1, 3, 2, 0}, executed)
+}
+
+func (s *parallelTaskProcessorSuite) TestWorkStealing() {
+	testScope := tally.NewTestScope("test", nil)
+	processor := NewParallelTaskProcessor(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(testScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:    10,
+			WorkerCount:  2,
+			RetryPolicy:  backoff.NewExponentialRetryPolicy(time.Millisecond),
+			WorkStealing: true,
+		},
+	).(*parallelTaskProcessorImpl)
+
+	// the blocked task is at the front of a deque, so the task queued
+	// behind it can only be processed by the other worker stealing it
+	releaseCh := make(chan struct{})
+	blockedTask := NewMockTask(s.controller)
+	blockedTask.EXPECT().Execute().DoAndReturn(func() error {
+		<-releaseCh
+		return nil
+	})
+	blockedTask.EXPECT().Ack()
+	s.NoError(processor.Submit(blockedTask))
+
+	var taskWG sync.WaitGroup
+	taskWG.Add(3)
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockTask(s.controller)
+		mockTask.EXPECT().Execute().Return(nil)
+		mockTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+		s.NoError(processor.Submit(mockTask))
+	}
+	s.Equal(4, processor.Stats().QueuedTasks)
+
+	processor.Start()
+	taskWG.Wait()
+	close(releaseCh)
+	processor.Stop()
+
+	stolen := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.paralleltask_stolen" {
+			stolen += counter.Value()
+		}
+	}
+	s.True(stolen >= 1)
+}
+
+func (s *parallelTaskProcessorSuite) TestPreemption() {
+	testScope := tally.NewTestScope("test", nil)
+	processor := NewParallelTaskProcessor(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(testScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:   10,
+			WorkerCount: 1,
+			RetryPolicy: backoff.NewExponentialRetryPolicy(time.Millisecond),
+			Preemption:  true,
+		},
+	).(*parallelTaskProcessorImpl)
+	processor.Start()
+	defer processor.Stop()
+
+	var taskWG sync.WaitGroup
+	taskWG.Add(3)
+	newMockTask := func(priority int) *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Execute().Return(nil)
+		mockTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+		return mockTask
+	}
+
+	startedCh := make(chan struct{})
+	preemptedCh := make(chan struct{})
+	preemptibleTask := NewMockPreemptibleTask(s.controller)
+	preemptibleTask.EXPECT().Priority().Return(2).AnyTimes()
+	preemptibleTask.EXPECT().Execute().DoAndReturn(func() error {
+		close(startedCh)
+		<-preemptedCh
+		return nil
+	})
+	preemptibleTask.EXPECT().Preempt().Do(func() { close(preemptedCh) }).Times(1)
+	preemptibleTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+	s.NoError(processor.Submit(preemptibleTask))
+	<-startedCh
+	s.Eventually(func() bool {
+		return atomic.LoadInt32(&processor.idleWorkers) == 0
+	}, time.Second, time.Millisecond)
+
+	// tasks of the same priority don't preempt
+	s.NoError(processor.Submit(newMockTask(2)))
+	s.NoError(processor.Submit(newMockTask(0)))
+	taskWG.Wait()
+
+	var preempted int64
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_preempted" {
+			s.Equal("2", counter.Tags()["task_priority"])
+			preempted += counter.Value()
+		}
+	}
+	s.Equal(int64(1), preempted)
+}
+
+func (s *parallelTaskProcessorSuite) TestInFlightTasks() {
+	processor := NewParallelTaskProcessor(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:          10,
+			WorkerCount:        2,
+			RetryPolicy:        backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MetricTagAllowlist: []string{"tenant"},
+		},
+	).(*parallelTaskProcessorImpl)
+	processor.Start()
+	defer processor.Stop()
+	s.Empty(processor.InFlightTasks())
+
+	var taskWG sync.WaitGroup
+	taskWG.Add(2)
+	startedCh := make(chan struct{}, 2)
+	doneCh := make(chan struct{})
+	execute := func() error {
+		startedCh <- struct{}{}
+		<-doneCh
+		return nil
+	}
+
+	mockTaggedTask := NewMockMetricTaggedTask(s.controller)
+	mockTaggedTask.EXPECT().MetricTags().Return(map[string]string{
+		"tenant":    "some random tenant",
+		"task_type": "some random type",
+	}).AnyTimes()
+	taggedTask := &testMetricTaggedTask{
+		MockPriorityTask:     NewMockPriorityTask(s.controller),
+		MockMetricTaggedTask: mockTaggedTask,
+	}
+	taggedTask.MockPriorityTask.EXPECT().Priority().Return(1).AnyTimes()
+	taggedTask.MockPriorityTask.EXPECT().Execute().DoAndReturn(execute)
+	taggedTask.MockPriorityTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+	s.NoError(processor.Submit(taggedTask))
+	<-startedCh
+
+	mockTask := NewMockTask(s.controller)
+	mockTask.EXPECT().Execute().DoAndReturn(execute)
+	mockTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+	s.NoError(processor.Submit(mockTask))
+	<-startedCh
+
+	tasks := processor.InFlightTasks()
+	s.Len(tasks, 2)
+	s.Equal(1, tasks[0].Priority)
+	s.Equal(map[string]string{"tenant": "some random tenant"}, tasks[0].Tags)
+	s.Equal(NoPriority, tasks[1].Priority)
+	s.Nil(tasks[1].Tags)
+	s.False(tasks[1].StartTime.Before(tasks[0].StartTime))
+
+	close(doneCh)
+	taskWG.Wait()
+	s.Eventually(func() bool {
+		return len(processor.InFlightTasks()) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func (s *parallelTaskProcessorSuite) TestWorkerHooks() {
+	var lock sync.Mutex
+	var events []string
+	started := make(map[int]int)
+	stopped := make(map[int]int)
+	s.processor.options.OnWorkerStart = func(workerID int) {
+		lock.Lock()
+		defer lock.Unlock()
+		started[workerID]++
+		events = append(events, "start")
+	}
+	s.processor.options.OnWorkerStop = func(workerID int) {
+		lock.Lock()
+		defer lock.Unlock()
+		stopped[workerID]++
+		events = append(events, "stop")
+		if len(stopped) == 1 {
+			panic("some random panic")
+		}
+	}
+
+	doneCh := make(chan struct{})
+	mockTask := NewMockTask(s.controller)
+	mockTask.EXPECT().Execute().DoAndReturn(func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, "execute")
+		return nil
+	}).Times(1)
+	mockTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+	s.processor.Start()
+	s.NoError(s.processor.Submit(mockTask))
+	<-doneCh
+
+	// workers removed by SetWorkerCount invoke OnWorkerStop as well
+	s.NoError(s.processor.SetWorkerCount(3))
+	s.NoError(s.processor.SetWorkerCount(1))
+	s.processor.Stop()
+
+	// the worker executing the task has started before, and stopped after the execution
+	s.Equal([]string{"start", "execute"}, events[:2])
+	s.Len(started, 3)
+	s.Equal(started, stopped)
+	for _, count := range started {
+		s.Equal(1, count)
+	}
+}
+
+func (s *parallelTaskProcessorSuite) TestSetWorkerCount() {
+	s.Error(s.processor.SetWorkerCount(0))
+
+	s.NoError(s.processor.SetWorkerCount(3))
+	s.processor.Start()
+	s.Len(s.processor.workerShutdownChs, 3)
+
+	s.NoError(s.processor.SetWorkerCount(5))
+	s.Len(s.processor.workerShutdownChs, 5)
+
+	s.NoError(s.processor.SetWorkerCount(2))
+	s.Len(s.processor.workerShutdownChs, 2)
+
+	numTasks := 10
+	var taskWG sync.WaitGroup
+	taskWG.Add(numTasks)
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockTask(s.controller)
+		mockTask.EXPECT().Execute().Return(nil).Times(1)
+		mockTask.EXPECT().Ack().Do(func() { taskWG.Done() }).Times(1)
+		s.NoError(s.processor.Submit(mockTask))
+	}
+	taskWG.Wait()
+
+	s.processor.Stop()
+	s.Equal(ErrTaskProcessorClosed, s.processor.SetWorkerCount(1))
+}
+
+func (s *parallelTaskProcessorSuite) TestIdleWorkerTimeout_ScaleToZeroAndBack() {
+	s.processor.options.IdleWorkerTimeout = 10 * time.Millisecond
+	s.NoError(s.processor.SetWorkerCount(3))
+	s.processor.Start()
+	defer s.processor.Stop()
+
+	s.Eventually(func() bool {
+		return atomic.LoadInt32(&s.processor.liveWorkers) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	numTasks := 10
+	var taskWG sync.WaitGroup
+	taskWG.Add(numTasks)
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockTask(s.controller)
+		mockTask.EXPECT().Execute().Return(nil).Times(1)
+		mockTask.EXPECT().Ack().Do(func() { taskWG.Done() }).Times(1)
+		s.NoError(s.processor.Submit(mockTask))
+		s.True(atomic.LoadInt32(&s.processor.liveWorkers) > 0)
+	}
+	taskWG.Wait()
+
+	s.Eventually(func() bool {
+		return atomic.LoadInt32(&s.processor.liveWorkers) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func (s *parallelTaskProcessorSuite) TestIdleWorkerTimeout_MinWorkerCount() {
+	s.processor.options.IdleWorkerTimeout = 10 * time.Millisecond
+	s.processor.options.MinWorkerCount = 2
+	s.NoError(s.processor.SetWorkerCount(5))
+	s.processor.Start()
+	defer s.processor.Stop()
+
+	s.Eventually(func() bool {
+		return atomic.LoadInt32(&s.processor.liveWorkers) == 2
+	}, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	s.Equal(int32(2), atomic.LoadInt32(&s.processor.liveWorkers))
+}
+
+func (s *parallelTaskProcessorSuite) TestStats() {
+	s.Equal(ProcessorStats{ConfiguredWorkers: 1}, s.processor.Stats())
+
+	mockTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().DoAndReturn(func() error {
+			stats := s.processor.Stats()
+			s.Equal(1, stats.BusyWorkers)
+			s.Zero(stats.RetryingTasks)
+			return errRetryable
+		}),
+		mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		mockTask.EXPECT().RetryErr(errRetryable).Return(true),
+		mockTask.EXPECT().Execute().DoAndReturn(func() error {
+			stats := s.processor.Stats()
+			s.Equal(1, stats.BusyWorkers)
+			s.Equal(1, stats.RetryingTasks)
+			return nil
+		}),
+		mockTask.EXPECT().Ack(),
+	)
+	s.processor.executeTask(mockTask)
+
+	mockTask = NewMockTask(s.controller)
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(errNonRetryable),
+		mockTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable),
+		mockTask.EXPECT().RetryErr(errNonRetryable).Return(false).AnyTimes(),
+		mockTask.EXPECT().Nack(),
+	)
+	s.processor.executeTask(mockTask)
+
+	s.Equal(ProcessorStats{
+		ConfiguredWorkers: 1,
+		SucceededTasks:    1,
+		FailedTasks:       1,
+	}, s.processor.Stats())
+}
+
 func (s *parallelTaskProcessorSuite) TestExecuteTask_RetryableError() {
 	mockTask := NewMockTask(s.controller)
 	gomock.InOrder(
@@ -134,6 +577,276 @@ func (s *parallelTaskProcessorSuite) TestExecuteTask_RetryableError() {
 	s.processor.executeTask(mockTask)
 }
 
+func (s *parallelTaskProcessorSuite) TestExecuteTask_OnTaskAttempt() {
+	var attemptErrs []error
+	s.processor.options.OnTaskAttempt = func(_ Task, err error) {
+		attemptErrs = append(attemptErrs, err)
+	}
+	mockTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(errRetryable),
+		mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		mockTask.EXPECT().RetryErr(errRetryable).Return(true),
+		mockTask.EXPECT().Execute().Return(nil),
+		mockTask.EXPECT().Ack(),
+	)
+
+	s.processor.executeTask(mockTask)
+	s.Equal([]error{errRetryable, nil}, attemptErrs)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_ExecuteHooks() {
+	var events []string
+	var afterErrs []error
+	s.processor.options.BeforeExecute = func(_ PriorityTask) {
+		events = append(events, "before")
+	}
+	s.processor.options.AfterExecute = func(_ PriorityTask, err error, latency time.Duration) {
+		events = append(events, "after")
+		afterErrs = append(afterErrs, err)
+		s.True(latency >= 0)
+	}
+	record := func(event string) func() {
+		return func() { events = append(events, event) }
+	}
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Do(record("execute")).Return(errRetryable),
+		mockTask.EXPECT().HandleErr(errRetryable).Do(func(_ error) { events = append(events, "handle") }).Return(errRetryable),
+		mockTask.EXPECT().RetryErr(errRetryable).Return(true),
+		mockTask.EXPECT().Execute().Do(record("execute")).Return(nil),
+		mockTask.EXPECT().Ack().Do(record("ack")),
+	)
+
+	s.processor.executeTask(mockTask)
+	s.Equal([]string{"before", "execute", "after", "handle", "before", "execute", "after", "ack"}, events)
+	s.Equal([]error{errRetryable, nil}, afterErrs)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_ExecuteHooksPanic() {
+	s.processor.options.BeforeExecute = func(_ PriorityTask) {
+		panic("some random panic")
+	}
+	s.processor.options.AfterExecute = func(_ PriorityTask, _ error, _ time.Duration) {
+		panic("some random panic")
+	}
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(nil),
+		mockTask.EXPECT().Ack(),
+	)
+	s.processor.executeTask(mockTask)
+
+	// hooks are only invoked with PriorityTasks
+	plainTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		plainTask.EXPECT().Execute().Return(nil),
+		plainTask.EXPECT().Ack(),
+	)
+	s.processor.executeTask(plainTask)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_CorrelationID() {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s.processor.logger = loggerimpl.NewLogger(zap.New(core))
+	s.processor.options.SlowTaskThreshold = time.Millisecond
+	s.processor.options.BeforeExecute = func(_ PriorityTask) {
+		panic("some random panic")
+	}
+
+	correlatedTask := &testCorrelatedTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		correlationID:    "some random correlation ID",
+	}
+	correlatedTask.EXPECT().Priority().Return(0).AnyTimes()
+	correlatedTask.EXPECT().Execute().DoAndReturn(func() error {
+		time.Sleep(5 * time.Millisecond)
+		return errNonRetryable
+	}).Times(1)
+	correlatedTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable).Times(1)
+	correlatedTask.EXPECT().RetryErr(errNonRetryable).Return(false).Times(1)
+	correlatedTask.EXPECT().Nack().Times(1)
+	// tasks wrapped by the scheduler are unwrapped
+	s.processor.executeTask(&requeuedTask{taskWrapper: taskWrapper{PriorityTask: correlatedTask}, firstAttemptTime: time.Now()})
+
+	messages := make(map[string]bool)
+	for _, entry := range logs.TakeAll() {
+		messages[entry.Message] = true
+		s.Equal("some random correlation ID", entry.ContextMap()["queue-task-correlation-id"], entry.Message)
+	}
+	s.Equal(map[string]bool{
+		"Task execution hook BeforeExecute panicked.": true,
+		"Task exhausted.":     true,
+		"Slow task detected.": true,
+	}, messages)
+
+	// the correlation ID is omitted for tasks without one
+	uncorrelatedTask := &testCorrelatedTask{MockPriorityTask: NewMockPriorityTask(s.controller)}
+	uncorrelatedTask.EXPECT().Priority().Return(0).AnyTimes()
+	uncorrelatedTask.EXPECT().Execute().Return(errNonRetryable).Times(1)
+	uncorrelatedTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable).Times(1)
+	uncorrelatedTask.EXPECT().RetryErr(errNonRetryable).Return(false).Times(1)
+	uncorrelatedTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(uncorrelatedTask)
+	s.NotZero(logs.Len())
+	for _, entry := range logs.TakeAll() {
+		s.NotContains(entry.ContextMap(), "queue-task-correlation-id")
+	}
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_RetryBackoffMultiplier() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+	s.processor.options.RetryBackoffMultiplier = func(_ Task, _ int) float64 {
+		return 2
+	}
+
+	mockTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(errRetryable),
+		mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		mockTask.EXPECT().RetryErr(errRetryable).Return(true),
+		mockTask.EXPECT().Execute().Return(nil),
+		mockTask.EXPECT().Ack(),
+	)
+	s.processor.executeTask(mockTask)
+
+	var delays []time.Duration
+	for _, timer := range testScope.Snapshot().Timers() {
+		if timer.Name() == "test.prioritytask_retry_backoff" {
+			delays = append(delays, timer.Values()...)
+		}
+	}
+	// the retry policy jitters the interval down by up to 20%
+	s.Len(delays, 1)
+	s.True(delays[0] >= 1600*time.Microsecond && delays[0] <= 2*time.Millisecond)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_TaskRetryPolicy() {
+	retryPolicy := backoff.NewExponentialRetryPolicy(time.Millisecond)
+	retryPolicy.SetMaximumAttempts(5)
+	s.processor.options.RetryPolicy = retryPolicy
+
+	// the policy of the task takes precedence over the processor's
+	taskRetryPolicy := backoff.NewExponentialRetryPolicy(time.Millisecond)
+	taskRetryPolicy.SetMaximumAttempts(1)
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Execute().Return(errRetryable).Times(2)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(2)
+	mockTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	mockTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(&testRetryPolicyTask{MockPriorityTask: mockTask, retryPolicy: taskRetryPolicy})
+
+	// the processor's policy is used if the task has no policy
+	defaultTask := NewMockPriorityTask(s.controller)
+	defaultTask.EXPECT().Priority().Return(0).AnyTimes()
+	defaultTask.EXPECT().Execute().Return(errRetryable).Times(6)
+	defaultTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(6)
+	defaultTask.EXPECT().RetryErr(errRetryable).Return(true).Times(5)
+	defaultTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(&testRetryPolicyTask{MockPriorityTask: defaultTask})
+	s.Equal(int64(2), s.processor.Stats().FailedTasks)
+}
+
+func (s *parallelTaskProcessorSuite) TestSubmit_Batch() {
+	processor := NewParallelTaskProcessor(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:    1,
+			WorkerCount:  1,
+			RetryPolicy:  backoff.NewExponentialRetryPolicy(time.Millisecond),
+			BatchWindow:  time.Hour,
+			MaxBatchSize: 3,
+		},
+	)
+	var doneWG sync.WaitGroup
+	doneWG.Add(3)
+	var batches [][]PriorityTask
+	batchExecute := func(tasks []PriorityTask) []error {
+		batches = append(batches, tasks)
+		return []error{nil, errRetryable, errNonRetryable}
+	}
+	newTask := func() *testBatchableTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		return &testBatchableTask{MockPriorityTask: mockTask, batchKey: "endpoint", batchExecute: batchExecute}
+	}
+	succeededTask := newTask()
+	succeededTask.EXPECT().Ack().Do(doneWG.Done).Times(1)
+	// the retryable task is retried on its own
+	retriedTask := newTask()
+	retriedTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	retriedTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	retriedTask.EXPECT().Execute().Return(nil).Times(1)
+	retriedTask.EXPECT().Ack().Do(doneWG.Done).Times(1)
+	failedTask := newTask()
+	failedTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable).Times(1)
+	failedTask.EXPECT().RetryErr(errNonRetryable).Return(false).Times(1)
+	failedTask.EXPECT().Nack().Do(doneWG.Done).Times(1)
+
+	processor.Start()
+	defer processor.Stop()
+	s.NoError(processor.Submit(succeededTask))
+	s.NoError(processor.Submit(retriedTask))
+	s.Equal(2, processor.Stats().BatchedTasks)
+	s.NoError(processor.Submit(failedTask))
+	doneWG.Wait()
+
+	s.Equal([][]PriorityTask{{succeededTask, retriedTask, failedTask}}, batches)
+	s.Zero(processor.Stats().BatchedTasks)
+	s.Equal(int64(2), processor.Stats().SucceededTasks)
+	s.Equal(int64(1), processor.Stats().FailedTasks)
+}
+
+func (s *parallelTaskProcessorSuite) TestSubmit_BatchWindow() {
+	processor := NewParallelTaskProcessor(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:   1,
+			WorkerCount: 1,
+			RetryPolicy: backoff.NewExponentialRetryPolicy(time.Millisecond),
+			BatchWindow: 10 * time.Millisecond,
+		},
+	)
+	var doneWG sync.WaitGroup
+	doneWG.Add(4)
+	batchCh := make(chan []PriorityTask, 1)
+	newTask := func(batchKey string) *testBatchableTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		mockTask.EXPECT().Ack().Do(doneWG.Done).Times(1)
+		return &testBatchableTask{
+			MockPriorityTask: mockTask,
+			batchKey:         batchKey,
+			batchExecute: func(tasks []PriorityTask) []error {
+				batchCh <- tasks
+				return make([]error, len(tasks))
+			},
+		}
+	}
+	batchedTasks := []*testBatchableTask{newTask("endpoint"), newTask("endpoint")}
+	// tasks alone in their batch or without a batch key are executed on their own
+	singleTask := newTask("other endpoint")
+	singleTask.EXPECT().Execute().Return(nil).Times(1)
+	unbatchedTask := newTask("")
+	unbatchedTask.EXPECT().Execute().Return(nil).Times(1)
+
+	processor.Start()
+	defer processor.Stop()
+	for _, task := range []PriorityTask{batchedTasks[0], singleTask, batchedTasks[1], unbatchedTask} {
+		s.NoError(processor.Submit(task))
+	}
+	doneWG.Wait()
+	s.Equal([]PriorityTask{batchedTasks[0], batchedTasks[1]}, <-batchCh)
+}
+
 func (s *parallelTaskProcessorSuite) TestExecuteTask_NonRetryableError() {
 	mockTask := NewMockTask(s.controller)
 	gomock.InOrder(
@@ -146,6 +859,281 @@ func (s *parallelTaskProcessorSuite) TestExecuteTask_NonRetryableError() {
 	s.processor.executeTask(mockTask)
 }
 
+func (s *parallelTaskProcessorSuite) TestExecuteTask_RetryBudgetExhausted() {
+	var exhaustedErr error
+	s.processor.options.OnTaskExhausted = func(task Task, err error) {
+		exhaustedErr = err
+	}
+	s.processor.retryLimiter = quotas.NewSimpleRateLimiter(1)
+	s.True(s.processor.retryLimiter.Allow()) // consume the budget
+
+	mockTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(errRetryable),
+		mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		mockTask.EXPECT().RetryErr(errRetryable).Return(true),
+	)
+
+	s.processor.executeTask(mockTask)
+	s.Equal(errRetryable, exhaustedErr)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_GlobalMaxRetries() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+	var exhaustedErr error
+	s.processor.options.OnTaskExhausted = func(task Task, err error) {
+		exhaustedErr = err
+	}
+	s.Error(s.processor.SetGlobalMaxRetries(-1))
+	s.NoError(s.processor.SetGlobalMaxRetries(1))
+
+	// the second retry exceeds the cap
+	exhaustedTask := NewMockTask(s.controller)
+	exhaustedTask.EXPECT().Execute().Return(errRetryable).Times(2)
+	exhaustedTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(2)
+	exhaustedTask.EXPECT().RetryErr(errRetryable).Return(true).Times(2)
+	s.processor.executeTask(exhaustedTask)
+	s.Equal(errRetryable, exhaustedErr)
+	numExhausted := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_global_retries_exhausted" {
+			numExhausted += counter.Value()
+		}
+	}
+	s.Equal(int64(1), numExhausted)
+
+	// updating the cap restarts the count
+	s.NoError(s.processor.SetGlobalMaxRetries(1))
+	retriedTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		retriedTask.EXPECT().Execute().Return(errRetryable),
+		retriedTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		retriedTask.EXPECT().RetryErr(errRetryable).Return(true),
+		retriedTask.EXPECT().Execute().Return(nil),
+		retriedTask.EXPECT().Ack(),
+	)
+	s.processor.executeTask(retriedTask)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_Outcomes() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+	retryPolicy := backoff.NewExponentialRetryPolicy(time.Millisecond)
+	retryPolicy.SetMaximumAttempts(2)
+	s.processor.options.RetryPolicy = retryPolicy
+
+	succeededTask := NewMockTask(s.controller)
+	succeededTask.EXPECT().Execute().Return(nil).Times(1)
+	succeededTask.EXPECT().Ack().Times(1)
+	s.processor.executeTask(succeededTask)
+
+	failedTask := NewMockTask(s.controller)
+	failedTask.EXPECT().Execute().Return(errNonRetryable).Times(1)
+	failedTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable).Times(1)
+	failedTask.EXPECT().RetryErr(errNonRetryable).Return(false).Times(1)
+	failedTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(failedTask)
+
+	timedOutTask := NewMockTask(s.controller)
+	timedOutTask.EXPECT().Execute().Return(context.DeadlineExceeded).Times(1)
+	timedOutTask.EXPECT().HandleErr(context.DeadlineExceeded).Return(context.DeadlineExceeded).Times(1)
+	timedOutTask.EXPECT().RetryErr(context.DeadlineExceeded).Return(false).Times(1)
+	timedOutTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(timedOutTask)
+
+	expiredTask := NewMockTask(s.controller)
+	expiredTask.EXPECT().Execute().Return(errRetryable).Times(3)
+	expiredTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(3)
+	expiredTask.EXPECT().RetryErr(errRetryable).Return(true).Times(2)
+	expiredTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(expiredTask)
+
+	s.processor.retryLimiter = quotas.NewSimpleRateLimiter(1)
+	s.True(s.processor.retryLimiter.Allow()) // consume the budget
+	exhaustedTask := NewMockTask(s.controller)
+	exhaustedTask.EXPECT().Execute().Return(errRetryable).Times(1)
+	exhaustedTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	exhaustedTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	exhaustedTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(exhaustedTask)
+
+	outcomes := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_outcomes" {
+			outcomes[counter.Tags()["task_outcome"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{
+		taskOutcomeSuccess:          1,
+		taskOutcomePermanentFailure: 1,
+		taskOutcomeTimeout:          1,
+		taskOutcomeExpired:          1,
+		taskOutcomeRetryableFailure: 1,
+	}, outcomes)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_NewTaskReservedFraction() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+	s.processor.workerCount = 4
+	s.processor.options.NewTaskReservedFraction = 0.3
+
+	// two workers are reserved for new tasks, and the other two are already retrying
+	atomic.StoreInt32(&s.processor.retryingWorkers, 2)
+	deniedTask := NewMockTask(s.controller)
+	deniedTask.EXPECT().Execute().Return(errRetryable).Times(1)
+	deniedTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	deniedTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	deniedTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(deniedTask)
+	numExhausted := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_retry_capacity_exhausted" {
+			numExhausted += counter.Value()
+		}
+	}
+	s.Equal(int64(1), numExhausted)
+
+	// the task is retried in place once a worker stops retrying
+	atomic.StoreInt32(&s.processor.retryingWorkers, 1)
+	retriedTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		retriedTask.EXPECT().Execute().Return(errRetryable).Times(1),
+		retriedTask.EXPECT().Execute().Return(errRetryable).Times(1),
+		retriedTask.EXPECT().Execute().Return(nil).Times(1),
+	)
+	retriedTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(2)
+	retriedTask.EXPECT().RetryErr(errRetryable).Return(true).Times(2)
+	retriedTask.EXPECT().Ack().Times(1)
+	s.processor.executeTask(retriedTask)
+	s.Equal(int32(1), atomic.LoadInt32(&s.processor.retryingWorkers))
+
+	gauges := make(map[string]float64)
+	for _, gauge := range testScope.Snapshot().Gauges() {
+		gauges[gauge.Name()] = gauge.Value()
+	}
+	s.Equal(float64(1), gauges["test.paralleltask_retrying_worker_count"])
+	s.Equal(float64(0), gauges["test.paralleltask_new_task_worker_count"])
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_SlowTask() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+	s.processor.options.SlowTaskThreshold = 10 * time.Millisecond
+
+	fastTask := NewMockTask(s.controller)
+	fastTask.EXPECT().Execute().Return(nil).Times(1)
+	fastTask.EXPECT().Ack().Times(1)
+	s.processor.executeTask(fastTask)
+
+	slowTask := NewMockPriorityTask(s.controller)
+	slowTask.EXPECT().Priority().Return(1).Times(1)
+	slowTask.EXPECT().Execute().DoAndReturn(func() error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}).Times(1)
+	slowTask.EXPECT().Ack().Times(1)
+	s.processor.executeTask(slowTask)
+
+	snapshot := testScope.Snapshot()
+	numSlowTasks := int64(0)
+	for _, counter := range snapshot.Counters() {
+		if counter.Name() == "test.prioritytask_slow" {
+			s.Equal("1", counter.Tags()["task_priority"])
+			numSlowTasks += counter.Value()
+		}
+	}
+	s.Equal(int64(1), numSlowTasks)
+	numLatencies := 0
+	for _, timer := range snapshot.Timers() {
+		if timer.Name() == "test.paralleltask_task_processing_latency" {
+			numLatencies++
+		}
+	}
+	s.Equal(2, numLatencies)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_RetryAttempts() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+
+	succeededTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		succeededTask.EXPECT().Execute().Return(errRetryable),
+		succeededTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		succeededTask.EXPECT().RetryErr(errRetryable).Return(true),
+		succeededTask.EXPECT().Execute().Return(nil),
+		succeededTask.EXPECT().Ack(),
+	)
+	s.processor.executeTask(succeededTask)
+
+	failedTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		failedTask.EXPECT().Execute().Return(errNonRetryable),
+		failedTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable),
+		failedTask.EXPECT().RetryErr(errNonRetryable).Return(false),
+		failedTask.EXPECT().Nack(),
+	)
+	s.processor.executeTask(failedTask)
+
+	attempts := make(map[string]map[float64]int64)
+	for _, histogram := range testScope.Snapshot().Histograms() {
+		if histogram.Name() != "test.prioritytask_retry_attempts" {
+			continue
+		}
+		outcome := histogram.Tags()["task_outcome"]
+		attempts[outcome] = make(map[float64]int64)
+		for upperBound, count := range histogram.Values() {
+			if count != 0 {
+				attempts[outcome][upperBound] = count
+			}
+		}
+	}
+	s.Equal(map[string]map[float64]int64{
+		taskOutcomeSuccess:   {2: 1},
+		taskOutcomeExhausted: {1: 1},
+	}, attempts)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_AttemptMetrics() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+
+	mockTask := NewMockTask(s.controller)
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(errRetryable),
+		mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		mockTask.EXPECT().RetryErr(errRetryable).Return(true),
+		mockTask.EXPECT().Execute().Return(errRetryable),
+		mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		mockTask.EXPECT().RetryErr(errRetryable).Return(true),
+		mockTask.EXPECT().Execute().Return(nil),
+		mockTask.EXPECT().Ack(),
+	)
+	s.processor.executeTask(mockTask)
+
+	executions := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_attempts" {
+			executions[counter.Tags()["attempt"]+","+counter.Tags()["task_outcome"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{
+		"first,failure": 1,
+		"retry,failure": 1,
+		"retry,success": 1,
+	}, executions)
+
+	latencies := make(map[string]int)
+	for _, timer := range testScope.Snapshot().Timers() {
+		if timer.Name() == "test.prioritytask_attempt_latency" {
+			latencies[timer.Tags()["attempt"]] += len(timer.Values())
+		}
+	}
+	s.Equal(map[string]int{taskAttemptFirst: 1, taskAttemptRetry: 2}, latencies)
+}
+
 func (s *parallelTaskProcessorSuite) TestExecuteTask_ProcessorStopped() {
 	mockTask := NewMockTask(s.controller)
 	mockTask.EXPECT().Execute().Return(errRetryable).AnyTimes()
@@ -162,3 +1150,365 @@ func (s *parallelTaskProcessorSuite) TestExecuteTask_ProcessorStopped() {
 	atomic.StoreInt32(&s.processor.status, common.DaemonStatusStopped)
 	<-done
 }
+
+func (s *parallelTaskProcessorSuite) TestStop_ContextAwareTask() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().HandleErr(context.Canceled).Return(context.Canceled).Times(1)
+	executingCh := make(chan struct{})
+	task := &testContextAwareTask{
+		MockPriorityTask: mockTask,
+		executeFn: func(ctx context.Context) error {
+			close(executingCh)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	s.processor.Start()
+	s.NoError(s.processor.Submit(task))
+	<-executingCh
+	s.processor.Stop()
+	s.Equal(0, s.processor.Stats().BusyWorkers)
+}
+
+func (s *parallelTaskProcessorSuite) TestStop_FutureTask() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().HandleErr(context.Canceled).Return(context.Canceled).Times(1)
+	executingCh := make(chan struct{})
+	task := &testContextAwareTask{
+		MockPriorityTask: mockTask,
+		executeFn: func(ctx context.Context) error {
+			close(executingCh)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Second):
+				return errors.New("task is not cancelled on processor shutdown")
+			}
+		},
+	}
+
+	// the processor context reaches the task through the future wrapper
+	s.processor.Start()
+	s.NoError(s.processor.Submit(newFutureTask(task)))
+	<-executingCh
+	s.processor.Stop()
+	s.Equal(0, s.processor.Stats().BusyWorkers)
+}
+
+func (s *parallelTaskProcessorSuite) TestDeferredAck() {
+	processor := NewParallelTaskProcessor(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:   1,
+			WorkerCount: 1,
+			RetryPolicy: backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DeferredAck: true,
+		},
+	).(*parallelTaskProcessorImpl)
+	newDeferredTask := func(handles chan<- TaskHandle) *testContextAwareTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		return &testContextAwareTask{
+			MockPriorityTask: mockTask,
+			executeFn: func(ctx context.Context) error {
+				handle, ok := TaskHandleFromContext(ctx)
+				s.True(ok)
+				handles <- handle
+				return ErrTaskPending
+			},
+		}
+	}
+
+	// the task is left pending without occupying the worker
+	handles := make(chan TaskHandle, 2)
+	ackedTask := newDeferredTask(handles)
+	processor.executeTask(ackedTask)
+	nackedTask := newDeferredTask(handles)
+	processor.executeTask(nackedTask)
+	s.Equal(2, processor.Stats().PendingTasks)
+	s.Zero(processor.Stats().BusyWorkers)
+
+	processor.Start()
+	defer processor.Stop()
+	ackedTask.MockPriorityTask.EXPECT().Ack()
+	s.NoError(processor.Complete(<-handles, nil))
+	nackedTask.MockPriorityTask.EXPECT().Nack()
+	handle := <-handles
+	s.NoError(processor.Complete(handle, errNonRetryable))
+	s.Equal(ErrUnknownTaskHandle, processor.Complete(handle, nil))
+
+	// tasks completed before the execution returns are finalized once it returns
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Ack()
+	processor.executeTask(&testContextAwareTask{
+		MockPriorityTask: mockTask,
+		executeFn: func(ctx context.Context) error {
+			handle, _ := TaskHandleFromContext(ctx)
+			s.NoError(processor.Complete(handle, nil))
+			return ErrTaskPending
+		},
+	})
+
+	stats := processor.Stats()
+	s.Zero(stats.PendingTasks)
+	s.Equal(int64(2), stats.SucceededTasks)
+	s.Equal(int64(1), stats.FailedTasks)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteContext() {
+	type contextKey struct{}
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().HandleErr(context.Canceled).Return(context.Canceled).Times(1)
+	executingCh := make(chan struct{})
+	var contextValue interface{}
+	task := &testContextAwareTask{
+		MockPriorityTask: mockTask,
+		executeFn: func(ctx context.Context) error {
+			contextValue = ctx.Value(contextKey{})
+			close(executingCh)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	s.processor.options.ExecuteContext = func(task PriorityTask) context.Context {
+		return context.WithValue(context.Background(), contextKey{}, task)
+	}
+
+	// the derived context is cancelled on Stop as well
+	s.processor.Start()
+	s.NoError(s.processor.Submit(task))
+	<-executingCh
+	s.processor.Stop()
+	s.Equal(task, contextValue)
+	s.Equal(0, s.processor.Stats().BusyWorkers)
+}
+
+func (s *parallelTaskProcessorSuite) TestStop_ShutdownTimeout() {
+	var timedOutTasks []Task
+	s.processor.options.ShutdownTimeout = 10 * time.Millisecond
+	s.processor.options.OnShutdownTimeout = func(task Task) {
+		timedOutTasks = append(timedOutTasks, task)
+	}
+
+	// Ack or Nack must not be called after the task is handed off
+	mockTask := NewMockTask(s.controller)
+	executingCh := make(chan struct{})
+	blockCh := make(chan struct{})
+	mockTask.EXPECT().Execute().DoAndReturn(func() error {
+		close(executingCh)
+		<-blockCh
+		return nil
+	}).Times(1)
+
+	s.processor.Start()
+	s.NoError(s.processor.Submit(mockTask))
+	<-executingCh
+	s.processor.Stop()
+	s.Equal([]Task{mockTask}, timedOutTasks)
+
+	close(blockCh)
+	s.True(common.AwaitWaitGroup(&s.processor.workerWG, time.Second))
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_RequeueRetry() {
+	var requeuedRetries []int
+	s.processor.options.RequeueRetry = func(task PriorityTask, retries int, firstAttemptTime time.Time) bool {
+		requeuedRetries = append(requeuedRetries, retries)
+		return true
+	}
+
+	// Ack or Nack must not be called once the task is requeued
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Execute().Return(errRetryable).Times(1)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	mockTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	s.processor.executeTask(mockTask)
+	s.Equal([]int{1}, requeuedRetries)
+
+	// retry state is carried across requeues
+	requeued := &requeuedTask{taskWrapper: taskWrapper{PriorityTask: mockTask}, retries: 2, firstAttemptTime: time.Now()}
+	mockTask.EXPECT().Execute().Return(errRetryable).Times(1)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	mockTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	s.processor.executeTask(requeued)
+	s.Equal([]int{1, 3}, requeuedRetries)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_Yield() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+	var yieldedRetries []int
+	s.processor.options.OnYield = func(task PriorityTask, retries int, firstAttemptTime time.Time) bool {
+		yieldedRetries = append(yieldedRetries, retries)
+		return true
+	}
+
+	// Ack or Nack must not be called once the task yields
+	task := &testContextAwareTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		executeFn: func(ctx context.Context) error {
+			return ErrTaskYielded
+		},
+	}
+	task.EXPECT().Priority().Return(0).AnyTimes()
+	s.processor.executeTask(task)
+	s.Equal([]int{0}, yieldedRetries)
+
+	// retry state is carried across yields
+	s.processor.executeTask(&requeuedTask{taskWrapper: taskWrapper{PriorityTask: task}, retries: 2, firstAttemptTime: time.Now()})
+	s.Equal([]int{0, 2}, yieldedRetries)
+	numYielded := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_yielded" {
+			numYielded += counter.Value()
+		}
+	}
+	s.Equal(int64(2), numYielded)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_Yield_Rejected() {
+	s.processor.options.OnYield = func(task PriorityTask, retries int, firstAttemptTime time.Time) bool {
+		return false
+	}
+
+	// the yield is handled as an error if the task isn't taken over
+	task := &testContextAwareTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		executeFn: func(ctx context.Context) error {
+			return ErrTaskYielded
+		},
+	}
+	task.EXPECT().Priority().Return(0).AnyTimes()
+	task.EXPECT().HandleErr(ErrTaskYielded).Return(ErrTaskYielded).Times(1)
+	task.EXPECT().RetryErr(ErrTaskYielded).Return(false).Times(1)
+	task.EXPECT().Nack().Times(1)
+	s.processor.executeTask(task)
+	s.Equal(int64(1), s.processor.Stats().FailedTasks)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_RequeueRetry_Exhausted() {
+	retryPolicy := backoff.NewExponentialRetryPolicy(time.Millisecond)
+	retryPolicy.SetMaximumAttempts(3)
+	s.processor.options.RetryPolicy = retryPolicy
+	s.processor.options.RequeueRetry = func(task PriorityTask, retries int, firstAttemptTime time.Time) bool {
+		s.Fail("task should not be requeued after exhausting retries")
+		return true
+	}
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Execute().Return(errRetryable).Times(1)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	mockTask.EXPECT().Nack().Times(1)
+	s.processor.executeTask(&requeuedTask{taskWrapper: taskWrapper{PriorityTask: mockTask}, retries: 3, firstAttemptTime: time.Now()})
+	s.Equal(int64(1), s.processor.Stats().FailedTasks)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_RequeueRetry_Rejected() {
+	numRequeueAttempts := 0
+	s.processor.options.RequeueRetry = func(task PriorityTask, retries int, firstAttemptTime time.Time) bool {
+		numRequeueAttempts++
+		return false
+	}
+
+	// task is retried in place if it can't be requeued
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(errRetryable).Times(1),
+		mockTask.EXPECT().Execute().Return(nil).Times(1),
+	)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	mockTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	mockTask.EXPECT().Ack().Times(1)
+	s.processor.executeTask(mockTask)
+	s.Equal(1, numRequeueAttempts)
+}
+
+func (s *parallelTaskProcessorSuite) TestExecuteTask_RequeueRetry_MaxRequeues() {
+	testScope := tally.NewTestScope("test", nil)
+	s.processor.metricsScope = metrics.NewClient(testScope, metrics.Common).Scope(metrics.ParallelTaskProcessingScope)
+	s.processor.options.MaxRequeues = 2
+	s.processor.options.RequeueRetry = func(task PriorityTask, retries int, firstAttemptTime time.Time) bool {
+		s.Fail("task should not be requeued after reaching max requeues")
+		return true
+	}
+	var exhaustedErr error
+	s.processor.options.OnTaskExhausted = func(task Task, err error) {
+		exhaustedErr = err
+	}
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Execute().Return(errRetryable).Times(1)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	mockTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	s.processor.executeTask(&requeuedTask{taskWrapper: taskWrapper{PriorityTask: mockTask}, retries: 2, requeues: 2, firstAttemptTime: time.Now()})
+	s.Equal(errRetryable, exhaustedErr)
+	s.Equal(int64(1), s.processor.Stats().FailedTasks)
+	numLoopsBroken := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_resubmit_loop_broken" {
+			s.Equal("0", counter.Tags()["task_priority"])
+			numLoopsBroken += counter.Value()
+		}
+	}
+	s.Equal(int64(1), numLoopsBroken)
+}
+
+func BenchmarkParallelTaskProcessor_SkewedTasks(b *testing.B) {
+	for _, workStealing := range []bool{false, true} {
+		b.Run(fmt.Sprintf("WorkStealing-%v", workStealing), func(b *testing.B) {
+			processor := NewParallelTaskProcessor(
+				loggerimpl.NewNopLogger(),
+				metrics.NewClient(tally.NoopScope, metrics.Common),
+				&ParallelTaskProcessorOptions{
+					QueueSize:    64,
+					WorkerCount:  8,
+					RetryPolicy:  backoff.NewExponentialRetryPolicy(time.Millisecond),
+					WorkStealing: workStealing,
+				},
+			)
+			processor.Start()
+			defer processor.Stop()
+
+			// one in every 64 tasks is slow, the rest complete immediately
+			var taskWG sync.WaitGroup
+			taskWG.Add(b.N)
+			b.ResetTimer()
+			for i := 0; i != b.N; i++ {
+				task := &benchmarkPriorityTask{waitGroup: &taskWG}
+				if i%64 == 0 {
+					task.executionTime = time.Millisecond
+				}
+				if err := processor.Submit(task); err != nil {
+					b.Fatal(err)
+				}
+			}
+			taskWG.Wait()
+		})
+	}
+}
+
+func (t *testCorrelatedTask) CorrelationID() string {
+	return t.correlationID
+}
+
+func (t *testRetryPolicyTask) RetryPolicy() backoff.RetryPolicy {
+	return t.retryPolicy
+}
+
+func (t *testBatchableTask) BatchKey() string {
+	return t.batchKey
+}
+
+func (t *testBatchableTask) BatchExecute(tasks []PriorityTask) []error {
+	return t.batchExecute(tasks)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"sync"
+
+	farm "github.com/dgryski/go-farm"
+
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// PartitionedSchedulerOptions configs the partitioned scheduler
+	PartitionedSchedulerOptions struct {
+		// PartitionCount is the number of partitions, each with its own queues and dispatchers
+		PartitionCount int
+		// SchedulerOptions are the options of the WRR task scheduler of each partition. Each partition
+		// has WorkerCount workers of its own, unless WorkerPool is specified to share its workers
+		SchedulerOptions *WeightedRoundRobinTaskSchedulerOptions
+	}
+
+	// PartitionedScheduler is a scheduler which spreads tasks across independent WRR task schedulers
+	PartitionedScheduler interface {
+		Scheduler
+		// Partition returns the partition tasks with the given key are submitted to
+		Partition(key string) int
+		// PartitionStats returns the stats of the scheduler of each partition, indexed by partition
+		PartitionStats() []WeightedRoundRobinTaskSchedulerStats
+	}
+
+	// partitionedScheduler routes PartitionedTasks to the partitions by the hash of their keys
+	partitionedScheduler struct {
+		partitions []WeightedRoundRobinTaskScheduler
+	}
+)
+
+var _ PartitionedScheduler = (*partitionedScheduler)(nil)
+
+var (
+	// ErrNotPartitionedTask is the error returned when submitting a task not implementing PartitionedTask
+	ErrNotPartitionedTask = errors.New("task does not implement PartitionedTask")
+)
+
+// NewPartitionedScheduler creates a scheduler which routes each PartitionedTask to one of the partitions by the
+// hash of its PartitionKey. Partitions are WRR task schedulers created with the same options, each with its own
+// queues and dispatchers, so submissions and dispatches of different partitions don't contend with each other.
+// Weights apply within each partition. Tasks with the same key always go to the same partition, so they're
+// dispatched in the order they're submitted as long as the scheduler of a partition preserves the order, e.g.
+// for tasks of the same priority. Metrics of each partition are tagged with the partition
+func NewPartitionedScheduler(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	options *PartitionedSchedulerOptions,
+) (PartitionedScheduler, error) {
+	if options.PartitionCount <= 0 {
+		return nil, errors.New("partition count must be positive")
+	}
+	if options.SchedulerOptions == nil {
+		return nil, errors.New("scheduler options are not specified")
+	}
+
+	partitions := make([]WeightedRoundRobinTaskScheduler, 0, options.PartitionCount)
+	for partition := 0; partition != options.PartitionCount; partition++ {
+		schedulerOptions := *options.SchedulerOptions
+		scheduler, err := NewWeightedRoundRobinTaskScheduler(
+			logger.WithTags(tag.TaskPartition(partition)),
+			metricsClient,
+			&schedulerOptions,
+		)
+		if err != nil {
+			return nil, err
+		}
+		scheduler.SetMetricsScope(metricsClient.Scope(metrics.TaskSchedulerScope, metrics.TaskPartitionTag(partition)))
+		partitions = append(partitions, scheduler)
+	}
+	return &partitionedScheduler{
+		partitions: partitions,
+	}, nil
+}
+
+func (s *partitionedScheduler) Start() {
+	for _, scheduler := range s.partitions {
+		scheduler.Start()
+	}
+}
+
+// Stop stops the partitions concurrently, so that each of them
+// waits for its dispatchers at the same time as the others
+func (s *partitionedScheduler) Stop() {
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(len(s.partitions))
+	for _, scheduler := range s.partitions {
+		go func(scheduler WeightedRoundRobinTaskScheduler) {
+			defer waitGroup.Done()
+			scheduler.Stop()
+		}(scheduler)
+	}
+	waitGroup.Wait()
+}
+
+func (s *partitionedScheduler) Submit(
+	task PriorityTask,
+) error {
+	scheduler, err := s.getPartition(task)
+	if err != nil {
+		return err
+	}
+	return scheduler.Submit(task)
+}
+
+func (s *partitionedScheduler) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	scheduler, err := s.getPartition(task)
+	if err != nil {
+		return false, err
+	}
+	return scheduler.TrySubmit(task)
+}
+
+func (s *partitionedScheduler) Partition(
+	key string,
+) int {
+	return int(farm.Fingerprint32([]byte(key)) % uint32(len(s.partitions)))
+}
+
+func (s *partitionedScheduler) PartitionStats() []WeightedRoundRobinTaskSchedulerStats {
+	stats := make([]WeightedRoundRobinTaskSchedulerStats, 0, len(s.partitions))
+	for _, scheduler := range s.partitions {
+		stats = append(stats, scheduler.Stats())
+	}
+	return stats
+}
+
+func (s *partitionedScheduler) getPartition(
+	task PriorityTask,
+) (WeightedRoundRobinTaskScheduler, error) {
+	partitionedTask, ok := task.(PartitionedTask)
+	if !ok {
+		return nil, ErrNotPartitionedTask
+	}
+	return s.partitions[s.Partition(partitionedTask.PartitionKey())], nil
+}
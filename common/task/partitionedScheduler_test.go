@@ -0,0 +1,143 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+func TestPartitionedScheduler(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	logger, err := loggerimpl.NewDevelopment()
+	require.NoError(t, err)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler, err := NewPartitionedScheduler(
+		logger,
+		metrics.NewClient(testScope, metrics.Common),
+		&PartitionedSchedulerOptions{
+			PartitionCount: 4,
+			SchedulerOptions: &WeightedRoundRobinTaskSchedulerOptions{
+				Weights:         testSchedulerWeights,
+				QueueSize:       10,
+				WorkerCount:     1,
+				DispatcherCount: 1,
+				RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+				// tasks are kept in the queues as the scheduler is not started
+				AllowSubmitBeforeStart: true,
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	newPartitionedTask := func(key string) *MockPartitionedTask {
+		mockTask := NewMockPartitionedTask(controller)
+		mockTask.EXPECT().PartitionKey().Return(key).AnyTimes()
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		// queued tasks may be executed once the scheduler is started
+		mockTask.EXPECT().Execute().Return(nil).AnyTimes()
+		mockTask.EXPECT().Ack().AnyTimes()
+		return mockTask
+	}
+
+	expectedQueuedTasks := make([]int, 4)
+	for _, key := range []string{"a", "b", "c", "d", "e", "a", "a", "f"} {
+		partition := scheduler.Partition(key)
+		require.True(t, partition >= 0 && partition < 4)
+		expectedQueuedTasks[partition]++
+		if key == "f" {
+			submitted, err := scheduler.TrySubmit(newPartitionedTask(key))
+			require.NoError(t, err)
+			require.True(t, submitted)
+		} else {
+			require.NoError(t, scheduler.Submit(newPartitionedTask(key)))
+		}
+	}
+	// tasks with the same key are always submitted to the same partition
+	require.Equal(t, scheduler.Partition("a"), scheduler.Partition("a"))
+
+	stats := scheduler.PartitionStats()
+	require.Len(t, stats, 4)
+	numSubmitted := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_submit_request" {
+			numSubmitted[counter.Tags()["task_partition"]] += counter.Value()
+		}
+	}
+	for partition, partitionStats := range stats {
+		require.Equal(t, expectedQueuedTasks[partition], partitionStats.QueuedTasks[1])
+		if expectedQueuedTasks[partition] != 0 {
+			require.Equal(t, int64(expectedQueuedTasks[partition]), numSubmitted[strconv.Itoa(partition)])
+		}
+	}
+
+	mockTask := NewMockPriorityTask(controller)
+	require.Equal(t, ErrNotPartitionedTask, scheduler.Submit(mockTask))
+	_, err = scheduler.TrySubmit(mockTask)
+	require.Equal(t, ErrNotPartitionedTask, err)
+
+	scheduler.Start()
+	scheduler.Stop()
+}
+
+func TestNewPartitionedScheduler_InvalidOptions(t *testing.T) {
+	logger, err := loggerimpl.NewDevelopment()
+	require.NoError(t, err)
+	for _, options := range []*PartitionedSchedulerOptions{
+		{
+			PartitionCount: 0,
+			SchedulerOptions: &WeightedRoundRobinTaskSchedulerOptions{
+				Weights:         testSchedulerWeights,
+				QueueSize:       10,
+				WorkerCount:     1,
+				DispatcherCount: 1,
+				RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			},
+		},
+		{
+			PartitionCount: 2,
+		},
+		{
+			PartitionCount: 2,
+			SchedulerOptions: &WeightedRoundRobinTaskSchedulerOptions{
+				Weights:         testSchedulerWeights,
+				QueueSize:       10,
+				WorkerCount:     1,
+				DispatcherCount: -1,
+				RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			},
+		},
+	} {
+		_, err := NewPartitionedScheduler(logger, metrics.NewClient(tally.NoopScope, metrics.Common), options)
+		require.Error(t, err)
+	}
+}
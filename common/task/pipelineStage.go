@@ -0,0 +1,265 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type (
+	// PipelineFunc processes an item read by PipelineStage and returns its result
+	PipelineFunc func(ctx context.Context, item interface{}) (interface{}, error)
+
+	// PipelineResult is the outcome of processing an item read by PipelineStage
+	PipelineResult struct {
+		Item   interface{}
+		Result interface{}
+		// Err is the error returned by the PipelineFunc, or encountered
+		// when submitting and processing the task of the item
+		Err error
+	}
+
+	// PipelineStage is a stage of a streaming pipeline backed by a scheduler, it reads items from an
+	// input channel, submits a task with the priority returned by priorityFn for each item to process
+	// it, and writes the results to an output channel. The concurrency is bounded by the scheduler's
+	// workers, and failed tasks are not retried
+	PipelineStage struct {
+		scheduler     Scheduler
+		priorityFn    func(item interface{}) int
+		process       PipelineFunc
+		preserveOrder bool
+	}
+
+	// pipelineTask processes a single item for PipelineStage
+	pipelineTask struct {
+		ctx      context.Context
+		process  PipelineFunc
+		item     interface{}
+		priority int
+		state    int32
+		result   interface{}
+		err      error
+		resultCh chan<- PipelineResult
+	}
+)
+
+const (
+	// pipelineStageMaxPendingResults bounds the number of items read but whose results
+	// are not yet written to the output channel, so that a slow consumer, or a slow item
+	// when the order is preserved, stops the stage from reading more items
+	pipelineStageMaxPendingResults = 1024
+)
+
+var _ PriorityTask = (*pipelineTask)(nil)
+
+// NewPipelineStage creates a new PipelineStage. If preserveOrder is true, results are written in the
+// order the items are read, otherwise they're written as soon as the items are processed
+func NewPipelineStage(
+	scheduler Scheduler,
+	priorityFn func(item interface{}) int,
+	process PipelineFunc,
+	preserveOrder bool,
+) *PipelineStage {
+	return &PipelineStage{
+		scheduler:     scheduler,
+		priorityFn:    priorityFn,
+		process:       process,
+		preserveOrder: preserveOrder,
+	}
+}
+
+// Run reads items from in, items are passed as interface{} as the module can't use type parameters,
+// and returns the channel the results are written to. The output channel is closed once in is closed
+// and the results of all the items are written. If ctx is done, reading stops and the output channel is closed without waiting for the
+// remaining results, the context passed to the PipelineFunc is cancelled as well
+func (p *PipelineStage) Run(
+	ctx context.Context,
+	in <-chan interface{},
+) <-chan PipelineResult {
+	out := make(chan PipelineResult)
+	pendingCh := make(chan struct{}, pipelineStageMaxPendingResults)
+	if p.preserveOrder {
+		// the result of each item is written to its own channel, which are consumed in order
+		orderedCh := make(chan chan PipelineResult, pipelineStageMaxPendingResults)
+		go func() {
+			p.readLoop(ctx, in, pendingCh, func() chan<- PipelineResult {
+				resultCh := make(chan PipelineResult, 1)
+				orderedCh <- resultCh
+				return resultCh
+			})
+			close(orderedCh)
+		}()
+		go func() {
+			defer close(out)
+			for resultCh := range orderedCh {
+				select {
+				case result := <-resultCh:
+					if !writeResult(ctx, out, pendingCh, result) {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+
+	resultCh := make(chan PipelineResult, pipelineStageMaxPendingResults)
+	readDoneCh := make(chan struct{})
+	numItems := 0
+	go func() {
+		numItems = p.readLoop(ctx, in, pendingCh, func() chan<- PipelineResult {
+			return resultCh
+		})
+		close(readDoneCh)
+	}()
+	go func() {
+		defer close(out)
+		numResults := 0
+		for readDoneCh != nil || numResults != numItems {
+			select {
+			case result := <-resultCh:
+				if !writeResult(ctx, out, pendingCh, result) {
+					return
+				}
+				numResults++
+			case <-readDoneCh:
+				// numItems is final once reading is done
+				readDoneCh = nil
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// readLoop reads items until in is closed or ctx is done, and returns the number of items
+// read. newResultCh returns the channel the result of the next item is written to
+func (p *PipelineStage) readLoop(
+	ctx context.Context,
+	in <-chan interface{},
+	pendingCh chan struct{},
+	newResultCh func() chan<- PipelineResult,
+) int {
+	numItems := 0
+	for {
+		select {
+		case pendingCh <- struct{}{}:
+		case <-ctx.Done():
+			return numItems
+		}
+		var item interface{}
+		select {
+		case received, ok := <-in:
+			if !ok {
+				// in is closed
+				return numItems
+			}
+			item = received
+		case <-ctx.Done():
+			return numItems
+		}
+		numItems++
+
+		task := &pipelineTask{
+			ctx:      ctx,
+			process:  p.process,
+			item:     item,
+			priority: p.priorityFn(item),
+			state:    int32(TaskStatePending),
+			resultCh: newResultCh(),
+		}
+		if err := p.scheduler.Submit(task); err != nil {
+			task.resultCh <- PipelineResult{Item: task.item, Err: err}
+		}
+	}
+}
+
+// writeResult writes the result to out and releases its pending slot, it returns false if ctx is done first
+func writeResult(
+	ctx context.Context,
+	out chan<- PipelineResult,
+	pendingCh <-chan struct{},
+	result PipelineResult,
+) bool {
+	select {
+	case out <- result:
+		<-pendingCh
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (t *pipelineTask) Execute() error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	result, err := t.process(t.ctx, t.item)
+	if err != nil {
+		return err
+	}
+	t.result = result
+	return nil
+}
+
+func (t *pipelineTask) HandleErr(err error) error {
+	t.err = err
+	return err
+}
+
+func (t *pipelineTask) RetryErr(err error) bool {
+	return false
+}
+
+func (t *pipelineTask) Ack() {
+	if atomic.CompareAndSwapInt32(&t.state, int32(TaskStatePending), int32(TaskStateAcked)) {
+		t.resultCh <- PipelineResult{Item: t.item, Result: t.result}
+	}
+}
+
+func (t *pipelineTask) Nack() {
+	if !atomic.CompareAndSwapInt32(&t.state, int32(TaskStatePending), int32(TaskStateNacked)) {
+		return
+	}
+
+	err := t.err
+	if err == nil {
+		// the task is not processed, e.g. the scheduler is stopped
+		err = ErrTaskNacked
+	}
+	t.resultCh <- PipelineResult{Item: t.item, Err: err}
+}
+
+func (t *pipelineTask) State() State {
+	return State(atomic.LoadInt32(&t.state))
+}
+
+func (t *pipelineTask) Priority() int {
+	return t.priority
+}
+
+func (t *pipelineTask) SetPriority(priority int) {
+	t.priority = priority
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	pipelineStageSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		scheduler WeightedRoundRobinTaskScheduler
+	}
+)
+
+func TestPipelineStageSuite(t *testing.T) {
+	s := new(pipelineStageSuite)
+	suite.Run(t, s)
+}
+
+func (s *pipelineStageSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       100,
+			WorkerCount:     4,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			NackOnStop:      true,
+		},
+	)
+	s.NoError(err)
+	s.scheduler = scheduler
+	s.scheduler.Start()
+}
+
+func (s *pipelineStageSuite) TearDownTest() {
+	s.scheduler.Stop()
+}
+
+func (s *pipelineStageSuite) TestRun_PreserveOrder() {
+	errItem := errors.New("some random error")
+	stage := NewPipelineStage(s.scheduler, func(item interface{}) int {
+		// priority 3 has no weight, so the task is rejected
+		return item.(int) % 4
+	}, func(ctx context.Context, item interface{}) (interface{}, error) {
+		// later items complete first
+		time.Sleep(time.Duration(20-item.(int)) * time.Millisecond / 10)
+		if item.(int) == 5 {
+			return nil, errItem
+		}
+		return item.(int) * 2, nil
+	}, true)
+
+	in := make(chan interface{})
+	go func() {
+		for i := 0; i != 20; i++ {
+			in <- i
+		}
+		close(in)
+	}()
+
+	item := 0
+	for result := range stage.Run(context.Background(), in) {
+		s.Equal(item, result.Item)
+		switch {
+		case item%4 == 3:
+			s.Error(result.Err)
+		case item == 5:
+			s.Equal(errItem, result.Err)
+		default:
+			s.NoError(result.Err)
+			s.Equal(item*2, result.Result)
+		}
+		item++
+	}
+	s.Equal(20, item)
+}
+
+func (s *pipelineStageSuite) TestRun_Unordered() {
+	stage := NewPipelineStage(s.scheduler, func(item interface{}) int {
+		return 1
+	}, func(ctx context.Context, item interface{}) (interface{}, error) {
+		return item.(int) * 2, nil
+	}, false)
+
+	in := make(chan interface{}, 20)
+	var expected []interface{}
+	for i := 0; i != 20; i++ {
+		in <- i
+		expected = append(expected, i*2)
+	}
+	close(in)
+
+	var results []interface{}
+	for result := range stage.Run(context.Background(), in) {
+		s.NoError(result.Err)
+		results = append(results, result.Result)
+	}
+	s.ElementsMatch(expected, results)
+
+	emptyCh := make(chan interface{})
+	close(emptyCh)
+	_, ok := <-stage.Run(context.Background(), emptyCh)
+	s.False(ok)
+}
+
+func (s *pipelineStageSuite) TestRun_ContextDone() {
+	for _, preserveOrder := range []bool{true, false} {
+		ctx, cancel := context.WithCancel(context.Background())
+		startedCh := make(chan struct{}, 1)
+		stage := NewPipelineStage(s.scheduler, func(item interface{}) int {
+			return 0
+		}, func(ctx context.Context, item interface{}) (interface{}, error) {
+			select {
+			case startedCh <- struct{}{}:
+			default:
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, preserveOrder)
+
+		// in is never closed, the output channel is closed once ctx is done
+		in := make(chan interface{}, 2)
+		in <- 0
+		in <- 1
+		out := stage.Run(ctx, in)
+		<-startedCh
+		cancel()
+		for range out {
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// priorityActivity tracks whether the queue of each priority has tasks. A priority is reported active as
+	// soon as a task is queued while it's idle, and idle once its queue is seen empty for the debounce interval,
+	// so a queue flapping between empty and non-empty is reported active once. Submitters and dispatchers only
+	// update atomics unless a priority transitions, idle priorities are detected by sweep. A nil
+	// priorityActivity tracks nothing
+	priorityActivity struct {
+		sync.RWMutex
+		// states is keyed by priority, states are kept when queues are removed so that they're reported idle
+		states map[int]*priorityActivityState
+
+		debounce time.Duration
+		onActive func(priority int)
+		onIdle   func(priority int)
+	}
+
+	priorityActivityState struct {
+		// transitionLock serializes the transitions of the priority along with the callbacks they invoke
+		transitionLock sync.Mutex
+
+		priority int
+		// queue is protected by the lock of priorityActivity, it's replaced if the priority is re-added
+		queue  TaskQueue
+		active int32 // atomic
+		// emptySince is the time in nanoseconds the queue is first seen empty since it's
+		// last seen with tasks, zero if it's not seen empty since then
+		emptySince int64 // atomic
+	}
+)
+
+func newPriorityActivity(
+	debounce time.Duration,
+	onActive func(priority int),
+	onIdle func(priority int),
+) *priorityActivity {
+	return &priorityActivity{
+		states:   make(map[int]*priorityActivityState),
+		debounce: debounce,
+		onActive: onActive,
+		onIdle:   onIdle,
+	}
+}
+
+// add starts tracking the queue of its priority, which is initially idle
+func (a *priorityActivity) add(
+	queue TaskQueue,
+) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if state, ok := a.states[queue.Priority()]; ok {
+		state.queue = queue
+		return
+	}
+	a.states[queue.Priority()] = &priorityActivityState{
+		priority: queue.Priority(),
+		queue:    queue,
+	}
+}
+
+// queued is called once a task is queued with the priority, it reports the priority active if it's idle
+func (a *priorityActivity) queued(
+	priority int,
+) {
+	state, _ := a.get(priority)
+	if state == nil {
+		return
+	}
+
+	// only written when the queue has been seen empty, to keep the submit path cheap
+	if atomic.LoadInt64(&state.emptySince) != 0 {
+		atomic.StoreInt64(&state.emptySince, 0)
+	}
+	if atomic.LoadInt32(&state.active) == 0 {
+		a.activate(state)
+	}
+}
+
+// dispatched is called once a task of the priority is polled by a dispatcher,
+// it starts the debounce interval if the queue of the priority becomes empty
+func (a *priorityActivity) dispatched(
+	priority int,
+) {
+	state, queue := a.get(priority)
+	if state == nil || atomic.LoadInt32(&state.active) == 0 || queue.Len() != 0 {
+		return
+	}
+	atomic.CompareAndSwapInt64(&state.emptySince, 0, time.Now().UnixNano())
+}
+
+// sweep reports the priorities whose queue has been empty for the debounce interval idle, and those with
+// queued tasks active, as tasks may be queued or removed without going through queued or dispatched
+func (a *priorityActivity) sweep(
+	now time.Time,
+) {
+	a.RLock()
+	states := make([]*priorityActivityState, 0, len(a.states))
+	queues := make([]TaskQueue, 0, len(a.states))
+	for _, state := range a.states {
+		states = append(states, state)
+		queues = append(queues, state.queue)
+	}
+	a.RUnlock()
+
+	for idx, state := range states {
+		if queues[idx].Len() != 0 {
+			atomic.StoreInt64(&state.emptySince, 0)
+			if atomic.LoadInt32(&state.active) == 0 {
+				a.activate(state)
+			}
+			continue
+		}
+		if atomic.LoadInt32(&state.active) == 0 {
+			continue
+		}
+		if atomic.CompareAndSwapInt64(&state.emptySince, 0, now.UnixNano()) {
+			continue
+		}
+		a.deactivate(state, queues[idx], now)
+	}
+}
+
+func (a *priorityActivity) get(
+	priority int,
+) (*priorityActivityState, TaskQueue) {
+	if a == nil {
+		return nil, nil
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	state, ok := a.states[priority]
+	if !ok {
+		return nil, nil
+	}
+	return state, state.queue
+}
+
+func (a *priorityActivity) activate(
+	state *priorityActivityState,
+) {
+	state.transitionLock.Lock()
+	defer state.transitionLock.Unlock()
+
+	if atomic.LoadInt32(&state.active) == 1 {
+		return
+	}
+	atomic.StoreInt32(&state.active, 1)
+	if a.onActive != nil {
+		a.onActive(state.priority)
+	}
+}
+
+// deactivate reports the priority idle if its queue is still empty and has been seen empty for the debounce
+// interval. The priority is marked idle before checking the queue, so that a submitter queuing a task
+// concurrently either finds the task counted by the check or the priority idle, and reports it active
+func (a *priorityActivity) deactivate(
+	state *priorityActivityState,
+	queue TaskQueue,
+	now time.Time,
+) {
+	state.transitionLock.Lock()
+	defer state.transitionLock.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&state.active, 1, 0) {
+		return
+	}
+	emptySince := atomic.LoadInt64(&state.emptySince)
+	if queue.Len() != 0 || emptySince == 0 || now.Sub(time.Unix(0, emptySince)) < a.debounce {
+		atomic.StoreInt32(&state.active, 1)
+		return
+	}
+	if a.onIdle != nil {
+		a.onIdle(state.priority)
+	}
+}
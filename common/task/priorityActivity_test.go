@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	priorityActivitySuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestPriorityActivitySuite(t *testing.T) {
+	s := new(priorityActivitySuite)
+	suite.Run(t, s)
+}
+
+func (s *priorityActivitySuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *priorityActivitySuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *priorityActivitySuite) TestTransitions() {
+	var events []string
+	activity := newPriorityActivity(
+		time.Second,
+		func(priority int) { events = append(events, "active") },
+		func(priority int) { events = append(events, "idle") },
+	)
+	queue := newTaskQueue(1, 10)
+	activity.add(queue)
+
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	activity.queued(1)
+	activity.queued(1)
+	s.Equal([]string{"active"}, events)
+
+	// the queue becomes empty, but it's only reported idle once it stays empty for the debounce interval
+	_, ok := queue.Poll()
+	s.True(ok)
+	activity.dispatched(1)
+	now := time.Now()
+	activity.sweep(now)
+	s.Equal([]string{"active"}, events)
+
+	// flapping within the debounce interval restarts it without reporting any transition
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	activity.queued(1)
+	_, ok = queue.Poll()
+	s.True(ok)
+	activity.dispatched(1)
+	activity.sweep(now.Add(time.Second))
+	s.Equal([]string{"active"}, events)
+	activity.sweep(now.Add(3 * time.Second))
+	s.Equal([]string{"active", "idle"}, events)
+	activity.sweep(now.Add(5 * time.Second))
+	s.Equal([]string{"active", "idle"}, events)
+
+	// tasks queued without going through queued are picked up by the sweep
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	activity.sweep(now.Add(6 * time.Second))
+	s.Equal([]string{"active", "idle", "active"}, events)
+
+	// tasks removed without going through dispatched are picked up by the sweep as well
+	_, ok = queue.RemoveHead()
+	s.True(ok)
+	activity.sweep(now.Add(7 * time.Second))
+	s.Equal([]string{"active", "idle", "active"}, events)
+	activity.sweep(now.Add(8 * time.Second))
+	s.Equal([]string{"active", "idle", "active", "idle"}, events)
+}
+
+func (s *priorityActivitySuite) TestNil() {
+	var activity *priorityActivity
+	activity.add(newTaskQueue(1, 10))
+	activity.queued(1)
+	activity.dispatched(1)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+)
+
+type (
+	// priorityProcessorQueue buffers the tasks submitted to ParallelTaskProcessor so that workers
+	// pick up the buffered task with the highest priority, i.e. the smallest value. Tasks with the
+	// same priority are picked up in the order they're submitted, and tasks which are not
+	// PriorityTask are picked up after all PriorityTasks
+	priorityProcessorQueue struct {
+		// slotsCh bounds the number of buffered tasks, a slot is
+		// taken before a task is added and released after it's removed
+		slotsCh chan struct{}
+		// readyCh receives a signal for each buffered task
+		readyCh chan struct{}
+
+		sync.Mutex
+		tasks   processorTaskHeap
+		nextSeq int64
+	}
+
+	processorTaskHeap []processorQueueItem
+
+	processorQueueItem struct {
+		task     Task
+		priority int
+		seq      int64
+	}
+)
+
+func newPriorityProcessorQueue(
+	size int,
+) *priorityProcessorQueue {
+	return &priorityProcessorQueue{
+		slotsCh: make(chan struct{}, size),
+		readyCh: make(chan struct{}, size),
+	}
+}
+
+// put blocks until the task is added, returns false if either shutdownCh or cancelCh is closed first
+func (q *priorityProcessorQueue) put(
+	task Task,
+	shutdownCh <-chan struct{},
+	cancelCh <-chan struct{},
+) bool {
+	select {
+	case q.slotsCh <- struct{}{}:
+	case <-shutdownCh:
+		return false
+	case <-cancelCh:
+		return false
+	}
+	q.add(task)
+	return true
+}
+
+// offer adds the task only if the queue is not full
+func (q *priorityProcessorQueue) offer(
+	task Task,
+) bool {
+	select {
+	case q.slotsCh <- struct{}{}:
+	default:
+		return false
+	}
+	q.add(task)
+	return true
+}
+
+// poll removes the task with the highest priority, it must
+// be called only after a signal is received from readyCh
+func (q *priorityProcessorQueue) poll() Task {
+	q.Lock()
+	item := heap.Pop(&q.tasks).(processorQueueItem)
+	q.Unlock()
+
+	<-q.slotsCh
+	return item.task
+}
+
+func (q *priorityProcessorQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.tasks)
+}
+
+func (q *priorityProcessorQueue) add(
+	task Task,
+) {
+	priority := math.MaxInt32
+	if priorityTask, ok := task.(PriorityTask); ok {
+		priority = priorityTask.Priority()
+	}
+
+	q.Lock()
+	heap.Push(&q.tasks, processorQueueItem{
+		task:     task,
+		priority: priority,
+		seq:      q.nextSeq,
+	})
+	q.nextSeq++
+	q.Unlock()
+
+	// never blocks as readyCh has the same capacity as slotsCh
+	q.readyCh <- struct{}{}
+}
+
+func (h processorTaskHeap) Len() int {
+	return len(h)
+}
+
+func (h processorTaskHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h processorTaskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *processorTaskHeap) Push(x interface{}) {
+	*h = append(*h, x.(processorQueueItem))
+}
+
+func (h *processorTaskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = processorQueueItem{}
+	*h = old[:n-1]
+	return item
+}
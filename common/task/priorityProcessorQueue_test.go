@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityProcessorQueue(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	queue := newPriorityProcessorQueue(3)
+	nonPriorityTask := NewMockTask(controller)
+	lowPriorityTask := NewMockPriorityTask(controller)
+	lowPriorityTask.EXPECT().Priority().Return(1).AnyTimes()
+	highPriorityTask := NewMockPriorityTask(controller)
+	highPriorityTask.EXPECT().Priority().Return(0).AnyTimes()
+
+	require.True(t, queue.offer(nonPriorityTask))
+	require.True(t, queue.offer(lowPriorityTask))
+	require.True(t, queue.put(highPriorityTask, nil, nil))
+	require.False(t, queue.offer(NewMockTask(controller)))
+	require.Equal(t, 3, queue.len())
+
+	cancelCh := make(chan struct{})
+	close(cancelCh)
+	require.False(t, queue.put(NewMockTask(controller), nil, cancelCh))
+
+	for _, expected := range []Task{highPriorityTask, lowPriorityTask, nonPriorityTask} {
+		<-queue.readyCh
+		require.Equal(t, expected, queue.poll())
+	}
+	require.Zero(t, queue.len())
+	require.True(t, queue.offer(nonPriorityTask))
+}
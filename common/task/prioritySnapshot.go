@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+type (
+	// prioritySnapshotTask pins the priority of the task to the value observed at submit time,
+	// so that tasks whose Priority changes between calls are queued, dispatched, retried and
+	// tagged in metrics with a consistent priority
+	prioritySnapshotTask struct {
+		taskWrapper
+
+		priority int
+	}
+
+	// replaceablePrioritySnapshotTask is the prioritySnapshotTask for ReplaceableTask,
+	// so that the snapshot can still be replaced by tasks with the same replace key
+	replaceablePrioritySnapshotTask struct {
+		*prioritySnapshotTask
+
+		replaceKey interface{}
+	}
+)
+
+func newPrioritySnapshotTask(
+	task PriorityTask,
+	priority int,
+) *prioritySnapshotTask {
+	return &prioritySnapshotTask{
+		taskWrapper: taskWrapper{PriorityTask: task},
+		priority:    priority,
+	}
+}
+
+func newReplaceablePrioritySnapshotTask(
+	task ReplaceableTask,
+	priority int,
+) *replaceablePrioritySnapshotTask {
+	return &replaceablePrioritySnapshotTask{
+		prioritySnapshotTask: newPrioritySnapshotTask(task, priority),
+		replaceKey:           task.ReplaceKey(),
+	}
+}
+
+// unwrapPrioritySnapshot returns the task submitted by the caller
+// if the given task is a priority snapshot
+func unwrapPrioritySnapshot(
+	task PriorityTask,
+) PriorityTask {
+	switch snapshot := task.(type) {
+	case *prioritySnapshotTask:
+		return snapshot.PriorityTask
+	case *replaceablePrioritySnapshotTask:
+		return snapshot.PriorityTask
+	default:
+		return task
+	}
+}
+
+func (t *prioritySnapshotTask) Priority() int {
+	return t.priority
+}
+
+func (t *replaceablePrioritySnapshotTask) ReplaceKey() interface{} {
+	return t.replaceKey
+}
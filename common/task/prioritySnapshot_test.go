@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	prioritySnapshotSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestPrioritySnapshotSuite(t *testing.T) {
+	s := new(prioritySnapshotSuite)
+	suite.Run(t, s)
+}
+
+func (s *prioritySnapshotSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *prioritySnapshotSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *prioritySnapshotSuite) TestPriority() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Times(0)
+
+	snapshot := newPrioritySnapshotTask(mockTask, 2)
+	s.Equal(2, snapshot.Priority())
+	s.Equal(mockTask, unwrapPrioritySnapshot(snapshot))
+	s.Equal(mockTask, unwrapPrioritySnapshot(mockTask))
+}
+
+func (s *prioritySnapshotSuite) TestMetricTags() {
+	s.Nil(newPrioritySnapshotTask(NewMockPriorityTask(s.controller), 2).MetricTags())
+
+	mockTaggedTask := NewMockMetricTaggedTask(s.controller)
+	tags := map[string]string{"tenant": "some random tenant"}
+	mockTaggedTask.EXPECT().MetricTags().Return(tags).Times(1)
+	task := &testMetricTaggedTask{
+		MockPriorityTask:     NewMockPriorityTask(s.controller),
+		MockMetricTaggedTask: mockTaggedTask,
+	}
+	s.Equal(tags, newPrioritySnapshotTask(task, 2).MetricTags())
+}
+
+func (s *prioritySnapshotSuite) TestExecuteWithContext() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Execute().Return(nil).Times(1)
+	s.NoError(newPrioritySnapshotTask(mockTask, 2).ExecuteWithContext(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	task := &testContextAwareTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		executeFn: func(ctx context.Context) error {
+			return ctx.Err()
+		},
+	}
+	s.Equal(context.Canceled, newPrioritySnapshotTask(task, 2).ExecuteWithContext(ctx))
+}
+
+func (s *prioritySnapshotSuite) TestReplaceKey() {
+	mockTask := NewMockReplaceableTask(s.controller)
+	mockTask.EXPECT().ReplaceKey().Return("some random key").Times(1)
+
+	snapshot := newReplaceablePrioritySnapshotTask(mockTask, 2)
+	s.Equal("some random key", snapshot.ReplaceKey())
+	s.Equal(2, snapshot.Priority())
+	s.Equal(mockTask, unwrapPrioritySnapshot(snapshot))
+}
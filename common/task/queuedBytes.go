@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync/atomic"
+)
+
+type (
+	// queuedBytes tracks the estimated memory footprint of the tasks queued across the task queues of all
+	// priorities, tasks are added and removed by the queues with their locks held. A nil queuedBytes
+	// tracks nothing
+	queuedBytes struct {
+		bytes int64 // atomic
+
+		// sizeOf returns the estimated size of the task, which must not change while the task is queued
+		sizeOf func(task PriorityTask) int64
+		// onUpdate is invoked with the queued bytes whenever they change
+		onUpdate func(bytes int64)
+	}
+)
+
+func newQueuedBytes(
+	sizeOf func(task PriorityTask) int64,
+	onUpdate func(bytes int64),
+) *queuedBytes {
+	return &queuedBytes{
+		sizeOf:   sizeOf,
+		onUpdate: onUpdate,
+	}
+}
+
+// add counts the size of the task added to a queue
+func (b *queuedBytes) add(
+	task PriorityTask,
+) {
+	b.update(task, 1)
+}
+
+// remove discounts the size of the task removed from a queue
+func (b *queuedBytes) remove(
+	task PriorityTask,
+) {
+	b.update(task, -1)
+}
+
+// load returns the total size of the queued tasks
+func (b *queuedBytes) load() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.bytes)
+}
+
+func (b *queuedBytes) update(
+	task PriorityTask,
+	sign int64,
+) {
+	if b == nil {
+		return
+	}
+	// the size is of the task submitted by the caller, however it's wrapped while queued
+	size := b.sizeOf(unwrapSchedulerTask(task).(PriorityTask))
+	if size <= 0 {
+		return
+	}
+	b.onUpdate(atomic.AddInt64(&b.bytes, sign*size))
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+)
+
+type (
+	// resourceBudget limits the total cost of the in-flight tasks of all priorities on each resource
+	// dimension, tasks are charged when polled by concurrency limited queues and refunded once released
+	resourceBudget struct {
+		sync.Mutex
+		budgets  map[string]float64 // immutable
+		inFlight map[string]float64
+
+		// cost returns the cost of the task on each dimension
+		cost func(task PriorityTask) map[string]float64
+		// onUpdate is invoked with the fraction of the budget of a dimension taken by in-flight tasks whenever it changes
+		onUpdate func(dimension string, utilization float64)
+	}
+)
+
+func newResourceBudget(
+	budgets map[string]float64,
+	cost func(task PriorityTask) map[string]float64,
+	onUpdate func(dimension string, utilization float64),
+) *resourceBudget {
+	copied := make(map[string]float64, len(budgets))
+	for dimension, budget := range budgets {
+		copied[dimension] = budget
+	}
+	return &resourceBudget{
+		budgets:  copied,
+		inFlight: make(map[string]float64, len(budgets)),
+		cost:     cost,
+		onUpdate: onUpdate,
+	}
+}
+
+// fits returns true if dispatching a task of the cost keeps the in-flight cost of every dimension within its
+// budget. A task costing more than a budget still fits once nothing is in flight on the dimension, so that it's
+// not starved. Dimensions without a budget and non-positive costs are ignored
+func (b *resourceBudget) fits(
+	cost map[string]float64,
+) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	for dimension, value := range cost {
+		budget, ok := b.budgets[dimension]
+		if !ok || value <= 0 {
+			continue
+		}
+		inFlight := b.inFlight[dimension]
+		if inFlight > 0 && inFlight+value > budget {
+			return false
+		}
+	}
+	return true
+}
+
+// acquire charges the cost to the in-flight cost of the dimensions
+func (b *resourceBudget) acquire(
+	cost map[string]float64,
+) {
+	b.update(cost, 1)
+}
+
+// release refunds the cost charged by acquire
+func (b *resourceBudget) release(
+	cost map[string]float64,
+) {
+	b.update(cost, -1)
+}
+
+func (b *resourceBudget) update(
+	cost map[string]float64,
+	sign float64,
+) {
+	var dimensions []string
+	var utilizations []float64
+	b.Lock()
+	for dimension, value := range cost {
+		budget, ok := b.budgets[dimension]
+		if !ok || value <= 0 {
+			continue
+		}
+		inFlight := b.inFlight[dimension] + sign*value
+		if inFlight < 0 {
+			// accumulated rounding errors
+			inFlight = 0
+		}
+		b.inFlight[dimension] = inFlight
+		dimensions = append(dimensions, dimension)
+		utilizations = append(utilizations, inFlight/budget)
+	}
+	b.Unlock()
+
+	for i, dimension := range dimensions {
+		b.onUpdate(dimension, utilizations[i])
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	resourceBudgetSuite struct {
+		*require.Assertions
+		suite.Suite
+	}
+)
+
+func TestResourceBudgetSuite(t *testing.T) {
+	s := new(resourceBudgetSuite)
+	suite.Run(t, s)
+}
+
+func (s *resourceBudgetSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+}
+
+func (s *resourceBudgetSuite) TestFits() {
+	utilizations := make(map[string]float64)
+	budget := newResourceBudget(
+		map[string]float64{"cpu": 2, "api": 4},
+		nil,
+		func(dimension string, utilization float64) {
+			utilizations[dimension] = utilization
+		},
+	)
+
+	s.True(budget.fits(nil))
+	s.True(budget.fits(map[string]float64{"cpu": 2, "api": 4}))
+	budget.acquire(map[string]float64{"cpu": 1, "api": 1})
+	s.Equal(map[string]float64{"cpu": 0.5, "api": 0.25}, utilizations)
+
+	s.True(budget.fits(map[string]float64{"cpu": 1, "api": 3}))
+	s.False(budget.fits(map[string]float64{"cpu": 1.5}))
+	s.False(budget.fits(map[string]float64{"cpu": 1, "api": 3.5}))
+	// dimensions without a budget and non-positive costs are ignored
+	s.True(budget.fits(map[string]float64{"cpu": -1, "disk": 100}))
+
+	budget.release(map[string]float64{"cpu": 1, "api": 1, "disk": 100})
+	s.Equal(map[string]float64{"cpu": 0, "api": 0}, utilizations)
+}
+
+func (s *resourceBudgetSuite) TestFits_Oversized() {
+	budget := newResourceBudget(
+		map[string]float64{"cpu": 1},
+		nil,
+		func(string, float64) {},
+	)
+
+	// a task costing more than the budget fits once nothing is in flight
+	s.True(budget.fits(map[string]float64{"cpu": 3}))
+	budget.acquire(map[string]float64{"cpu": 3})
+	s.False(budget.fits(map[string]float64{"cpu": 0.5}))
+
+	budget.release(map[string]float64{"cpu": 3})
+	s.True(budget.fits(map[string]float64{"cpu": 3}))
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type (
+	// retrySlowStart is the retry budget of ParallelTaskProcessor when RetrySlowStartWindow is specified.
+	// Once the budget is exhausted, or a downstream dependency recovers, the allowed retry rate drops
+	// and ramps back linearly to the max rate over the window, so that the retries accumulated during
+	// an outage don't overwhelm the recovering downstream all at once
+	retrySlowStart struct {
+		sync.Mutex
+
+		maxRate float64
+		window  time.Duration
+		// onRateUpdate is invoked with the lock held whenever the allowed rate changes
+		onRateUpdate func(rate float64)
+		now          func() time.Time
+
+		// the following fields are protected by the lock
+		limiter       *rate.Limiter
+		rate          float64
+		ramping       bool
+		rampStartTime time.Time
+	}
+)
+
+// minRetrySlowStartRate is the allowed retry rate per second at the start of a ramp
+const minRetrySlowStartRate = 1
+
+func newRetrySlowStart(
+	maxRate float64,
+	window time.Duration,
+	onRateUpdate func(rate float64),
+) *retrySlowStart {
+	return &retrySlowStart{
+		maxRate:      maxRate,
+		window:       window,
+		onRateUpdate: onRateUpdate,
+		now:          time.Now,
+		limiter:      rate.NewLimiter(rate.Limit(maxRate), retrySlowStartBurst(maxRate)),
+		rate:         maxRate,
+	}
+}
+
+// allow returns true if a retry is allowed, a retry denied at the max rate means the budget
+// is exhausted, which restarts the ramp. Retries denied while ramping don't restart it
+func (s *retrySlowStart) allow() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	s.updateRateLocked(now)
+	if s.limiter.AllowN(now, 1) {
+		return true
+	}
+	if !s.ramping {
+		s.restartLocked(now)
+	}
+	return false
+}
+
+// restart drops the allowed rate and ramps it back over the window,
+// retries allowed by the tokens accumulated so far are discarded
+func (s *retrySlowStart) restart() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.restartLocked(s.now())
+}
+
+func (s *retrySlowStart) restartLocked(
+	now time.Time,
+) {
+	s.ramping = true
+	s.rampStartTime = now
+	s.limiter = rate.NewLimiter(rate.Limit(s.maxRate), retrySlowStartBurst(s.maxRate))
+	s.limiter.AllowN(now, s.limiter.Burst())
+	s.rate = s.maxRate
+	s.updateRateLocked(now)
+}
+
+func (s *retrySlowStart) updateRateLocked(
+	now time.Time,
+) {
+	if !s.ramping {
+		return
+	}
+
+	allowedRate := s.maxRate
+	if progress := float64(now.Sub(s.rampStartTime)) / float64(s.window); progress < 1 {
+		allowedRate = math.Min(math.Max(s.maxRate*progress, minRetrySlowStartRate), s.maxRate)
+	} else {
+		s.ramping = false
+	}
+	if allowedRate != s.rate {
+		s.limiter.SetLimitAt(now, rate.Limit(allowedRate))
+		s.rate = allowedRate
+		s.onRateUpdate(allowedRate)
+	}
+}
+
+// retrySlowStartBurst is the burst of the retry budget, the same as quotas.NewSimpleRateLimiter
+func retrySlowStartBurst(
+	maxRate float64,
+) int {
+	if burst := int(maxRate); burst > 1 {
+		return burst
+	}
+	return 1
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrySlowStart(t *testing.T) {
+	var rates []float64
+	slowStart := newRetrySlowStart(10, 10*time.Second, func(rate float64) {
+		rates = append(rates, rate)
+	})
+	now := time.Now()
+	slowStart.now = func() time.Time { return now }
+	allowed := func() int {
+		numAllowed := 0
+		for slowStart.allow() {
+			numAllowed++
+		}
+		return numAllowed
+	}
+
+	// exhausting the budget at the max rate starts the ramp
+	require.Equal(t, 10, allowed())
+	require.True(t, slowStart.ramping)
+	require.Equal(t, []float64{1}, rates)
+
+	// retries denied while ramping don't restart it
+	now = now.Add(5 * time.Second)
+	require.Equal(t, 5, allowed())
+	require.True(t, slowStart.ramping)
+	require.Equal(t, []float64{1, 5}, rates)
+
+	now = now.Add(5 * time.Second)
+	require.Equal(t, 10, allowed())
+	require.Equal(t, []float64{1, 5, 10, 1}, rates)
+
+	// tokens accumulated before the restart are discarded
+	now = now.Add(20 * time.Second)
+	slowStart.restart()
+	require.False(t, slowStart.allow())
+	require.Equal(t, []float64{1, 5, 10, 1, 1}, rates)
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// RunAllFunc processes an item passed to RunAll and returns its result
+	RunAllFunc func(ctx context.Context, item interface{}) (interface{}, error)
+
+	// runAll tracks the results of the tasks submitted by RunAll
+	runAll struct {
+		ctx    context.Context
+		cancel context.CancelFunc
+		fn     RunAllFunc
+
+		results []interface{}
+		tasksWG sync.WaitGroup
+
+		sync.Mutex
+		firstErr error
+	}
+
+	// runAllTask processes a single item for RunAll, it's never retried
+	runAllTask struct {
+		run      *runAll
+		index    int
+		item     interface{}
+		priority int
+		state    int32
+		err      error
+	}
+)
+
+var _ PriorityTask = (*runAllTask)(nil)
+
+// RunAll submits a task with the given priority for each item to the scheduler, which calls fn with the
+// item, and waits for all of them to complete. Results are returned in the order of the items, along with
+// the first error returned by fn or encountered when submitting and processing the tasks, in which case
+// the context passed to fn is cancelled, items not processed yet are skipped, and their results are nil.
+// The concurrency is bounded by the scheduler's workers, failed tasks are not retried. If ctx is done
+// before all the tasks complete, RunAll returns ctx.Err() without waiting for the remaining tasks, which
+// is the only way to return if the scheduler drops queued tasks on stop without nacking them
+func RunAll(
+	ctx context.Context,
+	scheduler Scheduler,
+	priority int,
+	items []interface{},
+	fn RunAllFunc,
+) ([]interface{}, error) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	run := &runAll{
+		ctx:     runCtx,
+		cancel:  cancel,
+		fn:      fn,
+		results: make([]interface{}, len(items)),
+	}
+	for idx, item := range items {
+		if runCtx.Err() != nil {
+			break
+		}
+		run.tasksWG.Add(1)
+		task := &runAllTask{
+			run:      run,
+			index:    idx,
+			item:     item,
+			priority: priority,
+			state:    int32(TaskStatePending),
+		}
+		if err := scheduler.Submit(task); err != nil {
+			run.tasksWG.Done()
+			run.fail(err)
+			break
+		}
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		run.tasksWG.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-ctx.Done():
+		// the remaining tasks return immediately once dispatched,
+		// they may still be writing the results, so no result is returned
+		return nil, ctx.Err()
+	}
+
+	run.Lock()
+	defer run.Unlock()
+	return run.results, run.firstErr
+}
+
+// fail records the first error and cancels the remaining tasks
+func (r *runAll) fail(
+	err error,
+) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.firstErr == nil {
+		r.firstErr = err
+		r.cancel()
+	}
+}
+
+func (t *runAllTask) Execute() error {
+	if err := t.run.ctx.Err(); err != nil {
+		return err
+	}
+	result, err := t.run.fn(t.run.ctx, t.item)
+	if err != nil {
+		return err
+	}
+
+	t.run.Lock()
+	t.run.results[t.index] = result
+	t.run.Unlock()
+	return nil
+}
+
+func (t *runAllTask) HandleErr(err error) error {
+	t.err = err
+	return err
+}
+
+func (t *runAllTask) RetryErr(err error) bool {
+	return false
+}
+
+func (t *runAllTask) Ack() {
+	if atomic.CompareAndSwapInt32(&t.state, int32(TaskStatePending), int32(TaskStateAcked)) {
+		t.run.tasksWG.Done()
+	}
+}
+
+func (t *runAllTask) Nack() {
+	if !atomic.CompareAndSwapInt32(&t.state, int32(TaskStatePending), int32(TaskStateNacked)) {
+		return
+	}
+
+	err := t.err
+	if err == nil {
+		// the task is not processed, e.g. the scheduler is stopped
+		err = ErrTaskNacked
+	}
+	t.run.fail(err)
+	t.run.tasksWG.Done()
+}
+
+func (t *runAllTask) State() State {
+	return State(atomic.LoadInt32(&t.state))
+}
+
+func (t *runAllTask) Priority() int {
+	return t.priority
+}
+
+func (t *runAllTask) SetPriority(priority int) {
+	t.priority = priority
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	runAllSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		scheduler WeightedRoundRobinTaskScheduler
+	}
+)
+
+func TestRunAllSuite(t *testing.T) {
+	s := new(runAllSuite)
+	suite.Run(t, s)
+}
+
+func (s *runAllSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       100,
+			WorkerCount:     2,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			NackOnStop:      true,
+		},
+	)
+	s.NoError(err)
+	s.scheduler = scheduler
+	s.scheduler.Start()
+}
+
+func (s *runAllSuite) TearDownTest() {
+	s.scheduler.Stop()
+}
+
+func (s *runAllSuite) TestRunAll() {
+	var items []interface{}
+	for i := 0; i != 20; i++ {
+		items = append(items, i)
+	}
+	var running, maxRunning int32
+	results, err := RunAll(context.Background(), s.scheduler, 1, items, func(ctx context.Context, item interface{}) (interface{}, error) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			observed := atomic.LoadInt32(&maxRunning)
+			if current <= observed || atomic.CompareAndSwapInt32(&maxRunning, observed, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return item.(int) * 2, nil
+	})
+	s.NoError(err)
+	s.Len(results, len(items))
+	for idx, result := range results {
+		s.Equal(idx*2, result)
+	}
+	// concurrency is bounded by the workers of the scheduler
+	s.True(atomic.LoadInt32(&maxRunning) <= 2)
+
+	results, err = RunAll(context.Background(), s.scheduler, 1, nil, nil)
+	s.NoError(err)
+	s.Empty(results)
+}
+
+func (s *runAllSuite) TestRunAll_Error() {
+	errItem := errors.New("some random error")
+	items := []interface{}{0, 1, 2}
+	results, err := RunAll(context.Background(), s.scheduler, 1, items, func(ctx context.Context, item interface{}) (interface{}, error) {
+		if item.(int) == 1 {
+			return nil, errItem
+		}
+		return item, nil
+	})
+	s.Equal(errItem, err)
+	s.Len(results, len(items))
+	s.Nil(results[1])
+}
+
+func (s *runAllSuite) TestRunAll_SubmitError() {
+	// unknown priority
+	results, err := RunAll(context.Background(), s.scheduler, 5, []interface{}{0}, func(ctx context.Context, item interface{}) (interface{}, error) {
+		s.Fail("item should not be processed")
+		return nil, nil
+	})
+	s.Error(err)
+	s.Equal([]interface{}{nil}, results)
+}
+
+func (s *runAllSuite) TestRunAll_ContextDone() {
+	ctx, cancel := context.WithCancel(context.Background())
+	blockCh := make(chan struct{})
+	defer close(blockCh)
+	startedCh := make(chan struct{}, 1)
+	go func() {
+		<-startedCh
+		cancel()
+	}()
+
+	results, err := RunAll(ctx, s.scheduler, 1, []interface{}{0}, func(ctx context.Context, item interface{}) (interface{}, error) {
+		startedCh <- struct{}{}
+		<-blockCh
+		return item, nil
+	})
+	s.Equal(context.Canceled, err)
+	s.Nil(results)
+}
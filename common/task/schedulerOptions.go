@@ -0,0 +1,228 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/service/dynamicconfig"
+)
+
+type (
+	// weightedRoundRobinTaskSchedulerConfig is the JSON representation of
+	// WeightedRoundRobinTaskSchedulerOptions, fields that are not serializable
+	// are replaced by their declarative counterparts
+	weightedRoundRobinTaskSchedulerConfig struct {
+		*WeightedRoundRobinTaskSchedulerOptions
+
+		Weights        map[string]interface{} `json:"weights"`
+		RetryPolicy    *retryPolicyConfig     `json:"retryPolicy"`
+		IdempotencyTTL string                 `json:"idempotencyTTL"`
+		MaxQueueAge    map[int]string         `json:"maxQueueAge"`
+		MaxWaitSLA     []string               `json:"maxWaitSLA"`
+		WarmupDuration string                 `json:"warmupDuration"`
+
+		HealthStalenessWindow        string `json:"healthStalenessWindow"`
+		DrainProgressInterval        string `json:"drainProgressInterval"`
+		AdaptiveBackpressureMaxDelay string `json:"adaptiveBackpressureMaxDelay"`
+		CircuitBreakerOpenDuration   string `json:"circuitBreakerOpenDuration"`
+		RetrySlowStartWindow         string `json:"retrySlowStartWindow"`
+
+		AgePriorityEscalation         map[int]string `json:"agePriorityEscalation"`
+		AgePriorityEscalationInterval string         `json:"agePriorityEscalationInterval"`
+		EffectiveConcurrencyWindow    string         `json:"effectiveConcurrencyWindow"`
+		WeightDriftWindow             string         `json:"weightDriftWindow"`
+
+		DispatcherShutdownTimeout string `json:"dispatcherShutdownTimeout"`
+		ProcessorShutdownTimeout  string `json:"processorShutdownTimeout"`
+		WeightsRefreshInterval    string `json:"weightsRefreshInterval"`
+		NonDroppableGracePeriod   string `json:"nonDroppableGracePeriod"`
+		PriorityIdleDebounce      string `json:"priorityIdleDebounce"`
+		ReadinessCheckInterval    string `json:"readinessCheckInterval"`
+		BatchWindow               string `json:"batchWindow"`
+		ProcessorCapacityWait     string `json:"processorCapacityWait"`
+		EnqueueTimeTolerance      string `json:"enqueueTimeTolerance"`
+	}
+
+	// retryPolicyConfig is the JSON representation of backoff.ExponentialRetryPolicy,
+	// intervals are in the format accepted by time.ParseDuration
+	retryPolicyConfig struct {
+		InitialInterval    string  `json:"initialInterval"`
+		BackoffCoefficient float64 `json:"backoffCoefficient"`
+		MaximumInterval    string  `json:"maximumInterval"`
+		ExpirationInterval string  `json:"expirationInterval"`
+		MaximumAttempts    int     `json:"maximumAttempts"`
+	}
+)
+
+// ParseOptions loads WeightedRoundRobinTaskSchedulerOptions from JSON. Weights are keyed by
+// priority and remain static, RetryPolicy is specified by the retryPolicy object which maps to
+// an exponential retry policy, durations are strings like "10s". Fields which can't be serialized,
+// e.g. callbacks and DispatchStrategy, are left empty. Unknown fields are rejected
+func ParseOptions(
+	data []byte,
+) (*WeightedRoundRobinTaskSchedulerOptions, error) {
+	config := &weightedRoundRobinTaskSchedulerConfig{
+		WeightedRoundRobinTaskSchedulerOptions: &WeightedRoundRobinTaskSchedulerOptions{},
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to decode scheduler options: %v", err)
+	}
+
+	options := config.WeightedRoundRobinTaskSchedulerOptions
+	options.Weights = dynamicconfig.GetMapPropertyFn(config.Weights)
+
+	var err error
+	if config.RetryPolicy == nil {
+		return nil, errors.New("retry policy is not specified in the scheduler option")
+	}
+	if options.RetryPolicy, err = config.RetryPolicy.toRetryPolicy(); err != nil {
+		return nil, err
+	}
+	durations := []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"idempotencyTTL", config.IdempotencyTTL, &options.IdempotencyTTL},
+		{"warmupDuration", config.WarmupDuration, &options.WarmupDuration},
+		{"healthStalenessWindow", config.HealthStalenessWindow, &options.HealthStalenessWindow},
+		{"drainProgressInterval", config.DrainProgressInterval, &options.DrainProgressInterval},
+		{"adaptiveBackpressureMaxDelay", config.AdaptiveBackpressureMaxDelay, &options.AdaptiveBackpressureMaxDelay},
+		{"circuitBreakerOpenDuration", config.CircuitBreakerOpenDuration, &options.CircuitBreakerOpenDuration},
+		{"retrySlowStartWindow", config.RetrySlowStartWindow, &options.RetrySlowStartWindow},
+		{"effectiveConcurrencyWindow", config.EffectiveConcurrencyWindow, &options.EffectiveConcurrencyWindow},
+		{"weightDriftWindow", config.WeightDriftWindow, &options.WeightDriftWindow},
+		{"dispatcherShutdownTimeout", config.DispatcherShutdownTimeout, &options.DispatcherShutdownTimeout},
+		{"processorShutdownTimeout", config.ProcessorShutdownTimeout, &options.ProcessorShutdownTimeout},
+		{"enqueueTimeTolerance", config.EnqueueTimeTolerance, &options.EnqueueTimeTolerance},
+		{"processorCapacityWait", config.ProcessorCapacityWait, &options.ProcessorCapacityWait},
+		{"batchWindow", config.BatchWindow, &options.BatchWindow},
+		{"readinessCheckInterval", config.ReadinessCheckInterval, &options.ReadinessCheckInterval},
+		{"priorityIdleDebounce", config.PriorityIdleDebounce, &options.PriorityIdleDebounce},
+		{"nonDroppableGracePeriod", config.NonDroppableGracePeriod, &options.NonDroppableGracePeriod},
+		{"weightsRefreshInterval", config.WeightsRefreshInterval, &options.WeightsRefreshInterval},
+		{"agePriorityEscalationInterval", config.AgePriorityEscalationInterval, &options.AgePriorityEscalationInterval},
+	}
+	for _, duration := range durations {
+		if *duration.target, err = parseOptionalDuration(duration.name, duration.value); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.AgePriorityEscalation) != 0 {
+		options.AgePriorityEscalation = make(map[int]time.Duration, len(config.AgePriorityEscalation))
+		for priority, value := range config.AgePriorityEscalation {
+			if options.AgePriorityEscalation[priority], err = parseOptionalDuration(
+				fmt.Sprintf("agePriorityEscalation of priority %v", priority),
+				value,
+			); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(config.MaxQueueAge) != 0 {
+		options.MaxQueueAge = make(map[int]time.Duration, len(config.MaxQueueAge))
+		for priority, value := range config.MaxQueueAge {
+			if options.MaxQueueAge[priority], err = parseOptionalDuration(
+				fmt.Sprintf("maxQueueAge of priority %v", priority),
+				value,
+			); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(config.MaxWaitSLA) != 0 {
+		options.MaxWaitSLA = make([]time.Duration, len(config.MaxWaitSLA))
+		for priority, value := range config.MaxWaitSLA {
+			if options.MaxWaitSLA[priority], err = parseOptionalDuration(
+				fmt.Sprintf("maxWaitSLA of priority %v", priority),
+				value,
+			); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := ValidateOptions(options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func (c *retryPolicyConfig) toRetryPolicy() (backoff.RetryPolicy, error) {
+	initialInterval, err := parseOptionalDuration("retryPolicy.initialInterval", c.InitialInterval)
+	if err != nil {
+		return nil, err
+	}
+	if initialInterval <= 0 {
+		return nil, errors.New("retryPolicy.initialInterval is not specified")
+	}
+	maximumInterval, err := parseOptionalDuration("retryPolicy.maximumInterval", c.MaximumInterval)
+	if err != nil {
+		return nil, err
+	}
+	expirationInterval, err := parseOptionalDuration("retryPolicy.expirationInterval", c.ExpirationInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := backoff.NewExponentialRetryPolicy(initialInterval)
+	if c.BackoffCoefficient != 0 {
+		if c.BackoffCoefficient < 1 {
+			return nil, fmt.Errorf("invalid retryPolicy.backoffCoefficient %v", c.BackoffCoefficient)
+		}
+		policy.SetBackoffCoefficient(c.BackoffCoefficient)
+	}
+	if maximumInterval != 0 {
+		policy.SetMaximumInterval(maximumInterval)
+	}
+	if expirationInterval != 0 {
+		policy.SetExpirationInterval(expirationInterval)
+	}
+	if c.MaximumAttempts != 0 {
+		policy.SetMaximumAttempts(c.MaximumAttempts)
+	}
+	return policy, nil
+}
+
+func parseOptionalDuration(
+	name string,
+	value string,
+) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %q: %v", name, value, err)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("invalid %v %q: duration is negative", name, value)
+	}
+	return duration, nil
+}
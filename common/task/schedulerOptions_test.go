@@ -0,0 +1,430 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/service/dynamicconfig"
+)
+
+type (
+	schedulerOptionsSuite struct {
+		*require.Assertions
+		suite.Suite
+	}
+)
+
+func TestSchedulerOptionsSuite(t *testing.T) {
+	s := new(schedulerOptionsSuite)
+	suite.Run(t, s)
+}
+
+func (s *schedulerOptionsSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+}
+
+func (s *schedulerOptionsSuite) TestParseOptions() {
+	options, err := ParseOptions([]byte(`{
+		"weights": {"0": 10, "1": 1},
+		"queueSize": 100,
+		"workerCount": 8,
+		"dispatcherCount": 2,
+		"retryPolicy": {
+			"initialInterval": "10ms",
+			"backoffCoefficient": 1.5,
+			"maximumInterval": "1s",
+			"maximumAttempts": 5
+		},
+		"processorQueueSize": 16,
+		"metricTagAllowlist": ["domain"],
+		"nackOnStop": true,
+		"maxConcurrencyByPriority": [0, 2],
+		"idempotencyCacheSize": 1000,
+		"idempotencyTTL": "5m",
+		"directDispatch": [0],
+		"minDispatchPerRound": {"1": 1},
+		"maxQueueAge": {"1": "30s"},
+		"agePriorityEscalation": {"1": "1m"},
+		"agePriorityEscalationInterval": "10s",
+		"effectiveConcurrencyWindow": "1m",
+		"weightDriftWindow": "1m",
+		"queueSizes": {"1": 50},
+		"proportionalQueueSizes": true,
+		"dispatcherShutdownTimeout": "10s",
+		"processorShutdownTimeout": "30s",
+		"warmupDuration": "1m",
+		"warmupWorkerCount": 2,
+		"healthStalenessWindow": "30s",
+		"drainProgressInterval": "5s",
+		"adaptiveBackpressureMaxDelay": "100ms",
+		"adaptiveBackpressureLowWatermark": 0.5,
+		"loadShedding": {"1": {"lowWatermark": 0.5, "maxProbability": 0.8}},
+		"circuitBreakerFailureThreshold": 5,
+		"circuitBreakerOpenDuration": "30s",
+		"expressPriority": 0,
+		"priorityOrder": [1, 0],
+		"enqueueTimeTolerance": "2s",
+		"processorCapacityWait": "5ms",
+		"batchWindow": "20ms",
+		"readinessCheckInterval": "3s",
+		"priorityIdleDebounce": "500ms",
+		"maxWaitSLA": ["1s", "", "1m"],
+		"nonDroppableGracePeriod": "30s",
+		"weightsRefreshInterval": "1m"
+	}`))
+	s.NoError(err)
+
+	expectedRetryPolicy := backoff.NewExponentialRetryPolicy(10 * time.Millisecond)
+	expectedRetryPolicy.SetBackoffCoefficient(1.5)
+	expectedRetryPolicy.SetMaximumInterval(time.Second)
+	expectedRetryPolicy.SetMaximumAttempts(5)
+	s.Equal(expectedRetryPolicy, options.RetryPolicy)
+	s.Equal(map[string]interface{}{"0": float64(10), "1": float64(1)}, options.Weights())
+
+	options.Weights = nil
+	options.RetryPolicy = nil
+	s.Equal(&WeightedRoundRobinTaskSchedulerOptions{
+		QueueSize:                        100,
+		WorkerCount:                      8,
+		DispatcherCount:                  2,
+		ProcessorQueueSize:               16,
+		MetricTagAllowlist:               []string{"domain"},
+		NackOnStop:                       true,
+		MaxConcurrencyByPriority:         []int{0, 2},
+		IdempotencyCacheSize:             1000,
+		IdempotencyTTL:                   5 * time.Minute,
+		DirectDispatch:                   []int{0},
+		MinDispatchPerRound:              map[int]int{1: 1},
+		MaxQueueAge:                      map[int]time.Duration{1: 30 * time.Second},
+		AgePriorityEscalation:            map[int]time.Duration{1: time.Minute},
+		AgePriorityEscalationInterval:    10 * time.Second,
+		EffectiveConcurrencyWindow:       time.Minute,
+		WeightDriftWindow:                time.Minute,
+		QueueSizes:                       map[int]int{1: 50},
+		ProportionalQueueSizes:           true,
+		DispatcherShutdownTimeout:        10 * time.Second,
+		ProcessorShutdownTimeout:         30 * time.Second,
+		WarmupDuration:                   time.Minute,
+		WarmupWorkerCount:                2,
+		HealthStalenessWindow:            30 * time.Second,
+		DrainProgressInterval:            5 * time.Second,
+		AdaptiveBackpressureMaxDelay:     100 * time.Millisecond,
+		AdaptiveBackpressureLowWatermark: 0.5,
+		LoadShedding:                     map[int]LoadSheddingCurve{1: {LowWatermark: 0.5, MaxProbability: 0.8}},
+		CircuitBreakerFailureThreshold:   5,
+		CircuitBreakerOpenDuration:       30 * time.Second,
+		ExpressPriority:                  common.IntPtr(0),
+		PriorityOrder:                    []int{1, 0},
+		EnqueueTimeTolerance:             2 * time.Second,
+		ProcessorCapacityWait:            5 * time.Millisecond,
+		BatchWindow:                      20 * time.Millisecond,
+		ReadinessCheckInterval:           3 * time.Second,
+		PriorityIdleDebounce:             500 * time.Millisecond,
+		MaxWaitSLA:                       []time.Duration{time.Second, 0, time.Minute},
+		NonDroppableGracePeriod:          30 * time.Second,
+		WeightsRefreshInterval:           time.Minute,
+	}, options)
+}
+
+func (s *schedulerOptionsSuite) TestParseOptions_SingleWorker() {
+	options, err := ParseOptions([]byte(`{
+		"weights": {"0": 1},
+		"queueSize": 10,
+		"retryPolicy": {"initialInterval": "10ms"},
+		"singleWorker": true
+	}`))
+	s.NoError(err)
+	s.True(options.SingleWorker)
+}
+
+func (s *schedulerOptionsSuite) TestParseOptions_Invalid() {
+	testCases := map[string]string{
+		"malformed":           `{"weights":`,
+		"unknown field":       `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "workers": 1}`,
+		"no weights":          `{"queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}}`,
+		"invalid priority":    `{"weights": {"high": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}}`,
+		"negative weight":     `{"weights": {"0": -1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}}`,
+		"no retry policy":     `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1}`,
+		"no initial interval": `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"maximumAttempts": 1}}`,
+		"invalid duration":    `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1"}}`,
+		"invalid coefficient": `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s", "backoffCoefficient": 0.5}}`,
+		"invalid queue size":  `{"weights": {"0": 1}, "queueSize": -1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}}`,
+		"invalid worker":      `{"weights": {"0": 1}, "queueSize": 1, "workerCount": -1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}}`,
+		"invalid dispatcher":  `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": -1, "retryPolicy": {"initialInterval": "1s"}}`,
+		"invalid max age":     `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "maxQueueAge": {"0": "-1s"}}`,
+		"invalid wait SLA":    `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "maxWaitSLA": ["1s", "-1s"]}`,
+		"invalid escalation":  `{"weights": {"0": 1, "1": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "agePriorityEscalation": {"1": "1"}}`,
+		"invalid window":      `{"weights": {"0": 1, "1": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "effectiveConcurrencyWindow": "1"}`,
+		"invalid max tasks":   `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "maxTasksPerRound": -1}`,
+		"invalid concurrency": `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "maxConcurrencyByPriority": [-1]}`,
+		"invalid slow start":  `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "retrySlowStartWindow": "1m"}`,
+		"conflicting options": `{"weights": {"0": 1}, "queueSize": 1, "workerCount": 1, "dispatcherCount": 1, "retryPolicy": {"initialInterval": "1s"}, "directDispatch": [0], "idleOnly": [0]}`,
+	}
+	for name, data := range testCases {
+		_, err := ParseOptions([]byte(data))
+		s.Error(err, name)
+	}
+}
+
+func (s *schedulerOptionsSuite) TestValidateOptions() {
+	newOptions := func() *WeightedRoundRobinTaskSchedulerOptions {
+		return &WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         dynamicconfig.GetMapPropertyFn(map[string]interface{}{"0": 10, "1": 1}),
+			QueueSize:       10,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		}
+	}
+	s.NoError(ValidateOptions(newOptions()))
+
+	testCases := map[string]func(options *WeightedRoundRobinTaskSchedulerOptions){
+		"no weights": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.Weights = nil
+		},
+		"empty weights": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.Weights = dynamicconfig.GetMapPropertyFn(map[string]interface{}{})
+		},
+		"negative weight": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.Weights = dynamicconfig.GetMapPropertyFn(map[string]interface{}{"0": -1})
+		},
+		"negative queue size": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.QueueSize = -1
+		},
+		"negative queue size of priority": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.QueueSizes = map[int]int{1: -1}
+		},
+		"proportional queue size less than one": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.QueueSize = 1
+			options.ProportionalQueueSizes = true
+		},
+		"negative max blocked submitters": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.MaxBlockedSubmitters = -1
+		},
+		"negative warmup worker count": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.WarmupWorkerCount = -1
+		},
+		"worker pool with circuit breakers": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.WorkerPool = &SharedWorkerPool{}
+			options.CircuitBreakerFailureThreshold = 1
+		},
+		"invalid dead letter queue size": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.DeadLetterQueueSize = map[int]int{0: 0}
+		},
+		"worker pool with retry requeue": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.WorkerPool = &SharedWorkerPool{}
+			options.RetryRequeue = true
+		},
+		"invalid queue depth threshold": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.QueueDepthThresholds = []float64{0.5, 1.5}
+		},
+		"preserve order with retry requeue": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PreserveIntraPriorityOrder = []int{1}
+			options.RetryRequeue = true
+		},
+		"preserve order of direct dispatch priority": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PreserveIntraPriorityOrder = []int{0}
+			options.DirectDispatch = []int{0}
+		},
+		"preserve order with max concurrency": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PreserveIntraPriorityOrder = []int{0}
+			options.MaxConcurrencyByPriority = []int{2}
+		},
+		"invalid adaptive backpressure watermarks": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.AdaptiveBackpressureMaxDelay = time.Second
+			options.AdaptiveBackpressureLowWatermark = 0.8
+			options.AdaptiveBackpressureHighWatermark = 0.5
+		},
+		"negative readiness check interval": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ReadinessCheckInterval = -time.Second
+		},
+		"negative priority idle debounce": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PriorityIdleDebounce = -time.Second
+		},
+		"negative max wait SLA": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.MaxWaitSLA = []time.Duration{0, -time.Second}
+		},
+		"negative non-droppable grace period": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.NonDroppableGracePeriod = -time.Second
+		},
+		"negative weights refresh interval": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.WeightsRefreshInterval = -time.Second
+		},
+		"invalid load shedding watermarks": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.LoadShedding = map[int]LoadSheddingCurve{2: {LowWatermark: 0.8, HighWatermark: 0.5, MaxProbability: 1}}
+		},
+		"invalid load shedding probability": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.LoadShedding = map[int]LoadSheddingCurve{2: {LowWatermark: 0.5, MaxProbability: 1.5}}
+		},
+		"negative max queued bytes": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.SizeOf = func(PriorityTask) int64 { return 1 }
+			options.MaxQueuedBytes = -1
+		},
+		"queued bytes limit without size of": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.SoftQueuedBytes = 100
+		},
+		"soft queued bytes not below max": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.SizeOf = func(PriorityTask) int64 { return 1 }
+			options.MaxQueuedBytes = 100
+			options.SoftQueuedBytes = 100
+		},
+		"size of with lock-free queues": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.SizeOf = func(PriorityTask) int64 { return 1 }
+			options.LockFreeQueues = true
+		},
+		"adaptive retry backoff multiplier below one": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.AdaptiveRetryBackoffMaxMultiplier = 0.5
+		},
+		"invalid adaptive retry backoff watermarks": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.AdaptiveRetryBackoffMaxMultiplier = 4
+			options.AdaptiveRetryBackoffLowWatermark = 0.8
+			options.AdaptiveRetryBackoffHighWatermark = 0.5
+		},
+		"retry slow start without retry budget": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.RetrySlowStartWindow = time.Minute
+		},
+		"negative new task reserved fraction": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.NewTaskReservedFraction = -0.1
+		},
+		"new task reserved fraction above one": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.NewTaskReservedFraction = 1.5
+		},
+		"preempting rounds with fair queuing": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PreemptRoundOnHighPriority = true
+			options.FairQueuing = true
+		},
+		"preempting rounds with custom dispatch strategy": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PreemptRoundOnHighPriority = true
+			options.DispatchStrategy = NewStrictPriorityDispatchStrategy()
+		},
+		"borrow capacity without max concurrency": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.BorrowCapacity = true
+		},
+		"borrow capacity without any priority limited": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.BorrowCapacity = true
+			options.MaxConcurrencyByPriority = []int{0, 0}
+		},
+		"age priority escalation without higher priority": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.AgePriorityEscalation = map[int]time.Duration{0: time.Minute}
+		},
+		"invalid age priority escalation": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.AgePriorityEscalation = map[int]time.Duration{1: 0}
+		},
+		"negative age priority escalation interval": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.AgePriorityEscalationInterval = -time.Second
+		},
+		"age priority escalation with preserved order": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.AgePriorityEscalation = map[int]time.Duration{1: time.Minute}
+			options.PreserveIntraPriorityOrder = []int{1}
+		},
+		"drain on stop with dynamic priority": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.DrainOnStop = true
+			options.DynamicPriority = true
+		},
+		"negative effective concurrency window": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.EffectiveConcurrencyWindow = -time.Second
+		},
+		"effective concurrency without max concurrency": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.EffectiveConcurrencyWindow = time.Minute
+		},
+		"execution share with borrowing capacity": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ExecutionShare = true
+			options.MaxConcurrencyByPriority = []int{1}
+			options.BorrowCapacity = true
+		},
+		"retry requeue backoff without retry requeue": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.RetryRequeueBackoff = true
+		},
+		"negative weight drift window": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.WeightDriftWindow = -time.Second
+		},
+		"negative dispatcher shutdown timeout": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.DispatcherShutdownTimeout = -time.Second
+		},
+		"worker pool with processor shutdown timeout": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.WorkerPool = &SharedWorkerPool{}
+			options.ProcessorShutdownTimeout = time.Second
+		},
+		"negative processor shutdown timeout": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ProcessorShutdownTimeout = -time.Second
+		},
+		"negative max consecutive processor failures": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.MaxConsecutiveProcessorFailures = -1
+		},
+		"negative processor capacity wait": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ProcessorCapacityWait = -time.Second
+		},
+		"non-positive resource budget": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ResourceBudgets = map[string]float64{"cpu": 0}
+		},
+		"negative batch window": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.BatchWindow = -time.Second
+		},
+		"negative max batch size": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.MaxBatchSize = -1
+		},
+		"negative reserved capacity": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ReservedCapacity = []int{1, -1}
+		},
+		"reserved capacity exceeding queue size": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ReservedCapacity = []int{options.QueueSize, 1}
+		},
+		"reserved capacity with lock-free queues": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ReservedCapacity = []int{1}
+			options.LockFreeQueues = true
+		},
+		"negative enqueue time tolerance": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.EnqueueTimeTolerance = -time.Second
+		},
+		"negative weight ratio warning threshold": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.WeightRatioWarningThreshold = -1
+		},
+		"priority order missing priority": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PriorityOrder = []int{1}
+		},
+		"priority order without weight": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PriorityOrder = []int{0, 2}
+		},
+		"duplicate priority in priority order": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.PriorityOrder = []int{1, 1}
+		},
+		"dynamic priority with idle only": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.DynamicPriority = true
+			options.IdleOnly = []int{1}
+		},
+		"express priority is idle only": func(options *WeightedRoundRobinTaskSchedulerOptions) {
+			options.ExpressPriority = common.IntPtr(1)
+			options.IdleOnly = []int{1}
+		},
+	}
+	for name, update := range testCases {
+		options := newOptions()
+		update(options)
+		s.Error(ValidateOptions(options), name)
+	}
+}
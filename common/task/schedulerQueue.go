@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// SchedulerQueue is a WRR task scheduler without a processor, the tasks are pulled via Dequeue
+	// in the order determined by the dispatch strategy instead, and are processed by the caller,
+	// who is responsible for acking or nacking them. The dispatchers hand each task over to a
+	// consumer blocked in Dequeue, so at most DispatcherCount tasks are removed from their queues
+	// ahead of the consumers.
+	//
+	// Options related to the processor, WorkerCount, ProcessorQueueSize, RetryPolicy and
+	// ExecuteContext, don't apply, and updating the worker count via Reconfigure fails
+	SchedulerQueue interface {
+		WeightedRoundRobinTaskScheduler
+		// Dequeue blocks until the next task is dispatched, the context is done or the queue is stopped,
+		// it's safe to be called concurrently by multiple consumers
+		Dequeue(ctx context.Context) (PriorityTask, error)
+	}
+
+	schedulerQueueImpl struct {
+		*weightedRoundRobinTaskSchedulerImpl
+
+		processor *handoffProcessor
+	}
+
+	// handoffProcessor is the processor of a scheduler queue, which
+	// passes the dispatched tasks to the consumers of the queue
+	handoffProcessor struct {
+		tasksCh    chan PriorityTask
+		shutdownCh <-chan struct{}
+	}
+)
+
+var _ Processor = (*handoffProcessor)(nil)
+
+// NewSchedulerQueue creates a new scheduler queue, the tasks are dispatched as the WRR task scheduler created
+// with the same options would, except that RetryRequeue, WorkerPool, warmup, IdleOnly and circuit breakers are
+// not supported
+func NewSchedulerQueue(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) (SchedulerQueue, error) {
+	if options.RetryRequeue || options.WorkerPool != nil || (options.WarmupDuration > 0 && options.WarmupWorkerCount > 0) ||
+		len(options.IdleOnly) != 0 || options.CircuitBreakerFailureThreshold > 0 {
+		return nil, errors.New(
+			"scheduler queue can't be used with retry requeue, shared worker pool, warmup, idle only or circuit breakers",
+		)
+	}
+
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(logger, metricsClient, options)
+	if err != nil {
+		return nil, err
+	}
+
+	schedulerImpl := scheduler.(*weightedRoundRobinTaskSchedulerImpl)
+	processor := &handoffProcessor{
+		tasksCh:    make(chan PriorityTask),
+		shutdownCh: schedulerImpl.shutdownCh,
+	}
+	schedulerImpl.processor = processor
+	return &schedulerQueueImpl{
+		weightedRoundRobinTaskSchedulerImpl: schedulerImpl,
+		processor:                           processor,
+	}, nil
+}
+
+func (q *schedulerQueueImpl) Dequeue(
+	ctx context.Context,
+) (PriorityTask, error) {
+	select {
+	case task := <-q.processor.tasksCh:
+		return task, nil
+	case <-q.shutdownCh:
+		return nil, ErrTaskSchedulerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *handoffProcessor) Start() {}
+
+func (p *handoffProcessor) Stop() {}
+
+// Submit blocks until the task is taken by
+// a consumer or the scheduler is stopped
+func (p *handoffProcessor) Submit(
+	task Task,
+) error {
+	select {
+	case p.tasksCh <- task.(PriorityTask):
+		return nil
+	case <-p.shutdownCh:
+		return ErrTaskProcessorClosed
+	}
+}
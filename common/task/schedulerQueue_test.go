@@ -0,0 +1,213 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	schedulerQueueSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestSchedulerQueueSuite(t *testing.T) {
+	s := new(schedulerQueueSuite)
+	suite.Run(t, s)
+}
+
+func (s *schedulerQueueSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *schedulerQueueSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *schedulerQueueSuite) TestDequeue_Weighted() {
+	queue := s.newTestSchedulerQueue(&WeightedRoundRobinTaskSchedulerOptions{
+		AllowSubmitBeforeStart: true,
+	})
+
+	// tasks are submitted before starting, so that they are all
+	// queued when the dispatch strategy is first consulted
+	numTasksPerPriority := 6
+	for priority := 0; priority != 3; priority++ {
+		for i := 0; i != numTasksPerPriority; i++ {
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			s.NoError(queue.Submit(mockTask))
+		}
+	}
+	queue.Start()
+	defer queue.Stop()
+
+	// a full round dispatches tasks in proportion to the weights
+	dequeued := make(map[int]int)
+	for i := 0; i != 6; i++ {
+		task, err := queue.Dequeue(context.Background())
+		s.NoError(err)
+		dequeued[task.Priority()]++
+	}
+	s.Equal(map[int]int{0: 3, 1: 2, 2: 1}, dequeued)
+
+	// tasks are not executed by the queue
+	s.Equal(ProcessorStats{}, queue.Stats().Processor)
+}
+
+func (s *schedulerQueueSuite) TestDequeue_ConcurrentConsumers() {
+	queue := s.newTestSchedulerQueue(&WeightedRoundRobinTaskSchedulerOptions{})
+	queue.Start()
+	defer queue.Stop()
+
+	numConsumers := 5
+	numTasks := 50
+	var consumersWG sync.WaitGroup
+	consumersWG.Add(numConsumers)
+	var lock sync.Mutex
+	dequeued := make(map[PriorityTask]int)
+	for i := 0; i != numConsumers; i++ {
+		go func() {
+			defer consumersWG.Done()
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				task, err := queue.Dequeue(ctx)
+				cancel()
+				if err != nil {
+					return
+				}
+				task.Ack()
+				lock.Lock()
+				dequeued[task]++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 3).AnyTimes()
+		mockTask.EXPECT().Ack().Times(1)
+		s.NoError(queue.Submit(mockTask))
+	}
+	consumersWG.Wait()
+
+	s.Len(dequeued, numTasks)
+	for _, count := range dequeued {
+		s.Equal(1, count)
+	}
+}
+
+func (s *schedulerQueueSuite) TestDequeue_ContextDone() {
+	queue := s.newTestSchedulerQueue(&WeightedRoundRobinTaskSchedulerOptions{})
+	queue.Start()
+	defer queue.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	task, err := queue.Dequeue(ctx)
+	s.Nil(task)
+	s.Equal(context.Canceled, err)
+}
+
+func (s *schedulerQueueSuite) TestStop() {
+	queue := s.newTestSchedulerQueue(&WeightedRoundRobinTaskSchedulerOptions{NackOnStop: true})
+	queue.Start()
+
+	// the first task is held by the dispatcher waiting for a consumer,
+	// and the second one is still queued, both of them are nacked on stop
+	var nackWG sync.WaitGroup
+	nackWG.Add(2)
+	for i := 0; i != 2; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		mockTask.EXPECT().Nack().Do(func() { nackWG.Done() }).Times(1)
+		s.NoError(queue.Submit(mockTask))
+	}
+	for queue.Stats().QueuedTasks[0] != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	queue.Stop()
+	nackWG.Wait()
+
+	task, err := queue.Dequeue(context.Background())
+	s.Nil(task)
+	s.Equal(ErrTaskSchedulerClosed, err)
+}
+
+func (s *schedulerQueueSuite) TestReconfigure() {
+	queue := s.newTestSchedulerQueue(&WeightedRoundRobinTaskSchedulerOptions{})
+
+	s.NoError(queue.Reconfigure(ReconfigureOptions{Weights: map[int]int{0: 1, 1: 1, 2: 1}}))
+	s.Error(queue.Reconfigure(ReconfigureOptions{WorkerCount: 3}))
+}
+
+func (s *schedulerQueueSuite) TestIncompatibleOptions() {
+	for _, options := range []*WeightedRoundRobinTaskSchedulerOptions{
+		{RetryRequeue: true},
+		{WorkerPool: &SharedWorkerPool{}},
+		{WarmupDuration: time.Second, WarmupWorkerCount: 1},
+		{IdleOnly: []int{2}},
+	} {
+		options.Weights = testSchedulerWeights
+		_, err := NewSchedulerQueue(
+			loggerimpl.NewDevelopmentForTest(s.Suite),
+			metrics.NewClient(tally.NoopScope, metrics.Common),
+			options,
+		)
+		s.Error(err)
+	}
+}
+
+func (s *schedulerQueueSuite) newTestSchedulerQueue(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) SchedulerQueue {
+	options.Weights = testSchedulerWeights
+	options.QueueSize = 100
+	options.DispatcherCount = 1
+	options.RetryPolicy = backoff.NewExponentialRetryPolicy(time.Millisecond)
+	queue, err := NewSchedulerQueue(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		options,
+	)
+	s.NoError(err)
+	return queue
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// SequencedSchedulerOptions configs the sequenced scheduler
+	SequencedSchedulerOptions struct {
+		// InitialSequence is the sequence number of the first task to dispatch
+		InitialSequence int64
+		// BufferSize is the max number of out of order tasks held until the missing sequences arrive
+		BufferSize int
+		// GapTimeout, if specified, skips the missing sequences once the next expected task hasn't
+		// arrived for this long while later tasks are held, tasks of the skipped sequences are then rejected
+		GapTimeout time.Duration
+	}
+
+	// sequencedScheduler submits SequencedTasks to the underlying scheduler strictly
+	// in the order of their sequence numbers, regardless of the order they arrive
+	sequencedScheduler struct {
+		sync.Mutex
+
+		status       int32
+		scheduler    Scheduler
+		logger       log.Logger
+		metricsScope metrics.Scope
+		options      *SequencedSchedulerOptions
+
+		// the following fields are protected by the lock
+		nextSequence int64
+		pendingTasks map[int64]SequencedTask
+		gapTimer     *time.Timer
+	}
+)
+
+var _ Scheduler = (*sequencedScheduler)(nil)
+
+var (
+	// ErrNotSequencedTask is the error returned when submitting a task not implementing SequencedTask
+	ErrNotSequencedTask = errors.New("task does not implement SequencedTask")
+	// ErrStaleSequence is the error returned when submitting a task whose sequence
+	// is already dispatched, skipped or held by the sequenced scheduler
+	ErrStaleSequence = errors.New("task sequence is already dispatched, skipped or pending")
+	// ErrSequenceBufferFull is the error returned when an out of order task can't be held
+	ErrSequenceBufferFull = errors.New("sequenced scheduler buffer is full")
+)
+
+// NewSequencedScheduler creates a scheduler which holds out of order SequencedTasks and submits each task to the
+// given scheduler only after all the tasks with smaller sequence numbers are submitted, so tasks are processed in
+// sequence as long as the given scheduler dispatches tasks in submission order, e.g. a single worker WRR task
+// scheduler with the tasks of one priority. Submitting the next expected task blocks until the task, along with
+// the held tasks following it, is accepted by the given scheduler, TrySubmit only fails fast when the buffer is full
+func NewSequencedScheduler(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	scheduler Scheduler,
+	options *SequencedSchedulerOptions,
+) Scheduler {
+	return &sequencedScheduler{
+		status:       common.DaemonStatusInitialized,
+		scheduler:    scheduler,
+		logger:       logger,
+		metricsScope: metricsClient.Scope(metrics.TaskSchedulerScope),
+		options:      options,
+		nextSequence: options.InitialSequence,
+		pendingTasks: make(map[int64]SequencedTask),
+	}
+}
+
+func (s *sequencedScheduler) Start() {
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
+		return
+	}
+
+	s.scheduler.Start()
+}
+
+// Stop stops the underlying scheduler and nacks the tasks held for missing sequences
+func (s *sequencedScheduler) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusStarted, common.DaemonStatusStopped) {
+		return
+	}
+
+	s.Lock()
+	if s.gapTimer != nil {
+		s.gapTimer.Stop()
+		s.gapTimer = nil
+	}
+	pendingTasks := s.pendingTasks
+	s.pendingTasks = make(map[int64]SequencedTask)
+	s.Unlock()
+
+	s.scheduler.Stop()
+	for _, task := range pendingTasks {
+		task.Nack()
+	}
+}
+
+func (s *sequencedScheduler) Submit(
+	task PriorityTask,
+) error {
+	_, err := s.submit(task)
+	return err
+}
+
+func (s *sequencedScheduler) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	submitted, err := s.submit(task)
+	if err == ErrSequenceBufferFull {
+		return false, nil
+	}
+	return submitted, err
+}
+
+func (s *sequencedScheduler) submit(
+	task PriorityTask,
+) (bool, error) {
+	sequencedTask, ok := task.(SequencedTask)
+	if !ok {
+		return false, ErrNotSequencedTask
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if atomic.LoadInt32(&s.status) == common.DaemonStatusStopped {
+		return false, ErrTaskSchedulerClosed
+	}
+
+	sequence := sequencedTask.Sequence()
+	if _, ok := s.pendingTasks[sequence]; ok || sequence < s.nextSequence {
+		return false, ErrStaleSequence
+	}
+	if sequence != s.nextSequence {
+		if len(s.pendingTasks) >= s.options.BufferSize {
+			return false, ErrSequenceBufferFull
+		}
+		s.pendingTasks[sequence] = sequencedTask
+		s.updateGap()
+		return true, nil
+	}
+
+	if err := s.scheduler.Submit(sequencedTask); err != nil {
+		return false, err
+	}
+	s.nextSequence++
+	s.releasePendingTasks()
+	return true, nil
+}
+
+// releasePendingTasks submits the held tasks which are next in sequence, held tasks
+// rejected by the underlying scheduler are nacked, as the following tasks can't wait for them
+func (s *sequencedScheduler) releasePendingTasks() {
+	for {
+		task, ok := s.pendingTasks[s.nextSequence]
+		if !ok {
+			break
+		}
+		delete(s.pendingTasks, s.nextSequence)
+		s.nextSequence++
+		if err := s.scheduler.Submit(task); err != nil {
+			s.logger.Error("fail to submit sequenced task to scheduler", tag.Error(err))
+			task.Nack()
+		}
+	}
+
+	// the next expected sequence has changed, so the time waiting for it restarts
+	if s.gapTimer != nil {
+		s.gapTimer.Stop()
+		s.gapTimer = nil
+	}
+	s.updateGap()
+}
+
+// updateGap emits the number of sequences missing before the held tasks, and
+// starts waiting for the next expected sequence if GapTimeout is specified
+func (s *sequencedScheduler) updateGap() {
+	if len(s.pendingTasks) == 0 {
+		s.metricsScope.UpdateGauge(metrics.PriorityTaskSequenceGap, 0)
+		return
+	}
+	s.metricsScope.UpdateGauge(metrics.PriorityTaskSequenceGap, float64(s.minPendingSequence()-s.nextSequence))
+
+	if s.options.GapTimeout > 0 && s.gapTimer == nil {
+		gapSequence := s.nextSequence
+		s.gapTimer = time.AfterFunc(s.options.GapTimeout, func() {
+			s.skipGap(gapSequence)
+		})
+	}
+}
+
+// skipGap skips the missing sequences if the given sequence is still the next expected one
+func (s *sequencedScheduler) skipGap(
+	gapSequence int64,
+) {
+	s.Lock()
+	defer s.Unlock()
+
+	// the timer may fire after the gap is filled or the scheduler is stopped,
+	// in which case the timer is already stopped and possibly replaced
+	if s.nextSequence != gapSequence || len(s.pendingTasks) == 0 {
+		return
+	}
+
+	minSequence := s.minPendingSequence()
+	s.metricsScope.AddCounter(metrics.PriorityTaskSequenceSkipped, minSequence-s.nextSequence)
+	s.logger.Warn("Sequenced scheduler skipped missing sequences.",
+		tag.Counter(int(minSequence-s.nextSequence)))
+	s.nextSequence = minSequence
+	s.gapTimer = nil
+	s.releasePendingTasks()
+}
+
+func (s *sequencedScheduler) minPendingSequence() int64 {
+	first := true
+	var minSequence int64
+	for sequence := range s.pendingTasks {
+		if first || sequence < minSequence {
+			minSequence = sequence
+			first = false
+		}
+	}
+	return minSequence
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	sequencedSchedulerSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller    *gomock.Controller
+		mockScheduler *MockScheduler
+		testScope     tally.TestScope
+
+		sequencedScheduler *sequencedScheduler
+	}
+)
+
+func TestSequencedSchedulerSuite(t *testing.T) {
+	s := new(sequencedSchedulerSuite)
+	suite.Run(t, s)
+}
+
+func (s *sequencedSchedulerSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockScheduler = NewMockScheduler(s.controller)
+	s.testScope = tally.NewTestScope("test", nil)
+
+	s.sequencedScheduler = s.newTestSequencedScheduler(&SequencedSchedulerOptions{
+		InitialSequence: 10,
+		BufferSize:      2,
+	})
+}
+
+func (s *sequencedSchedulerSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *sequencedSchedulerSuite) TestSubmit_InSequence() {
+	tasks := s.newTestSequencedTasks(10, 13)
+	gomock.InOrder(
+		s.mockScheduler.EXPECT().Submit(tasks[0]).Return(nil),
+		s.mockScheduler.EXPECT().Submit(tasks[1]).Return(nil),
+		s.mockScheduler.EXPECT().Submit(tasks[2]).Return(nil),
+	)
+
+	s.NoError(s.sequencedScheduler.Submit(tasks[2]))
+	s.Equal(float64(2), s.getSequenceGap())
+	submitted, err := s.sequencedScheduler.TrySubmit(tasks[1])
+	s.NoError(err)
+	s.True(submitted)
+	s.Equal(float64(1), s.getSequenceGap())
+	s.NoError(s.sequencedScheduler.Submit(tasks[0]))
+	s.Equal(float64(0), s.getSequenceGap())
+	s.Equal(int64(13), s.sequencedScheduler.nextSequence)
+	s.Empty(s.sequencedScheduler.pendingTasks)
+}
+
+func (s *sequencedSchedulerSuite) TestSubmit_Rejected() {
+	s.Equal(ErrNotSequencedTask, s.sequencedScheduler.Submit(NewMockPriorityTask(s.controller)))
+
+	tasks := s.newTestSequencedTasks(9, 14)
+	s.Equal(ErrStaleSequence, s.sequencedScheduler.Submit(tasks[0]))
+	s.NoError(s.sequencedScheduler.Submit(tasks[2]))
+	s.Equal(ErrStaleSequence, s.sequencedScheduler.Submit(tasks[2]))
+	s.NoError(s.sequencedScheduler.Submit(tasks[3]))
+
+	// the buffer is full, while the next expected task is still accepted
+	s.Equal(ErrSequenceBufferFull, s.sequencedScheduler.Submit(tasks[4]))
+	submitted, err := s.sequencedScheduler.TrySubmit(tasks[4])
+	s.NoError(err)
+	s.False(submitted)
+
+	// held tasks rejected by the underlying scheduler are nacked
+	gomock.InOrder(
+		s.mockScheduler.EXPECT().Submit(tasks[1]).Return(nil),
+		s.mockScheduler.EXPECT().Submit(tasks[2]).Return(ErrTaskSchedulerClosed),
+		tasks[2].(*MockSequencedTask).EXPECT().Nack(),
+		s.mockScheduler.EXPECT().Submit(tasks[3]).Return(nil),
+	)
+	s.NoError(s.sequencedScheduler.Submit(tasks[1]))
+	s.Equal(int64(13), s.sequencedScheduler.nextSequence)
+}
+
+func (s *sequencedSchedulerSuite) TestGapTimeout() {
+	s.sequencedScheduler = s.newTestSequencedScheduler(&SequencedSchedulerOptions{
+		InitialSequence: 10,
+		BufferSize:      2,
+		GapTimeout:      10 * time.Millisecond,
+	})
+
+	tasks := s.newTestSequencedTasks(10, 13)
+	submittedCh := make(chan struct{})
+	s.mockScheduler.EXPECT().Submit(tasks[2]).Do(func(_ PriorityTask) { close(submittedCh) }).Return(nil)
+	s.NoError(s.sequencedScheduler.Submit(tasks[2]))
+
+	select {
+	case <-submittedCh:
+	case <-time.After(time.Second):
+		s.Fail("missing sequences are not skipped")
+	}
+	s.Equal(ErrStaleSequence, s.sequencedScheduler.Submit(tasks[0]))
+
+	s.sequencedScheduler.Lock()
+	defer s.sequencedScheduler.Unlock()
+	s.Equal(int64(13), s.sequencedScheduler.nextSequence)
+	s.Nil(s.sequencedScheduler.gapTimer)
+	skipped := int64(0)
+	for _, counter := range s.testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_sequence_skipped" {
+			skipped += counter.Value()
+		}
+	}
+	s.Equal(int64(2), skipped)
+}
+
+func (s *sequencedSchedulerSuite) TestStartStop() {
+	s.mockScheduler.EXPECT().Start().Times(1)
+	s.sequencedScheduler.Start()
+
+	tasks := s.newTestSequencedTasks(11, 12)
+	s.NoError(s.sequencedScheduler.Submit(tasks[0]))
+
+	s.mockScheduler.EXPECT().Stop().Times(1)
+	tasks[0].(*MockSequencedTask).EXPECT().Nack().Times(1)
+	s.sequencedScheduler.Stop()
+
+	s.Equal(ErrTaskSchedulerClosed, s.sequencedScheduler.Submit(s.newTestSequencedTasks(10, 11)[0]))
+}
+
+func (s *sequencedSchedulerSuite) newTestSequencedScheduler(
+	options *SequencedSchedulerOptions,
+) *sequencedScheduler {
+	return NewSequencedScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(s.testScope, metrics.Common),
+		s.mockScheduler,
+		options,
+	).(*sequencedScheduler)
+}
+
+func (s *sequencedSchedulerSuite) newTestSequencedTasks(
+	from int64,
+	to int64,
+) []SequencedTask {
+	var tasks []SequencedTask
+	for sequence := from; sequence != to; sequence++ {
+		mockTask := NewMockSequencedTask(s.controller)
+		mockTask.EXPECT().Sequence().Return(sequence).AnyTimes()
+		tasks = append(tasks, mockTask)
+	}
+	return tasks
+}
+
+func (s *sequencedSchedulerSuite) getSequenceGap() float64 {
+	for _, gauge := range s.testScope.Snapshot().Gauges() {
+		if gauge.Name() == "test.prioritytask_sequence_gap" {
+			return gauge.Value()
+		}
+	}
+	return -1
+}
@@ -183,7 +183,7 @@ func (t *sequentialTaskProcessorImpl) processTaskOnce(taskqueue SequentialTaskQu
 		if task.RetryErr(err) {
 			taskqueue.Add(task)
 		} else {
-			t.logger.Error("Unable to process task", tag.Error(err))
+			t.logger.Error("Unable to process task", appendCorrelationTag([]tag.Tag{tag.Error(err)}, task)...)
 			task.Nack()
 		}
 	} else {
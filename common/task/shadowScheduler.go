@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync/atomic"
+
+	"github.com/uber/cadence/common"
+)
+
+type (
+	// shadowScheduler mirrors submissions to a shadow scheduler, so that a new
+	// scheduler config can be evaluated against production traffic
+	shadowScheduler struct {
+		status          int32
+		primary         Scheduler
+		shadow          Scheduler
+		shadowTransform func(task PriorityTask) PriorityTask
+	}
+)
+
+var _ Scheduler = (*shadowScheduler)(nil)
+
+// NewShadowScheduler creates a scheduler which submits tasks to the primary scheduler, and for each
+// task accepted by the primary, submits shadowTransform(task) to the shadow scheduler. The transform
+// is applied before the task is submitted to the primary, and must return a task which is safe to
+// execute alongside the original one, e.g. a no-op, or nil to skip shadowing the task for sampling.
+// Only the primary's result is returned to the caller. Shadow submissions never block, shadow
+// tasks not accepted by the shadow scheduler, or derived from tasks rejected by the primary, are nacked
+func NewShadowScheduler(
+	primary Scheduler,
+	shadow Scheduler,
+	shadowTransform func(task PriorityTask) PriorityTask,
+) Scheduler {
+	return &shadowScheduler{
+		status:          common.DaemonStatusInitialized,
+		primary:         primary,
+		shadow:          shadow,
+		shadowTransform: shadowTransform,
+	}
+}
+
+func (s *shadowScheduler) Start() {
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
+		return
+	}
+
+	s.primary.Start()
+	s.shadow.Start()
+}
+
+func (s *shadowScheduler) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusStarted, common.DaemonStatusStopped) {
+		return
+	}
+
+	s.primary.Stop()
+	s.shadow.Stop()
+}
+
+func (s *shadowScheduler) Submit(
+	task PriorityTask,
+) error {
+	// the shadow task is derived before the task is handed to the primary
+	// scheduler, which may be executing the task once it's submitted
+	shadowTask := s.shadowTransform(task)
+	if err := s.primary.Submit(task); err != nil {
+		s.discardShadow(shadowTask)
+		return err
+	}
+	s.submitShadow(shadowTask)
+	return nil
+}
+
+func (s *shadowScheduler) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	shadowTask := s.shadowTransform(task)
+	submitted, err := s.primary.TrySubmit(task)
+	if err != nil || !submitted {
+		s.discardShadow(shadowTask)
+		return submitted, err
+	}
+	s.submitShadow(shadowTask)
+	return true, nil
+}
+
+func (s *shadowScheduler) submitShadow(
+	shadowTask PriorityTask,
+) {
+	if shadowTask == nil {
+		return
+	}
+	// errors are not returned, the shadow scheduler must not affect the primary,
+	// but the rejected shadow task is still completed so it's not leaked
+	if submitted, err := s.shadow.TrySubmit(shadowTask); err != nil || !submitted {
+		shadowTask.Nack()
+	}
+}
+
+func (s *shadowScheduler) discardShadow(
+	shadowTask PriorityTask,
+) {
+	if shadowTask != nil {
+		shadowTask.Nack()
+	}
+}
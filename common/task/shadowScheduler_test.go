@@ -0,0 +1,122 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	shadowSchedulerSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller      *gomock.Controller
+		mockPrimary     *MockScheduler
+		mockShadow      *MockScheduler
+		shadowTasks     map[PriorityTask]PriorityTask
+		shadowScheduler Scheduler
+	}
+)
+
+func TestShadowSchedulerSuite(t *testing.T) {
+	s := new(shadowSchedulerSuite)
+	suite.Run(t, s)
+}
+
+func (s *shadowSchedulerSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockPrimary = NewMockScheduler(s.controller)
+	s.mockShadow = NewMockScheduler(s.controller)
+	s.shadowTasks = make(map[PriorityTask]PriorityTask)
+
+	s.shadowScheduler = NewShadowScheduler(s.mockPrimary, s.mockShadow, func(task PriorityTask) PriorityTask {
+		return s.shadowTasks[task]
+	})
+}
+
+func (s *shadowSchedulerSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *shadowSchedulerSuite) TestStartStop() {
+	s.mockPrimary.EXPECT().Start().Times(1)
+	s.mockShadow.EXPECT().Start().Times(1)
+	s.shadowScheduler.Start()
+	s.shadowScheduler.Start()
+
+	s.mockPrimary.EXPECT().Stop().Times(1)
+	s.mockShadow.EXPECT().Stop().Times(1)
+	s.shadowScheduler.Stop()
+	s.shadowScheduler.Stop()
+}
+
+func (s *shadowSchedulerSuite) TestSubmit() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockShadowTask := NewMockPriorityTask(s.controller)
+	s.shadowTasks[mockTask] = mockShadowTask
+
+	s.mockPrimary.EXPECT().Submit(mockTask).Return(nil).Times(1)
+	s.mockShadow.EXPECT().TrySubmit(mockShadowTask).Return(true, nil).Times(1)
+	s.NoError(s.shadowScheduler.Submit(mockTask))
+
+	// shadow tasks rejected by the shadow scheduler are nacked
+	s.mockPrimary.EXPECT().Submit(mockTask).Return(nil).Times(1)
+	s.mockShadow.EXPECT().TrySubmit(mockShadowTask).Return(false, errors.New("some random error")).Times(1)
+	mockShadowTask.EXPECT().Nack().Times(1)
+	s.NoError(s.shadowScheduler.Submit(mockTask))
+
+	// tasks rejected by the primary are not shadowed
+	s.mockPrimary.EXPECT().Submit(mockTask).Return(ErrTaskSchedulerClosed).Times(1)
+	mockShadowTask.EXPECT().Nack().Times(1)
+	s.Equal(ErrTaskSchedulerClosed, s.shadowScheduler.Submit(mockTask))
+
+	// tasks are not shadowed if the transform returns nil
+	unsampledTask := NewMockPriorityTask(s.controller)
+	s.mockPrimary.EXPECT().Submit(unsampledTask).Return(nil).Times(1)
+	s.NoError(s.shadowScheduler.Submit(unsampledTask))
+}
+
+func (s *shadowSchedulerSuite) TestTrySubmit() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockShadowTask := NewMockPriorityTask(s.controller)
+	s.shadowTasks[mockTask] = mockShadowTask
+
+	s.mockPrimary.EXPECT().TrySubmit(mockTask).Return(true, nil).Times(1)
+	s.mockShadow.EXPECT().TrySubmit(mockShadowTask).Return(false, nil).Times(1)
+	mockShadowTask.EXPECT().Nack().Times(1)
+	submitted, err := s.shadowScheduler.TrySubmit(mockTask)
+	s.NoError(err)
+	s.True(submitted)
+
+	s.mockPrimary.EXPECT().TrySubmit(mockTask).Return(false, nil).Times(1)
+	mockShadowTask.EXPECT().Nack().Times(1)
+	submitted, err = s.shadowScheduler.TrySubmit(mockTask)
+	s.NoError(err)
+	s.False(submitted)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+)
+
+type (
+	// sharedQueueCapacity bounds the total number of tasks queued across the task queues of all priorities,
+	// with a number of slots reserved for each priority which can't be taken by the other priorities. Slots
+	// of a priority are taken from its reservation first, and from the unreserved slots once it's used up
+	sharedQueueCapacity struct {
+		sync.Mutex
+		reserved   []int // immutable
+		unreserved int   // immutable
+		// queued is the number of slots taken by each priority
+		queued map[int]int
+		// sharedQueued is the number of unreserved slots taken by all priorities
+		sharedQueued int
+		// releasedCh is created when an acquisition waits for a slot and closed when slots are released
+		releasedCh chan struct{}
+
+		// onUpdate is invoked with the number of reserved and unreserved slots taken by a priority whenever they change
+		onUpdate func(priority int, reservedQueued int, sharedQueued int)
+	}
+)
+
+func newSharedQueueCapacity(
+	capacity int,
+	reserved []int,
+	onUpdate func(priority int, reservedQueued int, sharedQueued int),
+) *sharedQueueCapacity {
+	unreserved := capacity
+	for _, count := range reserved {
+		unreserved -= count
+	}
+	return &sharedQueueCapacity{
+		reserved:   append([]int(nil), reserved...),
+		unreserved: unreserved,
+		queued:     make(map[int]int),
+		onUpdate:   onUpdate,
+	}
+}
+
+// acquire takes slots for the given number of tasks of the priority,
+// returns false if the priority can't take enough slots
+func (c *sharedQueueCapacity) acquire(
+	priority int,
+	count int,
+) bool {
+	c.Lock()
+	queued := c.queued[priority]
+	shared := sharedSlots(queued+count, c.reservedSlots(priority)) - sharedSlots(queued, c.reservedSlots(priority))
+	if c.sharedQueued+shared > c.unreserved {
+		c.Unlock()
+		return false
+	}
+	c.queued[priority] = queued + count
+	c.sharedQueued += shared
+	reservedQueued, sharedQueued := c.usageLocked(priority)
+	c.Unlock()
+
+	c.onUpdate(priority, reservedQueued, sharedQueued)
+	return true
+}
+
+// release returns the slots of the given number of tasks of the priority,
+// unreserved slots are returned before the reserved ones
+func (c *sharedQueueCapacity) release(
+	priority int,
+	count int,
+) {
+	c.Lock()
+	queued := c.queued[priority]
+	if count > queued {
+		count = queued
+	}
+	c.sharedQueued -= sharedSlots(queued, c.reservedSlots(priority)) - sharedSlots(queued-count, c.reservedSlots(priority))
+	if queued == count {
+		delete(c.queued, priority)
+	} else {
+		c.queued[priority] = queued - count
+	}
+	if c.releasedCh != nil {
+		close(c.releasedCh)
+		c.releasedCh = nil
+	}
+	reservedQueued, sharedQueued := c.usageLocked(priority)
+	c.Unlock()
+
+	c.onUpdate(priority, reservedQueued, sharedQueued)
+}
+
+// isFull returns true if the priority can't take another slot
+func (c *sharedQueueCapacity) isFull(
+	priority int,
+) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.queued[priority] >= c.reservedSlots(priority) && c.sharedQueued >= c.unreserved
+}
+
+// released returns a channel closed once slots are released
+func (c *sharedQueueCapacity) released() <-chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.releasedCh == nil {
+		c.releasedCh = make(chan struct{})
+	}
+	return c.releasedCh
+}
+
+func (c *sharedQueueCapacity) reservedSlots(
+	priority int,
+) int {
+	if priority < 0 || priority >= len(c.reserved) {
+		return 0
+	}
+	return c.reserved[priority]
+}
+
+func (c *sharedQueueCapacity) usageLocked(
+	priority int,
+) (int, int) {
+	queued := c.queued[priority]
+	shared := sharedSlots(queued, c.reservedSlots(priority))
+	return queued - shared, shared
+}
+
+// sharedSlots returns the number of unreserved slots taken by the given number of queued tasks
+func sharedSlots(
+	queued int,
+	reserved int,
+) int {
+	if queued <= reserved {
+		return 0
+	}
+	return queued - reserved
+}
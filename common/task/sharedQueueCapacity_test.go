@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	sharedQueueCapacitySuite struct {
+		*require.Assertions
+		suite.Suite
+	}
+)
+
+func TestSharedQueueCapacitySuite(t *testing.T) {
+	s := new(sharedQueueCapacitySuite)
+	suite.Run(t, s)
+}
+
+func (s *sharedQueueCapacitySuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+}
+
+func (s *sharedQueueCapacitySuite) TestAcquire() {
+	usages := make(map[int][2]int)
+	capacity := newSharedQueueCapacity(
+		5,
+		[]int{2, 0, 1},
+		func(priority int, reservedQueued int, sharedQueued int) {
+			usages[priority] = [2]int{reservedQueued, sharedQueued}
+		},
+	)
+
+	// priority 1 takes all the unreserved slots
+	s.True(capacity.acquire(1, 2))
+	s.False(capacity.acquire(1, 1))
+	s.True(capacity.isFull(1))
+	// priorities without a reservation, e.g. out of the reserved range, can't take any slot
+	s.False(capacity.acquire(3, 1))
+	s.Equal(map[int][2]int{1: {0, 2}}, usages)
+
+	// reserved slots are still available, but not beyond the reservation
+	s.False(capacity.isFull(0))
+	s.False(capacity.acquire(0, 3))
+	s.True(capacity.acquire(0, 2))
+	s.True(capacity.isFull(0))
+	s.True(capacity.acquire(2, 1))
+	s.Equal(map[int][2]int{0: {2, 0}, 1: {0, 2}, 2: {1, 0}}, usages)
+
+	// an unreserved slot released by priority 1 can be taken by priority 0
+	releasedCh := capacity.released()
+	capacity.release(1, 1)
+	<-releasedCh
+	s.True(capacity.acquire(0, 1))
+	s.Equal(map[int][2]int{0: {2, 1}, 1: {0, 1}, 2: {1, 0}}, usages)
+
+	// unreserved slots are released first
+	capacity.release(0, 1)
+	s.Equal([2]int{2, 0}, usages[0])
+	s.True(capacity.acquire(2, 1))
+	s.Equal([2]int{1, 1}, usages[2])
+	s.False(capacity.acquire(1, 1))
+}
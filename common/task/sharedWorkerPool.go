@@ -0,0 +1,184 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	// SharedWorkerPool is a pool of workers shared by multiple WRR task schedulers, which caps the
+	// total number of worker goroutines in a process hosting many schedulers. Each scheduler keeps
+	// its own priority queues and dispatchers, and submits the dispatched tasks to the pool.
+	//
+	// The pool has a single FIFO queue, so there's no fairness across schedulers: weights only apply
+	// among the priorities of the same scheduler, and each scheduler gets workers roughly in proportion
+	// to the rate its dispatchers submit tasks. A busy scheduler can occupy all the workers, its
+	// DispatcherCount and MaxConcurrencyByPriority can be used to bound its share.
+	//
+	// The pool is started and stopped independently of the schedulers, it should be started before
+	// and stopped after all the schedulers using it. Stopping a scheduler doesn't wait for its tasks
+	// already submitted to the pool
+	SharedWorkerPool struct {
+		processor *parallelTaskProcessorImpl
+	}
+
+	// sharedWorkerPoolProcessor is the processor of a scheduler using a shared worker pool,
+	// its lifecycle is managed by the pool instead of the scheduler
+	sharedWorkerPoolProcessor struct {
+		pool       *SharedWorkerPool
+		shutdownCh <-chan struct{}
+	}
+)
+
+var _ common.Daemon = (*SharedWorkerPool)(nil)
+var _ ParallelTaskProcessor = (*sharedWorkerPoolProcessor)(nil)
+
+var (
+	errSharedWorkerPoolWorkerCount      = errors.New("worker count of a shared worker pool can't be updated via the scheduler")
+	errSharedWorkerPoolGlobalMaxRetries = errors.New("global max retries of a shared worker pool can't be updated via the scheduler")
+)
+
+// NewSharedWorkerPool creates a new worker pool to be specified as the WorkerPool of WRR
+// task scheduler options, WorkerCount of the given options is the cap on the number of workers
+func NewSharedWorkerPool(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	options *ParallelTaskProcessorOptions,
+) *SharedWorkerPool {
+	return &SharedWorkerPool{
+		processor: NewParallelTaskProcessor(logger, metricsClient, options).(*parallelTaskProcessorImpl),
+	}
+}
+
+// Start starts the workers of the pool
+func (p *SharedWorkerPool) Start() {
+	p.processor.Start()
+}
+
+// Stop stops the workers of the pool, tasks submitted by the schedulers afterwards are rejected
+func (p *SharedWorkerPool) Stop() {
+	p.processor.Stop()
+}
+
+// SetWorkerCount updates the number of workers of the pool
+func (p *SharedWorkerPool) SetWorkerCount(
+	count int,
+) error {
+	return p.processor.SetWorkerCount(count)
+}
+
+// Stats returns a snapshot of the pool's internal state
+func (p *SharedWorkerPool) Stats() ProcessorStats {
+	return p.processor.Stats()
+}
+
+// Complete finalizes a task left pending when the pool is created with DeferredAck
+func (p *SharedWorkerPool) Complete(
+	handle TaskHandle,
+	err error,
+) error {
+	return p.processor.Complete(handle, err)
+}
+
+// WasStarted returns true if the pool has been started, even if it's stopped afterwards
+func (p *SharedWorkerPool) WasStarted() bool {
+	return p.processor.WasStarted()
+}
+
+// InFlightTasks returns descriptors of the tasks being executed by the pool for all its schedulers
+func (p *SharedWorkerPool) InFlightTasks() []InFlightTask {
+	return p.processor.InFlightTasks()
+}
+
+func newSharedWorkerPoolProcessor(
+	pool *SharedWorkerPool,
+	shutdownCh <-chan struct{},
+) *sharedWorkerPoolProcessor {
+	return &sharedWorkerPoolProcessor{
+		pool:       pool,
+		shutdownCh: shutdownCh,
+	}
+}
+
+func (p *sharedWorkerPoolProcessor) Start() {}
+
+func (p *sharedWorkerPoolProcessor) Stop() {}
+
+// Submit blocks until the task is submitted to the pool,
+// or either the pool or the scheduler is stopped
+func (p *sharedWorkerPoolProcessor) Submit(
+	task Task,
+) error {
+	return p.pool.processor.submit(task, p.shutdownCh, nil)
+}
+
+func (p *sharedWorkerPoolProcessor) submitReportingBlocked(
+	task Task,
+	onBlocked func(),
+) error {
+	return p.pool.processor.submit(task, p.shutdownCh, onBlocked)
+}
+
+func (p *sharedWorkerPoolProcessor) bufferOccupancy() float64 {
+	return p.pool.processor.bufferOccupancy()
+}
+
+func (p *sharedWorkerPoolProcessor) TrySubmit(
+	task Task,
+) (bool, error) {
+	return p.pool.processor.TrySubmit(task)
+}
+
+func (p *sharedWorkerPoolProcessor) SetWorkerCount(
+	count int,
+) error {
+	return errSharedWorkerPoolWorkerCount
+}
+
+func (p *sharedWorkerPoolProcessor) SetGlobalMaxRetries(
+	maxRetries int,
+) error {
+	return errSharedWorkerPoolGlobalMaxRetries
+}
+
+func (p *sharedWorkerPoolProcessor) Stats() ProcessorStats {
+	return p.pool.Stats()
+}
+
+func (p *sharedWorkerPoolProcessor) Complete(
+	handle TaskHandle,
+	err error,
+) error {
+	return p.pool.Complete(handle, err)
+}
+
+func (p *sharedWorkerPoolProcessor) WasStarted() bool {
+	return p.pool.WasStarted()
+}
+
+func (p *sharedWorkerPoolProcessor) InFlightTasks() []InFlightTask {
+	return p.pool.InFlightTasks()
+}
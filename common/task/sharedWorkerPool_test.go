@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+)
+
+type (
+	sharedWorkerPoolSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestSharedWorkerPoolSuite(t *testing.T) {
+	s := new(sharedWorkerPoolSuite)
+	suite.Run(t, s)
+}
+
+func (s *sharedWorkerPoolSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *sharedWorkerPoolSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *sharedWorkerPoolSuite) TestSharedAcrossSchedulers() {
+	pool := s.newTestSharedWorkerPool(2)
+	pool.Start()
+	defer pool.Stop()
+
+	numTasks := 10
+	var tasksWG sync.WaitGroup
+	tasksWG.Add(2 * numTasks)
+	for i := 0; i != 2; i++ {
+		scheduler := s.newTestScheduler(pool)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		for j := 0; j != numTasks; j++ {
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(j % 3).AnyTimes()
+			mockTask.EXPECT().Execute().Return(nil).Times(1)
+			mockTask.EXPECT().Ack().Do(func() { tasksWG.Done() }).Times(1)
+			s.NoError(scheduler.Submit(mockTask))
+		}
+
+		// worker count is owned by the pool
+		s.Error(scheduler.Reconfigure(ReconfigureOptions{WorkerCount: 3}))
+		s.Equal(2, scheduler.Stats().Processor.ConfiguredWorkers)
+	}
+	tasksWG.Wait()
+
+	s.Equal(int64(2*numTasks), pool.Stats().SucceededTasks)
+	s.NoError(pool.SetWorkerCount(3))
+	s.Equal(3, pool.Stats().ConfiguredWorkers)
+}
+
+func (s *sharedWorkerPoolSuite) TestSchedulerStop() {
+	// the pool is not started, so the dispatcher blocks when submitting the second task
+	pool := s.newTestSharedWorkerPool(1)
+	scheduler := s.newTestScheduler(pool)
+	scheduler.Start()
+
+	mockTask1 := NewMockPriorityTask(s.controller)
+	mockTask1.EXPECT().Priority().Return(0).AnyTimes()
+	s.NoError(scheduler.Submit(mockTask1))
+	mockTask2 := NewMockPriorityTask(s.controller)
+	mockTask2.EXPECT().Priority().Return(0).AnyTimes()
+	s.NoError(scheduler.Submit(mockTask2))
+	for scheduler.Stats().QueuedTasks[0] != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// stopping the scheduler unblocks its dispatchers without stopping the pool,
+	// the task being submitted is dropped along with the queued tasks rather than nacked
+	scheduler.Stop()
+	s.Equal(1, pool.Stats().QueuedTasks)
+}
+
+func (s *sharedWorkerPoolSuite) TestIncompatibleOptions() {
+	pool := s.newTestSharedWorkerPool(1)
+	for _, options := range []*WeightedRoundRobinTaskSchedulerOptions{
+		{SingleWorker: true},
+		{RetryRequeue: true},
+		{WarmupDuration: time.Second, WarmupWorkerCount: 1},
+		{IdleOnly: []int{2}},
+	} {
+		options.Weights = testSchedulerWeights
+		options.QueueSize = 10
+		options.DispatcherCount = 1
+		options.RetryPolicy = backoff.NewExponentialRetryPolicy(time.Millisecond)
+		options.WorkerPool = pool
+		_, err := NewWeightedRoundRobinTaskScheduler(
+			loggerimpl.NewDevelopmentForTest(s.Suite),
+			metrics.NewClient(tally.NoopScope, metrics.Common),
+			options,
+		)
+		s.Error(err)
+	}
+}
+
+func (s *sharedWorkerPoolSuite) newTestSharedWorkerPool(
+	workerCount int,
+) *SharedWorkerPool {
+	return NewSharedWorkerPool(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:   1,
+			WorkerCount: workerCount,
+			RetryPolicy: backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+}
+
+func (s *sharedWorkerPoolSuite) newTestScheduler(
+	pool *SharedWorkerPool,
+) WeightedRoundRobinTaskScheduler {
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       100,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			WorkerPool:      pool,
+		},
+	)
+	s.NoError(err)
+	return scheduler
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+)
+
+type (
+	// SubmissionRecord describes a submission recorded by a recording scheduler, it's encoded as a JSON line
+	SubmissionRecord struct {
+		// Time is when the task is submitted
+		Time time.Time `json:"time"`
+		// Priority is the priority declared by the task when it's submitted
+		Priority int `json:"priority"`
+		// MetricTags are the tags of MetricTaggedTasks
+		MetricTags map[string]string `json:"metricTags,omitempty"`
+		// CorrelationID is the correlation ID of CorrelatedTasks
+		CorrelationID string `json:"correlationId,omitempty"`
+		// Try indicates the task is submitted via TrySubmit
+		Try bool `json:"try,omitempty"`
+		// Rejected indicates the task is not accepted by the scheduler, with Error if an error is returned
+		Rejected bool   `json:"rejected,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	// recordingScheduler records the submissions to a scheduler,
+	// so that they can be replayed against another scheduler
+	recordingScheduler struct {
+		scheduler Scheduler
+		logger    log.Logger
+
+		sync.Mutex
+		encoder *json.Encoder
+	}
+)
+
+var _ Scheduler = (*recordingScheduler)(nil)
+
+// NewRecordingScheduler creates a scheduler which submits tasks to the given scheduler, and writes a
+// SubmissionRecord for each submission to the sink as a JSON line once the submission returns, so that
+// a production incident can be captured and replayed against another config, see ReadSubmissionRecords.
+// Writes are serialized but not buffered, failures are logged and don't affect the submission
+func NewRecordingScheduler(
+	scheduler Scheduler,
+	sink io.Writer,
+	logger log.Logger,
+) Scheduler {
+	return &recordingScheduler{
+		scheduler: scheduler,
+		logger:    logger,
+		encoder:   json.NewEncoder(sink),
+	}
+}
+
+func (s *recordingScheduler) Start() {
+	s.scheduler.Start()
+}
+
+func (s *recordingScheduler) Stop() {
+	s.scheduler.Stop()
+}
+
+func (s *recordingScheduler) Submit(
+	task PriorityTask,
+) error {
+	// the task is described before it's submitted, as it may be executed and mutated once submitted
+	record := newSubmissionRecord(task)
+	err := s.scheduler.Submit(task)
+	if err != nil {
+		record.Rejected = true
+		record.Error = err.Error()
+	}
+	s.write(record)
+	return err
+}
+
+func (s *recordingScheduler) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	record := newSubmissionRecord(task)
+	record.Try = true
+	submitted, err := s.scheduler.TrySubmit(task)
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.Rejected = !submitted
+	s.write(record)
+	return submitted, err
+}
+
+func (s *recordingScheduler) write(
+	record *SubmissionRecord,
+) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.encoder.Encode(record); err != nil {
+		s.logger.Warn("Failed to record task submission.", tag.Error(err))
+	}
+}
+
+func newSubmissionRecord(
+	task PriorityTask,
+) *SubmissionRecord {
+	record := &SubmissionRecord{
+		Time:     time.Now(),
+		Priority: task.Priority(),
+	}
+	if taggedTask, ok := task.(MetricTaggedTask); ok {
+		// copied as the record is written once the submission returns
+		if tags := taggedTask.MetricTags(); len(tags) != 0 {
+			record.MetricTags = make(map[string]string, len(tags))
+			for key, value := range tags {
+				record.MetricTags[key] = value
+			}
+		}
+	}
+	if correlatedTask, ok := unwrapSchedulerTask(task).(CorrelatedTask); ok {
+		record.CorrelationID = correlatedTask.CorrelationID()
+	}
+	return record
+}
+
+// ReadSubmissionRecords reads the JSON lines written by a recording scheduler, sorted by the
+// submission time. Concurrent submissions are written in the order they return, not the order
+// they're made, so the records are sorted to restore the order of the submissions
+func ReadSubmissionRecords(
+	reader io.Reader,
+) ([]SubmissionRecord, error) {
+	var records []SubmissionRecord
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record SubmissionRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/cadence/common/log/loggerimpl"
+)
+
+func TestRecordingScheduler(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	mockScheduler := NewMockScheduler(controller)
+	var buf bytes.Buffer
+	scheduler := NewRecordingScheduler(mockScheduler, &buf, loggerimpl.NewNopLogger())
+
+	mockScheduler.EXPECT().Start().Times(1)
+	scheduler.Start()
+
+	correlatedTask := &testCorrelatedTask{
+		MockPriorityTask: NewMockPriorityTask(controller),
+		correlationID:    "some random correlation ID",
+	}
+	correlatedTask.EXPECT().Priority().Return(0).Times(1)
+	mockScheduler.EXPECT().Submit(correlatedTask).Return(nil).Times(1)
+	require.NoError(t, scheduler.Submit(correlatedTask))
+
+	mockTaggedTask := NewMockMetricTaggedTask(controller)
+	mockTaggedTask.EXPECT().MetricTags().Return(map[string]string{"domain": "some random domain"}).Times(1)
+	taggedTask := &testMetricTaggedTask{
+		MockPriorityTask:     NewMockPriorityTask(controller),
+		MockMetricTaggedTask: mockTaggedTask,
+	}
+	taggedTask.MockPriorityTask.EXPECT().Priority().Return(1).Times(1)
+	mockScheduler.EXPECT().TrySubmit(taggedTask).Return(false, nil).Times(1)
+	submitted, err := scheduler.TrySubmit(taggedTask)
+	require.NoError(t, err)
+	require.False(t, submitted)
+
+	rejectedTask := NewMockPriorityTask(controller)
+	rejectedTask.EXPECT().Priority().Return(5).Times(1)
+	mockScheduler.EXPECT().Submit(rejectedTask).Return(ErrTaskSchedulerClosed).Times(1)
+	require.Equal(t, ErrTaskSchedulerClosed, scheduler.Submit(rejectedTask))
+
+	mockScheduler.EXPECT().Stop().Times(1)
+	scheduler.Stop()
+
+	require.Equal(t, 3, strings.Count(buf.String(), "\n"))
+	records, err := ReadSubmissionRecords(&buf)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	for i, record := range records {
+		require.False(t, record.Time.IsZero())
+		records[i].Time = time.Time{}
+	}
+	require.Equal(t, []SubmissionRecord{
+		{Priority: 0, CorrelationID: "some random correlation ID"},
+		{Priority: 1, MetricTags: map[string]string{"domain": "some random domain"}, Try: true, Rejected: true},
+		{Priority: 5, Rejected: true, Error: ErrTaskSchedulerClosed.Error()},
+	}, records)
+}
+
+func TestRecordingScheduler_WriteFailure(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	mockScheduler := NewMockScheduler(controller)
+	scheduler := NewRecordingScheduler(mockScheduler, &failingWriter{}, loggerimpl.NewNopLogger())
+
+	// the submission is not affected
+	mockTask := NewMockPriorityTask(controller)
+	mockTask.EXPECT().Priority().Return(0).Times(1)
+	mockScheduler.EXPECT().Submit(mockTask).Return(nil).Times(1)
+	require.NoError(t, scheduler.Submit(mockTask))
+}
+
+func TestReadSubmissionRecords(t *testing.T) {
+	// records are sorted by the submission time
+	records, err := ReadSubmissionRecords(strings.NewReader(
+		`{"time":"2020-01-01T00:00:02Z","priority":2}` + "\n" +
+			"\n" +
+			`{"time":"2020-01-01T00:00:01Z","priority":1,"try":true}` + "\n",
+	))
+	require.NoError(t, err)
+	require.Equal(t, []SubmissionRecord{
+		{Time: time.Date(2020, 1, 1, 0, 0, 1, 0, time.UTC), Priority: 1, Try: true},
+		{Time: time.Date(2020, 1, 1, 0, 0, 2, 0, time.UTC), Priority: 2},
+	}, records)
+
+	_, err = ReadSubmissionRecords(strings.NewReader("not a record\n"))
+	require.Error(t, err)
+	_, err = ReadSubmissionRecords(&failingReader{})
+	require.Error(t, err)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("some random error")
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+)
+
+type (
+	// SwappableScheduler is a scheduler facade which allows atomically
+	// replacing the underlying scheduler without dropping queued tasks
+	SwappableScheduler interface {
+		Scheduler
+		// Swap routes all new submissions to the given scheduler, the previous
+		// scheduler is drained and stopped in the background. Once the facade
+		// is stopped, the given scheduler is stopped instead of being swapped in
+		Swap(scheduler Scheduler)
+	}
+
+	// DrainableScheduler is the interface for schedulers which support
+	// waiting for all queued tasks to be dispatched
+	DrainableScheduler interface {
+		Scheduler
+		// Drain blocks until all queued tasks are dispatched or the context is done
+		Drain(ctx context.Context) error
+	}
+
+	swappableSchedulerImpl struct {
+		// swapLock serializes Swap with Start and Stop, so that every scheduler swapped
+		// in is started and stopped exactly once along with the facade
+		swapLock     sync.Mutex
+		status       int32
+		active       atomic.Value // store the currently active schedulerHolder
+		drainTimeout time.Duration
+		drainWG      sync.WaitGroup
+		logger       log.Logger
+	}
+
+	schedulerHolder struct {
+		scheduler Scheduler
+	}
+)
+
+// NewSwappableScheduler creates a new scheduler facade backed by the given scheduler,
+// drainTimeout bounds how long a replaced scheduler is drained before it's stopped
+func NewSwappableScheduler(
+	logger log.Logger,
+	scheduler Scheduler,
+	drainTimeout time.Duration,
+) SwappableScheduler {
+	s := &swappableSchedulerImpl{
+		status:       common.DaemonStatusInitialized,
+		drainTimeout: drainTimeout,
+		logger:       logger,
+	}
+	s.active.Store(schedulerHolder{scheduler: scheduler})
+	return s
+}
+
+func (s *swappableSchedulerImpl) Start() {
+	s.swapLock.Lock()
+	defer s.swapLock.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
+		return
+	}
+
+	s.getActive().Start()
+	s.logger.Info("Swappable task scheduler started.")
+}
+
+func (s *swappableSchedulerImpl) Stop() {
+	s.swapLock.Lock()
+	defer s.swapLock.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&s.status, common.DaemonStatusStarted, common.DaemonStatusStopped) {
+		return
+	}
+
+	s.getActive().Stop()
+	if success := common.AwaitWaitGroup(&s.drainWG, time.Minute); !success {
+		s.logger.Warn("Swappable task scheduler timedout on shutdown.")
+	}
+	s.logger.Info("Swappable task scheduler shutdown.")
+}
+
+func (s *swappableSchedulerImpl) Submit(
+	task PriorityTask,
+) error {
+	for {
+		scheduler := s.getActive()
+		err := scheduler.Submit(task)
+		if err != ErrTaskSchedulerClosed || s.getActive() == scheduler {
+			return err
+		}
+		// the scheduler is swapped out concurrently, retry with the new one
+	}
+}
+
+func (s *swappableSchedulerImpl) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	for {
+		scheduler := s.getActive()
+		submitted, err := scheduler.TrySubmit(task)
+		if err != ErrTaskSchedulerClosed || s.getActive() == scheduler {
+			return submitted, err
+		}
+	}
+}
+
+func (s *swappableSchedulerImpl) Swap(
+	scheduler Scheduler,
+) {
+	s.swapLock.Lock()
+	defer s.swapLock.Unlock()
+
+	switch atomic.LoadInt32(&s.status) {
+	case common.DaemonStatusStopped:
+		scheduler.Stop()
+		s.logger.Warn("Swappable task scheduler is already stopped, stopped the scheduler swapped in.")
+		return
+	case common.DaemonStatusStarted:
+		scheduler.Start()
+	}
+	previous := s.getActive()
+	s.active.Store(schedulerHolder{scheduler: scheduler})
+
+	s.drainWG.Add(1)
+	go func() {
+		defer s.drainWG.Done()
+
+		if drainable, ok := previous.(DrainableScheduler); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+			defer cancel()
+			if err := drainable.Drain(ctx); err != nil {
+				s.logger.Warn("Failed to drain swapped out task scheduler.", tag.Error(err))
+			}
+		}
+		previous.Stop()
+	}()
+	s.logger.Info("Swappable task scheduler swapped.")
+}
+
+func (s *swappableSchedulerImpl) getActive() Scheduler {
+	return s.active.Load().(schedulerHolder).scheduler
+}
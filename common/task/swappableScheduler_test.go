@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/uber/cadence/common/log/loggerimpl"
+)
+
+type (
+	swappableSchedulerSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller         *gomock.Controller
+		mockScheduler      *MockScheduler
+		mockNewScheduler   *MockScheduler
+		swappableScheduler *swappableSchedulerImpl
+	}
+)
+
+func TestSwappableSchedulerSuite(t *testing.T) {
+	s := new(swappableSchedulerSuite)
+	suite.Run(t, s)
+}
+
+func (s *swappableSchedulerSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+	s.mockScheduler = NewMockScheduler(s.controller)
+	s.mockNewScheduler = NewMockScheduler(s.controller)
+
+	s.swappableScheduler = NewSwappableScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		s.mockScheduler,
+		time.Second,
+	).(*swappableSchedulerImpl)
+}
+
+func (s *swappableSchedulerSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *swappableSchedulerSuite) TestSwap() {
+	mockTask := NewMockPriorityTask(s.controller)
+
+	s.mockScheduler.EXPECT().Start().Times(1)
+	s.mockScheduler.EXPECT().Submit(mockTask).Return(nil).Times(1)
+	s.swappableScheduler.Start()
+	s.NoError(s.swappableScheduler.Submit(mockTask))
+
+	s.mockNewScheduler.EXPECT().Start().Times(1)
+	s.mockScheduler.EXPECT().Stop().Times(1)
+	s.swappableScheduler.Swap(s.mockNewScheduler)
+
+	s.mockNewScheduler.EXPECT().TrySubmit(mockTask).Return(true, nil).Times(1)
+	submitted, err := s.swappableScheduler.TrySubmit(mockTask)
+	s.NoError(err)
+	s.True(submitted)
+
+	s.mockNewScheduler.EXPECT().Stop().Times(1)
+	s.swappableScheduler.Stop()
+}
+
+func (s *swappableSchedulerSuite) TestSubmit_RetryOnConcurrentSwap() {
+	mockTask := NewMockPriorityTask(s.controller)
+
+	s.mockScheduler.EXPECT().Submit(mockTask).DoAndReturn(func(_ PriorityTask) error {
+		s.swappableScheduler.Swap(s.mockNewScheduler)
+		return ErrTaskSchedulerClosed
+	}).Times(1)
+	s.mockScheduler.EXPECT().Stop().Times(1)
+	s.mockNewScheduler.EXPECT().Submit(mockTask).Return(nil).Times(1)
+
+	s.NoError(s.swappableScheduler.Submit(mockTask))
+	s.swappableScheduler.drainWG.Wait()
+}
+
+func (s *swappableSchedulerSuite) TestSwap_Concurrent() {
+	s.mockScheduler.EXPECT().Start().Times(1)
+	s.mockScheduler.EXPECT().Stop().Times(1)
+	s.swappableScheduler.Start()
+
+	// every scheduler swapped in is started once, and stopped once either when
+	// it's swapped out or when the facade is stopped
+	numSchedulers := 10
+	var swapWG sync.WaitGroup
+	swapWG.Add(numSchedulers)
+	for i := 0; i != numSchedulers; i++ {
+		mockScheduler := NewMockScheduler(s.controller)
+		mockScheduler.EXPECT().Start().Times(1)
+		mockScheduler.EXPECT().Stop().Times(1)
+		go func() {
+			defer swapWG.Done()
+			s.swappableScheduler.Swap(mockScheduler)
+		}()
+	}
+	swapWG.Wait()
+	s.swappableScheduler.Stop()
+}
+
+func (s *swappableSchedulerSuite) TestSwap_AfterStop() {
+	s.mockScheduler.EXPECT().Start().Times(1)
+	s.mockScheduler.EXPECT().Stop().Times(1)
+	s.swappableScheduler.Start()
+	s.swappableScheduler.Stop()
+
+	// the scheduler is stopped instead of being started and swapped in
+	s.mockNewScheduler.EXPECT().Stop().Times(1)
+	s.swappableScheduler.Swap(s.mockNewScheduler)
+	s.True(s.swappableScheduler.getActive() == s.mockScheduler)
+}
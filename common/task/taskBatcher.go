@@ -0,0 +1,202 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// taskBatcher collects the BatchableTasks with the same batch key into batches, a batch is flushed
+	// once it holds maxSize tasks, or once window elapses since its first task is added
+	taskBatcher struct {
+		sync.Mutex
+		window  time.Duration
+		maxSize int
+		batches map[string]*taskBatch
+		// size is the number of tasks held in the batches not flushed yet
+		size   int
+		closed bool
+
+		// flush is invoked with the batches flushed when the window elapses,
+		// or with the task itself if the batch holds a single task
+		flush func(task Task)
+	}
+
+	// taskBatch is the tasks with the same batch key executed together via BatchExecute, it goes through the buffer
+	// of the processor as a single task, and workers execute it via executeBatch instead of the Task methods
+	taskBatch struct {
+		key   string
+		tasks []Task
+		timer *time.Timer
+	}
+)
+
+var _ PriorityTask = (*taskBatch)(nil)
+
+var errTaskBatchNotExecutable = errors.New("task batch can only be executed by the processor")
+
+func newTaskBatcher(
+	window time.Duration,
+	maxSize int,
+	flush func(task Task),
+) *taskBatcher {
+	return &taskBatcher{
+		window:  window,
+		maxSize: maxSize,
+		batches: make(map[string]*taskBatch),
+		flush:   flush,
+	}
+}
+
+// add adds the task to the batch of its key and returns true, or returns false if the task is not a
+// BatchableTask, its batch key is empty or the batcher is closed. The batch is returned once it's full,
+// and the caller takes over the batch, or the task itself if the batch holds a single task
+func (b *taskBatcher) add(
+	task Task,
+) (bool, Task) {
+	batchableTask, ok := unwrapSchedulerTask(task).(BatchableTask)
+	if !ok {
+		return false, nil
+	}
+	key := batchableTask.BatchKey()
+	if key == "" {
+		return false, nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return false, nil
+	}
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &taskBatch{key: key}
+		b.batches[key] = batch
+		batch.timer = time.AfterFunc(b.window, func() {
+			b.flushBatch(batch)
+		})
+	}
+	batch.tasks = append(batch.tasks, task)
+	b.size++
+	if b.maxSize <= 0 || len(batch.tasks) < b.maxSize {
+		return true, nil
+	}
+	batch.timer.Stop()
+	b.removeLocked(batch)
+	return true, batch.task()
+}
+
+// flushBatch flushes the batch unless it's already flushed as it's full
+func (b *taskBatcher) flushBatch(
+	batch *taskBatch,
+) {
+	b.Lock()
+	if b.closed || b.batches[batch.key] != batch {
+		b.Unlock()
+		return
+	}
+	b.removeLocked(batch)
+	b.Unlock()
+
+	b.flush(batch.task())
+}
+
+// close stops flushing batches and returns the tasks held in the batches not flushed yet
+func (b *taskBatcher) close() []Task {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+	var tasks []Task
+	for _, batch := range b.batches {
+		batch.timer.Stop()
+		tasks = append(tasks, batch.tasks...)
+	}
+	b.batches = make(map[string]*taskBatch)
+	b.size = 0
+	return tasks
+}
+
+// len returns the number of tasks held in the batches not flushed yet
+func (b *taskBatcher) len() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.size
+}
+
+func (b *taskBatcher) removeLocked(
+	batch *taskBatch,
+) {
+	delete(b.batches, batch.key)
+	b.size -= len(batch.tasks)
+}
+
+// task returns the batch, or the task itself if the batch holds a single task
+func (b *taskBatch) task() Task {
+	if len(b.tasks) == 1 {
+		return b.tasks[0]
+	}
+	return b
+}
+
+func (b *taskBatch) Execute() error {
+	return errTaskBatchNotExecutable
+}
+
+func (b *taskBatch) HandleErr(err error) error {
+	return err
+}
+
+func (b *taskBatch) RetryErr(err error) bool {
+	return false
+}
+
+func (b *taskBatch) Ack() {
+	for _, task := range b.tasks {
+		task.Ack()
+	}
+}
+
+func (b *taskBatch) Nack() {
+	for _, task := range b.tasks {
+		task.Nack()
+	}
+}
+
+func (b *taskBatch) State() State {
+	return TaskStatePending
+}
+
+// Priority returns the priority of the first task in the batch
+func (b *taskBatch) Priority() int {
+	if priorityTask, ok := b.tasks[0].(PriorityTask); ok {
+		return priorityTask.Priority()
+	}
+	return NoPriority
+}
+
+// SetPriority is a no-op, the priorities of the tasks in the batch are not changed
+func (b *taskBatch) SetPriority(int) {}
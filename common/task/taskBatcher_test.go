@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	taskBatcherSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestTaskBatcherSuite(t *testing.T) {
+	s := new(taskBatcherSuite)
+	suite.Run(t, s)
+}
+
+func (s *taskBatcherSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *taskBatcherSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *taskBatcherSuite) newBatchableTask(
+	batchKey string,
+) *testBatchableTask {
+	return &testBatchableTask{MockPriorityTask: NewMockPriorityTask(s.controller), batchKey: batchKey}
+}
+
+func (s *taskBatcherSuite) TestAdd() {
+	batcher := newTaskBatcher(time.Hour, 2, func(Task) {
+		s.Fail("no batch should be flushed by the window")
+	})
+
+	// tasks which are not batchable or without a batch key are not batched
+	batched, _ := batcher.add(NewMockPriorityTask(s.controller))
+	s.False(batched)
+	batched, _ = batcher.add(s.newBatchableTask(""))
+	s.False(batched)
+
+	tasks := []Task{s.newBatchableTask("a"), s.newBatchableTask("b"), s.newBatchableTask("a")}
+	for _, task := range tasks[:2] {
+		batched, batch := batcher.add(task)
+		s.True(batched)
+		s.Nil(batch)
+	}
+	s.Equal(2, batcher.len())
+	batched, batch := batcher.add(tasks[2])
+	s.True(batched)
+	s.Equal([]Task{tasks[0], tasks[2]}, batch.(*taskBatch).tasks)
+	s.Equal(1, batcher.len())
+
+	s.Equal([]Task{tasks[1]}, batcher.close())
+	s.Zero(batcher.len())
+	batched, _ = batcher.add(s.newBatchableTask("a"))
+	s.False(batched)
+}
+
+func (s *taskBatcherSuite) TestFlush() {
+	flushedCh := make(chan Task, 2)
+	batcher := newTaskBatcher(time.Millisecond, 0, func(task Task) {
+		flushedCh <- task
+	})
+
+	task := s.newBatchableTask("a")
+	batched, _ := batcher.add(task)
+	s.True(batched)
+	// a batch holding a single task is flushed as the task itself
+	s.Equal(task, <-flushedCh)
+	s.Zero(batcher.len())
+
+	batcher.window = time.Hour
+	tasks := []Task{s.newBatchableTask("a"), s.newBatchableTask("a")}
+	for _, task := range tasks {
+		batched, batch := batcher.add(task)
+		s.True(batched)
+		s.Nil(batch)
+	}
+	batcher.flushBatch(batcher.batches["a"])
+	s.Equal(tasks, (<-flushedCh).(*taskBatch).tasks)
+	s.Zero(batcher.len())
+}
@@ -0,0 +1,840 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type (
+	taskQueueImpl struct {
+		sync.Mutex
+
+		priority int
+		capacity int
+		tasks    []PriorityTask
+		// enqueueTimes[i] is the time tasks[i] is added to the queue
+		enqueueTimes []time.Time
+		head         int
+		size         int
+		// reserved is the number of slots reserved by Reserve but not yet used
+		reserved int
+		closed   bool
+		// lastPollTime is the last time a task is polled from the queue
+		lastPollTime time.Time
+		// onPoll, if specified, is invoked with the queue priority
+		// and the enqueue time of each polled task
+		onPoll func(priority int, enqueueTime time.Time)
+		// depthThresholds are the ascending fractions of the capacity reported via onThresholdCrossed
+		depthThresholds []float64
+		// crossedThresholds is the number of depthThresholds the queue depth is currently at or above
+		crossedThresholds int
+		// onThresholdCrossed is invoked when the queue depth reaches one of depthThresholds,
+		// and with upward being false when the depth drops back below the threshold
+		onThresholdCrossed func(priority int, threshold float64, upward bool)
+		// notFullCh is created when a blocking put finds the queue full
+		// and closed when space becomes available
+		notFullCh chan struct{}
+		// inbox, if not nil, accepts tasks from Offer and Put without taking the lock. Tasks in the inbox
+		// are moved to the tail of the queue, in order, before any other operation on the queue under the
+		// lock, and the slots of the queue are acquired from the inbox, so it counts all queued tasks
+		inbox *mpscRing
+		// sharedCapacity, if not nil, bounds the tasks queued across the queues of all priorities
+		// in addition to the capacity of the queue, it can't be used with inbox
+		sharedCapacity *sharedQueueCapacity
+		// queuedBytes, if not nil, tracks the size of the tasks queued across the queues of all priorities
+		queuedBytes *queuedBytes
+		// retained, if not nil, returns true for the tasks which must not be removed by PollExpired,
+		// RemoveExpired and RemoveHead, e.g. non-droppable tasks
+		retained func(task PriorityTask) bool
+	}
+)
+
+var errLockFreeQueueCapacity = errors.New("capacity of a lock-free queue can't be updated")
+
+func newTaskQueue(
+	priority int,
+	capacity int,
+) *taskQueueImpl {
+	if capacity <= 0 {
+		// a queue without capacity can never accept a task
+		capacity = 1
+	}
+
+	return &taskQueueImpl{
+		priority:     priority,
+		capacity:     capacity,
+		tasks:        make([]PriorityTask, capacity),
+		enqueueTimes: make([]time.Time, capacity),
+	}
+}
+
+// newLockFreeTaskQueue creates a task queue whose Offer and Put don't take the lock unless the queue is full,
+// for high submit concurrency. The capacity can't be updated, and the depth thresholds are only
+// reported when the queue is accessed under the lock, e.g. by Poll
+func newLockFreeTaskQueue(
+	priority int,
+	capacity int,
+) *taskQueueImpl {
+	queue := newTaskQueue(priority, capacity)
+	queue.inbox = newMPSCRing(queue.capacity)
+	return queue
+}
+
+func (q *taskQueueImpl) Priority() int {
+	return q.priority
+}
+
+func (q *taskQueueImpl) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	return q.size
+}
+
+func (q *taskQueueImpl) Poll() (PriorityTask, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	if q.size == 0 {
+		return nil, false
+	}
+
+	enqueueTime := q.enqueueTimes[q.head]
+	task := q.removeHeadLocked()
+	q.lastPollTime = time.Now()
+	if q.onPoll != nil {
+		q.onPoll(q.priority, enqueueTime)
+	}
+	return task, true
+}
+
+// Peek returns the task at the head of the queue without removing it,
+// returns false if the queue is empty
+func (q *taskQueueImpl) Peek() (PriorityTask, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	if q.size == 0 {
+		return nil, false
+	}
+	return q.tasks[q.head], true
+}
+
+// HeadEnqueueTime returns the time the task at the head of the queue is added to the queue,
+// returns false if the queue is empty
+func (q *taskQueueImpl) HeadEnqueueTime() (time.Time, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	if q.size == 0 {
+		return time.Time{}, false
+	}
+	return q.enqueueTimes[q.head], true
+}
+
+// PollExpired removes the task at the head of the queue
+// only if it's added to the queue before the deadline
+// PeekN returns up to n tasks from the head of the queue in order without removing them,
+// returns nil if the queue is empty or n is not positive
+func (q *taskQueueImpl) PeekN(
+	n int,
+) []PriorityTask {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	if n > q.size {
+		n = q.size
+	}
+	if n <= 0 {
+		return nil
+	}
+	tasks := make([]PriorityTask, 0, n)
+	for i := 0; i != n; i++ {
+		tasks = append(tasks, q.tasks[(q.head+i)%q.capacity])
+	}
+	return tasks
+}
+
+func (q *taskQueueImpl) PollExpired(
+	deadline time.Time,
+) (PriorityTask, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	if q.size == 0 || !q.enqueueTimes[q.head].Before(deadline) || q.isRetainedLocked(q.tasks[q.head]) {
+		return nil, false
+	}
+	return q.removeHeadLocked(), true
+}
+
+// RemoveHead removes the task closest to the head of the queue without polling it, skipping
+// retained tasks, returns false if the queue has no task which can be removed
+func (q *taskQueueImpl) RemoveHead() (PriorityTask, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	for i := 0; i != q.size; i++ {
+		task := q.tasks[(q.head+i)%q.capacity]
+		if q.isRetainedLocked(task) {
+			continue
+		}
+		if i == 0 {
+			return q.removeHeadLocked(), true
+		}
+		q.removeAtLocked(i)
+		return task, true
+	}
+	return nil, false
+}
+
+// LastPollTime returns the last time a task is polled from the queue,
+// or zero time if no task has been polled
+func (q *taskQueueImpl) LastPollTime() time.Time {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.lastPollTime
+}
+
+// Remove removes the given task, or its priority snapshot, from the
+// queue, returns false if the task is not in the queue
+func (q *taskQueueImpl) Remove(
+	task PriorityTask,
+) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	for i := 0; i != q.size; i++ {
+		if unwrapPrioritySnapshot(q.tasks[(q.head+i)%q.capacity]) != task {
+			continue
+		}
+		q.removeAtLocked(i)
+		return true
+	}
+	return false
+}
+
+// RemoveExpired removes the tasks added to the queue before the deadline, including tasks
+// moved with their enqueue time, and returns them in order
+func (q *taskQueueImpl) RemoveExpired(
+	deadline time.Time,
+) []PriorityTask {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	var removed []PriorityTask
+	numKept := 0
+	for i := 0; i != q.size; i++ {
+		idx := (q.head + i) % q.capacity
+		if q.enqueueTimes[idx].Before(deadline) && !q.isRetainedLocked(q.tasks[idx]) {
+			q.queuedBytes.remove(q.tasks[idx])
+			removed = append(removed, q.tasks[idx])
+			continue
+		}
+
+		// shift the kept tasks forward to fill the gaps
+		keptIdx := (q.head + numKept) % q.capacity
+		q.tasks[keptIdx] = q.tasks[idx]
+		q.enqueueTimes[keptIdx] = q.enqueueTimes[idx]
+		numKept++
+	}
+	for i := numKept; i != q.size; i++ {
+		q.tasks[(q.head+i)%q.capacity] = nil
+	}
+	q.size = numKept
+	if len(removed) != 0 {
+		q.releaseLocked(len(removed))
+		q.signalNotFullLocked()
+		q.updateThresholdsLocked()
+	}
+	return removed
+}
+
+// MoveTo moves the tasks matching the predicate to the tail of the target queue in order, until
+// the target queue is full, and returns the number of tasks moved. Moved tasks are replaced by
+// the result of wrap and keep their enqueue time. The locks of both queues are held while moving,
+// so callers must serialize calls to MoveTo to avoid lock order inversions
+func (q *taskQueueImpl) MoveTo(
+	target *taskQueueImpl,
+	predicate func(PriorityTask) bool,
+	wrap func(PriorityTask) PriorityTask,
+) int {
+	return q.moveTo(target, func(task PriorityTask, _ time.Time) bool {
+		return predicate(task)
+	}, wrap)
+}
+
+// MoveExpiredTo is the same as MoveTo, except that it moves the tasks added
+// to the queue before the deadline, including tasks moved with their enqueue time
+func (q *taskQueueImpl) MoveExpiredTo(
+	target *taskQueueImpl,
+	deadline time.Time,
+	wrap func(PriorityTask) PriorityTask,
+) int {
+	return q.moveTo(target, func(_ PriorityTask, enqueueTime time.Time) bool {
+		return enqueueTime.Before(deadline)
+	}, wrap)
+}
+
+func (q *taskQueueImpl) moveTo(
+	target *taskQueueImpl,
+	predicate func(task PriorityTask, enqueueTime time.Time) bool,
+	wrap func(PriorityTask) PriorityTask,
+) int {
+	target.Lock()
+	defer target.Unlock()
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainInboxLocked()
+	numMoved, numKept := 0, 0
+	for i := 0; i != q.size; i++ {
+		idx := (q.head + i) % q.capacity
+		task := unwrapPrioritySnapshot(q.tasks[idx])
+		// the task is only wrapped once it's certain to be moved
+		if !target.isFullLocked() && predicate(task, q.enqueueTimes[idx]) && target.acquireLocked(1) {
+			q.queuedBytes.remove(q.tasks[idx])
+			target.appendLocked(wrap(task), time.Time{})
+			target.enqueueTimes[(target.head+target.size-1)%target.capacity] = q.enqueueTimes[idx]
+			numMoved++
+			continue
+		}
+
+		// shift the kept tasks forward to fill the gaps
+		keptIdx := (q.head + numKept) % q.capacity
+		q.tasks[keptIdx] = q.tasks[idx]
+		q.enqueueTimes[keptIdx] = q.enqueueTimes[idx]
+		numKept++
+	}
+	for i := numKept; i != q.size; i++ {
+		q.tasks[(q.head+i)%q.capacity] = nil
+	}
+	q.size = numKept
+	if numMoved != 0 {
+		q.releaseLocked(numMoved)
+		q.signalNotFullLocked()
+		q.updateThresholdsLocked()
+	}
+	return numMoved
+}
+
+// Cap returns the capacity of the queue
+func (q *taskQueueImpl) Cap() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.capacity
+}
+
+// SetCapacity updates the capacity of the queue, it fails if the capacity
+// is not positive or more tasks than the new capacity are currently queued
+func (q *taskQueueImpl) SetCapacity(
+	capacity int,
+) error {
+	if capacity <= 0 {
+		return fmt.Errorf("queue size must be positive, got: %v", capacity)
+	}
+
+	if q.inbox != nil {
+		return errLockFreeQueueCapacity
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.size+q.reserved > capacity {
+		return fmt.Errorf("unable to shrink queue size to %v, %v tasks are queued and %v slots are reserved", capacity, q.size, q.reserved)
+	}
+
+	tasks := make([]PriorityTask, capacity)
+	enqueueTimes := make([]time.Time, capacity)
+	for i := 0; i != q.size; i++ {
+		tasks[i] = q.tasks[(q.head+i)%q.capacity]
+		enqueueTimes[i] = q.enqueueTimes[(q.head+i)%q.capacity]
+	}
+	q.tasks = tasks
+	q.enqueueTimes = enqueueTimes
+	q.head = 0
+	q.capacity = capacity
+	q.signalNotFullLocked()
+	q.updateThresholdsLocked()
+	return nil
+}
+
+// Offer adds the task to the tail of the queue,
+// returns false if the queue is full or closed
+func (q *taskQueueImpl) Offer(
+	task PriorityTask,
+) bool {
+	if q.inbox != nil {
+		_, ok := q.offerInbox(task, time.Time{})
+		return ok
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	return q.offerLocked(task, time.Time{})
+}
+
+// OfferWithPosition is the same as Offer, except that it also returns
+// the number of tasks ahead of the task when it's added
+func (q *taskQueueImpl) OfferWithPosition(
+	task PriorityTask,
+) (int, bool) {
+	return q.offerAt(task, time.Time{})
+}
+
+// offerAt is the same as OfferWithPosition, except that the task is considered enqueued at
+// enqueueTime, instead of when it's added, unless enqueueTime is zero
+func (q *taskQueueImpl) offerAt(
+	task PriorityTask,
+	enqueueTime time.Time,
+) (int, bool) {
+	if q.inbox != nil {
+		return q.offerInbox(task, enqueueTime)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	position := q.size
+	return position, q.offerLocked(task, enqueueTime)
+}
+
+// offerInbox adds the task to the inbox without taking the lock if a slot can be acquired, the
+// returned position counts the reserved slots as well as the tasks ahead of the task
+func (q *taskQueueImpl) offerInbox(
+	task PriorityTask,
+	enqueueTime time.Time,
+) (int, bool) {
+	position, ok := q.inbox.acquire(1, q.capacity)
+	if !ok {
+		return 0, false
+	}
+	q.inbox.push(task, enqueueTimeOrNow(enqueueTime))
+	return position, true
+}
+
+// Reserve reserves slots for the given number of tasks, reserved slots can't be used by
+// Offer or Put, returns false if the queue is closed or there's not enough space
+func (q *taskQueueImpl) Reserve(
+	count int,
+) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed || !q.acquireLocked(count) {
+		return false
+	}
+	q.reserved += count
+	return true
+}
+
+// Unreserve releases the given number of reserved slots
+func (q *taskQueueImpl) Unreserve(
+	count int,
+) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.unreserveLocked(count)
+}
+
+func (q *taskQueueImpl) unreserveLocked(
+	count int,
+) {
+	q.reserved -= count
+	q.releaseLocked(count)
+	q.signalNotFullLocked()
+}
+
+// CommitReserved adds the task to the tail of the queue using a slot reserved by
+// Reserve, returns false and releases the slot if the queue is closed
+func (q *taskQueueImpl) CommitReserved(
+	task PriorityTask,
+) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		q.unreserveLocked(1)
+		return false
+	}
+	q.commitReservedLocked(task)
+	return true
+}
+
+// commitReservedLocked adds the task to the tail of the queue using a reserved slot,
+// the caller must ensure a slot is reserved and the queue is not closed
+func (q *taskQueueImpl) commitReservedLocked(
+	task PriorityTask,
+) {
+	q.reserved--
+	q.appendLocked(task, time.Time{})
+}
+
+// Put adds the task to the tail of the queue, blocking until there's space
+// in the queue, returns false if the queue or shutdownCh is closed before that
+func (q *taskQueueImpl) Put(
+	task PriorityTask,
+	shutdownCh <-chan struct{},
+) bool {
+	_, ok := q.PutWithPosition(task, shutdownCh)
+	return ok
+}
+
+// PutWithPosition is the same as Put, except that it also returns
+// the number of tasks ahead of the task when it's added
+func (q *taskQueueImpl) PutWithPosition(
+	task PriorityTask,
+	shutdownCh <-chan struct{},
+) (int, bool) {
+	return q.putAt(task, time.Time{}, shutdownCh)
+}
+
+// putAt is the same as PutWithPosition, except that the task is considered enqueued at
+// enqueueTime, instead of when it's added, unless enqueueTime is zero
+func (q *taskQueueImpl) putAt(
+	task PriorityTask,
+	enqueueTime time.Time,
+	shutdownCh <-chan struct{},
+) (int, bool) {
+	if q.inbox != nil {
+		if position, ok := q.offerInbox(task, enqueueTime); ok {
+			return position, true
+		}
+	}
+
+	for {
+		q.Lock()
+		if q.closed {
+			q.Unlock()
+			return 0, false
+		}
+		q.drainInboxLocked()
+		if position := q.size; q.offerLocked(task, enqueueTime) {
+			q.Unlock()
+			return position, true
+		}
+		if !q.awaitNotFullLocked(shutdownCh) {
+			return 0, false
+		}
+	}
+}
+
+// PutFront adds the task to the head of the queue, ahead of the queued tasks, blocking until
+// there's space in the queue, returns false if the queue or shutdownCh is closed before that
+func (q *taskQueueImpl) PutFront(
+	task PriorityTask,
+	shutdownCh <-chan struct{},
+) bool {
+	for {
+		q.Lock()
+		if q.closed {
+			q.Unlock()
+			return false
+		}
+		// tasks in the inbox are added before the task so that it ends up ahead of them
+		q.drainInboxLocked()
+		if q.acquireLocked(1) {
+			q.pushHeadLocked(task, time.Now())
+			q.Unlock()
+			return true
+		}
+		if !q.awaitNotFullLocked(shutdownCh) {
+			return false
+		}
+	}
+}
+
+// Close closes the queue and returns all the tasks in the queue,
+// no task can be added to the queue after it's closed
+func (q *taskQueueImpl) Close() []PriorityTask {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	if q.inbox != nil {
+		q.inbox.close()
+		// wait for the tasks being added to the inbox, whose slots are acquired before it's closed
+		for q.drainInboxLocked(); q.inbox.numAcquired() != q.size+q.reserved; q.drainInboxLocked() {
+			runtime.Gosched()
+		}
+	}
+	tasks := make([]PriorityTask, 0, q.size)
+	for q.size != 0 {
+		tasks = append(tasks, q.removeHeadLocked())
+	}
+	return tasks
+}
+
+// PutOrReplace replaces the queued task with the same replace key with the given task,
+// the given task will take the position of the replaced task, but its age starts afresh. If no such task exists, the task
+// is added to the tail of the queue, blocking until there's space in the queue. Returns the
+// replaced task, if any, and false if the queue or shutdownCh is closed before the task is added
+func (q *taskQueueImpl) PutOrReplace(
+	task ReplaceableTask,
+	shutdownCh <-chan struct{},
+) (PriorityTask, bool) {
+	key := task.ReplaceKey()
+	for {
+		q.Lock()
+		if q.closed {
+			q.Unlock()
+			return nil, false
+		}
+		q.drainInboxLocked()
+		if replaced := q.replaceLocked(key, task); replaced != nil {
+			q.Unlock()
+			return replaced, true
+		}
+		if q.offerLocked(task, time.Time{}) {
+			q.Unlock()
+			return nil, true
+		}
+		if !q.awaitNotFullLocked(shutdownCh) {
+			return nil, false
+		}
+	}
+}
+
+func (q *taskQueueImpl) replaceLocked(
+	key interface{},
+	task PriorityTask,
+) PriorityTask {
+	for i := 0; i != q.size; i++ {
+		idx := (q.head + i) % q.capacity
+		if queuedTask, ok := q.tasks[idx].(ReplaceableTask); ok && queuedTask.ReplaceKey() == key {
+			q.queuedBytes.remove(q.tasks[idx])
+			q.queuedBytes.add(task)
+			q.tasks[idx] = task
+			q.enqueueTimes[idx] = time.Now()
+			return queuedTask
+		}
+	}
+	return nil
+}
+
+func (q *taskQueueImpl) offerLocked(
+	task PriorityTask,
+	enqueueTime time.Time,
+) bool {
+	if q.closed || !q.acquireLocked(1) {
+		return false
+	}
+
+	q.appendLocked(task, enqueueTime)
+	return true
+}
+
+// appendLocked adds the task to the tail of the queue, the caller must ensure a slot is acquired.
+// A zero enqueueTime means the task is enqueued now
+func (q *taskQueueImpl) appendLocked(
+	task PriorityTask,
+	enqueueTime time.Time,
+) {
+	// tasks in the inbox are added before the task to keep the order
+	q.drainInboxLocked()
+	q.pushTailLocked(task, enqueueTimeOrNow(enqueueTime))
+}
+
+func enqueueTimeOrNow(
+	enqueueTime time.Time,
+) time.Time {
+	if enqueueTime.IsZero() {
+		return time.Now()
+	}
+	return enqueueTime
+}
+
+func (q *taskQueueImpl) pushTailLocked(
+	task PriorityTask,
+	enqueueTime time.Time,
+) {
+	tail := (q.head + q.size) % q.capacity
+	q.tasks[tail] = task
+	q.enqueueTimes[tail] = enqueueTime
+	q.size++
+	q.queuedBytes.add(task)
+	q.updateThresholdsLocked()
+}
+
+func (q *taskQueueImpl) pushHeadLocked(
+	task PriorityTask,
+	enqueueTime time.Time,
+) {
+	q.head = (q.head + q.capacity - 1) % q.capacity
+	q.tasks[q.head] = task
+	q.enqueueTimes[q.head] = enqueueTime
+	q.size++
+	q.queuedBytes.add(task)
+	q.updateThresholdsLocked()
+}
+
+// drainInboxLocked moves the tasks in the inbox to the tail of the queue
+func (q *taskQueueImpl) drainInboxLocked() {
+	if q.inbox == nil {
+		return
+	}
+	for {
+		task, enqueueTime, ok := q.inbox.pop()
+		if !ok {
+			return
+		}
+		q.pushTailLocked(task, enqueueTime)
+	}
+}
+
+// acquireLocked acquires slots for the given number of tasks, returns false if there's not enough space
+func (q *taskQueueImpl) acquireLocked(
+	count int,
+) bool {
+	if q.inbox == nil {
+		if q.size+q.reserved+count > q.capacity {
+			return false
+		}
+		return q.sharedCapacity == nil || q.sharedCapacity.acquire(q.priority, count)
+	}
+	_, ok := q.inbox.acquire(count, q.capacity)
+	return ok
+}
+
+// releaseLocked releases the slots of removed tasks or unreserved slots
+func (q *taskQueueImpl) releaseLocked(
+	count int,
+) {
+	if q.inbox != nil {
+		q.inbox.release(count)
+	}
+	if q.sharedCapacity != nil {
+		q.sharedCapacity.release(q.priority, count)
+	}
+}
+
+// isFullLocked returns true if no task can be added to the queue, including when it's closed
+func (q *taskQueueImpl) isFullLocked() bool {
+	if q.inbox != nil {
+		return q.closed || q.inbox.numAcquired() >= q.capacity
+	}
+	return q.closed || q.size+q.reserved >= q.capacity ||
+		(q.sharedCapacity != nil && q.sharedCapacity.isFull(q.priority))
+}
+
+func (q *taskQueueImpl) isRetainedLocked(
+	task PriorityTask,
+) bool {
+	return q.retained != nil && q.retained(task)
+}
+
+// removeAtLocked removes the i-th task from the head of the queue
+func (q *taskQueueImpl) removeAtLocked(
+	i int,
+) {
+	q.queuedBytes.remove(q.tasks[(q.head+i)%q.capacity])
+
+	// shift the following tasks forward to fill the gap
+	for j := i; j != q.size-1; j++ {
+		q.tasks[(q.head+j)%q.capacity] = q.tasks[(q.head+j+1)%q.capacity]
+		q.enqueueTimes[(q.head+j)%q.capacity] = q.enqueueTimes[(q.head+j+1)%q.capacity]
+	}
+	q.tasks[(q.head+q.size-1)%q.capacity] = nil
+	q.size--
+	q.releaseLocked(1)
+	q.signalNotFullLocked()
+	q.updateThresholdsLocked()
+}
+
+func (q *taskQueueImpl) removeHeadLocked() PriorityTask {
+	task := q.tasks[q.head]
+	q.tasks[q.head] = nil
+	q.head = (q.head + 1) % q.capacity
+	q.size--
+	q.queuedBytes.remove(task)
+	q.releaseLocked(1)
+	q.signalNotFullLocked()
+	q.updateThresholdsLocked()
+	return task
+}
+
+// updateThresholdsLocked reports the depth thresholds crossed since the last update
+func (q *taskQueueImpl) updateThresholdsLocked() {
+	for q.crossedThresholds < len(q.depthThresholds) &&
+		float64(q.size) >= q.depthThresholds[q.crossedThresholds]*float64(q.capacity) {
+		q.onThresholdCrossed(q.priority, q.depthThresholds[q.crossedThresholds], true)
+		q.crossedThresholds++
+	}
+	for q.crossedThresholds > 0 &&
+		float64(q.size) < q.depthThresholds[q.crossedThresholds-1]*float64(q.capacity) {
+		q.crossedThresholds--
+		q.onThresholdCrossed(q.priority, q.depthThresholds[q.crossedThresholds], false)
+	}
+}
+
+// awaitNotFullLocked unlocks the queue and blocks until space may become available after a slot
+// can't be acquired, returns false if shutdownCh is closed before that. The caller must hold the lock
+func (q *taskQueueImpl) awaitNotFullLocked(
+	shutdownCh <-chan struct{},
+) bool {
+	if q.notFullCh == nil {
+		q.notFullCh = make(chan struct{})
+	}
+	notFullCh := q.notFullCh
+	var releasedCh <-chan struct{}
+	if q.sharedCapacity != nil {
+		releasedCh = q.sharedCapacity.released()
+		if q.size+q.reserved < q.capacity && !q.sharedCapacity.isFull(q.priority) {
+			// shared slots are released by other queues since the slot can't be acquired
+			q.Unlock()
+			return true
+		}
+	}
+	q.Unlock()
+
+	select {
+	case <-notFullCh:
+	case <-releasedCh:
+	case <-shutdownCh:
+		return false
+	}
+	return true
+}
+
+func (q *taskQueueImpl) signalNotFullLocked() {
+	if q.notFullCh != nil {
+		close(q.notFullCh)
+		q.notFullCh = nil
+	}
+}
@@ -0,0 +1,703 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	taskQueueSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+)
+
+func TestTaskQueueSuite(t *testing.T) {
+	s := new(taskQueueSuite)
+	suite.Run(t, s)
+}
+
+func (s *taskQueueSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *taskQueueSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *taskQueueSuite) TestOfferPoll() {
+	queue := newTaskQueue(1, 3)
+	s.Equal(1, queue.Priority())
+
+	_, ok := queue.Poll()
+	s.False(ok)
+	s.True(queue.LastPollTime().IsZero())
+
+	// wrap around the ring buffer a few times
+	for round := 0; round != 3; round++ {
+		tasks := []PriorityTask{}
+		for i := 0; i != 3; i++ {
+			mockTask := NewMockPriorityTask(s.controller)
+			s.True(queue.Offer(mockTask))
+			tasks = append(tasks, mockTask)
+		}
+		s.False(queue.Offer(NewMockPriorityTask(s.controller)))
+		s.Equal(3, queue.Len())
+
+		for _, expectedTask := range tasks {
+			task, ok := queue.Poll()
+			s.True(ok)
+			s.Equal(expectedTask, task)
+		}
+		s.Zero(queue.Len())
+	}
+	s.False(queue.LastPollTime().IsZero())
+}
+
+func (s *taskQueueSuite) TestPollExpired() {
+	queue := newTaskQueue(1, 3)
+	_, ok := queue.PollExpired(time.Now().Add(time.Minute))
+	s.False(ok)
+
+	mockTask1 := NewMockPriorityTask(s.controller)
+	s.True(queue.Offer(mockTask1))
+	deadline := time.Now().Add(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	mockTask2 := NewMockPriorityTask(s.controller)
+	s.True(queue.Offer(mockTask2))
+
+	_, ok = queue.PollExpired(deadline.Add(-time.Minute))
+	s.False(ok)
+	task, ok := queue.PollExpired(deadline)
+	s.True(ok)
+	s.Equal(mockTask1, task)
+	_, ok = queue.PollExpired(deadline)
+	s.False(ok)
+	s.Equal(1, queue.Len())
+}
+
+func (s *taskQueueSuite) TestHeadEnqueueTime() {
+	queue := newTaskQueue(1, 3)
+	_, ok := queue.HeadEnqueueTime()
+	s.False(ok)
+
+	enqueueTime := time.Now().Add(-time.Minute)
+	_, ok = queue.offerAt(NewMockPriorityTask(s.controller), enqueueTime)
+	s.True(ok)
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	headEnqueueTime, ok := queue.HeadEnqueueTime()
+	s.True(ok)
+	s.Equal(enqueueTime, headEnqueueTime)
+
+	_, ok = queue.Poll()
+	s.True(ok)
+	headEnqueueTime, ok = queue.HeadEnqueueTime()
+	s.True(ok)
+	s.True(headEnqueueTime.After(enqueueTime))
+}
+
+func (s *taskQueueSuite) TestReserve() {
+	queue := newTaskQueue(1, 3)
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	s.False(queue.Reserve(3))
+	s.True(queue.Reserve(2))
+
+	// reserved slots can't be used by Offer
+	s.False(queue.Offer(NewMockPriorityTask(s.controller)))
+	s.Error(queue.SetCapacity(2))
+
+	mockTask := NewMockPriorityTask(s.controller)
+	queue.Lock()
+	queue.commitReservedLocked(mockTask)
+	queue.Unlock()
+	s.Equal(2, queue.Len())
+
+	queue.Unreserve(1)
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	s.Equal(3, queue.Len())
+
+	queue.Close()
+	s.False(queue.Reserve(1))
+}
+
+func (s *taskQueueSuite) TestRemove() {
+	queue := newTaskQueue(1, 4)
+	// move head so that tasks wrap around the ring buffer
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	queue.Poll()
+	queue.Poll()
+
+	tasks := []PriorityTask{}
+	for i := 0; i != 4; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		s.True(queue.Offer(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+
+	s.True(queue.Remove(tasks[1]))
+	s.False(queue.Remove(tasks[1]))
+	s.Equal(3, queue.Len())
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+
+	for _, expectedTask := range []PriorityTask{tasks[0], tasks[2], tasks[3]} {
+		task, ok := queue.Poll()
+		s.True(ok)
+		s.Equal(expectedTask, task)
+	}
+}
+
+func (s *taskQueueSuite) TestPeekN() {
+	queue := newTaskQueue(1, 4)
+	s.Nil(queue.PeekN(2))
+
+	// move head so that tasks wrap around the ring buffer
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	queue.Poll()
+	queue.Poll()
+
+	tasks := []PriorityTask{}
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		s.True(queue.Offer(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+
+	s.Equal(tasks[:2], queue.PeekN(2))
+	s.Equal(tasks, queue.PeekN(10))
+	s.Nil(queue.PeekN(0))
+	s.Equal(3, queue.Len())
+	task, ok := queue.Poll()
+	s.True(ok)
+	s.True(task == tasks[0])
+}
+
+func (s *taskQueueSuite) TestMoveTo() {
+	queue := newTaskQueue(1, 4)
+	// move head so that tasks wrap around the ring buffer
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	queue.Poll()
+
+	tasks := []PriorityTask{}
+	for i := 0; i != 4; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		s.True(queue.Offer(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+	targetQueue := newTaskQueue(0, 3)
+	targetTask := NewMockPriorityTask(s.controller)
+	s.True(targetQueue.Offer(targetTask))
+
+	var wrapped []PriorityTask
+	numMoved := queue.MoveTo(
+		targetQueue,
+		func(task PriorityTask) bool {
+			return task != tasks[1]
+		},
+		func(task PriorityTask) PriorityTask {
+			wrapped = append(wrapped, task)
+			return task
+		},
+	)
+	// the target queue is full after moving two tasks
+	s.Equal(2, numMoved)
+	s.Equal([]PriorityTask{tasks[0], tasks[2]}, wrapped)
+
+	for _, expectedTask := range []PriorityTask{targetTask, tasks[0], tasks[2]} {
+		task, ok := targetQueue.Poll()
+		s.True(ok)
+		s.Equal(expectedTask, task)
+	}
+	s.Equal(2, queue.Len())
+	for _, expectedTask := range []PriorityTask{tasks[1], tasks[3]} {
+		task, ok := queue.Poll()
+		s.True(ok)
+		s.Equal(expectedTask, task)
+	}
+}
+
+func (s *taskQueueSuite) TestMoveExpiredTo() {
+	queue := newTaskQueue(1, 3)
+	oldTask := NewMockPriorityTask(s.controller)
+	s.True(queue.Offer(oldTask))
+	time.Sleep(10 * time.Millisecond)
+	deadline := time.Now()
+	newTask := NewMockPriorityTask(s.controller)
+	s.True(queue.Offer(newTask))
+
+	targetQueue := newTaskQueue(0, 2)
+	numMoved := queue.MoveExpiredTo(targetQueue, deadline, func(task PriorityTask) PriorityTask {
+		return task
+	})
+	s.Equal(1, numMoved)
+	task, ok := targetQueue.Poll()
+	s.True(ok)
+	s.True(task == oldTask)
+	task, ok = queue.Poll()
+	s.True(ok)
+	s.True(task == newTask)
+
+	// moved tasks keep their enqueue time
+	s.True(targetQueue.Offer(oldTask))
+	s.Equal(1, targetQueue.MoveExpiredTo(queue, time.Now().Add(time.Millisecond), func(task PriorityTask) PriorityTask {
+		return task
+	}))
+	s.Zero(queue.MoveExpiredTo(targetQueue, deadline, func(task PriorityTask) PriorityTask {
+		return task
+	}))
+}
+
+func (s *taskQueueSuite) TestRemoveExpired() {
+	queue := newTaskQueue(1, 3)
+	s.Nil(queue.RemoveExpired(time.Now()))
+
+	now := time.Now()
+	var tasks []PriorityTask
+	for _, enqueueTime := range []time.Time{now.Add(-time.Minute), now, now.Add(-2 * time.Minute)} {
+		mockTask := NewMockPriorityTask(s.controller)
+		_, ok := queue.offerAt(mockTask, enqueueTime)
+		s.True(ok)
+		tasks = append(tasks, mockTask)
+	}
+
+	s.Equal([]PriorityTask{tasks[0], tasks[2]}, queue.RemoveExpired(now.Add(-time.Second)))
+	s.Equal(1, queue.Len())
+	task, ok := queue.Poll()
+	s.True(ok)
+	s.True(task == tasks[1])
+}
+
+func (s *taskQueueSuite) TestRetained() {
+	queue := newTaskQueue(1, 4)
+	retainedTask := NewMockPriorityTask(s.controller)
+	queue.retained = func(task PriorityTask) bool {
+		return task == retainedTask
+	}
+
+	now := time.Now()
+	tasks := []PriorityTask{retainedTask}
+	for i := 0; i != 3; i++ {
+		tasks = append(tasks, NewMockPriorityTask(s.controller))
+	}
+	for _, task := range tasks {
+		_, ok := queue.offerAt(task, now.Add(-time.Minute))
+		s.True(ok)
+	}
+
+	_, ok := queue.PollExpired(now)
+	s.False(ok)
+	task, ok := queue.RemoveHead()
+	s.True(ok)
+	s.True(task == tasks[1])
+	s.Equal([]PriorityTask{tasks[2], tasks[3]}, queue.RemoveExpired(now))
+	_, ok = queue.RemoveHead()
+	s.False(ok)
+
+	s.Equal(1, queue.Len())
+	task, ok = queue.Poll()
+	s.True(ok)
+	s.True(task == retainedTask)
+}
+
+func (s *taskQueueSuite) TestPut_BlockUntilNotFull() {
+	queue := newTaskQueue(1, 1)
+	shutdownCh := make(chan struct{})
+	s.True(queue.Put(NewMockPriorityTask(s.controller), shutdownCh))
+
+	putCh := make(chan bool)
+	go func() {
+		putCh <- queue.Put(NewMockPriorityTask(s.controller), shutdownCh)
+	}()
+
+	select {
+	case <-putCh:
+		s.Fail("put should block when the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, ok := queue.Poll()
+	s.True(ok)
+	s.True(<-putCh)
+	s.Equal(1, queue.Len())
+}
+
+func (s *taskQueueSuite) TestPut_Shutdown() {
+	queue := newTaskQueue(1, 1)
+	shutdownCh := make(chan struct{})
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+
+	putCh := make(chan bool)
+	go func() {
+		putCh <- queue.Put(NewMockPriorityTask(s.controller), shutdownCh)
+	}()
+
+	close(shutdownCh)
+	s.False(<-putCh)
+	s.Equal(1, queue.Len())
+}
+
+func (s *taskQueueSuite) TestClose() {
+	queue := newTaskQueue(1, 2)
+	shutdownCh := make(chan struct{})
+	tasks := []PriorityTask{NewMockPriorityTask(s.controller), NewMockPriorityTask(s.controller)}
+	for _, task := range tasks {
+		s.True(queue.Offer(task))
+	}
+
+	putCh := make(chan bool)
+	go func() {
+		putCh <- queue.Put(NewMockPriorityTask(s.controller), shutdownCh)
+	}()
+
+	s.Equal(tasks, queue.Close())
+	s.False(<-putCh)
+	s.False(queue.Offer(NewMockPriorityTask(s.controller)))
+	s.False(queue.Put(NewMockPriorityTask(s.controller), shutdownCh))
+	s.Zero(queue.Len())
+}
+
+func (s *taskQueueSuite) TestPutOrReplace() {
+	queue := newTaskQueue(1, 3)
+	shutdownCh := make(chan struct{})
+
+	newReplaceableTask := func(key string) *MockReplaceableTask {
+		mockTask := NewMockReplaceableTask(s.controller)
+		mockTask.EXPECT().ReplaceKey().Return(key).AnyTimes()
+		return mockTask
+	}
+
+	taskA := newReplaceableTask("a")
+	taskB := newReplaceableTask("b")
+	plainTask := NewMockPriorityTask(s.controller)
+	s.True(queue.Offer(taskA))
+	s.True(queue.Offer(plainTask))
+	replaced, ok := queue.PutOrReplace(taskB, shutdownCh)
+	s.True(ok)
+	s.Nil(replaced)
+
+	// queue is full, but replacing doesn't need extra space
+	newTaskA := newReplaceableTask("a")
+	replaced, ok = queue.PutOrReplace(newTaskA, shutdownCh)
+	s.True(ok)
+	s.Equal(taskA, replaced)
+	s.Equal(3, queue.Len())
+
+	for _, expectedTask := range []PriorityTask{newTaskA, plainTask, taskB} {
+		task, ok := queue.Poll()
+		s.True(ok)
+		s.Equal(expectedTask, task)
+	}
+
+	queue.Close()
+	_, ok = queue.PutOrReplace(newReplaceableTask("c"), shutdownCh)
+	s.False(ok)
+}
+
+func (s *taskQueueSuite) TestPutFront() {
+	for _, lockFree := range []bool{false, true} {
+		queue := newTaskQueue(1, 3)
+		if lockFree {
+			queue = newLockFreeTaskQueue(1, 3)
+		}
+		shutdownCh := make(chan struct{})
+
+		taskA := NewMockPriorityTask(s.controller)
+		taskB := NewMockPriorityTask(s.controller)
+		frontTask := NewMockPriorityTask(s.controller)
+		s.True(queue.Offer(taskA))
+		s.True(queue.Offer(taskB))
+		s.True(queue.PutFront(frontTask, shutdownCh))
+		s.Equal(3, queue.Len())
+
+		putCh := make(chan bool)
+		blockedTask := NewMockPriorityTask(s.controller)
+		go func() {
+			putCh <- queue.PutFront(blockedTask, shutdownCh)
+		}()
+		select {
+		case <-putCh:
+			s.Fail("put front should block when the queue is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		task, ok := queue.Poll()
+		s.True(ok)
+		s.True(task == frontTask)
+		s.True(<-putCh)
+		for _, expectedTask := range []PriorityTask{blockedTask, taskA, taskB} {
+			task, ok := queue.Poll()
+			s.True(ok)
+			s.True(task == expectedTask)
+		}
+
+		s.True(queue.Offer(taskA))
+		close(shutdownCh)
+		s.True(queue.PutFront(frontTask, shutdownCh))
+		s.Len(queue.Close(), 2)
+		s.False(queue.PutFront(frontTask, shutdownCh))
+	}
+}
+
+func (s *taskQueueSuite) TestQueuedBytes() {
+	taskA := NewMockPriorityTask(s.controller)
+	taskB := NewMockPriorityTask(s.controller)
+	taskC := NewMockPriorityTask(s.controller)
+	sizes := map[PriorityTask]int64{taskA: 10, taskB: 20, taskC: 0}
+	var updates []int64
+	queue := newTaskQueue(1, 3)
+	queue.queuedBytes = newQueuedBytes(
+		func(task PriorityTask) int64 { return sizes[task] },
+		func(bytes int64) { updates = append(updates, bytes) },
+	)
+	shutdownCh := make(chan struct{})
+
+	s.True(queue.Offer(taskA))
+	s.True(queue.PutFront(taskB, shutdownCh))
+	// tasks without a positive size are not counted
+	s.True(queue.Offer(taskC))
+	s.Equal(int64(30), queue.queuedBytes.load())
+
+	task, ok := queue.Poll()
+	s.True(ok)
+	s.True(task == taskB)
+	task, ok = queue.RemoveHead()
+	s.True(ok)
+	s.True(task == taskA)
+	task, ok = queue.RemoveHead()
+	s.True(ok)
+	s.True(task == taskC)
+	_, ok = queue.RemoveHead()
+	s.False(ok)
+	s.Zero(queue.queuedBytes.load())
+	s.Equal([]int64{10, 30, 10, 0}, updates)
+}
+
+func (s *taskQueueSuite) TestSetCapacity() {
+	queue := newTaskQueue(1, 3)
+	shutdownCh := make(chan struct{})
+	// move head so that tasks wrap around the ring buffer
+	s.True(queue.Offer(NewMockPriorityTask(s.controller)))
+	queue.Poll()
+
+	tasks := []PriorityTask{}
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		s.True(queue.Offer(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+
+	putCh := make(chan bool)
+	blockedTask := NewMockPriorityTask(s.controller)
+	go func() {
+		putCh <- queue.Put(blockedTask, shutdownCh)
+	}()
+
+	s.Error(queue.SetCapacity(0))
+	s.Error(queue.SetCapacity(2))
+	s.NoError(queue.SetCapacity(5))
+	s.True(<-putCh)
+	s.Equal(5, queue.Cap())
+	s.Equal(4, queue.Len())
+
+	for _, expectedTask := range append(tasks, blockedTask) {
+		task, ok := queue.Poll()
+		s.True(ok)
+		s.Equal(expectedTask, task)
+	}
+	s.NoError(queue.SetCapacity(1))
+	s.Equal(1, queue.Cap())
+}
+
+func (s *taskQueueSuite) TestLockFree_OfferPoll() {
+	queue := newLockFreeTaskQueue(1, 3)
+	s.Error(queue.SetCapacity(5))
+
+	// wrap around the inbox and the ring buffer a few times
+	for round := 0; round != 3; round++ {
+		tasks := []PriorityTask{}
+		for i := 0; i != 3; i++ {
+			mockTask := NewMockPriorityTask(s.controller)
+			position, ok := queue.OfferWithPosition(mockTask)
+			s.True(ok)
+			s.Equal(i, position)
+			tasks = append(tasks, mockTask)
+		}
+		s.False(queue.Offer(NewMockPriorityTask(s.controller)))
+		s.Equal(3, queue.Len())
+
+		for _, expectedTask := range tasks {
+			task, ok := queue.Poll()
+			s.True(ok)
+			s.Equal(expectedTask, task)
+		}
+		_, ok := queue.Poll()
+		s.False(ok)
+	}
+}
+
+func (s *taskQueueSuite) TestLockFree_Order() {
+	queue := newLockFreeTaskQueue(1, 3)
+	tasks := []PriorityTask{}
+	for i := 0; i != 3; i++ {
+		tasks = append(tasks, NewMockPriorityTask(s.controller))
+	}
+
+	// tasks in the inbox are kept ahead of tasks added under the lock
+	s.True(queue.Offer(tasks[0]))
+	s.True(queue.Reserve(1))
+	s.True(queue.Offer(tasks[1]))
+	s.False(queue.Offer(NewMockPriorityTask(s.controller)))
+	queue.Lock()
+	queue.commitReservedLocked(tasks[2])
+	queue.Unlock()
+	for _, expectedTask := range tasks {
+		task, ok := queue.Poll()
+		s.True(ok)
+		s.Equal(expectedTask, task)
+	}
+
+	// Put blocks on the full queue until a task is polled
+	for _, task := range tasks {
+		s.True(queue.Offer(task))
+	}
+	putCh := make(chan bool)
+	blockedTask := NewMockPriorityTask(s.controller)
+	go func() {
+		putCh <- queue.Put(blockedTask, nil)
+	}()
+	task, ok := queue.Poll()
+	s.True(ok)
+	s.Equal(tasks[0], task)
+	s.True(<-putCh)
+	s.Equal([]PriorityTask{tasks[1], tasks[2], blockedTask}, queue.Close())
+	s.False(queue.Offer(NewMockPriorityTask(s.controller)))
+}
+
+func (s *taskQueueSuite) TestLockFree_ConcurrentClose() {
+	queue := newLockFreeTaskQueue(1, 1000)
+
+	numProducers := 8
+	var producerWG sync.WaitGroup
+	producerWG.Add(numProducers)
+	numOffered := make([]int, numProducers)
+	for producer := 0; producer != numProducers; producer++ {
+		go func(producer int) {
+			defer producerWG.Done()
+			for queue.Offer(&benchmarkPriorityTask{priority: producer}) {
+				numOffered[producer]++
+			}
+		}(producer)
+	}
+	numPolled := 0
+	for i := 0; i != 100; i++ {
+		if _, ok := queue.Poll(); ok {
+			numPolled++
+		}
+	}
+
+	// every task accepted before the queue is closed is returned
+	numClosed := len(queue.Close())
+	producerWG.Wait()
+	total := 0
+	for _, num := range numOffered {
+		total += num
+	}
+	s.Equal(total, numPolled+numClosed)
+}
+
+func BenchmarkTaskQueue_ConcurrentPut(b *testing.B) {
+	queues := map[string]func() (put func(PriorityTask), poll func() bool){
+		"mutex": func() (func(PriorityTask), func() bool) {
+			queue := newTaskQueue(0, 1024)
+			return func(task PriorityTask) { queue.Put(task, nil) }, func() bool {
+				_, ok := queue.Poll()
+				return ok
+			}
+		},
+		"lockFree": func() (func(PriorityTask), func() bool) {
+			queue := newLockFreeTaskQueue(0, 1024)
+			return func(task PriorityTask) { queue.Put(task, nil) }, func() bool {
+				_, ok := queue.Poll()
+				return ok
+			}
+		},
+		"channel": func() (func(PriorityTask), func() bool) {
+			queue := make(chan PriorityTask, 1024)
+			return func(task PriorityTask) { queue <- task }, func() bool {
+				select {
+				case <-queue:
+					return true
+				default:
+					return false
+				}
+			}
+		},
+	}
+	for _, name := range []string{"mutex", "lockFree", "channel"} {
+		for _, parallelism := range []int{1, 8, 64} {
+			b.Run(fmt.Sprintf("%v-Parallelism-%v", name, parallelism), func(b *testing.B) {
+				put, poll := queues[name]()
+				doneCh := make(chan struct{})
+				consumerDoneCh := make(chan struct{})
+				// a single consumer, as the dispatcher
+				go func() {
+					defer close(consumerDoneCh)
+					for {
+						select {
+						case <-doneCh:
+							return
+						default:
+						}
+						if !poll() {
+							runtime.Gosched()
+						}
+					}
+				}()
+
+				task := &benchmarkPriorityTask{}
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						put(task)
+					}
+				})
+				b.StopTimer()
+				close(doneCh)
+				<-consumerDoneCh
+			})
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+)
+
+type (
+	// taskWrapper is embedded by the wrappers added around a submitted task, by the scheduler when
+	// dispatching it and by helpers like SubmitFuture. Processors only see the outermost wrapper, so
+	// it forwards ContextAwareTask and MetricTaggedTask. Other optional interfaces are checked by the
+	// scheduler on the submitted task, which is looked up through the wrappers by unwrapSchedulerTask
+	taskWrapper struct {
+		PriorityTask
+	}
+
+	// wrappedTask is implemented by the wrappers embedding taskWrapper
+	wrappedTask interface {
+		unwrap() PriorityTask
+	}
+)
+
+func (t *taskWrapper) MetricTags() map[string]string {
+	if taggedTask, ok := t.PriorityTask.(MetricTaggedTask); ok {
+		return taggedTask.MetricTags()
+	}
+	return nil
+}
+
+// ExecuteWithContext must be overridden by the wrappers overriding Execute
+func (t *taskWrapper) ExecuteWithContext(
+	ctx context.Context,
+) error {
+	if contextAwareTask, ok := t.PriorityTask.(ContextAwareTask); ok {
+		return contextAwareTask.ExecuteWithContext(ctx)
+	}
+	return t.PriorityTask.Execute()
+}
+
+func (t *taskWrapper) unwrap() PriorityTask {
+	return t.PriorityTask
+}
+
+// unwrapSchedulerTask returns the task submitted by the caller
+// if the given task is wrapped by the scheduler or a submit helper
+func unwrapSchedulerTask(
+	task Task,
+) Task {
+	for {
+		wrapper, ok := task.(wrappedTask)
+		if !ok {
+			return task
+		}
+		task = wrapper.unwrap()
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type (
+	taskWrapperSuite struct {
+		*require.Assertions
+		suite.Suite
+
+		controller *gomock.Controller
+	}
+
+	// testOptionalTask implements all the optional interfaces of PriorityTask
+	// which must be kept when the task is wrapped
+	testOptionalTask struct {
+		*MockPriorityTask
+
+		executeCtx context.Context
+	}
+
+	testBulkNacker struct{}
+
+	testContextKey struct{}
+)
+
+func TestTaskWrapperSuite(t *testing.T) {
+	s := new(taskWrapperSuite)
+	suite.Run(t, s)
+}
+
+func (s *taskWrapperSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+
+	s.controller = gomock.NewController(s.T())
+}
+
+func (s *taskWrapperSuite) TearDownTest() {
+	s.controller.Finish()
+}
+
+func (s *taskWrapperSuite) TestOptionalInterfaces() {
+	testCases := map[string]func(task PriorityTask) PriorityTask{
+		"priority snapshot": func(task PriorityTask) PriorityTask {
+			return newPrioritySnapshotTask(task, 1)
+		},
+		"end to end": func(task PriorityTask) PriorityTask {
+			return newEndToEndTask(task, nil, 1, time.Now())
+		},
+		"concurrency limited": func(task PriorityTask) PriorityTask {
+			return &concurrencyLimitedTask{taskWrapper: taskWrapper{PriorityTask: task}}
+		},
+		"requeued": func(task PriorityTask) PriorityTask {
+			return &requeuedTask{taskWrapper: taskWrapper{PriorityTask: task}}
+		},
+		"hierarchical dispatch": func(task PriorityTask) PriorityTask {
+			return &hierarchicalDispatchTask{taskWrapper: taskWrapper{PriorityTask: task}, priority: 1}
+		},
+		"idempotent": func(task PriorityTask) PriorityTask {
+			return &idempotentTaskWrapper{taskWrapper: taskWrapper{PriorityTask: task}, key: "some random key"}
+		},
+		"failure callback": func(task PriorityTask) PriorityTask {
+			return newFailureCallbackTask(task, func(error) {})
+		},
+		"future": func(task PriorityTask) PriorityTask {
+			return newFutureTask(task)
+		},
+		"dispatch awaited": func(task PriorityTask) PriorityTask {
+			return newDispatchAwaitedTask(task)
+		},
+		"barrier": func(task PriorityTask) PriorityTask {
+			return &barrierTask{taskWrapper: taskWrapper{PriorityTask: task}, barrier: &barrierImpl{}}
+		},
+	}
+	wrappers := make([]func(task PriorityTask) PriorityTask, 0, len(testCases))
+	for _, wrap := range testCases {
+		wrappers = append(wrappers, wrap)
+	}
+	testCases["nested"] = func(task PriorityTask) PriorityTask {
+		for _, wrap := range wrappers {
+			task = wrap(task)
+		}
+		return task
+	}
+
+	for name, wrap := range testCases {
+		task := &testOptionalTask{MockPriorityTask: NewMockPriorityTask(s.controller)}
+		wrapped := wrap(task)
+
+		// interfaces used by the processor are forwarded by the wrapper
+		ctx := context.WithValue(context.Background(), testContextKey{}, name)
+		s.NoError(wrapped.(ContextAwareTask).ExecuteWithContext(ctx), name)
+		s.Equal(name, task.executeCtx.Value(testContextKey{}), name)
+		s.Equal(task.MetricTags(), wrapped.(MetricTaggedTask).MetricTags(), name)
+
+		// interfaces used by the scheduler are resolved on the submitted task
+		submitted := unwrapSchedulerTask(wrapped)
+		s.Equal(task, submitted, name)
+		for _, ok := range []bool{
+			isNonDroppable(wrapped),
+			implementsIdempotentTask(submitted),
+			implementsBulkNackableTask(submitted),
+			implementsDependentTask(submitted),
+		} {
+			s.True(ok, name)
+		}
+	}
+}
+
+func implementsIdempotentTask(task Task) bool {
+	_, ok := task.(IdempotentTask)
+	return ok
+}
+
+func implementsBulkNackableTask(task Task) bool {
+	_, ok := task.(BulkNackableTask)
+	return ok
+}
+
+func implementsDependentTask(task Task) bool {
+	_, ok := task.(DependentTask)
+	return ok
+}
+
+func (t *testOptionalTask) ExecuteWithContext(
+	ctx context.Context,
+) error {
+	t.executeCtx = ctx
+	return nil
+}
+
+func (t *testOptionalTask) MetricTags() map[string]string {
+	return map[string]string{"domain": "some random domain"}
+}
+
+func (t *testOptionalTask) NonDroppable() bool {
+	return true
+}
+
+func (t *testOptionalTask) IdempotencyKey() string {
+	return "some random key"
+}
+
+func (t *testOptionalTask) BulkNacker() BulkNacker {
+	return testBulkNacker{}
+}
+
+func (t *testOptionalTask) Dependency() string {
+	return "some random dependency"
+}
+
+func (n testBulkNacker) NackAll(tasks []PriorityTask) {}
@@ -0,0 +1,229 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tasktest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/task"
+)
+
+type (
+	// DeterministicSchedulerOptions configs DeterministicScheduler
+	DeterministicSchedulerOptions struct {
+		// Weights are the WRR weights of the priorities, tasks of other priorities are rejected
+		Weights map[int]int
+		// WorkerCount is the number of simulated workers. Up to WorkerCount tasks are dispatched and ready
+		// to execute at a time, and the next one to execute is picked by the seeded random source, as if
+		// they were executed concurrently. Defaults to one, which executes tasks in the dispatch order
+		WorkerCount int
+		// MaxAttempts bounds the number of times a task failing with a retryable error is executed,
+		// zero means unlimited. Failed tasks are put back among the ready tasks for retry
+		MaxAttempts int
+	}
+
+	// DeterministicScheduler is a task.Scheduler for simulation and fuzz tests, which dispatches and
+	// executes tasks on the goroutine calling RunUntilIdle, so given the same seed, options and submissions,
+	// tasks are always executed in the same order. It's not safe for concurrent use, tasks may submit
+	// follow-up tasks from Execute, which runs on the goroutine calling RunUntilIdle
+	DeterministicScheduler struct {
+		options  *DeterministicSchedulerOptions
+		random   *rand.Rand
+		strategy task.DispatchStrategy
+		status   int32
+
+		queues          []task.TaskQueue // sorted by priority
+		queueByPriority map[int]*deterministicQueue
+		readyTasks      []*readyTask
+	}
+
+	deterministicQueue struct {
+		priority int
+		tasks    []task.PriorityTask
+	}
+
+	readyTask struct {
+		task.PriorityTask
+
+		attempts int
+	}
+)
+
+var _ task.Scheduler = (*DeterministicScheduler)(nil)
+
+// NewDeterministicScheduler creates a new deterministic scheduler, the seed decides
+// the execution order among the tasks ready to execute at the same time
+func NewDeterministicScheduler(
+	seed int64,
+	options *DeterministicSchedulerOptions,
+) (*DeterministicScheduler, error) {
+	if len(options.Weights) == 0 {
+		return nil, errors.New("weight is not specified in the scheduler option")
+	}
+
+	scheduler := &DeterministicScheduler{
+		options:         options,
+		random:          rand.New(rand.NewSource(seed)),
+		status:          common.DaemonStatusInitialized,
+		queueByPriority: make(map[int]*deterministicQueue, len(options.Weights)),
+	}
+	for priority := range options.Weights {
+		queue := &deterministicQueue{priority: priority}
+		scheduler.queueByPriority[priority] = queue
+		scheduler.queues = append(scheduler.queues, queue)
+	}
+	sort.Slice(scheduler.queues, func(i, j int) bool {
+		return scheduler.queues[i].Priority() < scheduler.queues[j].Priority()
+	})
+	scheduler.strategy = task.NewWeightedRoundRobinDispatchStrategy(func() map[int]int {
+		return options.Weights
+	}, nil)
+	return scheduler, nil
+}
+
+// Start implements task.Scheduler, tasks are only executed by RunUntilIdle
+func (s *DeterministicScheduler) Start() {
+	if s.status == common.DaemonStatusInitialized {
+		s.status = common.DaemonStatusStarted
+	}
+}
+
+// Stop implements task.Scheduler, tasks not yet executed are nacked
+func (s *DeterministicScheduler) Stop() {
+	if s.status == common.DaemonStatusStopped {
+		return
+	}
+	s.status = common.DaemonStatusStopped
+
+	for _, readyTask := range s.readyTasks {
+		readyTask.Nack()
+	}
+	s.readyTasks = nil
+	for _, queue := range s.queues {
+		for {
+			queuedTask, ok := queue.Poll()
+			if !ok {
+				break
+			}
+			queuedTask.Nack()
+		}
+	}
+}
+
+// Submit implements task.Scheduler, it never blocks
+func (s *DeterministicScheduler) Submit(
+	priorityTask task.PriorityTask,
+) error {
+	if s.status == common.DaemonStatusStopped {
+		return task.ErrTaskSchedulerClosed
+	}
+	queue, ok := s.queueByPriority[priorityTask.Priority()]
+	if !ok {
+		return fmt.Errorf("unknown task priority: %v", priorityTask.Priority())
+	}
+	queue.tasks = append(queue.tasks, priorityTask)
+	return nil
+}
+
+// TrySubmit implements task.Scheduler, the task is always accepted unless Submit fails
+func (s *DeterministicScheduler) TrySubmit(
+	priorityTask task.PriorityTask,
+) (bool, error) {
+	if err := s.Submit(priorityTask); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RunUntilIdle dispatches and executes tasks until there's no task left, including the tasks
+// submitted meanwhile, and returns the number of executions. It does nothing unless started
+func (s *DeterministicScheduler) RunUntilIdle() int {
+	workerCount := s.options.WorkerCount
+	if workerCount <= 0 {
+		workerCount = 1
+	}
+
+	numExecutions := 0
+	for s.status == common.DaemonStatusStarted {
+		for len(s.readyTasks) < workerCount {
+			priorityTask, ok := s.strategy.Next(s.queues)
+			if !ok {
+				break
+			}
+			s.readyTasks = append(s.readyTasks, &readyTask{PriorityTask: priorityTask})
+		}
+		if len(s.readyTasks) == 0 {
+			break
+		}
+
+		// the relative order of the remaining ready tasks is kept, so that
+		// the execution order only depends on the random source
+		index := s.random.Intn(len(s.readyTasks))
+		readyTask := s.readyTasks[index]
+		s.readyTasks = append(s.readyTasks[:index], s.readyTasks[index+1:]...)
+		s.execute(readyTask)
+		numExecutions++
+	}
+	return numExecutions
+}
+
+func (s *DeterministicScheduler) execute(
+	readyTask *readyTask,
+) {
+	readyTask.attempts++
+	err := readyTask.Execute()
+	if err != nil {
+		err = readyTask.HandleErr(err)
+	}
+	if err == nil {
+		readyTask.Ack()
+		return
+	}
+
+	if s.status == common.DaemonStatusStarted && readyTask.RetryErr(err) &&
+		(s.options.MaxAttempts <= 0 || readyTask.attempts < s.options.MaxAttempts) {
+		s.readyTasks = append(s.readyTasks, readyTask)
+		return
+	}
+	readyTask.Nack()
+}
+
+func (q *deterministicQueue) Priority() int {
+	return q.priority
+}
+
+func (q *deterministicQueue) Len() int {
+	return len(q.tasks)
+}
+
+func (q *deterministicQueue) Poll() (task.PriorityTask, bool) {
+	if len(q.tasks) == 0 {
+		return nil, false
+	}
+	head := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	return head, true
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tasktest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/cadence/common/task"
+)
+
+type (
+	recordingTask struct {
+		id        int
+		priority  int
+		failures  int
+		onExecute func(t *recordingTask)
+		log       *[]string
+		state     task.State
+	}
+)
+
+var errRecordingTaskFailed = errors.New("recording task failed")
+
+func TestDeterministicScheduler_SingleWorker(t *testing.T) {
+	scheduler := newTestDeterministicScheduler(t, 0, 1)
+
+	var log []string
+	for id, priority := range []int{0, 0, 0, 1, 1, 1} {
+		require.NoError(t, scheduler.Submit(&recordingTask{id: id, priority: priority, log: &log}))
+	}
+	require.Equal(t, 6, scheduler.RunUntilIdle())
+	// tasks are executed in the WRR dispatch order
+	require.Equal(t, []string{
+		"execute 0", "ack 0",
+		"execute 1", "ack 1",
+		"execute 3", "ack 3",
+		"execute 2", "ack 2",
+		"execute 4", "ack 4",
+		"execute 5", "ack 5",
+	}, log)
+}
+
+func TestDeterministicScheduler_Reproducible(t *testing.T) {
+	run := func(seed int64) []string {
+		scheduler := newTestDeterministicScheduler(t, seed, 4)
+		var log []string
+		for id := 0; id != 20; id++ {
+			require.NoError(t, scheduler.Submit(&recordingTask{id: id, priority: id % 2, failures: id % 3, log: &log}))
+		}
+		scheduler.RunUntilIdle()
+		return log
+	}
+
+	require.Equal(t, run(1), run(1))
+	require.NotEqual(t, run(1), run(2))
+}
+
+func TestDeterministicScheduler_Retry(t *testing.T) {
+	scheduler := newTestDeterministicScheduler(t, 0, 1)
+
+	var log []string
+	require.NoError(t, scheduler.Submit(&recordingTask{id: 0, priority: 0, failures: 1, log: &log}))
+	require.NoError(t, scheduler.Submit(&recordingTask{id: 1, priority: 0, failures: 5, log: &log}))
+	require.Equal(t, 5, scheduler.RunUntilIdle())
+	require.Equal(t, []string{
+		"execute 0",
+		"execute 0", "ack 0",
+		"execute 1",
+		"execute 1",
+		"execute 1", "nack 1",
+	}, log)
+}
+
+func TestDeterministicScheduler_FollowUpTasks(t *testing.T) {
+	scheduler := newTestDeterministicScheduler(t, 0, 2)
+
+	var log []string
+	require.NoError(t, scheduler.Submit(&recordingTask{id: 0, priority: 1, log: &log, onExecute: func(parent *recordingTask) {
+		require.NoError(t, scheduler.Submit(&recordingTask{id: 1, priority: 0, log: parent.log}))
+	}}))
+	require.Equal(t, 2, scheduler.RunUntilIdle())
+	require.Equal(t, []string{"execute 0", "ack 0", "execute 1", "ack 1"}, log)
+	require.Zero(t, scheduler.RunUntilIdle())
+}
+
+func TestDeterministicScheduler_Stop(t *testing.T) {
+	scheduler, err := NewDeterministicScheduler(0, &DeterministicSchedulerOptions{Weights: map[int]int{0: 1}})
+	require.NoError(t, err)
+
+	var log []string
+	queuedTask := &recordingTask{id: 0, priority: 0, log: &log}
+	require.NoError(t, scheduler.Submit(queuedTask))
+	require.Error(t, scheduler.Submit(&recordingTask{id: 1, priority: 1, log: &log}))
+
+	// tasks are not executed before the scheduler is started
+	require.Zero(t, scheduler.RunUntilIdle())
+
+	scheduler.Stop()
+	require.Equal(t, task.TaskStateNacked, queuedTask.State())
+	require.Equal(t, task.ErrTaskSchedulerClosed, scheduler.Submit(&recordingTask{id: 2, priority: 0, log: &log}))
+	require.Equal(t, []string{"nack 0"}, log)
+}
+
+func newTestDeterministicScheduler(
+	t *testing.T,
+	seed int64,
+	workerCount int,
+) *DeterministicScheduler {
+	scheduler, err := NewDeterministicScheduler(seed, &DeterministicSchedulerOptions{
+		Weights:     map[int]int{0: 2, 1: 1},
+		WorkerCount: workerCount,
+		MaxAttempts: 3,
+	})
+	require.NoError(t, err)
+	scheduler.Start()
+	return scheduler
+}
+
+func (t *recordingTask) Execute() error {
+	t.record("execute")
+	if t.onExecute != nil {
+		t.onExecute(t)
+	}
+	if t.failures > 0 {
+		t.failures--
+		return errRecordingTaskFailed
+	}
+	return nil
+}
+
+func (t *recordingTask) HandleErr(err error) error {
+	return err
+}
+
+func (t *recordingTask) RetryErr(err error) bool {
+	return err == errRecordingTaskFailed
+}
+
+func (t *recordingTask) Ack() {
+	t.state = task.TaskStateAcked
+	t.record("ack")
+}
+
+func (t *recordingTask) Nack() {
+	t.state = task.TaskStateNacked
+	t.record("nack")
+}
+
+func (t *recordingTask) State() task.State {
+	return t.state
+}
+
+func (t *recordingTask) Priority() int {
+	return t.priority
+}
+
+func (t *recordingTask) SetPriority(priority int) {
+	t.priority = priority
+}
+
+func (t *recordingTask) record(event string) {
+	*t.log = append(*t.log, fmt.Sprintf("%v %v", event, t.id))
+}
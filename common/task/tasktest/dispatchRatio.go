@@ -0,0 +1,169 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tasktest
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/cadence/common/task"
+)
+
+type (
+	// Submission specifies the tasks submitted for a priority by MeasureDispatchRatio
+	Submission struct {
+		Priority int
+		NumTasks int
+		// ExecutionTime is how long each task takes to execute, it should be long enough
+		// for the tasks to be backlogged in the scheduler
+		ExecutionTime time.Duration
+	}
+
+	measureTask struct {
+		priority      int
+		executionTime time.Duration
+		onDone        func(priority int)
+		state         int32
+	}
+)
+
+// MeasureDispatchRatio submits tasks to the scheduler as specified by submissions, and returns
+// the fraction of tasks executed for each priority within the window, which starts when this
+// function is called. The scheduler must already be started, and the submissions should keep
+// every priority backlogged during the window, otherwise the observed ratio reflects the
+// submissions rather than the scheduling. Tasks not executed within the window are left in the scheduler.
+func MeasureDispatchRatio(
+	scheduler task.Scheduler,
+	submissions []Submission,
+	window time.Duration,
+) (map[int]float64, error) {
+	var lock sync.Mutex
+	measuring := true
+	numExecuted := make(map[int]int, len(submissions))
+	onDone := func(priority int) {
+		lock.Lock()
+		defer lock.Unlock()
+		if measuring {
+			numExecuted[priority]++
+		}
+	}
+
+	var submitErr atomic.Value
+	for _, submission := range submissions {
+		// submit in parallel so that a full priority
+		// queue won't block other priorities
+		go func(submission Submission) {
+			for i := 0; i != submission.NumTasks; i++ {
+				if err := scheduler.Submit(&measureTask{
+					priority:      submission.Priority,
+					executionTime: submission.ExecutionTime,
+					onDone:        onDone,
+					state:         int32(task.TaskStatePending),
+				}); err != nil {
+					submitErr.Store(err)
+					return
+				}
+			}
+		}(submission)
+	}
+
+	time.Sleep(window)
+
+	lock.Lock()
+	defer lock.Unlock()
+	measuring = false
+
+	if err := submitErr.Load(); err != nil {
+		return nil, err.(error)
+	}
+
+	total := 0
+	for _, num := range numExecuted {
+		total += num
+	}
+	if total == 0 {
+		return nil, errors.New("no task is executed within the window")
+	}
+
+	ratios := make(map[int]float64, len(submissions))
+	for _, submission := range submissions {
+		ratios[submission.Priority] = float64(numExecuted[submission.Priority]) / float64(total)
+	}
+	return ratios, nil
+}
+
+// ExpectedDispatchRatio returns the dispatch ratio for each priority implied by
+// the weights, assuming all priorities are backlogged
+func ExpectedDispatchRatio(
+	weights map[int]int,
+) map[int]float64 {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+
+	ratios := make(map[int]float64, len(weights))
+	for priority, weight := range weights {
+		if total != 0 {
+			ratios[priority] = float64(weight) / float64(total)
+		}
+	}
+	return ratios
+}
+
+func (t *measureTask) Execute() error {
+	if t.executionTime != 0 {
+		time.Sleep(t.executionTime)
+	}
+	return nil
+}
+
+func (t *measureTask) HandleErr(err error) error {
+	return err
+}
+
+func (t *measureTask) RetryErr(err error) bool {
+	return false
+}
+
+func (t *measureTask) Ack() {
+	atomic.StoreInt32(&t.state, int32(task.TaskStateAcked))
+	t.onDone(t.priority)
+}
+
+func (t *measureTask) Nack() {
+	atomic.StoreInt32(&t.state, int32(task.TaskStateNacked))
+	t.onDone(t.priority)
+}
+
+func (t *measureTask) State() task.State {
+	return task.State(atomic.LoadInt32(&t.state))
+}
+
+func (t *measureTask) Priority() int {
+	return t.priority
+}
+
+func (t *measureTask) SetPriority(priority int) {
+	t.priority = priority
+}
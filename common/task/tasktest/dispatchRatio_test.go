@@ -0,0 +1,77 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tasktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/uber/cadence/common/backoff"
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/metrics"
+	"github.com/uber/cadence/common/service/dynamicconfig"
+	"github.com/uber/cadence/common/task"
+)
+
+func TestMeasureDispatchRatio_WeightedRoundRobin(t *testing.T) {
+	weights := map[int]int{0: 3, 1: 2, 2: 1}
+	scheduler, err := task.NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewNopLogger(),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&task.WeightedRoundRobinTaskSchedulerOptions{
+			Weights: dynamicconfig.GetMapPropertyFn(map[string]interface{}{
+				"0": 3,
+				"1": 2,
+				"2": 1,
+			}),
+			QueueSize:       1000,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	require.NoError(t, err)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	ratios, err := MeasureDispatchRatio(
+		scheduler,
+		[]Submission{
+			{Priority: 0, NumTasks: 10000, ExecutionTime: 100 * time.Microsecond},
+			{Priority: 1, NumTasks: 10000, ExecutionTime: 100 * time.Microsecond},
+			{Priority: 2, NumTasks: 10000, ExecutionTime: 100 * time.Microsecond},
+		},
+		200*time.Millisecond,
+	)
+	require.NoError(t, err)
+
+	for priority, expectedRatio := range ExpectedDispatchRatio(weights) {
+		require.InDelta(t, expectedRatio, ratios[priority], 0.05)
+	}
+}
+
+func TestExpectedDispatchRatio(t *testing.T) {
+	require.Equal(t, map[int]float64{0: 0.75, 1: 0.25}, ExpectedDispatchRatio(map[int]int{0: 3, 1: 1}))
+	require.Equal(t, map[int]float64{}, ExpectedDispatchRatio(map[int]int{0: 0}))
+}
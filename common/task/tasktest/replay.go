@@ -0,0 +1,158 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tasktest
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/cadence/common/task"
+)
+
+type (
+	// ReplayOptions configs ReplaySubmissions
+	ReplayOptions struct {
+		// Speed scales the recorded timing, e.g. 10 replays ten times faster, defaults to one
+		Speed float64
+		// NewTask creates the task submitted for each record, defaults to a no-op task with the
+		// priority, metric tags and correlation ID of the record
+		NewTask func(record task.SubmissionRecord) task.PriorityTask
+	}
+
+	// ReplayResult is the outcome of the replayed submissions
+	ReplayResult struct {
+		// Submitted is the number of tasks accepted by the scheduler
+		Submitted int
+		// Rejected is the number of tasks not accepted by the scheduler, including
+		// tasks not submitted by TrySubmit and tasks failed to be submitted
+		Rejected int
+	}
+
+	replayTask struct {
+		priority      int
+		metricTags    map[string]string
+		correlationID string
+		state         int32
+	}
+)
+
+// ReplaySubmissions re-drives the scheduler with the submissions recorded by a recording scheduler, see
+// task.NewRecordingScheduler. Each record is submitted at its offset from the first record, scaled by
+// Speed, via TrySubmit if it's recorded so and Submit otherwise, regardless of whether it's rejected
+// in the recording. Submissions are made one at a time, so a blocking Submit delays the following ones,
+// as blocked submitters would in the recorded system. The scheduler must already be started, tasks
+// still queued when this function returns are left in the scheduler
+func ReplaySubmissions(
+	scheduler task.Scheduler,
+	recording io.Reader,
+	options *ReplayOptions,
+) (ReplayResult, error) {
+	records, err := task.ReadSubmissionRecords(recording)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	speed := 1.0
+	newTask := newReplayTask
+	if options != nil {
+		if options.Speed > 0 {
+			speed = options.Speed
+		}
+		if options.NewTask != nil {
+			newTask = options.NewTask
+		}
+	}
+
+	var result ReplayResult
+	startTime := time.Now()
+	for _, record := range records {
+		offset := time.Duration(float64(record.Time.Sub(records[0].Time)) / speed)
+		if delay := offset - time.Since(startTime); delay > 0 {
+			time.Sleep(delay)
+		}
+
+		replayedTask := newTask(record)
+		submitted := true
+		if record.Try {
+			submitted, err = scheduler.TrySubmit(replayedTask)
+		} else {
+			err = scheduler.Submit(replayedTask)
+		}
+		if err != nil || !submitted {
+			result.Rejected++
+			continue
+		}
+		result.Submitted++
+	}
+	return result, nil
+}
+
+func newReplayTask(
+	record task.SubmissionRecord,
+) task.PriorityTask {
+	return &replayTask{
+		priority:      record.Priority,
+		metricTags:    record.MetricTags,
+		correlationID: record.CorrelationID,
+		state:         int32(task.TaskStatePending),
+	}
+}
+
+func (t *replayTask) Execute() error {
+	return nil
+}
+
+func (t *replayTask) HandleErr(err error) error {
+	return err
+}
+
+func (t *replayTask) RetryErr(err error) bool {
+	return false
+}
+
+func (t *replayTask) Ack() {
+	atomic.StoreInt32(&t.state, int32(task.TaskStateAcked))
+}
+
+func (t *replayTask) Nack() {
+	atomic.StoreInt32(&t.state, int32(task.TaskStateNacked))
+}
+
+func (t *replayTask) State() task.State {
+	return task.State(atomic.LoadInt32(&t.state))
+}
+
+func (t *replayTask) Priority() int {
+	return t.priority
+}
+
+func (t *replayTask) SetPriority(priority int) {
+	t.priority = priority
+}
+
+func (t *replayTask) MetricTags() map[string]string {
+	return t.metricTags
+}
+
+func (t *replayTask) CorrelationID() string {
+	return t.correlationID
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tasktest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/cadence/common/log/loggerimpl"
+	"github.com/uber/cadence/common/task"
+)
+
+func TestReplaySubmissions(t *testing.T) {
+	scheduler := newTestDeterministicScheduler(t, 0, 1)
+
+	var replayed []task.SubmissionRecord
+	startTime := time.Now()
+	result, err := ReplaySubmissions(scheduler, strings.NewReader(
+		`{"time":"2020-01-01T00:00:00.1Z","priority":1,"try":true}`+"\n"+
+			`{"time":"2020-01-01T00:00:00Z","priority":0}`+"\n"+
+			`{"time":"2020-01-01T00:00:00.05Z","priority":7,"correlationId":"some random correlation ID"}`+"\n",
+	), &ReplayOptions{
+		Speed: 2,
+		NewTask: func(record task.SubmissionRecord) task.PriorityTask {
+			replayed = append(replayed, record)
+			return newReplayTask(record)
+		},
+	})
+	require.NoError(t, err)
+	// the last record is replayed 100ms after the first one at twice the recorded speed
+	require.True(t, time.Since(startTime) >= 50*time.Millisecond)
+	require.Equal(t, ReplayResult{Submitted: 2, Rejected: 1}, result)
+	require.Len(t, replayed, 3)
+	require.Equal(t, 0, replayed[0].Priority)
+	require.Equal(t, "some random correlation ID", replayed[1].CorrelationID)
+	require.Equal(t, 1, replayed[2].Priority)
+	require.Equal(t, 2, scheduler.RunUntilIdle())
+
+	_, err = ReplaySubmissions(scheduler, strings.NewReader("not a record\n"), nil)
+	require.Error(t, err)
+}
+
+func TestReplaySubmissions_Recorded(t *testing.T) {
+	var recording bytes.Buffer
+	recordingScheduler := task.NewRecordingScheduler(
+		newTestDeterministicScheduler(t, 0, 1),
+		&recording,
+		loggerimpl.NewNopLogger(),
+	)
+	for _, priority := range []int{0, 1, 1, 0} {
+		require.NoError(t, recordingScheduler.Submit(&recordingTask{priority: priority}))
+	}
+
+	scheduler := newTestDeterministicScheduler(t, 0, 1)
+	result, err := ReplaySubmissions(scheduler, &recording, nil)
+	require.NoError(t, err)
+	require.Equal(t, ReplayResult{Submitted: 4}, result)
+	require.Equal(t, 4, scheduler.RunUntilIdle())
+}
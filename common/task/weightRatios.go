@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/service/dynamicconfig"
+)
+
+// NormalizeWeights converts the ratios of priorities into integer weights via the largest remainder method,
+// e.g. ratios of 0.7, 0.2 and 0.1 with roundsPerCycle of 10 yields weights of 7, 2 and 1. roundsPerCycle is
+// the number of tasks dispatched in a full WRR round when all priorities are backlogged, i.e. the sum of the
+// weights, smaller values give a finer interleaving but a coarser approximation of the ratios. Ratios don't
+// need to sum up to one. Priorities with a positive ratio get a weight of at least one so that they are
+// never starved, in which case the weights may sum up to more than roundsPerCycle
+func NormalizeWeights(
+	ratios []float64,
+	roundsPerCycle int,
+) []int {
+	weights := make([]int, len(ratios))
+	total := 0.0
+	var positive []int
+	for i, ratio := range ratios {
+		if ratio > 0 {
+			total += ratio
+			positive = append(positive, i)
+		}
+	}
+	if total == 0 || roundsPerCycle <= 0 {
+		return weights
+	}
+
+	assigned := 0
+	remainders := make([]float64, len(ratios))
+	for _, i := range positive {
+		quota := ratios[i] / total * float64(roundsPerCycle)
+		weights[i] = int(quota)
+		remainders[i] = quota - float64(weights[i])
+		assigned += weights[i]
+	}
+
+	// the remaining slots go to the largest remainders, ties are broken by the order of priorities
+	sort.SliceStable(positive, func(i, j int) bool {
+		return remainders[positive[i]] > remainders[positive[j]]
+	})
+	for _, i := range positive {
+		if assigned >= roundsPerCycle {
+			break
+		}
+		weights[i]++
+		assigned++
+	}
+
+	for _, i := range positive {
+		if weights[i] == 0 {
+			weights[i] = 1
+		}
+	}
+	return weights
+}
+
+// loadWeights converts the weights from dynamic config into integer weights,
+// values are treated as ratios and normalized if NormalizeWeightsTo is specified
+func loadWeights(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) (map[int]int, error) {
+	var filters []dynamicconfig.FilterOption
+	if options.WeightsDomain != "" {
+		filters = append(filters, dynamicconfig.DomainFilter(options.WeightsDomain))
+	}
+	dcValue := options.Weights(filters...)
+	if options.NormalizeWeightsTo <= 0 {
+		return common.ConvertDynamicConfigMapPropertyToIntMap(dcValue)
+	}
+
+	ratioByPriority := make(map[int]float64, len(dcValue))
+	priorities := make([]int, 0, len(dcValue))
+	for key, value := range dcValue {
+		priority, err := strconv.Atoi(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert key %v, error: %v", key, err)
+		}
+
+		var ratio float64
+		switch value := value.(type) {
+		case float64:
+			ratio = value
+		case int:
+			ratio = float64(value)
+		case int32:
+			ratio = float64(value)
+		case int64:
+			ratio = float64(value)
+		default:
+			return nil, fmt.Errorf("unknown value %v with type %T", value, value)
+		}
+		if ratio < 0 {
+			return nil, fmt.Errorf("invalid weight ratio %v for priority %v", ratio, priority)
+		}
+		ratioByPriority[priority] = ratio
+		priorities = append(priorities, priority)
+	}
+	sort.Ints(priorities)
+
+	ratios := make([]float64, len(priorities))
+	for i, priority := range priorities {
+		ratios[i] = ratioByPriority[priority]
+	}
+	normalizedWeights := NormalizeWeights(ratios, options.NormalizeWeightsTo)
+	weights := make(map[int]int, len(priorities))
+	for i, priority := range priorities {
+		weights[priority] = normalizedWeights[i]
+	}
+	return weights, nil
+}
+
+// weightDrift returns the max relative deviation of the share of tasks dispatched for each priority from the
+// share of its weight, e.g. 0.5 if a priority expected to take 40% of the dispatches only takes 20%. Both shares
+// are among the given priorities, which should all have a positive weight. False is returned if no task is dispatched
+func weightDrift(
+	dispatched map[int]int64,
+	weights map[int]int,
+) (float64, bool) {
+	totalDispatched := int64(0)
+	totalWeight := 0
+	for priority, num := range dispatched {
+		totalDispatched += num
+		totalWeight += weights[priority]
+	}
+	if totalDispatched == 0 || totalWeight == 0 {
+		return 0, false
+	}
+
+	drift := 0.0
+	for priority, num := range dispatched {
+		expected := float64(weights[priority]) / float64(totalWeight)
+		if expected == 0 {
+			continue
+		}
+		observed := float64(num) / float64(totalDispatched)
+		drift = math.Max(drift, math.Abs(observed-expected)/expected)
+	}
+	return drift, true
+}
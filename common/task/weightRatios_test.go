@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/uber/cadence/common/service/dynamicconfig"
+)
+
+func TestNormalizeWeights(t *testing.T) {
+	testCases := []struct {
+		ratios          []float64
+		roundsPerCycle  int
+		expectedWeights []int
+	}{
+		{
+			ratios:          []float64{0.7, 0.2, 0.1},
+			roundsPerCycle:  10,
+			expectedWeights: []int{7, 2, 1},
+		},
+		{
+			// ratios don't need to sum up to one
+			ratios:          []float64{70, 20, 10},
+			roundsPerCycle:  20,
+			expectedWeights: []int{14, 4, 2},
+		},
+		{
+			// quotas are 3.33 each, the remaining slot goes to the first priority
+			ratios:          []float64{1, 1, 1},
+			roundsPerCycle:  10,
+			expectedWeights: []int{4, 3, 3},
+		},
+		{
+			// quotas are 2.5, 1.65 and 0.85, the remaining slots go to the largest remainders
+			ratios:          []float64{0.5, 0.33, 0.17},
+			roundsPerCycle:  5,
+			expectedWeights: []int{2, 2, 1},
+		},
+		{
+			// positive ratios always get a weight
+			ratios:          []float64{0.99, 0, 0.01},
+			roundsPerCycle:  10,
+			expectedWeights: []int{10, 0, 1},
+		},
+		{
+			ratios:          []float64{0, 0},
+			roundsPerCycle:  10,
+			expectedWeights: []int{0, 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expectedWeights, NormalizeWeights(tc.ratios, tc.roundsPerCycle), "%v", tc.ratios)
+	}
+}
+
+func TestLoadWeights(t *testing.T) {
+	options := &WeightedRoundRobinTaskSchedulerOptions{
+		Weights: dynamicconfig.GetMapPropertyFn(map[string]interface{}{
+			"0": 0.7,
+			"1": 0.2,
+			"5": 0.1,
+		}),
+	}
+	weights, err := loadWeights(options)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 0, 1: 0, 5: 0}, weights)
+
+	options.NormalizeWeightsTo = 10
+	weights, err = loadWeights(options)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 7, 1: 2, 5: 1}, weights)
+
+	options.Weights = dynamicconfig.GetMapPropertyFn(map[string]interface{}{"0": -0.5})
+	_, err = loadWeights(options)
+	assert.Error(t, err)
+}
+
+func TestLoadWeights_Domain(t *testing.T) {
+	options := &WeightedRoundRobinTaskSchedulerOptions{
+		Weights: func(opts ...dynamicconfig.FilterOption) map[string]interface{} {
+			filters := make(map[dynamicconfig.Filter]interface{})
+			for _, opt := range opts {
+				opt(filters)
+			}
+			if filters[dynamicconfig.DomainName] == "noisy-domain" {
+				return map[string]interface{}{"0": 1, "1": 1}
+			}
+			return map[string]interface{}{"0": 3, "1": 1}
+		},
+	}
+	weights, err := loadWeights(options)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 3, 1: 1}, weights)
+
+	options.WeightsDomain = "noisy-domain"
+	weights, err = loadWeights(options)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 1, 1: 1}, weights)
+}
+
+func TestWeightDrift(t *testing.T) {
+	testCases := []struct {
+		dispatched    map[int]int64
+		weights       map[int]int
+		expectedDrift float64
+		expectedOK    bool
+	}{
+		{
+			dispatched:    map[int]int64{0: 30, 1: 20, 2: 10},
+			weights:       map[int]int{0: 3, 1: 2, 2: 1},
+			expectedDrift: 0,
+			expectedOK:    true,
+		},
+		{
+			// priority 2 gets 20% of the dispatches instead of 40%
+			dispatched:    map[int]int64{0: 80, 2: 20},
+			weights:       map[int]int{0: 3, 2: 2},
+			expectedDrift: 0.5,
+			expectedOK:    true,
+		},
+		{
+			// a starved priority has the deviation of one
+			dispatched:    map[int]int64{0: 10, 1: 0},
+			weights:       map[int]int{0: 1, 1: 1},
+			expectedDrift: 1,
+			expectedOK:    true,
+		},
+		{
+			dispatched: map[int]int64{0: 0, 1: 0},
+			weights:    map[int]int{0: 1, 1: 1},
+			expectedOK: false,
+		},
+		{
+			dispatched: map[int]int64{},
+			weights:    map[int]int{0: 1},
+			expectedOK: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		drift, ok := weightDrift(tc.dispatched, tc.weights)
+		require.Equal(t, tc.expectedOK, ok, "dispatched %v", tc.dispatched)
+		assert.InDelta(t, tc.expectedDrift, drift, 1e-9, "dispatched %v", tc.dispatched)
+	}
+}
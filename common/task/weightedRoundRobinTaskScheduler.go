@@ -21,8 +21,15 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,256 +43,5254 @@ import (
 )
 
 type (
-	// WeightedRoundRobinTaskSchedulerOptions configs WRR task scheduler
+	// WeightedRoundRobinTaskScheduler is the interface for the WRR task scheduler,
+	// which supports reconfiguring itself at runtime
+	WeightedRoundRobinTaskScheduler interface {
+		Scheduler
+		// Reconfigure atomically applies the weights and worker count changes,
+		// dispatchers will only observe the change between two dispatch rounds
+		Reconfigure(options ReconfigureOptions) error
+		// UpdateWeights replaces the weights with the given ones indexed by priority, as Reconfigure does.
+		// The number of weights must match the number of priorities currently weighted, which must be
+		// contiguous from zero, and every weight must be positive, so that no priority is starved by mistake
+		UpdateWeights(weights []int) error
+		// Drain blocks until all queued tasks are dispatched or the context is done, the progress
+		// is logged and emitted as metrics every DrainProgressInterval
+		Drain(ctx context.Context) error
+		// DrainProgress returns the number of queued tasks, both in total and of each priority. The latter
+		// is indexed by priority up to the highest priority with a task queue, negative priorities are only
+		// counted in the total, as are tasks held for DynamicPriority. It can be polled while Drain is in progress
+		DrainProgress() (remaining int, perPriority []int)
+		// Shutdown stops the scheduler gracefully: it rejects new submissions, waits for the queued tasks to be
+		// dispatched and for the processor to complete the tasks dispatched, and then stops the scheduler as Stop
+		// does. The waits are bounded by the context, once it's done the scheduler is stopped right away and the
+		// context's error is returned. The summary tells how many tasks completed during the shutdown and how many
+		// were still queued or in flight when it's stopped, which are handled as by Stop, e.g. nacked if NackOnStop
+		// is specified. In-flight tasks are only waited for if the processor is a ParallelTaskProcessor
+		Shutdown(ctx context.Context) (ShutdownSummary, error)
+		// StartAndWait starts the scheduler as Start does, and blocks until ReadinessCheck passes and dispatching
+		// begins. If the context is done first, the scheduler is stopped as Stop does and ErrProcessorNotReady is
+		// returned. It returns nil right after starting the scheduler if ReadinessCheck is not specified
+		StartAndWait(ctx context.Context) error
+		// SetQueueSize updates the size of the queue for the priority, shrinking the queue
+		// fails if more tasks than the new size are currently queued
+		SetQueueSize(priority int, size int) error
+		// Stats returns a snapshot of the scheduler's internal state
+		Stats() WeightedRoundRobinTaskSchedulerStats
+		// WasStarted returns true if the scheduler has been started, even if it's stopped afterwards,
+		// so that callers starting it defensively can check it idempotently. Repeated Start and Stop
+		// calls are no-ops and don't log
+		WasStarted() bool
+		// Reset returns a stopped scheduler to the initialized state so that it can be started again,
+		// as if it were newly created with the same options, except that the metrics scope set via
+		// SetMetricsScope is kept. Changes applied via Reconfigure are reverted and the weights are
+		// reloaded. Tasks still queued once Stop returns are discarded without being acked or nacked.
+		// It must be called after Stop returns, and not concurrently with any other method
+		Reset() error
+		// InFlightTasks returns descriptors of the tasks being executed by the processor, which
+		// include tasks of other schedulers when the processor is a shared WorkerPool
+		InFlightTasks() []InFlightTask
+		// SubmitFuture submits the task and returns a handle for waiting and cancelling it
+		SubmitFuture(task PriorityTask) (TaskFuture, error)
+		// SubmitWithFailureCallback submits the task as Submit does, and invokes onFailure exactly once with the
+		// error if the task fails with a non-retryable error or exhausts its retries, before it's handled as
+		// configured, e.g. nacked. It's never invoked if the task is acked, or nacked for other reasons like being
+		// dropped on Stop. The callback runs on the processor worker goroutine exhausting the task, so it should return quickly
+		SubmitWithFailureCallback(task PriorityTask, onFailure func(err error)) error
+		// SubmitAndAwaitDispatch submits the task and blocks until it's submitted to the processor by a
+		// dispatcher, for producers which must not outrun the dispatch capacity. It returns
+		// ErrTaskNotDispatched if the task is acked or nacked before that, e.g. when replaced or aged out,
+		// and ErrTaskSchedulerClosed once the scheduler is stopped. If the context is done first, the
+		// context error is returned and the task stays queued. The processor sees a wrapper of the task
+		SubmitAndAwaitDispatch(ctx context.Context, task PriorityTask) error
+		// SubmitWithPosition submits the task as Submit does, and returns the number of tasks ahead of it
+		// in the queue of its priority when it's enqueued, zero if it's dispatched directly or deduped.
+		// The position is best-effort, as queued tasks keep being dispatched concurrently, e.g. for
+		// displaying a rough ETA
+		SubmitWithPosition(task PriorityTask) (int, error)
+		// SubmitWithEnqueueTime submits the task as Submit does, except that the task is considered
+		// enqueued at enqueuedAt, e.g. when it was produced upstream, for MaxQueueAge, AgePriorityEscalation
+		// and the end to end latency. Tasks are still dispatched in the order they are submitted, so an
+		// earlier enqueue time doesn't move the task ahead of others, and aged tasks are only detected
+		// once they reach the head of the queue. A time later than EnqueueTimeTolerance from now is
+		// rejected with ErrEnqueueTimeInFuture, a later time within the tolerance is treated as now
+		SubmitWithEnqueueTime(task PriorityTask, enqueuedAt time.Time) error
+		// SubmitIdempotent submits the task, and returns true without submitting it if a task with
+		// the same IdempotencyKey was submitted within IdempotencyTTL, including tasks already completed.
+		// Keys of nacked tasks are forgotten so that they can be resubmitted. Only takes effect when the
+		// task implements IdempotentTask and IdempotencyCacheSize is specified, Submit behaves the same
+		// except that duplicates are not reported
+		SubmitIdempotent(task PriorityTask) (bool, error)
+		// SubmitReplace replaces the queued task with the same priority and replace key, or submits
+		// the task normally if no such task exists. The new task takes the position of the replaced one,
+		// so it may be dispatched before tasks submitted earlier than it. The replaced task is acked
+		SubmitReplace(task ReplaceableTask) error
+		// SubmitFront submits the task to the head of the queue of its priority, so that it's dispatched
+		// before the tasks already queued with the same priority. This violates the FIFO order within the
+		// priority and is intended for rare control tasks, e.g. a barrier which must run before queued work.
+		// It blocks until there's space in the queue, idempotency, dynamic priority and direct dispatch
+		// are not applied for tasks submitted this way
+		SubmitFront(task PriorityTask) error
+		// SubmitAtomic submits either all or none of the tasks: capacity for all the tasks is reserved
+		// in their priority queues first, and tasks are only enqueued if every reservation succeeds,
+		// otherwise ErrInsufficientCapacity is returned. It never blocks waiting for capacity.
+		// Tasks of the same priority are enqueued in the given order, idempotency and
+		// direct dispatch are not applied for tasks submitted this way
+		SubmitAtomic(tasks []PriorityTask) error
+		// SubmitBatch submits the tasks and notifies the dispatchers once for the whole batch. In blocking
+		// mode it blocks until all the tasks are enqueued. In partial mode it never blocks, tasks which
+		// don't fit in their priority queue are returned in the given order for the caller to retry later,
+		// once a task is not accepted, the following tasks of the same priority are not accepted either so
+		// that they are still dispatched in order. Unaccepted tasks are also returned along with
+		// ErrTaskSchedulerClosed if the scheduler is stopped meanwhile. Tasks of unknown priorities fail the
+		// whole batch before any task is enqueued. Idempotency and direct dispatch are not applied
+		SubmitBatch(tasks []PriorityTask, partial bool) ([]PriorityTask, error)
+		// Peek returns up to n tasks from the head of the queue of the priority, in dispatch order, without
+		// removing them, e.g. for admin tooling to inspect the oldest queued tasks. The tasks are the ones
+		// submitted by callers, and tasks held for DynamicPriority are not included. It's best-effort, as
+		// the returned tasks may be dispatched or replaced concurrently, so callers must not ack or nack them
+		Peek(priority int, n int) []PriorityTask
+		// DispatchDebugState returns the dispatch state of each priority with a task queue,
+		// sorted by priority. It's intended for debugging fairness issues
+		DispatchDebugState() []PriorityDebugInfo
+		// SetMetricsScope replaces the scope used for emitting scheduler metrics, timers already
+		// started complete against their original scope. Metrics emitted by the processor are not affected,
+		// neither are the submit path metrics if SubmitMetricsScope is specified
+		SetMetricsScope(scope metrics.Scope)
+		// RecentEvents returns the most recent submit, dispatch, dispatch error and drop events from
+		// the oldest to the newest, or nil if EventRecorderSize is not specified
+		RecentEvents() []SchedulerEvent
+		// Healthy returns false along with the reason if the scheduler is not running, or if tasks
+		// are queued but no dispatcher has made progress within HealthStalenessWindow, e.g. when the
+		// dispatchers are stuck submitting tasks to the processor. It's intended for liveness checks
+		Healthy() (bool, string)
+		// DispatcherState returns what the dispatchers are doing at the moment, one of the DispatcherState
+		// values, to tell a scheduler with no work from one which can't hand off work to its processor.
+		// With multiple dispatchers, the state of the dispatcher furthest along the dispatch is returned,
+		// i.e. submitting over dispatching over idle
+		DispatcherState() string
+		// Quiesce pauses dispatching tasks until Resume is called, tasks are still accepted and queued
+		// up to the queue size meanwhile. Tasks already dispatched to the processor, or being dispatched
+		// when Quiesce is called, are not affected. Healthy reports a quiesced scheduler as healthy
+		Quiesce()
+		// Resume resumes dispatching tasks paused by Quiesce
+		Resume()
+		// DeadLetterQueue removes and returns the tasks in the dead letter queue of the priority,
+		// oldest first, the caller takes over the ownership of the tasks. It returns nil if the
+		// priority has no dead letter queue. Tasks are kept after the scheduler is stopped
+		DeadLetterQueue(priority int) []PriorityTask
+		// WriteDebugState writes a human-readable report of the scheduler state for operators, e.g. to be served
+		// by an internal debug HTTP handler: status, options, the queue depth and dispatch state of each priority,
+		// worker utilization, in-flight tasks, recent events and dispatcher state. It's safe to call at any time,
+		// the state is captured before anything is written, so a slow writer doesn't block the scheduler
+		WriteDebugState(writer io.Writer) error
+		// Reprioritize moves the queued tasks matching the predicate from other priorities to the tail of the
+		// queue of the new priority, in the order they're queued within each priority, and returns the number of
+		// tasks moved. SetPriority is called on each moved task. Tasks are moved atomically with respect to the
+		// dispatchers, so a task is never dispatched twice or missed while being moved. If the new queue becomes
+		// full, the remaining matching tasks stay where they are. The predicate is called with queue locks held
+		// and must not call the scheduler
+		Reprioritize(predicate func(PriorityTask) bool, newPriority int) (int, error)
+		// RemapPriorities replaces the weights, and so the set of priorities, and moves the queued tasks of each
+		// priority to the tail of the queue of remap(priority), which must have a weight, preserving their order
+		// and enqueue time. SetPriority is called on each moved task. Queues of the priorities without a weight
+		// are removed, and queues of the new priorities are created as tasks are submitted. Dispatching is paused
+		// while the tasks are moved, which takes time proportional to the number of queued tasks. Tasks which
+		// don't fit into the queue of their new priority are nacked, as are retries held for RetryRequeueBackoff
+		// in removed queues. Submit racing with the removal of its queue fails with ErrPriorityRemoved, and the
+		// task can be resubmitted with a new priority, other submission methods fail as if the scheduler were
+		// stopped. Like Reconfigure, the weights are replaced by dynamic config once its value changes. Options
+		// keyed by priority, e.g. MaxQueueAge, and tasks held for DynamicPriority are not remapped. remap is
+		// called with the scheduler locks held and must not call the scheduler
+		RemapPriorities(weights map[int]int, remap func(priority int) int) error
+		// EvictOlderThan removes the queued tasks of all priorities which are enqueued before the cutoff, nacks
+		// them and returns the number of tasks evicted, e.g. for shedding a stale backlog. Tasks submitted with
+		// SubmitWithEnqueueTime are evicted by their given enqueue time. Tasks are removed atomically with respect
+		// to the dispatchers, so a task is either dispatched or evicted. Tasks held for DynamicPriority, retries
+		// held for RetryRequeueBackoff, tasks in dead letter queues and NonDroppableTasks are not evicted
+		EvictOlderThan(cutoff time.Time) int
+	}
+
+	// WeightedRoundRobinTaskSchedulerStats is a snapshot of the internal state of
+	// WeightedRoundRobinTaskScheduler, including its processor
+	WeightedRoundRobinTaskSchedulerStats struct {
+		// QueuedTasks is the number of tasks waiting to be dispatched, keyed by priority
+		QueuedTasks map[int]int
+		// DynamicPriorityTasks is the number of tasks held for DynamicPriority
+		DynamicPriorityTasks int
+		// QueuedBytes is the estimated size of the queued tasks, it's zero unless SizeOf is specified
+		QueuedBytes int64
+		// Processor is the stats of the underlying processor, it's empty
+		// if the processor is not a ParallelTaskProcessor
+		Processor ProcessorStats
+	}
+
+	// ShutdownSummary describes the tasks handled by WeightedRoundRobinTaskScheduler.Shutdown
+	ShutdownSummary struct {
+		// Completed is the number of tasks acked or nacked by the processor during the shutdown
+		Completed int64
+		// AbandonedQueued is the number of tasks still queued once the scheduler is stopped
+		AbandonedQueued int
+		// AbandonedInFlight is the number of tasks still buffered, executing or pending
+		// completion in the processor once the scheduler is stopped
+		AbandonedInFlight int
+	}
+
+	// PriorityDebugInfo is the dispatch state of a priority in WeightedRoundRobinTaskScheduler
+	PriorityDebugInfo struct {
+		Priority int
+		// Weight is the currently configured weight of the priority
+		Weight int
+		// DispatchedInRound is the number of tasks dispatched in the current round,
+		// it's only available when the dispatch strategy is WeightedRoundRobinDispatchStrategy
+		DispatchedInRound int
+		// QueueDepth is the number of tasks waiting to be dispatched
+		QueueDepth int
+		// LastServiced is the last time a task of the priority is dispatched
+		LastServiced time.Time
+		// ShedProbability is the probability of shedding a submission at the current queue depth, see LoadShedding
+		ShedProbability float64
+	}
+
+	// LoadSheddingCurve is the probability of shedding a submission to a priority by the depth of its queue,
+	// which grows linearly from zero at the low watermark to the max probability at the high watermark
+	LoadSheddingCurve struct {
+		// LowWatermark is the depth as a fraction of the queue size beyond which submissions are shed
+		LowWatermark float64 `json:"lowWatermark"`
+		// HighWatermark is the depth as a fraction of the queue size at
+		// which MaxProbability is reached, it defaults to one
+		HighWatermark float64 `json:"highWatermark"`
+		// MaxProbability is the shed probability at and beyond the high watermark, in (0, 1]
+		MaxProbability float64 `json:"maxProbability"`
+	}
+
+	// ReconfigureOptions specifies the changes applied by WeightedRoundRobinTaskScheduler.Reconfigure
+	// zero value fields are left unchanged
+	ReconfigureOptions struct {
+		// Weights replaces the weights currently used by the scheduler,
+		// it remains effective until the dynamic config value of the weights changes
+		Weights map[int]int
+		// WorkerCount updates the number of workers of the underlying processor
+		WorkerCount int
+	}
+
+	// WeightedRoundRobinTaskSchedulerOptions configs WRR task scheduler,
+	// it can be loaded from its JSON representation via ParseOptions
 	WeightedRoundRobinTaskSchedulerOptions struct {
-		Weights         dynamicconfig.MapPropertyFn
-		QueueSize       int
-		WorkerCount     int
-		DispatcherCount int
-		RetryPolicy     backoff.RetryPolicy
+		// Weights is the dispatch weight of each priority. A priority with a weight of zero gets no share of the
+		// dispatches, its tasks are drained only when no task of the positive weight priorities can be dispatched,
+		// in the scan order of the zero weight priorities, as best-effort work. Unlike IdleOnly, it doesn't wait
+		// for idle workers, and it follows weight updates
+		Weights         dynamicconfig.MapPropertyFn `json:"-"`
+		QueueSize       int                         `json:"queueSize"`
+		WorkerCount     int                         `json:"workerCount"`
+		DispatcherCount int                         `json:"dispatcherCount"`
+		RetryPolicy     backoff.RetryPolicy         `json:"-"`
+		// ProcessorQueueSize is the size of the buffer between dispatchers and workers, default to 1.
+		// A larger buffer keeps workers busy when execution time is bursty and reduces the time
+		// dispatchers are blocked, but tasks in the buffer are no longer subject to the weights,
+		// so the dispatch order will be less accurate when workers are saturated
+		ProcessorQueueSize int `json:"processorQueueSize"`
+		// QueueSizes overrides QueueSize for the task queues of the specified priorities
+		QueueSizes map[int]int `json:"queueSizes"`
+		// ProportionalQueueSizes sizes the task queue of each priority with a positive weight in proportion to its
+		// weight, unless specified by QueueSizes, as higher weight priorities are expected to carry more traffic.
+		// The QueueSize of each such priority is pooled and split by their weights, e.g. a QueueSize of 100 with
+		// weights [5, 3, 2] sizes the queues as [150, 90, 60]. The derived sizes must be at least one. Sizes are
+		// derived from the weights when the queues are created and don't follow weight updates, zero weight
+		// priorities get QueueSize
+		ProportionalQueueSizes bool `json:"proportionalQueueSizes"`
+		// ReservedCapacity, if specified, bounds the total number of tasks queued across the task queues of all
+		// priorities by QueueSize, out of which ReservedCapacity[p] slots are reserved for priority p, so that a
+		// priority can always queue that many tasks however congested the other priorities are. The remaining slots
+		// are shared, a priority takes them once its reservation is used up, and when none is left its submissions
+		// are handled as if its queue is full, e.g. Submit blocks and TrySubmit fails. The size of each queue still
+		// applies. The reserved and shared slots taken by each priority are emitted as PriorityTaskReservedCapacityUsage
+		// and PriorityTaskSharedCapacityUsage. Tasks held by DynamicPriority are not counted. It can't be used with
+		// LockFreeQueues
+		ReservedCapacity []int `json:"reservedCapacity"`
+		// LoadShedding, if specified, rejects Submit, SubmitIdempotent and SubmitWithPosition of the priorities
+		// with a curve with ErrTaskShed at random as their queues fill up, instead of only blocking once the queue
+		// is full. The shed probability follows the curve of the priority by the depth of its queue, so giving
+		// lower priorities lower watermarks or higher max probabilities sheds less important work first. Priorities
+		// without a curve and NonDroppableTasks are never shed, and it's off by default. Shed submissions are emitted as PriorityTaskShed
+		// and rejected with RejectReasonShed, the current probabilities are reported by DispatchDebugState
+		LoadShedding map[int]LoadSheddingCurve `json:"loadShedding"`
+		// SizeOf, if specified, estimates the memory footprint in bytes of a task, so that the total size of the
+		// queued tasks is tracked, emitted as PriorityTaskQueuedBytes and reported by Stats. It must return the
+		// same size for a task while it's queued. Tasks held for DynamicPriority are not counted, and it can't be
+		// used with LockFreeQueues
+		SizeOf func(task PriorityTask) int64 `json:"-"`
+		// MaxQueuedBytes, if positive, rejects the tasks submitted via Submit, TrySubmit and the methods built on
+		// them with ErrQueuedBytesExceeded if queuing them would take the queued bytes beyond it. Rejections are
+		// emitted as PriorityTaskQueuedBytesRejected and tagged with RejectReasonQueuedBytesExceeded.
+		// SoftQueuedBytes, if positive, sheds queued tasks once such a submission takes the queued bytes beyond
+		// it, from the lowest priority and oldest first, until they're back within it. Priorities higher than the
+		// one of the submitted task are not shed, nor are NonDroppableTasks, shed tasks are nacked and emitted as
+		// PriorityTaskQueuedBytesShed.
+		// Both require SizeOf, and the soft limit must be below the hard one. The limits are checked before the
+		// tasks are queued, so concurrent submissions may exceed them slightly
+		MaxQueuedBytes  int64 `json:"maxQueuedBytes"`
+		SoftQueuedBytes int64 `json:"softQueuedBytes"`
+		// PriorityProcessorQueue, if true, orders the tasks in the processor buffer by priority,
+		// so that a large ProcessorQueueSize doesn't let lower priority tasks be picked up first
+		PriorityProcessorQueue bool `json:"priorityProcessorQueue"`
+		// WorkStealingProcessorQueue, if true, splits the processor buffer into a deque per worker, with idle
+		// workers stealing from the deques of busy ones. Ignored if PriorityProcessorQueue is specified
+		WorkStealingProcessorQueue bool `json:"workStealingProcessorQueue"`
+		// OnDispatchError is invoked with a *DispatchError when a task fails to be submitted
+		// to the processor, if not specified, the task will be nacked. Tasks refused by the processor
+		// as it's stopped along with the scheduler are dropped with the queued tasks instead
+		OnDispatchError DispatchErrorHandler `json:"-"`
+		// MetricTagAllowlist specifies the keys of task metric tags that can be used
+		// for tagging the metrics emitted by the scheduler and its processor,
+		// metrics are always tagged with the task priority
+		MetricTagAllowlist []string `json:"metricTagAllowlist"`
+		// OnTasksDropped is invoked with all the tasks still queued when the scheduler is stopped, tasks
+		// are sorted by priority and then by the order they are submitted, so that callers can persist them
+		// in bulk and reconstruct the order later. The scheduler no longer owns the tasks after the call
+		OnTasksDropped func(tasks []PriorityTask) `json:"-"`
+		// NackOnStop nacks the tasks still queued when the scheduler is stopped, if OnTasksDropped
+		// is not specified. Tasks implementing BulkNackableTask are nacked in bulk
+		NackOnStop bool `json:"nackOnStop"`
+		// DrainOnStop submits the tasks still queued when the scheduler is stopped to the processor before
+		// stopping it, instead of dropping them. Once the dispatchers exit, the queues are flushed strictly by
+		// priority, in the order the dispatch strategy scans them, and in submission order within each priority,
+		// so the processor receives the drained tasks in the same order as during normal operation. The worker
+		// count still determines whether they're executed in that order. Drained tasks are not subject to
+		// dispatch limits or circuit breakers, and once the processor fails to accept a task, it and the
+		// following tasks are dropped as configured by OnTasksDropped and NackOnStop. It can't be used with
+		// HandoffTarget, DynamicPriority or PreserveIntraPriorityOrder
+		DrainOnStop bool `json:"drainOnStop"`
+		// DispatcherShutdownTimeout is how long Stop waits for the dispatchers to exit, which includes waiting
+		// for the processor to accept the tasks being dispatched or drained by DrainOnStop, defaults to one
+		// minute. ProcessorShutdownTimeout is how long the processor waits for the tasks being executed to
+		// finish, see ParallelTaskProcessorOptions.ShutdownTimeout, defaults to one minute as well. Both stages
+		// log distinct warnings when they time out. ProcessorShutdownTimeout can't be used with WorkerPool
+		DispatcherShutdownTimeout time.Duration `json:"-"`
+		ProcessorShutdownTimeout  time.Duration `json:"-"`
+		// NonDroppableGracePeriod is how long Stop is extended to execute the NonDroppableTasks still queued which
+		// are neither drained, handed off nor passed to OnTasksDropped, and don't fit into the dead letter queue of
+		// their priority, defaults to ten seconds. They're executed one at a time, and those not started within the
+		// period are nacked once the task being executed returns, instead of being dropped with NackOnStop unset
+		NonDroppableGracePeriod time.Duration `json:"-"`
+		// EnqueueTimeTolerance is how far in the future the enqueue time passed to SubmitWithEnqueueTime can be,
+		// to allow for clock skew between hosts, defaults to one second
+		EnqueueTimeTolerance time.Duration `json:"-"`
+		// OnReject, if specified, is invoked in the submitting goroutine with every task whose submission
+		// is rejected and one of the RejectReason values, after PriorityTaskRejected is emitted. The
+		// caller still owns the task. Tasks deduped by their idempotency key are not rejected
+		OnReject func(task PriorityTask, reason string) `json:"-"`
+		// OnSubmit, if specified, is invoked in the submitting goroutine with every submitted task before its
+		// priority is checked against the weights and before it's queued, e.g. to validate or enrich the task.
+		// A non-nil error rejects the submission with RejectReasonValidationFailed, and is returned to the caller.
+		// If any task of SubmitAtomic or SubmitBatch fails the validation, none of the tasks is submitted
+		OnSubmit func(task PriorityTask) error `json:"-"`
+		// MaxConcurrencyByPriority limits the number of tasks that are dispatched but not yet acked or
+		// nacked for each priority, indexed by priority, so that a priority can't take up all workers.
+		// Zero or a priority beyond the end means no limit. Once the limit is reached, tasks of the
+		// priority won't be dispatched while other priorities proceed
+		MaxConcurrencyByPriority []int `json:"maxConcurrencyByPriority"`
+		// BorrowCapacity, if true, lets a priority which reached its MaxConcurrencyByPriority limit borrow the
+		// unused slots of a higher priority with a limit and no queued task. Once tasks of the higher priority are
+		// queued again, the slots are reclaimed by asking the borrowing PreemptibleTasks to yield, other borrowing
+		// tasks keep the slots until they complete. Each borrowed slot is emitted as PriorityTaskCapacityBorrowed
+		// tagged by the borrowing priority, and each reclaim as PriorityTaskCapacityReclaimed tagged by the lending one
+		BorrowCapacity bool `json:"borrowCapacity"`
+		// EffectiveConcurrencyWindow, if specified, emits PriorityTaskEffectiveConcurrency for each priority with
+		// a concurrency limit every window, the average number of tasks of the priority dispatched but not yet
+		// acked or nacked over the window, including tasks taking borrowed slots. Compared to the limit, it tells
+		// a priority starved of workers or dispatch turns, whose achieved concurrency stays well below the limit,
+		// from one capped by the limit. It requires MaxConcurrencyByPriority
+		EffectiveConcurrencyWindow time.Duration `json:"-"`
+		// ExecutionShare, if true, balances the share of workers taken by each priority rather than only the share
+		// of dispatches. A priority whose share of the tasks dispatched but not yet acked or nacked exceeds its share
+		// of the weights, both among the priorities with queued or in-flight tasks, is not dispatched while another
+		// weighted priority has a task to dispatch, so slow tasks of a priority can't take more workers than its
+		// weight grants. Direct dispatch and idle only priorities are not balanced. The dispatch and execution shares
+		// of each priority are emitted as PriorityTaskDispatchShare and PriorityTaskExecutionShare periodically.
+		// It can't be used with BorrowCapacity
+		ExecutionShare bool `json:"executionShare"`
+		// ResourceBudgets, if specified, limits the total cost of the tasks dispatched but not yet acked or nacked
+		// on each resource dimension, e.g. CPU and the quota of a rate limited API, across all priorities. The cost
+		// of a task is returned by ResourceCost if specified, or declared by ResourceCostTask, tasks without a cost
+		// are not limited. When the task at the head of a priority queue would exceed the budget of a dimension, the
+		// priority is skipped like one which reached its MaxConcurrencyByPriority limit, until in-flight tasks release
+		// their cost. A task costing more than a budget is dispatched once nothing else is in flight on the dimension.
+		// The fraction of each budget taken is emitted as PriorityTaskResourceUtilization tagged by the dimension.
+		// Direct dispatch priorities are not limited
+		ResourceBudgets map[string]float64 `json:"resourceBudgets"`
+		// ResourceCost, if specified, returns the cost of the task on each dimension of ResourceBudgets,
+		// instead of the cost declared by ResourceCostTask
+		ResourceCost func(task PriorityTask) map[string]float64 `json:"-"`
+		// WeightDriftWindow, if specified, compares the share of tasks dispatched for each priority over every
+		// window with the share of its weight, among the weighted priorities which dispatched a task within the
+		// window or have queued tasks at its end, and emits the max relative deviation as PriorityTaskWeightDrift.
+		// A large drift indicates the configured weights are not honored, e.g. a starved priority or a saturated
+		// processor skewing the ratio. Direct dispatch and idle only priorities are not considered
+		WeightDriftWindow time.Duration `json:"-"`
+		// WeightRatioWarningThreshold, if specified, checks the weights when the scheduler starts, and if the
+		// ratio of the largest weight to the smallest non-zero weight exceeds the threshold, logs a warning and
+		// emits PriorityTaskWeightRatioExceeded once, as such weights, e.g. [1000000, 1, 1], effectively make
+		// a strict priority scheduler which likely starves the lower priorities by mistake. It's only a warning,
+		// so intentionally skewed weights still work
+		WeightRatioWarningThreshold float64 `json:"weightRatioWarningThreshold"`
+		// IdempotencyCacheSize is the max number of idempotency keys remembered by
+		// the scheduler, zero disables the deduplication of IdempotentTask
+		IdempotencyCacheSize int `json:"idempotencyCacheSize"`
+		// IdempotencyTTL is how long an idempotency key is remembered, zero means
+		// keys are only evicted when the cache is full
+		IdempotencyTTL time.Duration `json:"-"`
+		// DispatchYieldEvery makes each dispatcher call runtime.Gosched after dispatching the
+		// specified number of tasks, so that dispatchers won't monopolize a P under sustained load.
+		// It slightly reduces the max throughput in exchange for fairness with co-located goroutines.
+		// Zero disables yielding
+		DispatchYieldEvery int `json:"dispatchYieldEvery"`
+		// MaxTasksPerRound bounds the number of tasks a dispatcher hands off before it goes back to
+		// the top of its loop and re-checks notifications and shutdown, so that it stays responsive
+		// under sustained load. It's independent of the weights: a value below the sum of the weights
+		// splits a weighted round across several dispatch loops, the dispatch strategy resumes where
+		// it left off so the weighted ratios hold. Zero means unlimited
+		MaxTasksPerRound int `json:"maxTasksPerRound"`
+		// DirectDispatch lists the priorities whose tasks are submitted to the processor
+		// directly, bypassing the priority queue, when there's an idle worker and no task of
+		// the same priority is queued. This reduces the latency for latency critical priorities
+		// under light load, tasks are queued as usual otherwise
+		DirectDispatch []int `json:"directDispatch"`
+		// ExpressPriority, if specified, is added to DirectDispatch, for the common case of a single top
+		// priority which needs near-zero queue latency. Express tasks may be executed ahead of tasks of other
+		// priorities waiting in their queues regardless of the weights, but are never dispatched ahead of
+		// queued tasks of the express priority, as direct dispatch only happens when that queue is empty.
+		// Only Submit and SubmitIdempotent dispatch directly, other submit methods always queue the tasks
+		ExpressPriority *int `json:"expressPriority"`
+		// IdleOnly lists the priorities whose tasks are dispatched only when no task of other priorities
+		// can be dispatched and the processor has idle workers, for best-effort work which should only
+		// consume spare capacity. Unlike a low weight, idle-only tasks never compete with other tasks,
+		// so they may wait indefinitely under sustained load. Idle-only tasks are dispatched in the scan order
+		// of their priorities, and the priorities still need weights to be accepted
+		IdleOnly []int `json:"idleOnly"`
+		// PreserveIntraPriorityOrder lists the priorities whose tasks are executed one at a time in the order
+		// they're queued, so tasks submitted by the same goroutine are executed in submission order even with
+		// multiple workers. It's enforced by limiting the in-flight tasks of the priority to one, as
+		// MaxConcurrencyByPriority does, so the throughput of the priority is bounded by the latency of a single
+		// task including its retries, and only one worker is used for the priority. Tasks retried via
+		// OnDispatchError are requeued at the tail and may be executed out of order. It can't be used with
+		// RetryRequeue or direct dispatch of the same priority
+		PreserveIntraPriorityOrder []int `json:"preserveIntraPriorityOrder"`
+		// PriorityOrder, if specified, is the order the dispatch strategy scans the priority queues, from the
+		// highest priority to the lowest, instead of the ascending order of priorities. It must be a permutation
+		// of the priorities in the initial weights, priorities added by later weights are scanned after them
+		// in ascending order. Priority inversions are detected against this order
+		PriorityOrder []int `json:"priorityOrder"`
+		// DispatchStrategy decides the order tasks are dispatched from the priority queues,
+		// if not specified, a WeightedRoundRobinDispatchStrategy using Weights will be used
+		DispatchStrategy DispatchStrategy `json:"-"`
+		// FairQueuing uses a VirtualTimeFairQueuingDispatchStrategy with Weights instead of the default
+		// WRR dispatch strategy, for precise weighted fairness regardless of burst patterns. It doesn't
+		// apply if DispatchStrategy is specified, and MinDispatchPerRound is ignored
+		FairQueuing bool `json:"fairQueuing"`
+		// MinDispatchPerRound guarantees the number of tasks dispatched per round for each
+		// priority (if it has them), before the weighted budget applies to the remainder.
+		// This gives each priority a floor of service even if its weight is tiny compared
+		// to other busy priorities. It's only used by the default dispatch strategy
+		MinDispatchPerRound map[int]int `json:"minDispatchPerRound"`
+		// PreemptRoundOnHighPriority aborts the current dispatch round when a task is submitted to a queue scanned
+		// before the queue of the task last dispatched, and starts a new round, so that the task is dispatched
+		// next instead of after the remaining weights of the round are used up. This bounds the dispatch latency
+		// of latency critical priorities under mixed load, at the cost of the lower priorities getting more than
+		// their share over an aborted round. Each abort is emitted as PriorityTaskRoundPreempted. It's only used
+		// by the default dispatch strategy, and can't be used with DispatchStrategy or FairQueuing
+		PreemptRoundOnHighPriority bool `json:"preemptRoundOnHighPriority"`
+		// MaxQueueAge specifies how long tasks of each priority can wait in the queue, tasks queued for
+		// longer are evicted and nacked before dispatch instead of being executed. It's intended for
+		// best-effort work that loses value over time, priorities without a max age never age out. NonDroppableTasks
+		// never age out, and tasks queued behind one are only aged out once it's dispatched
+		MaxQueueAge map[int]time.Duration `json:"-"`
+		// MaxWaitSLA, if specified, is the max time a task of each priority, indexed by priority, should wait
+		// in the queue, zero means no SLA. Whenever the task at the head of a queue has waited longer than the
+		// SLA of its priority, dispatchers poll that queue ahead of the dispatch strategy, overriding the weights,
+		// until its oldest task is back within the SLA. The queue whose oldest task exceeds its SLA by the largest
+		// fraction is dispatched first. Concurrency limits and the dispatch limiter still apply, and idle only
+		// priorities are not overridden. As the override only starts once the SLA is exceeded, it bounds how long
+		// tasks wait beyond the SLA rather than guaranteeing it, each task dispatched after waiting longer than its
+		// SLA is emitted as PriorityTaskSLAViolation
+		MaxWaitSLA []time.Duration `json:"-"`
+		// AgePriorityEscalation promotes queued tasks as they age, to bound the time any task waits without
+		// computing priorities upfront. It maps a priority to the age after which its queued tasks are moved
+		// to the tail of the queue of the next higher priority, i.e. the closest smaller priority with a weight.
+		// The age counts from when a task is first queued, so with thresholds ascending along the priorities, a
+		// task climbs one priority per threshold. Queues are swept every AgePriorityEscalationInterval, promoted
+		// tasks are handled as if they were moved by Reprioritize, and promotions are emitted as
+		// PriorityTaskAgePromoted by the priority promoted from. Tasks are not promoted into full queues.
+		// Priorities whose order is preserved can't be escalated
+		AgePriorityEscalation map[int]time.Duration `json:"-"`
+		// AgePriorityEscalationInterval is how often the queues are swept for AgePriorityEscalation,
+		// default to one second
+		AgePriorityEscalationInterval time.Duration `json:"-"`
+		// SingleWorker runs the scheduler with exactly one dispatcher and one worker, overriding
+		// WorkerCount and DispatcherCount, for tasks which must not be executed concurrently.
+		// The resulting ordering contract is:
+		//   - tasks are executed one at a time, in the order they are dispatched, and the execution,
+		//     ack or nack of a task happens before the execution of the next one
+		//   - the dispatch order follows the dispatch strategy, tasks of the same priority are
+		//     dispatched in the order they are submitted
+		//   - retries happen in place, a failing task occupies the worker until it succeeds or
+		//     exhausts its retries, so no other task is executed between its attempts
+		//   - tasks requeued by DispatchErrorActionRetry, or resubmitted after being nacked,
+		//     lose their position and are dispatched after the tasks already queued
+		// The worker count can't be changed via Reconfigure
+		SingleWorker bool `json:"singleWorker"`
+		// DispatchLimiter, if specified, is consulted before dispatching each task. When the task
+		// at the head of a priority queue is denied, the priority is skipped and the task stays at
+		// the head of the queue, so tasks of the same priority are held back as well. Denied tasks
+		// are reconsidered after dispatchLimiterRetryInterval or when new tasks are submitted
+		DispatchLimiter DispatchLimiter `json:"-"`
+		// RetryRequeue puts tasks which fail with a retryable error back to the tail of their priority
+		// queue instead of retrying them in place, so that a failing task doesn't occupy a worker and
+		// fresh tasks get a turn. The retry policy still bounds the number of attempts and the expiration,
+		// counted across requeues, but its backoff interval is not applied, the time spent in the queue
+		// takes its place. Tasks are retried in place if the queue is full or the scheduler is stopping
+		RetryRequeue bool `json:"retryRequeue"`
+		// RetryRequeueBackoff, if true, holds each task requeued by RetryRequeue for the backoff interval of the
+		// retry policy before putting it back to its queue, instead of requeueing it at once, so that neither a worker
+		// nor a dispatcher turn is spent while waiting out the backoff. A slot of the queue is reserved for the held
+		// task, so it's retried in place if the queue is full. Once queued, the task is behind the tasks submitted
+		// while it's held, and the retry may be executed by any worker. Held tasks are not counted as queued, e.g.
+		// by Stats, and are dropped on Stop along with the queued tasks, so they're handed to OnTasksDropped, NackOnStop
+		// or DrainOnStop as well. It requires RetryRequeue
+		RetryRequeueBackoff bool `json:"retryRequeueBackoff"`
+		// MaxResubmits limits the number of times a task is requeued by RetryRequeue, once reached the task
+		// is exhausted the next time it fails, as if it had exhausted its retries, so that a poison task
+		// can't keep consuming capacity when the retry policy allows unlimited attempts. Zero means unlimited
+		MaxResubmits int `json:"maxResubmits"`
+		// OnTaskExhausted, if specified, is invoked instead of Nack when a task fails with a non-retryable
+		// error, exhausts its retries or reaches MaxResubmits. The callback takes over the ownership of the
+		// task. It's not supported with WorkerPool, as the shared processor handles exhausted tasks
+		OnTaskExhausted func(task PriorityTask, err error) `json:"-"`
+		// DeadLetterQueueSize specifies the capacity of the dead letter queue of each priority. Tasks of
+		// a priority with a dead letter queue are put into the queue instead of being handed to
+		// OnTaskExhausted or nacked once exhausted, to be drained via DeadLetterQueue. The scheduler
+		// neither acks nor nacks dead letters, except when dropped per DeadLetterOverflowPolicy
+		DeadLetterQueueSize map[int]int `json:"deadLetterQueueSize"`
+		// DeadLetterOverflowPolicy decides how exhausted tasks are handled when the dead letter queue
+		// is full, by default they're handled as if the priority had no dead letter queue
+		DeadLetterOverflowPolicy DeadLetterOverflowPolicy `json:"deadLetterOverflowPolicy"`
+		// WarmupDuration and WarmupWorkerCount start the processor with WarmupWorkerCount workers
+		// and ramp up linearly to WorkerCount over WarmupDuration after the scheduler is started,
+		// so that cold downstream dependencies are not overwhelmed at startup. The ramp up stops
+		// if the worker count is updated via Reconfigure. Warmup is disabled if either is zero
+		WarmupDuration    time.Duration `json:"-"`
+		WarmupWorkerCount int           `json:"warmupWorkerCount"`
+		// SnapshotPriority calls Priority only once when a task is submitted and uses the result for
+		// queueing, dispatching, retrying and metrics, for tasks whose Priority may change between calls.
+		// Tasks are wrapped when submitted, so the processor, OnDispatchError and OnTasksDropped don't see
+		// the submitted task, and only MetricTaggedTask and ContextAwareTask are visible to the processor.
+		// The same applies to OnTaskExhausted
+		SnapshotPriority bool `json:"snapshotPriority"`
+		// AllowManyPriorities allows specifying weights for more than MaxPriorities priorities,
+		// for users who accept the cost of a task queue per priority and longer dispatch rounds
+		AllowManyPriorities bool `json:"allowManyPriorities"`
+		// NormalizeWeightsTo, if positive, interprets the values of Weights as ratios, e.g. 0.7, 0.2 and 0.1,
+		// which are normalized via NormalizeWeights into integer weights summing up to NormalizeWeightsTo.
+		// Weights specified via Reconfigure are not normalized
+		NormalizeWeightsTo int `json:"normalizeWeightsTo"`
+		// WeightsDomain, if specified, loads Weights with the domain filter, so that the weights of a scheduler
+		// dedicated to the tasks of a domain can be overridden for the domain in dynamic config, e.g. to
+		// de-prioritize a noisy domain during an incident
+		WeightsDomain string `json:"weightsDomain"`
+		// WeightsRefreshInterval is how often Weights is reloaded from dynamic config, defaults to five seconds.
+		// Reloaded weights take effect from the next dispatch round, and queues are created for the priorities
+		// added on demand. Whenever the effective weights change, by a reload, Reconfigure or RemapPriorities,
+		// the change is logged and emitted as PriorityTaskWeightsUpdated, and the weight of each priority as
+		// PriorityTaskWeight, which is emitted on Start as well
+		WeightsRefreshInterval time.Duration `json:"-"`
+		// WorkerPool, if specified, executes the dispatched tasks in the given pool shared with other
+		// schedulers instead of workers owned by the scheduler, see SharedWorkerPool for fairness across
+		// schedulers. WorkerCount, ProcessorQueueSize and the worker count in Reconfigure don't apply,
+		// and it can't be used with SingleWorker, RetryRequeue or warmup
+		WorkerPool *SharedWorkerPool `json:"-"`
+		// EventRecorderSize is the number of the most recent scheduler events kept in memory for
+		// debugging, which are accessible via RecentEvents. Zero disables recording events
+		EventRecorderSize int `json:"eventRecorderSize"`
+		// HandoffTarget, if specified, receives the tasks still queued when the scheduler is stopped, e.g.
+		// the scheduler on the host a shard is migrated to. Tasks are submitted to the target in priority and
+		// submission order without blocking, those not accepted by the target, because it's full or stopped,
+		// are dropped as configured by OnTasksDropped and NackOnStop
+		HandoffTarget Scheduler `json:"-"`
+		// ExecuteContext derives the execution context of tasks implementing ContextAwareTask,
+		// see ParallelTaskProcessorOptions for details. It doesn't apply if WorkerPool is specified
+		ExecuteContext func(task PriorityTask) context.Context `json:"-"`
+		// BeforeExecute and AfterExecute are invoked around each execution of a task, see
+		// ParallelTaskProcessorOptions for details. The hooks see the tasks submitted to the processor,
+		// which may wrap the tasks submitted to the scheduler. They don't apply if WorkerPool is specified
+		BeforeExecute func(task PriorityTask)                                   `json:"-"`
+		AfterExecute  func(task PriorityTask, err error, latency time.Duration) `json:"-"`
+		// PriorityInversionQueueDepth, if specified, enables detecting priority inversions: whenever a task is
+		// dispatched while a higher priority (smaller value) has at least this many tasks waiting to be dispatched,
+		// PriorityTaskInversion is emitted tagged with both priorities. Inversions are inherent to WRR weighting,
+		// the metric quantifies how often they happen. Shallow queues are ignored to keep the check cheap
+		PriorityInversionQueueDepth int `json:"priorityInversionQueueDepth"`
+		// QueueDepthThresholds are fractions of QueueSize in (0, 1], e.g. 0.5, 0.8 and 0.95. Whenever the
+		// depth of a priority queue reaches a threshold, PriorityTaskQueueThresholdCrossed is emitted tagged
+		// with the priority and the threshold, and PriorityTaskQueueThresholdRecovered once it drops back
+		// below. Unlike the queue size gauge, transient spikes between gauge samples are captured
+		QueueDepthThresholds []float64 `json:"queueDepthThresholds"`
+		// AdaptiveBackpressureMaxDelay, if specified, slows down Submit, SubmitIdempotent and SubmitWithPosition
+		// as the backlog grows instead of only blocking once the queue is full. Once the depth of a priority queue
+		// exceeds AdaptiveBackpressureLowWatermark, submitting to the queue is delayed in proportion to the depth,
+		// up to the max delay at AdaptiveBackpressureHighWatermark. Watermarks are fractions of QueueSize, the high
+		// watermark defaults to one. The injected delay is emitted as PriorityTaskBackpressureDelay
+		AdaptiveBackpressureMaxDelay      time.Duration `json:"-"`
+		AdaptiveBackpressureLowWatermark  float64       `json:"adaptiveBackpressureLowWatermark"`
+		AdaptiveBackpressureHighWatermark float64       `json:"adaptiveBackpressureHighWatermark"`
+		// AdaptiveRetryBackoffMaxMultiplier, if specified, widens the backoff of tasks retried in place as the
+		// backlog of their priority grows, to reduce the retry pressure when a priority is overwhelmed. Once the
+		// depth of the priority queue exceeds AdaptiveRetryBackoffLowWatermark, the retry interval computed by
+		// RetryPolicy is multiplied by a factor growing linearly from one up to the max multiplier at
+		// AdaptiveRetryBackoffHighWatermark. Watermarks are fractions of QueueSize, the high watermark defaults
+		// to one. The max multiplier must be at least one, the applied interval is emitted as
+		// PriorityTaskRetryBackoff. It doesn't apply to RetryRequeue or WorkerPool
+		AdaptiveRetryBackoffMaxMultiplier float64 `json:"adaptiveRetryBackoffMaxMultiplier"`
+		AdaptiveRetryBackoffLowWatermark  float64 `json:"adaptiveRetryBackoffLowWatermark"`
+		AdaptiveRetryBackoffHighWatermark float64 `json:"adaptiveRetryBackoffHighWatermark"`
+		// MaxBlockedSubmitters, if specified, limits the number of goroutines blocked in Submit, SubmitIdempotent
+		// and SubmitWithPosition waiting for space in full task queues, so that submitters can't pile up without
+		// bound when dispatching stalls. Once the limit is reached, submitting to a full queue fails immediately
+		// with ErrTooManyBlockedSubmitters. Submissions that don't need to wait are not affected
+		MaxBlockedSubmitters int `json:"maxBlockedSubmitters"`
+		// MaxConsecutiveProcessorFailures, if specified, fails the scheduler once this many tasks in a row are
+		// refused by the processor, e.g. as it's stopped independently of the scheduler. A failed scheduler
+		// rejects new submissions with ErrSchedulerFailed instead of accepting tasks which would all be nacked,
+		// the transition is logged and emitted as PriorityTaskSchedulerFailed. Queued tasks are still dispatched
+		// and handled as dispatch errors. Refusals while the scheduler is stopping are not counted, and a failed
+		// scheduler only recovers via Stop and Reset
+		MaxConsecutiveProcessorFailures int `json:"maxConsecutiveProcessorFailures"`
+		// ProcessorCapacityWait, if specified, makes a dispatcher which failed to submit a task retried by
+		// DispatchErrorActionRetry end its round and wait up to this long for room in the processor buffer
+		// before dispatching again, instead of polling the retried task back in a busy loop. The dispatcher
+		// resumes as soon as the buffer has room, without waiting for a notification from a new submission.
+		// Processors which don't report their buffer are waited on for the whole duration
+		ProcessorCapacityWait time.Duration `json:"-"`
+		// AllowSubmitBeforeStart accepts tasks submitted before Start is called, they're queued and only
+		// dispatched once the scheduler is started. By default such submissions fail with ErrSchedulerNotStarted,
+		// so that a scheduler which is never started doesn't silently hold the tasks forever
+		AllowSubmitBeforeStart bool `json:"allowSubmitBeforeStart"`
+		// CircuitBreakerFailureThreshold, if specified, opens the circuit breaker of a dependency once that many
+		// executions of DependentTasks of the dependency, including retries, fail in a row. While the breaker is
+		// open, tasks of the dependency fail to be dispatched with ErrCircuitBreakerOpen and are handled by
+		// OnDispatchError, nacked by default, instead of taking up workers. A single task is dispatched every
+		// CircuitBreakerOpenDuration to probe the dependency, and the breaker closes once a task succeeds.
+		// Whether the breaker of each dependency is open is emitted as PriorityTaskCircuitBreakerOpen. It
+		// can't be used with WorkerPool, as executions of the shared workers are not observed
+		CircuitBreakerFailureThreshold int `json:"circuitBreakerFailureThreshold"`
+		// CircuitBreakerOpenDuration is how long a breaker stays open before probing the dependency,
+		// defaults to ten seconds
+		CircuitBreakerOpenDuration time.Duration `json:"-"`
+		// MaxRetriesPerSecond limits the retries made by the processor across all tasks, see
+		// ParallelTaskProcessorOptions.MaxRetriesPerSecond. Zero means unlimited. It can't be used with WorkerPool
+		MaxRetriesPerSecond int `json:"maxRetriesPerSecond"`
+		// RetrySlowStartWindow ramps the retry budget back over the window once it's exhausted, or once a
+		// circuit breaker closes, so that a recovering dependency isn't hit by all the accumulated retries at once,
+		// see ParallelTaskProcessorOptions.RetrySlowStartWindow. It requires MaxRetriesPerSecond
+		RetrySlowStartWindow time.Duration `json:"-"`
+		// NewTaskReservedFraction reserves the fraction of the workers for tasks executed for the first time, so
+		// that tasks retrying in place can't starve new tasks, see ParallelTaskProcessorOptions.NewTaskReservedFraction.
+		// Combined with RetryRequeue, tasks are requeued instead of being retried in place. It must be between
+		// zero and one, and it can't be used with WorkerPool
+		NewTaskReservedFraction float64 `json:"newTaskReservedFraction"`
+		// BatchWindow and MaxBatchSize batch the dispatched BatchableTasks with the same batch key, so that they're
+		// executed together via BatchExecute, see ParallelTaskProcessorOptions.BatchWindow. Tasks held in batches
+		// count as in flight. They can't be used with WorkerPool
+		BatchWindow  time.Duration `json:"-"`
+		MaxBatchSize int           `json:"maxBatchSize"`
+		// HealthStalenessWindow is how long the dispatchers may go without making progress while tasks are
+		// queued before Healthy reports the scheduler as wedged, defaults to one minute. Dispatchers waiting
+		// for tasks held by MaxConcurrencyByPriority for longer than the window are also considered wedged
+		HealthStalenessWindow time.Duration `json:"-"`
+		// DrainProgressInterval is how often Drain reports the remaining tasks of each priority and the
+		// estimated time to drain them, based on the dispatch rate since the last report, defaults to
+		// ten seconds. The progress is also reported when Drain starts and completes
+		DrainProgressInterval time.Duration `json:"-"`
+		// BatchCounters accumulates the counters emitted by the scheduler in memory and flushes them to
+		// the metrics scope every few seconds and on Stop, instead of calling the metrics system for every
+		// submitted or dispatched task. Timers are still emitted per task. Counters emitted by the processor
+		// are not batched. Counters accumulated before SetMetricsScope is called are flushed to the new scope
+		BatchCounters bool `json:"batchCounters"`
+		// PerPriorityScope emits the metrics of each priority to a sub-scope created once per priority
+		// and cached, instead of tagging the metrics with the priority on every emission. The scheduler
+		// and the processor it creates both use the cached scopes
+		PerPriorityScope bool `json:"perPriorityScope"`
+		// SubmitMetricsScope is the scope for the metrics emitted on the submit path, i.e. the submit
+		// requests, submit latency, backpressure delay, idempotency dedups and rejections, so that they
+		// can be attributed to the calling context. Dispatch and execution metrics, including the gauges and
+		// the metrics emitted by the processor, stay on the scheduler's scope. Defaults to the scheduler's
+		// scope, including the one set via SetMetricsScope. Counters batched by BatchCounters are flushed
+		// to the scope they are emitted to
+		SubmitMetricsScope metrics.Scope `json:"-"`
+		// Preemption asks a PreemptibleTask being executed to yield its worker when a task of a higher priority
+		// is dispatched while all workers are busy, see ParallelTaskProcessorOptions.Preemption. It can't be
+		// used with WorkerPool
+		Preemption bool `json:"preemption"`
+		// CooperativeYield passes a YieldChecker to the tasks implementing ContextAwareTask via the context of
+		// their execution, see YieldCheckerFromContext. The checker asks the task to yield when a queue of a
+		// higher priority in the scan order has tasks waiting while all workers are busy, and a task returning
+		// ErrTaskYielded is put back to the tail of its priority queue without being acked or nacked, keeping
+		// its retry state. It can't be used with WorkerPool
+		CooperativeYield bool `json:"cooperativeYield"`
+		// PriorityFunc, if specified, decides the priority of each submitted task instead of the priority declared
+		// by the task, so that global policies like tenant fairness can be applied in a single place. It's called
+		// once per submission, before OutOfRangePolicy applies to its result, so a priority without weight is
+		// rejected or clamped like a declared one. SetPriority is called on the task with the resulting priority
+		// if it differs from the declared one and has a weight, before the task is queued. OnSubmit still observes
+		// the declared priority, and DynamicPriorityTasks are still resolved at dispatch time
+		PriorityFunc func(task PriorityTask) int `json:"-"`
+		// OutOfRangePolicy decides how tasks whose priority has no weight are submitted, by default
+		// they are rejected. When clamping, SetPriority is called on the task with the clamped priority
+		// before it's queued, so the task is handled exactly as if it was submitted with that priority
+		OutOfRangePolicy OutOfRangePolicy `json:"outOfRangePolicy"`
+		// DynamicPriority resolves the priority of DynamicPriorityTasks submitted via Submit or TrySubmit at
+		// dispatch time. Instead of the queue of their submitted priority, such tasks are held in a single
+		// heap bounded by QueueSize, and each dispatch re-evaluates the current priorities of all the held
+		// tasks, so its cost grows linearly with the number of held tasks, unlike the constant cost of the per
+		// priority queues. The held task with the highest current priority is dispatched as if it's at the head
+		// of the queue of that priority, which is subject to the weights, and SetPriority is called on the task
+		// with the priority before it's dispatched. Current priorities without a queue fall back to the submitted
+		// priority. Held tasks are not subject to direct dispatch, backpressure, max queue age, concurrency limits
+		// or Reprioritize. It can't be used with IdleOnly
+		DynamicPriority bool `json:"dynamicPriority"`
+		// EndToEndLatency emits PriorityTaskEndToEndLatency, the latency from when a task is queued until it's
+		// acked or exhausted, tagged by the outcome and the priority. Unlike the latencies of the separate stages,
+		// it covers the retries within the processor and requeues. Tasks are wrapped when being submitted to the
+		// processor, which costs an allocation per dispatch. The time blocked in Submit on a full queue is not
+		// included, it's measured by PriorityTaskSubmitLatency
+		EndToEndLatency bool `json:"endToEndLatency"`
+		// LockFreeQueues backs the priority queues with a lock-free ring at the tail, so that submitters don't
+		// contend on the queue lock with each other or with the dispatchers unless the queue is full. Tasks of
+		// a priority are still dispatched in the order they're submitted, and TrySubmit still fails when the
+		// queue is full. It targets high submit concurrency, SetQueueSize isn't supported and the queue depth
+		// thresholds are only checked when the dispatchers access the queue
+		LockFreeQueues bool `json:"lockFreeQueues"`
+		// OnStart and OnStop are invoked once the scheduler is started and stopped respectively, at most once
+		// each, e.g. for registering the scheduler with service discovery. Panics are recovered and logged
+		OnStart func() `json:"-"`
+		OnStop  func() `json:"-"`
+		// ReadinessCheck, if specified, is called once the processor is started and before dispatching begins,
+		// e.g. to wait for the connections the tasks need, and retried every ReadinessCheckInterval, which
+		// defaults to one second, until it returns nil. Start returns right away and dispatching begins in the
+		// background once the check passes, while StartAndWait blocks until then. Tasks submitted in the meantime
+		// stay queued, and OnStart is invoked once dispatching begins. Attempts are emitted as
+		// PriorityTaskReadinessCheckAttempt and failed ones as PriorityTaskReadinessCheckFailure
+		ReadinessCheck         func(ctx context.Context) error `json:"-"`
+		ReadinessCheckInterval time.Duration                   `json:"-"`
+		// OnPriorityActive and OnPriorityIdle, if specified, are invoked when the queue of a priority transitions
+		// from empty to having tasks and back, e.g. for autoscalers reacting to the activity of each priority
+		// without polling the queue depths. A priority is reported active as soon as a task is queued while it's
+		// idle, and idle once its queue stays empty for PriorityIdleDebounce, which defaults to one second, so a
+		// queue flapping between empty and non-empty within the debounce interval is only reported active once.
+		// Idle priorities are detected every debounce interval, so they're reported within twice the interval.
+		// Callbacks of a priority are serialized and alternate between active and idle, starting with active.
+		// They're invoked in the submitting goroutine or a background one, and must return quickly. Tasks
+		// dispatched directly and tasks held for DynamicPriority don't count as queued
+		OnPriorityActive     func(priority int) `json:"-"`
+		OnPriorityIdle       func(priority int) `json:"-"`
+		PriorityIdleDebounce time.Duration      `json:"-"`
+
+		// hierarchyParent, if specified, submits the dispatched tasks to the parent scheduler
+		// of a HierarchicalScheduler instead of a processor owned by the scheduler
+		hierarchyParent *hierarchyParent
+	}
+
+	// requeuedTask is a task put back to its queue for retry,
+	// it carries the retry state across requeues
+	requeuedTask struct {
+		taskWrapper
+
+		retries          int
+		requeues         int
+		firstAttemptTime time.Time
+		// queueTime is when the task is first queued, only set if EndToEndLatency is specified
+		queueTime time.Time
+	}
+
+	// polledTaskInfo describes where a task is
+	// polled from, so that dispatch errors can be traced
+	polledTaskInfo struct {
+		priority    int
+		enqueueTime time.Time
+	}
+
+	// metricsScopeHolder wraps metrics.Scope so that implementations
+	// with different concrete types can be stored in atomic.Value
+	metricsScopeHolder struct {
+		scope metrics.Scope
+		// priorityScopes is only set when PerPriorityScope is specified
+		priorityScopes *priorityScopes
+	}
+
+	weightedRoundRobinTaskSchedulerImpl struct {
+		sync.RWMutex
+
+		status     int32
+		weights    atomic.Value // store the currently used weights
+		taskQueues map[int]*taskQueueImpl
+		queueList  []TaskQueue // taskQueues sorted by priority, replaced on update
+		// dispatchQueueList is the same as queueList, except that queues with max age
+		// or concurrency limit are wrapped, and queues are sorted by PriorityOrder
+		dispatchQueueList []TaskQueue
+		// idleOnlyQueueList is the same as dispatchQueueList but for IdleOnly
+		// priorities, which are not visible to the dispatch strategy
+		idleOnlyQueueList []TaskQueue
+		shutdownCh        chan struct{}
+		notifyCh          chan struct{}
+		dispatcherWG      sync.WaitGroup
+		// backgroundWG tracks the goroutines other than dispatchers started by Start
+		backgroundWG  sync.WaitGroup
+		logger        log.Logger
+		metricsClient metrics.Client
+		metricsScope  atomic.Value // store metricsScopeHolder
+		// submitMetricsScope has a nil scope unless SubmitMetricsScope is specified
+		submitMetricsScope metricsScopeHolder
+		options            *WeightedRoundRobinTaskSchedulerOptions
+
+		// dispatchLock serializes calls to dispatchStrategy
+		// and is held by Reconfigure when applying changes
+		dispatchLock     sync.Mutex
+		dispatchStrategy DispatchStrategy
+		// agedOutTasks are the tasks evicted by aging queues, protected by dispatchLock
+		agedOutTasks []PriorityTask
+		// dispatchDenied indicates if any task is denied by the dispatch limiter
+		// since the last call to the dispatch strategy, protected by dispatchLock
+		dispatchDenied bool
+		// dispatchRetryScheduled indicates if a retry of the denied tasks is scheduled
+		dispatchRetryScheduled int32
+		// polledTask describes the task last polled by
+		// the dispatch strategy, protected by dispatchLock
+		polledTask polledTaskInfo
+		// idleOnlyDispatchStartTime is when dispatchers started dispatching idle-only tasks,
+		// zero if the last dispatched task is not idle-only, protected by dispatchLock
+		idleOnlyDispatchStartTime time.Time
+		// warmupCancelled indicates if the worker count is updated via Reconfigure,
+		// in which case the warmup stops ramping up workers, protected by dispatchLock
+		warmupCancelled bool
+		// highPriorityCh signals the dispatchers to abort the current round,
+		// nil unless PreemptRoundOnHighPriority is specified
+		highPriorityCh chan struct{}
+		// roundPriority is the priority of the task last dispatched by the dispatch strategy,
+		// or noRoundPriority if the last round is finished, only updated with PreemptRoundOnHighPriority
+		roundPriority int64
+
+		metricTagAllowlist map[string]struct{}
+		directDispatch     map[int]struct{}
+		idleOnly           map[int]struct{}
+		preserveOrder      map[int]struct{}
+		// priorityRanks maps priorities to their indices in PriorityOrder
+		priorityRanks    map[int]int
+		deadLetterQueues map[int]*taskQueueImpl // immutable after creation
+		idempotencyKeys  *idempotencyKeys
+		eventRecorder    *eventRecorder   // nil if recording events is disabled
+		batchedCounters  *batchedCounters // nil if counters are not batched
+		circuitBreakers  *circuitBreakers // nil if circuit breakers are disabled
+		capacityPool     *capacityPool    // nil unless BorrowCapacity is specified
+		// submitBatchedCounters is nil unless both BatchCounters and SubmitMetricsScope are specified
+		submitBatchedCounters *batchedCounters
+		// concurrencyIntegrators integrate the dispatched tasks of each priority with a concurrency limit,
+		// nil unless EffectiveConcurrencyWindow is specified
+		concurrencyIntegrators map[int]*concurrencyIntegrator
+		executionShare         *executionShare // nil unless ExecutionShare is specified
+		resourceBudget         *resourceBudget // nil unless ResourceBudgets is specified
+		delayedRetries         *delayedRetries // nil unless RetryRequeueBackoff is specified
+		// sharedCapacity is shared by the task queues of all priorities, nil unless ReservedCapacity is specified
+		sharedCapacity *sharedQueueCapacity
+		// queuedBytes is shared by the task queues of all priorities, nil unless SizeOf is specified
+		queuedBytes *queuedBytes
+		// priorityActivity is nil unless OnPriorityActive or OnPriorityIdle is specified
+		priorityActivity *priorityActivity
+		// shedRandom returns the random numbers in [0, 1) which LoadShedding compares the shed probabilities to
+		shedRandom func() float64
+		// refusedTasks are the tasks refused by the processor as the scheduler is stopped, which are
+		// dropped along with the queued tasks unless refusedTasksDropped, protected by the lock
+		refusedTasks        []PriorityTask
+		refusedTasksDropped bool
+		// driftDispatched is the number of tasks dispatched for each priority since the weight drift is last
+		// reported, protected by the dispatchLock, nil unless WeightDriftWindow is specified
+		driftDispatched map[int]int64
+		// dynamicTasks holds DynamicPriorityTasks, nil unless DynamicPriority is specified
+		dynamicTasks *dynamicPriorityQueue
+		// lastProgressTime is the time in nanoseconds a dispatcher last polled
+		// the dispatch strategy, whether or not a task is dispatched
+		lastProgressTime int64
+		// dispatcherStates holds the state of each dispatcher started, each updated
+		// by its dispatcher via atomic stores. The slice is protected by the lock
+		dispatcherStates []*int32
+		// quiesced indicates if dispatching is paused by Quiesce
+		quiesced int32
+		// blockedSubmitters is the number of submitters blocked on full
+		// task queues, only tracked if MaxBlockedSubmitters is specified
+		blockedSubmitters int32
+		// processorFailures is the number of tasks refused by the processor in a row, only
+		// tracked if MaxConsecutiveProcessorFailures is specified
+		processorFailures int32
+		// failed indicates if the scheduler is failed as the processor keeps refusing tasks
+		failed int32
+		// shuttingDown indicates if new submissions are rejected as Shutdown is in progress
+		shuttingDown int32
+		// processorRefused indicates if a task retried by DispatchErrorActionRetry is refused by the
+		// processor since a dispatcher last waited for capacity, only tracked if ProcessorCapacityWait is specified
+		processorRefused int32
+
+		processor Processor
+	}
+)
+
+// MaxPriorities is the max number of priorities the WRR task scheduler accepts weights
+// for, unless AllowManyPriorities is specified. Each priority has its own task queue and
+// is visited in every dispatch round, so the cost grows with the number of priorities
+const MaxPriorities = 256
+
+const (
+	defaultProcessorQueueSize    = 1
+	defaultUpdateWeightsInterval = 5 * time.Second
+	counterFlushInterval         = 5 * time.Second
+	drainCheckInterval           = 10 * time.Millisecond
+	dispatchLimiterRetryInterval = 10 * time.Millisecond
+	processorCapacityInterval    = time.Millisecond
+	defaultHealthStalenessWindow = time.Minute
+	defaultDrainProgressInterval = 10 * time.Second
+
+	defaultCircuitBreakerOpenDuration = 10 * time.Second
+	defaultDispatcherShutdownTimeout  = time.Minute
+	defaultEnqueueTimeTolerance       = time.Second
+	defaultReadinessCheckInterval     = time.Second
+	defaultPriorityIdleDebounce       = time.Second
+	defaultNonDroppableGracePeriod    = 10 * time.Second
+
+	defaultAgePriorityEscalationInterval = time.Second
+	executionShareReportInterval         = 10 * time.Second
+
+	// schedulerStatusResetting is the status of a scheduler being reset by Reset
+	schedulerStatusResetting = -1
+	// noRoundPriority is the roundPriority when no dispatch round is in progress
+	noRoundPriority = math.MinInt64
+)
+
+var (
+	// ErrTaskSchedulerClosed is the error returned when submitting task to a stopped scheduler
+	ErrTaskSchedulerClosed = errors.New("task scheduler has already shutdown")
+	// ErrSchedulerNotStarted is the error returned when submitting task to a scheduler which is not
+	// started yet, unless submitting before Start is explicitly allowed
+	ErrSchedulerNotStarted = errors.New("task scheduler is not started yet")
+	// ErrInsufficientCapacity is the error returned when there's not enough capacity for an atomic submission
+	ErrInsufficientCapacity = errors.New("insufficient capacity in task queues")
+	// ErrTooManyBlockedSubmitters is the error returned when submitting task to a full queue
+	// while MaxBlockedSubmitters submitters are already waiting for space
+	ErrTooManyBlockedSubmitters = errors.New("too many submitters blocked on full task queues")
+	// ErrSchedulerNotStopped is the error returned when resetting a scheduler which is not stopped
+	ErrSchedulerNotStopped = errors.New("task scheduler is not stopped")
+	// ErrCircuitBreakerOpen is the error passed to OnDispatchError for tasks
+	// not dispatched as the circuit breaker of their dependency is open
+	ErrCircuitBreakerOpen = errors.New("circuit breaker of the task dependency is open")
+	// ErrEnqueueTimeInFuture is the error returned when the enqueue time passed to
+	// SubmitWithEnqueueTime is later than EnqueueTimeTolerance from now
+	ErrEnqueueTimeInFuture = errors.New("enqueue time is in the future")
+	// ErrSchedulerFailed is the error returned when submitting task to a scheduler failed
+	// as its processor keeps refusing tasks, see MaxConsecutiveProcessorFailures
+	ErrSchedulerFailed = errors.New("task scheduler is failed as the processor keeps refusing tasks")
+	// ErrPriorityRemoved is the error returned when the queue of the task priority is removed
+	// by RemapPriorities while the task is being submitted
+	ErrPriorityRemoved = errors.New("task priority is removed")
+	// ErrProcessorNotReady is the error returned by StartAndWait when
+	// ReadinessCheck doesn't pass before the context is done
+	ErrProcessorNotReady = errors.New("task processor is not ready")
+	// ErrQueuedBytesExceeded is the error returned when queuing the task
+	// would take the size of the queued tasks beyond MaxQueuedBytes
+	ErrQueuedBytesExceeded = errors.New("queued tasks exceed the max queued bytes")
+	// ErrTaskShed is the error returned when the submission is shed by LoadShedding
+	ErrTaskShed = errors.New("task is shed as the task queue is overloaded")
+
+	errTaskNotSubmitted = errors.New("task is not submitted to the processor")
+)
+
+// Reasons of rejected submissions, tagged on PriorityTaskRejected and passed to OnReject
+const (
+	// RejectReasonQueueFull is the reason of submissions which don't wait for a full task queue
+	RejectReasonQueueFull = "queue_full"
+	// RejectReasonShutdown is the reason of submissions to a stopped or stopping scheduler
+	RejectReasonShutdown = "shutdown"
+	// RejectReasonNotStarted is the reason of submissions before the scheduler is started
+	RejectReasonNotStarted = "not_started"
+	// RejectReasonTooManyBlockedSubmitters is the reason of submissions rejected by MaxBlockedSubmitters
+	RejectReasonTooManyBlockedSubmitters = "too_many_blocked_submitters"
+	// RejectReasonUnknownPriority is the reason of submissions of tasks whose priority has no weight
+	RejectReasonUnknownPriority = "unknown_priority"
+	// RejectReasonValidationFailed is the reason of submissions rejected by OnSubmit
+	RejectReasonValidationFailed = "validation_failed"
+	// RejectReasonSchedulerFailed is the reason of submissions to a scheduler failed by MaxConsecutiveProcessorFailures
+	RejectReasonSchedulerFailed = "scheduler_failed"
+	// RejectReasonQueuedBytesExceeded is the reason of submissions rejected by MaxQueuedBytes
+	RejectReasonQueuedBytesExceeded = "queued_bytes_exceeded"
+	// RejectReasonShed is the reason of submissions shed by LoadShedding
+	RejectReasonShed = "shed"
+)
+
+// States of dispatchers returned by DispatcherState
+const (
+	// DispatcherStateStopped is the state when no dispatcher is running
+	DispatcherStateStopped = "stopped"
+	// DispatcherStateIdle is the state of dispatchers waiting for tasks to be queued, or for Resume once quiesced
+	DispatcherStateIdle = "idle"
+	// DispatcherStateDispatching is the state of dispatchers polling the queues for the next task
+	DispatcherStateDispatching = "dispatching"
+	// DispatcherStateSubmitting is the state of dispatchers handing off a task to the processor,
+	// a dispatcher staying in this state is blocked as the processor is full
+	DispatcherStateSubmitting = "submitting"
+)
+
+// dispatcher states stored in dispatcherStates, ordered by how far along the dispatch they are
+const (
+	dispatcherStateStopped int32 = iota
+	dispatcherStateIdle
+	dispatcherStateDispatching
+	dispatcherStateSubmitting
+)
+
+var dispatcherStateNames = []string{
+	dispatcherStateStopped:     DispatcherStateStopped,
+	dispatcherStateIdle:        DispatcherStateIdle,
+	dispatcherStateDispatching: DispatcherStateDispatching,
+	dispatcherStateSubmitting:  DispatcherStateSubmitting,
+}
+
+// NewWeightedRoundRobinTaskScheduler creates a new WRR task scheduler
+func NewWeightedRoundRobinTaskScheduler(
+	logger log.Logger,
+	metricsClient metrics.Client,
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) (WeightedRoundRobinTaskScheduler, error) {
+	weights, err := validateOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.SingleWorker {
+		singleWorkerOptions := *options
+		singleWorkerOptions.WorkerCount = 1
+		singleWorkerOptions.DispatcherCount = 1
+		options = &singleWorkerOptions
+	}
+
+	scheduler := &weightedRoundRobinTaskSchedulerImpl{
+		status:        common.DaemonStatusInitialized,
+		notifyCh:      make(chan struct{}, 1),
+		logger:        logger,
+		metricsClient: metricsClient,
+		options:       options,
+	}
+	if err := scheduler.initialize(weights); err != nil {
+		return nil, err
+	}
+	return scheduler, nil
+}
+
+// initialize creates the internal state of the scheduler from its options,
+// which is done again when the scheduler is reset
+func (w *weightedRoundRobinTaskSchedulerImpl) initialize(
+	weights map[int]int,
+) error {
+	options := w.options
+	processorQueueSize := options.ProcessorQueueSize
+	if processorQueueSize <= 0 {
+		processorQueueSize = defaultProcessorQueueSize
+	}
+
+	w.taskQueues = make(map[int]*taskQueueImpl)
+	w.queueList = nil
+	w.dispatchQueueList = nil
+	w.idleOnlyQueueList = nil
+	w.shutdownCh = make(chan struct{})
+	w.metricTagAllowlist = newMetricTagAllowlist(options.MetricTagAllowlist)
+	w.directDispatch = make(map[int]struct{}, len(options.DirectDispatch))
+	w.idleOnly = make(map[int]struct{}, len(options.IdleOnly))
+	w.preserveOrder = make(map[int]struct{}, len(options.PreserveIntraPriorityOrder))
+	w.priorityRanks = make(map[int]int, len(options.PriorityOrder))
+	w.deadLetterQueues = nil
+	w.idempotencyKeys = nil
+	w.eventRecorder = nil
+	w.batchedCounters = nil
+	w.submitBatchedCounters = nil
+	w.circuitBreakers = nil
+	w.capacityPool = nil
+	w.concurrencyIntegrators = nil
+	if options.EffectiveConcurrencyWindow > 0 {
+		w.concurrencyIntegrators = make(map[int]*concurrencyIntegrator)
+	}
+	w.executionShare = nil
+	if options.ExecutionShare {
+		w.executionShare = newExecutionShare(w.getWeights)
+	}
+	w.resourceBudget = nil
+	if len(options.ResourceBudgets) != 0 {
+		w.resourceBudget = newResourceBudget(
+			options.ResourceBudgets,
+			w.resourceCost,
+			func(dimension string, utilization float64) {
+				w.getMetricsScope().Tagged(metrics.ResourceDimensionTag(dimension)).
+					UpdateGauge(metrics.PriorityTaskResourceUtilization, utilization)
+			},
+		)
+	}
+	w.shedRandom = rand.Float64
+	w.queuedBytes = nil
+	if options.SizeOf != nil {
+		w.queuedBytes = newQueuedBytes(options.SizeOf, func(bytes int64) {
+			w.getMetricsScope().UpdateGauge(metrics.PriorityTaskQueuedBytes, float64(bytes))
+		})
+	}
+	w.priorityActivity = nil
+	if options.OnPriorityActive != nil || options.OnPriorityIdle != nil {
+		w.priorityActivity = newPriorityActivity(w.priorityIdleDebounce(), options.OnPriorityActive, options.OnPriorityIdle)
+	}
+	w.sharedCapacity = nil
+	if len(options.ReservedCapacity) != 0 {
+		w.sharedCapacity = newSharedQueueCapacity(
+			options.QueueSize,
+			options.ReservedCapacity,
+			func(priority int, reservedQueued int, sharedQueued int) {
+				metricsScope := w.getPriorityMetricsScope(priority)
+				metricsScope.UpdateGauge(metrics.PriorityTaskReservedCapacityUsage, float64(reservedQueued))
+				metricsScope.UpdateGauge(metrics.PriorityTaskSharedCapacityUsage, float64(sharedQueued))
+			},
+		)
+	}
+	w.driftDispatched = nil
+	if options.WeightDriftWindow > 0 {
+		w.driftDispatched = make(map[int]int64)
+	}
+	w.refusedTasks = nil
+	w.refusedTasksDropped = false
+	w.delayedRetries = nil
+	if options.RetryRequeueBackoff {
+		w.delayedRetries = newDelayedRetries()
+	}
+	w.dynamicTasks = nil
+	w.agedOutTasks = nil
+	w.dispatchDenied = false
+	w.polledTask = polledTaskInfo{}
+	w.idleOnlyDispatchStartTime = time.Time{}
+	w.warmupCancelled = false
+	w.highPriorityCh = nil
+	if options.PreemptRoundOnHighPriority {
+		w.highPriorityCh = make(chan struct{}, 1)
+	}
+	atomic.StoreInt64(&w.roundPriority, noRoundPriority)
+	atomic.StoreInt32(&w.dispatchRetryScheduled, 0)
+	atomic.StoreInt64(&w.lastProgressTime, 0)
+	w.dispatcherStates = nil
+	atomic.StoreInt32(&w.quiesced, 0)
+	atomic.StoreInt32(&w.blockedSubmitters, 0)
+	atomic.StoreInt32(&w.processorFailures, 0)
+	atomic.StoreInt32(&w.failed, 0)
+	atomic.StoreInt32(&w.shuttingDown, 0)
+	atomic.StoreInt32(&w.processorRefused, 0)
+	processorOptions := &ParallelTaskProcessorOptions{
+		QueueSize:          processorQueueSize,
+		WorkerCount:        options.WorkerCount,
+		RetryPolicy:        options.RetryPolicy,
+		MetricTagAllowlist: options.MetricTagAllowlist,
+		ExecuteContext:     options.ExecuteContext,
+		BeforeExecute:      options.BeforeExecute,
+		AfterExecute:       options.AfterExecute,
+		PriorityQueue:      options.PriorityProcessorQueue,
+		WorkStealing:       options.WorkStealingProcessorQueue,
+		PerPriorityScope:   options.PerPriorityScope,
+		Preemption:         options.Preemption,
+		ShutdownTimeout:    options.ProcessorShutdownTimeout,
+
+		MaxRetriesPerSecond:     options.MaxRetriesPerSecond,
+		RetrySlowStartWindow:    options.RetrySlowStartWindow,
+		NewTaskReservedFraction: options.NewTaskReservedFraction,
+
+		BatchWindow:  options.BatchWindow,
+		MaxBatchSize: options.MaxBatchSize,
+	}
+	if options.RetryRequeue {
+		processorOptions.RequeueRetry = w.requeueRetry
+		processorOptions.MaxRequeues = options.MaxResubmits
+	}
+	if options.CooperativeYield {
+		processorOptions.ExecuteContext = w.yieldExecuteContext
+		processorOptions.OnYield = w.requeueYielded
+	}
+	if options.AdaptiveRetryBackoffMaxMultiplier > 0 {
+		processorOptions.RetryBackoffMultiplier = w.retryBackoffMultiplier
+	}
+	if len(options.DeadLetterQueueSize) != 0 {
+		w.deadLetterQueues = make(map[int]*taskQueueImpl, len(options.DeadLetterQueueSize))
+		for priority, size := range options.DeadLetterQueueSize {
+			w.deadLetterQueues[priority] = newTaskQueue(priority, size)
+		}
+	}
+	if options.OnTaskExhausted != nil || w.deadLetterQueues != nil {
+		processorOptions.OnTaskExhausted = w.onTaskExhausted
+	}
+	if options.CircuitBreakerFailureThreshold > 0 {
+		openDuration := options.CircuitBreakerOpenDuration
+		if openDuration == 0 {
+			openDuration = defaultCircuitBreakerOpenDuration
+		}
+		w.circuitBreakers = newCircuitBreakers(
+			options.CircuitBreakerFailureThreshold,
+			openDuration,
+			w.onCircuitBreakerStateChange,
+		)
+		processorOptions.OnTaskAttempt = w.onTaskAttempt
+	}
+	if options.BorrowCapacity {
+		w.capacityPool = newCapacityPool(
+			func(priority int) {
+				w.getPriorityMetricsScope(priority).IncCounter(metrics.PriorityTaskCapacityBorrowed)
+			},
+			func(priority int) {
+				w.getPriorityMetricsScope(priority).IncCounter(metrics.PriorityTaskCapacityReclaimed)
+			},
+		)
+	}
+	if w.warmupEnabled() {
+		processorOptions.WorkerCount = options.WarmupWorkerCount
+	}
+	if options.WorkerPool != nil {
+		w.processor = newSharedWorkerPoolProcessor(options.WorkerPool, w.shutdownCh)
+	} else if options.hierarchyParent != nil {
+		w.processor = newHierarchicalChildProcessor(options.hierarchyParent)
+	} else {
+		w.processor = NewParallelTaskProcessor(w.logger, w.metricsClient, processorOptions)
+	}
+	for _, priority := range options.DirectDispatch {
+		w.directDispatch[priority] = struct{}{}
+	}
+	if options.ExpressPriority != nil {
+		w.directDispatch[*options.ExpressPriority] = struct{}{}
+	}
+	for _, priority := range options.IdleOnly {
+		w.idleOnly[priority] = struct{}{}
+	}
+	for _, priority := range options.PreserveIntraPriorityOrder {
+		w.preserveOrder[priority] = struct{}{}
+	}
+	for rank, priority := range options.PriorityOrder {
+		w.priorityRanks[priority] = rank
+	}
+	if options.IdempotencyCacheSize > 0 {
+		w.idempotencyKeys = newIdempotencyKeys(options.IdempotencyCacheSize, options.IdempotencyTTL)
+	}
+	if options.EventRecorderSize > 0 {
+		w.eventRecorder = newEventRecorder(options.EventRecorderSize)
+	}
+	if options.BatchCounters {
+		w.batchedCounters = newBatchedCounters()
+	}
+	w.submitMetricsScope = metricsScopeHolder{}
+	if options.SubmitMetricsScope != nil {
+		w.submitMetricsScope = newMetricsScopeHolder(options.SubmitMetricsScope, options.PerPriorityScope)
+		if options.BatchCounters {
+			w.submitBatchedCounters = newBatchedCounters()
+		}
+	}
+	w.weights.Store(weights)
+	if w.metricsScope.Load() == nil {
+		w.SetMetricsScope(w.metricsClient.Scope(metrics.TaskSchedulerScope))
+	}
+	w.dispatchStrategy = options.DispatchStrategy
+	if w.dispatchStrategy == nil && options.FairQueuing {
+		w.dispatchStrategy = NewVirtualTimeFairQueuingDispatchStrategy(w.getWeights)
+	}
+	if w.dispatchStrategy == nil {
+		w.dispatchStrategy = NewWeightedRoundRobinDispatchStrategy(w.getWeights, options.MinDispatchPerRound)
+	}
+	if options.DynamicPriority {
+		w.dynamicTasks = newDynamicPriorityQueue(options.QueueSize, w.scansBefore)
+		// held tasks can only be dispatched via existing queues
+		for priority := range weights {
+			if _, err := w.getOrCreateTaskQueue(priority); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateOptions validates the options as NewWeightedRoundRobinTaskScheduler does,
+// without creating the scheduler, so configs can be checked without side effects
+func ValidateOptions(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) error {
+	_, err := validateOptions(options)
+	return err
+}
+
+// validateOptions returns the initial weights if the options are valid
+func validateOptions(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) (map[int]int, error) {
+	if options.Weights == nil {
+		return nil, errors.New("weight is not specified in the scheduler option")
+	}
+	weights, err := loadWeights(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(weights) == 0 {
+		return nil, errors.New("weight is not specified in the scheduler option")
+	}
+	for priority, weight := range weights {
+		if weight < 0 {
+			return nil, fmt.Errorf("invalid weight %v for priority %v", weight, priority)
+		}
+	}
+	if err := validatePriorityCount(weights, options.AllowManyPriorities); err != nil {
+		return nil, err
+	}
+	if err := validatePriorityOrder(options.PriorityOrder, weights); err != nil {
+		return nil, err
+	}
+
+	// zero sizes and counts are allowed e.g. for schedulers that only dispatch via direct dispatch
+	if options.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid queue size %v", options.QueueSize)
+	}
+	for priority, size := range options.QueueSizes {
+		if size < 0 {
+			return nil, fmt.Errorf("invalid queue size %v for priority %v", size, priority)
+		}
+	}
+	if options.ProportionalQueueSizes {
+		for priority, weight := range weights {
+			if _, ok := options.QueueSizes[priority]; ok || weight <= 0 {
+				continue
+			}
+			if size := proportionalQueueSize(options, weights, weight); size < 1 {
+				return nil, fmt.Errorf("queue size %v derived from the weight of priority %v is less than one", size, priority)
+			}
+		}
+	}
+	totalReserved := 0
+	for priority, count := range options.ReservedCapacity {
+		if count < 0 {
+			return nil, fmt.Errorf("invalid reserved capacity %v for priority %v", count, priority)
+		}
+		totalReserved += count
+	}
+	if len(options.ReservedCapacity) != 0 && (options.QueueSize <= 0 || totalReserved > options.QueueSize) {
+		return nil, fmt.Errorf("total reserved capacity %v exceeds queue size %v", totalReserved, options.QueueSize)
+	}
+	if len(options.ReservedCapacity) != 0 && options.LockFreeQueues {
+		return nil, errors.New("reserved capacity can't be used with lock-free queues")
+	}
+	if options.MaxQueuedBytes < 0 || options.SoftQueuedBytes < 0 {
+		return nil, fmt.Errorf("invalid queued bytes limits %v and %v", options.MaxQueuedBytes, options.SoftQueuedBytes)
+	}
+	if (options.MaxQueuedBytes > 0 || options.SoftQueuedBytes > 0) && options.SizeOf == nil {
+		return nil, errors.New("queued bytes limits require SizeOf")
+	}
+	if options.MaxQueuedBytes > 0 && options.SoftQueuedBytes >= options.MaxQueuedBytes {
+		return nil, fmt.Errorf("soft queued bytes %v is not below max queued bytes %v", options.SoftQueuedBytes, options.MaxQueuedBytes)
+	}
+	if options.SizeOf != nil && options.LockFreeQueues {
+		return nil, errors.New("SizeOf can't be used with lock-free queues")
+	}
+	for priority, curve := range options.LoadShedding {
+		if !validWatermarks(curve.LowWatermark, curve.HighWatermark) || curve.MaxProbability <= 0 || curve.MaxProbability > 1 {
+			return nil, fmt.Errorf("invalid load shedding curve %+v for priority %v", curve, priority)
+		}
+	}
+	if options.WorkerCount < 0 {
+		return nil, fmt.Errorf("invalid worker count %v", options.WorkerCount)
+	}
+	if options.DispatcherCount < 0 {
+		return nil, fmt.Errorf("invalid dispatcher count %v", options.DispatcherCount)
+	}
+	if options.WarmupWorkerCount < 0 {
+		return nil, fmt.Errorf("invalid warmup worker count %v", options.WarmupWorkerCount)
+	}
+	if options.MaxTasksPerRound < 0 {
+		return nil, fmt.Errorf("invalid max tasks per round %v", options.MaxTasksPerRound)
+	}
+	if options.ProcessorQueueSize < 0 {
+		return nil, fmt.Errorf("invalid processor queue size %v", options.ProcessorQueueSize)
+	}
+	if options.MaxBlockedSubmitters < 0 {
+		return nil, fmt.Errorf("invalid max blocked submitters %v", options.MaxBlockedSubmitters)
+	}
+	if options.MaxConsecutiveProcessorFailures < 0 {
+		return nil, fmt.Errorf("invalid max consecutive processor failures %v", options.MaxConsecutiveProcessorFailures)
+	}
+	if options.BatchWindow < 0 {
+		return nil, fmt.Errorf("invalid batch window %v", options.BatchWindow)
+	}
+	if options.MaxBatchSize < 0 {
+		return nil, fmt.Errorf("invalid max batch size %v", options.MaxBatchSize)
+	}
+	if options.ProcessorCapacityWait < 0 {
+		return nil, fmt.Errorf("invalid processor capacity wait %v", options.ProcessorCapacityWait)
+	}
+	if options.CircuitBreakerFailureThreshold < 0 {
+		return nil, fmt.Errorf("invalid circuit breaker failure threshold %v", options.CircuitBreakerFailureThreshold)
+	}
+	for priority, limit := range options.MaxConcurrencyByPriority {
+		if limit < 0 {
+			return nil, fmt.Errorf("invalid max concurrency %v for priority %v", limit, priority)
+		}
+	}
+	for dimension, budget := range options.ResourceBudgets {
+		if budget <= 0 {
+			return nil, fmt.Errorf("invalid resource budget %v for dimension %v", budget, dimension)
+		}
+	}
+	if options.MaxRetriesPerSecond < 0 {
+		return nil, fmt.Errorf("invalid max retries per second %v", options.MaxRetriesPerSecond)
+	}
+	if options.RetrySlowStartWindow < 0 {
+		return nil, fmt.Errorf("invalid retry slow start window %v", options.RetrySlowStartWindow)
+	}
+	if options.RetrySlowStartWindow > 0 && options.MaxRetriesPerSecond == 0 {
+		return nil, errors.New("retry slow start requires max retries per second")
+	}
+	if options.PreemptRoundOnHighPriority && (options.DispatchStrategy != nil || options.FairQueuing) {
+		return nil, errors.New("preempting rounds requires the default dispatch strategy")
+	}
+	if options.NewTaskReservedFraction < 0 || options.NewTaskReservedFraction > 1 {
+		return nil, fmt.Errorf("invalid new task reserved fraction %v", options.NewTaskReservedFraction)
+	}
+	if options.BorrowCapacity && !hasMaxConcurrency(options) {
+		return nil, errors.New("borrowing capacity requires max concurrency by priority")
+	}
+	if options.ExecutionShare && options.BorrowCapacity {
+		return nil, errors.New("execution share can't be used with borrowing capacity")
+	}
+	if options.EffectiveConcurrencyWindow < 0 {
+		return nil, fmt.Errorf("invalid effective concurrency window %v", options.EffectiveConcurrencyWindow)
+	}
+	if options.EffectiveConcurrencyWindow > 0 && !hasMaxConcurrency(options) {
+		return nil, errors.New("effective concurrency requires max concurrency by priority")
+	}
+	if options.WeightDriftWindow < 0 {
+		return nil, fmt.Errorf("invalid weight drift window %v", options.WeightDriftWindow)
+	}
+	if options.DispatcherShutdownTimeout < 0 {
+		return nil, fmt.Errorf("invalid dispatcher shutdown timeout %v", options.DispatcherShutdownTimeout)
+	}
+	if options.ProcessorShutdownTimeout < 0 {
+		return nil, fmt.Errorf("invalid processor shutdown timeout %v", options.ProcessorShutdownTimeout)
+	}
+	if options.WeightsRefreshInterval < 0 {
+		return nil, fmt.Errorf("invalid weights refresh interval %v", options.WeightsRefreshInterval)
+	}
+	if options.NonDroppableGracePeriod < 0 {
+		return nil, fmt.Errorf("invalid non-droppable grace period %v", options.NonDroppableGracePeriod)
+	}
+	if options.ReadinessCheckInterval < 0 {
+		return nil, fmt.Errorf("invalid readiness check interval %v", options.ReadinessCheckInterval)
+	}
+	if options.PriorityIdleDebounce < 0 {
+		return nil, fmt.Errorf("invalid priority idle debounce %v", options.PriorityIdleDebounce)
+	}
+	if options.EnqueueTimeTolerance < 0 {
+		return nil, fmt.Errorf("invalid enqueue time tolerance %v", options.EnqueueTimeTolerance)
+	}
+	if options.WeightRatioWarningThreshold < 0 {
+		return nil, fmt.Errorf("invalid weight ratio warning threshold %v", options.WeightRatioWarningThreshold)
+	}
+	for priority, sla := range options.MaxWaitSLA {
+		if sla < 0 {
+			return nil, fmt.Errorf("invalid max wait SLA %v for priority %v", sla, priority)
+		}
+	}
+	for priority, size := range options.DeadLetterQueueSize {
+		if size <= 0 {
+			return nil, fmt.Errorf("invalid dead letter queue size %v for priority %v", size, priority)
+		}
+	}
+	for _, threshold := range options.QueueDepthThresholds {
+		if threshold <= 0 || threshold > 1 {
+			return nil, fmt.Errorf("invalid queue depth threshold %v", threshold)
+		}
+	}
+	if options.AdaptiveBackpressureMaxDelay < 0 {
+		return nil, fmt.Errorf("invalid adaptive backpressure max delay %v", options.AdaptiveBackpressureMaxDelay)
+	}
+	if options.AdaptiveBackpressureMaxDelay > 0 &&
+		!validWatermarks(options.AdaptiveBackpressureLowWatermark, options.AdaptiveBackpressureHighWatermark) {
+		return nil, fmt.Errorf(
+			"invalid adaptive backpressure watermarks %v and %v",
+			options.AdaptiveBackpressureLowWatermark,
+			options.AdaptiveBackpressureHighWatermark,
+		)
+	}
+	if options.AdaptiveRetryBackoffMaxMultiplier != 0 && options.AdaptiveRetryBackoffMaxMultiplier < 1 {
+		return nil, fmt.Errorf("invalid adaptive retry backoff max multiplier %v", options.AdaptiveRetryBackoffMaxMultiplier)
+	}
+	if options.AdaptiveRetryBackoffMaxMultiplier != 0 &&
+		!validWatermarks(options.AdaptiveRetryBackoffLowWatermark, options.AdaptiveRetryBackoffHighWatermark) {
+		return nil, fmt.Errorf(
+			"invalid adaptive retry backoff watermarks %v and %v",
+			options.AdaptiveRetryBackoffLowWatermark,
+			options.AdaptiveRetryBackoffHighWatermark,
+		)
+	}
+
+	// children of a HierarchicalScheduler share the workers of the parent as a worker pool is shared
+	sharedWorkers := options.WorkerPool != nil || options.hierarchyParent != nil
+	if sharedWorkers &&
+		(options.SingleWorker || options.RetryRequeue || (options.WarmupDuration > 0 && options.WarmupWorkerCount > 0) ||
+			options.OnTaskExhausted != nil || len(options.DeadLetterQueueSize) != 0) {
+		return nil, errors.New(
+			"shared worker pool can't be used with single worker, retry requeue, warmup, OnTaskExhausted or dead letter queues",
+		)
+	}
+	if sharedWorkers && len(options.IdleOnly) != 0 {
+		return nil, errors.New("shared worker pool can't be used with idle only priorities")
+	}
+	if sharedWorkers && (options.CircuitBreakerFailureThreshold > 0 || options.Preemption || options.CooperativeYield) {
+		return nil, errors.New("shared worker pool can't be used with circuit breakers, preemption or cooperative yield")
+	}
+	if sharedWorkers && (options.MaxRetriesPerSecond > 0 || options.NewTaskReservedFraction > 0) {
+		return nil, errors.New("shared worker pool can't be used with retry budget or reserved workers for new tasks")
+	}
+	if sharedWorkers && options.BatchWindow != 0 {
+		return nil, errors.New("shared worker pool can't be used with batching")
+	}
+	if sharedWorkers && options.ProcessorShutdownTimeout != 0 {
+		return nil, errors.New("shared worker pool can't be used with processor shutdown timeout")
+	}
+	for _, priority := range options.IdleOnly {
+		if isDirectDispatchPriority(options, priority) {
+			return nil, fmt.Errorf("priority %v can't be both direct dispatch and idle only", priority)
+		}
+	}
+	if options.DynamicPriority && len(options.IdleOnly) != 0 {
+		return nil, errors.New("dynamic priority can't be used with idle only priorities")
+	}
+	if options.DrainOnStop && (options.HandoffTarget != nil || options.DynamicPriority ||
+		len(options.PreserveIntraPriorityOrder) != 0) {
+		return nil, errors.New("drain on stop can't be used with handoff target, dynamic priority or preserving intra priority order")
+	}
+	if options.RetryRequeueBackoff && !options.RetryRequeue {
+		return nil, errors.New("retry requeue backoff requires retry requeue")
+	}
+	if options.RetryRequeue && len(options.PreserveIntraPriorityOrder) != 0 {
+		return nil, errors.New("retry requeue can't be used with preserving intra priority order")
+	}
+	if options.AgePriorityEscalationInterval < 0 {
+		return nil, fmt.Errorf("invalid age priority escalation interval %v", options.AgePriorityEscalationInterval)
+	}
+	for priority, age := range options.AgePriorityEscalation {
+		if age <= 0 {
+			return nil, fmt.Errorf("invalid age priority escalation %v for priority %v", age, priority)
+		}
+		if _, ok := nextHigherPriority(weights, priority); !ok {
+			return nil, fmt.Errorf("priority %v can't be escalated as there's no higher priority", priority)
+		}
+	}
+	for _, priority := range options.PreserveIntraPriorityOrder {
+		if _, ok := options.AgePriorityEscalation[priority]; ok {
+			return nil, fmt.Errorf("order of priority %v can't be preserved with age priority escalation", priority)
+		}
+		if isDirectDispatchPriority(options, priority) {
+			return nil, fmt.Errorf("order of direct dispatch priority %v can't be preserved", priority)
+		}
+		if limit := maxConcurrency(options, priority); limit > 1 {
+			return nil, fmt.Errorf("order of priority %v can't be preserved with max concurrency %v", priority, limit)
+		}
+	}
+	return weights, nil
+}
+
+// validatePriorityOrder checks if the order is a permutation of the priorities with weights
+func validatePriorityOrder(
+	order []int,
+	weights map[int]int,
+) error {
+	if len(order) == 0 {
+		return nil
+	}
+	if len(order) != len(weights) {
+		return fmt.Errorf("priority order %v doesn't match the %v priorities with weights", order, len(weights))
+	}
+	seen := make(map[int]struct{}, len(order))
+	for _, priority := range order {
+		if _, ok := weights[priority]; !ok {
+			return fmt.Errorf("priority %v in priority order has no weight", priority)
+		}
+		if _, ok := seen[priority]; ok {
+			return fmt.Errorf("duplicate priority %v in priority order", priority)
+		}
+		seen[priority] = struct{}{}
+	}
+	return nil
+}
+
+func isDirectDispatchPriority(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+	priority int,
+) bool {
+	if options.ExpressPriority != nil && *options.ExpressPriority == priority {
+		return true
+	}
+	for _, directDispatchPriority := range options.DirectDispatch {
+		if directDispatchPriority == priority {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Start() {
+	if !atomic.CompareAndSwapInt32(&w.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
+		return
+	}
+
+	w.processor.Start()
+	if w.options.ReadinessCheck == nil {
+		w.startDispatching()
+		return
+	}
+
+	// the goroutine is tracked as a dispatcher so that Stop waits for it before the dispatchers it starts
+	w.dispatcherWG.Add(1)
+	go func() {
+		_ = w.awaitReadinessAndStartDispatching(context.Background())
+	}()
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) StartAndWait(
+	ctx context.Context,
+) error {
+	if !atomic.CompareAndSwapInt32(&w.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
+		return errors.New("task scheduler is already started")
+	}
+
+	w.processor.Start()
+	if w.options.ReadinessCheck == nil {
+		w.startDispatching()
+		return nil
+	}
+
+	w.dispatcherWG.Add(1)
+	if err := w.awaitReadinessAndStartDispatching(ctx); err != nil {
+		w.Stop()
+		return err
+	}
+	return nil
+}
+
+// awaitReadinessAndStartDispatching retries ReadinessCheck until it passes, and then starts dispatching. It
+// returns ErrProcessorNotReady if either the context is done or the scheduler is stopped first. The caller must
+// add the goroutine to the dispatcher wait group, which is done once the dispatchers are started
+func (w *weightedRoundRobinTaskSchedulerImpl) awaitReadinessAndStartDispatching(
+	ctx context.Context,
+) error {
+	defer w.dispatcherWG.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-w.shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	interval := w.options.ReadinessCheckInterval
+	if interval == 0 {
+		interval = defaultReadinessCheckInterval
+	}
+	for attempt := 1; ; attempt++ {
+		metricsScope := w.getMetricsScope()
+		metricsScope.IncCounter(metrics.PriorityTaskReadinessCheckAttempt)
+		err := w.options.ReadinessCheck(ctx)
+		if err == nil {
+			w.logger.Info("Task processor is ready.", tag.Attempt(int32(attempt)))
+			w.startDispatching()
+			return nil
+		}
+		metricsScope.IncCounter(metrics.PriorityTaskReadinessCheckFailure)
+		w.logger.Warn("Task processor is not ready.", tag.Attempt(int32(attempt)), tag.Error(err))
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if w.isStopped() {
+				w.logger.Info("Weighted round robin task scheduler stopped before the processor is ready.")
+			} else {
+				w.logger.Error("Task processor is not ready before the deadline.", tag.Attempt(int32(attempt)), tag.Error(err))
+			}
+			return ErrProcessorNotReady
+		}
+	}
+}
+
+// startDispatching starts the dispatchers and the background goroutines of a started scheduler
+func (w *weightedRoundRobinTaskSchedulerImpl) startDispatching() {
+	atomic.StoreInt64(&w.lastProgressTime, time.Now().UnixNano())
+	w.dispatcherWG.Add(w.options.DispatcherCount)
+	for i := 0; i != w.options.DispatcherCount; i++ {
+		go w.dispatcher()
+	}
+	w.backgroundWG.Add(1)
+	go w.updateWeights()
+	w.emitWeights(w.getWeights())
+	if w.warmupEnabled() {
+		w.backgroundWG.Add(1)
+		go w.warmup()
+	}
+	if len(w.options.AgePriorityEscalation) != 0 {
+		w.backgroundWG.Add(1)
+		go w.escalateAgedTasks()
+	}
+	if w.concurrencyIntegrators != nil {
+		w.backgroundWG.Add(1)
+		go w.emitEffectiveConcurrency()
+	}
+	if w.executionShare != nil {
+		w.backgroundWG.Add(1)
+		go w.emitExecutionShares()
+	}
+	if w.driftDispatched != nil {
+		w.backgroundWG.Add(1)
+		go w.emitWeightDrift()
+	}
+	if w.priorityActivity != nil {
+		w.backgroundWG.Add(1)
+		go w.sweepPriorityActivity()
+	}
+
+	w.checkWeightRatio()
+	w.logger.Info("Weighted round robin task scheduler started.")
+	w.invokeLifecycleCallback(w.options.OnStart)
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Stop() {
+	if !atomic.CompareAndSwapInt32(&w.status, common.DaemonStatusStarted, common.DaemonStatusStopped) {
+		return
+	}
+
+	close(w.shutdownCh)
+
+	// the processor keeps running while the queued tasks are drained to it
+	if !w.options.DrainOnStop {
+		w.processor.Stop()
+	}
+
+	dispatcherShutdownTimeout := w.options.DispatcherShutdownTimeout
+	if dispatcherShutdownTimeout <= 0 {
+		dispatcherShutdownTimeout = defaultDispatcherShutdownTimeout
+	}
+	if success := common.AwaitWaitGroup(&w.dispatcherWG, dispatcherShutdownTimeout); !success {
+		w.logger.Warn("Weighted round robin task scheduler dispatchers timedout on shutdown.")
+	}
+
+	w.dropQueuedTasks()
+	if w.options.DrainOnStop {
+		w.processor.Stop()
+	}
+	w.flushCounters()
+
+	w.logger.Info("Weighted round robin task scheduler shutdown.")
+	w.invokeLifecycleCallback(w.options.OnStop)
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Shutdown(
+	ctx context.Context,
+) (ShutdownSummary, error) {
+	if atomic.LoadInt32(&w.status) != common.DaemonStatusStarted {
+		return ShutdownSummary{}, ErrTaskSchedulerClosed
+	}
+	if !atomic.CompareAndSwapInt32(&w.shuttingDown, 0, 1) {
+		return ShutdownSummary{}, errors.New("task scheduler is already shutting down")
+	}
+
+	w.logger.Info("Weighted round robin task scheduler shutting down.")
+	processor, _ := w.processor.(ParallelTaskProcessor)
+	completedTasks := func() int64 {
+		if processor == nil {
+			return 0
+		}
+		stats := processor.Stats()
+		return stats.SucceededTasks + stats.FailedTasks
+	}
+	completedBefore := completedTasks()
+
+	err := w.Drain(ctx)
+	if err == nil && processor != nil {
+		err = awaitProcessorIdle(ctx, processor)
+	}
+
+	summary := ShutdownSummary{
+		Completed: completedTasks() - completedBefore,
+	}
+	summary.AbandonedQueued, _ = w.DrainProgress()
+	if processor != nil {
+		summary.AbandonedInFlight = processorTasks(processor.Stats())
+	}
+	if err != nil {
+		w.logger.Warn(
+			"Weighted round robin task scheduler shutdown deadline exceeded.",
+			tag.Error(err),
+			tag.Counter(summary.AbandonedQueued+summary.AbandonedInFlight),
+		)
+	}
+	w.Stop()
+	return summary, err
+}
+
+// awaitProcessorIdle blocks until the processor has no task buffered, executing
+// or pending completion, returns the context's error if it's done before
+func awaitProcessorIdle(
+	ctx context.Context,
+	processor ParallelTaskProcessor,
+) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for processorTasks(processor.Stats()) != 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// processorTasks returns the number of tasks submitted to the processor which are not yet completed
+func processorTasks(
+	stats ProcessorStats,
+) int {
+	return stats.QueuedTasks + stats.BusyWorkers + stats.PendingTasks + stats.BatchedTasks
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) WasStarted() bool {
+	return atomic.LoadInt32(&w.status) != common.DaemonStatusInitialized
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Reset() error {
+	if !atomic.CompareAndSwapInt32(&w.status, common.DaemonStatusStopped, schedulerStatusResetting) {
+		return ErrSchedulerNotStopped
+	}
+
+	weights, err := validateOptions(w.options)
+	if err == nil {
+		w.backgroundWG.Wait()
+		// discard the notification left by tasks submitted before stopped
+		select {
+		case <-w.notifyCh:
+		default:
+		}
+		err = w.initialize(weights)
+	}
+	if err != nil {
+		atomic.StoreInt32(&w.status, common.DaemonStatusStopped)
+		return err
+	}
+
+	atomic.StoreInt32(&w.status, common.DaemonStatusInitialized)
+	w.logger.Info("Weighted round robin task scheduler reset.")
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) invokeLifecycleCallback(
+	callback func(),
+) {
+	if callback == nil {
+		return
+	}
+
+	var err error
+	defer log.CapturePanic(w.logger, &err)
+	callback()
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) dropQueuedTasks() {
+	w.Lock()
+	queues := w.queueList
+	refusedTasks := w.refusedTasks
+	w.refusedTasks = nil
+	w.refusedTasksDropped = true
+	w.Unlock()
+
+	if w.options.DrainOnStop {
+		// drained in the order the queues are scanned during normal operation
+		queues = append([]TaskQueue(nil), queues...)
+		sort.SliceStable(queues, func(i, j int) bool {
+			return w.scansBefore(queues[i].Priority(), queues[j].Priority())
+		})
+	}
+
+	// closing the queues, instead of polling them, guarantees no task can be
+	// enqueued after this point, so every task accepted by Submit is either
+	// dispatched or dropped here
+	var heldTasks []PriorityTask
+	if w.delayedRetries != nil {
+		// held tasks are committed to their queues with the lock of delayedRetries
+		// held, so they're either closed with the queues or returned here
+		heldTasks = w.delayedRetries.close()
+	}
+	// refused tasks are polled before the tasks still queued with the same priority
+	droppedTasks := refusedTasks
+	for _, queue := range queues {
+		droppedTasks = append(droppedTasks, queue.(*taskQueueImpl).Close()...)
+	}
+	if len(refusedTasks) != 0 || len(heldTasks) != 0 {
+		// held tasks would be queued behind the queued tasks of the same priority
+		droppedTasks = append(droppedTasks, heldTasks...)
+		sort.SliceStable(droppedTasks, func(i, j int) bool {
+			if w.options.DrainOnStop {
+				return w.scansBefore(droppedTasks[i].Priority(), droppedTasks[j].Priority())
+			}
+			return droppedTasks[i].Priority() < droppedTasks[j].Priority()
+		})
+	}
+	if w.dynamicTasks != nil {
+		droppedTasks = append(droppedTasks, w.dynamicTasks.close()...)
+	}
+
+	if w.options.DrainOnStop && len(droppedTasks) != 0 {
+		droppedTasks = w.drainTasks(droppedTasks)
+	}
+	if w.options.HandoffTarget != nil && len(droppedTasks) != 0 {
+		droppedTasks = w.handoffTasks(droppedTasks)
+	}
+	if w.options.OnTasksDropped == nil && len(droppedTasks) != 0 {
+		droppedTasks = w.retainNonDroppableTasks(droppedTasks)
+	}
+
+	if len(droppedTasks) == 0 {
+		return
+	}
+	if w.eventRecorder != nil {
+		for _, task := range droppedTasks {
+			w.eventRecorder.record(EventTypeDrop, task.Priority(), nil)
+		}
+	}
+	if w.options.OnTasksDropped != nil {
+		w.options.OnTasksDropped(droppedTasks)
+		return
+	}
+	if w.options.NackOnStop {
+		nackTasks(droppedTasks)
+	}
+}
+
+// drainTasks submits the tasks to the processor in the given order, and returns
+// the tasks not submitted once the processor fails to accept a task
+func (w *weightedRoundRobinTaskSchedulerImpl) drainTasks(
+	tasks []PriorityTask,
+) []PriorityTask {
+	for idx, task := range tasks {
+		priority := task.Priority()
+		if err := w.processor.Submit(task); err != nil {
+			w.eventRecorder.record(EventTypeDispatchError, priority, err)
+			w.logger.Warn(
+				"Weighted round robin task scheduler failed to drain queued tasks.",
+				tag.Error(err),
+				tag.Counter(len(tasks)-idx),
+			)
+			return tasks[idx:]
+		}
+		w.eventRecorder.record(EventTypeDispatch, priority, nil)
+	}
+	w.logger.Info("Weighted round robin task scheduler drained queued tasks.", tag.Counter(len(tasks)))
+	return nil
+}
+
+// handoffTasks submits the tasks to the handoff target and returns the tasks not accepted
+func (w *weightedRoundRobinTaskSchedulerImpl) handoffTasks(
+	tasks []PriorityTask,
+) []PriorityTask {
+	var rejectedTasks []PriorityTask
+	for _, task := range tasks {
+		if submitted, err := w.options.HandoffTarget.TrySubmit(task); err != nil || !submitted {
+			rejectedTasks = append(rejectedTasks, task)
+		}
+	}
+	w.logger.Info("Weighted round robin task scheduler handed off queued tasks.", tag.Counter(len(tasks)-len(rejectedTasks)))
+	return rejectedTasks
+}
+
+// retainNonDroppableTasks puts the NonDroppableTasks being dropped on Stop into the dead letter queue of their
+// priority, executes those not fitting into it, and returns the other tasks
+func (w *weightedRoundRobinTaskSchedulerImpl) retainNonDroppableTasks(
+	tasks []PriorityTask,
+) []PriorityTask {
+	var droppableTasks, nonDroppableTasks []PriorityTask
+	for _, task := range tasks {
+		if !isNonDroppable(task) {
+			droppableTasks = append(droppableTasks, task)
+			continue
+		}
+		if !w.addDeadLetter(task) {
+			nonDroppableTasks = append(nonDroppableTasks, task)
+		}
+	}
+	if len(nonDroppableTasks) != 0 {
+		w.executeNonDroppableTasks(nonDroppableTasks)
+	}
+	return droppableTasks
+}
+
+// executeNonDroppableTasks executes the tasks in order, blocking Stop for up to NonDroppableGracePeriod. The
+// tasks not started within the period are nacked, and the task being executed is left to complete on its own
+func (w *weightedRoundRobinTaskSchedulerImpl) executeNonDroppableTasks(
+	tasks []PriorityTask,
+) {
+	for _, task := range tasks {
+		w.incTaskCounter(metrics.PriorityTaskNonDroppableDrainExtended, task, task.Priority())
+	}
+	gracePeriod := w.options.NonDroppableGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultNonDroppableGracePeriod
+	}
+	w.logger.Warn("Weighted round robin task scheduler extended shutdown to execute non-droppable tasks.", tag.Counter(len(tasks)))
+
+	deadline := time.Now().Add(gracePeriod)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for idx, task := range tasks {
+			if !time.Now().Before(deadline) {
+				nackTasks(tasks[idx:])
+				return
+			}
+			if err := w.executeTaskInline(task); err != nil {
+				task.Nack()
+			} else {
+				task.Ack()
+			}
+		}
+	}()
+
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-doneCh:
+	case <-timer.C:
+		w.logger.Warn("Weighted round robin task scheduler timedout executing non-droppable tasks on shutdown.")
+	}
+}
+
+// executeTaskInline executes the task without the processor, returns the error left by HandleErr
+func (w *weightedRoundRobinTaskSchedulerImpl) executeTaskInline(
+	task PriorityTask,
+) (err error) {
+	defer log.CapturePanic(w.logger, &err)
+
+	if err = task.Execute(); err != nil {
+		err = task.HandleErr(err)
+	}
+	return err
+}
+
+// isNonDroppable returns true if the task, unwrapped from the wrappers added by the scheduler, is a
+// NonDroppableTask which must not be dropped
+func isNonDroppable(
+	task PriorityTask,
+) bool {
+	nonDroppableTask, ok := unwrapSchedulerTask(task).(NonDroppableTask)
+	return ok && nonDroppableTask.NonDroppable()
+}
+
+// nackTasks nacks the tasks, grouping tasks whose submitted task implements BulkNackableTask
+// by their nacker so that each group is nacked in one call. The nacker is given the queued
+// tasks, so that the wrappers added around the submitted tasks are still nacked
+func nackTasks(
+	tasks []PriorityTask,
+) {
+	var nackers []BulkNacker
+	groups := make(map[BulkNacker][]PriorityTask)
+	for _, task := range tasks {
+		bulkNackableTask, ok := unwrapSchedulerTask(task).(BulkNackableTask)
+		if !ok {
+			task.Nack()
+			continue
+		}
+
+		nacker := bulkNackableTask.BulkNacker()
+		if _, ok := groups[nacker]; !ok {
+			nackers = append(nackers, nacker)
+		}
+		groups[nacker] = append(groups[nacker], task)
+	}
+
+	for _, nacker := range nackers {
+		nacker.NackAll(groups[nacker])
+	}
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Submit(task PriorityTask) error {
+	_, err := w.SubmitIdempotent(task)
+	return err
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitIdempotent(task PriorityTask) (bool, error) {
+	deduped, _, err := w.submit(task, time.Time{})
+	return deduped, err
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitWithPosition(task PriorityTask) (int, error) {
+	_, position, err := w.submit(task, time.Time{})
+	return position, err
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitWithEnqueueTime(
+	task PriorityTask,
+	enqueuedAt time.Time,
+) error {
+	tolerance := w.options.EnqueueTimeTolerance
+	if tolerance == 0 {
+		tolerance = defaultEnqueueTimeTolerance
+	}
+	now := time.Now()
+	if enqueuedAt.Sub(now) > tolerance {
+		w.rejectTask(task, task.Priority(), RejectReasonValidationFailed)
+		return ErrEnqueueTimeInFuture
+	}
+	if enqueuedAt.After(now) {
+		enqueuedAt = now
+	}
+	_, _, err := w.submit(task, enqueuedAt)
+	return err
+}
+
+// submit blocks until the task is queued, and returns if the task is deduped and the number
+// of tasks ahead of it in the queue when it's enqueued. A zero enqueueTime means now
+func (w *weightedRoundRobinTaskSchedulerImpl) submit(
+	task PriorityTask,
+	enqueueTime time.Time,
+) (bool, int, error) {
+	if err := w.validateSubmission(task); err != nil {
+		w.rejectTask(task, task.Priority(), RejectReasonValidationFailed)
+		return false, 0, err
+	}
+	priority := w.taskPriority(task)
+	metricsScope := w.getSubmitTaskMetricsScope(task, priority)
+	w.incSubmitTaskCounter(metrics.PriorityTaskSubmitRequest, task, priority)
+	defer recordLatency(metricsScope, metrics.PriorityTaskSubmitLatency, time.Now())
+
+	taskQueue, err := w.getOrCreateTaskQueue(priority)
+	if err != nil {
+		w.rejectTask(task, priority, RejectReasonUnknownPriority)
+		return false, 0, err
+	}
+
+	if err := w.checkSubmittable(); err != nil {
+		w.rejectTask(task, priority, rejectReason(err))
+		return false, 0, err
+	}
+	if w.idempotencyKeys != nil {
+		var deduped bool
+		if task, deduped = w.idempotencyKeys.acquire(task); deduped {
+			w.incSubmitTaskCounter(metrics.PriorityTaskIdempotencyDeduped, task, priority)
+			return true, 0, nil
+		}
+	}
+	queuedTask := w.snapshotPriority(task, priority)
+	if dynamicTask, ok := w.getDynamicPriorityTask(task); ok {
+		position, ok := w.dynamicTasks.put(queuedTask, dynamicTask, enqueueTime, w.shutdownCh)
+		if !ok {
+			w.releaseIdempotencyKey(task)
+			w.rejectTask(task, priority, RejectReasonShutdown)
+			return false, 0, ErrTaskSchedulerClosed
+		}
+		w.eventRecorder.record(EventTypeSubmit, priority, nil)
+		w.signalHighPriority(priority)
+		w.notifyDispatcher()
+		return false, position, nil
+	}
+	if w.tryDirectDispatch(queuedTask, taskQueue, enqueueTime) {
+		w.eventRecorder.record(EventTypeSubmit, priority, nil)
+		w.eventRecorder.record(EventTypeDispatch, priority, nil)
+		return false, 0, nil
+	}
+	if !isNonDroppable(task) && w.shedSubmission(taskQueue) {
+		w.releaseIdempotencyKey(task)
+		w.incSubmitTaskCounter(metrics.PriorityTaskShed, task, priority)
+		w.rejectTask(task, priority, RejectReasonShed)
+		return false, 0, ErrTaskShed
+	}
+	if w.exceedsMaxQueuedBytes(task) {
+		w.releaseIdempotencyKey(task)
+		w.incSubmitTaskCounter(metrics.PriorityTaskQueuedBytesRejected, task, priority)
+		w.rejectTask(task, priority, RejectReasonQueuedBytesExceeded)
+		return false, 0, ErrQueuedBytesExceeded
+	}
+	if !w.applyBackpressure(taskQueue, metricsScope) {
+		w.releaseIdempotencyKey(task)
+		w.rejectTask(task, priority, RejectReasonShutdown)
+		return false, 0, ErrTaskSchedulerClosed
+	}
+	position, err := w.putTask(taskQueue, queuedTask, enqueueTime)
+	if err != nil {
+		w.releaseIdempotencyKey(task)
+		w.rejectTask(task, priority, rejectReason(err))
+		return false, 0, err
+	}
+	w.shedQueuedBytes(priority)
+	w.eventRecorder.record(EventTypeSubmit, priority, nil)
+	w.priorityActivity.queued(priority)
+	w.signalHighPriority(priority)
+	// notification must be sent after the task is enqueued,
+	// see notifyDispatcher for details
+	w.notifyDispatcher()
+	return false, position, nil
+}
+
+// putTask blocks until the task is added to the queue, unless MaxBlockedSubmitters
+// submitters are already blocked, and returns the number of tasks ahead of it
+func (w *weightedRoundRobinTaskSchedulerImpl) putTask(
+	taskQueue *taskQueueImpl,
+	task PriorityTask,
+	enqueueTime time.Time,
+) (int, error) {
+	if w.options.MaxBlockedSubmitters > 0 {
+		if position, ok := taskQueue.offerAt(task, enqueueTime); ok {
+			return position, nil
+		}
+		if atomic.AddInt32(&w.blockedSubmitters, 1) > int32(w.options.MaxBlockedSubmitters) {
+			atomic.AddInt32(&w.blockedSubmitters, -1)
+			return 0, ErrTooManyBlockedSubmitters
+		}
+		defer atomic.AddInt32(&w.blockedSubmitters, -1)
+	}
+
+	position, ok := taskQueue.putAt(task, enqueueTime, w.shutdownCh)
+	if !ok {
+		if !w.isStopped() {
+			// queues are only closed by Stop and RemapPriorities
+			return 0, ErrPriorityRemoved
+		}
+		return 0, ErrTaskSchedulerClosed
+	}
+	return position, nil
+}
+
+// applyBackpressure delays the submission in proportion to the depth of the
+// queue, returns false if the scheduler is stopped during the delay
+func (w *weightedRoundRobinTaskSchedulerImpl) applyBackpressure(
+	taskQueue *taskQueueImpl,
+	metricsScope metrics.Scope,
+) bool {
+	if w.options.AdaptiveBackpressureMaxDelay <= 0 {
+		return true
+	}
+
+	delay := backpressureDelay(
+		float64(taskQueue.Len())/float64(taskQueue.Cap()),
+		w.options.AdaptiveBackpressureLowWatermark,
+		w.options.AdaptiveBackpressureHighWatermark,
+		w.options.AdaptiveBackpressureMaxDelay,
+	)
+	if delay <= 0 {
+		return true
+	}
+
+	metricsScope.RecordTimer(metrics.PriorityTaskBackpressureDelay, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.shutdownCh:
+		return false
+	}
+}
+
+// exceedsMaxQueuedBytes returns true if queuing the task takes the queued bytes beyond MaxQueuedBytes
+func (w *weightedRoundRobinTaskSchedulerImpl) exceedsMaxQueuedBytes(
+	task PriorityTask,
+) bool {
+	if w.options.MaxQueuedBytes <= 0 {
+		return false
+	}
+	// sized as tracked by queuedBytes, instead of the wrappers added on submission
+	return w.queuedBytes.load()+w.options.SizeOf(unwrapSchedulerTask(task).(PriorityTask)) > w.options.MaxQueuedBytes
+}
+
+// shedQueuedBytes sheds queued tasks from the lowest priority and oldest first until the queued bytes are
+// back within SoftQueuedBytes, priorities higher than the given priority of the submitted task are not shed
+func (w *weightedRoundRobinTaskSchedulerImpl) shedQueuedBytes(
+	priority int,
+) {
+	softLimit := w.options.SoftQueuedBytes
+	if softLimit <= 0 || w.queuedBytes.load() <= softLimit {
+		return
+	}
+
+	w.RLock()
+	queues := append([]TaskQueue(nil), w.queueList...)
+	w.RUnlock()
+	sort.SliceStable(queues, func(i, j int) bool {
+		return w.scansBefore(queues[j].Priority(), queues[i].Priority())
+	})
+
+	// holding the dispatch lock so that no task is polled while being shed
+	w.dispatchLock.Lock()
+	var shed []PriorityTask
+	for _, queue := range queues {
+		if w.scansBefore(queue.Priority(), priority) {
+			break
+		}
+		for w.queuedBytes.load() > softLimit {
+			task, ok := queue.(*taskQueueImpl).RemoveHead()
+			if !ok {
+				break
+			}
+			shed = append(shed, task)
+		}
+	}
+	w.dispatchLock.Unlock()
+
+	// nack outside the dispatch lock so that dispatchers are not blocked
+	for _, task := range shed {
+		taskPriority := task.Priority()
+		w.incTaskCounter(metrics.PriorityTaskQueuedBytesShed, task, taskPriority)
+		w.eventRecorder.record(EventTypeDrop, taskPriority, nil)
+		task.Nack()
+	}
+}
+
+// shedSubmission returns true if the submission to the queue is to be shed by LoadShedding
+func (w *weightedRoundRobinTaskSchedulerImpl) shedSubmission(
+	taskQueue *taskQueueImpl,
+) bool {
+	probability := w.shedProbability(taskQueue)
+	return probability > 0 && w.shedRandom() < probability
+}
+
+// shedProbability returns the probability of shedding a submission to the queue at its current depth
+func (w *weightedRoundRobinTaskSchedulerImpl) shedProbability(
+	taskQueue *taskQueueImpl,
+) float64 {
+	curve, ok := w.options.LoadShedding[taskQueue.Priority()]
+	if !ok {
+		return 0
+	}
+	return shedProbability(float64(taskQueue.Len())/float64(taskQueue.Cap()), curve)
+}
+
+// shedProbability grows linearly from zero at the low watermark of the curve to its max probability
+// at the high watermark, depth and watermarks are fractions of the queue capacity
+func shedProbability(
+	depth float64,
+	curve LoadSheddingCurve,
+) float64 {
+	highWatermark := curve.HighWatermark
+	if highWatermark <= 0 {
+		highWatermark = 1
+	}
+	if depth <= curve.LowWatermark {
+		return 0
+	}
+	if depth >= highWatermark {
+		return curve.MaxProbability
+	}
+	return curve.MaxProbability * (depth - curve.LowWatermark) / (highWatermark - curve.LowWatermark)
+}
+
+// retryBackoffMultiplier scales the retry backoff of the task by the depth of its priority queue
+func (w *weightedRoundRobinTaskSchedulerImpl) retryBackoffMultiplier(
+	_ Task,
+	priority int,
+) float64 {
+	w.RLock()
+	taskQueue, ok := w.taskQueues[priority]
+	w.RUnlock()
+	if !ok {
+		return 1
+	}
+
+	return retryBackoffMultiplier(
+		float64(taskQueue.Len())/float64(taskQueue.Cap()),
+		w.options.AdaptiveRetryBackoffLowWatermark,
+		w.options.AdaptiveRetryBackoffHighWatermark,
+		w.options.AdaptiveRetryBackoffMaxMultiplier,
+	)
+}
+
+// retryBackoffMultiplier grows linearly from one at the low watermark to maxMultiplier at the high watermark,
+// depth and watermarks are fractions of the queue capacity, a zero high watermark means one
+func retryBackoffMultiplier(
+	depth float64,
+	lowWatermark float64,
+	highWatermark float64,
+	maxMultiplier float64,
+) float64 {
+	if highWatermark <= 0 {
+		highWatermark = 1
+	}
+	if depth <= lowWatermark {
+		return 1
+	}
+	if depth >= highWatermark {
+		return maxMultiplier
+	}
+	return 1 + (maxMultiplier-1)*(depth-lowWatermark)/(highWatermark-lowWatermark)
+}
+
+// validWatermarks checks the watermarks are fractions of the queue capacity
+// and the low watermark is below the high one, a zero high watermark means one
+func validWatermarks(
+	lowWatermark float64,
+	highWatermark float64,
+) bool {
+	if highWatermark == 0 {
+		highWatermark = 1
+	}
+	return lowWatermark >= 0 && lowWatermark < highWatermark && highWatermark <= 1
+}
+
+// backpressureDelay grows linearly from zero at the low watermark to maxDelay at the high watermark,
+// depth and watermarks are fractions of the queue capacity, a zero high watermark means one
+func backpressureDelay(
+	depth float64,
+	lowWatermark float64,
+	highWatermark float64,
+	maxDelay time.Duration,
+) time.Duration {
+	if highWatermark <= 0 {
+		highWatermark = 1
+	}
+	if depth <= lowWatermark {
+		return 0
+	}
+	if depth >= highWatermark {
+		return maxDelay
+	}
+	return time.Duration(float64(maxDelay) * (depth - lowWatermark) / (highWatermark - lowWatermark))
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) TrySubmit(
+	task PriorityTask,
+) (bool, error) {
+	if err := w.validateSubmission(task); err != nil {
+		w.rejectTask(task, task.Priority(), RejectReasonValidationFailed)
+		return false, err
+	}
+	priority := w.taskPriority(task)
+	taskQueue, err := w.getOrCreateTaskQueue(priority)
+	if err != nil {
+		w.rejectTask(task, priority, RejectReasonUnknownPriority)
+		return false, err
+	}
+
+	if err := w.checkSubmittable(); err != nil {
+		w.rejectTask(task, priority, rejectReason(err))
+		return false, err
+	}
+	if w.idempotencyKeys != nil {
+		var deduped bool
+		if task, deduped = w.idempotencyKeys.acquire(task); deduped {
+			// the task is already submitted
+			w.incSubmitTaskCounter(metrics.PriorityTaskIdempotencyDeduped, task, priority)
+			return true, nil
+		}
+	}
+	queuedTask := w.snapshotPriority(task, priority)
+	offered := false
+	if dynamicTask, ok := w.getDynamicPriorityTask(task); ok {
+		offered = w.dynamicTasks.offer(queuedTask, dynamicTask)
+	} else {
+		if w.exceedsMaxQueuedBytes(task) {
+			w.releaseIdempotencyKey(task)
+			w.incSubmitTaskCounter(metrics.PriorityTaskQueuedBytesRejected, task, priority)
+			w.rejectTask(task, priority, RejectReasonQueuedBytesExceeded)
+			return false, ErrQueuedBytesExceeded
+		}
+		if offered = taskQueue.Offer(queuedTask); offered {
+			w.shedQueuedBytes(priority)
+		}
+	}
+	if !offered {
+		w.releaseIdempotencyKey(task)
+		w.rejectTask(task, priority, RejectReasonQueueFull)
+		return false, nil
+	}
+	w.eventRecorder.record(EventTypeSubmit, priority, nil)
+	w.priorityActivity.queued(priority)
+	w.signalHighPriority(priority)
+	w.incSubmitTaskCounter(metrics.PriorityTaskSubmitRequest, task, priority)
+	w.notifyDispatcher()
+	return true, nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitAtomic(
+	tasks []PriorityTask,
+) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	if err := w.validateSubmissions(tasks); err != nil {
+		return err
+	}
+
+	tasksByPriority := make(map[int][]PriorityTask)
+	taskPriorities := make([]int, 0, len(tasks))
+	for _, task := range tasks {
+		priority := w.taskPriority(task)
+		tasksByPriority[priority] = append(tasksByPriority[priority], w.snapshotPriority(task, priority))
+		taskPriorities = append(taskPriorities, priority)
+	}
+	// none of the tasks is submitted if any of them is rejected
+	rejectAll := func(reason string) {
+		for idx, task := range tasks {
+			w.rejectTask(task, taskPriorities[idx], reason)
+		}
+	}
+	priorities := make([]int, 0, len(tasksByPriority))
+	for priority := range tasksByPriority {
+		priorities = append(priorities, priority)
+	}
+	sort.Ints(priorities)
+
+	taskQueues := make([]*taskQueueImpl, 0, len(priorities))
+	for _, priority := range priorities {
+		taskQueue, err := w.getOrCreateTaskQueue(priority)
+		if err != nil {
+			rejectAll(RejectReasonUnknownPriority)
+			return err
+		}
+		taskQueues = append(taskQueues, taskQueue)
+	}
+
+	if err := w.checkSubmittable(); err != nil {
+		rejectAll(rejectReason(err))
+		return err
+	}
+	for idx, taskQueue := range taskQueues {
+		if !taskQueue.Reserve(len(tasksByPriority[taskQueue.Priority()])) {
+			for _, reservedQueue := range taskQueues[:idx] {
+				reservedQueue.Unreserve(len(tasksByPriority[reservedQueue.Priority()]))
+			}
+			if w.isStopped() {
+				rejectAll(RejectReasonShutdown)
+				return ErrTaskSchedulerClosed
+			}
+			rejectAll(RejectReasonQueueFull)
+			return ErrInsufficientCapacity
+		}
+	}
+
+	// commit while holding the locks of all the queues, acquired in priority order,
+	// so that no task is enqueued if any of the queues is closed by Stop meanwhile
+	for _, taskQueue := range taskQueues {
+		taskQueue.Lock()
+	}
+	closed := false
+	for _, taskQueue := range taskQueues {
+		closed = closed || taskQueue.closed
+	}
+	for _, taskQueue := range taskQueues {
+		if closed {
+			taskQueue.unreserveLocked(len(tasksByPriority[taskQueue.Priority()]))
+			continue
+		}
+		for _, task := range tasksByPriority[taskQueue.Priority()] {
+			taskQueue.commitReservedLocked(task)
+		}
+	}
+	for _, taskQueue := range taskQueues {
+		taskQueue.Unlock()
+	}
+	if closed {
+		rejectAll(RejectReasonShutdown)
+		return ErrTaskSchedulerClosed
+	}
+
+	for _, priority := range priorities {
+		for _, task := range tasksByPriority[priority] {
+			w.incSubmitTaskCounter(metrics.PriorityTaskSubmitRequest, task, priority)
+			w.eventRecorder.record(EventTypeSubmit, priority, nil)
+			w.priorityActivity.queued(priority)
+			w.signalHighPriority(priority)
+		}
+	}
+	w.notifyDispatcher()
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitBatch(
+	tasks []PriorityTask,
+	partial bool,
+) ([]PriorityTask, error) {
+	if err := w.validateSubmissions(tasks); err != nil {
+		return tasks, err
+	}
+	priorities := make([]int, 0, len(tasks))
+	for _, task := range tasks {
+		priorities = append(priorities, w.taskPriority(task))
+	}
+	taskQueues := make([]*taskQueueImpl, 0, len(tasks))
+	for _, priority := range priorities {
+		taskQueue, err := w.getOrCreateTaskQueue(priority)
+		if err != nil {
+			// none of the tasks is submitted
+			for idx, task := range tasks {
+				w.rejectTask(task, priorities[idx], RejectReasonUnknownPriority)
+			}
+			return nil, err
+		}
+		taskQueues = append(taskQueues, taskQueue)
+	}
+
+	if err := w.checkSubmittable(); err != nil {
+		for idx, task := range tasks {
+			w.rejectTask(task, priorities[idx], rejectReason(err))
+		}
+		return tasks, err
+	}
+
+	var unaccepted []PriorityTask
+	fullPriorities := make(map[int]struct{})
+	numEnqueued := 0
+	for idx, task := range tasks {
+		priority := priorities[idx]
+		queuedTask := w.snapshotPriority(task, priority)
+		if partial {
+			if _, ok := fullPriorities[priority]; ok || !taskQueues[idx].Offer(queuedTask) {
+				fullPriorities[priority] = struct{}{}
+				unaccepted = append(unaccepted, task)
+				w.rejectTask(task, priority, RejectReasonQueueFull)
+				continue
+			}
+		} else if !taskQueues[idx].Offer(queuedTask) {
+			// dispatchers must be notified of the tasks already enqueued before blocking,
+			// otherwise the queue may never be drained
+			if numEnqueued != 0 {
+				w.notifyDispatcher()
+			}
+			if !taskQueues[idx].Put(queuedTask, w.shutdownCh) {
+				unaccepted = tasks[idx:]
+				for unacceptedIdx, task := range unaccepted {
+					w.rejectTask(task, priorities[idx+unacceptedIdx], RejectReasonShutdown)
+				}
+				break
+			}
+		}
+		numEnqueued++
+		w.incSubmitTaskCounter(metrics.PriorityTaskSubmitRequest, task, priority)
+		w.eventRecorder.record(EventTypeSubmit, priority, nil)
+		w.priorityActivity.queued(priority)
+		w.signalHighPriority(priority)
+	}
+
+	if numEnqueued != 0 {
+		w.notifyDispatcher()
+	}
+	if len(unaccepted) != 0 && w.isStopped() {
+		return unaccepted, ErrTaskSchedulerClosed
+	}
+	return unaccepted, nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitReplace(
+	task ReplaceableTask,
+) error {
+	if err := w.validateSubmission(task); err != nil {
+		w.rejectTask(task, task.Priority(), RejectReasonValidationFailed)
+		return err
+	}
+	priority := w.taskPriority(task)
+	metricsScope := w.getSubmitTaskMetricsScope(task, priority)
+	w.incSubmitTaskCounter(metrics.PriorityTaskSubmitRequest, task, priority)
+	defer recordLatency(metricsScope, metrics.PriorityTaskSubmitLatency, time.Now())
+
+	taskQueue, err := w.getOrCreateTaskQueue(priority)
+	if err != nil {
+		w.rejectTask(task, priority, RejectReasonUnknownPriority)
+		return err
+	}
+
+	if err := w.checkSubmittable(); err != nil {
+		w.rejectTask(task, priority, rejectReason(err))
+		return err
+	}
+	if w.options.SnapshotPriority {
+		task = newReplaceablePrioritySnapshotTask(task, priority)
+	}
+	replaced, ok := taskQueue.PutOrReplace(task, w.shutdownCh)
+	if !ok {
+		w.rejectTask(task, priority, RejectReasonShutdown)
+		return ErrTaskSchedulerClosed
+	}
+	w.eventRecorder.record(EventTypeSubmit, priority, nil)
+	if replaced != nil {
+		// the replaced task is superseded by the new one
+		replaced.Ack()
+		return nil
+	}
+	w.priorityActivity.queued(priority)
+	w.signalHighPriority(priority)
+	w.notifyDispatcher()
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitFront(
+	task PriorityTask,
+) error {
+	if err := w.validateSubmission(task); err != nil {
+		w.rejectTask(task, task.Priority(), RejectReasonValidationFailed)
+		return err
+	}
+	priority := w.taskPriority(task)
+	metricsScope := w.getSubmitTaskMetricsScope(task, priority)
+	w.incSubmitTaskCounter(metrics.PriorityTaskSubmitRequest, task, priority)
+	defer recordLatency(metricsScope, metrics.PriorityTaskSubmitLatency, time.Now())
+
+	taskQueue, err := w.getOrCreateTaskQueue(priority)
+	if err != nil {
+		w.rejectTask(task, priority, RejectReasonUnknownPriority)
+		return err
+	}
+
+	if err := w.checkSubmittable(); err != nil {
+		w.rejectTask(task, priority, rejectReason(err))
+		return err
+	}
+	if !taskQueue.PutFront(w.snapshotPriority(task, priority), w.shutdownCh) {
+		w.rejectTask(task, priority, RejectReasonShutdown)
+		return ErrTaskSchedulerClosed
+	}
+	w.eventRecorder.record(EventTypeSubmit, priority, nil)
+	w.priorityActivity.queued(priority)
+	w.signalHighPriority(priority)
+	w.notifyDispatcher()
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitWithFailureCallback(
+	task PriorityTask,
+	onFailure func(err error),
+) error {
+	return w.Submit(newFailureCallbackTask(task, onFailure))
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitFuture(
+	task PriorityTask,
+) (TaskFuture, error) {
+	future := newFutureTask(task)
+	future.remove = func() bool {
+		return w.removeTask(future)
+	}
+
+	if err := w.Submit(future); err != nil {
+		return nil, err
+	}
+	return future, nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SubmitAndAwaitDispatch(
+	ctx context.Context,
+	task PriorityTask,
+) error {
+	awaitedTask := newDispatchAwaitedTask(task)
+	if err := w.Submit(awaitedTask); err != nil {
+		return err
+	}
+
+	select {
+	case <-awaitedTask.dispatchedCh:
+		return awaitedTask.err
+	case <-w.shutdownCh:
+		return ErrTaskSchedulerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) removeTask(
+	task PriorityTask,
+) bool {
+	if w.options.SnapshotPriority {
+		// the priority of the task may have changed since it's submitted
+		w.RLock()
+		queues := w.queueList
+		w.RUnlock()
+		for _, queue := range queues {
+			if queue.(*taskQueueImpl).Remove(task) {
+				return true
+			}
+		}
+		return false
+	}
+
+	w.RLock()
+	taskQueue, ok := w.taskQueues[task.Priority()]
+	w.RUnlock()
+
+	return ok && taskQueue.Remove(task)
+}
+
+// snapshotPriority wraps the task with the given priority
+// observed at submit time if SnapshotPriority is enabled
+func (w *weightedRoundRobinTaskSchedulerImpl) snapshotPriority(
+	task PriorityTask,
+	priority int,
+) PriorityTask {
+	if !w.options.SnapshotPriority {
+		return task
+	}
+	return newPrioritySnapshotTask(task, priority)
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) releaseIdempotencyKey(
+	task PriorityTask,
+) {
+	if w.idempotencyKeys != nil {
+		w.idempotencyKeys.release(task)
+	}
+}
+
+// tryDirectDispatch submits the task to the processor without queueing it if the task priority allows
+// direct dispatch, returns false if the task needs to be queued. Tasks are only directly dispatched when
+// the priority queue is empty, so that tasks with the same priority are still dispatched in order.
+func (w *weightedRoundRobinTaskSchedulerImpl) tryDirectDispatch(
+	task PriorityTask,
+	taskQueue *taskQueueImpl,
+	enqueueTime time.Time,
+) bool {
+	if _, ok := w.directDispatch[taskQueue.Priority()]; !ok || taskQueue.Len() != 0 || w.isQuiesced() {
+		return false
+	}
+	if !w.allowDependency(task) {
+		// leave the task to the dispatchers, which reject it
+		return false
+	}
+
+	processor, ok := w.processor.(ParallelTaskProcessor)
+	if !ok {
+		return false
+	}
+	observer := getDispatchObserver(task)
+	if observer != nil {
+		observer.beforeDispatch()
+	}
+	submitted, err := processor.TrySubmit(w.wrapEndToEndTask(task, taskQueue.Priority(), enqueueTimeOrNow(enqueueTime)))
+	if err == nil && !submitted {
+		err = errTaskNotSubmitted
+	}
+	if observer != nil {
+		observer.afterDispatch(err)
+	}
+	return err == nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) dispatcher() {
+	defer w.dispatcherWG.Done()
+
+	state := w.registerDispatcher()
+	defer atomic.StoreInt32(state, dispatcherStateStopped)
+
+	numDispatched := 0
+	for {
+		// wait for a notification when the dispatch strategy has
+		// no task to dispatch. Notifications are only consumed here,
+		// before asking the strategy for tasks, so any task enqueued before
+		// the notification is sent will be observed by the strategy
+		idleStartTime := time.Now()
+		atomic.StoreInt32(state, dispatcherStateIdle)
+		w.awaitProcessorCapacity()
+		select {
+		case <-w.notifyCh:
+			// block until there's a new task
+		case <-w.shutdownCh:
+			return
+		}
+		atomic.StoreInt32(state, dispatcherStateDispatching)
+
+		// idle and busy time tells if dispatchers are starved of work or of CPU,
+		// time blocked by the processor is counted as busy time
+		busyStartTime := time.Now()
+		w.getMetricsScope().RecordTimer(metrics.PriorityTaskDispatcherIdleTime, busyStartTime.Sub(idleStartTime))
+
+		numDispatchedInRound := 0
+		for {
+			if w.isStopped() {
+				return
+			}
+			// a quiesced dispatcher waits for the notification sent by Resume
+			if w.isQuiesced() {
+				break
+			}
+
+			task, polledTask, ok := w.nextTask()
+			atomic.StoreInt64(&w.lastProgressTime, time.Now().UnixNano())
+			if !ok {
+				w.getMetricsScope().RecordTimer(metrics.PriorityTaskDispatcherBusyTime, time.Since(busyStartTime))
+				if numDispatchedInRound == 0 {
+					// woken up without any task to dispatch, e.g. another dispatcher took the task notified
+					w.getMetricsScope().IncCounter(metrics.PriorityTaskSpuriousWakeup)
+				}
+				break
+			}
+			atomic.StoreInt32(state, dispatcherStateSubmitting)
+			w.dispatchTask(task, polledTask)
+			atomic.StoreInt32(state, dispatcherStateDispatching)
+			if atomic.LoadInt32(&w.processorRefused) == 1 {
+				// the retried task would be polled again right away, wait for
+				// processor capacity first, the retry has notified dispatchers
+				w.getMetricsScope().RecordTimer(metrics.PriorityTaskDispatcherBusyTime, time.Since(busyStartTime))
+				break
+			}
+
+			numDispatched++
+			if w.options.DispatchYieldEvery > 0 && numDispatched >= w.options.DispatchYieldEvery {
+				numDispatched = 0
+				runtime.Gosched()
+			}
+			numDispatchedInRound++
+			if w.options.MaxTasksPerRound > 0 && numDispatchedInRound >= w.options.MaxTasksPerRound {
+				// there may be more tasks queued, notify so that the dispatcher
+				// continues after re-checking shutdown at the top of the loop
+				w.getMetricsScope().RecordTimer(metrics.PriorityTaskDispatcherBusyTime, time.Since(busyStartTime))
+				w.notifyDispatcher()
+				break
+			}
+		}
+	}
+}
+
+// awaitProcessorCapacity waits up to ProcessorCapacityWait for room in the processor
+// buffer if a task retried by DispatchErrorActionRetry is refused by the processor
+func (w *weightedRoundRobinTaskSchedulerImpl) awaitProcessorCapacity() {
+	if !atomic.CompareAndSwapInt32(&w.processorRefused, 1, 0) {
+		return
+	}
+
+	reporter, _ := w.processor.(bufferReporter)
+	ticker := time.NewTicker(processorCapacityInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(w.options.ProcessorCapacityWait)
+	defer timer.Stop()
+	for reporter == nil || reporter.bufferOccupancy() >= 1 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return
+		case <-w.shutdownCh:
+			return
+		}
+	}
+}
+
+// registerDispatcher returns the state updated by a new dispatcher
+func (w *weightedRoundRobinTaskSchedulerImpl) registerDispatcher() *int32 {
+	state := new(int32)
+	w.Lock()
+	w.dispatcherStates = append(w.dispatcherStates, state)
+	w.Unlock()
+	return state
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) dispatchTask(
+	task PriorityTask,
+	polledTask polledTaskInfo,
+) {
+	// the task may be processed concurrently once submitted, so its priority is read beforehand
+	priority := NoPriority
+	if w.eventRecorder != nil {
+		priority = task.Priority()
+	}
+
+	observer := getDispatchObserver(task)
+	if observer != nil {
+		observer.beforeDispatch()
+	}
+	// measures how long the dispatcher is blocked by the processor,
+	// which is not specific to the task, so the metric is not tagged
+	submitStartTime := time.Now()
+	var err error
+	if w.allowDependency(task) {
+		err = w.submitToProcessor(w.wrapEndToEndTask(task, polledTask.priority, polledTask.enqueueTime))
+		w.trackProcessorFailure(err)
+	} else {
+		err = ErrCircuitBreakerOpen
+		w.incTaskCounter(metrics.PriorityTaskCircuitBreakerRejected, task, polledTask.priority)
+	}
+	recordLatency(w.getMetricsScope(), metrics.PriorityTaskProcessorSubmitLatency, submitStartTime)
+	if observer != nil {
+		observer.afterDispatch(err)
+	}
+
+	if err == nil {
+		w.eventRecorder.record(EventTypeDispatch, priority, nil)
+		return
+	}
+
+	w.eventRecorder.record(EventTypeDispatchError, priority, err)
+	if limitedTask, ok := task.(*concurrencyLimitedTask); ok {
+		// the task is no longer in-flight, the handler should see the original task
+		limitedTask.release()
+		task = limitedTask.PriorityTask
+	}
+	w.handleDispatchError(task, &DispatchError{
+		Err:         err,
+		Priority:    polledTask.priority,
+		EnqueueTime: polledTask.enqueueTime,
+	})
+}
+
+// submitToProcessor submits the task to the processor, emitting PriorityTaskProcessorQueueFull when the
+// dispatcher is blocked as the processor buffer is full, and the buffer occupancy once the task is submitted.
+// A full processor buffer means workers are too slow, rather than producers too fast
+func (w *weightedRoundRobinTaskSchedulerImpl) submitToProcessor(
+	task PriorityTask,
+) error {
+	reporter, ok := w.processor.(bufferReporter)
+	if !ok {
+		return w.processor.Submit(task)
+	}
+
+	metricsScope := w.getMetricsScope()
+	err := reporter.submitReportingBlocked(task, func() {
+		metricsScope.IncCounter(metrics.PriorityTaskProcessorQueueFull)
+	})
+	metricsScope.UpdateGauge(metrics.PriorityTaskProcessorQueueOccupancy, reporter.bufferOccupancy())
+	return err
+}
+
+// nextTask returns the next task to dispatch along with the queue it's polled from
+func (w *weightedRoundRobinTaskSchedulerImpl) nextTask() (PriorityTask, polledTaskInfo, bool) {
+	w.RLock()
+	taskQueues := w.queueList
+	queues := w.dispatchQueueList
+	idleOnlyQueues := w.idleOnlyQueueList
+	w.RUnlock()
+
+	w.dispatchLock.Lock()
+	w.dispatchDenied = false
+	w.polledTask = polledTaskInfo{}
+	task, ok := w.nextOverdueTaskLocked(taskQueues, queues)
+	dispatchQueues := queues
+	if !ok {
+		dispatchQueues = w.mergeDynamicPriorityTaskLocked(queues)
+		w.preemptRoundLocked()
+		task, ok = w.dispatchStrategy.Next(dispatchQueues)
+		w.updateRoundPriorityLocked(ok)
+	}
+	if !ok && !w.dispatchDenied {
+		task, ok = w.nextZeroWeightTaskLocked(dispatchQueues)
+	}
+	idleOnly, idleOnlyPending := false, false
+	// tasks denied by the dispatch limiter are still pending work
+	if !ok && !w.dispatchDenied && len(idleOnlyQueues) != 0 {
+		task, idleOnly, idleOnlyPending = w.nextIdleOnlyTaskLocked(idleOnlyQueues)
+		ok = idleOnly
+	}
+	idleOnlyDispatchTime := w.updateIdleOnlyDispatchLocked(idleOnly)
+	polledTask := w.polledTask
+	if ok && !idleOnly && w.driftDispatched != nil {
+		w.driftDispatched[polledTask.priority]++
+	}
+	agedOutTasks := w.agedOutTasks
+	w.agedOutTasks = nil
+	dispatchDenied := w.dispatchDenied
+	w.dispatchLock.Unlock()
+
+	if idleOnlyDispatchTime > 0 {
+		w.getMetricsScope().RecordTimer(metrics.PriorityTaskIdleOnlyDispatchTime, idleOnlyDispatchTime)
+	}
+	// workers becoming idle don't notify dispatchers, so
+	// idle-only tasks are reconsidered after an interval
+	if !ok && (dispatchDenied || idleOnlyPending) {
+		w.scheduleDispatchRetry()
+	}
+	if ok && w.options.PriorityInversionQueueDepth > 0 {
+		w.detectPriorityInversion(queues, task)
+	}
+	if ok {
+		w.priorityActivity.dispatched(polledTask.priority)
+		w.checkWaitSLA(polledTask)
+	}
+
+	// nack outside the dispatch lock so that other dispatchers are not blocked
+	for _, agedOutTask := range agedOutTasks {
+		priority := agedOutTask.Priority()
+		w.incTaskCounter(metrics.PriorityTaskAgedOut, agedOutTask, priority)
+		w.eventRecorder.record(EventTypeDrop, priority, nil)
+		agedOutTask.Nack()
+	}
+	return task, polledTask, ok
+}
+
+// nextOverdueTaskLocked polls the queue whose oldest task exceeds MaxWaitSLA by the largest fraction, ahead
+// of the dispatch strategy. taskQueues are the queues of all priorities, while only the dispatch queues are polled
+func (w *weightedRoundRobinTaskSchedulerImpl) nextOverdueTaskLocked(
+	taskQueues []TaskQueue,
+	dispatchQueues []TaskQueue,
+) (PriorityTask, bool) {
+	if len(w.options.MaxWaitSLA) == 0 {
+		return nil, false
+	}
+
+	type overdueQueue struct {
+		queue TaskQueue
+		// ratio is the wait time of the oldest task over the SLA
+		ratio float64
+	}
+	now := time.Now()
+	var overdue []overdueQueue
+	for _, queue := range taskQueues {
+		sla := w.maxWaitSLA(queue.Priority())
+		if sla <= 0 {
+			continue
+		}
+		enqueueTime, ok := queue.(*taskQueueImpl).HeadEnqueueTime()
+		if !ok || now.Sub(enqueueTime) <= sla {
+			continue
+		}
+		for _, dispatchQueue := range dispatchQueues {
+			if dispatchQueue.Priority() == queue.Priority() {
+				overdue = append(overdue, overdueQueue{
+					queue: dispatchQueue,
+					ratio: float64(now.Sub(enqueueTime)) / float64(sla),
+				})
+				break
+			}
+		}
+	}
+	if len(overdue) == 0 {
+		return nil, false
+	}
+
+	sort.SliceStable(overdue, func(i, j int) bool {
+		return overdue[i].ratio > overdue[j].ratio
+	})
+	// overdue queues may be held back, e.g. by their concurrency limit
+	for _, entry := range overdue {
+		if task, ok := entry.queue.Poll(); ok {
+			return task, true
+		}
+	}
+	return nil, false
+}
+
+// checkWaitSLA emits PriorityTaskSLAViolation if the polled task has waited longer than its MaxWaitSLA
+func (w *weightedRoundRobinTaskSchedulerImpl) checkWaitSLA(
+	polledTask polledTaskInfo,
+) {
+	sla := w.maxWaitSLA(polledTask.priority)
+	if sla <= 0 || polledTask.enqueueTime.IsZero() || time.Since(polledTask.enqueueTime) <= sla {
+		return
+	}
+	w.incPriorityCounter(metrics.PriorityTaskSLAViolation, polledTask.priority)
+}
+
+// maxConcurrency returns the MaxConcurrencyByPriority limit of the priority, zero if it's not limited
+func maxConcurrency(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+	priority int,
+) int {
+	if priority < 0 || priority >= len(options.MaxConcurrencyByPriority) {
+		return 0
+	}
+	return options.MaxConcurrencyByPriority[priority]
+}
+
+// hasMaxConcurrency returns true if MaxConcurrencyByPriority limits any priority
+func hasMaxConcurrency(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) bool {
+	for _, limit := range options.MaxConcurrencyByPriority {
+		if limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) maxWaitSLA(
+	priority int,
+) time.Duration {
+	if priority < 0 || priority >= len(w.options.MaxWaitSLA) {
+		return 0
+	}
+	return w.options.MaxWaitSLA[priority]
+}
+
+// preemptRoundLocked aborts the round of the WRR dispatch strategy if a task
+// is submitted to a queue scanned before the queue currently dispatched from
+func (w *weightedRoundRobinTaskSchedulerImpl) preemptRoundLocked() {
+	if w.highPriorityCh == nil {
+		return
+	}
+	select {
+	case <-w.highPriorityCh:
+	default:
+		return
+	}
+	strategy, ok := w.dispatchStrategy.(*WeightedRoundRobinDispatchStrategy)
+	if ok && strategy.abortRound() {
+		w.getMetricsScope().IncCounter(metrics.PriorityTaskRoundPreempted)
+	}
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) updateRoundPriorityLocked(
+	dispatched bool,
+) {
+	if w.highPriorityCh == nil {
+		return
+	}
+	if !dispatched {
+		atomic.StoreInt64(&w.roundPriority, noRoundPriority)
+		return
+	}
+	atomic.StoreInt64(&w.roundPriority, int64(w.polledTask.priority))
+}
+
+// signalHighPriority signals the dispatchers to abort the current round if the task just
+// submitted with the priority is scanned before the task last dispatched. It must only be
+// called after the task is enqueued, so that the new round observes the task
+func (w *weightedRoundRobinTaskSchedulerImpl) signalHighPriority(
+	priority int,
+) {
+	if w.highPriorityCh == nil {
+		return
+	}
+	roundPriority := atomic.LoadInt64(&w.roundPriority)
+	if roundPriority == noRoundPriority || !w.scansBefore(priority, int(roundPriority)) {
+		return
+	}
+	select {
+	case w.highPriorityCh <- struct{}{}:
+	default:
+	}
+}
+
+// mergeDynamicPriorityTaskLocked returns the queues with the held DynamicPriorityTask of the highest current
+// priority exposed at the head of the queue of that priority, the given queues are returned if there's none
+func (w *weightedRoundRobinTaskSchedulerImpl) mergeDynamicPriorityTaskLocked(
+	queues []TaskQueue,
+) []TaskQueue {
+	if w.dynamicTasks == nil {
+		return queues
+	}
+	entry, ok := w.dynamicTasks.peek()
+	if !ok {
+		return queues
+	}
+
+	idx := -1
+	for i, queue := range queues {
+		if queue.Priority() == entry.priority {
+			idx = i
+			break
+		}
+		if queue.Priority() == entry.submittedPriority {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return queues
+	}
+	mergedQueues := append([]TaskQueue(nil), queues...)
+	mergedQueues[idx] = &dynamicPriorityView{
+		TaskQueue: queues[idx],
+		queue:     w.dynamicTasks,
+		entry:     entry,
+		onPoll:    w.setPolledTask,
+	}
+	return mergedQueues
+}
+
+// getDynamicPriorityTask returns the task as a DynamicPriorityTask if its priority should be resolved at dispatch time
+func (w *weightedRoundRobinTaskSchedulerImpl) getDynamicPriorityTask(
+	task PriorityTask,
+) (DynamicPriorityTask, bool) {
+	if w.dynamicTasks == nil {
+		return nil, false
+	}
+	dynamicTask, ok := unwrapSchedulerTask(task).(DynamicPriorityTask)
+	return dynamicTask, ok
+}
+
+// wrapEndToEndTask returns the task to submit to the processor, which is wrapped to record the
+// end to end latency if EndToEndLatency is specified. Requeued tasks keep their first queue time
+func (w *weightedRoundRobinTaskSchedulerImpl) wrapEndToEndTask(
+	task PriorityTask,
+	priority int,
+	queueTime time.Time,
+) PriorityTask {
+	if !w.options.EndToEndLatency {
+		return task
+	}
+	requeued := task
+	if limitedTask, ok := requeued.(*concurrencyLimitedTask); ok {
+		requeued = limitedTask.PriorityTask
+	}
+	if requeued, ok := requeued.(*requeuedTask); ok && !requeued.queueTime.IsZero() {
+		queueTime = requeued.queueTime
+	}
+	if queueTime.IsZero() {
+		queueTime = time.Now()
+	}
+	return newEndToEndTask(task, w, priority, queueTime)
+}
+
+// nextZeroWeightTaskLocked polls the first task of the priorities with a zero weight, which
+// the dispatch strategy never dispatches, once no task of other priorities can be dispatched
+func (w *weightedRoundRobinTaskSchedulerImpl) nextZeroWeightTaskLocked(
+	queues []TaskQueue,
+) (PriorityTask, bool) {
+	weights := w.getWeights()
+	for _, queue := range queues {
+		if weight, ok := weights[queue.Priority()]; !ok || weight != 0 {
+			continue
+		}
+		if task, ok := queue.Poll(); ok {
+			return task, true
+		}
+	}
+	return nil, false
+}
+
+// nextIdleOnlyTaskLocked polls the first idle-only task if the processor has idle workers, the
+// second returned value tells if a task is polled, the third tells if idle-only tasks are pending
+func (w *weightedRoundRobinTaskSchedulerImpl) nextIdleOnlyTaskLocked(
+	idleOnlyQueues []TaskQueue,
+) (PriorityTask, bool, bool) {
+	pending := false
+	for _, queue := range idleOnlyQueues {
+		if queue.Len() != 0 {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		return nil, false, false
+	}
+
+	processor, ok := w.processor.(ParallelTaskProcessor)
+	if !ok {
+		return nil, false, true
+	}
+	stats := processor.Stats()
+	if stats.LiveWorkers-stats.BusyWorkers <= stats.QueuedTasks {
+		return nil, false, true
+	}
+
+	for _, queue := range idleOnlyQueues {
+		if task, ok := queue.Poll(); ok {
+			return task, true, true
+		}
+	}
+	// tasks may be held back by wrapped queues, e.g. for the concurrency limit
+	return nil, false, true
+}
+
+// updateIdleOnlyDispatchLocked tracks the period during which idle-only tasks are dispatched, returns the
+// length of the period when it ends, i.e. when a dispatcher finds no idle-only task to dispatch
+func (w *weightedRoundRobinTaskSchedulerImpl) updateIdleOnlyDispatchLocked(
+	idleOnly bool,
+) time.Duration {
+	if idleOnly {
+		if w.idleOnlyDispatchStartTime.IsZero() {
+			w.idleOnlyDispatchStartTime = time.Now()
+		}
+		return 0
+	}
+	if w.idleOnlyDispatchStartTime.IsZero() {
+		return 0
+	}
+	idleOnlyDispatchTime := time.Since(w.idleOnlyDispatchStartTime)
+	w.idleOnlyDispatchStartTime = time.Time{}
+	return idleOnlyDispatchTime
+}
+
+// detectPriorityInversion emits a metric for each higher priority with
+// tasks waiting when the given task is dispatched
+func (w *weightedRoundRobinTaskSchedulerImpl) detectPriorityInversion(
+	queues []TaskQueue,
+	task PriorityTask,
+) {
+	priority := task.Priority()
+	for _, queue := range queues {
+		// queues are sorted by the scan order of priorities
+		if !w.scansBefore(queue.Priority(), priority) {
+			return
+		}
+		if queue.Len() >= w.options.PriorityInversionQueueDepth {
+			w.incPriorityCounter(metrics.PriorityTaskInversion, priority, metrics.WaitingTaskPriorityTag(queue.Priority()))
+		}
+	}
+}
+
+// requeueRetry puts the task back to the tail of its queue for retry,
+// the task is dispatched again like newly submitted tasks
+func (w *weightedRoundRobinTaskSchedulerImpl) requeueRetry(
+	task PriorityTask,
+	retries int,
+	firstAttemptTime time.Time,
+) bool {
+	return w.requeueTask(task, retries, firstAttemptTime, true)
+}
+
+// requeueYielded puts the task yielding its worker back to the tail of its queue, unlike
+// requeueRetry the task is neither delayed nor counted towards MaxResubmits
+func (w *weightedRoundRobinTaskSchedulerImpl) requeueYielded(
+	task PriorityTask,
+	retries int,
+	firstAttemptTime time.Time,
+) bool {
+	return w.requeueTask(task, retries, firstAttemptTime, false)
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) requeueTask(
+	task PriorityTask,
+	retries int,
+	firstAttemptTime time.Time,
+	retry bool,
+) bool {
+	if w.isStopped() {
+		return false
+	}
+	w.RLock()
+	taskQueue, ok := w.taskQueues[task.Priority()]
+	w.RUnlock()
+	if !ok {
+		return false
+	}
+
+	timedTask, task := unwrapEndToEndTask(task)
+	// the concurrency slot held by the task is released once the task is requeued
+	limitedTask, isLimited := task.(*concurrencyLimitedTask)
+	if isLimited {
+		task = limitedTask.PriorityTask
+	}
+	requeued, ok := task.(*requeuedTask)
+	if !ok {
+		requeued = &requeuedTask{taskWrapper: taskWrapper{PriorityTask: task}}
+	}
+	requeued.retries = retries
+	requeued.firstAttemptTime = firstAttemptTime
+	if timedTask != nil {
+		requeued.queueTime = timedTask.queueTime
+	}
+
+	// yielded tasks are not delayed as they didn't fail
+	delay := time.Duration(0)
+	if retry {
+		delay = w.retryRequeueDelay(requeued, retries, firstAttemptTime)
+	}
+	// never block here as the dispatchers may be waiting for the worker
+	if delay > 0 {
+		if !taskQueue.Reserve(1) {
+			return false
+		}
+		if !w.delayedRetries.add(requeued, delay, func(task *requeuedTask) {
+			w.commitDelayedRetry(taskQueue, task)
+		}) {
+			taskQueue.Unreserve(1)
+			return false
+		}
+	} else if !taskQueue.Offer(requeued) {
+		return false
+	}
+	if retry {
+		requeued.requeues++
+	}
+	if isLimited {
+		limitedTask.release()
+	}
+	w.notifyDispatcher()
+	return true
+}
+
+// retryRequeueDelay returns how long the requeued task is held before it's queued, zero if it's queued
+// at once. retries is the number of attempts so far, which indexes the next backoff interval from zero
+func (w *weightedRoundRobinTaskSchedulerImpl) retryRequeueDelay(
+	task PriorityTask,
+	retries int,
+	firstAttemptTime time.Time,
+) time.Duration {
+	if w.delayedRetries == nil {
+		return 0
+	}
+	// the retry policy is exhausted if the delay is negative, which is handled by the processor
+	retryPolicy := taskRetryPolicy(task, w.options.RetryPolicy)
+	return retryPolicy.ComputeNextDelay(time.Since(firstAttemptTime), retries-1)
+}
+
+// commitDelayedRetry queues the task held by delayedRetries using the slot reserved for it
+func (w *weightedRoundRobinTaskSchedulerImpl) commitDelayedRetry(
+	taskQueue *taskQueueImpl,
+	task *requeuedTask,
+) {
+	if !taskQueue.CommitReserved(task) {
+		// queues are only closed after delayedRetries, unless removed by RemapPriorities
+		w.logger.Warn("Weighted round robin task scheduler failed to queue a delayed retry.", tag.TaskPriority(taskQueue.Priority()))
+		task.Nack()
+		return
+	}
+	w.notifyDispatcher()
+}
+
+// onTaskExhausted puts the exhausted task into its dead letter queue, or hands it to OnTaskExhausted,
+// after releasing and unwrapping the wrappers added by the scheduler
+func (w *weightedRoundRobinTaskSchedulerImpl) onTaskExhausted(
+	task Task,
+	err error,
+) {
+	timedTask, priorityTask := unwrapEndToEndTask(task.(PriorityTask))
+	if timedTask != nil {
+		timedTask.record(taskOutcomeExhausted)
+	}
+	if limitedTask, ok := priorityTask.(*concurrencyLimitedTask); ok {
+		limitedTask.release()
+		priorityTask = limitedTask.PriorityTask
+	}
+	if requeued, ok := priorityTask.(*requeuedTask); ok {
+		priorityTask = requeued.PriorityTask
+	}
+
+	if w.addDeadLetter(priorityTask) {
+		return
+	}
+	if w.options.OnTaskExhausted != nil {
+		w.options.OnTaskExhausted(priorityTask, err)
+		return
+	}
+	priorityTask.Nack()
+}
+
+// addDeadLetter puts the task into the dead letter queue of its priority,
+// returns false if the priority has no dead letter queue or it's full
+func (w *weightedRoundRobinTaskSchedulerImpl) addDeadLetter(
+	task PriorityTask,
+) bool {
+	priority := task.Priority()
+	deadLetterQueue, ok := w.deadLetterQueues[priority]
+	if !ok {
+		return false
+	}
+
+	for !deadLetterQueue.Offer(task) {
+		if w.options.DeadLetterOverflowPolicy != DeadLetterOverflowPolicyDropOldest {
+			w.incTaskCounter(metrics.PriorityTaskDeadLetterDropped, task, priority)
+			return false
+		}
+		if oldestTask, ok := deadLetterQueue.Poll(); ok {
+			w.incTaskCounter(metrics.PriorityTaskDeadLetterDropped, oldestTask, priority)
+			oldestTask.Nack()
+		}
+	}
+	w.incTaskCounter(metrics.PriorityTaskDeadLettered, task, priority)
+	return true
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) DeadLetterQueue(
+	priority int,
+) []PriorityTask {
+	deadLetterQueue, ok := w.deadLetterQueues[priority]
+	if !ok {
+		return nil
+	}
+
+	var tasks []PriorityTask
+	for {
+		task, ok := deadLetterQueue.Poll()
+		if !ok {
+			return tasks
+		}
+		tasks = append(tasks, task)
+	}
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Reprioritize(
+	predicate func(PriorityTask) bool,
+	newPriority int,
+) (int, error) {
+	if w.isStopped() {
+		return 0, ErrTaskSchedulerClosed
+	}
+	targetQueue, err := w.getOrCreateTaskQueue(newPriority)
+	if err != nil {
+		return 0, err
+	}
+
+	w.RLock()
+	queues := w.queueList
+	w.RUnlock()
+
+	// holding the dispatch lock so that no task is polled while being moved
+	w.dispatchLock.Lock()
+	numMoved := 0
+	for _, queue := range queues {
+		taskQueue := queue.(*taskQueueImpl)
+		if taskQueue == targetQueue {
+			continue
+		}
+		numMoved += taskQueue.MoveTo(targetQueue, predicate, func(task PriorityTask) PriorityTask {
+			task.SetPriority(newPriority)
+			return w.snapshotPriority(task, newPriority)
+		})
+	}
+	w.dispatchLock.Unlock()
+
+	if numMoved != 0 {
+		w.notifyDispatcher()
+	}
+	return numMoved, nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) EvictOlderThan(
+	cutoff time.Time,
+) int {
+	w.RLock()
+	queues := w.queueList
+	w.RUnlock()
+
+	// holding the dispatch lock so that no task is polled while being evicted
+	w.dispatchLock.Lock()
+	var evicted []PriorityTask
+	for _, queue := range queues {
+		evicted = append(evicted, queue.(*taskQueueImpl).RemoveExpired(cutoff)...)
+	}
+	w.dispatchLock.Unlock()
+
+	// nack outside the dispatch lock so that dispatchers are not blocked
+	for _, task := range evicted {
+		priority := task.Priority()
+		w.incTaskCounter(metrics.PriorityTaskEvicted, task, priority)
+		w.eventRecorder.record(EventTypeDrop, priority, nil)
+		task.Nack()
+	}
+	if len(evicted) != 0 {
+		w.logger.Info("Evicted queued tasks.", tag.Counter(len(evicted)))
+	}
+	return len(evicted)
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) RemapPriorities(
+	weights map[int]int,
+	remap func(priority int) int,
+) error {
+	if w.isStopped() {
+		return ErrTaskSchedulerClosed
+	}
+	if err := validateWeightValues(weights, w.options.AllowManyPriorities); err != nil {
+		return err
+	}
+
+	// holding the dispatch lock so that no task is polled while being moved
+	w.dispatchLock.Lock()
+	defer w.dispatchLock.Unlock()
+
+	// the weights are replaced with the lock held, so that no queue
+	// of the old priorities can be created once they're remapped
+	w.Lock()
+	queues := w.queueList
+	targets := make(map[int]int, len(queues))
+	for _, queue := range queues {
+		priority := queue.Priority()
+		target := remap(priority)
+		if _, ok := weights[target]; !ok {
+			w.Unlock()
+			return fmt.Errorf("weight for priority %v is not specified, which priority %v is remapped to", target, priority)
+		}
+		targets[priority] = target
+	}
+	w.storeWeights(copyWeights(weights))
+	removed := w.removeTaskQueuesLocked(weights)
+	w.Unlock()
+
+	// tasks are staged by their new priority first, so that tasks moved
+	// to a queue which is remapped as well are not moved again
+	stagingQueues := make(map[int]*taskQueueImpl)
+	var stagingOrder []int
+	wrap := func(target int) func(PriorityTask) PriorityTask {
+		return func(task PriorityTask) PriorityTask {
+			task.SetPriority(target)
+			return w.snapshotPriority(task, target)
+		}
+	}
+	stagingSizes := make(map[int]int)
+	for _, queue := range queues {
+		if target := targets[queue.Priority()]; target != queue.Priority() {
+			if _, ok := stagingSizes[target]; !ok {
+				stagingOrder = append(stagingOrder, target)
+			}
+			stagingSizes[target] += queue.(*taskQueueImpl).Cap()
+		}
+	}
+	for _, target := range stagingOrder {
+		stagingQueues[target] = newTaskQueue(target, stagingSizes[target])
+	}
+	for _, queue := range queues {
+		if target := targets[queue.Priority()]; target != queue.Priority() {
+			queue.(*taskQueueImpl).MoveTo(stagingQueues[target], func(PriorityTask) bool { return true }, wrap(target))
+		}
+	}
+
+	numMoved := 0
+	var droppedTasks []PriorityTask
+	for _, target := range stagingOrder {
+		stagingQueue := stagingQueues[target]
+		targetQueue, err := w.getOrCreateTaskQueue(target)
+		if err == nil {
+			numMoved += stagingQueue.MoveTo(targetQueue, func(PriorityTask) bool { return true }, func(task PriorityTask) PriorityTask {
+				return w.snapshotPriority(task, target)
+			})
+		}
+		// the priority may be removed by dynamic config concurrently
+		droppedTasks = append(droppedTasks, stagingQueue.Close()...)
+	}
+	for _, queue := range queues {
+		taskQueue := queue.(*taskQueueImpl)
+		if _, ok := removed[taskQueue.Priority()]; !ok {
+			continue
+		}
+		// tasks added to the removed queue while being moved lose their enqueue time
+		target := targets[taskQueue.Priority()]
+		targetQueue, err := w.getOrCreateTaskQueue(target)
+		for _, task := range taskQueue.Close() {
+			task = unwrapPrioritySnapshot(task)
+			if err == nil && targetQueue.Offer(wrap(target)(task)) {
+				numMoved++
+			} else {
+				droppedTasks = append(droppedTasks, task)
+			}
+		}
+	}
+
+	if numMoved != 0 {
+		w.notifyDispatcher()
+	}
+	if len(droppedTasks) != 0 {
+		w.logger.Warn("Weighted round robin task scheduler nacked tasks not fitting into remapped priorities.", tag.Counter(len(droppedTasks)))
+		for _, task := range droppedTasks {
+			w.eventRecorder.record(EventTypeDrop, task.Priority(), nil)
+		}
+		nackTasks(droppedTasks)
+	}
+	w.logger.Info("Weighted round robin task scheduler remapped priorities.", tag.Counter(numMoved))
+	return nil
+}
+
+// removeTaskQueuesLocked removes the queues of the priorities without a weight
+// and returns the removed priorities, the caller must hold the lock
+func (w *weightedRoundRobinTaskSchedulerImpl) removeTaskQueuesLocked(
+	weights map[int]int,
+) map[int]struct{} {
+	removed := make(map[int]struct{})
+	for priority := range w.taskQueues {
+		if _, ok := weights[priority]; !ok {
+			removed[priority] = struct{}{}
+		}
+	}
+	if len(removed) == 0 {
+		return removed
+	}
+
+	for priority := range removed {
+		delete(w.taskQueues, priority)
+		if w.concurrencyIntegrators != nil {
+			delete(w.concurrencyIntegrators, priority)
+		}
+		if w.capacityPool != nil {
+			w.capacityPool.remove(priority)
+		}
+		if w.executionShare != nil {
+			w.executionShare.remove(priority)
+		}
+	}
+	w.queueList = removeTaskQueues(w.queueList, removed)
+	w.dispatchQueueList = removeTaskQueues(w.dispatchQueueList, removed)
+	w.idleOnlyQueueList = removeTaskQueues(w.idleOnlyQueueList, removed)
+	return removed
+}
+
+// removeTaskQueues returns a new list without the queues of the priorities,
+// a new list is needed as dispatchers may be iterating the current one
+func removeTaskQueues(
+	queues []TaskQueue,
+	priorities map[int]struct{},
+) []TaskQueue {
+	newQueues := make([]TaskQueue, 0, len(queues))
+	for _, queue := range queues {
+		if _, ok := priorities[queue.Priority()]; !ok {
+			newQueues = append(newQueues, queue)
+		}
+	}
+	return newQueues
+}
+
+// allowDependency returns false if the task is a DependentTask
+// and the circuit breaker of its dependency is open
+func (w *weightedRoundRobinTaskSchedulerImpl) allowDependency(
+	task PriorityTask,
+) bool {
+	if w.circuitBreakers == nil {
+		return true
+	}
+	dependency, ok := getTaskDependency(task)
+	return !ok || w.circuitBreakers.allow(dependency)
+}
+
+// onTaskAttempt is invoked by the processor after each execution of a task
+func (w *weightedRoundRobinTaskSchedulerImpl) onTaskAttempt(
+	task Task,
+	err error,
+) {
+	if dependency, ok := getTaskDependency(task); ok {
+		w.circuitBreakers.record(dependency, err == nil)
+	}
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) onCircuitBreakerStateChange(
+	dependency string,
+	open bool,
+) {
+	value := float64(0)
+	if open {
+		value = 1
+		w.logger.Warn("Circuit breaker of task dependency opened.", tag.Value(dependency))
+	} else {
+		w.logger.Info("Circuit breaker of task dependency closed.", tag.Value(dependency))
+		// the retries of tasks failed during the outage shouldn't hit the dependency all at once
+		if starter, ok := w.processor.(retrySlowStarter); ok {
+			starter.restartRetrySlowStart()
+		}
+	}
+	w.getMetricsScope().Tagged(metrics.TaskDependencyTag(dependency)).UpdateGauge(metrics.PriorityTaskCircuitBreakerOpen, value)
+}
+
+// setDispatchDenied is invoked by dispatch limited
+// queues during polling, which holds the dispatch lock
+func (w *weightedRoundRobinTaskSchedulerImpl) setDispatchDenied() {
+	w.dispatchDenied = true
+}
+
+// scheduleDispatchRetry wakes up a dispatcher after dispatchLimiterRetryInterval,
+// so that tasks denied by the dispatch limiter are reconsidered even if no new task arrives
+func (w *weightedRoundRobinTaskSchedulerImpl) scheduleDispatchRetry() {
+	if !atomic.CompareAndSwapInt32(&w.dispatchRetryScheduled, 0, 1) {
+		return
+	}
+	time.AfterFunc(dispatchLimiterRetryInterval, func() {
+		atomic.StoreInt32(&w.dispatchRetryScheduled, 0)
+		w.notifyDispatcher()
+	})
+}
+
+// setPolledTask is invoked by task queues
+// during polling, which holds the dispatch lock
+func (w *weightedRoundRobinTaskSchedulerImpl) setPolledTask(
+	priority int,
+	enqueueTime time.Time,
+) {
+	w.polledTask = polledTaskInfo{
+		priority:    priority,
+		enqueueTime: enqueueTime,
+	}
+}
+
+// onQueueThresholdCrossed is invoked by task queues when the
+// queue depth crosses one of the QueueDepthThresholds
+func (w *weightedRoundRobinTaskSchedulerImpl) onQueueThresholdCrossed(
+	priority int,
+	threshold float64,
+	upward bool,
+) {
+	metric := metrics.PriorityTaskQueueThresholdCrossed
+	if !upward {
+		metric = metrics.PriorityTaskQueueThresholdRecovered
+	}
+	w.incPriorityCounter(metric, priority, metrics.QueueThresholdTag(threshold))
+}
+
+// addAgedOutTask is invoked by aging queues
+// during polling, which holds the dispatch lock
+func (w *weightedRoundRobinTaskSchedulerImpl) addAgedOutTask(
+	task PriorityTask,
+) {
+	w.agedOutTasks = append(w.agedOutTasks, task)
+}
+
+// checkSubmittable returns the error for submitting tasks if the scheduler is stopped,
+// or it's not started yet and AllowSubmitBeforeStart is not specified
+func (w *weightedRoundRobinTaskSchedulerImpl) checkSubmittable() error {
+	if w.isStopped() || atomic.LoadInt32(&w.shuttingDown) == 1 {
+		return ErrTaskSchedulerClosed
+	}
+	if !w.options.AllowSubmitBeforeStart && atomic.LoadInt32(&w.status) == common.DaemonStatusInitialized {
+		return ErrSchedulerNotStarted
+	}
+	if atomic.LoadInt32(&w.failed) == 1 {
+		return ErrSchedulerFailed
+	}
+	return nil
+}
+
+// trackProcessorFailure counts the consecutive tasks refused by the processor, and fails
+// the scheduler once MaxConsecutiveProcessorFailures is reached
+func (w *weightedRoundRobinTaskSchedulerImpl) trackProcessorFailure(
+	err error,
+) {
+	maxFailures := w.options.MaxConsecutiveProcessorFailures
+	if maxFailures <= 0 {
+		return
+	}
+	if err == nil {
+		atomic.StoreInt32(&w.processorFailures, 0)
+		return
+	}
+	// the processor is expected to refuse tasks once the scheduler is stopping
+	if w.isStopped() {
+		return
+	}
+	if atomic.AddInt32(&w.processorFailures, 1) < int32(maxFailures) ||
+		!atomic.CompareAndSwapInt32(&w.failed, 0, 1) {
+		return
+	}
+
+	w.getMetricsScope().IncCounter(metrics.PriorityTaskSchedulerFailed)
+	w.logger.Error(
+		"Weighted round robin task scheduler failed as the processor keeps refusing tasks.",
+		tag.Counter(maxFailures),
+		tag.Error(err),
+	)
+}
+
+// rejectTask emits PriorityTaskRejected tagged with the reason and invokes OnReject
+// validateSubmission returns the error of OnSubmit for the task, nil if OnSubmit is not specified
+func (w *weightedRoundRobinTaskSchedulerImpl) validateSubmission(
+	task PriorityTask,
+) error {
+	if w.options.OnSubmit == nil {
+		return nil
+	}
+	return w.options.OnSubmit(task)
+}
+
+// validateSubmissions validates all the tasks, which are all rejected if any of them fails the validation
+func (w *weightedRoundRobinTaskSchedulerImpl) validateSubmissions(
+	tasks []PriorityTask,
+) error {
+	if w.options.OnSubmit == nil {
+		return nil
+	}
+	for _, task := range tasks {
+		if err := w.options.OnSubmit(task); err != nil {
+			for _, task := range tasks {
+				w.rejectTask(task, task.Priority(), RejectReasonValidationFailed)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) rejectTask(
+	task PriorityTask,
+	priority int,
+	reason string,
+) {
+	w.incSubmitTaskCounter(metrics.PriorityTaskRejected, task, priority, metrics.RejectReasonTag(reason))
+	if w.options.OnReject != nil {
+		w.options.OnReject(task, reason)
+	}
+}
+
+// rejectReason returns the reject reason of the errors returned by checkSubmittable and putTask
+func rejectReason(err error) string {
+	switch err {
+	case ErrSchedulerNotStarted:
+		return RejectReasonNotStarted
+	case ErrTooManyBlockedSubmitters:
+		return RejectReasonTooManyBlockedSubmitters
+	case ErrSchedulerFailed:
+		return RejectReasonSchedulerFailed
+	case ErrPriorityRemoved:
+		return RejectReasonUnknownPriority
+	default:
+		return RejectReasonShutdown
+	}
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) isStopped() bool {
+	select {
+	case <-w.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Reconfigure(
+	options ReconfigureOptions,
+) error {
+	if options.Weights == nil && options.WorkerCount == 0 {
+		return errors.New("no change specified in the reconfigure options")
+	}
+	if options.WorkerCount < 0 {
+		return fmt.Errorf("invalid worker count: %v", options.WorkerCount)
+	}
+	if options.WorkerCount != 0 && w.options.SingleWorker {
+		return errors.New("worker count can't be updated for single worker scheduler")
+	}
+
+	var processor ParallelTaskProcessor
+	if options.WorkerCount != 0 {
+		var ok bool
+		if processor, ok = w.processor.(ParallelTaskProcessor); !ok {
+			return errors.New("processor does not support updating worker count")
+		}
+	}
+
+	w.dispatchLock.Lock()
+	defer w.dispatchLock.Unlock()
+
+	if options.Weights != nil {
+		if err := w.validateWeights(options.Weights); err != nil {
+			return err
+		}
+	}
+
+	if processor != nil {
+		if err := processor.SetWorkerCount(options.WorkerCount); err != nil {
+			return err
+		}
+		w.warmupCancelled = true
+	}
+	if options.Weights != nil {
+		w.storeWeights(copyWeights(options.Weights))
+	}
+
+	w.logger.Info("Weighted round robin task scheduler reconfigured.")
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) UpdateWeights(
+	weights []int,
+) error {
+	currentWeights := w.getWeights()
+	if len(weights) != len(currentWeights) {
+		return fmt.Errorf("invalid number of weights %v, expecting %v", len(weights), len(currentWeights))
+	}
+	for priority := range currentWeights {
+		if priority < 0 || priority >= len(currentWeights) {
+			return fmt.Errorf("weights can't be indexed by priority as priority %v is not in [0, %v), use Reconfigure instead", priority, len(currentWeights))
+		}
+	}
+	weightsByPriority := make(map[int]int, len(weights))
+	for priority, weight := range weights {
+		if weight <= 0 {
+			return fmt.Errorf("invalid weight %v for priority %v", weight, priority)
+		}
+		weightsByPriority[priority] = weight
+	}
+	return w.Reconfigure(ReconfigureOptions{Weights: weightsByPriority})
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) validateWeights(
+	weights map[int]int,
+) error {
+	if err := validateWeightValues(weights, w.options.AllowManyPriorities); err != nil {
+		return err
+	}
+
+	w.RLock()
+	defer w.RUnlock()
+	for priority := range w.taskQueues {
+		if _, ok := weights[priority]; !ok {
+			return fmt.Errorf("weight for priority %v is not specified, which has a task queue", priority)
+		}
+	}
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Drain(
+	ctx context.Context,
+) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	reportInterval := w.options.DrainProgressInterval
+	if reportInterval <= 0 {
+		reportInterval = defaultDrainProgressInterval
+	}
+	remaining, perPriority := w.DrainProgress()
+	if remaining == 0 {
+		return nil
+	}
+	w.reportDrainProgress(remaining, perPriority, 0)
+	lastReportTime := time.Now()
+	lastReportRemaining := remaining
+
+	for remaining != 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.shutdownCh:
+			return ErrTaskSchedulerClosed
+		}
+
+		remaining, perPriority = w.DrainProgress()
+		if now := time.Now(); remaining == 0 || now.Sub(lastReportTime) >= reportInterval {
+			w.reportDrainProgress(
+				remaining,
+				perPriority,
+				estimateDrainTime(lastReportRemaining, remaining, now.Sub(lastReportTime)),
+			)
+			lastReportTime = now
+			lastReportRemaining = remaining
+		}
+	}
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) DrainProgress() (int, []int) {
+	w.RLock()
+	defer w.RUnlock()
+
+	remaining := 0
+	var perPriority []int
+	for _, taskQueue := range w.queueList {
+		// queueList is sorted by priority, so the last queue has the highest priority
+		priority := taskQueue.Priority()
+		if perPriority == nil && priority >= 0 {
+			perPriority = make([]int, w.queueList[len(w.queueList)-1].Priority()+1)
+		}
+		numTasks := taskQueue.Len()
+		remaining += numTasks
+		if priority >= 0 {
+			perPriority[priority] = numTasks
+		}
+	}
+	if w.dynamicTasks != nil {
+		// the priorities of held tasks are not resolved until they're dispatched
+		remaining += w.dynamicTasks.len()
+	}
+	return remaining, perPriority
+}
+
+// reportDrainProgress logs and emits the drain progress, estimatedTime is zero if it can't be estimated
+func (w *weightedRoundRobinTaskSchedulerImpl) reportDrainProgress(
+	remaining int,
+	perPriority []int,
+	estimatedTime time.Duration,
+) {
+	for priority, numTasks := range perPriority {
+		w.getPriorityMetricsScope(priority).UpdateGauge(metrics.PriorityTaskDrainRemaining, float64(numTasks))
+	}
+	if remaining == 0 {
+		w.logger.Info("Weighted round robin task scheduler drained.")
+		return
+	}
+	if estimatedTime == 0 {
+		w.logger.Info("Weighted round robin task scheduler draining.",
+			tag.Counter(remaining), tag.TaskQueueDepths(perPriority))
+		return
+	}
+	w.getMetricsScope().UpdateGauge(metrics.PriorityTaskDrainEstimatedTime, estimatedTime.Seconds())
+	w.logger.Info("Weighted round robin task scheduler draining.",
+		tag.Counter(remaining), tag.TaskQueueDepths(perPriority), tag.DrainEstimatedTime(estimatedTime))
+}
+
+// estimateDrainTime extrapolates the time to drain the remaining tasks from the number of tasks drained
+// over the elapsed time, returns zero if no progress is made, e.g. when tasks arrive as fast as dispatched
+func estimateDrainTime(
+	previousRemaining int,
+	remaining int,
+	elapsed time.Duration,
+) time.Duration {
+	drained := previousRemaining - remaining
+	if drained <= 0 || remaining == 0 {
+		return 0
+	}
+	return time.Duration(int64(elapsed) / int64(drained) * int64(remaining))
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) SetQueueSize(
+	priority int,
+	size int,
+) error {
+	taskQueue, err := w.getOrCreateTaskQueue(priority)
+	if err != nil {
+		return err
+	}
+	if err := taskQueue.SetCapacity(size); err != nil {
+		return err
+	}
+
+	w.logger.Info("Weighted round robin task scheduler queue size updated.", tag.TaskPriority(priority), tag.TaskQueueSize(size))
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Stats() WeightedRoundRobinTaskSchedulerStats {
+	w.RLock()
+	queuedTasks := make(map[int]int, len(w.taskQueues))
+	for priority, taskQueue := range w.taskQueues {
+		queuedTasks[priority] = taskQueue.Len()
+	}
+	w.RUnlock()
+
+	stats := WeightedRoundRobinTaskSchedulerStats{
+		QueuedTasks: queuedTasks,
+	}
+	if w.dynamicTasks != nil {
+		stats.DynamicPriorityTasks = w.dynamicTasks.len()
+	}
+	stats.QueuedBytes = w.queuedBytes.load()
+	if processor, ok := w.processor.(ParallelTaskProcessor); ok {
+		stats.Processor = processor.Stats()
+	}
+	return stats
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) InFlightTasks() []InFlightTask {
+	if processor, ok := w.processor.(ParallelTaskProcessor); ok {
+		return processor.InFlightTasks()
+	}
+	return nil
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Peek(
+	priority int,
+	n int,
+) []PriorityTask {
+	w.RLock()
+	taskQueue, ok := w.taskQueues[priority]
+	w.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	tasks := taskQueue.PeekN(n)
+	for idx, task := range tasks {
+		tasks[idx] = unwrapSchedulerTask(task).(PriorityTask)
+	}
+	return tasks
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) DispatchDebugState() []PriorityDebugInfo {
+	w.RLock()
+	queues := w.queueList
+	w.RUnlock()
+
+	weights := w.getWeights()
+	strategy, _ := w.dispatchStrategy.(*WeightedRoundRobinDispatchStrategy)
+	debugInfos := make([]PriorityDebugInfo, 0, len(queues))
+	// no task is dispatched while the lock is held, so the queue depths are consistent with the round
+	w.dispatchLock.Lock()
+	for _, queue := range queues {
+		taskQueue := queue.(*taskQueueImpl)
+		debugInfo := PriorityDebugInfo{
+			Priority:     taskQueue.Priority(),
+			Weight:       weights[taskQueue.Priority()],
+			QueueDepth:   taskQueue.Len(),
+			LastServiced: taskQueue.LastPollTime(),
+		}
+		if strategy != nil {
+			debugInfo.DispatchedInRound = strategy.dispatchedInRound(debugInfo.Priority)
+		}
+		debugInfo.ShedProbability = w.shedProbability(taskQueue)
+		debugInfos = append(debugInfos, debugInfo)
+	}
+	w.dispatchLock.Unlock()
+	return debugInfos
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) RecentEvents() []SchedulerEvent {
+	return w.eventRecorder.recentEvents()
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Healthy() (bool, string) {
+	switch atomic.LoadInt32(&w.status) {
+	case common.DaemonStatusInitialized:
+		return false, "scheduler is not started"
+	case common.DaemonStatusStopped:
+		return false, "scheduler is stopped"
+	}
+	if w.isQuiesced() {
+		// dispatchers are not expected to make progress
+		return true, ""
+	}
+
+	stalenessWindow := w.options.HealthStalenessWindow
+	if stalenessWindow <= 0 {
+		stalenessWindow = defaultHealthStalenessWindow
+	}
+	sinceLastProgress := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastProgressTime)))
+	if sinceLastProgress <= stalenessWindow {
+		return true, ""
+	}
+	// idle dispatchers don't make progress, which is fine if there's nothing to dispatch
+	if numQueuedTasks := w.numQueuedTasks(); numQueuedTasks != 0 {
+		return false, fmt.Sprintf("no dispatch progress in %v with %v queued tasks", sinceLastProgress, numQueuedTasks)
+	}
+	return true, ""
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) DispatcherState() string {
+	w.RLock()
+	states := w.dispatcherStates
+	w.RUnlock()
+
+	state := dispatcherStateStopped
+	for _, dispatcherState := range states {
+		if current := atomic.LoadInt32(dispatcherState); current > state {
+			state = current
+		}
+	}
+	return dispatcherStateNames[state]
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Quiesce() {
+	if !atomic.CompareAndSwapInt32(&w.quiesced, 0, 1) {
+		return
+	}
+
+	w.getMetricsScope().UpdateGauge(metrics.PriorityTaskQuiesced, 1)
+	w.logger.Info("Weighted round robin task scheduler quiesced.")
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) Resume() {
+	if !atomic.CompareAndSwapInt32(&w.quiesced, 1, 0) {
+		return
+	}
+
+	// the time spent quiesced doesn't count against the health check
+	atomic.StoreInt64(&w.lastProgressTime, time.Now().UnixNano())
+	w.getMetricsScope().UpdateGauge(metrics.PriorityTaskQuiesced, 0)
+	w.notifyDispatcher()
+	w.logger.Info("Weighted round robin task scheduler resumed.")
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) isQuiesced() bool {
+	return atomic.LoadInt32(&w.quiesced) == 1
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) numQueuedTasks() int {
+	w.RLock()
+	defer w.RUnlock()
+
+	numTasks := 0
+	for _, taskQueue := range w.taskQueues {
+		numTasks += taskQueue.Len()
+	}
+	if w.dynamicTasks != nil {
+		numTasks += w.dynamicTasks.len()
+	}
+	return numTasks
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) handleDispatchError(
+	task PriorityTask,
+	err error,
+) {
+	if w.isStopped() && isProcessorClosedError(err) && w.addRefusedTask(task) {
+		// the processor is stopped before the dispatchers exit, which is not a failure of the task
+		w.logger.Debug("Processor is stopped before the task is submitted.")
+		return
+	}
+	w.logger.Error("fail to submit task to processor", appendCorrelationTag([]tag.Tag{tag.Error(err)}, task)...)
+
+	action := DispatchErrorActionNack
+	if w.options.OnDispatchError != nil {
+		action = w.options.OnDispatchError(task, err)
+	}
+
+	switch action {
+	case DispatchErrorActionDrop:
+		return
+	case DispatchErrorActionRetry:
+		w.RLock()
+		taskQueue, ok := w.taskQueues[task.Priority()]
+		w.RUnlock()
+		if ok && taskQueue.Offer(task) {
+			if w.options.ProcessorCapacityWait > 0 && !isCircuitBreakerOpenError(err) {
+				atomic.StoreInt32(&w.processorRefused, 1)
+			}
+			w.notifyDispatcher()
+			return
+		}
+		// queue is full, fallback to nack
+		task.Nack()
+	default:
+		task.Nack()
+	}
+}
+
+// addRefusedTask adds the task refused by the stopped processor to the tasks to drop, it returns
+// false if the queued tasks are already dropped, e.g. as Stop times out awaiting the dispatchers
+func (w *weightedRoundRobinTaskSchedulerImpl) addRefusedTask(
+	task PriorityTask,
+) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.refusedTasksDropped {
+		return false
+	}
+	w.refusedTasks = append(w.refusedTasks, task)
+	return true
+}
+
+func isCircuitBreakerOpenError(
+	err error,
+) bool {
+	if dispatchErr, ok := err.(*DispatchError); ok {
+		err = dispatchErr.Err
+	}
+	return err == ErrCircuitBreakerOpen
+}
+
+func isProcessorClosedError(
+	err error,
+) bool {
+	if dispatchErr, ok := err.(*DispatchError); ok {
+		err = dispatchErr.Err
+	}
+	return err == ErrTaskProcessorClosed
+}
+
+// taskPriority returns the priority of the task being submitted, which is decided by PriorityFunc if specified,
+// and clamped according to OutOfRangePolicy if the priority has no weight. SetPriority is called on the task if
+// the priority differs from the one declared by the task, unless the task is to be rejected
+func (w *weightedRoundRobinTaskSchedulerImpl) taskPriority(
+	task PriorityTask,
+) int {
+	declaredPriority := task.Priority()
+	priority := declaredPriority
+	if w.options.PriorityFunc != nil {
+		priority = w.options.PriorityFunc(task)
+	}
+	priority = w.clampPriority(priority)
+	if priority != declaredPriority {
+		// tasks to be rejected are left untouched
+		if _, ok := w.getWeights()[priority]; ok {
+			task.SetPriority(priority)
+		}
+	}
+	return priority
+}
+
+// clampPriority returns the priority clamped according to OutOfRangePolicy if the priority has no weight,
+// a priority without weight is returned as is if it should be rejected
+func (w *weightedRoundRobinTaskSchedulerImpl) clampPriority(
+	priority int,
+) int {
+	if w.options.OutOfRangePolicy == OutOfRangePolicyReject {
+		return priority
+	}
+
+	weights := w.getWeights()
+	if _, ok := weights[priority]; ok {
+		return priority
+	}
+	// weights are never empty
+	first := true
+	clampedPriority := priority
+	for weightedPriority := range weights {
+		if first ||
+			(w.options.OutOfRangePolicy == OutOfRangePolicyClampToLowest && weightedPriority > clampedPriority) ||
+			(w.options.OutOfRangePolicy == OutOfRangePolicyClampToHighest && weightedPriority < clampedPriority) {
+			clampedPriority = weightedPriority
+			first = false
+		}
+	}
+	return clampedPriority
+}
+
+// validateWeightValues validates the weights regardless of the queued tasks
+func validateWeightValues(
+	weights map[int]int,
+	allowManyPriorities bool,
+) error {
+	if len(weights) == 0 {
+		return errors.New("weight is not specified")
+	}
+	for priority, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("invalid weight %v for priority %v", weight, priority)
+		}
+	}
+	return validatePriorityCount(weights, allowManyPriorities)
+}
+
+// taskQueueSize returns the capacity of the task queue of the priority
+func taskQueueSize(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+	weights map[int]int,
+	priority int,
+) int {
+	if size, ok := options.QueueSizes[priority]; ok {
+		return size
+	}
+	weight := weights[priority]
+	if !options.ProportionalQueueSizes || weight <= 0 {
+		return options.QueueSize
+	}
+	size := proportionalQueueSize(options, weights, weight)
+	if size < 1 {
+		// the derived sizes are validated against the weights loaded on creation, not the reloaded ones
+		size = 1
+	}
+	return size
+}
+
+// proportionalQueueSize splits the QueueSize of all the priorities with a positive
+// weight and without an explicit queue size by the weight
+func proportionalQueueSize(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+	weights map[int]int,
+	weight int,
+) int {
+	count, totalWeight := 0, 0
+	for priority, weight := range weights {
+		if _, ok := options.QueueSizes[priority]; !ok && weight > 0 {
+			count++
+			totalWeight += weight
+		}
+	}
+	return int(int64(options.QueueSize) * int64(count) * int64(weight) / int64(totalWeight))
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) getOrCreateTaskQueue(
+	priority int,
+) (*taskQueueImpl, error) {
+	if _, ok := w.getWeights()[priority]; !ok {
+		return nil, fmt.Errorf("unknown task priority: %v", priority)
+	}
+
+	w.RLock()
+	if taskQueue, ok := w.taskQueues[priority]; ok {
+		w.RUnlock()
+		return taskQueue, nil
+	}
+	w.RUnlock()
+
+	w.Lock()
+	defer w.Unlock()
+	if taskQueue, ok := w.taskQueues[priority]; ok {
+		return taskQueue, nil
+	}
+	// the priority may be removed by RemapPriorities concurrently
+	if _, ok := w.getWeights()[priority]; !ok {
+		return nil, fmt.Errorf("unknown task priority: %v", priority)
+	}
+	var taskQueue *taskQueueImpl
+	queueSize := taskQueueSize(w.options, w.getWeights(), priority)
+	if w.options.LockFreeQueues {
+		taskQueue = newLockFreeTaskQueue(priority, queueSize)
+	} else {
+		taskQueue = newTaskQueue(priority, queueSize)
+	}
+	taskQueue.onPoll = w.setPolledTask
+	taskQueue.sharedCapacity = w.sharedCapacity
+	taskQueue.queuedBytes = w.queuedBytes
+	// non-droppable tasks are not shed by SoftQueuedBytes, evicted by EvictOlderThan or aged out by MaxQueueAge
+	taskQueue.retained = isNonDroppable
+	w.priorityActivity.add(taskQueue)
+	if len(w.options.QueueDepthThresholds) != 0 {
+		taskQueue.depthThresholds = append([]float64(nil), w.options.QueueDepthThresholds...)
+		sort.Float64s(taskQueue.depthThresholds)
+		taskQueue.onThresholdCrossed = w.onQueueThresholdCrossed
 	}
+	w.taskQueues[priority] = taskQueue
 
-	weightedRoundRobinTaskSchedulerImpl struct {
-		sync.RWMutex
+	w.queueList = insertTaskQueue(w.queueList, taskQueue)
 
-		status       int32
-		weights      atomic.Value // store the currently used weights
-		taskChs      map[int]chan PriorityTask
-		shutdownCh   chan struct{}
-		notifyCh     chan struct{}
-		dispatcherWG sync.WaitGroup
-		logger       log.Logger
-		metricsScope metrics.Scope
-		options      *WeightedRoundRobinTaskSchedulerOptions
+	var dispatchQueue TaskQueue = taskQueue
+	var evictExpired func()
+	if maxAge, ok := w.options.MaxQueueAge[priority]; ok && maxAge > 0 {
+		agingQueue := newAgingQueue(taskQueue, maxAge, w.addAgedOutTask)
+		dispatchQueue = agingQueue
+		evictExpired = agingQueue.evictExpired
+	}
+	if w.options.DispatchLimiter != nil {
+		dispatchQueue = newDispatchLimitedQueue(taskQueue, w.options.DispatchLimiter, evictExpired, w.setDispatchDenied)
+	}
+	limit := maxConcurrency(w.options, priority)
+	ok := limit > 0
+	if _, preserveOrder := w.preserveOrder[priority]; preserveOrder {
+		// a task is dispatched only after the previous one completes
+		limit, ok = 1, true
+	}
+	if !ok && (w.executionShare != nil || w.resourceBudget != nil) {
+		// in-flight tasks are tracked for all priorities without limiting them
+		limit, ok = math.MaxInt32, true
+	}
+	if ok {
+		limitedQueue := newConcurrencyLimitedQueue(
+			dispatchQueue,
+			limit,
+			func(inFlight int32) {
+				w.getPriorityMetricsScope(priority).UpdateGauge(metrics.PriorityTaskInFlight, float64(inFlight))
+			},
+			// tasks of the priority may become dispatchable
+			w.notifyDispatcher,
+		)
+		if w.resourceBudget != nil {
+			limitedQueue.resources = w.resourceBudget
+			limitedQueue.peek = taskQueue.Peek
+		}
+		if _, preserveOrder := w.preserveOrder[priority]; w.capacityPool != nil && !preserveOrder {
+			w.capacityPool.add(limitedQueue)
+		}
+		if w.concurrencyIntegrators != nil {
+			limitedQueue.executions = newConcurrencyIntegrator(time.Now())
+			w.concurrencyIntegrators[priority] = limitedQueue.executions
+		}
+		if _, idleOnly := w.idleOnly[priority]; w.executionShare != nil && !idleOnly {
+			w.executionShare.add(limitedQueue)
+		}
+		dispatchQueue = limitedQueue
+	}
+	if _, ok := w.idleOnly[priority]; ok {
+		w.idleOnlyQueueList = w.insertDispatchQueue(w.idleOnlyQueueList, dispatchQueue)
+	} else {
+		w.dispatchQueueList = w.insertDispatchQueue(w.dispatchQueueList, dispatchQueue)
+	}
+	return taskQueue, nil
+}
 
-		processor Processor
+// resourceCost returns the cost of the task on each dimension of ResourceBudgets
+func (w *weightedRoundRobinTaskSchedulerImpl) resourceCost(
+	task PriorityTask,
+) map[string]float64 {
+	task = unwrapSchedulerTask(task).(PriorityTask)
+	if w.options.ResourceCost != nil {
+		return w.options.ResourceCost(task)
 	}
-)
+	if costTask, ok := task.(ResourceCostTask); ok {
+		return costTask.ResourceCost()
+	}
+	return nil
+}
 
-const (
-	wRRTaskProcessorQueueSize    = 1
-	defaultUpdateWeightsInterval = 5 * time.Second
-)
+// insertTaskQueue returns a new list with the queue inserted, sorted by priority,
+// a new list is needed as dispatchers may be iterating the current one
+func insertTaskQueue(
+	queues []TaskQueue,
+	queue TaskQueue,
+) []TaskQueue {
+	newQueues := make([]TaskQueue, 0, len(queues)+1)
+	newQueues = append(newQueues, queues...)
+	newQueues = append(newQueues, queue)
+	sort.Slice(newQueues, func(i, j int) bool {
+		return newQueues[i].Priority() < newQueues[j].Priority()
+	})
+	return newQueues
+}
 
-var (
-	// ErrTaskSchedulerClosed is the error returned when submitting task to a stopped scheduler
-	ErrTaskSchedulerClosed = errors.New("task scheduler has already shutdown")
-)
+// insertDispatchQueue is the same as insertTaskQueue, except
+// that queues are sorted by the scan order of priorities
+func (w *weightedRoundRobinTaskSchedulerImpl) insertDispatchQueue(
+	queues []TaskQueue,
+	queue TaskQueue,
+) []TaskQueue {
+	newQueues := insertTaskQueue(queues, queue)
+	if len(w.priorityRanks) != 0 {
+		sort.SliceStable(newQueues, func(i, j int) bool {
+			return w.scansBefore(newQueues[i].Priority(), newQueues[j].Priority())
+		})
+	}
+	return newQueues
+}
 
-// NewWeightedRoundRobinTaskScheduler creates a new WRR task scheduler
-func NewWeightedRoundRobinTaskScheduler(
-	logger log.Logger,
-	metricsClient metrics.Client,
-	options *WeightedRoundRobinTaskSchedulerOptions,
-) (Scheduler, error) {
-	weights, err := common.ConvertDynamicConfigMapPropertyToIntMap(options.Weights())
-	if err != nil {
-		return nil, err
+// scansBefore returns true if priority a is scanned before priority b, i.e. a is a higher priority.
+// Priorities in PriorityOrder are scanned first, the rest are scanned in ascending order
+func (w *weightedRoundRobinTaskSchedulerImpl) scansBefore(
+	a int,
+	b int,
+) bool {
+	rankA, rankedA := w.priorityRanks[a]
+	rankB, rankedB := w.priorityRanks[b]
+	switch {
+	case rankedA && rankedB:
+		return rankA < rankB
+	case rankedA || rankedB:
+		return rankedA
+	default:
+		return a < b
 	}
+}
 
-	if len(weights) == 0 {
-		return nil, errors.New("weight is not specified in the scheduler option")
+// notifyDispatcher wakes up a dispatcher blocked on notifyCh. It must only be called
+// after a task is enqueued, then skipping the notification when notifyCh is already full
+// won't lose a wakeup: the pending notification hasn't been consumed yet, so the dispatcher
+// consuming it will query the dispatch strategy after the enqueue and is
+// guaranteed to observe the task.
+func (w *weightedRoundRobinTaskSchedulerImpl) notifyDispatcher() {
+	select {
+	case w.notifyCh <- struct{}{}:
+		// sent a notification to the dispatcher
+	default:
+		// do not block if there's already a notification
 	}
+}
 
-	scheduler := &weightedRoundRobinTaskSchedulerImpl{
-		status:       common.DaemonStatusInitialized,
-		taskChs:      make(map[int]chan PriorityTask),
-		shutdownCh:   make(chan struct{}),
-		notifyCh:     make(chan struct{}, 1),
-		logger:       logger,
-		metricsScope: metricsClient.Scope(metrics.TaskSchedulerScope),
-		options:      options,
-		processor: NewParallelTaskProcessor(
-			logger,
-			metricsClient,
-			&ParallelTaskProcessorOptions{
-				QueueSize:   wRRTaskProcessorQueueSize,
-				WorkerCount: options.WorkerCount,
-				RetryPolicy: options.RetryPolicy,
-			},
-		),
+func (w *weightedRoundRobinTaskSchedulerImpl) SetMetricsScope(
+	scope metrics.Scope,
+) {
+	w.metricsScope.Store(newMetricsScopeHolder(scope, w.options.PerPriorityScope))
+}
+
+func newMetricsScopeHolder(
+	scope metrics.Scope,
+	perPriorityScope bool,
+) metricsScopeHolder {
+	holder := metricsScopeHolder{scope: scope}
+	if perPriorityScope {
+		holder.priorityScopes = newPriorityScopes(scope)
 	}
-	scheduler.weights.Store(weights)
+	return holder
+}
 
-	return scheduler, nil
+func (w *weightedRoundRobinTaskSchedulerImpl) getMetricsScope() metrics.Scope {
+	return w.metricsScope.Load().(metricsScopeHolder).scope
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) Start() {
-	if !atomic.CompareAndSwapInt32(&w.status, common.DaemonStatusInitialized, common.DaemonStatusStarted) {
-		return
+// getPriorityMetricsScope returns the scope tagged with the priority,
+// which is cached if PerPriorityScope is specified
+func (w *weightedRoundRobinTaskSchedulerImpl) getPriorityMetricsScope(
+	priority int,
+) metrics.Scope {
+	holder := w.metricsScope.Load().(metricsScopeHolder)
+	if holder.priorityScopes != nil {
+		return holder.priorityScopes.get(priority)
 	}
+	return holder.scope.Tagged(metrics.TaskPriorityTag(priority))
+}
 
-	w.processor.Start()
+// getTaskMetricsScope returns the scope tagged with the task priority and the allowed task metric tags
+func (w *weightedRoundRobinTaskSchedulerImpl) getTaskMetricsScope(
+	task PriorityTask,
+	priority int,
+) metrics.Scope {
+	return w.metricsScope.Load().(metricsScopeHolder).getTaskScope(task, priority, w.metricTagAllowlist)
+}
 
-	w.dispatcherWG.Add(w.options.DispatcherCount)
-	for i := 0; i != w.options.DispatcherCount; i++ {
-		go w.dispatcher()
+// getSubmitTaskMetricsScope is the same as getTaskMetricsScope, except that
+// the SubmitMetricsScope is used if it's specified
+func (w *weightedRoundRobinTaskSchedulerImpl) getSubmitTaskMetricsScope(
+	task PriorityTask,
+	priority int,
+) metrics.Scope {
+	if w.submitMetricsScope.scope == nil {
+		return w.getTaskMetricsScope(task, priority)
 	}
-	go w.updateWeights()
+	return w.submitMetricsScope.getTaskScope(task, priority, w.metricTagAllowlist)
+}
 
-	w.logger.Info("Weighted round robin task scheduler started.")
+func (h metricsScopeHolder) getTaskScope(
+	task PriorityTask,
+	priority int,
+	allowlist map[string]struct{},
+) metrics.Scope {
+	if h.priorityScopes != nil {
+		return h.priorityScopes.getTaskScope(task, priority, allowlist)
+	}
+	return getTaskMetricsScope(h.scope, task, priority, allowlist)
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) Stop() {
-	if !atomic.CompareAndSwapInt32(&w.status, common.DaemonStatusStarted, common.DaemonStatusStopped) {
+// incTaskCounter increases the counter tagged with the task priority, the allowed task metric tags and the given tags
+func (w *weightedRoundRobinTaskSchedulerImpl) incTaskCounter(
+	metric int,
+	task PriorityTask,
+	priority int,
+	tags ...metrics.Tag,
+) {
+	if w.batchedCounters == nil {
+		getTaggedMetricsScope(w.getTaskMetricsScope(task, priority), tags).IncCounter(metric)
 		return
 	}
+	w.incCounter(metric, append(getTaskMetricsTags(task, priority, w.metricTagAllowlist), tags...))
+}
 
-	close(w.shutdownCh)
+// incSubmitTaskCounter is the same as incTaskCounter, except that
+// the SubmitMetricsScope is used if it's specified
+func (w *weightedRoundRobinTaskSchedulerImpl) incSubmitTaskCounter(
+	metric int,
+	task PriorityTask,
+	priority int,
+	tags ...metrics.Tag,
+) {
+	if w.submitMetricsScope.scope == nil {
+		w.incTaskCounter(metric, task, priority, tags...)
+		return
+	}
+	if w.submitBatchedCounters == nil {
+		getTaggedMetricsScope(w.getSubmitTaskMetricsScope(task, priority), tags).IncCounter(metric)
+		return
+	}
+	w.submitBatchedCounters.add(metric, append(getTaskMetricsTags(task, priority, w.metricTagAllowlist), tags...), 1)
+}
 
-	w.processor.Stop()
+// incPriorityCounter increases the counter tagged with the priority and the given tags
+func (w *weightedRoundRobinTaskSchedulerImpl) incPriorityCounter(
+	metric int,
+	priority int,
+	tags ...metrics.Tag,
+) {
+	if w.batchedCounters == nil {
+		getTaggedMetricsScope(w.getPriorityMetricsScope(priority), tags).IncCounter(metric)
+		return
+	}
+	w.incCounter(metric, append([]metrics.Tag{metrics.TaskPriorityTag(priority)}, tags...))
+}
 
-	if success := common.AwaitWaitGroup(&w.dispatcherWG, time.Minute); !success {
-		w.logger.Warn("Weighted round robin task scheduler timedout on shutdown.")
+// incCounter increases the counter with the given tags, which is
+// emitted on the next flush if BatchCounters is specified
+func (w *weightedRoundRobinTaskSchedulerImpl) incCounter(
+	metric int,
+	tags []metrics.Tag,
+) {
+	if w.batchedCounters != nil {
+		w.batchedCounters.add(metric, tags, 1)
+		return
 	}
+	getTaggedMetricsScope(w.getMetricsScope(), tags).IncCounter(metric)
+}
 
-	w.logger.Info("Weighted round robin task scheduler shutdown.")
+func (w *weightedRoundRobinTaskSchedulerImpl) flushCounters() {
+	if w.batchedCounters != nil {
+		w.batchedCounters.flush(w.getMetricsScope())
+	}
+	if w.submitBatchedCounters != nil {
+		w.submitBatchedCounters.flush(w.submitMetricsScope.scope)
+	}
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) Submit(task PriorityTask) error {
-	w.metricsScope.IncCounter(metrics.PriorityTaskSubmitRequest)
-	sw := w.metricsScope.StartTimer(metrics.PriorityTaskSubmitLatency)
-	defer sw.Stop()
+func (w *weightedRoundRobinTaskSchedulerImpl) getWeights() map[int]int {
+	return w.weights.Load().(map[int]int)
+}
 
-	taskCh, err := w.getOrCreateTaskChan(task.Priority())
-	if err != nil {
-		return err
+// storeWeights replaces the effective weights, which dispatchers observe from the next dispatch round, and
+// logs and emits the new weights if they differ from the previous ones. The caller must hold the dispatch lock
+func (w *weightedRoundRobinTaskSchedulerImpl) storeWeights(
+	weights map[int]int,
+) {
+	previousWeights := w.getWeights()
+	w.weights.Store(weights)
+	if reflect.DeepEqual(previousWeights, weights) {
+		return
 	}
 
-	select {
-	case taskCh <- task:
-		w.notifyDispatcher()
-		return nil
-	case <-w.shutdownCh:
-		return ErrTaskSchedulerClosed
+	w.logger.Info("Weighted round robin task scheduler weights updated.", tag.TaskWeights(weights))
+	w.getMetricsScope().IncCounter(metrics.PriorityTaskWeightsUpdated)
+	w.emitWeights(weights)
+}
+
+// emitWeights emits the weight of each priority
+func (w *weightedRoundRobinTaskSchedulerImpl) emitWeights(
+	weights map[int]int,
+) {
+	for priority, weight := range weights {
+		w.getPriorityMetricsScope(priority).UpdateGauge(metrics.PriorityTaskWeight, float64(weight))
 	}
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) TrySubmit(
-	task PriorityTask,
-) (bool, error) {
-	taskCh, err := w.getOrCreateTaskChan(task.Priority())
-	if err != nil {
-		return false, err
+// checkWeightRatio warns about weights skewed beyond WeightRatioWarningThreshold, which
+// is likely a misconfiguration starving the priorities with the smaller weights
+func (w *weightedRoundRobinTaskSchedulerImpl) checkWeightRatio() {
+	if w.options.WeightRatioWarningThreshold <= 0 {
+		return
+	}
+	weights := w.getWeights()
+	ratio := maxWeightRatio(weights)
+	if ratio <= w.options.WeightRatioWarningThreshold {
+		return
 	}
+	w.logger.Warn(
+		"Weighted round robin task scheduler weights are skewed, which may unintentionally starve low priorities.",
+		tag.TaskWeights(weights),
+		tag.TaskWeightRatio(ratio),
+	)
+	w.getMetricsScope().IncCounter(metrics.PriorityTaskWeightRatioExceeded)
+}
 
-	select {
-	case taskCh <- task:
-		w.metricsScope.IncCounter(metrics.PriorityTaskSubmitRequest)
-		w.notifyDispatcher()
-		return true, nil
-	case <-w.shutdownCh:
-		return false, ErrTaskSchedulerClosed
-	default:
-		return false, nil
+// maxWeightRatio returns the ratio of the largest weight to the smallest
+// non-zero weight, which is one if less than two weights are non-zero
+func maxWeightRatio(
+	weights map[int]int,
+) float64 {
+	maxWeight, minWeight := 0, 0
+	for _, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		if weight > maxWeight {
+			maxWeight = weight
+		}
+		if minWeight == 0 || weight < minWeight {
+			minWeight = weight
+		}
 	}
+	if minWeight == 0 {
+		return 1
+	}
+	return float64(maxWeight) / float64(minWeight)
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) dispatcher() {
-	defer w.dispatcherWG.Done()
+// validatePriorityCount guards against weights keyed by raw semantic values
+// instead of a small set of priorities, which is a common misconfiguration
+func validatePriorityCount(
+	weights map[int]int,
+	allowManyPriorities bool,
+) error {
+	if !allowManyPriorities && len(weights) > MaxPriorities {
+		return fmt.Errorf(
+			"weights specified for %v priorities, which exceeds the max of %v, set AllowManyPriorities to override",
+			len(weights),
+			MaxPriorities,
+		)
+	}
+	return nil
+}
+
+func copyWeights(
+	weights map[int]int,
+) map[int]int {
+	weightsCopy := make(map[int]int, len(weights))
+	for priority, weight := range weights {
+		weightsCopy[priority] = weight
+	}
+	return weightsCopy
+}
+
+func (w *weightedRoundRobinTaskSchedulerImpl) warmupEnabled() bool {
+	return w.options.WarmupDuration > 0 &&
+		w.options.WarmupWorkerCount > 0 &&
+		w.options.WarmupWorkerCount < w.options.WorkerCount
+}
 
-	outstandingTasks := false
-	taskChs := make(map[int]chan PriorityTask)
+// warmup ramps up the worker count of the processor, one worker at a time
+func (w *weightedRoundRobinTaskSchedulerImpl) warmup() {
+	defer w.backgroundWG.Done()
 
+	processor, ok := w.processor.(ParallelTaskProcessor)
+	if !ok {
+		return
+	}
+
+	startTime := time.Now()
+	stepInterval := w.options.WarmupDuration / time.Duration(w.options.WorkerCount-w.options.WarmupWorkerCount)
+	ticker := time.NewTicker(stepInterval)
+	defer ticker.Stop()
 	for {
-		if !outstandingTasks {
-			// if no task is dispatched in the last round,
-			// wait for a notification
-			select {
-			case <-w.notifyCh:
-				// block until there's a new task
-			case <-w.shutdownCh:
-				return
-			}
+		select {
+		case <-ticker.C:
+		case <-w.shutdownCh:
+			return
 		}
 
-		outstandingTasks = false
-		w.updateTaskChs(taskChs)
-		weights := w.getWeights()
-		for priority, taskCh := range taskChs {
-			for i := 0; i < weights[priority]; i++ {
-				select {
-				case task := <-taskCh:
-					// dispatched at least one task in this round
-					outstandingTasks = true
-
-					if err := w.processor.Submit(task); err != nil {
-						w.logger.Error("fail to submit task to processor", tag.Error(err))
-						task.Nack()
-					}
-				case <-w.shutdownCh:
-					return
-				default:
-					// if no task, don't block. Skip to next priority
-					break
-				}
-			}
+		workerCount := warmupWorkerCount(
+			w.options.WarmupWorkerCount,
+			w.options.WorkerCount,
+			w.options.WarmupDuration,
+			time.Since(startTime),
+		)
+		w.dispatchLock.Lock()
+		if w.warmupCancelled {
+			w.dispatchLock.Unlock()
+			return
+		}
+		err := processor.SetWorkerCount(workerCount)
+		w.dispatchLock.Unlock()
+
+		if err != nil {
+			w.logger.Warn("Weighted round robin task scheduler failed to ramp up workers.", tag.Error(err))
+			return
+		}
+		if workerCount == w.options.WorkerCount {
+			w.logger.Info("Weighted round robin task scheduler warmup finished.")
+			return
 		}
 	}
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) getOrCreateTaskChan(
-	priority int,
-) (chan PriorityTask, error) {
-	if _, ok := w.getWeights()[priority]; !ok {
-		return nil, fmt.Errorf("unknown task priority: %v", priority)
+// warmupWorkerCount returns the worker count after the warmup has elapsed
+// for the given time, it increases linearly from start to target
+func warmupWorkerCount(
+	start int,
+	target int,
+	warmupDuration time.Duration,
+	elapsed time.Duration,
+) int {
+	if elapsed >= warmupDuration {
+		return target
 	}
+	return start + int(int64(target-start)*int64(elapsed)/int64(warmupDuration))
+}
 
-	w.RLock()
-	if taskCh, ok := w.taskChs[priority]; ok {
+// escalateAgedTasks periodically promotes the tasks queued for longer than AgePriorityEscalation
+func (w *weightedRoundRobinTaskSchedulerImpl) escalateAgedTasks() {
+	defer w.backgroundWG.Done()
+
+	interval := w.options.AgePriorityEscalationInterval
+	if interval == 0 {
+		interval = defaultAgePriorityEscalationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.promoteAgedTasks(time.Now())
+		case <-w.shutdownCh:
+			return
+		}
+	}
+}
+
+// promoteAgedTasks moves the tasks queued for longer than AgePriorityEscalation by now to the
+// queues of the next higher priorities, and returns the number of tasks promoted
+func (w *weightedRoundRobinTaskSchedulerImpl) promoteAgedTasks(
+	now time.Time,
+) int {
+	weights := w.getWeights()
+	priorities := make([]int, 0, len(w.options.AgePriorityEscalation))
+	for priority := range w.options.AgePriorityEscalation {
+		priorities = append(priorities, priority)
+	}
+	// the higher priorities are swept first, so that the tasks promoted
+	// by a sweep are not promoted again by the same sweep
+	sort.Ints(priorities)
+
+	numPromoted := 0
+	for _, priority := range priorities {
+		w.RLock()
+		sourceQueue, ok := w.taskQueues[priority]
 		w.RUnlock()
-		return taskCh, nil
+		if !ok {
+			continue
+		}
+		targetPriority, ok := nextHigherPriority(weights, priority)
+		if !ok {
+			continue
+		}
+		targetQueue, err := w.getOrCreateTaskQueue(targetPriority)
+		if err != nil {
+			continue
+		}
+
+		// holding the dispatch lock so that no task is polled while being moved
+		w.dispatchLock.Lock()
+		numMoved := sourceQueue.MoveExpiredTo(
+			targetQueue,
+			now.Add(-w.options.AgePriorityEscalation[priority]),
+			func(task PriorityTask) PriorityTask {
+				task.SetPriority(targetPriority)
+				return w.snapshotPriority(task, targetPriority)
+			},
+		)
+		w.dispatchLock.Unlock()
+		if numMoved != 0 {
+			w.getPriorityMetricsScope(priority).AddCounter(metrics.PriorityTaskAgePromoted, int64(numMoved))
+			numPromoted += numMoved
+		}
+	}
+
+	if numPromoted != 0 {
+		w.notifyDispatcher()
+	}
+	return numPromoted
+}
+
+// emitEffectiveConcurrency periodically emits the effective concurrency of each priority with a concurrency limit
+func (w *weightedRoundRobinTaskSchedulerImpl) emitEffectiveConcurrency() {
+	defer w.backgroundWG.Done()
+
+	ticker := time.NewTicker(w.options.EffectiveConcurrencyWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.reportEffectiveConcurrency(time.Now())
+		case <-w.shutdownCh:
+			return
+		}
+	}
+}
+
+// reportEffectiveConcurrency emits the average concurrency of each
+// priority since the last report and starts a new sampling window
+func (w *weightedRoundRobinTaskSchedulerImpl) reportEffectiveConcurrency(
+	now time.Time,
+) {
+	w.RLock()
+	integrators := make(map[int]*concurrencyIntegrator, len(w.concurrencyIntegrators))
+	for priority, integrator := range w.concurrencyIntegrators {
+		integrators[priority] = integrator
 	}
 	w.RUnlock()
 
-	w.Lock()
-	defer w.Unlock()
-	if taskCh, ok := w.taskChs[priority]; ok {
-		return taskCh, nil
+	for priority, integrator := range integrators {
+		w.getPriorityMetricsScope(priority).UpdateGauge(metrics.PriorityTaskEffectiveConcurrency, integrator.sample(now))
+	}
+}
+
+// emitExecutionShares periodically emits the dispatch and execution shares of each priority
+func (w *weightedRoundRobinTaskSchedulerImpl) emitExecutionShares() {
+	defer w.backgroundWG.Done()
+
+	ticker := time.NewTicker(executionShareReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.reportExecutionShares()
+		case <-w.shutdownCh:
+			return
+		}
+	}
+}
+
+// reportExecutionShares emits the share of the tasks dispatched since the last report
+// and the current share of the in-flight tasks of each priority
+func (w *weightedRoundRobinTaskSchedulerImpl) reportExecutionShares() {
+	dispatchShares, executionShares := w.executionShare.shares()
+	for priority, share := range dispatchShares {
+		w.getPriorityMetricsScope(priority).UpdateGauge(metrics.PriorityTaskDispatchShare, share)
+	}
+	for priority, share := range executionShares {
+		w.getPriorityMetricsScope(priority).UpdateGauge(metrics.PriorityTaskExecutionShare, share)
+	}
+}
+
+// emitWeightDrift periodically emits the deviation of the dispatch ratio from the weights
+func (w *weightedRoundRobinTaskSchedulerImpl) emitWeightDrift() {
+	defer w.backgroundWG.Done()
+
+	ticker := time.NewTicker(w.options.WeightDriftWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.reportWeightDrift()
+		case <-w.shutdownCh:
+			return
+		}
 	}
-	taskCh := make(chan PriorityTask, w.options.QueueSize)
-	w.taskChs[priority] = taskCh
-	return taskCh, nil
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) updateTaskChs(taskChs map[int]chan PriorityTask) {
+// reportWeightDrift emits the weight drift of the tasks dispatched since the last report
+// and starts a new window, nothing is emitted if no task is dispatched within the window
+func (w *weightedRoundRobinTaskSchedulerImpl) reportWeightDrift() {
 	w.RLock()
-	defer w.RUnlock()
+	queues := w.dispatchQueueList
+	w.RUnlock()
+
+	w.dispatchLock.Lock()
+	dispatched := w.driftDispatched
+	w.driftDispatched = make(map[int]int64, len(dispatched))
+	w.dispatchLock.Unlock()
+
+	// priorities with queued tasks are backlogged even if none is dispatched
+	for _, queue := range queues {
+		if _, ok := dispatched[queue.Priority()]; !ok && queue.Len() != 0 {
+			dispatched[queue.Priority()] = 0
+		}
+	}
 
-	for priority, taskCh := range w.taskChs {
-		if _, ok := taskChs[priority]; !ok {
-			taskChs[priority] = taskCh
+	weights := w.getWeights()
+	activeWeights := make(map[int]int, len(dispatched))
+	for priority := range dispatched {
+		if _, ok := w.directDispatch[priority]; ok {
+			delete(dispatched, priority)
+			continue
 		}
+		if weight := weights[priority]; weight > 0 {
+			activeWeights[priority] = weight
+		} else {
+			delete(dispatched, priority)
+		}
+	}
+	if drift, ok := weightDrift(dispatched, activeWeights); ok {
+		w.getMetricsScope().UpdateGauge(metrics.PriorityTaskWeightDrift, drift)
 	}
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) notifyDispatcher() {
-	select {
-	case w.notifyCh <- struct{}{}:
-		// sent a notification to the dispatcher
-	default:
-		// do not block if there's already a notification
+// sweepPriorityActivity periodically reports the priorities whose queue stays empty idle
+func (w *weightedRoundRobinTaskSchedulerImpl) sweepPriorityActivity() {
+	defer w.backgroundWG.Done()
+
+	ticker := time.NewTicker(w.priorityIdleDebounce())
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.priorityActivity.sweep(now)
+		case <-w.shutdownCh:
+			return
+		}
 	}
 }
 
-func (w *weightedRoundRobinTaskSchedulerImpl) getWeights() map[int]int {
-	return w.weights.Load().(map[int]int)
+func (w *weightedRoundRobinTaskSchedulerImpl) priorityIdleDebounce() time.Duration {
+	if w.options.PriorityIdleDebounce > 0 {
+		return w.options.PriorityIdleDebounce
+	}
+	return defaultPriorityIdleDebounce
+}
+
+// nextHigherPriority returns the closest priority with a weight which is smaller than the given one
+func nextHigherPriority(
+	weights map[int]int,
+	priority int,
+) (int, bool) {
+	higherPriority, found := 0, false
+	for p := range weights {
+		if p < priority && (!found || p > higherPriority) {
+			higherPriority, found = p, true
+		}
+	}
+	return higherPriority, found
 }
 
 func (w *weightedRoundRobinTaskSchedulerImpl) updateWeights() {
-	ticker := time.NewTicker(defaultUpdateWeightsInterval)
+	defer w.backgroundWG.Done()
+
+	// only apply the weights from dynamic config when its value changes,
+	// so that weights specified via Reconfigure won't be overwritten
+	lastConfigWeights := w.getWeights()
+
+	interval := w.options.WeightsRefreshInterval
+	if interval <= 0 {
+		interval = defaultUpdateWeightsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// counters are flushed on their own interval, which doesn't follow WeightsRefreshInterval
+	flushTicker := time.NewTicker(counterFlushInterval)
+	defer flushTicker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			weights, err := common.ConvertDynamicConfigMapPropertyToIntMap(w.options.Weights())
+			weights, err := loadWeights(w.options)
+			if err == nil && !reflect.DeepEqual(weights, lastConfigWeights) {
+				// validated and applied as the weights specified via Reconfigure, the current
+				// weights are kept if the reloaded ones are rejected, and retried on the next reload
+				if err = w.Reconfigure(ReconfigureOptions{Weights: weights}); err == nil {
+					lastConfigWeights = weights
+				}
+			}
 			if err != nil {
 				w.logger.Error("failed to update weight for round robin task scheduler", tag.Error(err))
-			} else {
-				w.weights.Store(weights)
 			}
+		case <-flushTicker.C:
+			w.flushCounters()
 		case <-w.shutdownCh:
-			ticker.Stop()
 			return
 		}
 	}
 }
+
+func (t *requeuedTask) retryState() (int, int, time.Time, bool) {
+	return t.retries, t.requeues, t.firstAttemptTime, true
+}
@@ -21,10 +21,16 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,6 +38,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/uber/cadence/common"
 	"github.com/uber/cadence/common/backoff"
@@ -56,6 +65,50 @@ type (
 	mockPriorityTaskMatcher struct {
 		task *MockPriorityTask
 	}
+
+	testBulkNackableTask struct {
+		*MockPriorityTask
+		*MockBulkNackableTask
+	}
+
+	benchmarkPriorityTask struct {
+		priority      int
+		executionTime time.Duration
+		waitGroup     *sync.WaitGroup
+	}
+
+	// countingMetricsScope counts the calls for emitting counters
+	countingMetricsScope struct {
+		metrics.Scope
+
+		calls *int64
+	}
+
+	testResourceCostTask struct {
+		*MockPriorityTask
+
+		cost map[string]float64
+	}
+
+	testNonDroppableTask struct {
+		*MockPriorityTask
+	}
+
+	// testIdempotentOptionalTask is an IdempotentTask implementing the other optional interfaces
+	testIdempotentOptionalTask struct {
+		*MockPriorityTask
+
+		key                 string
+		retryPolicy         backoff.RetryPolicy
+		executedWithContext bool
+	}
+
+	// capacityReportingProcessor reports its buffer as full until full is cleared
+	capacityReportingProcessor struct {
+		Processor
+
+		full int32
+	}
 )
 
 var (
@@ -103,11 +156,148 @@ func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_Success() {
 	err := s.scheduler.Submit(mockTask)
 	s.NoError(err)
 
-	task := <-s.scheduler.taskChs[taskPriority]
+	task, ok := s.scheduler.taskQueues[taskPriority].Poll()
+	s.True(ok)
 	s.Equal(mockTask, task)
-	for _, taskCh := range s.scheduler.taskChs {
-		s.Empty(taskCh)
+	for _, taskQueue := range s.scheduler.taskQueues {
+		s.Zero(taskQueue.Len())
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_Fail_SchedulerNotStarted() {
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	s.NoError(err)
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+
+	s.Equal(ErrSchedulerNotStarted, scheduler.Submit(mockTask))
+	_, err = scheduler.TrySubmit(mockTask)
+	s.Equal(ErrSchedulerNotStarted, err)
+	s.Equal(ErrSchedulerNotStarted, scheduler.SubmitAtomic([]PriorityTask{mockTask}))
+	unaccepted, err := scheduler.SubmitBatch([]PriorityTask{mockTask}, true)
+	s.Equal(ErrSchedulerNotStarted, err)
+	s.Equal([]PriorityTask{mockTask}, unaccepted)
+	remaining, _ := scheduler.DrainProgress()
+	s.Zero(remaining)
+
+	scheduler.Start()
+	scheduler.Stop()
+	s.Equal(ErrTaskSchedulerClosed, scheduler.Submit(mockTask))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_Rejected() {
+	var rejected []string
+	testScope := tally.NewTestScope("test", nil)
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(testScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       1,
+			WorkerCount:     1,
+			DispatcherCount: 0, // queued tasks are never dispatched
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			OnTasksDropped:  func(_ []PriorityTask) {},
+			OnReject: func(_ PriorityTask, reason string) {
+				rejected = append(rejected, reason)
+			},
+		},
+	)
+	s.NoError(err)
+	newTask := func(priority int) PriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+
+	s.Equal(ErrSchedulerNotStarted, scheduler.Submit(newTask(0)))
+	scheduler.Start()
+	s.Error(scheduler.Submit(newTask(10)))
+	submitted, err := scheduler.TrySubmit(newTask(0))
+	s.NoError(err)
+	s.True(submitted)
+	submitted, err = scheduler.TrySubmit(newTask(0))
+	s.NoError(err)
+	s.False(submitted)
+	scheduler.Stop()
+	s.Equal(ErrTaskSchedulerClosed, scheduler.SubmitAtomic([]PriorityTask{newTask(1), newTask(2)}))
+
+	s.Equal([]string{
+		RejectReasonNotStarted,
+		RejectReasonUnknownPriority,
+		RejectReasonQueueFull,
+		RejectReasonShutdown,
+		RejectReasonShutdown,
+	}, rejected)
+	counts := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_rejected" {
+			counts[counter.Tags()["reason"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{
+		RejectReasonNotStarted:      1,
+		RejectReasonUnknownPriority: 1,
+		RejectReasonQueueFull:       1,
+		RejectReasonShutdown:        2,
+	}, counts)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_OnSubmit() {
+	errInvalidTask := errors.New("invalid task")
+	var validated []int
+	var rejected []string
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			OnSubmit: func(task PriorityTask) error {
+				validated = append(validated, task.Priority())
+				if task.Priority() == 10 {
+					return errInvalidTask
+				}
+				return nil
+			},
+			OnReject: func(_ PriorityTask, reason string) {
+				rejected = append(rejected, reason)
+			},
+		},
+	)
+	newTask := func(priority int) PriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
 	}
+
+	s.NoError(scheduler.Submit(newTask(0)))
+	// the validation runs before the priority is checked against the weights
+	s.Equal(errInvalidTask, scheduler.Submit(newTask(10)))
+	submitted, err := scheduler.TrySubmit(newTask(10))
+	s.Equal(errInvalidTask, err)
+	s.False(submitted)
+	s.Equal(errInvalidTask, scheduler.SubmitAtomic([]PriorityTask{newTask(1), newTask(10)}))
+	s.Equal(1, scheduler.numQueuedTasks())
+
+	s.Equal([]int{0, 10, 10, 1, 10}, validated)
+	s.Equal([]string{
+		RejectReasonValidationFailed,
+		RejectReasonValidationFailed,
+		RejectReasonValidationFailed,
+		RejectReasonValidationFailed,
+	}, rejected)
 }
 
 func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_Fail_SchedulerShutDown() {
@@ -140,6 +330,99 @@ func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_Fail_UnknownPriority()
 	s.NotEqual(ErrTaskSchedulerClosed, err)
 }
 
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_OutOfRangePolicy() {
+	testCases := []struct {
+		policy           OutOfRangePolicy
+		taskPriority     int
+		expectedPriority int // NoPriority if the task should be rejected
+	}{
+		{OutOfRangePolicyReject, 5, NoPriority},
+		{OutOfRangePolicyReject, -3, NoPriority},
+		{OutOfRangePolicyClampToLowest, 5, 2},
+		{OutOfRangePolicyClampToLowest, -3, 2},
+		{OutOfRangePolicyClampToLowest, 1, 1},
+		{OutOfRangePolicyClampToHighest, 5, 0},
+		{OutOfRangePolicyClampToHighest, -3, 0},
+		{OutOfRangePolicyClampToHighest, 1, 1},
+	}
+
+	for _, tc := range testCases {
+		scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+			&WeightedRoundRobinTaskSchedulerOptions{
+				Weights:          testSchedulerWeights,
+				QueueSize:        s.queueSize,
+				WorkerCount:      1,
+				DispatcherCount:  1,
+				RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+				OutOfRangePolicy: tc.policy,
+			},
+		)
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(tc.taskPriority).AnyTimes()
+		if tc.expectedPriority == NoPriority {
+			s.Error(scheduler.Submit(mockTask))
+			continue
+		}
+
+		if tc.expectedPriority != tc.taskPriority {
+			mockTask.EXPECT().SetPriority(tc.expectedPriority).Times(1)
+		}
+		s.NoError(scheduler.Submit(mockTask))
+		s.Equal(1, scheduler.taskQueues[tc.expectedPriority].Len())
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_PriorityFunc() {
+	testCases := []struct {
+		policy           OutOfRangePolicy
+		taskPriority     int
+		computedPriority int
+		expectedPriority int // NoPriority if the task should be rejected
+	}{
+		{OutOfRangePolicyReject, 0, 2, 2},
+		{OutOfRangePolicyReject, 1, 1, 1},
+		// the task's own priority has no weight but the computed one does
+		{OutOfRangePolicyReject, 5, 0, 0},
+		{OutOfRangePolicyReject, 0, 5, NoPriority},
+		{OutOfRangePolicyClampToLowest, 0, 5, 2},
+		{OutOfRangePolicyClampToHighest, 2, -3, 0},
+		// clamped back to the declared priority
+		{OutOfRangePolicyClampToHighest, 0, -3, 0},
+	}
+
+	for _, tc := range testCases {
+		var submittedTasks []PriorityTask
+		scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+			&WeightedRoundRobinTaskSchedulerOptions{
+				Weights:          testSchedulerWeights,
+				QueueSize:        s.queueSize,
+				WorkerCount:      1,
+				DispatcherCount:  1,
+				RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+				OutOfRangePolicy: tc.policy,
+				PriorityFunc: func(task PriorityTask) int {
+					submittedTasks = append(submittedTasks, task)
+					return tc.computedPriority
+				},
+			},
+		)
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(tc.taskPriority).AnyTimes()
+		if tc.expectedPriority == NoPriority {
+			s.Error(scheduler.Submit(mockTask))
+			s.Equal([]PriorityTask{mockTask}, submittedTasks)
+			continue
+		}
+
+		if tc.expectedPriority != tc.taskPriority {
+			mockTask.EXPECT().SetPriority(tc.expectedPriority).Times(1)
+		}
+		s.NoError(scheduler.Submit(mockTask))
+		s.Equal([]PriorityTask{mockTask}, submittedTasks)
+		s.Equal(1, scheduler.taskQueues[tc.expectedPriority].Len())
+	}
+}
+
 func (s *weightedRoundRobinTaskSchedulerSuite) TestTrySubmit() {
 	taskPriority := 1
 	for i := 0; i != s.queueSize; i++ {
@@ -184,7 +467,7 @@ func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_SubmitWithNoError(
 				if expectedRemainingTasksNum < 0 {
 					expectedRemainingTasksNum = 0
 				}
-				s.Equal(expectedRemainingTasksNum, len(s.scheduler.taskChs[priority]))
+				s.Equal(expectedRemainingTasksNum, s.scheduler.taskQueues[priority].Len())
 			}
 		}
 
@@ -206,8 +489,8 @@ func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_SubmitWithNoError(
 	s.scheduler.processor = s.mockProcessor
 
 	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
 	go func() {
-		s.scheduler.dispatcherWG.Add(1)
 		s.scheduler.dispatcher()
 		close(doneCh)
 	}()
@@ -235,8 +518,8 @@ func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_FailToSubmit() {
 	s.scheduler.processor = s.mockProcessor
 
 	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
 	go func() {
-		s.scheduler.dispatcherWG.Add(1)
 		s.scheduler.dispatcher()
 		close(doneCh)
 	}()
@@ -247,67 +530,5432 @@ func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_FailToSubmit() {
 	<-doneCh
 }
 
-func (s *weightedRoundRobinTaskSchedulerSuite) TestWRR() {
-	numTasks := 1000
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_FailToSubmit_CustomErrorHandler() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+
+	submitErr := errors.New("some random error")
+	var handlerCalled int
+	submitTime := time.Now()
+	s.scheduler.options.OnDispatchError = func(task PriorityTask, err error) DispatchErrorAction {
+		s.Equal(mockTask, task)
+		s.True(errors.Is(err, submitErr))
+		var dispatchErr *DispatchError
+		s.True(errors.As(err, &dispatchErr))
+		s.Equal(0, dispatchErr.Priority)
+		s.False(dispatchErr.EnqueueTime.Before(submitTime))
+		handlerCalled++
+		return DispatchErrorActionRetry
+	}
+
 	var taskWG sync.WaitGroup
+	s.scheduler.Submit(mockTask)
+	taskWG.Add(1)
 
-	s.mockProcessor.EXPECT().Start()
-	s.mockProcessor.EXPECT().Stop()
+	gomock.InOrder(
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).Return(submitErr),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(func(_ Task) error {
+			taskWG.Done()
+			return nil
+		}),
+	)
+	s.scheduler.processor = s.mockProcessor
 
-	tasks := []PriorityTask{}
-	mockFn := func(_ Task) error {
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	taskWG.Wait()
+	close(s.scheduler.shutdownCh)
+
+	<-doneCh
+	s.Equal(1, handlerCalled)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_FailToSubmit_ProcessorCapacityWait() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.scheduler.options.ProcessorCapacityWait = time.Minute
+	s.scheduler.options.OnDispatchError = func(task PriorityTask, err error) DispatchErrorAction {
+		return DispatchErrorActionRetry
+	}
+
+	s.scheduler.Submit(mockTask)
+	refusedCh := make(chan struct{})
+	dispatchedCh := make(chan struct{})
+	gomock.InOrder(
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(func(_ Task) error {
+			close(refusedCh)
+			return errors.New("processor is busy")
+		}),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(func(_ Task) error {
+			close(dispatchedCh)
+			return nil
+		}),
+	)
+	processor := &capacityReportingProcessor{Processor: s.mockProcessor, full: 1}
+	s.scheduler.processor = processor
+
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	// the retried task is not polled again while the processor buffer is full
+	<-refusedCh
+	select {
+	case <-dispatchedCh:
+		s.Fail("task should not be dispatched before the processor has capacity")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the dispatcher resumes once there's capacity, without a new submission
+	atomic.StoreInt32(&processor.full, 0)
+	select {
+	case <-dispatchedCh:
+	case <-time.After(time.Second):
+		s.Fail("task should be dispatched once the processor has capacity")
+	}
+	close(s.scheduler.shutdownCh)
+
+	<-doneCh
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestHandleDispatchError_Drop() {
+	mockTask := NewMockPriorityTask(s.controller)
+	s.scheduler.options.OnDispatchError = func(task PriorityTask, err error) DispatchErrorAction {
+		return DispatchErrorActionDrop
+	}
+
+	// no Nack is expected on the task
+	s.scheduler.handleDispatchError(mockTask, errors.New("some random error"))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatchTask_ProcessorSubmitLatency() {
+	testScope := tally.NewTestScope("test", nil)
+	s.scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	mockTask := NewMockPriorityTask(s.controller)
+	s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).Return(nil).Times(1)
+	s.scheduler.processor = s.mockProcessor
+
+	s.scheduler.dispatchTask(mockTask, polledTaskInfo{})
+
+	timers := testScope.Snapshot().Timers()
+	s.Len(timers, 1)
+	for _, timer := range timers {
+		s.Equal("test.prioritytask_processor_submit_latency", timer.Name())
+		s.Len(timer.Values(), 1)
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_IdleAndBusyTime() {
+	testScope := tally.NewTestScope("test", nil)
+	s.scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	var taskWG sync.WaitGroup
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.NoError(s.scheduler.Submit(mockTask))
+	taskWG.Add(1)
+	s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(func(_ Task) error {
 		taskWG.Done()
 		return nil
+	}).Times(1)
+	s.scheduler.processor = s.mockProcessor
+
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	taskWG.Wait()
+	numTimerValues := func(name string) int {
+		for _, timer := range testScope.Snapshot().Timers() {
+			if timer.Name() == name {
+				return len(timer.Values())
+			}
+		}
+		return 0
 	}
-	for i := 0; i != numTasks; i++ {
-		mockTask := NewMockPriorityTask(s.controller)
-		mockTask.EXPECT().Priority().Return(rand.Intn(len(testSchedulerWeights()))).Times(1)
-		tasks = append(tasks, mockTask)
-		taskWG.Add(1)
-		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(mockFn)
+	// busy time is recorded once the dispatcher finds no task to dispatch
+	for numTimerValues("test.prioritytask_dispatcher_busy_time") == 0 {
+		runtime.Gosched()
 	}
+	close(s.scheduler.shutdownCh)
+	<-doneCh
+
+	s.Equal(1, numTimerValues("test.prioritytask_dispatcher_idle_time"))
+	s.Equal(1, numTimerValues("test.prioritytask_dispatcher_busy_time"))
+}
 
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_SpuriousWakeup() {
+	testScope := tally.NewTestScope("test", nil)
+	s.scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.NoError(s.scheduler.Submit(mockTask))
+	s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).Return(nil).Times(1)
 	s.scheduler.processor = s.mockProcessor
-	s.scheduler.Start()
-	for _, task := range tasks {
-		if rand.Intn(2) == 0 {
-			s.NoError(s.scheduler.Submit(task))
-		} else {
-			submitted, err := s.scheduler.TrySubmit(task)
-			s.NoError(err)
-			s.True(submitted)
+
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	numBusyTimes := func() int {
+		for _, timer := range testScope.Snapshot().Timers() {
+			if timer.Name() == "test.prioritytask_dispatcher_busy_time" {
+				return len(timer.Values())
+			}
 		}
+		return 0
 	}
-	taskWG.Wait()
-	s.scheduler.Stop()
+	spuriousWakeups := func() int64 {
+		for _, counter := range testScope.Snapshot().Counters() {
+			if counter.Name() == "test.prioritytask_spurious_wakeup" {
+				return counter.Value()
+			}
+		}
+		return 0
+	}
+	for numBusyTimes() == 0 {
+		runtime.Gosched()
+	}
+	s.Zero(spuriousWakeups())
+
+	// a notification without any queued task wakes the dispatcher up for nothing
+	s.scheduler.notifyDispatcher()
+	for numBusyTimes() == 1 {
+		runtime.Gosched()
+	}
+	close(s.scheduler.shutdownCh)
+	<-doneCh
+	s.Equal(int64(1), spuriousWakeups())
 }
 
-func (s *weightedRoundRobinTaskSchedulerSuite) newTestWeightedRoundRobinTaskScheduler(
-	options *WeightedRoundRobinTaskSchedulerOptions,
-) *weightedRoundRobinTaskSchedulerImpl {
-	scheduler, err := NewWeightedRoundRobinTaskScheduler(
-		loggerimpl.NewDevelopmentForTest(s.Suite),
-		metrics.NewClient(tally.NoopScope, metrics.Common),
-		options,
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDetectPriorityInversion() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                     testSchedulerWeights,
+			QueueSize:                   s.queueSize,
+			WorkerCount:                 1,
+			DispatcherCount:             1,
+			RetryPolicy:                 backoff.NewExponentialRetryPolicy(time.Millisecond),
+			PriorityInversionQueueDepth: 2,
+		},
 	)
-	s.NoError(err)
-	return scheduler.(*weightedRoundRobinTaskSchedulerImpl)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	newMockTask := func(priority int) *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+	for _, priority := range []int{0, 0, 1, 2} {
+		s.NoError(scheduler.Submit(newMockTask(priority)))
+	}
+
+	// priority 1 doesn't have enough tasks waiting to be counted
+	scheduler.detectPriorityInversion(scheduler.dispatchQueueList, newMockTask(2))
+	scheduler.detectPriorityInversion(scheduler.dispatchQueueList, newMockTask(1))
+	scheduler.detectPriorityInversion(scheduler.dispatchQueueList, newMockTask(0))
+
+	var inversions []map[string]string
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_inversion" {
+			s.Equal(int64(1), counter.Value())
+			inversions = append(inversions, counter.Tags())
+		}
+	}
+	s.Len(inversions, 2)
+	for _, tags := range inversions {
+		s.Equal("0", tags["waiting_task_priority"])
+	}
+	s.ElementsMatch([]string{"1", "2"}, []string{inversions[0]["task_priority"], inversions[1]["task_priority"]})
 }
 
-func newMockPriorityTaskMatcher(mockTask *MockPriorityTask) gomock.Matcher {
-	return &mockPriorityTaskMatcher{
-		task: mockTask,
+func (s *weightedRoundRobinTaskSchedulerSuite) TestPriorityOrder() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                     testSchedulerWeights,
+			QueueSize:                   s.queueSize,
+			WorkerCount:                 1,
+			DispatcherCount:             0, // tasks are only dispatched via nextTask
+			RetryPolicy:                 backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DispatchStrategy:            NewStrictPriorityDispatchStrategy(),
+			PriorityOrder:               []int{2, 0, 1},
+			PriorityInversionQueueDepth: 1,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	newMockTask := func(priority int) *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
 	}
+	for _, priority := range []int{0, 1, 2, 1} {
+		s.NoError(scheduler.Submit(newMockTask(priority)))
+	}
+
+	// inversions are detected against the priority order
+	scheduler.detectPriorityInversion(scheduler.dispatchQueueList, newMockTask(2))
+	scheduler.detectPriorityInversion(scheduler.dispatchQueueList, newMockTask(0))
+	var inversions int64
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_inversion" {
+			s.Equal("0", counter.Tags()["task_priority"])
+			s.Equal("2", counter.Tags()["waiting_task_priority"])
+			inversions += counter.Value()
+		}
+	}
+	s.Equal(int64(1), inversions)
+
+	var priorities []int
+	for i := 0; i != 4; i++ {
+		task, _, ok := scheduler.nextTask()
+		s.True(ok)
+		priorities = append(priorities, task.Priority())
+	}
+	s.Equal([]int{2, 0, 1, 1}, priorities)
 }
 
-func (m *mockPriorityTaskMatcher) Matches(x interface{}) bool {
-	taskPtr, ok := x.(*MockPriorityTask)
-	if !ok {
-		return false
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDynamicPriority() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  0, // tasks are only dispatched via nextTask
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DispatchStrategy: NewStrictPriorityDispatchStrategy(),
+			DynamicPriority:  true,
+		},
+	)
+	staticTask := NewMockPriorityTask(s.controller)
+	staticTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.Submit(staticTask))
+
+	newDynamicTask := func(priority *int32) *MockDynamicPriorityTask {
+		mockTask := NewMockDynamicPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(2).AnyTimes()
+		mockTask.EXPECT().CurrentPriority().DoAndReturn(func() int {
+			return int(atomic.LoadInt32(priority))
+		}).AnyTimes()
+		return mockTask
 	}
-	return taskPtr == m.task
+	urgentPriority, otherPriority := int32(2), int32(2)
+	urgentTask := newDynamicTask(&urgentPriority)
+	otherTask := newDynamicTask(&otherPriority)
+	s.NoError(scheduler.Submit(otherTask))
+	submitted, err := scheduler.TrySubmit(urgentTask)
+	s.NoError(err)
+	s.True(submitted)
+	s.Equal(2, scheduler.Stats().DynamicPriorityTasks)
+	remaining, _ := scheduler.DrainProgress()
+	s.Equal(3, remaining)
+
+	// the deadline of the task approaches after it's submitted
+	atomic.StoreInt32(&urgentPriority, 0)
+	urgentTask.EXPECT().SetPriority(0).Times(1)
+	otherTask.EXPECT().SetPriority(2).Times(1)
+	var dispatched []PriorityTask
+	for i := 0; i != 3; i++ {
+		task, polledTask, ok := scheduler.nextTask()
+		s.True(ok)
+		s.False(polledTask.enqueueTime.IsZero())
+		dispatched = append(dispatched, task)
+	}
+	s.Equal([]PriorityTask{urgentTask, staticTask, otherTask}, dispatched)
+	s.Zero(scheduler.Stats().DynamicPriorityTasks)
+	_, _, ok := scheduler.nextTask()
+	s.False(ok)
 }
 
-func (m *mockPriorityTaskMatcher) String() string {
-	return fmt.Sprintf("is equal to %v", m.task)
+func (s *weightedRoundRobinTaskSchedulerSuite) TestQueueDepthThresholds() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:              testSchedulerWeights,
+			QueueSize:            4,
+			WorkerCount:          1,
+			DispatcherCount:      0, // tasks are only dispatched via nextTask
+			RetryPolicy:          backoff.NewExponentialRetryPolicy(time.Millisecond),
+			QueueDepthThresholds: []float64{0.75, 0.5},
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	submitTask := func() {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	// depth goes up to 3, down to 1 and then back to 2
+	for i := 0; i != 3; i++ {
+		submitTask()
+	}
+	for i := 0; i != 2; i++ {
+		_, _, ok := scheduler.nextTask()
+		s.True(ok)
+	}
+	submitTask()
+
+	crossed := make(map[string]int64)
+	recovered := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		tags := counter.Tags()
+		switch counter.Name() {
+		case "test.prioritytask_queue_threshold_crossed":
+			s.Equal("0", tags["task_priority"])
+			crossed[tags["queue_threshold"]] += counter.Value()
+		case "test.prioritytask_queue_threshold_recovered":
+			s.Equal("0", tags["task_priority"])
+			recovered[tags["queue_threshold"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{"0.5": 2, "0.75": 1}, crossed)
+	s.Equal(map[string]int64{"0.5": 1, "0.75": 1}, recovered)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestProcessorQueueSize() {
+	s.Equal(defaultProcessorQueueSize, cap(s.scheduler.processor.(*parallelTaskProcessorImpl).tasksCh))
+
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:            testSchedulerWeights,
+			QueueSize:          s.queueSize,
+			WorkerCount:        1,
+			DispatcherCount:    3,
+			RetryPolicy:        backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ProcessorQueueSize: 10,
+		},
+	)
+	s.Equal(10, cap(scheduler.processor.(*parallelTaskProcessorImpl).tasksCh))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStats() {
+	for _, priority := range []int{0, 0, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority)
+		s.NoError(s.scheduler.Submit(mockTask))
+	}
+
+	stats := s.scheduler.Stats()
+	s.Equal(map[int]int{0: 2, 2: 1}, stats.QueuedTasks)
+	s.Equal(1, stats.Processor.ConfiguredWorkers)
+
+	s.scheduler.processor = s.mockProcessor
+	s.Equal(ProcessorStats{}, s.scheduler.Stats().Processor)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitFuture_Cancel() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	future, err := s.scheduler.SubmitFuture(mockTask)
+	s.NoError(err)
+	s.Equal(1, s.scheduler.taskQueues[1].Len())
+
+	s.True(future.Cancel())
+	s.Equal(ErrTaskCancelled, future.Get(context.Background()))
+	s.Zero(s.scheduler.taskQueues[1].Len())
+	s.False(future.Cancel())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitFuture_Completed() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	mockTask.EXPECT().Execute().Return(nil).Times(1)
+	mockTask.EXPECT().Ack().Times(1)
+
+	s.scheduler.Start()
+	defer s.scheduler.Stop()
+	future, err := s.scheduler.SubmitFuture(mockTask)
+	s.NoError(err)
+
+	s.NoError(future.Get(context.Background()))
+	s.False(future.Cancel())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitFuture_Result() {
+	task := &testResultTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		executeFn: func(ctx context.Context) (interface{}, error) {
+			return "some random result", nil
+		},
+	}
+	task.EXPECT().Priority().Return(1).AnyTimes()
+	task.EXPECT().Ack().Times(1)
+
+	s.scheduler.Start()
+	defer s.scheduler.Stop()
+	future, err := s.scheduler.SubmitFuture(task)
+	s.NoError(err)
+
+	result, err := future.GetResult(context.Background())
+	s.NoError(err)
+	s.Equal("some random result", result)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestProportionalQueueSizes() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights: dynamicconfig.GetMapPropertyFn(map[string]interface{}{
+				"0": 5,
+				"1": 3,
+				"2": 2,
+				"3": 0,
+				"4": 1,
+			}),
+			QueueSize:              100,
+			QueueSizes:             map[int]int{4: 10},
+			ProportionalQueueSizes: true,
+			WorkerCount:            1,
+			DispatcherCount:        0,
+			RetryPolicy:            backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+
+	// the queue size of the positive weight priorities without an explicit size is split by
+	// their weights, the zero weight priority gets the queue size, and the explicit size is kept
+	for priority, expectedSize := range map[int]int{0: 150, 1: 90, 2: 60, 3: 100, 4: 10} {
+		taskQueue, err := scheduler.getOrCreateTaskQueue(priority)
+		s.NoError(err)
+		s.Equal(expectedSize, taskQueue.Cap(), "priority %v", priority)
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmit_DirectDispatch() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DirectDispatch:  []int{0},
+		},
+	)
+	// only start the processor, so tasks can only be processed via direct dispatch
+	processor := scheduler.processor.(*parallelTaskProcessorImpl)
+	processor.Start()
+	defer processor.Stop()
+	for atomic.LoadInt32(&processor.idleWorkers) == 0 {
+		runtime.Gosched()
+	}
+
+	doneCh := make(chan struct{})
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Execute().Return(nil).Times(1)
+	mockTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+	s.NoError(scheduler.Submit(mockTask))
+	<-doneCh
+	s.Zero(scheduler.taskQueues[0].Len())
+
+	// priority not in DirectDispatch is queued as usual
+	mockTask = NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.Submit(mockTask))
+	s.Equal(1, scheduler.taskQueues[1].Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestExpressPriority() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DirectDispatch:  []int{1},
+			ExpressPriority: common.IntPtr(0),
+		},
+	)
+	s.Equal(map[int]struct{}{0: {}, 1: {}}, scheduler.directDispatch)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestPreserveIntraPriorityOrder() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                    testSchedulerWeights,
+			QueueSize:                  s.queueSize,
+			WorkerCount:                4,
+			DispatcherCount:            3,
+			RetryPolicy:                backoff.NewExponentialRetryPolicy(time.Millisecond),
+			PreserveIntraPriorityOrder: []int{0},
+		},
+	)
+
+	numTasks := 50
+	var lock sync.Mutex
+	var executed []int
+	var inFlight, maxInFlight int32
+	var taskWG sync.WaitGroup
+	taskWG.Add(2 * numTasks)
+	scheduler.Start()
+	defer scheduler.Stop()
+	for i := 0; i != numTasks; i++ {
+		idx := i
+		orderedTask := NewMockPriorityTask(s.controller)
+		orderedTask.EXPECT().Priority().Return(0).AnyTimes()
+		orderedTask.EXPECT().Execute().DoAndReturn(func() error {
+			if current := atomic.AddInt32(&inFlight, 1); current > atomic.LoadInt32(&maxInFlight) {
+				atomic.StoreInt32(&maxInFlight, current)
+			}
+			lock.Lock()
+			executed = append(executed, idx)
+			lock.Unlock()
+			runtime.Gosched()
+			atomic.AddInt32(&inFlight, -1)
+			return nil
+		})
+		orderedTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+		s.NoError(scheduler.Submit(orderedTask))
+
+		// tasks of other priorities are still processed concurrently
+		otherTask := NewMockPriorityTask(s.controller)
+		otherTask.EXPECT().Priority().Return(1).AnyTimes()
+		otherTask.EXPECT().Execute().Return(nil)
+		otherTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+		s.NoError(scheduler.Submit(otherTask))
+	}
+	taskWG.Wait()
+
+	s.Equal(int32(1), atomic.LoadInt32(&maxInFlight))
+	s.Len(executed, numTasks)
+	for idx, taskIdx := range executed {
+		s.Equal(idx, taskIdx)
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestIdleOnly() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0, // tasks are only dispatched via nextTask
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			IdleOnly:        []int{2},
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	processor := scheduler.processor.(ParallelTaskProcessor)
+
+	idleOnlyTask := NewMockPriorityTask(s.controller)
+	idleOnlyTask.EXPECT().Priority().Return(2).AnyTimes()
+	s.NoError(scheduler.Submit(idleOnlyTask))
+
+	// no idle worker before the processor is started
+	_, _, ok := scheduler.nextTask()
+	s.False(ok)
+
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	// tasks of other priorities are dispatched first
+	blockCh := make(chan struct{})
+	regularTask := NewMockPriorityTask(s.controller)
+	regularTask.EXPECT().Priority().Return(0).AnyTimes()
+	regularTask.EXPECT().Execute().DoAndReturn(func() error {
+		<-blockCh
+		return nil
+	}).Times(1)
+	regularTask.EXPECT().Ack().Times(1)
+	s.NoError(scheduler.Submit(regularTask))
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(regularTask, task)
+
+	// no idle worker while the regular task is executed
+	s.NoError(processor.Submit(task))
+	for processor.Stats().BusyWorkers == 0 {
+		runtime.Gosched()
+	}
+	_, _, ok = scheduler.nextTask()
+	s.False(ok)
+
+	close(blockCh)
+	for processor.Stats().BusyWorkers != 0 {
+		runtime.Gosched()
+	}
+	task, _, ok = scheduler.nextTask()
+	s.True(ok)
+	s.Equal(idleOnlyTask, task)
+
+	// the idle-only dispatch time is recorded once there's no more idle-only task
+	_, _, ok = scheduler.nextTask()
+	s.False(ok)
+	var numTimerValues int
+	for _, timer := range testScope.Snapshot().Timers() {
+		if timer.Name() == "test.prioritytask_idle_only_dispatch_time" {
+			numTimerValues += len(timer.Values())
+		}
+	}
+	s.Equal(1, numTimerValues)
+
+	_, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:        testSchedulerWeights,
+			DirectDispatch: []int{2},
+			IdleOnly:       []int{2},
+		},
+	)
+	s.Error(err)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestLifecycleCallbacks() {
+	var startCount, stopCount int
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			OnStart: func() {
+				startCount++
+				panic("some random panic")
+			},
+			OnStop: func() {
+				stopCount++
+			},
+		},
+	)
+	scheduler.processor = s.mockProcessor
+
+	// panics are recovered
+	s.mockProcessor.EXPECT().Start().Times(1)
+	scheduler.Start()
+	scheduler.Start()
+	s.Equal(1, startCount)
+	s.Zero(stopCount)
+
+	s.mockProcessor.EXPECT().Stop().Times(1)
+	scheduler.Stop()
+	scheduler.Stop()
+	s.Equal(1, startCount)
+	s.Equal(1, stopCount)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStartStop_Repeated() {
+	core, logs := observer.New(zapcore.DebugLevel)
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewLogger(zap.New(core)),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	s.NoError(err)
+	s.False(scheduler.WasStarted())
+
+	// stopping a scheduler which is not started is a no-op
+	scheduler.Stop()
+	s.Zero(logs.Len())
+
+	for i := 0; i != 2; i++ {
+		scheduler.Start()
+		s.True(scheduler.WasStarted())
+	}
+	for i := 0; i != 2; i++ {
+		scheduler.Stop()
+		s.True(scheduler.WasStarted())
+	}
+	scheduler.Start()
+
+	var messages []string
+	for _, entry := range logs.All() {
+		messages = append(messages, entry.Message)
+	}
+	s.Equal([]string{
+		"Parallel task processor started.",
+		"Weighted round robin task scheduler started.",
+		"Parallel task processor shutdown.",
+		"Weighted round robin task scheduler shutdown.",
+	}, messages)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestReset() {
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:           testSchedulerWeights,
+			QueueSize:         s.queueSize,
+			WorkerCount:       1,
+			DispatcherCount:   1,
+			RetryPolicy:       backoff.NewExponentialRetryPolicy(time.Millisecond),
+			EventRecorderSize: 10,
+		},
+	)
+	s.NoError(err)
+	s.Equal(ErrSchedulerNotStopped, scheduler.Reset())
+
+	for round := 0; round != 2; round++ {
+		scheduler.Start()
+		s.Equal(ErrSchedulerNotStopped, scheduler.Reset())
+
+		var taskWG sync.WaitGroup
+		taskWG.Add(1)
+		s.NoError(scheduler.Submit(&benchmarkPriorityTask{
+			priority:  round,
+			waitGroup: &taskWG,
+		}))
+		taskWG.Wait()
+		scheduler.Stop()
+		s.Equal(ErrTaskSchedulerClosed, scheduler.Submit(&benchmarkPriorityTask{}))
+		s.NotEmpty(scheduler.RecentEvents())
+
+		s.NoError(scheduler.Reset())
+		s.False(scheduler.WasStarted())
+		s.Empty(scheduler.RecentEvents())
+		s.Equal(ErrSchedulerNotStarted, scheduler.Submit(&benchmarkPriorityTask{}))
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_OnTasksDropped() {
+	var droppedTasks []PriorityTask
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0, // no dispatcher so that all tasks remain queued
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			OnTasksDropped: func(tasks []PriorityTask) {
+				droppedTasks = tasks
+			},
+		},
+	)
+	scheduler.Start()
+
+	var expectedTasks [3][]PriorityTask
+	for _, priority := range []int{2, 0, 1, 0, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+		expectedTasks[priority] = append(expectedTasks[priority], mockTask)
+	}
+
+	scheduler.Stop()
+	s.Equal(append(append(expectedTasks[0], expectedTasks[1]...), expectedTasks[2]...), droppedTasks)
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.Equal(ErrTaskSchedulerClosed, scheduler.Submit(mockTask))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatchError_CorrelationID() {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	scheduler.logger = loggerimpl.NewLogger(zap.New(core))
+
+	correlatedTask := &testCorrelatedTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		correlationID:    "some random correlation ID",
+	}
+	correlatedTask.EXPECT().Nack().Times(1)
+	scheduler.handleDispatchError(correlatedTask, errors.New("some random error"))
+
+	s.Equal(1, logs.Len())
+	entry := logs.All()[0]
+	s.Equal("fail to submit task to processor", entry.Message)
+	s.Equal("some random correlation ID", entry.ContextMap()["queue-task-correlation-id"])
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestCheckWeightRatio() {
+	for threshold, exceeded := range map[float64]bool{100: true, 1000: false} {
+		core, logs := observer.New(zapcore.WarnLevel)
+		scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+			&WeightedRoundRobinTaskSchedulerOptions{
+				Weights: dynamicconfig.GetMapPropertyFn(map[string]interface{}{
+					"0": 1000,
+					"1": 10,
+					"2": 1,
+					"3": 0,
+				}),
+				QueueSize:                   s.queueSize,
+				WorkerCount:                 1,
+				DispatcherCount:             0,
+				RetryPolicy:                 backoff.NewExponentialRetryPolicy(time.Millisecond),
+				WeightRatioWarningThreshold: threshold,
+			},
+		)
+		scheduler.logger = loggerimpl.NewLogger(zap.New(core))
+		testScope := tally.NewTestScope("test", nil)
+		scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+		scheduler.checkWeightRatio()
+		if !exceeded {
+			s.Zero(logs.Len())
+			s.Empty(testScope.Snapshot().Counters())
+			continue
+		}
+		s.Equal(1, logs.Len())
+		s.Equal("1000", logs.All()[0].ContextMap()["queue-task-weight-ratio"])
+		s.Len(testScope.Snapshot().Counters(), 1)
+		for _, counter := range testScope.Snapshot().Counters() {
+			s.Equal("test.prioritytask_weight_ratio_exceeded", counter.Name())
+			s.Equal(int64(1), counter.Value())
+		}
+	}
+
+	s.Equal(float64(1), maxWeightRatio(map[int]int{0: 5, 1: 0}))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_DispatcherShutdownTimeout() {
+	core, logs := observer.New(zapcore.WarnLevel)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                   testSchedulerWeights,
+			QueueSize:                 s.queueSize,
+			WorkerCount:               1,
+			DispatcherCount:           1,
+			RetryPolicy:               backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DispatcherShutdownTimeout: 10 * time.Millisecond,
+		},
+	)
+	scheduler.logger = loggerimpl.NewLogger(zap.New(core))
+	scheduler.processor = s.mockProcessor
+
+	// the dispatcher is blocked by the processor even after it's stopped
+	submittingCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	s.mockProcessor.EXPECT().Start()
+	s.mockProcessor.EXPECT().Submit(gomock.Any()).DoAndReturn(func(_ Task) error {
+		close(submittingCh)
+		<-releaseCh
+		return nil
+	})
+	s.mockProcessor.EXPECT().Stop()
+	scheduler.Start()
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.Submit(mockTask))
+	<-submittingCh
+
+	scheduler.Stop()
+	close(releaseCh)
+	s.Equal(1, logs.FilterMessage("Weighted round robin task scheduler dispatchers timedout on shutdown.").Len())
+	s.Zero(logs.FilterMessage("Parallel task processor timedout on shutdown.").Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_ProcessorShutdownTimeout() {
+	core, logs := observer.New(zapcore.WarnLevel)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                  testSchedulerWeights,
+			QueueSize:                s.queueSize,
+			WorkerCount:              1,
+			DispatcherCount:          1,
+			RetryPolicy:              backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ProcessorShutdownTimeout: 10 * time.Millisecond,
+		},
+	)
+	scheduler.logger = loggerimpl.NewLogger(zap.New(core))
+	scheduler.processor = NewParallelTaskProcessor(
+		scheduler.logger,
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&ParallelTaskProcessorOptions{
+			QueueSize:       1,
+			WorkerCount:     1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ShutdownTimeout: scheduler.options.ProcessorShutdownTimeout,
+		},
+	)
+
+	// the task keeps executing after the processor is stopped
+	executingCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	completedCh := make(chan struct{})
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	mockTask.EXPECT().Execute().DoAndReturn(func() error {
+		close(executingCh)
+		<-releaseCh
+		return nil
+	})
+	mockTask.EXPECT().Ack().Do(func() {
+		close(completedCh)
+	})
+	scheduler.Start()
+	s.NoError(scheduler.Submit(mockTask))
+	<-executingCh
+
+	scheduler.Stop()
+	close(releaseCh)
+	<-completedCh
+	s.Equal(1, logs.FilterMessage("Parallel task processor timedout on shutdown.").Len())
+	s.Zero(logs.FilterMessage("Weighted round robin task scheduler dispatchers timedout on shutdown.").Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_ProcessorClosed() {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	var droppedTasks []PriorityTask
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewLogger(zap.New(core)),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			OnTasksDropped: func(tasks []PriorityTask) {
+				droppedTasks = tasks
+			},
+		},
+	)
+	s.NoError(err)
+	impl := scheduler.(*weightedRoundRobinTaskSchedulerImpl)
+	impl.processor = s.mockProcessor
+
+	// the dispatcher is blocked by the processor until it's stopped
+	submittingCh := make(chan struct{})
+	stoppedCh := make(chan struct{})
+	s.mockProcessor.EXPECT().Start()
+	s.mockProcessor.EXPECT().Submit(gomock.Any()).DoAndReturn(func(_ Task) error {
+		close(submittingCh)
+		<-stoppedCh
+		return ErrTaskProcessorClosed
+	})
+	s.mockProcessor.EXPECT().Stop().Do(func() {
+		close(stoppedCh)
+	})
+	scheduler.Start()
+
+	refusedTask := NewMockPriorityTask(s.controller)
+	refusedTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.Submit(refusedTask))
+	<-submittingCh
+	queuedTask := NewMockPriorityTask(s.controller)
+	queuedTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.Submit(queuedTask))
+
+	// the refused task is neither nacked nor logged as an error, but dropped ahead of the queued task
+	scheduler.Stop()
+	s.Equal([]PriorityTask{refusedTask, queuedTask}, droppedTasks)
+	s.Zero(logs.Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestMaxConsecutiveProcessorFailures() {
+	var rejectReasons []string
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                         testSchedulerWeights,
+			QueueSize:                       s.queueSize,
+			WorkerCount:                     1,
+			DispatcherCount:                 1,
+			RetryPolicy:                     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxConsecutiveProcessorFailures: 2,
+			OnReject: func(_ PriorityTask, reason string) {
+				rejectReasons = append(rejectReasons, reason)
+			},
+		},
+	)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	core, logs := observer.New(zapcore.ErrorLevel)
+	scheduler.logger = loggerimpl.NewLogger(zap.New(core))
+	scheduler.processor = s.mockProcessor
+
+	// dispatcher is not started, so tasks are dispatched one at a time, and a success resets the count
+	processorErr := errors.New("processor is broken")
+	gomock.InOrder(
+		s.mockProcessor.EXPECT().Submit(gomock.Any()).Return(processorErr),
+		s.mockProcessor.EXPECT().Submit(gomock.Any()).Return(nil),
+		s.mockProcessor.EXPECT().Submit(gomock.Any()).Return(processorErr).Times(2),
+	)
+	for i := 0; i != 4; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		if i != 1 {
+			mockTask.EXPECT().Nack().Times(1)
+		}
+		s.NoError(scheduler.Submit(mockTask))
+		task, polledTask, ok := scheduler.nextTask()
+		s.True(ok)
+		scheduler.dispatchTask(task, polledTask)
+		if i != 3 {
+			s.Zero(logs.FilterMessage("Weighted round robin task scheduler failed as the processor keeps refusing tasks.").Len())
+		}
+	}
+	s.Equal(1, logs.FilterMessage("Weighted round robin task scheduler failed as the processor keeps refusing tasks.").Len())
+
+	rejectedTask := NewMockPriorityTask(s.controller)
+	rejectedTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.Equal(ErrSchedulerFailed, scheduler.Submit(rejectedTask))
+	s.Equal([]string{RejectReasonSchedulerFailed}, rejectReasons)
+	s.Zero(scheduler.numQueuedTasks())
+
+	var failedCount int64
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_scheduler_failed" {
+			failedCount += counter.Value()
+		}
+	}
+	s.Equal(int64(1), failedCount)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitToProcessor_QueueFull() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:            testSchedulerWeights,
+			QueueSize:          s.queueSize,
+			WorkerCount:        1,
+			DispatcherCount:    1,
+			ProcessorQueueSize: 1,
+			RetryPolicy:        backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	queueFullCount := func() int64 {
+		var count int64
+		for _, counter := range testScope.Snapshot().Counters() {
+			if counter.Name() == "test.prioritytask_processor_queue_full" {
+				count += counter.Value()
+			}
+		}
+		return count
+	}
+
+	var taskWG sync.WaitGroup
+	var tasks []PriorityTask
+	for i := 0; i != 2; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		mockTask.EXPECT().Execute().Return(nil).Times(1)
+		mockTask.EXPECT().Ack().Do(func() { taskWG.Done() }).Times(1)
+		tasks = append(tasks, mockTask)
+	}
+	taskWG.Add(len(tasks))
+
+	// the processor is not started, so the first task fills its buffer and the second one blocks
+	s.NoError(scheduler.submitToProcessor(tasks[0]))
+	s.Zero(queueFullCount())
+	occupancy := float64(-1)
+	for _, gauge := range testScope.Snapshot().Gauges() {
+		if gauge.Name() == "test.prioritytask_processor_queue_occupancy" {
+			occupancy = gauge.Value()
+		}
+	}
+	s.Equal(float64(1), occupancy)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- scheduler.submitToProcessor(tasks[1])
+	}()
+	for queueFullCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	scheduler.processor.Start()
+	defer scheduler.processor.Stop()
+	s.NoError(<-errCh)
+	taskWG.Wait()
+	s.Equal(int64(1), queueFullCount())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_Busy_Repeated() {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	for i := 0; i != 20; i++ {
+		scheduler, err := NewWeightedRoundRobinTaskScheduler(
+			loggerimpl.NewLogger(zap.New(core)),
+			metrics.NewClient(tally.NoopScope, metrics.Common),
+			&WeightedRoundRobinTaskSchedulerOptions{
+				Weights:         testSchedulerWeights,
+				QueueSize:       s.queueSize,
+				WorkerCount:     1,
+				DispatcherCount: 2,
+				RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+				OnTasksDropped:  func(_ []PriorityTask) {},
+			},
+		)
+		s.NoError(err)
+		scheduler.Start()
+
+		// stop once the processor is busy so that the dispatchers are blocked submitting to it
+		var executed sync.Once
+		executingCh := make(chan struct{})
+		for priority := 0; priority != 3; priority++ {
+			for j := 0; j != 5; j++ {
+				mockTask := NewMockPriorityTask(s.controller)
+				mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+				mockTask.EXPECT().Execute().DoAndReturn(func() error {
+					executed.Do(func() { close(executingCh) })
+					time.Sleep(time.Millisecond)
+					return nil
+				}).AnyTimes()
+				mockTask.EXPECT().Ack().AnyTimes()
+				mockTask.EXPECT().Nack().AnyTimes()
+				s.NoError(scheduler.Submit(mockTask))
+			}
+		}
+		<-executingCh
+		scheduler.Stop()
+	}
+	s.Zero(logs.Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSetMetricsScope() {
+	oldTestScope := tally.NewTestScope("old", nil)
+	newTestScope := tally.NewTestScope("new", nil)
+	s.scheduler.SetMetricsScope(metrics.NewClient(oldTestScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(s.scheduler.Submit(mockTask))
+
+	s.scheduler.SetMetricsScope(metrics.NewClient(newTestScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	s.NoError(s.scheduler.Submit(mockTask))
+	s.NoError(s.scheduler.Submit(mockTask))
+
+	s.Len(oldTestScope.Snapshot().Counters(), 1)
+	for _, counter := range oldTestScope.Snapshot().Counters() {
+		s.Equal(int64(1), counter.Value())
+	}
+	s.Len(newTestScope.Snapshot().Counters(), 1)
+	for _, counter := range newTestScope.Snapshot().Counters() {
+		s.Equal(int64(2), counter.Value())
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_NackOnStop() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0, // no dispatcher so that all tasks remain queued
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			NackOnStop:      true,
+		},
+	)
+	scheduler.Start()
+
+	mockNackers := []*MockBulkNacker{NewMockBulkNacker(s.controller), NewMockBulkNacker(s.controller)}
+	bulkTasks := make([][]PriorityTask, len(mockNackers))
+	for i := 0; i != 6; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 3).AnyTimes()
+		if i == 0 {
+			// task not supporting bulk nack
+			mockTask.EXPECT().Nack().Times(1)
+			s.NoError(scheduler.Submit(mockTask))
+			continue
+		}
+
+		mockBulkNackableTask := NewMockBulkNackableTask(s.controller)
+		mockBulkNackableTask.EXPECT().BulkNacker().Return(mockNackers[i%2]).Times(1)
+		task := &testBulkNackableTask{
+			MockPriorityTask:     mockTask,
+			MockBulkNackableTask: mockBulkNackableTask,
+		}
+		s.NoError(scheduler.Submit(task))
+		bulkTasks[i%2] = append(bulkTasks[i%2], task)
+	}
+
+	for idx, mockNacker := range mockNackers {
+		expectedTasks := bulkTasks[idx]
+		mockNacker.EXPECT().NackAll(gomock.Any()).DoAndReturn(func(tasks []PriorityTask) {
+			s.ElementsMatch(expectedTasks, tasks)
+		}).Times(1)
+	}
+	scheduler.Stop()
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestNackTasks_WrappedTasks() {
+	mockNacker := NewMockBulkNacker(s.controller)
+	var tasks []PriorityTask
+	for _, wrap := range []func(task PriorityTask) PriorityTask{
+		func(task PriorityTask) PriorityTask {
+			return newPrioritySnapshotTask(task, 1)
+		},
+		func(task PriorityTask) PriorityTask {
+			return &requeuedTask{taskWrapper: taskWrapper{PriorityTask: task}}
+		},
+		func(task PriorityTask) PriorityTask {
+			return &idempotentTaskWrapper{taskWrapper: taskWrapper{PriorityTask: task}}
+		},
+		func(task PriorityTask) PriorityTask {
+			return &concurrencyLimitedTask{taskWrapper: taskWrapper{PriorityTask: task}}
+		},
+	} {
+		mockBulkNackableTask := NewMockBulkNackableTask(s.controller)
+		mockBulkNackableTask.EXPECT().BulkNacker().Return(mockNacker).Times(1)
+		tasks = append(tasks, wrap(&testBulkNackableTask{
+			MockPriorityTask:     NewMockPriorityTask(s.controller),
+			MockBulkNackableTask: mockBulkNackableTask,
+		}))
+	}
+
+	// the wrapped tasks are nacked in bulk instead of one by one
+	mockNacker.EXPECT().NackAll(tasks).Times(1)
+	nackTasks(tasks)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_HandoffTarget() {
+	mockTarget := NewMockScheduler(s.controller)
+	var droppedTasks []PriorityTask
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0, // no dispatcher so that all tasks remain queued
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			HandoffTarget:   mockTarget,
+			OnTasksDropped: func(tasks []PriorityTask) {
+				droppedTasks = tasks
+			},
+		},
+	)
+	scheduler.Start()
+
+	var tasks []PriorityTask
+	for i := 0; i != 4; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 2).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+
+	// tasks are handed off in priority and submission order,
+	// tasks not accepted by the target fall back to OnTasksDropped
+	gomock.InOrder(
+		mockTarget.EXPECT().TrySubmit(tasks[0]).Return(true, nil),
+		mockTarget.EXPECT().TrySubmit(tasks[2]).Return(false, nil),
+		mockTarget.EXPECT().TrySubmit(tasks[1]).Return(false, ErrTaskSchedulerClosed),
+		mockTarget.EXPECT().TrySubmit(tasks[3]).Return(true, nil),
+	)
+	scheduler.Stop()
+	s.Equal([]PriorityTask{tasks[2], tasks[1]}, droppedTasks)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStop_DrainOnStop() {
+	var droppedTasks []PriorityTask
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0, // no dispatcher so that all tasks remain queued
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			PriorityOrder:   []int{1, 0, 2},
+			DrainOnStop:     true,
+			OnTasksDropped: func(tasks []PriorityTask) {
+				droppedTasks = tasks
+			},
+		},
+	)
+	scheduler.processor = s.mockProcessor
+	s.mockProcessor.EXPECT().Start().Times(1)
+	scheduler.Start()
+
+	var tasks []*MockPriorityTask
+	for _, priority := range []int{2, 0, 1, 0, 2, 1, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+
+	// tasks are drained strictly by the priority order and then in submission order, the processor
+	// is stopped afterwards, and tasks not accepted by the processor fall back to OnTasksDropped
+	gomock.InOrder(
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(tasks[2])).Return(nil),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(tasks[5])).Return(nil),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(tasks[1])).Return(nil),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(tasks[3])).Return(nil),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(tasks[0])).Return(nil),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(tasks[4])).Return(errors.New("some random error")),
+		s.mockProcessor.EXPECT().Stop().Times(1),
+	)
+	scheduler.Stop()
+	s.Len(droppedTasks, 2)
+	s.True(droppedTasks[0] == tasks[4])
+	s.True(droppedTasks[1] == tasks[6])
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatchDebugState() {
+	s.Empty(s.scheduler.DispatchDebugState())
+
+	for _, priority := range []int{0, 0, 0, 0, 1} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(s.scheduler.Submit(mockTask))
+	}
+
+	startTime := time.Now()
+	for i := 0; i != 2; i++ {
+		task, _, ok := s.scheduler.nextTask()
+		s.True(ok)
+		s.Equal(0, task.Priority())
+	}
+
+	debugInfos := s.scheduler.DispatchDebugState()
+	s.Len(debugInfos, 2)
+	s.False(debugInfos[0].LastServiced.Before(startTime))
+	debugInfos[0].LastServiced = time.Time{}
+	s.Equal([]PriorityDebugInfo{
+		{Priority: 0, Weight: 3, DispatchedInRound: 2, QueueDepth: 2},
+		{Priority: 1, Weight: 2, DispatchedInRound: 0, QueueDepth: 1},
+	}, debugInfos)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitReplace() {
+	oldTask := NewMockReplaceableTask(s.controller)
+	oldTask.EXPECT().Priority().Return(1).AnyTimes()
+	oldTask.EXPECT().ReplaceKey().Return("some random key").AnyTimes()
+	oldTask.EXPECT().Ack().Times(1)
+	s.NoError(s.scheduler.SubmitReplace(oldTask))
+
+	newTask := NewMockReplaceableTask(s.controller)
+	newTask.EXPECT().Priority().Return(1).AnyTimes()
+	newTask.EXPECT().ReplaceKey().Return("some random key").AnyTimes()
+	s.NoError(s.scheduler.SubmitReplace(newTask))
+
+	s.Equal(1, s.scheduler.taskQueues[1].Len())
+	task, ok := s.scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	s.Equal(newTask, task)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitFront() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+
+	var tasks []*MockPriorityTask
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+	for i := 0; i != 2; i++ {
+		frontTask := NewMockPriorityTask(s.controller)
+		frontTask.EXPECT().Priority().Return(1).AnyTimes()
+		s.NoError(scheduler.SubmitFront(frontTask))
+		// the latest task submitted to the front is dispatched first
+		tasks = append([]*MockPriorityTask{frontTask}, tasks...)
+	}
+
+	for _, expectedTask := range tasks {
+		task, _, ok := scheduler.nextTask()
+		s.True(ok)
+		s.True(task == expectedTask)
+	}
+	_, _, ok := scheduler.nextTask()
+	s.False(ok)
+
+	unknownTask := NewMockPriorityTask(s.controller)
+	unknownTask.EXPECT().Priority().Return(100).AnyTimes()
+	s.Error(scheduler.SubmitFront(unknownTask))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitFront_ConcurrentDispatch() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	scheduler.processor = s.mockProcessor
+	s.mockProcessor.EXPECT().Start().Times(1)
+	scheduler.Start()
+
+	var taskWG sync.WaitGroup
+	newTask := func() *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		taskWG.Add(1)
+		return mockTask
+	}
+	submitFn := func(_ Task) error {
+		taskWG.Done()
+		return nil
+	}
+
+	// the dispatcher is stuck submitting the first task while the others are queued
+	submittingCh := make(chan struct{})
+	unblockCh := make(chan struct{})
+	firstTask := newTask()
+	queuedTasks := []*MockPriorityTask{newTask(), newTask(), newTask()}
+	barrierTask := newTask()
+	expected := []*gomock.Call{
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(firstTask)).DoAndReturn(func(task Task) error {
+			close(submittingCh)
+			<-unblockCh
+			return submitFn(task)
+		}),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(barrierTask)).DoAndReturn(submitFn),
+	}
+	for _, queuedTask := range queuedTasks {
+		expected = append(expected, s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(queuedTask)).DoAndReturn(submitFn))
+	}
+	gomock.InOrder(expected...)
+
+	s.NoError(scheduler.Submit(firstTask))
+	<-submittingCh
+	for _, queuedTask := range queuedTasks {
+		s.NoError(scheduler.Submit(queuedTask))
+	}
+	s.NoError(scheduler.SubmitFront(barrierTask))
+	close(unblockCh)
+	taskWG.Wait()
+
+	s.mockProcessor.EXPECT().Stop().Times(1)
+	scheduler.Stop()
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitWithFailureCallback() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  1,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			SnapshotPriority: true,
+		},
+	)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	var taskWG sync.WaitGroup
+	var failures []error
+	onFailure := func(err error) {
+		failures = append(failures, err)
+	}
+
+	succeededTask := NewMockPriorityTask(s.controller)
+	succeededTask.EXPECT().Priority().Return(0).AnyTimes()
+	succeededTask.EXPECT().Execute().Return(nil).Times(1)
+	succeededTask.EXPECT().Ack().Do(func() { taskWG.Done() }).Times(1)
+
+	failedTask := NewMockPriorityTask(s.controller)
+	failedTask.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		failedTask.EXPECT().Execute().Return(errRetryable),
+		failedTask.EXPECT().HandleErr(errRetryable).Return(errRetryable),
+		failedTask.EXPECT().RetryErr(errRetryable).Return(true),
+		failedTask.EXPECT().Execute().Return(errNonRetryable),
+		failedTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable),
+		failedTask.EXPECT().RetryErr(errNonRetryable).Return(false),
+		failedTask.EXPECT().Nack().Do(func() {
+			// the callback is invoked before the task is nacked
+			s.Equal([]error{errNonRetryable}, failures)
+			taskWG.Done()
+		}),
+	)
+
+	taskWG.Add(2)
+	s.NoError(scheduler.SubmitWithFailureCallback(succeededTask, onFailure))
+	s.NoError(scheduler.SubmitWithFailureCallback(failedTask, onFailure))
+	taskWG.Wait()
+	s.Equal([]error{errNonRetryable}, failures)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestMaxConcurrencyByPriority() {
+	maxConcurrency := 2
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                  testSchedulerWeights,
+			QueueSize:                s.queueSize,
+			WorkerCount:              8,
+			DispatcherCount:          3,
+			RetryPolicy:              backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxConcurrencyByPriority: []int{0, 0, maxConcurrency},
+		},
+	)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	var taskWG sync.WaitGroup
+	var inFlight [3]int32
+	var maxInFlight [3]int32
+	numTasksPerPriority := 50
+	for i := 0; i != numTasksPerPriority; i++ {
+		for _, priority := range []int{0, 2} {
+			priority := priority
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			mockTask.EXPECT().Execute().DoAndReturn(func() error {
+				current := atomic.AddInt32(&inFlight[priority], 1)
+				for {
+					max := atomic.LoadInt32(&maxInFlight[priority])
+					if current <= max || atomic.CompareAndSwapInt32(&maxInFlight[priority], max, current) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&inFlight[priority], -1)
+				return nil
+			}).Times(1)
+			mockTask.EXPECT().Ack().Do(func() { taskWG.Done() }).Times(1)
+			taskWG.Add(1)
+			s.NoError(scheduler.Submit(mockTask))
+		}
+	}
+
+	taskWG.Wait()
+	s.True(atomic.LoadInt32(&maxInFlight[2]) <= int32(maxConcurrency))
+	limitedQueue := scheduler.dispatchQueueList[len(scheduler.dispatchQueueList)-1].(*concurrencyLimitedQueue)
+	s.Equal(2, limitedQueue.Priority())
+	s.Zero(atomic.LoadInt32(&limitedQueue.inFlight))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestBorrowCapacity() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                  testSchedulerWeights,
+			QueueSize:                s.queueSize,
+			WorkerCount:              1,
+			DispatcherCount:          0,
+			RetryPolicy:              backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxConcurrencyByPriority: []int{1, 1},
+			BorrowCapacity:           true,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	_, err := scheduler.getOrCreateTaskQueue(0)
+	s.NoError(err)
+
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	// the idle priority 0 lends its slot to the second task
+	for i := 0; i != 2; i++ {
+		_, _, ok := scheduler.nextTask()
+		s.True(ok)
+	}
+	_, _, ok := scheduler.nextTask()
+	s.False(ok)
+
+	borrowed := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_capacity_borrowed" {
+			s.Equal("1", counter.Tags()["task_priority"])
+			borrowed += counter.Value()
+		}
+	}
+	s.Equal(int64(1), borrowed)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestEffectiveConcurrency() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                    testSchedulerWeights,
+			QueueSize:                  s.queueSize,
+			WorkerCount:                1,
+			DispatcherCount:            0,
+			RetryPolicy:                backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxConcurrencyByPriority:   []int{0, 2},
+			EffectiveConcurrencyWindow: time.Hour,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	getEffectiveConcurrency := func() float64 {
+		for _, gauge := range testScope.Snapshot().Gauges() {
+			if gauge.Name() == "test.prioritytask_effective_concurrency" {
+				s.Equal("1", gauge.Tags()["task_priority"])
+				return gauge.Value()
+			}
+		}
+		return -1
+	}
+
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		mockTask.EXPECT().Ack().AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	// the third task waits for a slot, so the priority achieves its limit
+	var polledTasks []PriorityTask
+	for i := 0; i != 2; i++ {
+		task, _, ok := scheduler.nextTask()
+		s.True(ok)
+		polledTasks = append(polledTasks, task)
+	}
+	_, _, ok := scheduler.nextTask()
+	s.False(ok)
+	scheduler.reportEffectiveConcurrency(time.Now().Add(time.Hour))
+	s.InDelta(2, getEffectiveConcurrency(), 0.01)
+
+	// nothing is dispatched in the new window once both tasks are acked
+	for _, task := range polledTasks {
+		task.Ack()
+	}
+	scheduler.reportEffectiveConcurrency(time.Now().Add(2 * time.Hour))
+	s.InDelta(0, getEffectiveConcurrency(), 0.01)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestExecutionShare() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ExecutionShare:  true,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	submit := func(priority int, numTasks int) {
+		for i := 0; i != numTasks; i++ {
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			s.NoError(scheduler.Submit(mockTask))
+		}
+	}
+	nextPriority := func() int {
+		task, _, ok := scheduler.nextTask()
+		s.True(ok)
+		return task.Priority()
+	}
+
+	submit(2, 3)
+	s.Equal(2, nextPriority())
+	s.Equal(2, nextPriority())
+
+	// priority 2 already takes more than its share of 1/4 of the in-flight tasks
+	submit(0, 2)
+	s.Equal(0, nextPriority())
+	s.Equal(0, nextPriority())
+	s.Equal(2, nextPriority())
+	_, _, ok := scheduler.nextTask()
+	s.False(ok)
+
+	scheduler.reportExecutionShares()
+	shares := make(map[string]float64)
+	for _, gauge := range testScope.Snapshot().Gauges() {
+		switch gauge.Name() {
+		case "test.prioritytask_dispatch_share", "test.prioritytask_execution_share":
+			shares[gauge.Name()+"."+gauge.Tags()["task_priority"]] = gauge.Value()
+		}
+	}
+	s.Len(shares, 4)
+	s.InDelta(0.4, shares["test.prioritytask_dispatch_share.0"], 1e-9)
+	s.InDelta(0.6, shares["test.prioritytask_dispatch_share.2"], 1e-9)
+	s.InDelta(0.4, shares["test.prioritytask_execution_share.0"], 1e-9)
+	s.InDelta(0.6, shares["test.prioritytask_execution_share.2"], 1e-9)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestResourceBudgets() {
+	testScope := tally.NewTestScope("test", nil)
+	costs := make(map[PriorityTask]map[string]float64)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ResourceBudgets: map[string]float64{"cpu": 2, "api": 1},
+			ResourceCost: func(task PriorityTask) map[string]float64 {
+				return costs[task]
+			},
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	submit := func(priority int, cost map[string]float64) PriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		costs[mockTask] = cost
+		s.NoError(scheduler.Submit(mockTask))
+		return mockTask
+	}
+	nextTask := func() (PriorityTask, bool) {
+		task, _, ok := scheduler.nextTask()
+		if !ok {
+			return nil, false
+		}
+		return task, true
+	}
+	utilizations := func() map[string]float64 {
+		utilizations := make(map[string]float64)
+		for _, gauge := range testScope.Snapshot().Gauges() {
+			if gauge.Name() == "test.prioritytask_resource_utilization" {
+				utilizations[gauge.Tags()["resource_dimension"]] = gauge.Value()
+			}
+		}
+		return utilizations
+	}
+
+	apiAndCPUTask := submit(0, map[string]float64{"cpu": 1, "api": 1})
+	apiTask := submit(0, map[string]float64{"api": 1})
+	cpuTasks := []PriorityTask{
+		submit(1, map[string]float64{"cpu": 1}),
+		submit(2, map[string]float64{"cpu": 1}),
+	}
+
+	task, ok := nextTask()
+	s.True(ok)
+	s.Equal(apiAndCPUTask, unwrapSchedulerTask(task))
+	// the api task at the head of priority 0 exceeds the api budget, so the other priorities proceed
+	next, ok := nextTask()
+	s.True(ok)
+	s.Equal(cpuTasks[0], unwrapSchedulerTask(next))
+	_, ok = nextTask()
+	s.False(ok)
+	s.Equal(map[string]float64{"cpu": 1, "api": 1}, utilizations())
+
+	// releasing the cost of the first task makes room on both dimensions
+	apiAndCPUTask.(*MockPriorityTask).EXPECT().Ack().Times(1)
+	task.Ack()
+	s.Equal(map[string]float64{"cpu": 0.5, "api": 0}, utilizations())
+	var dispatched []Task
+	for i := 0; i != 2; i++ {
+		task, ok := nextTask()
+		s.True(ok)
+		dispatched = append(dispatched, unwrapSchedulerTask(task))
+	}
+	s.ElementsMatch([]Task{apiTask, cpuTasks[1]}, dispatched)
+	s.Equal(map[string]float64{"cpu": 1, "api": 1}, utilizations())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestResourceBudgets_OversizedTask() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ResourceBudgets: map[string]float64{"cpu": 1},
+		},
+	)
+	var tasks []*testResourceCostTask
+	for i := 0; i != 2; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		tasks = append(tasks, &testResourceCostTask{
+			MockPriorityTask: mockTask,
+			cost:             map[string]float64{"cpu": 3},
+		})
+		s.NoError(scheduler.Submit(tasks[i]))
+	}
+
+	// a task costing more than the budget is dispatched alone
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(tasks[0], unwrapSchedulerTask(task))
+	_, _, ok = scheduler.nextTask()
+	s.False(ok)
+
+	tasks[0].EXPECT().Nack().Times(1)
+	task.Nack()
+	task, _, ok = scheduler.nextTask()
+	s.True(ok)
+	s.Equal(tasks[1], unwrapSchedulerTask(task))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestReservedCapacity() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        4,
+			WorkerCount:      1,
+			DispatcherCount:  0,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ReservedCapacity: []int{2},
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	newTask := func(priority int) PriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+	usages := func() map[string]float64 {
+		usages := make(map[string]float64)
+		for _, gauge := range testScope.Snapshot().Gauges() {
+			usages[gauge.Name()+"."+gauge.Tags()["task_priority"]] = gauge.Value()
+		}
+		return usages
+	}
+
+	// the busy priority takes all the shared slots, and its next submission blocks
+	s.NoError(scheduler.Submit(newTask(1)))
+	s.NoError(scheduler.Submit(newTask(1)))
+	blockedTask := newTask(1)
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- scheduler.Submit(blockedTask)
+	}()
+	submitted, err := scheduler.TrySubmit(newTask(2))
+	s.NoError(err)
+	s.False(submitted)
+
+	// the reserved slots are still available to the priority they're reserved for
+	for i := 0; i != 2; i++ {
+		submitted, err := scheduler.TrySubmit(newTask(0))
+		s.NoError(err)
+		s.True(submitted)
+	}
+	submitted, err = scheduler.TrySubmit(newTask(0))
+	s.NoError(err)
+	s.False(submitted)
+	s.Equal(map[string]float64{
+		"test.prioritytask_reserved_capacity_usage.0": 2,
+		"test.prioritytask_shared_capacity_usage.0":   0,
+		"test.prioritytask_reserved_capacity_usage.1": 0,
+		"test.prioritytask_shared_capacity_usage.1":   2,
+	}, usages())
+
+	// a reserved slot released by dispatching can't be taken by the other priorities
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(0, task.Priority())
+	submitted, err = scheduler.TrySubmit(newTask(2))
+	s.NoError(err)
+	s.False(submitted)
+
+	// a shared slot released by dispatching unblocks the busy priority
+	for {
+		task, _, ok := scheduler.nextTask()
+		s.True(ok)
+		if task.Priority() == 1 {
+			break
+		}
+	}
+	s.NoError(<-doneCh)
+	s.Equal(2, scheduler.taskQueues[1].Len())
+	s.Equal(float64(2), usages()["test.prioritytask_shared_capacity_usage.1"])
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestWeightDrift() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:           testSchedulerWeights,
+			QueueSize:         s.queueSize,
+			WorkerCount:       1,
+			DispatcherCount:   0,
+			RetryPolicy:       backoff.NewExponentialRetryPolicy(time.Millisecond),
+			WeightDriftWindow: time.Hour,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	submit := func(priority int, numTasks int) {
+		for i := 0; i != numTasks; i++ {
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			s.NoError(scheduler.Submit(mockTask))
+		}
+	}
+	nextPriority := func() int {
+		task, _, ok := scheduler.nextTask()
+		s.True(ok)
+		return task.Priority()
+	}
+	weightDrift := func() (float64, bool) {
+		for _, gauge := range testScope.Snapshot().Gauges() {
+			if gauge.Name() == "test.prioritytask_weight_drift" {
+				return gauge.Value(), true
+			}
+		}
+		return 0, false
+	}
+
+	// nothing is emitted if no task is dispatched
+	scheduler.reportWeightDrift()
+	_, ok := weightDrift()
+	s.False(ok)
+
+	// priority 1 is backlogged but none of its tasks is dispatched within the window
+	submit(0, 3)
+	submit(1, 1)
+	for i := 0; i != 2; i++ {
+		s.Equal(0, nextPriority())
+	}
+	scheduler.reportWeightDrift()
+	drift, ok := weightDrift()
+	s.True(ok)
+	s.InDelta(1, drift, 1e-9)
+
+	// the dispatch ratio of the new window matches the weights of priority 0 and 1
+	s.Equal(0, nextPriority())
+	s.Equal(1, nextPriority())
+	submit(0, 2)
+	submit(1, 1)
+	for i := 0; i != 3; i++ {
+		nextPriority()
+	}
+	scheduler.reportWeightDrift()
+	drift, ok = weightDrift()
+	s.True(ok)
+	s.InDelta(0, drift, 1e-9)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestPeek() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  0,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			SnapshotPriority: true,
+		},
+	)
+	s.Nil(scheduler.Peek(1, 10))
+
+	// queued tasks are returned as submitted rather than as their priority snapshots
+	var mockTasks []PriorityTask
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+		mockTasks = append(mockTasks, mockTask)
+	}
+
+	peeked := scheduler.Peek(1, 2)
+	s.Len(peeked, 2)
+	for idx, task := range peeked {
+		s.True(task == mockTasks[idx])
+	}
+	s.Len(scheduler.Peek(1, 10), 3)
+	s.Equal(3, scheduler.taskQueues[1].Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitIdempotent() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:              testSchedulerWeights,
+			QueueSize:            s.queueSize,
+			WorkerCount:          1,
+			DispatcherCount:      1,
+			RetryPolicy:          backoff.NewExponentialRetryPolicy(time.Millisecond),
+			IdempotencyCacheSize: 10,
+			IdempotencyTTL:       time.Minute,
+		},
+	)
+
+	newTask := func() *testIdempotentTask {
+		mockIdempotentTask := NewMockIdempotentTask(s.controller)
+		mockIdempotentTask.EXPECT().IdempotencyKey().Return("some random key").AnyTimes()
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		return &testIdempotentTask{
+			MockPriorityTask:   mockTask,
+			MockIdempotentTask: mockIdempotentTask,
+		}
+	}
+
+	deduped, err := scheduler.SubmitIdempotent(newTask())
+	s.NoError(err)
+	s.False(deduped)
+	deduped, err = scheduler.SubmitIdempotent(newTask())
+	s.NoError(err)
+	s.True(deduped)
+	submitted, err := scheduler.TrySubmit(newTask())
+	s.NoError(err)
+	s.True(submitted)
+	s.Equal(1, scheduler.taskQueues[1].Len())
+
+	// key is forgotten once the task is nacked
+	task, ok := scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	task.(*idempotentTaskWrapper).PriorityTask.(*testIdempotentTask).MockPriorityTask.EXPECT().Nack().Times(1)
+	task.Nack()
+	deduped, err = scheduler.SubmitIdempotent(newTask())
+	s.NoError(err)
+	s.False(deduped)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitIdempotent_OptionalInterfaces() {
+	var sizedTasks []PriorityTask
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:              testSchedulerWeights,
+			QueueSize:            4,
+			WorkerCount:          1,
+			DispatcherCount:      0,
+			RetryPolicy:          backoff.NewExponentialRetryPolicy(time.Millisecond),
+			IdempotencyCacheSize: 10,
+			IdempotencyTTL:       time.Minute,
+			LoadShedding: map[int]LoadSheddingCurve{
+				1: {LowWatermark: 0, MaxProbability: 1},
+			},
+			SizeOf: func(task PriorityTask) int64 {
+				sizedTasks = append(sizedTasks, task)
+				return 10
+			},
+			MaxQueuedBytes: 100,
+		},
+	)
+	scheduler.shedRandom = func() float64 { return 0 }
+
+	// the second task would be shed if it's not seen as non-droppable
+	tasks := []*testIdempotentOptionalTask{s.newIdempotentOptionalTask("key-1"), s.newIdempotentOptionalTask("key-2")}
+	for _, task := range tasks {
+		s.NoError(scheduler.Submit(task))
+	}
+	s.NotEmpty(sizedTasks)
+	for _, task := range sizedTasks {
+		s.IsType(&testIdempotentOptionalTask{}, task)
+	}
+
+	queuedTask, ok := scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	s.IsType(&idempotentTaskWrapper{}, queuedTask)
+	s.True(unwrapSchedulerTask(queuedTask) == tasks[0])
+	s.Equal(tasks[0].MetricTags(), queuedTask.(MetricTaggedTask).MetricTags())
+	s.NoError(queuedTask.(ContextAwareTask).ExecuteWithContext(context.Background()))
+	s.True(tasks[0].executedWithContext)
+	_, ok = unwrapSchedulerTask(queuedTask).(PreemptibleTask)
+	s.True(ok)
+	policyTask, ok := unwrapSchedulerTask(queuedTask).(RetryPolicyTask)
+	s.True(ok)
+	s.True(policyTask.RetryPolicy() == tasks[0].retryPolicy)
+
+	// the task is held for DynamicPriority instead of being queued by its static priority
+	scheduler = s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:              testSchedulerWeights,
+			QueueSize:            4,
+			WorkerCount:          1,
+			DispatcherCount:      0,
+			RetryPolicy:          backoff.NewExponentialRetryPolicy(time.Millisecond),
+			IdempotencyCacheSize: 10,
+			IdempotencyTTL:       time.Minute,
+			DynamicPriority:      true,
+		},
+	)
+	s.NoError(scheduler.Submit(s.newIdempotentOptionalTask("key-1")))
+	remaining, perPriority := scheduler.DrainProgress()
+	s.Equal(1, remaining)
+	for _, numTasks := range perPriority {
+		s.Zero(numTasks)
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_YieldEvery() {
+	s.scheduler.options.DispatchYieldEvery = 2
+	s.scheduler.processor = s.mockProcessor
+
+	numTasks := 5
+	var taskWG sync.WaitGroup
+	taskWG.Add(numTasks)
+	s.mockProcessor.EXPECT().Submit(gomock.Any()).DoAndReturn(func(_ Task) error {
+		taskWG.Done()
+		return nil
+	}).Times(numTasks)
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 3).AnyTimes()
+		s.NoError(s.scheduler.Submit(mockTask))
+	}
+
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	taskWG.Wait()
+	close(s.scheduler.shutdownCh)
+	<-doneCh
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_MaxTasksPerRound() {
+	s.scheduler.options.MaxTasksPerRound = 2
+	s.scheduler.processor = s.mockProcessor
+
+	numTasks := 5
+	var taskWG sync.WaitGroup
+	taskWG.Add(numTasks)
+	s.mockProcessor.EXPECT().Submit(gomock.Any()).DoAndReturn(func(_ Task) error {
+		taskWG.Done()
+		return nil
+	}).Times(numTasks)
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 3).AnyTimes()
+		s.NoError(s.scheduler.Submit(mockTask))
+	}
+
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	// all tasks are dispatched across several rounds with a single notification
+	taskWG.Wait()
+	close(s.scheduler.shutdownCh)
+	<-doneCh
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestLockFreeQueues() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       4,
+			WorkerCount:     2,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			LockFreeQueues:  true,
+		},
+	)
+	s.Error(scheduler.SetQueueSize(0, 8))
+
+	numSubmitters := 4
+	numTasksPerSubmitter := 50
+	var tasksWG sync.WaitGroup
+	tasksWG.Add(numSubmitters * numTasksPerSubmitter)
+	scheduler.Start()
+	defer scheduler.Stop()
+	for submitter := 0; submitter != numSubmitters; submitter++ {
+		go func(submitter int) {
+			for i := 0; i != numTasksPerSubmitter; i++ {
+				// submitters block on the full queues
+				s.NoError(scheduler.Submit(&benchmarkPriorityTask{
+					priority:  (submitter + i) % 3,
+					waitGroup: &tasksWG,
+				}))
+			}
+		}(submitter)
+	}
+	tasksWG.Wait()
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSetQueueSize() {
+	s.Error(s.scheduler.SetQueueSize(5, 10)) // unknown priority
+	s.Error(s.scheduler.SetQueueSize(1, 0))
+
+	s.NoError(s.scheduler.SetQueueSize(1, 2))
+	s.Equal(2, s.scheduler.taskQueues[1].Cap())
+	for i := 0; i != 2; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(1).AnyTimes()
+		submitted, err := s.scheduler.TrySubmit(mockTask)
+		s.NoError(err)
+		s.True(submitted)
+	}
+	s.Error(s.scheduler.SetQueueSize(1, 1))
+	s.Equal(2, s.scheduler.taskQueues[1].Cap())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestMaxQueueAge() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxQueueAge:     map[int]time.Duration{1: time.Millisecond},
+		},
+	)
+
+	// dispatcher is not started, so tasks are only dispatched via nextTask
+	staleTask := NewMockPriorityTask(s.controller)
+	staleTask.EXPECT().Priority().Return(1).AnyTimes()
+	staleTask.EXPECT().Nack().Times(1)
+	s.NoError(scheduler.Submit(staleTask))
+	oldTask := NewMockPriorityTask(s.controller)
+	oldTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.NoError(scheduler.Submit(oldTask))
+	time.Sleep(5 * time.Millisecond)
+
+	freshTask := NewMockPriorityTask(s.controller)
+	freshTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.Submit(freshTask))
+
+	// priorities without max age never age out
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(oldTask, task)
+
+	task, _, ok = scheduler.nextTask()
+	s.True(ok)
+	s.Equal(freshTask, task)
+	s.Empty(scheduler.agedOutTasks)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitWithEnqueueTime() {
+	var rejectReasons []string
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxQueueAge:     map[int]time.Duration{1: time.Minute},
+			OnReject: func(_ PriorityTask, reason string) {
+				rejectReasons = append(rejectReasons, reason)
+			},
+		},
+	)
+
+	futureTask := NewMockPriorityTask(s.controller)
+	futureTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.Equal(ErrEnqueueTimeInFuture, scheduler.SubmitWithEnqueueTime(futureTask, time.Now().Add(time.Hour)))
+	s.Equal([]string{RejectReasonValidationFailed}, rejectReasons)
+	s.Zero(scheduler.numQueuedTasks())
+
+	// dispatcher is not started, so tasks are only dispatched via nextTask
+	staleTask := NewMockPriorityTask(s.controller)
+	staleTask.EXPECT().Priority().Return(1).AnyTimes()
+	staleTask.EXPECT().Nack().Times(1)
+	s.NoError(scheduler.SubmitWithEnqueueTime(staleTask, time.Now().Add(-time.Hour)))
+	skewedTask := NewMockPriorityTask(s.controller)
+	skewedTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.SubmitWithEnqueueTime(skewedTask, time.Now().Add(100*time.Millisecond)))
+
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(skewedTask, task)
+	s.Len(rejectReasons, 1)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSingleWorker_ExecutionOrder() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:            testSchedulerWeights,
+			QueueSize:          s.queueSize,
+			WorkerCount:        8,
+			DispatcherCount:    3,
+			ProcessorQueueSize: 16,
+			RetryPolicy:        backoff.NewExponentialRetryPolicy(time.Millisecond),
+			SingleWorker:       true,
+		},
+	)
+	s.Error(scheduler.Reconfigure(ReconfigureOptions{WorkerCount: 2}))
+
+	var taskWG sync.WaitGroup
+	var executing int32
+	var executionOrder []int
+	numTasksPerPriority := 4
+	// tasks are submitted before starting the scheduler, so the dispatch order is deterministic
+	for i := 0; i != numTasksPerPriority; i++ {
+		for priority := 0; priority != 3; priority++ {
+			taskID := priority*numTasksPerPriority + i
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			mockTask.EXPECT().Execute().DoAndReturn(func() error {
+				s.Equal(int32(1), atomic.AddInt32(&executing, 1))
+				executionOrder = append(executionOrder, taskID)
+				time.Sleep(100 * time.Microsecond)
+				return nil
+			}).Times(1)
+			mockTask.EXPECT().Ack().Do(func() {
+				atomic.AddInt32(&executing, -1)
+				taskWG.Done()
+			}).Times(1)
+			taskWG.Add(1)
+			s.NoError(scheduler.Submit(mockTask))
+		}
+	}
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	taskWG.Wait()
+	s.Equal([]int{
+		0, 1, 2, 4, 5, 8, // round 1
+		3, 6, 7, 9, // round 2
+		10, // round 3
+		11, // round 4
+	}, executionOrder)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSingleWorker_Retry() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:      testSchedulerWeights,
+			QueueSize:    s.queueSize,
+			RetryPolicy:  backoff.NewExponentialRetryPolicy(time.Millisecond),
+			SingleWorker: true,
+		},
+	)
+
+	var taskWG sync.WaitGroup
+	var executionOrder []string
+	failingTask := NewMockPriorityTask(s.controller)
+	failingTask.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		failingTask.EXPECT().Execute().DoAndReturn(func() error {
+			executionOrder = append(executionOrder, "failing")
+			return errRetryable
+		}).Times(2),
+		failingTask.EXPECT().Execute().DoAndReturn(func() error {
+			executionOrder = append(executionOrder, "failing")
+			return nil
+		}).Times(1),
+	)
+	failingTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(2)
+	failingTask.EXPECT().RetryErr(errRetryable).Return(true).Times(2)
+	failingTask.EXPECT().Ack().Do(func() { taskWG.Done() }).Times(1)
+	taskWG.Add(1)
+	s.NoError(scheduler.Submit(failingTask))
+
+	nextTask := NewMockPriorityTask(s.controller)
+	nextTask.EXPECT().Priority().Return(0).AnyTimes()
+	nextTask.EXPECT().Execute().DoAndReturn(func() error {
+		executionOrder = append(executionOrder, "next")
+		return nil
+	}).Times(1)
+	nextTask.EXPECT().Ack().Do(func() { taskWG.Done() }).Times(1)
+	taskWG.Add(1)
+	s.NoError(scheduler.Submit(nextTask))
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	taskWG.Wait()
+	s.Equal([]string{"failing", "failing", "failing", "next"}, executionOrder)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatchLimiter() {
+	var allowPriority0 int32
+	mockLimiter := NewMockDispatchLimiter(s.controller)
+	mockLimiter.EXPECT().Allow(gomock.Any()).DoAndReturn(func(task PriorityTask) bool {
+		return task.Priority() != 0 || atomic.LoadInt32(&allowPriority0) == 1
+	}).AnyTimes()
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DispatchLimiter: mockLimiter,
+		},
+	)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	executedCh := make(chan int, 2)
+	for _, priority := range []int{0, 1} {
+		priority := priority
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Execute().Return(nil).Times(1)
+		mockTask.EXPECT().Ack().Do(func() { executedCh <- priority }).Times(1)
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	// priority 0 is held back while other priorities proceed
+	s.Equal(1, <-executedCh)
+	select {
+	case <-executedCh:
+		s.Fail("denied task should not be executed")
+	case <-time.After(3 * dispatchLimiterRetryInterval):
+	}
+	s.Equal(1, scheduler.Stats().QueuedTasks[0])
+
+	// denied task is retried without new submissions
+	atomic.StoreInt32(&allowPriority0, 1)
+	s.Equal(0, <-executedCh)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitAtomic() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       2,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	newMockTask := func(priority int) *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+
+	s.NoError(scheduler.SubmitAtomic(nil))
+	tasks := []PriorityTask{newMockTask(1), newMockTask(0), newMockTask(1)}
+	s.NoError(scheduler.SubmitAtomic(tasks))
+	s.Equal(map[int]int{0: 1, 1: 2}, scheduler.Stats().QueuedTasks)
+
+	// no task is enqueued if any of the queues doesn't have enough capacity
+	s.Equal(ErrInsufficientCapacity, scheduler.SubmitAtomic([]PriorityTask{newMockTask(0), newMockTask(1)}))
+	s.Equal(map[int]int{0: 1, 1: 2}, scheduler.Stats().QueuedTasks)
+	s.Error(scheduler.SubmitAtomic([]PriorityTask{newMockTask(0), newMockTask(3)}))
+	s.Equal(map[int]int{0: 1, 1: 2}, scheduler.Stats().QueuedTasks)
+
+	// reservations are released after the atomic submission fails
+	s.NoError(scheduler.SubmitAtomic([]PriorityTask{newMockTask(0)}))
+	s.Equal(map[int]int{0: 2, 1: 2}, scheduler.Stats().QueuedTasks)
+
+	// tasks of the same priority are enqueued in the given order
+	task, ok := scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	s.Equal(tasks[0], task)
+	task, ok = scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	s.Equal(tasks[2], task)
+	s.Len(scheduler.taskQueues[0].Close(), 2)
+
+	scheduler.Start()
+	scheduler.Stop()
+	s.Equal(ErrTaskSchedulerClosed, scheduler.SubmitAtomic([]PriorityTask{newMockTask(0)}))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitBatch_Partial() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       2,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	newMockTask := func(priority int) *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+
+	unaccepted, err := scheduler.SubmitBatch([]PriorityTask{newMockTask(0), newMockTask(0)}, true)
+	s.NoError(err)
+	s.Empty(unaccepted)
+	<-scheduler.notifyCh
+
+	// tasks which don't fit are returned, others are enqueued
+	tasks := []PriorityTask{newMockTask(0), newMockTask(1), newMockTask(0), newMockTask(1)}
+	unaccepted, err = scheduler.SubmitBatch(tasks, true)
+	s.NoError(err)
+	s.Equal([]PriorityTask{tasks[0], tasks[2]}, unaccepted)
+	s.Equal(map[int]int{0: 2, 1: 2}, scheduler.Stats().QueuedTasks)
+	// dispatchers are notified once for the batch
+	s.Len(scheduler.notifyCh, 1)
+	<-scheduler.notifyCh
+
+	// once a task is not accepted, the following tasks of the same priority
+	// are not accepted either, even if there's space in the queue meanwhile
+	tasks = []PriorityTask{newMockTask(1), newMockTask(1)}
+	_, ok := scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	_, ok = scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	s.True(scheduler.taskQueues[1].Offer(newMockTask(1)))
+	s.True(scheduler.taskQueues[1].Offer(newMockTask(1)))
+	unaccepted, err = scheduler.SubmitBatch(tasks, true)
+	s.NoError(err)
+	s.Equal(tasks, unaccepted)
+	s.Empty(scheduler.notifyCh)
+
+	// no task is enqueued if any of the tasks has an unknown priority
+	_, err = scheduler.SubmitBatch([]PriorityTask{newMockTask(2), newMockTask(3)}, true)
+	s.Error(err)
+	s.Zero(scheduler.Stats().QueuedTasks[2])
+
+	s.Len(scheduler.taskQueues[0].Close(), 2)
+	s.Len(scheduler.taskQueues[1].Close(), 2)
+	scheduler.Start()
+	scheduler.Stop()
+	tasks = []PriorityTask{newMockTask(0)}
+	unaccepted, err = scheduler.SubmitBatch(tasks, true)
+	s.Equal(ErrTaskSchedulerClosed, err)
+	s.Equal(tasks, unaccepted)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitBatch_Blocking() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       1,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+
+	var tasks []PriorityTask
+	var executionOrder []PriorityTask
+	doneCh := make(chan struct{})
+	for i := 0; i != 5; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		mockTask.EXPECT().Execute().DoAndReturn(func() error {
+			executionOrder = append(executionOrder, mockTask)
+			return nil
+		}).Times(1)
+		if i == 4 {
+			mockTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+		} else {
+			mockTask.EXPECT().Ack().Times(1)
+		}
+		tasks = append(tasks, mockTask)
+	}
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	unaccepted, err := scheduler.SubmitBatch(tasks, false)
+	s.NoError(err)
+	s.Empty(unaccepted)
+	<-doneCh
+	s.Equal(tasks, executionOrder)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRetryRequeue() {
+	retryPolicy := backoff.NewExponentialRetryPolicy(time.Millisecond)
+	retryPolicy.SetMaximumAttempts(3)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                  testSchedulerWeights,
+			QueueSize:                s.queueSize,
+			WorkerCount:              1,
+			DispatcherCount:          1,
+			RetryPolicy:              retryPolicy,
+			RetryRequeue:             true,
+			MaxConcurrencyByPriority: []int{1},
+		},
+	)
+
+	var executionOrder []string
+	doneCh := make(chan struct{})
+	failingTask := NewMockPriorityTask(s.controller)
+	failingTask.EXPECT().Priority().Return(0).AnyTimes()
+	failingTask.EXPECT().Execute().DoAndReturn(func() error {
+		executionOrder = append(executionOrder, "failing")
+		return errRetryable
+	}).Times(4)
+	failingTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(4)
+	failingTask.EXPECT().RetryErr(errRetryable).Return(true).Times(3)
+	failingTask.EXPECT().Nack().Do(func() { close(doneCh) }).Times(1)
+	s.NoError(scheduler.Submit(failingTask))
+
+	freshTask := NewMockPriorityTask(s.controller)
+	freshTask.EXPECT().Priority().Return(0).AnyTimes()
+	freshTask.EXPECT().Execute().DoAndReturn(func() error {
+		executionOrder = append(executionOrder, "fresh")
+		return nil
+	}).Times(1)
+	freshTask.EXPECT().Ack().Times(1)
+	s.NoError(scheduler.Submit(freshTask))
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	<-doneCh
+
+	// the failing task goes to the tail of the queue, and the retry policy
+	// still bounds the number of attempts across requeues
+	s.Equal([]string{"failing", "fresh", "failing", "failing", "failing"}, executionOrder)
+	// slot is released after the task is nacked
+	limitedQueue := scheduler.dispatchQueueList[0].(*concurrencyLimitedQueue)
+	for atomic.LoadInt32(&limitedQueue.inFlight) != 0 {
+		runtime.Gosched()
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRetryRequeueBackoff() {
+	backoffInterval := 50 * time.Millisecond
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:             testSchedulerWeights,
+			QueueSize:           s.queueSize,
+			WorkerCount:         1,
+			DispatcherCount:     1,
+			RetryPolicy:         backoff.NewExponentialRetryPolicy(backoffInterval),
+			RetryRequeue:        true,
+			RetryRequeueBackoff: true,
+		},
+	)
+
+	var executionTimes []time.Time
+	var executionOrder []string
+	doneCh := make(chan struct{})
+	failingTask := NewMockPriorityTask(s.controller)
+	failingTask.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		failingTask.EXPECT().Execute().DoAndReturn(func() error {
+			executionTimes = append(executionTimes, time.Now())
+			executionOrder = append(executionOrder, "failing")
+			return errRetryable
+		}),
+		failingTask.EXPECT().Execute().DoAndReturn(func() error {
+			executionTimes = append(executionTimes, time.Now())
+			executionOrder = append(executionOrder, "failing")
+			return nil
+		}),
+	)
+	failingTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	failingTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	failingTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+	s.NoError(scheduler.Submit(failingTask))
+
+	freshTask := NewMockPriorityTask(s.controller)
+	freshTask.EXPECT().Priority().Return(0).AnyTimes()
+	freshTask.EXPECT().Execute().DoAndReturn(func() error {
+		executionOrder = append(executionOrder, "fresh")
+		return nil
+	}).Times(1)
+	freshTask.EXPECT().Ack().Times(1)
+	s.NoError(scheduler.Submit(freshTask))
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	<-doneCh
+
+	// the worker executes the fresh task while the failing one waits out the backoff
+	s.Equal([]string{"failing", "fresh", "failing"}, executionOrder)
+	// the retry policy jitters the interval by up to 20%
+	s.True(executionTimes[1].Sub(executionTimes[0]) >= backoffInterval*8/10)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRetryRequeueBackoff_TaskRetryPolicy() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:             testSchedulerWeights,
+			QueueSize:           s.queueSize,
+			WorkerCount:         1,
+			DispatcherCount:     1,
+			RetryPolicy:         backoff.NewExponentialRetryPolicy(time.Second),
+			RetryRequeue:        true,
+			RetryRequeueBackoff: true,
+		},
+	)
+
+	mockTask := NewMockPriorityTask(s.controller)
+	s.True(scheduler.retryRequeueDelay(&requeuedTask{taskWrapper: taskWrapper{PriorityTask: mockTask}}, 1, time.Now()) > 500*time.Millisecond)
+
+	// requeued tasks are held for the backoff interval of their own policy
+	policyTask := &testRetryPolicyTask{
+		MockPriorityTask: mockTask,
+		retryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+	}
+	s.True(scheduler.retryRequeueDelay(&requeuedTask{taskWrapper: taskWrapper{PriorityTask: policyTask}}, 1, time.Now()) < 100*time.Millisecond)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRetryRequeueBackoff_Stop() {
+	droppedCh := make(chan []PriorityTask, 1)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:             testSchedulerWeights,
+			QueueSize:           s.queueSize,
+			WorkerCount:         1,
+			DispatcherCount:     1,
+			RetryPolicy:         backoff.NewExponentialRetryPolicy(10 * time.Second),
+			RetryRequeue:        true,
+			RetryRequeueBackoff: true,
+			OnTasksDropped:      func(tasks []PriorityTask) { droppedCh <- tasks },
+		},
+	)
+
+	requeuedCh := make(chan struct{})
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	mockTask.EXPECT().Execute().Return(errRetryable).Times(1)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	mockTask.EXPECT().RetryErr(errRetryable).DoAndReturn(func(error) bool {
+		close(requeuedCh)
+		return true
+	}).Times(1)
+	s.NoError(scheduler.Submit(mockTask))
+	scheduler.Start()
+	<-requeuedCh
+	for {
+		scheduler.delayedRetries.Lock()
+		numHeld := len(scheduler.delayedRetries.timers)
+		scheduler.delayedRetries.Unlock()
+		if numHeld != 0 {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	// the held task is dropped along with the queued tasks
+	scheduler.Stop()
+	droppedTasks := <-droppedCh
+	s.Len(droppedTasks, 1)
+	s.True(unwrapSchedulerTask(droppedTasks[0]) == mockTask)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRetryRequeue_MaxResubmits() {
+	exhaustedCh := make(chan PriorityTask, 1)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                  testSchedulerWeights,
+			QueueSize:                s.queueSize,
+			WorkerCount:              1,
+			DispatcherCount:          1,
+			RetryPolicy:              backoff.NewExponentialRetryPolicy(time.Millisecond),
+			RetryRequeue:             true,
+			MaxResubmits:             2,
+			MaxConcurrencyByPriority: []int{1},
+			OnTaskExhausted: func(task PriorityTask, err error) {
+				s.Equal(errRetryable, err)
+				exhaustedCh <- task
+			},
+		},
+	)
+
+	// the retry policy allows unlimited attempts, the task is exhausted
+	// after it's requeued twice and fails for the third time
+	poisonTask := NewMockPriorityTask(s.controller)
+	poisonTask.EXPECT().Priority().Return(0).AnyTimes()
+	poisonTask.EXPECT().Execute().Return(errRetryable).Times(3)
+	poisonTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(3)
+	poisonTask.EXPECT().RetryErr(errRetryable).Return(true).Times(3)
+	s.NoError(scheduler.Submit(poisonTask))
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	// OnTaskExhausted sees the submitted task
+	s.Equal(poisonTask, <-exhaustedCh)
+	limitedQueue := scheduler.dispatchQueueList[0].(*concurrencyLimitedQueue)
+	s.Zero(atomic.LoadInt32(&limitedQueue.inFlight))
+
+	_, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			WorkerPool:      &SharedWorkerPool{},
+			OnTaskExhausted: func(task PriorityTask, err error) {},
+		},
+	)
+	s.Error(err)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDeadLetterQueue() {
+	var exhaustedTasks []PriorityTask
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:             testSchedulerWeights,
+			QueueSize:           s.queueSize,
+			WorkerCount:         1,
+			DispatcherCount:     1,
+			RetryPolicy:         backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DeadLetterQueueSize: map[int]int{0: 1},
+			OnTaskExhausted: func(task PriorityTask, err error) {
+				exhaustedTasks = append(exhaustedTasks, task)
+			},
+		},
+	)
+	s.NotNil(scheduler.processor.(*parallelTaskProcessorImpl).options.OnTaskExhausted)
+
+	newExhaustedTask := func(priority int) *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+	deadLetter := newExhaustedTask(0)
+	scheduler.onTaskExhausted(deadLetter, errNonRetryable)
+	// the dead letter queue is full, and priorities without
+	// dead letter queue are handed to OnTaskExhausted
+	overflowTask := newExhaustedTask(0)
+	scheduler.onTaskExhausted(overflowTask, errNonRetryable)
+	otherTask := newExhaustedTask(1)
+	scheduler.onTaskExhausted(otherTask, errNonRetryable)
+	s.Equal([]PriorityTask{overflowTask, otherTask}, exhaustedTasks)
+
+	s.Equal([]PriorityTask{deadLetter}, scheduler.DeadLetterQueue(0))
+	s.Empty(scheduler.DeadLetterQueue(0))
+	s.Nil(scheduler.DeadLetterQueue(1))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDeadLetterQueue_DropOldest() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                  testSchedulerWeights,
+			QueueSize:                s.queueSize,
+			WorkerCount:              1,
+			DispatcherCount:          1,
+			RetryPolicy:              backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DeadLetterQueueSize:      map[int]int{0: 2},
+			DeadLetterOverflowPolicy: DeadLetterOverflowPolicyDropOldest,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	var tasks []PriorityTask
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		if i == 0 {
+			// dropped to make room for the last task
+			mockTask.EXPECT().Nack().Times(1)
+		}
+		scheduler.onTaskExhausted(mockTask, errNonRetryable)
+		tasks = append(tasks, mockTask)
+	}
+	// priorities without dead letter queue are nacked
+	nackedTask := NewMockPriorityTask(s.controller)
+	nackedTask.EXPECT().Priority().Return(1).AnyTimes()
+	nackedTask.EXPECT().Nack().Times(1)
+	scheduler.onTaskExhausted(nackedTask, errNonRetryable)
+
+	s.Equal(tasks[1:], scheduler.DeadLetterQueue(0))
+
+	counters := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		counters[counter.Name()] += counter.Value()
+	}
+	s.Equal(int64(3), counters["test.prioritytask_dead_lettered"])
+	s.Equal(int64(1), counters["test.prioritytask_dead_letter_dropped"])
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestWarmupWorkerCount() {
+	warmupDuration := 60 * time.Second
+	for elapsed, expectedWorkerCount := range map[time.Duration]int{
+		0:                2,
+		10 * time.Second: 3,
+		29 * time.Second: 4,
+		30 * time.Second: 5,
+		59 * time.Second: 7,
+		60 * time.Second: 8,
+		90 * time.Second: 8,
+	} {
+		s.Equal(expectedWorkerCount, warmupWorkerCount(2, 8, warmupDuration, elapsed), elapsed.String())
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestWarmup() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:           testSchedulerWeights,
+			QueueSize:         s.queueSize,
+			WorkerCount:       4,
+			DispatcherCount:   1,
+			RetryPolicy:       backoff.NewExponentialRetryPolicy(time.Millisecond),
+			WarmupDuration:    30 * time.Millisecond,
+			WarmupWorkerCount: 1,
+		},
+	)
+	s.Equal(1, scheduler.Stats().Processor.ConfiguredWorkers)
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	s.Equal(1, scheduler.Stats().Processor.LiveWorkers)
+
+	// worker count never decreases during the warmup
+	lastWorkerCount := 1
+	for lastWorkerCount != 4 {
+		workerCount := scheduler.Stats().Processor.ConfiguredWorkers
+		s.True(workerCount >= lastWorkerCount)
+		lastWorkerCount = workerCount
+		time.Sleep(time.Millisecond)
+	}
+	s.Equal(4, scheduler.Stats().Processor.LiveWorkers)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestWarmup_Reconfigure() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:           testSchedulerWeights,
+			QueueSize:         s.queueSize,
+			WorkerCount:       4,
+			DispatcherCount:   1,
+			RetryPolicy:       backoff.NewExponentialRetryPolicy(time.Millisecond),
+			WarmupDuration:    20 * time.Millisecond,
+			WarmupWorkerCount: 1,
+		},
+	)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	// warmup no longer changes the worker count once it's reconfigured
+	s.NoError(scheduler.Reconfigure(ReconfigureOptions{WorkerCount: 2}))
+	time.Sleep(40 * time.Millisecond)
+	s.Equal(2, scheduler.Stats().Processor.ConfiguredWorkers)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSnapshotPriority() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(testScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  1,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			RetryRequeue:     true,
+			SnapshotPriority: true,
+		},
+	)
+	s.NoError(err)
+
+	// a task whose priority changes every time it's called
+	priorityCalls := int32(0)
+	doneCh := make(chan struct{})
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().DoAndReturn(func() int {
+		return int(atomic.AddInt32(&priorityCalls, 1)) - 1
+	}).AnyTimes()
+	gomock.InOrder(
+		mockTask.EXPECT().Execute().Return(errRetryable).Times(1),
+		mockTask.EXPECT().Execute().Return(nil).Times(1),
+	)
+	mockTask.EXPECT().HandleErr(errRetryable).Return(errRetryable).Times(1)
+	mockTask.EXPECT().RetryErr(errRetryable).Return(true).Times(1)
+	mockTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	s.NoError(scheduler.Submit(mockTask))
+	<-doneCh
+
+	// the priority observed at submit time is used for queueing, retry and metrics
+	s.Equal(int32(1), atomic.LoadInt32(&priorityCalls))
+	for _, counter := range testScope.Snapshot().Counters() {
+		if priority, ok := counter.Tags()["task_priority"]; ok {
+			s.Equal("0", priority)
+		}
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSnapshotPriority_SubmitFutureCancel() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  1,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			SnapshotPriority: true,
+		},
+	)
+
+	priorityCalls := 0
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().DoAndReturn(func() int {
+		priorityCalls++
+		return priorityCalls
+	}).AnyTimes()
+	future, err := scheduler.SubmitFuture(mockTask)
+	s.NoError(err)
+	s.Equal(1, scheduler.taskQueues[1].Len())
+
+	s.True(future.Cancel())
+	s.Zero(scheduler.taskQueues[1].Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestMaxPriorities() {
+	manyWeights := make(map[string]interface{}, MaxPriorities+1)
+	manyIntWeights := make(map[int]int, MaxPriorities+1)
+	for priority := 0; priority <= MaxPriorities; priority++ {
+		manyWeights[strconv.Itoa(priority)] = 1
+		manyIntWeights[priority] = 1
+	}
+	options := &WeightedRoundRobinTaskSchedulerOptions{
+		Weights:         dynamicconfig.GetMapPropertyFn(manyWeights),
+		QueueSize:       s.queueSize,
+		WorkerCount:     1,
+		DispatcherCount: 1,
+		RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+	}
+	_, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		options,
+	)
+	s.Error(err)
+	s.Error(s.scheduler.Reconfigure(ReconfigureOptions{Weights: manyIntWeights}))
+
+	options.AllowManyPriorities = true
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(options)
+	s.NoError(scheduler.Reconfigure(ReconfigureOptions{Weights: manyIntWeights}))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRecentEvents() {
+	s.Nil(s.scheduler.RecentEvents())
+
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:           testSchedulerWeights,
+			QueueSize:         s.queueSize,
+			WorkerCount:       1,
+			DispatcherCount:   1,
+			RetryPolicy:       backoff.NewExponentialRetryPolicy(time.Millisecond),
+			EventRecorderSize: 10,
+		},
+	)
+	scheduler.processor = s.mockProcessor
+
+	dispatchErr := errors.New("some random error")
+	mockTask1 := NewMockPriorityTask(s.controller)
+	mockTask1.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask2 := NewMockPriorityTask(s.controller)
+	mockTask2.EXPECT().Priority().Return(1).AnyTimes()
+	mockTask2.EXPECT().Nack().Times(1)
+	s.NoError(scheduler.Submit(mockTask1))
+	s.NoError(scheduler.Submit(mockTask2))
+
+	s.mockProcessor.EXPECT().Submit(mockTask1).Return(nil).Times(1)
+	s.mockProcessor.EXPECT().Submit(mockTask2).Return(dispatchErr).Times(1)
+	task, ok := scheduler.taskQueues[0].Poll()
+	s.True(ok)
+	scheduler.dispatchTask(task, polledTaskInfo{})
+	task, ok = scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	scheduler.dispatchTask(task, polledTaskInfo{})
+
+	mockTask3 := NewMockPriorityTask(s.controller)
+	mockTask3.EXPECT().Priority().Return(2).AnyTimes()
+	s.NoError(scheduler.Submit(mockTask3))
+	scheduler.dropQueuedTasks()
+
+	var eventTypes []SchedulerEventType
+	var priorities []int
+	for _, event := range scheduler.RecentEvents() {
+		eventTypes = append(eventTypes, event.Type)
+		priorities = append(priorities, event.Priority)
+	}
+	s.Equal([]SchedulerEventType{
+		EventTypeSubmit, EventTypeSubmit, EventTypeDispatch, EventTypeDispatchError, EventTypeSubmit, EventTypeDrop,
+	}, eventTypes)
+	s.Equal([]int{0, 1, 0, 1, 2, 2}, priorities)
+	s.Equal(dispatchErr, scheduler.RecentEvents()[3].Err)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestPreemptRoundOnHighPriority() {
+	// the number of low priority tasks dispatched after a high priority task is submitted mid-round
+	dispatchedBeforeHighPriority := func(preemptRound bool) (int, int64) {
+		scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+			&WeightedRoundRobinTaskSchedulerOptions{
+				Weights:                    dynamicconfig.GetMapPropertyFn(map[string]interface{}{"0": 1, "1": 1, "2": 5}),
+				QueueSize:                  s.queueSize,
+				WorkerCount:                1,
+				DispatcherCount:            0,
+				RetryPolicy:                backoff.NewExponentialRetryPolicy(time.Millisecond),
+				PreemptRoundOnHighPriority: preemptRound,
+			},
+		)
+		testScope := tally.NewTestScope("test", nil)
+		scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+		// the round dispatches one task of each priority before the low priority tasks
+		for _, priority := range []int{0, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2} {
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			s.NoError(scheduler.Submit(mockTask))
+		}
+		for _, priority := range []int{0, 1, 2} {
+			task, _, ok := scheduler.nextTask()
+			s.True(ok)
+			s.Equal(priority, task.Priority())
+		}
+
+		highPriorityTask := NewMockPriorityTask(s.controller)
+		highPriorityTask.EXPECT().Priority().Return(0).AnyTimes()
+		s.NoError(scheduler.Submit(highPriorityTask))
+		numDispatched := 0
+		for {
+			task, _, ok := scheduler.nextTask()
+			s.True(ok)
+			if task == highPriorityTask {
+				break
+			}
+			numDispatched++
+		}
+		// tasks not scanned before the task last dispatched don't abort the round
+		lowPriorityTask := NewMockPriorityTask(s.controller)
+		lowPriorityTask.EXPECT().Priority().Return(2).AnyTimes()
+		s.NoError(scheduler.Submit(lowPriorityTask))
+		_, _, ok := scheduler.nextTask()
+		s.True(ok)
+
+		numPreempted := int64(0)
+		for _, counter := range testScope.Snapshot().Counters() {
+			if counter.Name() == "test.prioritytask_round_preempted" {
+				numPreempted += counter.Value()
+			}
+		}
+		return numDispatched, numPreempted
+	}
+
+	numDispatched, numPreempted := dispatchedBeforeHighPriority(false)
+	s.Equal(4, numDispatched)
+	s.Zero(numPreempted)
+	numDispatched, numPreempted = dispatchedBeforeHighPriority(true)
+	s.Zero(numDispatched)
+	s.Equal(int64(1), numPreempted)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestFairQueuing() {
+	s.IsType(&WeightedRoundRobinDispatchStrategy{}, s.scheduler.dispatchStrategy)
+
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			FairQueuing:     true,
+		},
+	)
+	s.IsType(&VirtualTimeFairQueuingDispatchStrategy{}, scheduler.dispatchStrategy)
+
+	// weights reconfigured are used by the strategy
+	s.NoError(scheduler.Reconfigure(ReconfigureOptions{Weights: map[int]int{0: 0, 1: 1, 2: 1}}))
+	for _, priority := range []int{0, 1} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+	}
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(1, task.Priority())
+	// the zero weight priority is only drained afterwards
+	task, _, ok = scheduler.nextTask()
+	s.True(ok)
+	s.Equal(0, task.Priority())
+	_, _, ok = scheduler.nextTask()
+	s.False(ok)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestZeroWeight() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         dynamicconfig.GetMapPropertyFn(map[string]interface{}{"0": 2, "1": 0, "2": 0, "3": 1}),
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	submit := func(priorities ...int) {
+		for _, priority := range priorities {
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			s.NoError(scheduler.Submit(mockTask))
+		}
+	}
+	dispatchAll := func() []int {
+		var priorities []int
+		for {
+			task, _, ok := scheduler.nextTask()
+			if !ok {
+				return priorities
+			}
+			priorities = append(priorities, task.Priority())
+		}
+	}
+
+	// zero weight priorities are drained in scan order once other priorities are empty
+	submit(2, 1, 0, 3, 1, 0, 0)
+	s.Equal([]int{0, 0, 3, 0, 1, 1, 2}, dispatchAll())
+
+	// a zero weight priority competes with others once it gets a positive weight
+	s.NoError(scheduler.Reconfigure(ReconfigureOptions{Weights: map[int]int{0: 1, 1: 1, 2: 0, 3: 1}}))
+	submit(2, 1, 0)
+	s.Equal([]int{0, 1, 2}, dispatchAll())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcherState() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 2,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	scheduler.processor = s.mockProcessor
+	s.Equal(DispatcherStateStopped, scheduler.DispatcherState())
+
+	s.mockProcessor.EXPECT().Start().Times(1)
+	scheduler.Start()
+	awaitState := func(expected string) {
+		for scheduler.DispatcherState() != expected {
+			runtime.Gosched()
+		}
+	}
+	awaitState(DispatcherStateIdle)
+
+	// one dispatcher is stuck submitting while the other one is idle
+	submittingCh := make(chan struct{})
+	unblockCh := make(chan struct{})
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(func(_ Task) error {
+		close(submittingCh)
+		<-unblockCh
+		return nil
+	})
+	s.NoError(scheduler.Submit(mockTask))
+	<-submittingCh
+	s.Equal(DispatcherStateSubmitting, scheduler.DispatcherState())
+
+	close(unblockCh)
+	awaitState(DispatcherStateIdle)
+
+	s.mockProcessor.EXPECT().Stop().Times(1)
+	scheduler.Stop()
+	s.Equal(DispatcherStateStopped, scheduler.DispatcherState())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestCircuitBreaker_RetrySlowStart() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                        testSchedulerWeights,
+			QueueSize:                      s.queueSize,
+			WorkerCount:                    1,
+			DispatcherCount:                1,
+			RetryPolicy:                    backoff.NewExponentialRetryPolicy(time.Millisecond),
+			CircuitBreakerFailureThreshold: 1,
+			MaxRetriesPerSecond:            10,
+			RetrySlowStartWindow:           time.Minute,
+		},
+	)
+	slowStart := scheduler.processor.(*parallelTaskProcessorImpl).retrySlowStart
+	s.NotNil(slowStart)
+
+	// the retry budget ramps again once the dependency recovers
+	scheduler.onCircuitBreakerStateChange("some dependency", true)
+	s.False(slowStart.ramping)
+	scheduler.onCircuitBreakerStateChange("some dependency", false)
+	s.True(slowStart.ramping)
+	s.Equal(float64(minRetrySlowStartRate), slowStart.rate)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestHealthy() {
+	stalenessWindow := 20 * time.Millisecond
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:               testSchedulerWeights,
+			QueueSize:             s.queueSize,
+			WorkerCount:           1,
+			DispatcherCount:       1,
+			RetryPolicy:           backoff.NewExponentialRetryPolicy(time.Millisecond),
+			HealthStalenessWindow: stalenessWindow,
+		},
+	)
+	scheduler.processor = s.mockProcessor
+	healthy, reason := scheduler.Healthy()
+	s.False(healthy)
+	s.NotEmpty(reason)
+
+	s.mockProcessor.EXPECT().Start().Times(1)
+	scheduler.Start()
+	healthy, _ = scheduler.Healthy()
+	s.True(healthy)
+
+	// the dispatcher is stuck submitting the first task while the second one is queued
+	unblockCh := make(chan struct{})
+	mockTask1 := NewMockPriorityTask(s.controller)
+	mockTask1.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask2 := NewMockPriorityTask(s.controller)
+	mockTask2.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask1)).DoAndReturn(func(_ Task) error {
+			<-unblockCh
+			return nil
+		}),
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask2)).Return(nil),
+	)
+	s.NoError(scheduler.Submit(mockTask1))
+	for scheduler.numQueuedTasks() != 0 {
+		runtime.Gosched()
+	}
+	s.NoError(scheduler.Submit(mockTask2))
+	time.Sleep(2 * stalenessWindow)
+	healthy, reason = scheduler.Healthy()
+	s.False(healthy)
+	s.Contains(reason, "1 queued tasks")
+
+	// idle dispatchers are healthy
+	close(unblockCh)
+	for scheduler.numQueuedTasks() != 0 {
+		runtime.Gosched()
+	}
+	time.Sleep(2 * stalenessWindow)
+	healthy, _ = scheduler.Healthy()
+	s.True(healthy)
+
+	s.mockProcessor.EXPECT().Stop().Times(1)
+	scheduler.Stop()
+	healthy, reason = scheduler.Healthy()
+	s.False(healthy)
+	s.NotEmpty(reason)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestBatchCounters() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			BatchCounters:   true,
+		},
+	)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	for _, priority := range []int{0, 0, 0, 1} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+	}
+	getSubmitRequests := func() map[string]int64 {
+		submitRequests := make(map[string]int64)
+		for _, counter := range testScope.Snapshot().Counters() {
+			if counter.Name() == "test.prioritytask_submit_request" {
+				submitRequests[counter.Tags()["task_priority"]] += counter.Value()
+			}
+		}
+		return submitRequests
+	}
+	s.Empty(getSubmitRequests())
+
+	scheduler.flushCounters()
+	s.Equal(map[string]int64{"0": 3, "1": 1}, getSubmitRequests())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestPerPriorityScope() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  1,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			PerPriorityScope: true,
+		},
+	)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	s.True(scheduler.getPriorityMetricsScope(1) == scheduler.getPriorityMetricsScope(1))
+
+	for _, priority := range []int{0, 0, 1} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+	}
+	submitRequests := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_submit_request" {
+			submitRequests[counter.Tags()["task_priority"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{"0": 2, "1": 1}, submitRequests)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitMetricsScope() {
+	for _, batchCounters := range []bool{false, true} {
+		submitTestScope := tally.NewTestScope("submit", nil)
+		scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+			&WeightedRoundRobinTaskSchedulerOptions{
+				Weights:            testSchedulerWeights,
+				QueueSize:          s.queueSize,
+				WorkerCount:        1,
+				DispatcherCount:    0,
+				RetryPolicy:        backoff.NewExponentialRetryPolicy(time.Millisecond),
+				BatchCounters:      batchCounters,
+				SubmitMetricsScope: metrics.NewClient(submitTestScope, metrics.Common).Scope(metrics.TaskSchedulerScope),
+			},
+		)
+		testScope := tally.NewTestScope("test", nil)
+		scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+		for _, priority := range []int{0, 1, 100} {
+			mockTask := NewMockPriorityTask(s.controller)
+			mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+			if priority == 100 {
+				s.Error(scheduler.Submit(mockTask))
+				continue
+			}
+			s.NoError(scheduler.Submit(mockTask))
+		}
+		s.Equal(2, scheduler.numQueuedTasks())
+		scheduler.flushCounters()
+
+		counters := make(map[string]int64)
+		for _, counter := range submitTestScope.Snapshot().Counters() {
+			counters[counter.Name()] += counter.Value()
+		}
+		s.Equal(map[string]int64{
+			"submit.prioritytask_submit_request": 3,
+			"submit.prioritytask_rejected":       1,
+		}, counters)
+		timers := 0
+		for _, timer := range submitTestScope.Snapshot().Timers() {
+			s.Equal("submit.prioritytask_submit_latency", timer.Name())
+			timers += len(timer.Values())
+		}
+		s.Equal(3, timers)
+		s.Empty(testScope.Snapshot().Counters())
+		s.Empty(testScope.Snapshot().Timers())
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestEndToEndLatency() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			EndToEndLatency: true,
+		},
+	)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	var tasksWG sync.WaitGroup
+	tasksWG.Add(2)
+	// the task is retried within the processor before it succeeds
+	succeededTask := NewMockPriorityTask(s.controller)
+	succeededTask.EXPECT().Priority().Return(0).AnyTimes()
+	gomock.InOrder(
+		succeededTask.EXPECT().Execute().Return(errRetryable),
+		succeededTask.EXPECT().Execute().Return(nil),
+	)
+	succeededTask.EXPECT().HandleErr(errRetryable).Return(errRetryable)
+	succeededTask.EXPECT().RetryErr(errRetryable).Return(true)
+	succeededTask.EXPECT().Ack().Do(func() { tasksWG.Done() })
+	failedTask := NewMockPriorityTask(s.controller)
+	failedTask.EXPECT().Priority().Return(1).AnyTimes()
+	failedTask.EXPECT().Execute().Return(errNonRetryable)
+	failedTask.EXPECT().HandleErr(errNonRetryable).Return(errNonRetryable)
+	failedTask.EXPECT().RetryErr(errNonRetryable).Return(false)
+	failedTask.EXPECT().Nack().Do(func() { tasksWG.Done() })
+
+	scheduler.Start()
+	s.NoError(scheduler.Submit(succeededTask))
+	s.NoError(scheduler.Submit(failedTask))
+	tasksWG.Wait()
+	scheduler.Stop()
+
+	outcomes := make(map[string]string)
+	for _, timer := range testScope.Snapshot().Timers() {
+		if timer.Name() == "test.prioritytask_end_to_end_latency" {
+			s.Len(timer.Values(), 1)
+			outcomes[timer.Tags()["task_priority"]] = timer.Tags()["task_outcome"]
+		}
+	}
+	s.Equal(map[string]string{"0": "success", "1": "exhausted"}, outcomes)
+
+	// requeued tasks keep the time they're first queued
+	scheduler = s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0, // tasks are only dispatched via nextTask
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			EndToEndLatency: true,
+		},
+	)
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	_, err := scheduler.getOrCreateTaskQueue(0)
+	s.NoError(err)
+	queueTime := time.Now().Add(-time.Minute)
+	s.True(scheduler.requeueRetry(newEndToEndTask(mockTask, scheduler, 0, queueTime), 1, queueTime))
+	task, polledTask, ok := scheduler.nextTask()
+	s.True(ok)
+	timedTask, _ := unwrapEndToEndTask(scheduler.wrapEndToEndTask(task, polledTask.priority, polledTask.enqueueTime))
+	s.True(timedTask.queueTime.Equal(queueTime))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestQuiesce() {
+	testScope := tally.NewTestScope("test", nil)
+	s.scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	s.scheduler.processor = s.mockProcessor
+	s.mockProcessor.EXPECT().Start().Times(1)
+	s.scheduler.Start()
+	getQuiesced := func() float64 {
+		for _, gauge := range testScope.Snapshot().Gauges() {
+			if gauge.Name() == "test.prioritytask_quiesced" {
+				return gauge.Value()
+			}
+		}
+		return -1
+	}
+
+	s.scheduler.Quiesce()
+	s.Equal(float64(1), getQuiesced())
+	numTasks := 5
+	var tasksWG sync.WaitGroup
+	tasksWG.Add(numTasks)
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 3).AnyTimes()
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(func(_ Task) error {
+			tasksWG.Done()
+			return nil
+		}).Times(1)
+		s.NoError(s.scheduler.Submit(mockTask))
+	}
+
+	// tasks are kept in the queues while quiesced
+	time.Sleep(10 * time.Millisecond)
+	s.Equal(numTasks, s.scheduler.numQueuedTasks())
+	healthy, _ := s.scheduler.Healthy()
+	s.True(healthy)
+
+	s.scheduler.Resume()
+	s.Equal(float64(0), getQuiesced())
+	tasksWG.Wait()
+	s.Zero(s.scheduler.numQueuedTasks())
+
+	s.mockProcessor.EXPECT().Stop().Times(1)
+	s.scheduler.Stop()
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestReconfigure() {
+	s.Error(s.scheduler.Reconfigure(ReconfigureOptions{}))
+	s.Error(s.scheduler.Reconfigure(ReconfigureOptions{WorkerCount: -1}))
+	s.Error(s.scheduler.Reconfigure(ReconfigureOptions{Weights: map[int]int{0: -1}}))
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1)
+	s.NoError(s.scheduler.Submit(mockTask))
+
+	// priority 1 has a task queue, so its weight can't be removed
+	s.Error(s.scheduler.Reconfigure(ReconfigureOptions{Weights: map[int]int{0: 1}}))
+
+	newWeights := map[int]int{0: 5, 1: 1}
+	s.NoError(s.scheduler.Reconfigure(ReconfigureOptions{
+		Weights:     newWeights,
+		WorkerCount: 3,
+	}))
+	s.Equal(newWeights, s.scheduler.getWeights())
+	s.Equal(3, s.scheduler.processor.(*parallelTaskProcessorImpl).workerCount)
+
+	s.scheduler.processor = s.mockProcessor
+	s.Error(s.scheduler.Reconfigure(ReconfigureOptions{WorkerCount: 3}))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestUpdateWeights() {
+	s.Error(s.scheduler.UpdateWeights([]int{5, 1}))
+	s.Error(s.scheduler.UpdateWeights([]int{5, 1, 1, 1}))
+	s.Error(s.scheduler.UpdateWeights([]int{5, 0, 1}))
+	s.Error(s.scheduler.UpdateWeights([]int{5, -1, 1}))
+	s.Equal(map[int]int{0: 3, 1: 2, 2: 1}, s.scheduler.getWeights())
+
+	s.NoError(s.scheduler.UpdateWeights([]int{1, 2, 3}))
+	s.Equal(map[int]int{0: 1, 1: 2, 2: 3}, s.scheduler.getWeights())
+
+	// weights of non-contiguous priorities can't be indexed by priority
+	s.NoError(s.scheduler.Reconfigure(ReconfigureOptions{Weights: map[int]int{0: 3, 2: 2, 5: 1}}))
+	err := s.scheduler.UpdateWeights([]int{1, 2, 3})
+	s.Error(err)
+	s.Contains(err.Error(), "priority 5 is not in [0, 3)")
+	s.Equal(map[int]int{0: 3, 2: 2, 5: 1}, s.scheduler.getWeights())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestUpdateWeights_QueuedTasksDispatched() {
+	var lock sync.Mutex
+	var executed []int
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+
+	numTasks := 100
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(numTasks)
+	for i := 0; i != numTasks; i++ {
+		priority := i % 3
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Execute().DoAndReturn(func() error {
+			lock.Lock()
+			defer lock.Unlock()
+			executed = append(executed, priority)
+			return nil
+		}).Times(1)
+		mockTask.EXPECT().Ack().Do(func() { waitGroup.Done() }).Times(1)
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	// weights are updated while the dispatcher is running, no queued task is lost
+	scheduler.Start()
+	for _, weights := range [][]int{{1, 1, 1}, {1, 5, 10}, {10, 1, 1}} {
+		s.NoError(scheduler.UpdateWeights(weights))
+	}
+	waitGroup.Wait()
+	scheduler.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	s.Len(executed, numTasks)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRefreshWeights() {
+	testScope := tally.NewTestScope("test", nil)
+	var lock sync.Mutex
+	dcWeights := map[string]interface{}{"0": 3, "1": 2, "2": 1}
+	setWeights := func(weights map[string]interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		dcWeights = weights
+	}
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights: func(...dynamicconfig.FilterOption) map[string]interface{} {
+				lock.Lock()
+				defer lock.Unlock()
+				return dcWeights
+			},
+			QueueSize:              s.queueSize,
+			WorkerCount:            1,
+			DispatcherCount:        1,
+			RetryPolicy:            backoff.NewExponentialRetryPolicy(time.Millisecond),
+			WeightsRefreshInterval: time.Millisecond,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	unknownTask := NewMockPriorityTask(s.controller)
+	unknownTask.EXPECT().Priority().Return(3).AnyTimes()
+	s.Error(scheduler.Submit(unknownTask))
+
+	// the first task blocks the only worker, so that the others stay queued while the weights change
+	releaseCh := make(chan struct{})
+	var waitGroup sync.WaitGroup
+	newTask := func(priority int, execute func() error) *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Execute().DoAndReturn(execute).Times(1)
+		mockTask.EXPECT().Ack().Do(func() { waitGroup.Done() }).Times(1)
+		waitGroup.Add(1)
+		return mockTask
+	}
+	s.NoError(scheduler.Submit(newTask(0, func() error {
+		<-releaseCh
+		return nil
+	})))
+	for i := 0; i != 10; i++ {
+		s.NoError(scheduler.Submit(newTask(i%3, func() error { return nil })))
+	}
+	scheduler.Start()
+
+	newWeights := map[int]int{0: 1, 1: 2, 2: 3, 3: 4}
+	setWeights(map[string]interface{}{"0": 1, "1": 2, "2": 3, "3": 4})
+	deadline := time.Now().Add(10 * time.Second)
+	for !reflect.DeepEqual(newWeights, scheduler.getWeights()) {
+		if time.Now().After(deadline) {
+			s.FailNow("weights reloaded from dynamic config are not applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// a queue is created for the priority added to dynamic config
+	s.NoError(scheduler.Submit(newTask(3, func() error { return nil })))
+
+	// the priority with a task queue can't be removed, so the reloaded weights are rejected
+	setWeights(map[string]interface{}{"0": 1, "1": 2, "2": 3})
+	time.Sleep(20 * time.Millisecond)
+	s.Equal(newWeights, scheduler.getWeights())
+
+	close(releaseCh)
+	waitGroup.Wait()
+	scheduler.Stop()
+
+	numUpdates := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_weights_updated" {
+			numUpdates += counter.Value()
+		}
+	}
+	s.Equal(int64(1), numUpdates)
+	weights := make(map[string]float64)
+	for _, gauge := range testScope.Snapshot().Gauges() {
+		if gauge.Name() == "test.prioritytask_weight" {
+			weights[gauge.Tags()["task_priority"]] = gauge.Value()
+		}
+	}
+	s.Equal(map[string]float64{"0": 1, "1": 2, "2": 3, "3": 4}, weights)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitWithPosition() {
+	priorities := []int{0, 0, 1, 0}
+	expectedPositions := []int{0, 1, 0, 2}
+	for idx, priority := range priorities {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		position, err := s.scheduler.SubmitWithPosition(mockTask)
+		s.NoError(err)
+		s.Equal(expectedPositions[idx], position)
+	}
+
+	_, ok := s.scheduler.taskQueues[0].Poll()
+	s.True(ok)
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	position, err := s.scheduler.SubmitWithPosition(mockTask)
+	s.NoError(err)
+	s.Equal(2, position)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitAndAwaitDispatch() {
+	s.scheduler.processor = s.mockProcessor
+
+	// the task stays queued when the context is done first
+	queuedTask := NewMockPriorityTask(s.controller)
+	queuedTask.EXPECT().Priority().Return(1).AnyTimes()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, s.scheduler.SubmitAndAwaitDispatch(ctx, queuedTask))
+	s.Equal(1, s.scheduler.numQueuedTasks())
+	// remove the queued task so that it's not dispatched
+	_, ok := s.scheduler.taskQueues[1].Poll()
+	s.True(ok)
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Ack().Times(1)
+	submitCh := make(chan struct{})
+	s.mockProcessor.EXPECT().Submit(gomock.Any()).DoAndReturn(func(task Task) error {
+		<-submitCh
+		// the processor may complete the task before Submit returns
+		task.Ack()
+		return nil
+	}).Times(1)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.scheduler.SubmitAndAwaitDispatch(context.Background(), mockTask)
+	}()
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	select {
+	case <-errCh:
+		s.Fail("SubmitAndAwaitDispatch should block until the task is submitted to the processor")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(submitCh)
+	s.NoError(<-errCh)
+
+	close(s.scheduler.shutdownCh)
+	<-doneCh
+	s.Equal(ErrTaskSchedulerClosed, s.scheduler.SubmitAndAwaitDispatch(context.Background(), mockTask))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestSubmitAndAwaitDispatch_NotDispatched() {
+	awaitedTask := newDispatchAwaitedTask(NewMockPriorityTask(s.controller))
+	awaitedTask.PriorityTask.(*MockPriorityTask).EXPECT().Nack().Times(2)
+	awaitedTask.Nack()
+	<-awaitedTask.dispatchedCh
+	s.Equal(ErrTaskNotDispatched, awaitedTask.err)
+
+	// nacked by the processor
+	awaitedTask = newDispatchAwaitedTask(awaitedTask.PriorityTask)
+	awaitedTask.beforeDispatch()
+	awaitedTask.Nack()
+	<-awaitedTask.dispatchedCh
+	s.NoError(awaitedTask.err)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDrain() {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1)
+	s.NoError(s.scheduler.Submit(mockTask))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, s.scheduler.Drain(ctx))
+
+	_, ok := s.scheduler.taskQueues[1].Poll()
+	s.True(ok)
+	s.NoError(s.scheduler.Drain(context.Background()))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestShutdown() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     2,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+	_, err := scheduler.Shutdown(context.Background())
+	s.Equal(ErrTaskSchedulerClosed, err)
+
+	numTasks := 10
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 3).AnyTimes()
+		mockTask.EXPECT().Execute().DoAndReturn(func() error {
+			time.Sleep(time.Millisecond)
+			return nil
+		}).Times(1)
+		mockTask.EXPECT().Ack().Times(1)
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	scheduler.Start()
+	summary, err := scheduler.Shutdown(context.Background())
+	s.NoError(err)
+	s.Equal(ShutdownSummary{Completed: int64(numTasks)}, summary)
+	s.True(scheduler.isStopped())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestShutdown_DeadlineMidDrain() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			NackOnStop:      true,
+		},
+	)
+	scheduler.Start()
+	// the queued tasks are never dispatched while quiesced
+	scheduler.Quiesce()
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		mockTask.EXPECT().Nack().Times(1)
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	summary, err := scheduler.Shutdown(ctx)
+	s.Equal(context.DeadlineExceeded, err)
+	s.Equal(ShutdownSummary{AbandonedQueued: 3}, summary)
+	s.True(scheduler.isStopped())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestShutdown_DeadlineMidExecution() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                  testSchedulerWeights,
+			QueueSize:                s.queueSize,
+			WorkerCount:              1,
+			DispatcherCount:          1,
+			RetryPolicy:              backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ProcessorShutdownTimeout: 10 * time.Millisecond,
+		},
+	)
+	startedCh := make(chan struct{})
+	blockCh := make(chan struct{})
+	ackedCh := make(chan struct{})
+	blockingTask := NewMockPriorityTask(s.controller)
+	blockingTask.EXPECT().Priority().Return(0).AnyTimes()
+	blockingTask.EXPECT().Execute().DoAndReturn(func() error {
+		close(startedCh)
+		<-blockCh
+		return nil
+	}).Times(1)
+	blockingTask.EXPECT().Ack().Do(func() { close(ackedCh) }).Times(1)
+	s.NoError(scheduler.Submit(blockingTask))
+	completedTask := NewMockPriorityTask(s.controller)
+	completedTask.EXPECT().Priority().Return(1).AnyTimes()
+	// the worker may or may not pick up the second task once the first one completes after the stop
+	completedTask.EXPECT().Execute().Return(nil).MaxTimes(1)
+	completedTask.EXPECT().Ack().MaxTimes(1)
+	s.NoError(scheduler.Submit(completedTask))
+	scheduler.Start()
+	<-startedCh
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	type result struct {
+		summary ShutdownSummary
+		err     error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		summary, err := scheduler.Shutdown(ctx)
+		resultCh <- result{summary, err}
+	}()
+	for atomic.LoadInt32(&scheduler.shuttingDown) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// submissions are rejected once the shutdown starts
+	rejectedTask := NewMockPriorityTask(s.controller)
+	rejectedTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.Equal(ErrTaskSchedulerClosed, scheduler.Submit(rejectedTask))
+
+	// the first task is still executing at the deadline, while the second one waits for the worker
+	r := <-resultCh
+	s.Equal(context.DeadlineExceeded, r.err)
+	s.Equal(ShutdownSummary{AbandonedInFlight: 2}, r.summary)
+	s.True(scheduler.isStopped())
+
+	// the abandoned task is still acked by its worker once it completes
+	close(blockCh)
+	<-ackedCh
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStartAndWait() {
+	testScope := tally.NewTestScope("test", nil)
+	numChecks := 0
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ReadinessCheck: func(ctx context.Context) error {
+				numChecks++
+				if numChecks < 3 {
+					return errors.New("connection refused")
+				}
+				return nil
+			},
+			ReadinessCheckInterval: time.Millisecond,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	defer scheduler.Stop()
+
+	// tasks submitted before the processor is ready stay queued
+	doneCh := make(chan struct{})
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Execute().Return(nil).Times(1)
+	mockTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+	s.NoError(scheduler.Submit(mockTask))
+
+	s.NoError(scheduler.StartAndWait(context.Background()))
+	s.Equal(3, numChecks)
+	<-doneCh
+	s.Error(scheduler.StartAndWait(context.Background()))
+
+	counters := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		counters[counter.Name()] += counter.Value()
+	}
+	s.Equal(int64(3), counters["test.prioritytask_readiness_check_attempt"])
+	s.Equal(int64(2), counters["test.prioritytask_readiness_check_failure"])
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStartAndWait_NotReady() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			NackOnStop:      true,
+			ReadinessCheck: func(ctx context.Context) error {
+				return errors.New("connection refused")
+			},
+			ReadinessCheckInterval: time.Millisecond,
+		},
+	)
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Nack().Times(1)
+	s.NoError(scheduler.Submit(mockTask))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	s.Equal(ErrProcessorNotReady, scheduler.StartAndWait(ctx))
+	// the scheduler is stopped without dispatching any task
+	s.True(scheduler.isStopped())
+	s.Equal(ErrTaskSchedulerClosed, scheduler.Submit(mockTask))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestStart_ReadinessCheck() {
+	readyCh := make(chan struct{})
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ReadinessCheck: func(ctx context.Context) error {
+				select {
+				case <-readyCh:
+					return nil
+				default:
+					return errors.New("connection refused")
+				}
+			},
+			ReadinessCheckInterval: time.Millisecond,
+		},
+	)
+
+	// Start doesn't wait for the processor to be ready
+	scheduler.Start()
+	doneCh := make(chan struct{})
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	mockTask.EXPECT().Execute().Return(nil).Times(1)
+	mockTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+	s.NoError(scheduler.Submit(mockTask))
+	time.Sleep(10 * time.Millisecond)
+	s.Equal(1, scheduler.numQueuedTasks())
+
+	close(readyCh)
+	<-doneCh
+	scheduler.Stop()
+
+	// stopping the scheduler stops the readiness checks
+	stoppedScheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ReadinessCheck: func(ctx context.Context) error {
+				return errors.New("connection refused")
+			},
+		},
+	)
+	stoppedScheduler.Start()
+	stoppedScheduler.Stop()
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDrainProgress() {
+	testScope := tally.NewTestScope("test", nil)
+	s.scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	s.scheduler.options.DrainProgressInterval = time.Millisecond
+
+	remaining, perPriority := s.scheduler.DrainProgress()
+	s.Zero(remaining)
+	s.Empty(perPriority)
+
+	for _, priority := range []int{0, 2, 0} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority)
+		s.NoError(s.scheduler.Submit(mockTask))
+	}
+	remaining, perPriority = s.scheduler.DrainProgress()
+	s.Equal(3, remaining)
+	s.Equal([]int{2, 0, 1}, perPriority)
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- s.scheduler.Drain(context.Background())
+	}()
+	for _, priority := range []int{0, 0, 2} {
+		time.Sleep(5 * time.Millisecond)
+		_, ok := s.scheduler.taskQueues[priority].Poll()
+		s.True(ok)
+	}
+	s.NoError(<-doneCh)
+
+	// the remaining tasks of each priority are zero once drained
+	numGauges := 0
+	for _, gauge := range testScope.Snapshot().Gauges() {
+		if gauge.Name() == "test.prioritytask_drain_remaining" {
+			s.Zero(gauge.Value())
+			numGauges++
+		}
+	}
+	s.Equal(3, numGauges)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestEstimateDrainTime() {
+	s.Equal(20*time.Second, estimateDrainTime(30, 20, 10*time.Second))
+	s.Zero(estimateDrainTime(20, 20, 10*time.Second))
+	s.Zero(estimateDrainTime(10, 20, 10*time.Second))
+	s.Zero(estimateDrainTime(10, 0, 10*time.Second))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestAdaptiveBackpressure() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                          testSchedulerWeights,
+			QueueSize:                        4,
+			WorkerCount:                      1,
+			DispatcherCount:                  1,
+			RetryPolicy:                      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			AdaptiveBackpressureMaxDelay:     40 * time.Millisecond,
+			AdaptiveBackpressureLowWatermark: 0.5,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	submitTask := func() time.Duration {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		startTime := time.Now()
+		s.NoError(scheduler.Submit(mockTask))
+		return time.Since(startTime)
+	}
+
+	// depth is at or below the low watermark for the first three tasks
+	for i := 0; i != 3; i++ {
+		submitTask()
+	}
+	s.True(submitTask() >= 20*time.Millisecond)
+
+	var delays []time.Duration
+	for _, timer := range testScope.Snapshot().Timers() {
+		if timer.Name() == "test.prioritytask_backpressure_delay" {
+			delays = append(delays, timer.Values()...)
+		}
+	}
+	s.Equal([]time.Duration{20 * time.Millisecond}, delays)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestBackpressureDelay() {
+	s.Zero(backpressureDelay(0.5, 0.5, 0, time.Second))
+	s.Equal(500*time.Millisecond, backpressureDelay(0.75, 0.5, 0, time.Second))
+	s.Equal(500*time.Millisecond, backpressureDelay(0.6, 0.5, 0.7, time.Second))
+	s.Equal(time.Second, backpressureDelay(0.8, 0.5, 0.7, time.Second))
+	s.Equal(time.Second, backpressureDelay(1, 0.5, 0, time.Second))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestLoadShedding() {
+	testScope := tally.NewTestScope("test", nil)
+	var rejected []string
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       4,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			// the lowest priority is shed earlier and more aggressively
+			LoadShedding: map[int]LoadSheddingCurve{
+				1: {LowWatermark: 0.5, MaxProbability: 0.5},
+				2: {LowWatermark: 0.25, MaxProbability: 1},
+			},
+			OnReject: func(_ PriorityTask, reason string) {
+				rejected = append(rejected, reason)
+			},
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	random := 0.3
+	scheduler.shedRandom = func() float64 { return random }
+	submitTask := func(priority int) error {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return scheduler.Submit(mockTask)
+	}
+
+	for _, priority := range []int{0, 1, 2} {
+		for i := 0; i != 2; i++ {
+			s.NoError(submitTask(priority))
+		}
+	}
+	// priority 1 is at its low watermark
+	s.NoError(submitTask(1))
+	// priority 2 is halfway between its watermarks, so its submissions are shed with 0.33 probability
+	s.Equal(ErrTaskShed, submitTask(2))
+	random = 0.34
+	s.NoError(submitTask(2))
+	// priorities without a curve are never shed
+	s.NoError(submitTask(0))
+	s.NoError(submitTask(0))
+
+	s.Equal([]string{RejectReasonShed}, rejected)
+	numShed := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_shed" {
+			numShed[counter.Tags()["task_priority"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{"2": 1}, numShed)
+
+	shedProbabilities := make(map[int]float64)
+	for _, debugInfo := range scheduler.DispatchDebugState() {
+		shedProbabilities[debugInfo.Priority] = debugInfo.ShedProbability
+	}
+	s.Len(shedProbabilities, 3)
+	s.Zero(shedProbabilities[0])
+	s.Equal(0.25, shedProbabilities[1])
+	s.InDelta(2.0/3, shedProbabilities[2], 1e-9)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestQueuedBytes() {
+	testScope := tally.NewTestScope("test", nil)
+	sizes := make(map[PriorityTask]int64)
+	var rejected []string
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       10,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			SizeOf: func(task PriorityTask) int64 {
+				return sizes[task]
+			},
+			MaxQueuedBytes:  50,
+			SoftQueuedBytes: 30,
+			OnReject: func(_ PriorityTask, reason string) {
+				rejected = append(rejected, reason)
+			},
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	var nacked []PriorityTask
+	newTask := func(priority int, size int64) PriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Nack().Do(func() { nacked = append(nacked, mockTask) }).MaxTimes(1)
+		sizes[mockTask] = size
+		return mockTask
+	}
+
+	lowTasks := []PriorityTask{newTask(2, 10), newTask(2, 10), newTask(2, 10)}
+	for _, task := range lowTasks {
+		s.NoError(scheduler.Submit(task))
+	}
+	s.Empty(nacked)
+	// the soft limit is exceeded, so the oldest task of the lowest priority is shed
+	midTask := newTask(1, 10)
+	s.NoError(scheduler.Submit(midTask))
+	s.Equal(lowTasks[:1], nacked)
+	submitted, err := scheduler.TrySubmit(newTask(0, 10))
+	s.NoError(err)
+	s.True(submitted)
+	s.Equal(lowTasks[:2], nacked)
+	s.Equal(int64(30), scheduler.Stats().QueuedBytes)
+
+	// the hard limit rejects the task before it's queued
+	s.Equal(ErrQueuedBytesExceeded, scheduler.Submit(newTask(0, 25)))
+	submitted, err = scheduler.TrySubmit(newTask(0, 25))
+	s.Equal(ErrQueuedBytesExceeded, err)
+	s.False(submitted)
+	s.Equal([]string{RejectReasonQueuedBytesExceeded, RejectReasonQueuedBytesExceeded}, rejected)
+
+	// lower priorities are shed until the queued bytes are back within the soft limit
+	s.NoError(scheduler.Submit(newTask(0, 15)))
+	s.Equal(append(append([]PriorityTask(nil), lowTasks...), midTask), nacked)
+	s.Equal(int64(25), scheduler.Stats().QueuedBytes)
+
+	// priorities higher than the submitted one are not shed, even if the submitted task is shed
+	lastTask := newTask(2, 10)
+	s.NoError(scheduler.Submit(lastTask))
+	s.True(nacked[len(nacked)-1] == lastTask)
+	s.Equal(int64(25), scheduler.Stats().QueuedBytes)
+
+	numShed := make(map[string]int64)
+	numRejected := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		switch counter.Name() {
+		case "test.prioritytask_queued_bytes_shed":
+			numShed[counter.Tags()["task_priority"]] += counter.Value()
+		case "test.prioritytask_queued_bytes_rejected":
+			numRejected += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{"1": 1, "2": 4}, numShed)
+	s.Equal(int64(2), numRejected)
+	queuedBytes := float64(-1)
+	for _, gauge := range testScope.Snapshot().Gauges() {
+		if gauge.Name() == "test.prioritytask_queued_bytes" {
+			queuedBytes = gauge.Value()
+		}
+	}
+	s.Equal(float64(25), queuedBytes)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestPriorityActivity() {
+	var lock sync.Mutex
+	var events []string
+	record := func(event string, priority int) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, fmt.Sprintf("%v %v", event, priority))
+	}
+	getEvents := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), events...)
+	}
+	awaitEvents := func(numEvents int) {
+		timeoutCh := time.After(10 * time.Second)
+		for len(getEvents()) < numEvents {
+			select {
+			case <-timeoutCh:
+				s.FailNow("priority activity callbacks are not invoked", "events: %v", getEvents())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			OnPriorityActive: func(priority int) {
+				record("active", priority)
+			},
+			OnPriorityIdle: func(priority int) {
+				record("idle", priority)
+			},
+			PriorityIdleDebounce: 10 * time.Millisecond,
+		},
+	)
+
+	var taskWG sync.WaitGroup
+	newTask := func(priority int) PriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		mockTask.EXPECT().Execute().Return(nil)
+		mockTask.EXPECT().Ack().Do(func() { taskWG.Done() })
+		taskWG.Add(1)
+		return mockTask
+	}
+
+	// a priority is reported active as soon as its first task is queued
+	for i := 0; i != 3; i++ {
+		s.NoError(scheduler.Submit(newTask(1)))
+	}
+	s.Equal([]string{"active 1"}, getEvents())
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	taskWG.Wait()
+	awaitEvents(2)
+	s.Equal([]string{"active 1", "idle 1"}, getEvents())
+
+	// the priority becomes active again once another task is queued
+	s.NoError(scheduler.Submit(newTask(1)))
+	taskWG.Wait()
+	awaitEvents(4)
+	s.Equal([]string{"active 1", "idle 1", "active 1", "idle 1"}, getEvents())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestMaxWaitSLA() {
+	testScope := tally.NewTestScope("test", nil)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0, // tasks are only dispatched via nextTask
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxWaitSLA:      []time.Duration{0, time.Minute, time.Minute},
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	newTask := func(priority int) PriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		return mockTask
+	}
+
+	var highTasks []PriorityTask
+	for i := 0; i != 3; i++ {
+		highTasks = append(highTasks, newTask(0))
+		s.NoError(scheduler.Submit(highTasks[i]))
+	}
+	// the queue exceeding its SLA by the largest fraction is dispatched first, regardless of the weights
+	lowTask := newTask(2)
+	s.NoError(scheduler.SubmitWithEnqueueTime(lowTask, time.Now().Add(-3*time.Minute)))
+	midTask := newTask(1)
+	s.NoError(scheduler.SubmitWithEnqueueTime(midTask, time.Now().Add(-10*time.Minute)))
+	freshLowTask := newTask(2)
+	s.NoError(scheduler.Submit(freshLowTask))
+
+	var dispatched []PriorityTask
+	for {
+		task, _, ok := scheduler.nextTask()
+		if !ok {
+			break
+		}
+		dispatched = append(dispatched, task)
+	}
+	// once back within the SLA, the weights apply again
+	s.Equal([]PriorityTask{midTask, lowTask, highTasks[0], highTasks[1], highTasks[2], freshLowTask}, dispatched)
+
+	violations := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_sla_violation" {
+			violations[counter.Tags()["task_priority"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{"1": 1, "2": 1}, violations)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestShedProbability() {
+	s.Zero(shedProbability(0.5, LoadSheddingCurve{LowWatermark: 0.5, MaxProbability: 1}))
+	s.Equal(0.5, shedProbability(0.75, LoadSheddingCurve{LowWatermark: 0.5, MaxProbability: 1}))
+	s.Equal(0.25, shedProbability(0.6, LoadSheddingCurve{LowWatermark: 0.5, HighWatermark: 0.7, MaxProbability: 0.5}))
+	s.Equal(0.5, shedProbability(0.8, LoadSheddingCurve{LowWatermark: 0.5, HighWatermark: 0.7, MaxProbability: 0.5}))
+	s.Equal(1.0, shedProbability(1, LoadSheddingCurve{LowWatermark: 0.5, MaxProbability: 1}))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRetryBackoffMultiplier() {
+	s.Equal(1.0, retryBackoffMultiplier(0.5, 0.5, 0, 4))
+	s.Equal(2.5, retryBackoffMultiplier(0.75, 0.5, 0, 4))
+	s.InDelta(2.5, retryBackoffMultiplier(0.6, 0.5, 0.7, 4), 1e-9)
+	s.Equal(4.0, retryBackoffMultiplier(0.8, 0.5, 0.7, 4))
+	s.Equal(4.0, retryBackoffMultiplier(1, 0.5, 0, 4))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestMaxBlockedSubmitters() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:              testSchedulerWeights,
+			QueueSize:            1,
+			WorkerCount:          1,
+			DispatcherCount:      1,
+			RetryPolicy:          backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxBlockedSubmitters: 1,
+		},
+	)
+	newMockTask := func() *MockPriorityTask {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		return mockTask
+	}
+	s.NoError(scheduler.Submit(newMockTask()))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- scheduler.Submit(newMockTask())
+	}()
+	s.Eventually(func() bool {
+		return atomic.LoadInt32(&scheduler.blockedSubmitters) == 1
+	}, time.Second, time.Millisecond)
+	s.Equal(ErrTooManyBlockedSubmitters, scheduler.Submit(newMockTask()))
+	s.Equal(int32(1), atomic.LoadInt32(&scheduler.blockedSubmitters))
+
+	_, ok := scheduler.taskQueues[0].Poll()
+	s.True(ok)
+	s.NoError(<-errCh)
+	s.Zero(atomic.LoadInt32(&scheduler.blockedSubmitters))
+	s.Equal(1, scheduler.taskQueues[0].Len())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestReprioritize() {
+	var tasks []PriorityTask
+	for _, priority := range []int{0, 1, 1, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(s.scheduler.Submit(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+	tasks[2].(*MockPriorityTask).EXPECT().SetPriority(0).Times(1)
+	tasks[3].(*MockPriorityTask).EXPECT().SetPriority(0).Times(1)
+
+	numMoved, err := s.scheduler.Reprioritize(func(task PriorityTask) bool {
+		return task != tasks[1]
+	}, 0)
+	s.NoError(err)
+	s.Equal(2, numMoved)
+	s.Equal(1, s.scheduler.taskQueues[1].Len())
+	s.Zero(s.scheduler.taskQueues[2].Len())
+	for _, expectedTask := range []PriorityTask{tasks[0], tasks[2], tasks[3]} {
+		task, ok := s.scheduler.taskQueues[0].Poll()
+		s.True(ok)
+		s.Equal(expectedTask, task)
+	}
+
+	_, err = s.scheduler.Reprioritize(func(PriorityTask) bool { return true }, 10)
+	s.Error(err)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestEvictOlderThan() {
+	testScope := tally.NewTestScope("test", nil)
+	s.scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	now := time.Now()
+	var tasks []PriorityTask
+	for i, priority := range []int{0, 1, 1, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		enqueuedAt := now
+		if i != 1 {
+			enqueuedAt = now.Add(-time.Hour)
+		}
+		s.NoError(s.scheduler.SubmitWithEnqueueTime(mockTask, enqueuedAt))
+		tasks = append(tasks, mockTask)
+	}
+	for _, task := range []PriorityTask{tasks[0], tasks[2], tasks[3]} {
+		task.(*MockPriorityTask).EXPECT().Nack().Times(1)
+	}
+
+	s.Equal(3, s.scheduler.EvictOlderThan(now.Add(-time.Minute)))
+	s.Equal(1, s.scheduler.numQueuedTasks())
+	s.Equal(tasks[1:2], s.scheduler.Peek(1, 10))
+	numEvicted := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_evicted" {
+			numEvicted[counter.Tags()["task_priority"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{"0": 1, "1": 1, "2": 1}, numEvicted)
+
+	s.Zero(s.scheduler.EvictOlderThan(now.Add(-time.Minute)))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestNonDroppable_LoadShedding() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       4,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			LoadShedding: map[int]LoadSheddingCurve{
+				2: {LowWatermark: 0, MaxProbability: 1},
+			},
+		},
+	)
+	scheduler.shedRandom = func() float64 { return 0 }
+
+	droppableTask := NewMockPriorityTask(s.controller)
+	droppableTask.EXPECT().Priority().Return(2).AnyTimes()
+	s.NoError(scheduler.Submit(droppableTask))
+	s.Equal(ErrTaskShed, scheduler.Submit(droppableTask))
+
+	nonDroppableTask := s.newNonDroppableTask(2)
+	s.NoError(scheduler.Submit(nonDroppableTask))
+	s.Equal(2, scheduler.numQueuedTasks())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestNonDroppable_SubmitHelpers() {
+	testCases := map[string]func(scheduler *weightedRoundRobinTaskSchedulerImpl, task PriorityTask) error{
+		"submit future": func(scheduler *weightedRoundRobinTaskSchedulerImpl, task PriorityTask) error {
+			_, err := scheduler.SubmitFuture(task)
+			return err
+		},
+		"submit group": func(scheduler *weightedRoundRobinTaskSchedulerImpl, task PriorityTask) error {
+			_, err := SubmitGroup(scheduler, []PriorityTask{task})
+			return err
+		},
+		"submit and await dispatch": func(scheduler *weightedRoundRobinTaskSchedulerImpl, task PriorityTask) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			// the task is never dispatched, as there's no dispatcher
+			if err := scheduler.SubmitAndAwaitDispatch(ctx, task); err != context.DeadlineExceeded {
+				return err
+			}
+			return nil
+		},
+	}
+
+	for name, submit := range testCases {
+		scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+			&WeightedRoundRobinTaskSchedulerOptions{
+				Weights:         testSchedulerWeights,
+				QueueSize:       4,
+				WorkerCount:     1,
+				DispatcherCount: 0,
+				RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+				LoadShedding: map[int]LoadSheddingCurve{
+					2: {LowWatermark: 0, MaxProbability: 1},
+				},
+			},
+		)
+		scheduler.shedRandom = func() float64 { return 0 }
+
+		droppableTask := NewMockPriorityTask(s.controller)
+		droppableTask.EXPECT().Priority().Return(2).AnyTimes()
+		s.NoError(scheduler.Submit(droppableTask), name)
+		s.Equal(ErrTaskShed, submit(scheduler, droppableTask), name)
+
+		// the non-droppable task is found through the wrapper added by the submit helper
+		s.NoError(submit(scheduler, s.newNonDroppableTask(2)), name)
+		s.Equal(2, scheduler.numQueuedTasks(), name)
+	}
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestNonDroppable_QueuedBytes() {
+	sizes := make(map[PriorityTask]int64)
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       10,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			SizeOf: func(task PriorityTask) int64 {
+				return sizes[task]
+			},
+			MaxQueuedBytes:  100,
+			SoftQueuedBytes: 15,
+		},
+	)
+
+	nonDroppableTasks := []PriorityTask{s.newNonDroppableTask(2), s.newNonDroppableTask(2)}
+	for _, task := range nonDroppableTasks {
+		sizes[task] = 10
+		s.NoError(scheduler.Submit(task))
+	}
+	s.Equal(int64(20), scheduler.Stats().QueuedBytes)
+
+	// only the droppable task is shed, even though it's queued behind the non-droppable tasks
+	droppableTask := NewMockPriorityTask(s.controller)
+	droppableTask.EXPECT().Priority().Return(2).AnyTimes()
+	droppableTask.EXPECT().Nack().Times(1)
+	sizes[droppableTask] = 10
+	s.NoError(scheduler.Submit(droppableTask))
+	s.Equal(int64(20), scheduler.Stats().QueuedBytes)
+	s.Equal(nonDroppableTasks, scheduler.Peek(2, 10))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestNonDroppable_Eviction() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			MaxQueueAge:     map[int]time.Duration{1: time.Millisecond},
+		},
+	)
+
+	now := time.Now()
+	nonDroppableTask := s.newNonDroppableTask(2)
+	s.NoError(scheduler.SubmitWithEnqueueTime(nonDroppableTask, now.Add(-time.Hour)))
+	droppableTask := NewMockPriorityTask(s.controller)
+	droppableTask.EXPECT().Priority().Return(2).AnyTimes()
+	droppableTask.EXPECT().Nack().Times(1)
+	s.NoError(scheduler.SubmitWithEnqueueTime(droppableTask, now.Add(-time.Hour)))
+
+	s.Equal(1, scheduler.EvictOlderThan(now))
+	s.Equal([]PriorityTask{nonDroppableTask}, scheduler.Peek(2, 10))
+
+	// the stale non-droppable task is dispatched instead of being aged out
+	staleTask := s.newNonDroppableTask(1)
+	s.NoError(scheduler.Submit(staleTask))
+	time.Sleep(5 * time.Millisecond)
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(staleTask, task)
+	s.Empty(scheduler.agedOutTasks)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestNonDroppable_Stop() {
+	testScope := tally.NewTestScope("test", nil)
+	var droppedTasks []PriorityTask
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:             testSchedulerWeights,
+			QueueSize:           s.queueSize,
+			WorkerCount:         1,
+			DispatcherCount:     0, // no dispatcher so that all tasks remain queued
+			RetryPolicy:         backoff.NewExponentialRetryPolicy(time.Millisecond),
+			DeadLetterQueueSize: map[int]int{1: 1},
+			NackOnStop:          true,
+		},
+	)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	scheduler.Start()
+
+	// non-droppable tasks go to the dead letter queue of their priority, or are executed otherwise
+	deadLetterTask := s.newNonDroppableTask(1)
+	s.NoError(scheduler.Submit(deadLetterTask))
+	executedTask := s.newNonDroppableTask(0)
+	executedTask.EXPECT().Execute().Return(nil).Times(1)
+	executedTask.EXPECT().Ack().Times(1)
+	s.NoError(scheduler.Submit(executedTask))
+	failedTask := s.newNonDroppableTask(1)
+	failedTask.EXPECT().Execute().Return(errors.New("some random error")).Times(1)
+	failedTask.EXPECT().HandleErr(gomock.Any()).DoAndReturn(func(err error) error { return err }).Times(1)
+	failedTask.EXPECT().Nack().Times(1)
+	s.NoError(scheduler.Submit(failedTask))
+	droppableTask := NewMockPriorityTask(s.controller)
+	droppableTask.EXPECT().Priority().Return(2).AnyTimes()
+	droppableTask.EXPECT().Nack().Times(1)
+	s.NoError(scheduler.Submit(droppableTask))
+
+	scheduler.Stop()
+	s.Equal([]PriorityTask{deadLetterTask}, scheduler.DeadLetterQueue(1))
+	numExtended := int64(0)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_non_droppable_drain_extended" {
+			numExtended += counter.Value()
+		}
+	}
+	s.Equal(int64(2), numExtended)
+
+	// all tasks are handed to OnTasksDropped if specified
+	scheduler = s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       s.queueSize,
+			WorkerCount:     1,
+			DispatcherCount: 0,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+			OnTasksDropped: func(tasks []PriorityTask) {
+				droppedTasks = tasks
+			},
+		},
+	)
+	scheduler.Start()
+	nonDroppableTask := s.newNonDroppableTask(0)
+	s.NoError(scheduler.Submit(nonDroppableTask))
+	scheduler.Stop()
+	s.Equal([]PriorityTask{nonDroppableTask}, droppedTasks)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestNonDroppable_StopGracePeriod() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                 testSchedulerWeights,
+			QueueSize:               s.queueSize,
+			WorkerCount:             1,
+			DispatcherCount:         0, // no dispatcher so that all tasks remain queued
+			RetryPolicy:             backoff.NewExponentialRetryPolicy(time.Millisecond),
+			NonDroppableGracePeriod: 10 * time.Millisecond,
+		},
+	)
+	scheduler.Start()
+
+	releaseCh := make(chan struct{})
+	nackedCh := make(chan struct{})
+	slowTask := s.newNonDroppableTask(0)
+	slowTask.EXPECT().Execute().DoAndReturn(func() error {
+		<-releaseCh
+		return nil
+	}).Times(1)
+	slowTask.EXPECT().Ack().Times(1)
+	s.NoError(scheduler.Submit(slowTask))
+	// not started within the grace period, so it's nacked instead of being dropped
+	pendingTask := s.newNonDroppableTask(1)
+	pendingTask.EXPECT().Nack().Do(func() { close(nackedCh) }).Times(1)
+	s.NoError(scheduler.Submit(pendingTask))
+
+	// Stop returns once the grace period elapses, even though the slow task is still being executed
+	scheduler.Stop()
+	close(releaseCh)
+	<-nackedCh
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRemapPriorities() {
+	var tasks []PriorityTask
+	for _, priority := range []int{0, 1, 1, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(s.scheduler.Submit(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+
+	s.Error(s.scheduler.RemapPriorities(map[int]int{0: 3, 1: 1}, func(priority int) int { return priority }))
+	s.Equal(map[int]int{0: 3, 1: 2, 2: 1}, s.scheduler.getWeights())
+	s.Equal(4, s.scheduler.numQueuedTasks())
+
+	// priorities 0 and 1 are swapped and priority 2 is merged into the new priority 0
+	tasks[0].(*MockPriorityTask).EXPECT().SetPriority(1).Times(1)
+	for _, task := range tasks[1:] {
+		task.(*MockPriorityTask).EXPECT().SetPriority(0).Times(1)
+	}
+	s.NoError(s.scheduler.RemapPriorities(map[int]int{0: 3, 1: 1}, func(priority int) int {
+		if priority == 0 {
+			return 1
+		}
+		return 0
+	}))
+	s.Equal(map[int]int{0: 3, 1: 1}, s.scheduler.getWeights())
+	s.Equal(tasks[1:], s.scheduler.Peek(0, 10))
+	s.Equal(tasks[:1], s.scheduler.Peek(1, 10))
+	s.Nil(s.scheduler.Peek(2, 10))
+	s.Len(s.scheduler.queueList, 2)
+
+	removedTask := NewMockPriorityTask(s.controller)
+	removedTask.EXPECT().Priority().Return(2).AnyTimes()
+	s.Error(s.scheduler.Submit(removedTask))
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRemapPriorities_QueueFull() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:         testSchedulerWeights,
+			QueueSize:       2,
+			WorkerCount:     1,
+			DispatcherCount: 1,
+			RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+		},
+	)
+
+	var tasks []PriorityTask
+	for _, priority := range []int{0, 0, 1, 1} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		s.NoError(scheduler.Submit(mockTask))
+		tasks = append(tasks, mockTask)
+	}
+	for _, task := range tasks[2:] {
+		task.(*MockPriorityTask).EXPECT().SetPriority(0).Times(1)
+		task.(*MockPriorityTask).EXPECT().Nack().Times(1)
+	}
+
+	s.NoError(scheduler.RemapPriorities(map[int]int{0: 1}, func(int) int { return 0 }))
+	s.Equal(tasks[:2], scheduler.Peek(0, 10))
+	s.Equal(2, scheduler.numQueuedTasks())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestAgePriorityEscalation() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:               testSchedulerWeights,
+			QueueSize:             s.queueSize,
+			WorkerCount:           1,
+			DispatcherCount:       0,
+			RetryPolicy:           backoff.NewExponentialRetryPolicy(time.Millisecond),
+			AgePriorityEscalation: map[int]time.Duration{1: time.Minute, 2: time.Second},
+		},
+	)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+
+	agedTask := NewMockPriorityTask(s.controller)
+	agedTask.EXPECT().Priority().Return(2).AnyTimes()
+	s.NoError(scheduler.Submit(agedTask))
+	highPriorityTask := NewMockPriorityTask(s.controller)
+	highPriorityTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.NoError(scheduler.Submit(highPriorityTask))
+
+	now := time.Now()
+	s.Zero(scheduler.promoteAgedTasks(now))
+
+	agedTask.EXPECT().SetPriority(1).Times(1)
+	s.Equal(1, scheduler.promoteAgedTasks(now.Add(2*time.Second)))
+	s.Zero(scheduler.taskQueues[2].Len())
+	s.Equal(1, scheduler.taskQueues[1].Len())
+
+	// the age counts from when the task is first queued
+	agedTask.EXPECT().SetPriority(0).Times(1)
+	s.Equal(1, scheduler.promoteAgedTasks(now.Add(2*time.Minute)))
+	s.Zero(scheduler.taskQueues[1].Len())
+	for _, expectedTask := range []PriorityTask{highPriorityTask, agedTask} {
+		task, ok := scheduler.taskQueues[0].Poll()
+		s.True(ok)
+		s.True(task == expectedTask)
+	}
+
+	promotions := make(map[string]int64)
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_age_promoted" {
+			promotions[counter.Tags()["task_priority"]] += counter.Value()
+		}
+	}
+	s.Equal(map[string]int64{"1": 1, "2": 1}, promotions)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestAgePriorityEscalation_Sweep() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                       testSchedulerWeights,
+			QueueSize:                     s.queueSize,
+			WorkerCount:                   1,
+			DispatcherCount:               0,
+			RetryPolicy:                   backoff.NewExponentialRetryPolicy(time.Millisecond),
+			AgePriorityEscalation:         map[int]time.Duration{2: time.Millisecond},
+			AgePriorityEscalationInterval: time.Millisecond,
+		},
+	)
+	scheduler.processor = s.mockProcessor
+	sourceQueue, err := scheduler.getOrCreateTaskQueue(2)
+	s.NoError(err)
+	targetQueue, err := scheduler.getOrCreateTaskQueue(1)
+	s.NoError(err)
+	s.mockProcessor.EXPECT().Start().Times(1)
+	scheduler.Start()
+
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(2).AnyTimes()
+	mockTask.EXPECT().SetPriority(1).Times(1)
+	s.NoError(scheduler.Submit(mockTask))
+	for sourceQueue.Len() != 0 {
+		runtime.Gosched()
+	}
+	s.Equal(1, targetQueue.Len())
+
+	s.mockProcessor.EXPECT().Stop().Times(1)
+	scheduler.Stop()
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestCircuitBreaker() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:                        testSchedulerWeights,
+			QueueSize:                      s.queueSize,
+			WorkerCount:                    1,
+			DispatcherCount:                1,
+			RetryPolicy:                    backoff.NewExponentialRetryPolicy(time.Millisecond),
+			CircuitBreakerFailureThreshold: 2,
+			CircuitBreakerOpenDuration:     time.Hour,
+		},
+	)
+	testScope := tally.NewTestScope("test", nil)
+	scheduler.SetMetricsScope(metrics.NewClient(testScope, metrics.Common).Scope(metrics.TaskSchedulerScope))
+	scheduler.processor = s.mockProcessor
+	newDependentTask := func(dependency string) *MockDependentTask {
+		mockTask := NewMockDependentTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		mockTask.EXPECT().Dependency().Return(dependency).AnyTimes()
+		return mockTask
+	}
+
+	failedTask := newDependentTask("failing dependency")
+	scheduler.onTaskAttempt(failedTask, errRetryable)
+	scheduler.onTaskAttempt(failedTask, errNonRetryable)
+
+	rejectedTask := newDependentTask("failing dependency")
+	rejectedTask.EXPECT().Nack().Times(1)
+	scheduler.dispatchTask(rejectedTask, polledTaskInfo{priority: 0})
+
+	healthyTask := newDependentTask("healthy dependency")
+	s.mockProcessor.EXPECT().Submit(healthyTask).Return(nil).Times(1)
+	scheduler.dispatchTask(healthyTask, polledTaskInfo{priority: 0})
+
+	var open float64
+	var rejected int64
+	for _, gauge := range testScope.Snapshot().Gauges() {
+		if gauge.Name() == "test.prioritytask_circuit_breaker_open" {
+			s.Equal("failing dependency", gauge.Tags()["task_dependency"])
+			open = gauge.Value()
+		}
+	}
+	for _, counter := range testScope.Snapshot().Counters() {
+		if counter.Name() == "test.prioritytask_circuit_breaker_rejected" {
+			rejected += counter.Value()
+		}
+	}
+	s.Equal(float64(1), open)
+	s.Equal(int64(1), rejected)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestDispatcher_NoLostWakeup() {
+	numTasks := 10000
+	var numDispatched int32
+	s.mockProcessor.EXPECT().Submit(gomock.Any()).DoAndReturn(func(_ Task) error {
+		atomic.AddInt32(&numDispatched, 1)
+		return nil
+	}).Times(numTasks)
+	s.scheduler.processor = s.mockProcessor
+
+	doneCh := make(chan struct{})
+	s.scheduler.dispatcherWG.Add(1)
+	go func() {
+		s.scheduler.dispatcher()
+		close(doneCh)
+	}()
+
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(i % 3).AnyTimes()
+		s.NoError(s.scheduler.Submit(mockTask))
+		if i%7 == 0 {
+			// give the dispatcher a chance to finish its round and block
+			runtime.Gosched()
+		}
+
+		// every submitted task must eventually be dispatched without further submissions
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&numDispatched) != int32(i+1) {
+			s.True(time.Now().Before(deadline), "task %v is not dispatched", i)
+			runtime.Gosched()
+		}
+	}
+
+	close(s.scheduler.shutdownCh)
+	<-doneCh
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestWRR() {
+	numTasks := 1000
+	var taskWG sync.WaitGroup
+
+	s.mockProcessor.EXPECT().Start()
+	s.mockProcessor.EXPECT().Stop()
+
+	tasks := []PriorityTask{}
+	mockFn := func(_ Task) error {
+		taskWG.Done()
+		return nil
+	}
+	for i := 0; i != numTasks; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(rand.Intn(len(testSchedulerWeights()))).Times(1)
+		tasks = append(tasks, mockTask)
+		taskWG.Add(1)
+		s.mockProcessor.EXPECT().Submit(newMockPriorityTaskMatcher(mockTask)).DoAndReturn(mockFn)
+	}
+
+	s.scheduler.processor = s.mockProcessor
+	s.scheduler.Start()
+	for _, task := range tasks {
+		if rand.Intn(2) == 0 {
+			s.NoError(s.scheduler.Submit(task))
+		} else {
+			submitted, err := s.scheduler.TrySubmit(task)
+			s.NoError(err)
+			s.True(submitted)
+		}
+	}
+	taskWG.Wait()
+	s.scheduler.Stop()
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) newTestWeightedRoundRobinTaskScheduler(
+	options *WeightedRoundRobinTaskSchedulerOptions,
+) *weightedRoundRobinTaskSchedulerImpl {
+	// most tests queue tasks before starting the scheduler or running the dispatchers by hand
+	options.AllowSubmitBeforeStart = true
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewDevelopmentForTest(s.Suite),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		options,
+	)
+	s.NoError(err)
+	return scheduler.(*weightedRoundRobinTaskSchedulerImpl)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) newNonDroppableTask(
+	priority int,
+) *testNonDroppableTask {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+	return &testNonDroppableTask{
+		MockPriorityTask: mockTask,
+	}
+}
+
+func (t *testNonDroppableTask) NonDroppable() bool {
+	return true
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) newIdempotentOptionalTask(
+	key string,
+) *testIdempotentOptionalTask {
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(1).AnyTimes()
+	return &testIdempotentOptionalTask{
+		MockPriorityTask: mockTask,
+		key:              key,
+		retryPolicy:      backoff.NewExponentialRetryPolicy(time.Second),
+	}
+}
+
+func (t *testIdempotentOptionalTask) IdempotencyKey() string {
+	return t.key
+}
+
+func (t *testIdempotentOptionalTask) NonDroppable() bool {
+	return true
+}
+
+func (t *testIdempotentOptionalTask) CurrentPriority() int {
+	return 0
+}
+
+func (t *testIdempotentOptionalTask) MetricTags() map[string]string {
+	return map[string]string{"domain": t.key}
+}
+
+func (t *testIdempotentOptionalTask) ExecuteWithContext(
+	_ context.Context,
+) error {
+	t.executedWithContext = true
+	return nil
+}
+
+func (t *testIdempotentOptionalTask) Preempt() {}
+
+func (t *testIdempotentOptionalTask) RetryPolicy() backoff.RetryPolicy {
+	return t.retryPolicy
+}
+
+func newMockPriorityTaskMatcher(mockTask *MockPriorityTask) gomock.Matcher {
+	return &mockPriorityTaskMatcher{
+		task: mockTask,
+	}
+}
+
+func (m *mockPriorityTaskMatcher) Matches(x interface{}) bool {
+	taskPtr, ok := x.(*MockPriorityTask)
+	if !ok {
+		return false
+	}
+	return taskPtr == m.task
+}
+
+func (m *mockPriorityTaskMatcher) String() string {
+	return fmt.Sprintf("is equal to %v", m.task)
+}
+
+func BenchmarkWeightedRoundRobinTaskScheduler_ProcessorQueueSize(b *testing.B) {
+	for _, processorQueueSize := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("ProcessorQueueSize-%v", processorQueueSize), func(b *testing.B) {
+			benchmarkWeightedRoundRobinTaskScheduler(b, processorQueueSize)
+		})
+	}
+}
+
+func BenchmarkWeightedRoundRobinTaskScheduler_DirectDispatch(b *testing.B) {
+	for _, directDispatch := range [][]int{nil, {0}} {
+		b.Run(fmt.Sprintf("DirectDispatch-%v", directDispatch), func(b *testing.B) {
+			scheduler, err := NewWeightedRoundRobinTaskScheduler(
+				loggerimpl.NewNopLogger(),
+				metrics.NewClient(tally.NoopScope, metrics.Common),
+				&WeightedRoundRobinTaskSchedulerOptions{
+					Weights:         testSchedulerWeights,
+					QueueSize:       10000,
+					WorkerCount:     4,
+					DispatcherCount: 1,
+					RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+					DirectDispatch:  directDispatch,
+				},
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			scheduler.Start()
+			defer scheduler.Stop()
+
+			// light load: submit one task at a time and wait for its completion
+			b.ResetTimer()
+			for i := 0; i != b.N; i++ {
+				var taskWG sync.WaitGroup
+				taskWG.Add(1)
+				if err := scheduler.Submit(&benchmarkPriorityTask{
+					priority:  0,
+					waitGroup: &taskWG,
+				}); err != nil {
+					b.Fatal(err)
+				}
+				taskWG.Wait()
+			}
+		})
+	}
+}
+
+func BenchmarkWeightedRoundRobinTaskScheduler_ExpressPriority(b *testing.B) {
+	for _, expressPriority := range []*int{nil, common.IntPtr(0)} {
+		b.Run(fmt.Sprintf("ExpressPriority-%v", expressPriority != nil), func(b *testing.B) {
+			scheduler, err := NewWeightedRoundRobinTaskScheduler(
+				loggerimpl.NewNopLogger(),
+				metrics.NewClient(tally.NoopScope, metrics.Common),
+				&WeightedRoundRobinTaskSchedulerOptions{
+					Weights:         testSchedulerWeights,
+					QueueSize:       10000,
+					WorkerCount:     4,
+					DispatcherCount: 1,
+					RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+					ExpressPriority: expressPriority,
+				},
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			scheduler.Start()
+			defer scheduler.Stop()
+
+			// submit one task at a time and measure the latency until its completion
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := 0; i != b.N; i++ {
+				var taskWG sync.WaitGroup
+				taskWG.Add(1)
+				startTime := time.Now()
+				if err := scheduler.Submit(&benchmarkPriorityTask{
+					priority:  0,
+					waitGroup: &taskWG,
+				}); err != nil {
+					b.Fatal(err)
+				}
+				taskWG.Wait()
+				latencies[i] = time.Since(startTime)
+			}
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.Logf("p99 latency %v for %v tasks", latencies[len(latencies)*99/100], b.N)
+		})
+	}
+}
+
+func BenchmarkWeightedRoundRobinTaskScheduler_BatchCounters(b *testing.B) {
+	for _, batchCounters := range []bool{false, true} {
+		b.Run(fmt.Sprintf("BatchCounters-%v", batchCounters), func(b *testing.B) {
+			scheduler, err := NewWeightedRoundRobinTaskScheduler(
+				loggerimpl.NewNopLogger(),
+				metrics.NewClient(tally.NoopScope, metrics.Common),
+				&WeightedRoundRobinTaskSchedulerOptions{
+					Weights:         testSchedulerWeights,
+					QueueSize:       10000,
+					WorkerCount:     16,
+					DispatcherCount: 1,
+					RetryPolicy:     backoff.NewExponentialRetryPolicy(time.Millisecond),
+					BatchCounters:   batchCounters,
+				},
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			scope := &countingMetricsScope{
+				Scope: metrics.NewClient(tally.NoopScope, metrics.Common).Scope(metrics.TaskSchedulerScope),
+				calls: new(int64),
+			}
+			scheduler.SetMetricsScope(scope)
+			scheduler.Start()
+
+			var taskWG sync.WaitGroup
+			taskWG.Add(b.N)
+			b.ResetTimer()
+			for i := 0; i != b.N; i++ {
+				if err := scheduler.Submit(&benchmarkPriorityTask{
+					priority:  i % 3,
+					waitGroup: &taskWG,
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			taskWG.Wait()
+			b.StopTimer()
+
+			// counters batched are flushed on stop
+			scheduler.Stop()
+			b.Logf("%v counter calls for %v tasks", atomic.LoadInt64(scope.calls), b.N)
+		})
+	}
+}
+
+func benchmarkWeightedRoundRobinTaskScheduler(
+	b *testing.B,
+	processorQueueSize int,
+) {
+	scheduler, err := NewWeightedRoundRobinTaskScheduler(
+		loggerimpl.NewNopLogger(),
+		metrics.NewClient(tally.NoopScope, metrics.Common),
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:            testSchedulerWeights,
+			QueueSize:          10000,
+			WorkerCount:        16,
+			DispatcherCount:    1,
+			RetryPolicy:        backoff.NewExponentialRetryPolicy(time.Millisecond),
+			ProcessorQueueSize: processorQueueSize,
+		},
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	var taskWG sync.WaitGroup
+	taskWG.Add(b.N)
+	b.ResetTimer()
+	for i := 0; i != b.N; i++ {
+		task := &benchmarkPriorityTask{
+			priority:  i % 3,
+			waitGroup: &taskWG,
+		}
+		// bursty execution time: most tasks are fast, a few are slow
+		if i%50 == 0 {
+			task.executionTime = time.Millisecond
+		}
+		if err := scheduler.Submit(task); err != nil {
+			b.Fatal(err)
+		}
+	}
+	taskWG.Wait()
+}
+
+func (t *benchmarkPriorityTask) Execute() error {
+	if t.executionTime != 0 {
+		time.Sleep(t.executionTime)
+	}
+	return nil
+}
+
+func (t *benchmarkPriorityTask) HandleErr(err error) error { return err }
+
+func (t *benchmarkPriorityTask) RetryErr(err error) bool { return false }
+
+func (t *benchmarkPriorityTask) Ack() { t.waitGroup.Done() }
+
+func (t *benchmarkPriorityTask) Nack() { t.waitGroup.Done() }
+
+func (t *benchmarkPriorityTask) State() State { return TaskStatePending }
+
+func (t *benchmarkPriorityTask) Priority() int { return t.priority }
+
+func (t *benchmarkPriorityTask) SetPriority(priority int) { t.priority = priority }
+
+func (s *countingMetricsScope) IncCounter(counter int) {
+	atomic.AddInt64(s.calls, 1)
+	s.Scope.IncCounter(counter)
+}
+
+func (s *countingMetricsScope) AddCounter(counter int, delta int64) {
+	atomic.AddInt64(s.calls, 1)
+	s.Scope.AddCounter(counter, delta)
+}
+
+func (s *countingMetricsScope) Tagged(tags ...metrics.Tag) metrics.Scope {
+	return &countingMetricsScope{
+		Scope: s.Scope.Tagged(tags...),
+		calls: s.calls,
+	}
+}
+
+func (t *testResourceCostTask) ResourceCost() map[string]float64 { return t.cost }
+
+func (p *capacityReportingProcessor) submitReportingBlocked(task Task, onBlocked func()) error {
+	return p.Submit(task)
+}
+
+func (p *capacityReportingProcessor) bufferOccupancy() float64 {
+	if atomic.LoadInt32(&p.full) == 1 {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// workStealingQueue buffers the tasks submitted to ParallelTaskProcessor in a bounded deque per
+	// worker. Submitted tasks are spread over the deques, each worker picks up tasks from the front
+	// of its own deque, and steals from the back of the other deques when its own deque is empty,
+	// so workers stuck on slow tasks don't hold up the tasks queued behind them
+	workStealingQueue struct {
+		// slotsCh bounds the number of buffered tasks, a slot is
+		// taken before a task is added and released after it's removed
+		slotsCh chan struct{}
+		// readyCh receives a signal for each buffered task
+		readyCh chan struct{}
+
+		deques    []*taskDeque
+		nextDeque uint32
+	}
+
+	// taskDeque is a fixed size ring buffer of tasks
+	taskDeque struct {
+		sync.Mutex
+		tasks []Task
+		head  int
+		size  int
+	}
+)
+
+func newWorkStealingQueue(
+	size int,
+	numDeques int,
+) *workStealingQueue {
+	if numDeques <= 0 {
+		numDeques = 1
+	}
+	// the deques together can hold size tasks however the tasks are spread
+	dequeSize := (size + numDeques - 1) / numDeques
+	deques := make([]*taskDeque, numDeques)
+	for idx := range deques {
+		deques[idx] = &taskDeque{tasks: make([]Task, dequeSize)}
+	}
+	return &workStealingQueue{
+		slotsCh: make(chan struct{}, size),
+		readyCh: make(chan struct{}, size),
+		deques:  deques,
+	}
+}
+
+// put blocks until the task is added, returns false if either shutdownCh or cancelCh is closed first
+func (q *workStealingQueue) put(
+	task Task,
+	shutdownCh <-chan struct{},
+	cancelCh <-chan struct{},
+) bool {
+	select {
+	case q.slotsCh <- struct{}{}:
+	case <-shutdownCh:
+		return false
+	case <-cancelCh:
+		return false
+	}
+	q.add(task)
+	return true
+}
+
+// offer adds the task only if the queue is not full
+func (q *workStealingQueue) offer(
+	task Task,
+) bool {
+	select {
+	case q.slotsCh <- struct{}{}:
+	default:
+		return false
+	}
+	q.add(task)
+	return true
+}
+
+// poll removes a task for the worker, preferring the worker's own deque, and returns
+// whether it's stolen from another deque. It must be called only after a signal is
+// received from readyCh
+func (q *workStealingQueue) poll(
+	worker int,
+) (Task, bool) {
+	own := worker % len(q.deques)
+	for {
+		if task, ok := q.deques[own].popFront(); ok {
+			<-q.slotsCh
+			return task, false
+		}
+		// the signal guarantees a task for this worker in one of the deques, but it may
+		// be added to a deque already checked while the task checked for is polled by
+		// another worker, in which case the deques are checked again
+		for i := 1; i < len(q.deques); i++ {
+			if task, ok := q.deques[(own+i)%len(q.deques)].popBack(); ok {
+				<-q.slotsCh
+				return task, true
+			}
+		}
+	}
+}
+
+func (q *workStealingQueue) len() int {
+	length := 0
+	for _, deque := range q.deques {
+		deque.Lock()
+		length += deque.size
+		deque.Unlock()
+	}
+	return length
+}
+
+// add pushes the task to the back of the next deque in round robin order, or the
+// deque following it with space, which always exists as a slot was taken for the task
+func (q *workStealingQueue) add(
+	task Task,
+) {
+	start := int(atomic.AddUint32(&q.nextDeque, 1) % uint32(len(q.deques)))
+	for i := 0; ; i++ {
+		if q.deques[(start+i)%len(q.deques)].pushBack(task) {
+			break
+		}
+	}
+
+	// never blocks as readyCh has the same capacity as slotsCh
+	q.readyCh <- struct{}{}
+}
+
+func (d *taskDeque) pushBack(
+	task Task,
+) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.size == len(d.tasks) {
+		return false
+	}
+	d.tasks[(d.head+d.size)%len(d.tasks)] = task
+	d.size++
+	return true
+}
+
+func (d *taskDeque) popFront() (Task, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.size == 0 {
+		return nil, false
+	}
+	task := d.tasks[d.head]
+	d.tasks[d.head] = nil
+	d.head = (d.head + 1) % len(d.tasks)
+	d.size--
+	return task, true
+}
+
+func (d *taskDeque) popBack() (Task, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.size == 0 {
+		return nil, false
+	}
+	tail := (d.head + d.size - 1) % len(d.tasks)
+	task := d.tasks[tail]
+	d.tasks[tail] = nil
+	d.size--
+	return task, true
+}
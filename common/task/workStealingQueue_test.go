@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkStealingQueue(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	queue := newWorkStealingQueue(4, 2)
+	var tasks []Task
+	for i := 0; i != 4; i++ {
+		tasks = append(tasks, NewMockTask(controller))
+	}
+
+	// tasks are spread over the deques in round robin order
+	require.True(t, queue.offer(tasks[0]))
+	require.True(t, queue.offer(tasks[1]))
+	require.True(t, queue.put(tasks[2], nil, nil))
+	require.True(t, queue.put(tasks[3], nil, nil))
+	require.False(t, queue.offer(NewMockTask(controller)))
+	require.Equal(t, 4, queue.len())
+
+	cancelCh := make(chan struct{})
+	close(cancelCh)
+	require.False(t, queue.put(NewMockTask(controller), nil, cancelCh))
+
+	// worker 0 picks up its own deque from the front before stealing from the back of the other deque
+	for _, expected := range []struct {
+		task   Task
+		stolen bool
+	}{
+		{tasks[1], false},
+		{tasks[3], false},
+		{tasks[2], true},
+		{tasks[0], true},
+	} {
+		<-queue.readyCh
+		task, stolen := queue.poll(0)
+		require.Equal(t, expected.task, task)
+		require.Equal(t, expected.stolen, stolen)
+	}
+	require.Zero(t, queue.len())
+}
+
+func TestWorkStealingQueue_DequeFull(t *testing.T) {
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	queue := newWorkStealingQueue(3, 2)
+	var tasks []Task
+	for i := 0; i != 3; i++ {
+		tasks = append(tasks, NewMockTask(controller))
+		require.True(t, queue.offer(tasks[i]))
+	}
+	for i := 0; i != 2; i++ {
+		<-queue.readyCh
+		task, stolen := queue.poll(0)
+		require.Equal(t, tasks[1], task)
+		require.False(t, stolen)
+		require.True(t, queue.offer(tasks[1]))
+	}
+
+	// the deque of the second offer is full, so the task is added to the other deque
+	for _, expected := range []struct {
+		task   Task
+		stolen bool
+	}{
+		{tasks[1], false},
+		{tasks[2], true},
+		{tasks[0], true},
+	} {
+		<-queue.readyCh
+		task, stolen := queue.poll(0)
+		require.Equal(t, expected.task, task)
+		require.Equal(t, expected.stolen, stolen)
+	}
+}
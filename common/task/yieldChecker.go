@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+)
+
+type (
+	yieldCheckerContextKey struct{}
+
+	// schedulerYieldChecker is the YieldChecker of a task executed by a WRR task scheduler
+	schedulerYieldChecker struct {
+		scheduler *weightedRoundRobinTaskSchedulerImpl
+		priority  int
+	}
+)
+
+// YieldCheckerFromContext returns the YieldChecker of the task executed with the
+// context, if the task is executed by a WRR task scheduler with CooperativeYield
+func YieldCheckerFromContext(
+	ctx context.Context,
+) (YieldChecker, bool) {
+	checker, ok := ctx.Value(yieldCheckerContextKey{}).(YieldChecker)
+	return checker, ok
+}
+
+func (c *schedulerYieldChecker) ShouldYield() bool {
+	return c.scheduler.shouldYield(c.priority)
+}
+
+// yieldExecuteContext derives the execution context of the task from ExecuteContext, if
+// specified, and attaches the YieldChecker for the priority the task is dispatched with
+func (w *weightedRoundRobinTaskSchedulerImpl) yieldExecuteContext(
+	task PriorityTask,
+) context.Context {
+	ctx := context.Background()
+	if w.options.ExecuteContext != nil {
+		ctx = w.options.ExecuteContext(task)
+	}
+	return context.WithValue(ctx, yieldCheckerContextKey{}, &schedulerYieldChecker{
+		scheduler: w,
+		priority:  task.Priority(),
+	})
+}
+
+// shouldYield returns true if a queue scanned before the priority has tasks waiting
+// while no worker is idle. Queues are checked first as it's cheaper than the processor stats
+func (w *weightedRoundRobinTaskSchedulerImpl) shouldYield(
+	priority int,
+) bool {
+	if w.isStopped() {
+		// the execution context is cancelled instead
+		return false
+	}
+
+	w.RLock()
+	pending := false
+	for queuePriority, queue := range w.taskQueues {
+		if w.scansBefore(queuePriority, priority) && queue.Len() != 0 {
+			pending = true
+			break
+		}
+	}
+	w.RUnlock()
+	if !pending {
+		return false
+	}
+
+	processor, ok := w.processor.(ParallelTaskProcessor)
+	if !ok {
+		// the worker availability is unknown, consider the workers busy as idle-only dispatch does
+		return true
+	}
+	stats := processor.Stats()
+	return stats.LiveWorkers-stats.BusyWorkers <= stats.QueuedTasks
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package task
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/uber/cadence/common/backoff"
+)
+
+type (
+	yieldTestContextKey struct{}
+)
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestShouldYield() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  0,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			CooperativeYield: true,
+			ExecuteContext: func(task PriorityTask) context.Context {
+				return context.WithValue(context.Background(), yieldTestContextKey{}, task.Priority())
+			},
+		},
+	)
+	_, ok := YieldCheckerFromContext(context.Background())
+	s.False(ok)
+
+	checkers := make(map[int]YieldChecker)
+	for _, priority := range []int{0, 2} {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(priority).AnyTimes()
+		ctx := scheduler.yieldExecuteContext(mockTask)
+		// the context derived by ExecuteContext is kept
+		s.Equal(priority, ctx.Value(yieldTestContextKey{}))
+		checker, ok := YieldCheckerFromContext(ctx)
+		s.True(ok)
+		checkers[priority] = checker
+	}
+	s.False(checkers[0].ShouldYield())
+	s.False(checkers[2].ShouldYield())
+
+	// the processor is not started, so no worker is idle
+	mockTask := NewMockPriorityTask(s.controller)
+	mockTask.EXPECT().Priority().Return(0).AnyTimes()
+	s.NoError(scheduler.Submit(mockTask))
+	s.False(checkers[0].ShouldYield())
+	s.True(checkers[2].ShouldYield())
+
+	_, _, ok = scheduler.nextTask()
+	s.True(ok)
+	s.False(checkers[2].ShouldYield())
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestRequeueYielded() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  0,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			CooperativeYield: true,
+			RetryRequeue:     true,
+			MaxResubmits:     1,
+		},
+	)
+
+	queuedTask := NewMockPriorityTask(s.controller)
+	queuedTask.EXPECT().Priority().Return(1).AnyTimes()
+	s.NoError(scheduler.Submit(queuedTask))
+	yieldedTask := NewMockPriorityTask(s.controller)
+	yieldedTask.EXPECT().Priority().Return(1).AnyTimes()
+	firstAttemptTime := time.Now()
+	s.True(scheduler.requeueYielded(yieldedTask, 2, firstAttemptTime))
+	s.True(scheduler.requeueYielded(yieldedTask, 2, firstAttemptTime))
+
+	// the yielded task is queued at the tail, and yields are not resubmits
+	task, _, ok := scheduler.nextTask()
+	s.True(ok)
+	s.Equal(queuedTask, task)
+	task, _, ok = scheduler.nextTask()
+	s.True(ok)
+	requeued, ok := task.(*requeuedTask)
+	s.True(ok)
+	s.Equal(yieldedTask, requeued.PriorityTask)
+	s.Equal(2, requeued.retries)
+	s.Equal(0, requeued.requeues)
+	s.Equal(firstAttemptTime, requeued.firstAttemptTime)
+}
+
+func (s *weightedRoundRobinTaskSchedulerSuite) TestCooperativeYield() {
+	scheduler := s.newTestWeightedRoundRobinTaskScheduler(
+		&WeightedRoundRobinTaskSchedulerOptions{
+			Weights:          testSchedulerWeights,
+			QueueSize:        s.queueSize,
+			WorkerCount:      1,
+			DispatcherCount:  1,
+			RetryPolicy:      backoff.NewExponentialRetryPolicy(time.Millisecond),
+			CooperativeYield: true,
+		},
+	)
+
+	var lock sync.Mutex
+	var executed []string
+	record := func(name string) {
+		lock.Lock()
+		defer lock.Unlock()
+		executed = append(executed, name)
+	}
+
+	startedCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	executions := 0
+	longTask := &testContextAwareTask{
+		MockPriorityTask: NewMockPriorityTask(s.controller),
+		executeFn: func(ctx context.Context) error {
+			executions++
+			if executions > 1 {
+				record("long")
+				return nil
+			}
+			close(startedCh)
+			checker, ok := YieldCheckerFromContext(ctx)
+			if !ok {
+				return errors.New("yield checker is missing")
+			}
+			for !checker.ShouldYield() {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Millisecond):
+				}
+			}
+			record("yield")
+			return ErrTaskYielded
+		},
+	}
+	longTask.EXPECT().Priority().Return(2).AnyTimes()
+	longTask.EXPECT().Ack().Do(func() { close(doneCh) }).Times(1)
+
+	scheduler.Start()
+	defer scheduler.Stop()
+	s.NoError(scheduler.Submit(longTask))
+	<-startedCh
+
+	// the tasks fill the processor queue and the dispatcher, and then wait in their queue
+	for i := 0; i != 3; i++ {
+		mockTask := NewMockPriorityTask(s.controller)
+		mockTask.EXPECT().Priority().Return(0).AnyTimes()
+		mockTask.EXPECT().Execute().Do(func() { record("high") }).Return(nil).Times(1)
+		mockTask.EXPECT().Ack().Times(1)
+		s.NoError(scheduler.Submit(mockTask))
+	}
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		s.Fail("yielded task is not executed again")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	s.Equal([]string{"yield", "high", "high", "high", "long"}, executed)
+}